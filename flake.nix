@@ -40,6 +40,7 @@
             gopkgs
             godef
             golint
+            sqlc # Generates service/internal/repository/queries
             nodejs
             python3
             python3Packages.pip
@@ -46,6 +46,15 @@ export default async function FunctionDetailPage({
       { key: "STORAGE_BUCKET", value: "my-app-uploads" },
       { key: "IMAGE_QUALITY", value: "85" },
     ],
+    memoryRecommendation: {
+      p50PeakMb: 61,
+      p99PeakMb: 84,
+      maxPeakMb: 97,
+      limitMb: 512,
+      recommendedMb: 128,
+      samples: 1000,
+      auto: false,
+    },
   };
 
   return (
@@ -314,6 +323,56 @@ export default async function FunctionDetailPage({
                 </Button>
               </CardContent>
             </Card>
+
+            <Card>
+              <CardHeader>
+                <CardTitle>Memory</CardTitle>
+                <CardDescription>
+                  Peaks of the last{" "}
+                  {functionData.memoryRecommendation.samples} invocations
+                </CardDescription>
+              </CardHeader>
+              <CardContent className="space-y-4">
+                <div className="grid grid-cols-3 gap-2">
+                  <div>
+                    <h3 className="text-sm font-medium">p50</h3>
+                    <p className="text-sm text-muted-foreground">
+                      {functionData.memoryRecommendation.p50PeakMb}MB
+                    </p>
+                  </div>
+                  <div>
+                    <h3 className="text-sm font-medium">p99</h3>
+                    <p className="text-sm text-muted-foreground">
+                      {functionData.memoryRecommendation.p99PeakMb}MB
+                    </p>
+                  </div>
+                  <div>
+                    <h3 className="text-sm font-medium">Max</h3>
+                    <p className="text-sm text-muted-foreground">
+                      {functionData.memoryRecommendation.maxPeakMb}MB
+                    </p>
+                  </div>
+                </div>
+                <div>
+                  <h3 className="text-sm font-medium">Recommendation</h3>
+                  <p className="text-sm text-muted-foreground">
+                    p99 peak {functionData.memoryRecommendation.p99PeakMb}MB,
+                    limit {functionData.memoryRecommendation.limitMb}MB —
+                    consider {functionData.memoryRecommendation.recommendedMb}MB
+                  </p>
+                </div>
+                <div className="flex items-center justify-between">
+                  <Badge variant="outline">
+                    {functionData.memoryRecommendation.auto
+                      ? "Auto-applied"
+                      : "Manual"}
+                  </Badge>
+                  <Button variant="outline" size="sm">
+                    Apply {functionData.memoryRecommendation.recommendedMb}MB
+                  </Button>
+                </div>
+              </CardContent>
+            </Card>
           </div>
         </div>
       </div>
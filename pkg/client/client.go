@@ -0,0 +1,450 @@
+// Package client calls the Kappa service API from other Go services. Its
+// types and methods follow the operations and schemas of the service's
+// OpenAPI document, which the service serves at /openapi.json.
+package client
+
+import (
+	"bytes"
+	"context"
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// OpenAPI is the service API's OpenAPI 3 document.
+//
+//go:embed openapi.json
+var OpenAPI []byte
+
+// FunctionConfig is how a function is registered. Extra holds any other
+// fields of the service's config, like retry or transform, as JSON.
+type FunctionConfig struct {
+	Name           string   `json:"name"`
+	BinaryPath     string   `json:"binaryPath,omitempty"`
+	Image          string   `json:"image,omitempty"`
+	Port           int      `json:"port,omitempty"`
+	Project        string   `json:"project,omitempty"`
+	Environment    string   `json:"environment,omitempty"`
+	Mode           string   `json:"mode,omitempty"`
+	Backend        string   `json:"backend,omitempty"`
+	Priority       string   `json:"priority,omitempty"`
+	TimeoutMs      *int     `json:"timeoutMs,omitempty"`
+	TimeoutGraceMs int      `json:"timeoutGraceMs,omitempty"`
+	MemoryMB       *int     `json:"memoryMb,omitempty"`
+	IdleTimeoutMs  *int     `json:"idleTimeoutMs,omitempty"`
+	LogRetention   *int     `json:"logRetention,omitempty"`
+	ResultTTLMs    *int     `json:"resultTtlMs,omitempty"`
+	Env            []string `json:"env,omitempty"`
+	MaxConcurrency int      `json:"maxConcurrency,omitempty"`
+	QueueDepth     int      `json:"queueDepth,omitempty"`
+	Visibility     string   `json:"visibility,omitempty"`
+	// Disabled are windows the function turns invocations away in
+	Disabled []DisabledWindow `json:"disabled,omitempty"`
+	// LogLevel is the level the runtime logs at: debug, info, warn or error
+	LogLevel string `json:"logLevel,omitempty"`
+
+	Extra map[string]json.RawMessage `json:"-"`
+}
+
+// MarshalJSON writes the config's fields with its extra ones.
+func (c FunctionConfig) MarshalJSON() ([]byte, error) {
+	type plain FunctionConfig
+	data, err := json.Marshal(plain(c))
+	if err != nil || len(c.Extra) == 0 {
+		return data, err
+	}
+	fields := make(map[string]json.RawMessage, len(c.Extra))
+	for k, v := range c.Extra {
+		fields[k] = v
+	}
+	// The typed fields win over extra ones of the same name
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return nil, err
+	}
+	return json.Marshal(fields)
+}
+
+// UnmarshalJSON reads the config's fields, keeping the others in Extra.
+func (c *FunctionConfig) UnmarshalJSON(data []byte) error {
+	type plain FunctionConfig
+	if err := json.Unmarshal(data, (*plain)(c)); err != nil {
+		return err
+	}
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return err
+	}
+	for _, known := range configFields {
+		delete(fields, known)
+	}
+	c.Extra = nil
+	if len(fields) > 0 {
+		c.Extra = fields
+	}
+	return nil
+}
+
+// configFields are the JSON names of FunctionConfig's typed fields
+var configFields = []string{
+	"name", "binaryPath", "image", "port", "project", "environment", "mode", "backend", "priority",
+	"timeoutMs", "memoryMb", "idleTimeoutMs", "logRetention", "resultTtlMs", "env", "maxConcurrency", "queueDepth", "visibility",
+	"disabled",
+}
+
+// DisabledWindow is a period a function is disabled for, open-ended at
+// either end when unset.
+type DisabledWindow struct {
+	From    *time.Time `json:"from,omitempty"`
+	Until   *time.Time `json:"until,omitempty"`
+	Message string     `json:"message,omitempty"`
+}
+
+// FunctionSummary is a function as listed.
+type FunctionSummary struct {
+	Name              string     `json:"name"`
+	Project           string     `json:"project,omitempty"`
+	Image             string     `json:"image,omitempty"`
+	Port              int        `json:"port,omitempty"`
+	Mode              string     `json:"mode,omitempty"`
+	IsRunning         bool       `json:"isRunning"`
+	Visibility        string     `json:"visibility"`
+	Disabled          bool       `json:"disabled,omitempty"`
+	StartError        string     `json:"startError,omitempty"`
+	LastInvoked       *time.Time `json:"lastInvoked,omitempty"`
+	RequestsProcessed int64      `json:"requestsProcessed,omitempty"`
+}
+
+// FunctionQuery filters and pages listed functions. Status is running,
+// stopped, disabled or failing, and a Limit of 0 lists every function.
+type FunctionQuery struct {
+	Prefix string
+	Status string
+	Limit  int
+	Offset int
+}
+
+// FunctionPage is a page of listed functions, sorted by name. NextOffset is
+// where the next page starts, 0 on the last one.
+type FunctionPage struct {
+	Functions  []FunctionSummary `json:"functions"`
+	Total      int               `json:"total"`
+	NextOffset int               `json:"nextOffset,omitempty"`
+}
+
+// Registration is the outcome of registering or updating a function.
+type Registration struct {
+	Name    string `json:"name"`
+	Status  string `json:"status"`
+	SHA256  string `json:"sha256,omitempty"`
+	Version int    `json:"version,omitempty"`
+}
+
+// Response is a function's response to an invocation.
+type Response struct {
+	StatusCode int
+	Header     http.Header
+	Body       []byte
+	// Attempts is how many times the service invoked the function
+	Attempts int
+}
+
+// Job is an async invocation and, once it is over, its result.
+type Job struct {
+	ID          string            `json:"id"`
+	Function    string            `json:"function"`
+	Project     string            `json:"project,omitempty"`
+	Status      string            `json:"status"`
+	StatusCode  int               `json:"statusCode,omitempty"`
+	Headers     map[string]string `json:"headers,omitempty"`
+	Body        json.RawMessage   `json:"body,omitempty"`
+	Error       string            `json:"error,omitempty"`
+	CreatedAt   time.Time         `json:"createdAt"`
+	CompletedAt *time.Time        `json:"completedAt,omitempty"`
+	ExpiresAt   time.Time         `json:"expiresAt"`
+}
+
+// Finished reports whether the job succeeded or failed.
+func (j Job) Finished() bool {
+	return j.Status == "succeeded" || j.Status == "failed"
+}
+
+// Error is an error answered by the service rather than the function.
+type Error struct {
+	StatusCode int
+	Message    string
+	// Kind is the platform error an invocation failed with, like timeout
+	Kind string
+	// RetryAfter is how long the service asked callers to wait, when it did
+	RetryAfter time.Duration
+	// Partial is what an invocation that timed out had to show for
+	// itself, as its runtime reported it, and Logs are the function's
+	// latest log lines, sent to callers who may read them
+	Partial json.RawMessage
+	Logs    []string
+}
+
+func (e *Error) Error() string {
+	if e.Kind != "" {
+		return fmt.Sprintf("kappa: %d %s (%s)", e.StatusCode, e.Message, e.Kind)
+	}
+	return fmt.Sprintf("kappa: %d %s", e.StatusCode, e.Message)
+}
+
+// Client calls a Kappa service.
+type Client struct {
+	// BaseURL is where the service is, like http://localhost:8000
+	BaseURL string
+	// Token is sent as a bearer token when set
+	Token      string
+	HTTPClient *http.Client
+}
+
+// New creates a client of the service at baseURL, authenticating with
+// token when it isn't empty.
+func New(baseURL, token string) *Client {
+	return &Client{
+		BaseURL:    strings.TrimSuffix(baseURL, "/"),
+		Token:      token,
+		HTTPClient: http.DefaultClient,
+	}
+}
+
+// ListFunctions lists the functions the caller may read.
+func (c *Client) ListFunctions(ctx context.Context) ([]FunctionSummary, error) {
+	page, err := c.ListFunctionsPage(ctx, FunctionQuery{})
+	return page.Functions, err
+}
+
+// ListFunctionsPage lists a page of the functions the caller may read.
+func (c *Client) ListFunctionsPage(ctx context.Context, q FunctionQuery) (FunctionPage, error) {
+	params := url.Values{}
+	if q.Prefix != "" {
+		params.Set("prefix", q.Prefix)
+	}
+	if q.Status != "" {
+		params.Set("status", q.Status)
+	}
+	if q.Limit > 0 {
+		params.Set("limit", strconv.Itoa(q.Limit))
+	}
+	if q.Offset > 0 {
+		params.Set("offset", strconv.Itoa(q.Offset))
+	}
+	path := "/functions"
+	if len(params) > 0 {
+		path += "?" + params.Encode()
+	}
+	var out FunctionPage
+	err := c.call(ctx, http.MethodGet, path, nil, &out)
+	return out, err
+}
+
+// RegisterFunction registers a function.
+func (c *Client) RegisterFunction(ctx context.Context, config FunctionConfig) (Registration, error) {
+	var out Registration
+	err := c.call(ctx, http.MethodPost, "/functions", config, &out)
+	return out, err
+}
+
+// GetFunction returns a function's configuration.
+func (c *Client) GetFunction(ctx context.Context, name string) (FunctionConfig, error) {
+	var out FunctionConfig
+	err := c.call(ctx, http.MethodGet, "/functions/"+url.PathEscape(name), nil, &out)
+	return out, err
+}
+
+// UpdateFunction redeploys a function with a new configuration.
+func (c *Client) UpdateFunction(ctx context.Context, config FunctionConfig) (Registration, error) {
+	var out Registration
+	err := c.call(ctx, http.MethodPut, "/functions/"+url.PathEscape(config.Name), config, &out)
+	return out, err
+}
+
+// UploadFunctionCode registers or redeploys a function running uploaded
+// code instead of a binary on the service's host: a binary, or a zip
+// archive whose entry file is run, bootstrap when entry is empty. The
+// config's BinaryPath must be empty.
+func (c *Client) UploadFunctionCode(ctx context.Context, config FunctionConfig, code io.Reader, entry string) (Registration, error) {
+	configJSON, err := json.Marshal(config)
+	if err != nil {
+		return Registration{}, err
+	}
+	// The code is streamed rather than read into memory, binaries are big
+	body, pw := io.Pipe()
+	form := multipart.NewWriter(pw)
+	go func() {
+		err := form.WriteField("config", string(configJSON))
+		if err == nil && entry != "" {
+			err = form.WriteField("entry", entry)
+		}
+		if err == nil {
+			var part io.Writer
+			if part, err = form.CreateFormFile("code", "code"); err == nil {
+				_, err = io.Copy(part, code)
+			}
+		}
+		if err == nil {
+			err = form.Close()
+		}
+		pw.CloseWithError(err)
+	}()
+
+	path := "/functions/" + url.PathEscape(config.Name) + "/code"
+	resp, err := c.send(ctx, http.MethodPost, path, body, form.FormDataContentType())
+	if err != nil {
+		body.Close()
+		return Registration{}, err
+	}
+	var out Registration
+	err = decode(resp, http.MethodPost, path, &out)
+	return out, err
+}
+
+// DeleteFunction deletes a function.
+func (c *Client) DeleteFunction(ctx context.Context, name string) error {
+	return c.call(ctx, http.MethodDelete, "/functions/"+url.PathEscape(name), nil, nil)
+}
+
+// GetFunctionLogs returns a function's recent log lines, oldest first.
+func (c *Client) GetFunctionLogs(ctx context.Context, name string) ([]string, error) {
+	var out struct {
+		Logs []string `json:"logs"`
+	}
+	err := c.call(ctx, http.MethodGet, "/functions/"+url.PathEscape(name)+"/logs", nil, &out)
+	return out.Logs, err
+}
+
+// InvokeFunction invokes a function with body, encoded as JSON, and returns
+// its response. Responses the function answered, whatever their status,
+// are returned as is; only errors of the service are returned as *Error.
+func (c *Client) InvokeFunction(ctx context.Context, name string, body any) (*Response, error) {
+	resp, err := c.do(ctx, http.MethodPost, "/functions/"+url.PathEscape(name), eventBody(body))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.Header.Get("X-Kappa-Error") != "" || (resp.StatusCode >= 400 && resp.Header.Get("X-Kappa-Attempts") == "") {
+		return nil, apiError(resp, data)
+	}
+	out := &Response{StatusCode: resp.StatusCode, Header: resp.Header, Body: data}
+	fmt.Sscan(resp.Header.Get("X-Kappa-Attempts"), &out.Attempts)
+	return out, nil
+}
+
+// InvokeFunctionAsync queues an invocation of a function with body and
+// returns the job to poll with GetJob.
+func (c *Client) InvokeFunctionAsync(ctx context.Context, name string, body any) (Job, error) {
+	var out Job
+	err := c.call(ctx, http.MethodPost, "/functions/"+url.PathEscape(name)+"/invoke-async", eventBody(body), &out)
+	return out, err
+}
+
+// GetJob returns an async invocation's status and, once it is over, its
+// result.
+func (c *Client) GetJob(ctx context.Context, id string) (Job, error) {
+	var out Job
+	err := c.call(ctx, http.MethodGet, "/jobs/"+url.PathEscape(id), nil, &out)
+	return out, err
+}
+
+// eventBody is what is sent for an event's body, JSON null for none as the
+// service needs a body to decode
+func eventBody(body any) any {
+	if body == nil {
+		return json.RawMessage("null")
+	}
+	return body
+}
+
+// call sends a request, decoding a successful response into out when it
+// isn't nil.
+func (c *Client) call(ctx context.Context, method, path string, in, out any) error {
+	resp, err := c.do(ctx, method, path, in)
+	if err != nil {
+		return err
+	}
+	return decode(resp, method, path, out)
+}
+
+// decode decodes a successful response into out when it isn't nil, and
+// returns the service's error otherwise.
+func decode(resp *http.Response, method, path string, out any) error {
+	defer resp.Body.Close()
+	if resp.StatusCode >= 400 {
+		data, _ := io.ReadAll(resp.Body)
+		return apiError(resp, data)
+	}
+	if out == nil {
+		return nil
+	}
+	if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+		return fmt.Errorf("kappa: invalid response to %s %s: %w", method, path, err)
+	}
+	return nil
+}
+
+func (c *Client) do(ctx context.Context, method, path string, in any) (*http.Response, error) {
+	if in == nil {
+		return c.send(ctx, method, path, nil, "")
+	}
+	data, err := json.Marshal(in)
+	if err != nil {
+		return nil, err
+	}
+	return c.send(ctx, method, path, bytes.NewReader(data), "application/json")
+}
+
+// send sends a request with body of contentType, which is left unset when
+// empty.
+func (c *Client) send(ctx context.Context, method, path string, body io.Reader, contentType string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, method, c.BaseURL+path, body)
+	if err != nil {
+		return nil, err
+	}
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	if c.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.Token)
+	}
+	httpClient := c.HTTPClient
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+	return httpClient.Do(req)
+}
+
+func apiError(resp *http.Response, body []byte) *Error {
+	e := &Error{
+		StatusCode: resp.StatusCode,
+		Message:    strings.TrimSpace(string(body)),
+		Kind:       resp.Header.Get("X-Kappa-Error"),
+	}
+	var seconds int
+	if _, err := fmt.Sscan(resp.Header.Get("Retry-After"), &seconds); err == nil {
+		e.RetryAfter = time.Duration(seconds) * time.Second
+	}
+	// Timeouts are described as JSON unless the function has a page for them
+	if e.Kind == "timeout" && strings.HasPrefix(resp.Header.Get("Content-Type"), "application/json") {
+		var timeout struct {
+			Error   string          `json:"error"`
+			Partial json.RawMessage `json:"partial"`
+			Logs    []string        `json:"logs"`
+		}
+		if err := json.Unmarshal(body, &timeout); err == nil && timeout.Error != "" {
+			e.Message, e.Partial, e.Logs = timeout.Error, timeout.Partial, timeout.Logs
+		}
+	}
+	return e
+}
@@ -0,0 +1,151 @@
+package client
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestOpenAPI_OperationsHaveMethods(t *testing.T) {
+	var spec struct {
+		OpenAPI string                                `json:"openapi"`
+		Paths   map[string]map[string]json.RawMessage `json:"paths"`
+	}
+	require.NoError(t, json.Unmarshal(OpenAPI, &spec))
+	assert.True(t, strings.HasPrefix(spec.OpenAPI, "3."))
+
+	client := reflect.TypeOf(&Client{})
+	for path, operations := range spec.Paths {
+		for method, operation := range operations {
+			var op struct {
+				OperationID string `json:"operationId"`
+			}
+			if method == "parameters" || json.Unmarshal(operation, &op) != nil || op.OperationID == "getOpenAPI" {
+				// Path parameters and the document itself
+				continue
+			}
+			id := op.OperationID
+			name := strings.ToUpper(id[:1]) + id[1:]
+			_, exists := client.MethodByName(name)
+			assert.True(t, exists, "%s %s has no client method %s", method, path, name)
+		}
+	}
+}
+
+func TestClient(t *testing.T) {
+	var registered FunctionConfig
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer secret" {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		switch r.Method + " " + r.URL.Path {
+		case "POST /functions":
+			require.NoError(t, json.NewDecoder(r.Body).Decode(&registered))
+			w.WriteHeader(http.StatusCreated)
+			json.NewEncoder(w).Encode(map[string]string{"name": registered.Name, "status": "registered"})
+		case "POST /functions/uploaded/code":
+			require.NoError(t, r.ParseMultipartForm(1<<20))
+			assert.JSONEq(t, `{"name":"uploaded","image":"alpine"}`, r.FormValue("config"))
+			assert.Equal(t, "bin/app", r.FormValue("entry"))
+			file, _, err := r.FormFile("code")
+			require.NoError(t, err)
+			code, _ := io.ReadAll(file)
+			w.WriteHeader(http.StatusCreated)
+			json.NewEncoder(w).Encode(map[string]any{"name": "uploaded", "status": "registered", "sha256": fmt.Sprintf("%x", sha256.Sum256(code)), "version": 1})
+		case "POST /functions/hello":
+			body, _ := io.ReadAll(r.Body)
+			w.Header().Set("X-Kappa-Attempts", "1")
+			w.WriteHeader(http.StatusTeapot)
+			w.Write(body)
+		case "POST /functions/busy":
+			w.Header().Set("X-Kappa-Error", "concurrencyLimit")
+			w.Header().Set("Retry-After", "1")
+			http.Error(w, "Function invocation failed", http.StatusTooManyRequests)
+		case "POST /functions/slow":
+			w.Header().Set("X-Kappa-Error", "timeout")
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte(`{"error":"Function invocation failed: deadline exceeded","kind":"timeout","partial":{"partial":{"rows":40}},"logs":["fetching page 3"]}`))
+		case "GET /functions":
+			assert.Equal(t, "limit=1&offset=2&prefix=he&status=running", r.URL.RawQuery)
+			json.NewEncoder(w).Encode(map[string]any{"functions": []map[string]any{{"name": "hello", "requestsProcessed": 3}}, "total": 4, "nextOffset": 3})
+		case "GET /functions/hello/logs":
+			json.NewEncoder(w).Encode(map[string]any{"name": "hello", "logs": []string{"started"}})
+		default:
+			http.Error(w, "Function not found", http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+	ctx := context.Background()
+	c := New(server.URL+"/", "secret")
+
+	timeout := 5000
+	reg, err := c.RegisterFunction(ctx, FunctionConfig{
+		Name:       "hello",
+		BinaryPath: "/bin/hello",
+		TimeoutMs:  &timeout,
+		Extra:      map[string]json.RawMessage{"retry": json.RawMessage(`{"maxAttempts":3}`)},
+	})
+	require.NoError(t, err)
+	assert.Equal(t, "registered", reg.Status)
+	assert.Equal(t, "/bin/hello", registered.BinaryPath)
+	assert.Equal(t, 5000, *registered.TimeoutMs)
+	assert.JSONEq(t, `{"maxAttempts":3}`, string(registered.Extra["retry"]), "fields the client doesn't know are passed on")
+
+	reg, err = c.UploadFunctionCode(ctx, FunctionConfig{Name: "uploaded", Image: "alpine"}, strings.NewReader("archive"), "bin/app")
+	require.NoError(t, err)
+	assert.Equal(t, fmt.Sprintf("%x", sha256.Sum256([]byte("archive"))), reg.SHA256)
+	assert.Equal(t, 1, reg.Version)
+
+	// The function's own errors are its response, the service's are errors
+	resp, err := c.InvokeFunction(ctx, "hello", map[string]string{"who": "world"})
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusTeapot, resp.StatusCode)
+	assert.JSONEq(t, `{"who":"world"}`, string(resp.Body))
+	assert.Equal(t, 1, resp.Attempts)
+
+	_, err = c.InvokeFunction(ctx, "busy", nil)
+	var apiErr *Error
+	require.ErrorAs(t, err, &apiErr)
+	assert.Equal(t, http.StatusTooManyRequests, apiErr.StatusCode)
+	assert.Equal(t, "concurrencyLimit", apiErr.Kind)
+	assert.Equal(t, time.Second, apiErr.RetryAfter)
+
+	_, err = c.InvokeFunction(ctx, "slow", nil)
+	require.ErrorAs(t, err, &apiErr)
+	assert.Equal(t, "timeout", apiErr.Kind)
+	assert.Equal(t, "Function invocation failed: deadline exceeded", apiErr.Message)
+	assert.JSONEq(t, `{"partial":{"rows":40}}`, string(apiErr.Partial))
+	assert.Equal(t, []string{"fetching page 3"}, apiErr.Logs)
+
+	page, err := c.ListFunctionsPage(ctx, FunctionQuery{Prefix: "he", Status: "running", Limit: 1, Offset: 2})
+	require.NoError(t, err)
+	require.Len(t, page.Functions, 1)
+	assert.Equal(t, int64(3), page.Functions[0].RequestsProcessed)
+	assert.Equal(t, 4, page.Total)
+	assert.Equal(t, 3, page.NextOffset)
+
+	logs, err := c.GetFunctionLogs(ctx, "hello")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"started"}, logs)
+
+	err = c.DeleteFunction(ctx, "missing")
+	require.ErrorAs(t, err, &apiErr)
+	assert.Equal(t, http.StatusNotFound, apiErr.StatusCode)
+
+	_, err = New(server.URL, "wrong").ListFunctions(ctx)
+	require.ErrorAs(t, err, &apiErr)
+	assert.Equal(t, http.StatusUnauthorized, apiErr.StatusCode)
+}
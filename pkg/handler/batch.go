@@ -0,0 +1,43 @@
+package handler
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+)
+
+// BatchItem is one of the events of a batch, which webhook triggers with a
+// batch window deliver as the event body's items.
+type BatchItem struct {
+	ID   string          `json:"id"`
+	Body json.RawMessage `json:"body"`
+	// Attempt counts the times the item was delivered, from 1
+	Attempt int `json:"attempt"`
+}
+
+// BatchItems returns the items of a batched event.
+func BatchItems(event Event) ([]BatchItem, error) {
+	raw, exists := event.Body["items"]
+	if !exists {
+		return nil, fmt.Errorf("the event isn't a batch")
+	}
+	encoded, err := json.Marshal(raw)
+	if err != nil {
+		return nil, err
+	}
+	var items []BatchItem
+	if err := json.Unmarshal(encoded, &items); err != nil {
+		return nil, fmt.Errorf("invalid batch: %w", err)
+	}
+	return items, nil
+}
+
+// BatchResponse answers a batch, reporting the IDs of the items that
+// failed. Only those are delivered again, the rest of the batch is done.
+// Failing the whole batch, with a 4xx or 5xx response, retries every item.
+func BatchResponse(failed []string, requestID string) Response {
+	if failed == nil {
+		failed = []string{}
+	}
+	return NewResponse(http.StatusOK, map[string]any{"failedItems": failed}, requestID)
+}
@@ -0,0 +1,29 @@
+package handler
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBatchItems(t *testing.T) {
+	var event Event
+	require.NoError(t, json.Unmarshal([]byte(`{"body":{"items":[{"id":"a","body":{"n":1},"attempt":1},{"id":"b","body":"x","attempt":2}]}}`), &event))
+	items, err := BatchItems(event)
+	require.NoError(t, err)
+	require.Len(t, items, 2)
+	assert.Equal(t, "a", items[0].ID)
+	assert.JSONEq(t, `{"n":1}`, string(items[0].Body))
+	assert.Equal(t, 2, items[1].Attempt)
+
+	_, err = BatchItems(Event{Body: map[string]any{"n": 1}})
+	assert.Error(t, err)
+
+	resp := BatchResponse([]string{"b"}, "req-1")
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, map[string]any{"failedItems": []string{"b"}}, resp.Body)
+	assert.Equal(t, map[string]any{"failedItems": []string{}}, BatchResponse(nil, "req-1").Body)
+}
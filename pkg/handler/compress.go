@@ -0,0 +1,140 @@
+package handler
+
+import (
+	"compress/gzip"
+	"log"
+	"net/http"
+	"strings"
+)
+
+// HeaderAcceptEncoding on responses lists the encodings the runtime reads
+// events in, so the service only compresses events for runtimes that can
+// read them
+const HeaderAcceptEncoding = "Kappa-Accept-Encoding"
+
+// withCompression reads gzipped events and gzips responses of at least
+// minBytes when the service accepts it, leaving both as they are when
+// minBytes is 0.
+func withCompression(next http.HandlerFunc, minBytes int) http.HandlerFunc {
+	if minBytes <= 0 {
+		return next
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Content-Encoding") == "gzip" {
+			body, err := gzip.NewReader(r.Body)
+			if err != nil {
+				log.Printf("Error reading gzipped request body: %v", err)
+				http.Error(w, "Invalid gzipped request body", http.StatusBadRequest)
+				return
+			}
+			defer body.Close()
+			r.Body = body
+			r.Header.Del("Content-Encoding")
+			r.ContentLength = -1
+		}
+		w.Header().Set(HeaderAcceptEncoding, "gzip")
+
+		if !acceptsGzip(r) {
+			next(w, r)
+			return
+		}
+		cw := &compressWriter{ResponseWriter: w, minBytes: minBytes, status: http.StatusOK}
+		next(cw, r)
+		if err := cw.close(); err != nil {
+			log.Printf("Error writing gzipped response: %v", err)
+		}
+	}
+}
+
+// acceptsGzip reports whether the request's Accept-Encoding lists gzip.
+func acceptsGzip(r *http.Request) bool {
+	for _, encoding := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+		name, _, _ := strings.Cut(strings.TrimSpace(encoding), ";")
+		if name == "gzip" {
+			return true
+		}
+	}
+	return false
+}
+
+// compressWriter holds the response back until it has minBytes of body,
+// then streams it gzipped. Smaller responses are written as they are once
+// the handler is done.
+type compressWriter struct {
+	http.ResponseWriter
+	minBytes int
+	status   int
+	buf      []byte
+	gz       *gzip.Writer
+	// plain is set once the response is written without compressing
+	plain bool
+}
+
+func (cw *compressWriter) WriteHeader(status int) {
+	cw.status = status
+	// Streams are passed on as they are written, holding them back to
+	// compress would defeat them
+	if cw.Header().Get(HeaderResponseStream) != "" {
+		cw.writePlain()
+	}
+}
+
+// Unwrap lets streamed responses be flushed through to the connection
+func (cw *compressWriter) Unwrap() http.ResponseWriter {
+	return cw.ResponseWriter
+}
+
+func (cw *compressWriter) Write(p []byte) (int, error) {
+	switch {
+	case cw.gz != nil:
+		return cw.gz.Write(p)
+	case cw.plain:
+		return cw.ResponseWriter.Write(p)
+	}
+	cw.buf = append(cw.buf, p...)
+	if len(cw.buf) < cw.minBytes {
+		return len(p), nil
+	}
+
+	// Handlers encoding their own body are left to it
+	h := cw.Header()
+	if h.Get("Content-Encoding") != "" {
+		if err := cw.writePlain(); err != nil {
+			return 0, err
+		}
+		return len(p), nil
+	}
+	h.Set("Content-Encoding", "gzip")
+	h.Del("Content-Length")
+	h.Add("Vary", "Accept-Encoding")
+	cw.ResponseWriter.WriteHeader(cw.status)
+	// Favour latency over ratio, the hop is local
+	cw.gz, _ = gzip.NewWriterLevel(cw.ResponseWriter, gzip.BestSpeed)
+	buf := cw.buf
+	cw.buf = nil
+	if _, err := cw.gz.Write(buf); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// writePlain writes the status and what is held back as they are
+func (cw *compressWriter) writePlain() error {
+	cw.plain = true
+	cw.ResponseWriter.WriteHeader(cw.status)
+	buf := cw.buf
+	cw.buf = nil
+	_, err := cw.ResponseWriter.Write(buf)
+	return err
+}
+
+// close finishes the response once the handler is done.
+func (cw *compressWriter) close() error {
+	switch {
+	case cw.gz != nil:
+		return cw.gz.Close()
+	case cw.plain:
+		return nil
+	}
+	return cw.writePlain()
+}
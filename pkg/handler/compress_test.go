@@ -0,0 +1,72 @@
+package handler
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func gzipped(t *testing.T, data []byte) []byte {
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	_, err := gz.Write(data)
+	require.NoError(t, err)
+	require.NoError(t, gz.Close())
+	return buf.Bytes()
+}
+
+func TestWithCompression(t *testing.T) {
+	echo := func(event Event) Response {
+		return NewResponse(http.StatusCreated, event.Body, event.RequestID)
+	}
+	h := withCompression(createInvocationHandler(echo), 1024)
+	large := strings.Repeat("kappa", 1000)
+	event, err := json.Marshal(Event{Body: map[string]any{"data": large}, RequestID: "req-1"})
+	require.NoError(t, err)
+
+	// A gzipped event is read, and the large response gzipped back
+	req := httptest.NewRequest(http.MethodPost, "/", bytes.NewReader(gzipped(t, event)))
+	req.Header.Set("Content-Encoding", "gzip")
+	req.Header.Set("Accept-Encoding", "gzip")
+	rec := httptest.NewRecorder()
+	h(rec, req)
+	assert.Equal(t, http.StatusCreated, rec.Code)
+	assert.Equal(t, "gzip", rec.Header().Get(HeaderAcceptEncoding))
+	assert.Equal(t, "gzip", rec.Header().Get("Content-Encoding"))
+	assert.Less(t, rec.Body.Len(), len(large))
+	gz, err := gzip.NewReader(rec.Body)
+	require.NoError(t, err)
+	body, err := io.ReadAll(gz)
+	require.NoError(t, err)
+	assert.JSONEq(t, `{"data":"`+large+`"}`, string(body))
+
+	// Small responses, and those to callers not accepting gzip, are plain
+	small, _ := json.Marshal(Event{Body: map[string]any{"data": "small"}})
+	req = httptest.NewRequest(http.MethodPost, "/", bytes.NewReader(small))
+	req.Header.Set("Accept-Encoding", "gzip")
+	rec = httptest.NewRecorder()
+	h(rec, req)
+	assert.Equal(t, http.StatusCreated, rec.Code)
+	assert.Empty(t, rec.Header().Get("Content-Encoding"))
+	assert.JSONEq(t, `{"data":"small"}`, rec.Body.String())
+
+	rec = httptest.NewRecorder()
+	h(rec, httptest.NewRequest(http.MethodPost, "/", bytes.NewReader(event)))
+	assert.Empty(t, rec.Header().Get("Content-Encoding"))
+	assert.JSONEq(t, `{"data":"`+large+`"}`, rec.Body.String())
+
+	// A body that isn't gzip is rejected
+	req = httptest.NewRequest(http.MethodPost, "/", strings.NewReader("not gzip"))
+	req.Header.Set("Content-Encoding", "gzip")
+	rec = httptest.NewRecorder()
+	h(rec, req)
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+}
@@ -1,10 +1,36 @@
 package handler
 
 import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
 	"encoding/json"
 	"log"
 	"net/http"
 	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+)
+
+const (
+	// HeaderRequestID carries the invocation's request ID on the response
+	HeaderRequestID = "Kappa-Request-Id"
+	// HeaderResponseFormat tells the service how the response is encoded.
+	// "raw" means the HTTP status, headers and body are the handler's own,
+	// without it the service expects a JSON encoded Response envelope.
+	HeaderResponseFormat = "Kappa-Response-Format"
+	ResponseFormatRaw    = "raw"
+
+	// EnvTLSCertFile and EnvTLSKeyFile are injected by the service when the
+	// runtime should serve HTTPS instead of plain HTTP
+	EnvTLSCertFile = "KAPPA_TLS_CERT_FILE"
+	EnvTLSKeyFile  = "KAPPA_TLS_KEY_FILE"
+
+	// EnvCallerToken is injected by the service when it requires
+	// credentials, for the function to invoke other functions with as a
+	// bearer token
+	EnvCallerToken = "KAPPA_CALLER_TOKEN"
 )
 
 // Response is the Kappa function response structure
@@ -23,26 +49,68 @@ type Event struct {
 	Headers     map[string]string `json:"headers"`
 	QueryParams map[string]string `json:"queryParams"`
 	RequestID   string            `json:"requestId"`
+	// PathParams are the parameters of the service route the event came in
+	// on, like id for GET /users/{id}
+	PathParams map[string]string `json:"pathParams,omitempty"`
 }
 
 // Handler is a function type that processes a Kappa event and returns a response
 type Handler func(Event) Response
 
-// Start initializes the Kappa function server with the provided handler
+// Start initializes the Kappa function server with the provided handler. On
+// SIGTERM or SIGINT it stops accepting connections and lets the requests in
+// flight finish before returning.
 func Start(handler Handler) {
 	// Get the port from environment variables (injected by the kappa system)
 	port := os.Getenv("PORT")
 	if port == "" {
 		port = "8080" // Default port
 	}
+	certFile, keyFile := os.Getenv(EnvTLSCertFile), os.Getenv(EnvTLSKeyFile)
+	tls := certFile != "" && keyFile != ""
+	config := ServerConfigFromEnv()
+	logLevelFromEnv()
 
 	// Create a closure around the handler function
-	http.HandleFunc("/2015-03-31/functions/function/invocations", createInvocationHandler(handler))
+	http.HandleFunc("/2015-03-31/functions/function/invocations", withCompression(createInvocationHandler(handler), config.CompressMinBytes))
 	http.HandleFunc("/health", handleHealth)
+	http.HandleFunc("/runtime/info", handleRuntimeInfo(config, port, tls))
+	http.HandleFunc(LogLevelPath, handleLogLevel)
+	http.HandleFunc(TimeoutPath, handleTimeout)
+
+	server := config.server(":"+port, http.DefaultServeMux)
+	listener, err := config.listen(server.Addr)
+	if err != nil {
+		log.Fatal(err)
+	}
 
-	// Print startup message
-	log.Printf("Kappa function starting on port %s", port)
-	log.Fatal(http.ListenAndServe(":"+port, nil))
+	drained := make(chan struct{})
+	go func() {
+		defer close(drained)
+		stop := make(chan os.Signal, 1)
+		signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
+		<-stop
+		log.Printf("Kappa function draining for up to %s", config.DrainTimeout)
+		ctx, cancel := context.WithTimeout(context.Background(), config.DrainTimeout)
+		defer cancel()
+		if err := server.Shutdown(ctx); err != nil {
+			log.Printf("Kappa function stopped before draining: %v", err)
+		}
+	}()
+
+	// Serve over TLS if the service mounted a certificate for us
+	if tls {
+		log.Printf("Kappa function starting on port %s (tls)", port)
+		err = server.ServeTLS(listener, certFile, keyFile)
+	} else {
+		// Print startup message
+		log.Printf("Kappa function starting on port %s", port)
+		err = server.Serve(listener)
+	}
+	if err != http.ErrServerClosed {
+		log.Fatal(err)
+	}
+	<-drained
 }
 
 // createInvocationHandler returns an http.HandlerFunc that processes Kappa invocations
@@ -54,15 +122,6 @@ func createInvocationHandler(handler Handler) http.HandlerFunc {
 			return
 		}
 
-		// Extract request ID from headers or generate a new one
-		requestID := r.Header.Get("Kappa-Runtime-Aws-Request-Id")
-		if requestID == "" {
-			requestID = "req-" + r.Header.Get("X-Request-Id")
-		}
-
-		// Log the received request
-		log.Printf("REQUEST: %s %s", requestID, r.URL.Path)
-
 		// Parse the incoming event
 		var event Event
 		err := json.NewDecoder(r.Body).Decode(&event)
@@ -75,26 +134,95 @@ func createInvocationHandler(handler Handler) http.HandlerFunc {
 			return
 		}
 
-		// Set the request ID if not already in the event
-		if event.RequestID == "" {
-			event.RequestID = requestID
+		// The service puts the request ID in the event, fall back to the
+		// headers and then a fresh one
+		requestID := event.RequestID
+		for _, header := range []string{"Kappa-Runtime-Aws-Request-Id", "X-Request-Id"} {
+			if requestID == "" {
+				requestID = r.Header.Get(header)
+			}
 		}
+		if requestID == "" {
+			requestID = newRequestID()
+		}
+		event.RequestID = requestID
 
-		// Call the handler function
-		response := handler(event)
+		// Log the received request
+		log.Printf("REQUEST: %s %s", requestID, r.URL.Path)
 
-		// Set the content type to JSON
-		w.Header().Set("Content-Type", "application/json")
+		// Call the handler function, tracked in case the service gives up
+		// on it and asks for what it has
+		done := track(requestID)
+		response := callHandler(handler, event)
+		done(response)
 
-		// Send the response
-		w.WriteHeader(http.StatusOK)
-		json.NewEncoder(w).Encode(response)
+		writeResponse(w, response, event.RequestID)
 
 		// Log the response
 		log.Printf("RESPONSE: %s %d", requestID, response.StatusCode)
 	}
 }
 
+// writeResponse writes the handler's response as a plain HTTP response, using
+// its status code and headers directly rather than wrapping it in JSON.
+func writeResponse(w http.ResponseWriter, response Response, requestID string) {
+	for key, value := range response.Headers {
+		w.Header().Set(key, value)
+	}
+	stream, streamed := response.Body.(Stream)
+	contentType := w.Header().Get("Content-Type")
+	if contentType == "" {
+		contentType = "application/json"
+		if streamed {
+			contentType = "application/octet-stream"
+		}
+		w.Header().Set("Content-Type", contentType)
+	}
+	if streamed {
+		w.Header().Set(HeaderResponseStream, "true")
+	}
+
+	if response.RequestID != "" {
+		requestID = response.RequestID
+	}
+	w.Header().Set(HeaderRequestID, requestID)
+	w.Header().Set(HeaderResponseFormat, ResponseFormatRaw)
+
+	statusCode := response.StatusCode
+	if statusCode == 0 {
+		statusCode = http.StatusOK
+	}
+	w.WriteHeader(statusCode)
+
+	if streamed {
+		writeStream(w, stream, requestID)
+		return
+	}
+
+	// Non JSON bodies given as text or bytes are written as is
+	if !strings.Contains(contentType, "json") {
+		switch body := response.Body.(type) {
+		case string:
+			w.Write([]byte(body))
+			return
+		case []byte:
+			w.Write(body)
+			return
+		}
+	}
+
+	if response.Body != nil {
+		json.NewEncoder(w).Encode(response.Body)
+	}
+}
+
+// newRequestID makes a random ID for invocations that arrive without one.
+func newRequestID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
 // Health check endpoint
 func handleHealth(w http.ResponseWriter, r *http.Request) {
 	w.WriteHeader(http.StatusOK)
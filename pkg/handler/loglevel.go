@@ -0,0 +1,96 @@
+package handler
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+)
+
+const (
+	// EnvLogLevel is the level the runtime logs at when it starts, one of
+	// debug, info, warn or error. The service changes it afterwards through
+	// LogLevelPath, without restarting the runtime.
+	EnvLogLevel = "KAPPA_LOG_LEVEL"
+	// LogLevelPath is the runtime's control endpoint for its log level,
+	// GET reads it and PUT {"level": "debug"} changes it
+	LogLevelPath = "/runtime/log-level"
+)
+
+var logLevel = new(slog.LevelVar)
+
+// Logger is the runtime's leveled logger, writing to stderr. Handlers log
+// with it what should only show at some levels, like debug output, which
+// the service turns on and off without a redeploy.
+var Logger = slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: logLevel}))
+
+var logLevels = map[string]slog.Level{
+	"debug": slog.LevelDebug,
+	"info":  slog.LevelInfo,
+	"warn":  slog.LevelWarn,
+	"error": slog.LevelError,
+}
+
+// ParseLogLevel parses a level named debug, info, warn or error.
+func ParseLogLevel(name string) (slog.Level, error) {
+	level, ok := logLevels[strings.ToLower(name)]
+	if !ok {
+		return 0, fmt.Errorf("unknown log level %q, expected debug, info, warn or error", name)
+	}
+	return level, nil
+}
+
+func logLevelName(level slog.Level) string {
+	return strings.ToLower(level.String())
+}
+
+// logLevelFromEnv sets the level from EnvLogLevel, keeping info if it's
+// unset or invalid
+func logLevelFromEnv() {
+	v := os.Getenv(EnvLogLevel)
+	if v == "" {
+		return
+	}
+	level, err := ParseLogLevel(v)
+	if err != nil {
+		log.Printf("Ignoring invalid %s: %s", EnvLogLevel, v)
+		return
+	}
+	logLevel.Set(level)
+}
+
+type logLevelBody struct {
+	Level string `json:"level"`
+}
+
+// handleLogLevel reads or changes the level Logger logs at
+func handleLogLevel(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPut, http.MethodPost:
+		var body logLevelBody
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			http.Error(w, fmt.Sprintf("Invalid request: %v", err), http.StatusBadRequest)
+			return
+		}
+		level, err := ParseLogLevel(body.Level)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if level != logLevel.Level() {
+			log.Printf("Log level changed from %s to %s", logLevelName(logLevel.Level()), logLevelName(level))
+		}
+		logLevel.Set(level)
+	default:
+		w.Header().Set("Allow", "GET, PUT, POST")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(logLevelBody{Level: logLevelName(logLevel.Level())})
+}
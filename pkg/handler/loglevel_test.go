@@ -0,0 +1,42 @@
+package handler
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHandleLogLevel(t *testing.T) {
+	t.Cleanup(func() { logLevel.Set(slog.LevelInfo) })
+
+	t.Setenv(EnvLogLevel, "loud")
+	logLevelFromEnv()
+	assert.Equal(t, slog.LevelInfo, logLevel.Level(), "invalid levels are ignored")
+	t.Setenv(EnvLogLevel, "warn")
+	logLevelFromEnv()
+	assert.Equal(t, slog.LevelWarn, logLevel.Level())
+
+	rr := httptest.NewRecorder()
+	handleLogLevel(rr, httptest.NewRequest(http.MethodGet, LogLevelPath, nil))
+	assert.JSONEq(t, `{"level":"warn"}`, rr.Body.String())
+
+	rr = httptest.NewRecorder()
+	handleLogLevel(rr, httptest.NewRequest(http.MethodPut, LogLevelPath, strings.NewReader(`{"level":"DEBUG"}`)))
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.JSONEq(t, `{"level":"debug"}`, rr.Body.String())
+	assert.True(t, Logger.Enabled(context.Background(), slog.LevelDebug))
+
+	rr = httptest.NewRecorder()
+	handleLogLevel(rr, httptest.NewRequest(http.MethodPut, LogLevelPath, strings.NewReader(`{"level":"trace"}`)))
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+	assert.Equal(t, slog.LevelDebug, logLevel.Level())
+
+	rr = httptest.NewRecorder()
+	handleLogLevel(rr, httptest.NewRequest(http.MethodDelete, LogLevelPath, nil))
+	assert.Equal(t, http.StatusMethodNotAllowed, rr.Code)
+}
@@ -0,0 +1,42 @@
+package handler
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"runtime/debug"
+)
+
+// HeaderHandlerPanic marks the 500 a runtime answers with when its handler
+// panicked, its body the Panic, for the service to report and keep from the
+// caller.
+const HeaderHandlerPanic = "Kappa-Handler-Panic"
+
+// Panic is what a handler panicked with and where.
+type Panic struct {
+	Message string `json:"message"`
+	Stack   string `json:"stack"`
+}
+
+// callHandler calls handler with event, answering a panic with a 500
+// describing it rather than dropping the connection.
+func callHandler(handler Handler, event Event) (response Response) {
+	defer func() {
+		v := recover()
+		if v == nil {
+			return
+		}
+		p := Panic{Message: fmt.Sprint(v), Stack: string(debug.Stack())}
+		log.Printf("PANIC: %s %s\n%s", event.RequestID, p.Message, p.Stack)
+		response = Response{
+			StatusCode: http.StatusInternalServerError,
+			Headers: map[string]string{
+				"Content-Type":     "application/json",
+				HeaderHandlerPanic: "true",
+			},
+			Body:      p,
+			RequestID: event.RequestID,
+		}
+	}()
+	return handler(event)
+}
@@ -0,0 +1,33 @@
+package handler
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCreateInvocationHandler_Panic(t *testing.T) {
+	h := createInvocationHandler(func(Event) Response {
+		var m map[string]int
+		m["boom"]++
+		return NewResponse(http.StatusOK, nil, "")
+	})
+	event, err := json.Marshal(Event{RequestID: "req-1"})
+	require.NoError(t, err)
+
+	rec := httptest.NewRecorder()
+	h(rec, httptest.NewRequest(http.MethodPost, "/", bytes.NewReader(event)))
+	assert.Equal(t, http.StatusInternalServerError, rec.Code)
+	assert.Equal(t, "true", rec.Header().Get(HeaderHandlerPanic))
+	assert.Equal(t, "req-1", rec.Header().Get(HeaderRequestID))
+
+	var p Panic
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &p))
+	assert.Equal(t, "assignment to entry in nil map", p.Message)
+	assert.Contains(t, p.Stack, "panic_test.go")
+}
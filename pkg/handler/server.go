@@ -0,0 +1,204 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"runtime"
+	"strconv"
+	"time"
+)
+
+// The service injects these to tune the runtime's HTTP server, durations
+// are in milliseconds
+const (
+	EnvReadHeaderTimeout = "KAPPA_HTTP_READ_HEADER_TIMEOUT_MS"
+	EnvReadTimeout       = "KAPPA_HTTP_READ_TIMEOUT_MS"
+	EnvWriteTimeout      = "KAPPA_HTTP_WRITE_TIMEOUT_MS"
+	// EnvIdleTimeout is how long a kept-alive connection waits for its next
+	// request, it should outlast the service's idle connections
+	EnvIdleTimeout    = "KAPPA_HTTP_IDLE_TIMEOUT_MS"
+	EnvMaxHeaderBytes = "KAPPA_HTTP_MAX_HEADER_BYTES"
+	// EnvKeepAlive is "false" to close connections after each request
+	EnvKeepAlive = "KAPPA_HTTP_KEEPALIVE"
+	// EnvTCPKeepAlive is the interval of TCP keep-alive probes, negative
+	// to turn them off
+	EnvTCPKeepAlive = "KAPPA_HTTP_TCP_KEEPALIVE_MS"
+	// EnvDrainTimeout is how long requests in flight get to finish once the
+	// runtime is told to stop
+	EnvDrainTimeout = "KAPPA_HTTP_DRAIN_TIMEOUT_MS"
+	// EnvCompressMinBytes is the size from which events and responses are
+	// gzipped, 0 to never compress them
+	EnvCompressMinBytes = "KAPPA_HTTP_COMPRESS_MIN_BYTES"
+)
+
+// ServerConfig tunes the runtime's HTTP server.
+type ServerConfig struct {
+	ReadHeaderTimeout time.Duration
+	ReadTimeout       time.Duration
+	WriteTimeout      time.Duration
+	IdleTimeout       time.Duration
+	MaxHeaderBytes    int
+	KeepAlive         bool
+	TCPKeepAlive      time.Duration
+	DrainTimeout      time.Duration
+	CompressMinBytes  int
+}
+
+// DefaultServerConfig is used for whatever the service doesn't inject. The
+// write timeout leaves room for slow handlers, the service times out
+// invocations itself.
+func DefaultServerConfig() ServerConfig {
+	return ServerConfig{
+		ReadHeaderTimeout: 10 * time.Second,
+		ReadTimeout:       time.Minute,
+		WriteTimeout:      15 * time.Minute,
+		IdleTimeout:       2 * time.Minute,
+		MaxHeaderBytes:    http.DefaultMaxHeaderBytes,
+		KeepAlive:         true,
+		TCPKeepAlive:      15 * time.Second,
+		DrainTimeout:      10 * time.Second,
+		CompressMinBytes:  64 << 10,
+	}
+}
+
+// ServerConfigFromEnv returns the defaults overridden by the env the service
+// injected, ignoring values that don't parse.
+func ServerConfigFromEnv() ServerConfig {
+	c := DefaultServerConfig()
+	durations := map[string]*time.Duration{
+		EnvReadHeaderTimeout: &c.ReadHeaderTimeout,
+		EnvReadTimeout:       &c.ReadTimeout,
+		EnvWriteTimeout:      &c.WriteTimeout,
+		EnvIdleTimeout:       &c.IdleTimeout,
+		EnvTCPKeepAlive:      &c.TCPKeepAlive,
+		EnvDrainTimeout:      &c.DrainTimeout,
+	}
+	for env, d := range durations {
+		if v := os.Getenv(env); v != "" {
+			ms, err := strconv.Atoi(v)
+			if err != nil {
+				log.Printf("Ignoring invalid %s: %s", env, v)
+				continue
+			}
+			*d = time.Duration(ms) * time.Millisecond
+		}
+	}
+	if v := os.Getenv(EnvMaxHeaderBytes); v != "" {
+		if n, err := strconv.Atoi(v); err == nil && n > 0 {
+			c.MaxHeaderBytes = n
+		} else {
+			log.Printf("Ignoring invalid %s: %s", EnvMaxHeaderBytes, v)
+		}
+	}
+	if v := os.Getenv(EnvKeepAlive); v != "" {
+		c.KeepAlive = v != "false"
+	}
+	if v := os.Getenv(EnvCompressMinBytes); v != "" {
+		if n, err := strconv.Atoi(v); err == nil && n >= 0 {
+			c.CompressMinBytes = n
+		} else {
+			log.Printf("Ignoring invalid %s: %s", EnvCompressMinBytes, v)
+		}
+	}
+	return c
+}
+
+// Env returns the config as the env ServerConfigFromEnv reads.
+func (c ServerConfig) Env() []string {
+	ms := func(d time.Duration) int64 { return d.Milliseconds() }
+	return []string{
+		fmt.Sprintf("%s=%d", EnvReadHeaderTimeout, ms(c.ReadHeaderTimeout)),
+		fmt.Sprintf("%s=%d", EnvReadTimeout, ms(c.ReadTimeout)),
+		fmt.Sprintf("%s=%d", EnvWriteTimeout, ms(c.WriteTimeout)),
+		fmt.Sprintf("%s=%d", EnvIdleTimeout, ms(c.IdleTimeout)),
+		fmt.Sprintf("%s=%d", EnvMaxHeaderBytes, c.MaxHeaderBytes),
+		fmt.Sprintf("%s=%t", EnvKeepAlive, c.KeepAlive),
+		fmt.Sprintf("%s=%d", EnvTCPKeepAlive, ms(c.TCPKeepAlive)),
+		fmt.Sprintf("%s=%d", EnvDrainTimeout, ms(c.DrainTimeout)),
+		fmt.Sprintf("%s=%d", EnvCompressMinBytes, c.CompressMinBytes),
+	}
+}
+
+// server builds the HTTP server for handler, listening on addr.
+func (c ServerConfig) server(addr string, handler http.Handler) *http.Server {
+	server := &http.Server{
+		Addr:              addr,
+		Handler:           handler,
+		ReadHeaderTimeout: c.ReadHeaderTimeout,
+		ReadTimeout:       c.ReadTimeout,
+		WriteTimeout:      c.WriteTimeout,
+		IdleTimeout:       c.IdleTimeout,
+		MaxHeaderBytes:    c.MaxHeaderBytes,
+	}
+	server.SetKeepAlivesEnabled(c.KeepAlive)
+	return server
+}
+
+// listen opens addr with the config's TCP keep-alive.
+func (c ServerConfig) listen(addr string) (net.Listener, error) {
+	lc := net.ListenConfig{KeepAlive: c.TCPKeepAlive}
+	return lc.Listen(context.Background(), "tcp", addr)
+}
+
+// runtimeInfo is what /runtime/info reports, for debugging latency
+type runtimeInfo struct {
+	Port      string         `json:"port"`
+	TLS       bool           `json:"tls"`
+	GoVersion string         `json:"goVersion"`
+	PID       int            `json:"pid"`
+	Server    map[string]any `json:"server"`
+	// Time is the runtime's wall clock as it answers, with its UTC offset,
+	// for the service to tell how far it is off its own
+	Time time.Time `json:"time"`
+	// Timezone is TZ, or the abbreviation of the zone the runtime is in
+	// without it
+	Timezone string `json:"timezone"`
+	Locale   string `json:"locale,omitempty"`
+}
+
+// handleRuntimeInfo reports how the runtime's server is configured.
+func handleRuntimeInfo(c ServerConfig, port string, tls bool) http.HandlerFunc {
+	info := runtimeInfo{
+		Port:      port,
+		TLS:       tls,
+		GoVersion: runtime.Version(),
+		PID:       os.Getpid(),
+		Server: map[string]any{
+			"readHeaderTimeoutMs": c.ReadHeaderTimeout.Milliseconds(),
+			"readTimeoutMs":       c.ReadTimeout.Milliseconds(),
+			"writeTimeoutMs":      c.WriteTimeout.Milliseconds(),
+			"idleTimeoutMs":       c.IdleTimeout.Milliseconds(),
+			"maxHeaderBytes":      c.MaxHeaderBytes,
+			"keepAlive":           c.KeepAlive,
+			"tcpKeepAliveMs":      c.TCPKeepAlive.Milliseconds(),
+			"drainTimeoutMs":      c.DrainTimeout.Milliseconds(),
+			"compressMinBytes":    c.CompressMinBytes,
+		},
+		Locale: locale(),
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		info := info
+		info.Time = time.Now()
+		if info.Timezone = os.Getenv("TZ"); info.Timezone == "" {
+			info.Timezone, _ = info.Time.Zone()
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(info)
+	}
+}
+
+// locale is the locale the runtime's environment asks for, as the C
+// library resolves it
+func locale() string {
+	for _, env := range []string{"LC_ALL", "LC_TIME", "LANG"} {
+		if v := os.Getenv(env); v != "" {
+			return v
+		}
+	}
+	return ""
+}
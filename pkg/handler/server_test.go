@@ -0,0 +1,50 @@
+package handler
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestServerConfigFromEnv(t *testing.T) {
+	assert.Equal(t, DefaultServerConfig(), ServerConfigFromEnv())
+
+	t.Setenv(EnvWriteTimeout, "35000")
+	t.Setenv(EnvIdleTimeout, "soon")
+	t.Setenv(EnvMaxHeaderBytes, "4096")
+	t.Setenv(EnvKeepAlive, "false")
+	t.Setenv(EnvCompressMinBytes, "0")
+	c := ServerConfigFromEnv()
+	assert.Equal(t, 35*time.Second, c.WriteTimeout)
+	assert.Equal(t, DefaultServerConfig().IdleTimeout, c.IdleTimeout, "invalid values are ignored")
+	assert.Equal(t, 4096, c.MaxHeaderBytes)
+	assert.False(t, c.KeepAlive)
+	assert.Zero(t, c.CompressMinBytes)
+
+	// The env a config gives is read back as the same config
+	c.DrainTimeout = 8 * time.Second
+	for _, kv := range c.Env() {
+		key, value, _ := strings.Cut(kv, "=")
+		t.Setenv(key, value)
+	}
+	assert.Equal(t, c, ServerConfigFromEnv())
+}
+
+func TestHandleRuntimeInfo(t *testing.T) {
+	rec := httptest.NewRecorder()
+	handleRuntimeInfo(DefaultServerConfig(), "8080", false)(rec, httptest.NewRequest(http.MethodGet, "/runtime/info", nil))
+
+	var info runtimeInfo
+	require.NoError(t, json.NewDecoder(rec.Body).Decode(&info))
+	assert.Equal(t, "8080", info.Port)
+	assert.NotEmpty(t, info.GoVersion)
+	assert.Equal(t, float64(DefaultServerConfig().WriteTimeout.Milliseconds()), info.Server["writeTimeoutMs"])
+	assert.WithinDuration(t, time.Now(), info.Time, time.Minute)
+	assert.NotEmpty(t, info.Timezone)
+}
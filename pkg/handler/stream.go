@@ -0,0 +1,96 @@
+package handler
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+)
+
+// HeaderResponseStream is set on responses whose body is written as it is
+// produced, for the service to pass on to the caller as it arrives rather
+// than once it is complete.
+const HeaderResponseStream = "Kappa-Response-Stream"
+
+// Stream is a response body the handler writes as it produces it, set as
+// the Response's Body. Every Write is flushed through to the caller. The
+// response ends when it returns; an error can't change the status already
+// sent and is only logged.
+type Stream func(w io.Writer) error
+
+// NewStream creates a response streaming its body, of contentType.
+func NewStream(contentType string, body Stream, requestID string) Response {
+	return Response{
+		StatusCode: http.StatusOK,
+		Headers: map[string]string{
+			"Content-Type": contentType,
+		},
+		Body:      body,
+		RequestID: requestID,
+	}
+}
+
+// NewEventStream creates a response streaming the events produce sends as
+// Server-Sent Events.
+func NewEventStream(produce func(send func(event string, data any) error) error, requestID string) Response {
+	r := NewStream("text/event-stream", func(w io.Writer) error {
+		return produce(func(event string, data any) error {
+			return writeEvent(w, event, data)
+		})
+	}, requestID)
+	r.Headers["Cache-Control"] = "no-cache"
+	return r
+}
+
+// writeEvent writes one Server-Sent Event. Strings are sent as they are,
+// line by line, anything else encoded as JSON.
+func writeEvent(w io.Writer, event string, data any) error {
+	var text string
+	switch d := data.(type) {
+	case string:
+		text = d
+	case []byte:
+		text = string(d)
+	default:
+		encoded, err := json.Marshal(d)
+		if err != nil {
+			return fmt.Errorf("failed to encode event: %w", err)
+		}
+		text = string(encoded)
+	}
+
+	var b strings.Builder
+	if event != "" {
+		fmt.Fprintf(&b, "event: %s\n", event)
+	}
+	for _, line := range strings.Split(text, "\n") {
+		fmt.Fprintf(&b, "data: %s\n", line)
+	}
+	b.WriteString("\n")
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+// writeStream writes the stream's body, flushing each write.
+func writeStream(w http.ResponseWriter, stream Stream, requestID string) {
+	fw := &flushWriter{w: w, rc: http.NewResponseController(w)}
+	if err := stream(fw); err != nil {
+		log.Printf("Error streaming response %s: %v", requestID, err)
+	}
+}
+
+// flushWriter flushes every write to the connection.
+type flushWriter struct {
+	w  io.Writer
+	rc *http.ResponseController
+}
+
+func (f *flushWriter) Write(p []byte) (int, error) {
+	n, err := f.w.Write(p)
+	if err != nil {
+		return n, err
+	}
+	return n, f.rc.Flush()
+}
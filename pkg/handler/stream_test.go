@@ -0,0 +1,56 @@
+package handler
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewEventStream(t *testing.T) {
+	tokens := func(event Event) Response {
+		return NewEventStream(func(send func(string, any) error) error {
+			if err := send("", "hello\nworld"); err != nil {
+				return err
+			}
+			return send("done", map[string]int{"tokens": 2})
+		}, event.RequestID)
+	}
+	// Streams aren't held back to be compressed
+	h := withCompression(createInvocationHandler(tokens), 1)
+	event, err := json.Marshal(Event{RequestID: "req-1"})
+	require.NoError(t, err)
+
+	req := httptest.NewRequest(http.MethodPost, "/", bytes.NewReader(event))
+	req.Header.Set("Accept-Encoding", "gzip")
+	rec := httptest.NewRecorder()
+	h(rec, req)
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, "text/event-stream", rec.Header().Get("Content-Type"))
+	assert.Equal(t, "true", rec.Header().Get(HeaderResponseStream))
+	assert.Equal(t, "req-1", rec.Header().Get(HeaderRequestID))
+	assert.Empty(t, rec.Header().Get("Content-Encoding"))
+	assert.True(t, rec.Flushed)
+	assert.Equal(t, "data: hello\ndata: world\n\nevent: done\ndata: {\"tokens\":2}\n\n", rec.Body.String())
+}
+
+func TestNewStream(t *testing.T) {
+	rec := httptest.NewRecorder()
+	writeResponse(rec, NewStream("text/plain", func(w io.Writer) error {
+		_, err := io.WriteString(w, "chunk")
+		return err
+	}, ""), "req-1")
+	assert.Equal(t, "text/plain", rec.Header().Get("Content-Type"))
+	assert.Equal(t, "true", rec.Header().Get(HeaderResponseStream))
+	assert.Equal(t, "chunk", rec.Body.String())
+
+	// Without a content type it is a stream of bytes
+	rec = httptest.NewRecorder()
+	writeResponse(rec, Response{Body: Stream(func(io.Writer) error { return nil })}, "req-1")
+	assert.Equal(t, "application/octet-stream", rec.Header().Get("Content-Type"))
+}
@@ -0,0 +1,176 @@
+package handler
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"runtime"
+	"sync"
+	"time"
+)
+
+// TimeoutPath is the runtime's control endpoint the service signals an
+// invocation it gave up on through, POST {"requestId": "...", "graceMs": 500}.
+// It answers with what the invocation had to show for itself within the
+// grace window, as a PartialResult.
+const TimeoutPath = "/runtime/timeout"
+
+// maxTimeoutGrace caps how long the runtime waits for a partial result,
+// whatever the service asks for
+const maxTimeoutGrace = 30 * time.Second
+
+// PartialResult is what an invocation that timed out had when it was
+// signalled: the last result its handler reported with Partial, or its
+// response body if it returned within the grace window, and diagnostics.
+type PartialResult struct {
+	RequestID string `json:"requestId"`
+	Partial   any    `json:"partial,omitempty"`
+	// Finished is whether the handler returned within the grace window
+	Finished   bool  `json:"finished"`
+	ElapsedMs  int64 `json:"elapsedMs"`
+	Goroutines int   `json:"goroutines"`
+}
+
+// inflight is an invocation the handler is running.
+type inflight struct {
+	started  time.Time
+	timedOut chan struct{}
+	signal   sync.Once
+	// reported is sent to when the handler reports a result after the
+	// invocation timed out, and closed when it returns
+	reported chan struct{}
+	finished chan struct{}
+
+	mu         sync.Mutex
+	partial    any
+	hasPartial bool
+}
+
+var (
+	inflightMu sync.Mutex
+	inflights  = make(map[string]*inflight)
+)
+
+// track registers an invocation as running, for Partial and TimedOut to
+// find, until the returned function is called with its response.
+func track(requestID string) func(Response) {
+	f := &inflight{
+		started:  time.Now(),
+		timedOut: make(chan struct{}),
+		reported: make(chan struct{}, 1),
+		finished: make(chan struct{}),
+	}
+	inflightMu.Lock()
+	inflights[requestID] = f
+	inflightMu.Unlock()
+
+	return func(response Response) {
+		inflightMu.Lock()
+		if inflights[requestID] == f {
+			delete(inflights, requestID)
+		}
+		inflightMu.Unlock()
+		// A handler that noticed the timeout and returned early answers
+		// with what it has, unless it already reported that. Streams are
+		// still to be written, there is nothing to show of them
+		_, streamed := response.Body.(Stream)
+		f.mu.Lock()
+		if !f.hasPartial && response.Body != nil && !streamed {
+			f.partial, f.hasPartial = response.Body, true
+		}
+		f.mu.Unlock()
+		close(f.finished)
+	}
+}
+
+func lookup(requestID string) *inflight {
+	inflightMu.Lock()
+	defer inflightMu.Unlock()
+	return inflights[requestID]
+}
+
+// Partial records what the invocation has got so far, for the service to
+// return if it times out. Later calls replace earlier ones, and calls for
+// invocations that aren't running are ignored. Handlers doing long work in
+// steps report after each one, so a timeout doesn't lose all of it.
+func Partial(requestID string, result any) {
+	f := lookup(requestID)
+	if f == nil {
+		return
+	}
+	f.mu.Lock()
+	f.partial, f.hasPartial = result, true
+	f.mu.Unlock()
+	select {
+	case <-f.timedOut:
+		select {
+		case f.reported <- struct{}{}:
+		default:
+		}
+	default:
+	}
+}
+
+// TimedOut returns a channel closed when the service gives up on the
+// invocation, for handlers to stop and report what they have with Partial
+// or by returning. It is never closed for invocations that aren't running.
+func TimedOut(requestID string) <-chan struct{} {
+	f := lookup(requestID)
+	if f == nil {
+		return nil
+	}
+	return f.timedOut
+}
+
+type timeoutBody struct {
+	RequestID string `json:"requestId"`
+	GraceMs   int    `json:"graceMs"`
+}
+
+// handleTimeout signals an invocation it timed out and answers with its
+// partial result once the handler reports one, returns or the grace window
+// is over, whichever is first.
+func handleTimeout(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", "POST")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var body timeoutBody
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		http.Error(w, fmt.Sprintf("Invalid request: %v", err), http.StatusBadRequest)
+		return
+	}
+	f := lookup(body.RequestID)
+	if f == nil {
+		http.Error(w, fmt.Sprintf("Invocation not running: %s", body.RequestID), http.StatusNotFound)
+		return
+	}
+	grace := min(time.Duration(body.GraceMs)*time.Millisecond, maxTimeoutGrace)
+
+	f.signal.Do(func() { close(f.timedOut) })
+	timer := time.NewTimer(grace)
+	defer timer.Stop()
+	finished := false
+	select {
+	case <-f.reported:
+	case <-f.finished:
+		finished = true
+	case <-timer.C:
+	case <-r.Context().Done():
+		return
+	}
+
+	result := PartialResult{
+		RequestID:  body.RequestID,
+		Finished:   finished,
+		ElapsedMs:  time.Since(f.started).Milliseconds(),
+		Goroutines: runtime.NumGoroutine(),
+	}
+	f.mu.Lock()
+	result.Partial = f.partial
+	f.mu.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
@@ -0,0 +1,67 @@
+package handler
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func signalTimeout(t *testing.T, body string) (*httptest.ResponseRecorder, PartialResult) {
+	t.Helper()
+	rr := httptest.NewRecorder()
+	handleTimeout(rr, httptest.NewRequest(http.MethodPost, TimeoutPath, strings.NewReader(body)))
+	var result PartialResult
+	if rr.Code == http.StatusOK {
+		require.NoError(t, json.NewDecoder(rr.Body).Decode(&result))
+	}
+	return rr, result
+}
+
+func TestHandleTimeout(t *testing.T) {
+	rr, _ := signalTimeout(t, `{"requestId":"gone","graceMs":10}`)
+	assert.Equal(t, http.StatusNotFound, rr.Code)
+
+	// A handler reporting progress, and again once it notices the timeout
+	done := track("steps")
+	Partial("steps", map[string]int{"done": 1})
+	go func() {
+		<-TimedOut("steps")
+		Partial("steps", map[string]int{"done": 2})
+	}()
+	rr, result := signalTimeout(t, `{"requestId":"steps","graceMs":5000}`)
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Equal(t, "steps", result.RequestID)
+	assert.Equal(t, map[string]any{"done": float64(2)}, result.Partial)
+	assert.False(t, result.Finished)
+	done(Response{})
+	assert.Nil(t, TimedOut("steps"), "finished invocations aren't tracked")
+
+	// A handler returning early answers with its response
+	done = track("early")
+	go func() {
+		<-TimedOut("early")
+		done(NewResponse(http.StatusOK, "half", "early"))
+	}()
+	_, result = signalTimeout(t, `{"requestId":"early","graceMs":5000}`)
+	assert.True(t, result.Finished)
+	assert.Equal(t, "half", result.Partial)
+
+	// A handler ignoring the timeout is waited on for the grace window only
+	done = track("stuck")
+	defer done(Response{})
+	started := time.Now()
+	_, result = signalTimeout(t, `{"requestId":"stuck","graceMs":20}`)
+	assert.Less(t, time.Since(started), time.Second)
+	assert.Nil(t, result.Partial)
+	assert.Positive(t, result.Goroutines)
+
+	rr = httptest.NewRecorder()
+	handleTimeout(rr, httptest.NewRequest(http.MethodGet, TimeoutPath, nil))
+	assert.Equal(t, http.StatusMethodNotAllowed, rr.Code)
+}
@@ -0,0 +1,274 @@
+package logger
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime/debug"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"gopkg.in/natefinch/lumberjack.v2"
+)
+
+// Config is how logs are written.
+type Config struct {
+	Level zapcore.Level
+	// Encoding is "console" or "json" for stdout and stderr, files are
+	// always JSON
+	Encoding string
+	// Outputs are "stdout", "stderr", paths of files, which are rotated, or
+	// URLs of sinks registered with zap.RegisterSink. Leaving files out
+	// disables file output.
+	Outputs []string
+	// Rotation is when files are rotated and how many are kept
+	Rotation Rotation
+	// Writers are extra outputs, encoded like stdout
+	Writers []zapcore.WriteSyncer
+	// SamplingInitial is how many entries with the same level and message
+	// are logged each second before sampling starts, 0 logs everything
+	SamplingInitial int
+	// SamplingThereafter is how often entries are logged once sampling
+	// starts, every SamplingThereafter-th entry
+	SamplingThereafter int
+}
+
+// Rotation is the rotation policy of file outputs.
+type Rotation struct {
+	// MaxSizeMB is how big a file grows before it is rotated
+	MaxSizeMB int
+	// MaxBackups is how many rotated files are kept, 0 keeps them all
+	MaxBackups int
+	// MaxAgeDays is how long rotated files are kept, 0 keeps them forever
+	MaxAgeDays int
+	// Compress gzips rotated files
+	Compress bool
+}
+
+// DefaultConfig logs at info to the console and to logs/app.log, rotated
+// every 5MB and kept for 28 days up to 10 files.
+func DefaultConfig() Config {
+	return Config{
+		Level:    zap.InfoLevel,
+		Encoding: "console",
+		Outputs:  []string{"stdout", "logs/app.log"},
+		Rotation: Rotation{
+			MaxSizeMB:  5,
+			MaxBackups: 10,
+			MaxAgeDays: 28,
+			Compress:   true,
+		},
+	}
+}
+
+// ConfigFromEnv reads LOG_LEVEL, LOG_ENCODING, LOG_OUTPUT as a comma
+// separated list, LOG_SAMPLING_INITIAL and LOG_SAMPLING_THEREAFTER, 100 by
+// default, and the rotation policy from LOG_FILE_MAX_SIZE_MB,
+// LOG_FILE_MAX_BACKUPS, LOG_FILE_MAX_AGE_DAYS and LOG_FILE_COMPRESS. Invalid
+// values keep their default and are reported in the error.
+func ConfigFromEnv() (Config, error) {
+	cfg := DefaultConfig()
+	var errs []error
+
+	if v := os.Getenv("LOG_LEVEL"); v != "" {
+		level, err := zapcore.ParseLevel(v)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("invalid level, defaulting to INFO: %w", err))
+		} else {
+			cfg.Level = level
+		}
+	}
+	if v := os.Getenv("LOG_ENCODING"); v != "" {
+		if v != "console" && v != "json" {
+			errs = append(errs, fmt.Errorf("invalid encoding %q, expected console or json", v))
+		} else {
+			cfg.Encoding = v
+		}
+	}
+	// Tests log to the console, not to files left in their package
+	if testing.Testing() {
+		cfg.Outputs = []string{"stdout"}
+	}
+	if v := os.Getenv("LOG_OUTPUT"); v != "" {
+		var outputs []string
+		for _, output := range strings.Split(v, ",") {
+			if output = strings.TrimSpace(output); output != "" {
+				outputs = append(outputs, output)
+			}
+		}
+		if len(outputs) > 0 {
+			cfg.Outputs = outputs
+		}
+	}
+	if v := os.Getenv("LOG_SAMPLING_INITIAL"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			errs = append(errs, fmt.Errorf("invalid LOG_SAMPLING_INITIAL %q", v))
+		} else {
+			cfg.SamplingInitial = n
+			cfg.SamplingThereafter = 100
+		}
+	}
+	if v := os.Getenv("LOG_SAMPLING_THEREAFTER"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			errs = append(errs, fmt.Errorf("invalid LOG_SAMPLING_THEREAFTER %q", v))
+		} else {
+			cfg.SamplingThereafter = n
+		}
+	}
+	for name, value := range map[string]*int{
+		"LOG_FILE_MAX_SIZE_MB":  &cfg.Rotation.MaxSizeMB,
+		"LOG_FILE_MAX_BACKUPS":  &cfg.Rotation.MaxBackups,
+		"LOG_FILE_MAX_AGE_DAYS": &cfg.Rotation.MaxAgeDays,
+	} {
+		if v := os.Getenv(name); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil || n < 0 {
+				errs = append(errs, fmt.Errorf("invalid %s %q", name, v))
+			} else {
+				*value = n
+			}
+		}
+	}
+	if v := os.Getenv("LOG_FILE_COMPRESS"); v != "" {
+		compress, err := strconv.ParseBool(v)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("invalid LOG_FILE_COMPRESS %q", v))
+		} else {
+			cfg.Rotation.Compress = compress
+		}
+	}
+	return cfg, errors.Join(errs...)
+}
+
+// isFile reports whether an output is a file, rather than a stream or a sink.
+func isFile(output string) bool {
+	return output != "stdout" && output != "stderr" && !strings.Contains(output, "://")
+}
+
+// Files returns the file outputs, which are rotated.
+func (c Config) Files() []string {
+	var files []string
+	for _, output := range c.Outputs {
+		if isFile(output) {
+			files = append(files, output)
+		}
+	}
+	return files
+}
+
+// backupTimeFormat is how lumberjack stamps the files it rotates
+const backupTimeFormat = "2006-01-02T15-04-05.000"
+
+// RotatedFiles returns the files a file output was rotated to, named like
+// logs/app-2006-01-02T15-04-05.000.log and gzipped when compressed, oldest
+// first.
+func RotatedFiles(file string) ([]string, error) {
+	ext := filepath.Ext(file)
+	prefix := strings.TrimSuffix(filepath.Base(file), ext) + "-"
+	entries, err := os.ReadDir(filepath.Dir(file))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var rotated []string
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || !strings.HasPrefix(name, prefix) {
+			continue
+		}
+		stamp := strings.TrimSuffix(strings.TrimSuffix(name, ".gz"), ext)
+		stamp = strings.TrimPrefix(stamp, prefix)
+		if _, err := time.Parse(backupTimeFormat, stamp); err != nil {
+			continue
+		}
+		rotated = append(rotated, filepath.Join(filepath.Dir(file), name))
+	}
+	// Timestamps sort like the times they stand for
+	sort.Strings(rotated)
+	return rotated, nil
+}
+
+// New builds a logger from cfg.
+func New(cfg Config) (*zap.Logger, error) {
+	if len(cfg.Outputs)+len(cfg.Writers) == 0 {
+		return nil, fmt.Errorf("no log outputs")
+	}
+
+	productionCfg := zap.NewProductionEncoderConfig()
+	productionCfg.TimeKey = "timestamp"
+	productionCfg.EncodeTime = zapcore.ISO8601TimeEncoder
+
+	developmentCfg := zap.NewDevelopmentEncoderConfig()
+	developmentCfg.EncodeLevel = zapcore.CapitalColorLevelEncoder
+
+	var streamEncoder zapcore.Encoder
+	switch cfg.Encoding {
+	case "", "console":
+		streamEncoder = zapcore.NewConsoleEncoder(developmentCfg)
+	case "json":
+		streamEncoder = zapcore.NewJSONEncoder(productionCfg)
+	default:
+		return nil, fmt.Errorf("unknown log encoding: %s", cfg.Encoding)
+	}
+
+	var gitRevision, goVersion string
+	if buildInfo, ok := debug.ReadBuildInfo(); ok {
+		goVersion = buildInfo.GoVersion
+		for _, v := range buildInfo.Settings {
+			if v.Key == "vcs.revision" {
+				gitRevision = v.Value
+				break
+			}
+		}
+	}
+
+	logLevel := zap.NewAtomicLevelAt(cfg.Level)
+	cores := make([]zapcore.Core, 0, len(cfg.Outputs)+len(cfg.Writers))
+	for _, writer := range cfg.Writers {
+		cores = append(cores, zapcore.NewCore(streamEncoder, writer, logLevel))
+	}
+	for _, output := range cfg.Outputs {
+		switch {
+		case output == "stdout":
+			cores = append(cores, zapcore.NewCore(streamEncoder, zapcore.AddSync(os.Stdout), logLevel))
+		case output == "stderr":
+			cores = append(cores, zapcore.NewCore(streamEncoder, zapcore.AddSync(os.Stderr), logLevel))
+		case strings.Contains(output, "://"):
+			sink, _, err := zap.Open(output)
+			if err != nil {
+				return nil, fmt.Errorf("failed to open log sink %s: %w", output, err)
+			}
+			cores = append(cores, zapcore.NewCore(streamEncoder, sink, logLevel))
+		default:
+			file := zapcore.AddSync(&lumberjack.Logger{
+				Filename:   output,
+				MaxSize:    cfg.Rotation.MaxSizeMB,
+				MaxBackups: cfg.Rotation.MaxBackups,
+				MaxAge:     cfg.Rotation.MaxAgeDays,
+				Compress:   cfg.Rotation.Compress,
+			})
+			// extra fields are added to the JSON file output alone
+			cores = append(cores, zapcore.NewCore(zapcore.NewJSONEncoder(productionCfg), file, logLevel).
+				With([]zapcore.Field{
+					zap.String("git_revision", gitRevision),
+					zap.String("go_version", goVersion),
+				}))
+		}
+	}
+
+	core := zapcore.NewTee(cores...)
+	if cfg.SamplingInitial > 0 {
+		core = zapcore.NewSamplerWithOptions(core, time.Second, cfg.SamplingInitial, max(cfg.SamplingThereafter, 1))
+	}
+	return zap.New(core), nil
+}
@@ -5,95 +5,63 @@ import (
 	"fmt"
 	"log"
 	"os"
-	"runtime/debug"
 	"sync"
+	"sync/atomic"
 
 	"go.uber.org/zap"
-	"go.uber.org/zap/zapcore"
-	"gopkg.in/natefinch/lumberjack.v2"
 )
 
 type ctxKey struct{}
 
-var once sync.Once
-
-var logger *zap.Logger
+var (
+	// current is the global logger, nil until Get or Configure sets it up
+	current atomic.Pointer[zap.Logger]
+	// initMu keeps concurrent first calls to Get from building it twice
+	initMu sync.Mutex
+)
 
+// ResetForTest discards the global logger, so the next Get builds it again
+// from the environment, and removes the default logs directory. It is for
+// tests that change the log config or don't want log files left behind.
 func ResetForTest() {
-
-	logger = nil
+	current.Store(nil)
 	os.RemoveAll("logs")
-	once = sync.Once{}
 }
 
-// Get initializes a zap.Logger instance if it has not been initialized
-// already and returns the same instance for subsequent calls.
-func Get() *zap.Logger {
-	once.Do(func() {
-		stdout := zapcore.AddSync(os.Stdout)
-
-		file := zapcore.AddSync(&lumberjack.Logger{
-			Filename:   "logs/app.log",
-			MaxSize:    5,
-			MaxBackups: 10,
-			MaxAge:     28,
-			Compress:   true,
-		})
-
-		level := zap.InfoLevel
-		levelEnv := os.Getenv("LOG_LEVEL")
-		if levelEnv != "" {
-			levelFromEnv, err := zapcore.ParseLevel(levelEnv)
-			if err != nil {
-				log.Println(
-					fmt.Errorf("invalid level, defaulting to INFO: %w", err),
-				)
-			}
-
-			level = levelFromEnv
-		}
-
-		logLevel := zap.NewAtomicLevelAt(level)
-
-		productionCfg := zap.NewProductionEncoderConfig()
-		productionCfg.TimeKey = "timestamp"
-		productionCfg.EncodeTime = zapcore.ISO8601TimeEncoder
-
-		developmentCfg := zap.NewDevelopmentEncoderConfig()
-		developmentCfg.EncodeLevel = zapcore.CapitalColorLevelEncoder
-
-		consoleEncoder := zapcore.NewConsoleEncoder(developmentCfg)
-		fileEncoder := zapcore.NewJSONEncoder(productionCfg)
-
-		var gitRevision string
-
-		buildInfo, ok := debug.ReadBuildInfo()
-		if ok {
-			for _, v := range buildInfo.Settings {
-				if v.Key == "vcs.revision" {
-					gitRevision = v.Value
-					break
-				}
-			}
-		}
-
-		// log to multiple destinations (console and file)
-		// extra fields are added to the JSON output alone
-		core := zapcore.NewTee(
-			zapcore.NewCore(consoleEncoder, stdout, logLevel),
-			zapcore.NewCore(fileEncoder, file, logLevel).
-				With(
-					[]zapcore.Field{
-						zap.String("git_revision", gitRevision),
-						zap.String("go_version", buildInfo.GoVersion),
-					},
-				),
-		)
+// Configure replaces the global logger with one built from cfg, for
+// programs that configure logging themselves rather than from the environment.
+func Configure(cfg Config) error {
+	l, err := New(cfg)
+	if err != nil {
+		return err
+	}
+	current.Store(l)
+	return nil
+}
 
-		logger = zap.New(core)
-	})
+// Get initializes a zap.Logger instance from the environment if it has not
+// been initialized already and returns the same instance for subsequent calls.
+func Get() *zap.Logger {
+	if l := current.Load(); l != nil {
+		return l
+	}
 
-	return logger
+	initMu.Lock()
+	defer initMu.Unlock()
+	if l := current.Load(); l != nil {
+		return l
+	}
+	cfg, err := ConfigFromEnv()
+	if err != nil {
+		log.Println(err)
+	}
+	l, err := New(cfg)
+	if err != nil {
+		log.Println(fmt.Errorf("invalid log config, using defaults: %w", err))
+		l, _ = New(DefaultConfig())
+	}
+	current.Store(l)
+	return l
 }
 
 // FromCtx returns the Logger associated with the ctx. If no logger
@@ -102,7 +70,7 @@ func Get() *zap.Logger {
 func FromCtx(ctx context.Context) *zap.Logger {
 	if l, ok := ctx.Value(ctxKey{}).(*zap.Logger); ok {
 		return l
-	} else if l := logger; l != nil {
+	} else if l := current.Load(); l != nil {
 		return l
 	}
 
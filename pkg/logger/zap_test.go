@@ -5,6 +5,7 @@ import (
 	"context"
 	"io"
 	"os"
+	"path/filepath"
 	"strings"
 	"sync"
 	"testing"
@@ -31,8 +32,7 @@ func captureOutput(f func()) string {
 	return buf.String()
 }
 
-// ResetForTest resets the logger instance for testing purposes.
-// Note: This is a local copy. Ideally, this function would be exported from the logger package.
+// resetGlobalLoggerState serializes ResetForTest between tests.
 var (
 	testOnce   sync.Once
 	testLogger *zap.Logger
@@ -128,16 +128,10 @@ func TestLogger_WithCtx_FromCtx(t *testing.T) {
 func TestGet_OutputFormat(t *testing.T) {
 
 	ResetForTest()
+	defer ResetForTest()
 
-	logDir := "logs"
-	logFile := "logs/app.log"
-	_ = os.Mkdir(logDir, 0755)
-	_ = os.Remove(logFile) // Clean up previous log file
-
-	defer func() {
-		_ = os.Remove(logFile)
-		// _ = os.Remove(logDir)  // maybe used by other tests
-	}()
+	logFile := filepath.Join(t.TempDir(), "app.log")
+	t.Setenv("LOG_OUTPUT", "stdout,"+logFile)
 
 	var consoleOutput string
 	var wg sync.WaitGroup
@@ -166,3 +160,115 @@ func TestGet_OutputFormat(t *testing.T) {
 			strings.Contains(string(content), `"go_version"`)
 	}, 2*time.Second, 100*time.Millisecond, "File log content not as expected")
 }
+
+func TestConfigFromEnv(t *testing.T) {
+	t.Setenv("LOG_LEVEL", "warn")
+	t.Setenv("LOG_ENCODING", "json")
+	t.Setenv("LOG_OUTPUT", "stderr, /var/log/kappa.log")
+	t.Setenv("LOG_SAMPLING_INITIAL", "10")
+	t.Setenv("LOG_FILE_MAX_SIZE_MB", "50")
+	t.Setenv("LOG_FILE_MAX_BACKUPS", "0")
+	t.Setenv("LOG_FILE_COMPRESS", "false")
+	cfg, err := ConfigFromEnv()
+	require.NoError(t, err)
+	assert.Equal(t, Config{
+		Level:              zap.WarnLevel,
+		Encoding:           "json",
+		Outputs:            []string{"stderr", "/var/log/kappa.log"},
+		Rotation:           Rotation{MaxSizeMB: 50, MaxBackups: 0, MaxAgeDays: 28, Compress: false},
+		SamplingInitial:    10,
+		SamplingThereafter: 100,
+	}, cfg)
+
+	t.Setenv("LOG_ENCODING", "xml")
+	t.Setenv("LOG_SAMPLING_THEREAFTER", "0")
+	cfg, err = ConfigFromEnv()
+	assert.ErrorContains(t, err, "invalid encoding")
+	assert.ErrorContains(t, err, "LOG_SAMPLING_THEREAFTER")
+	assert.Equal(t, "console", cfg.Encoding, "invalid values keep their default")
+	assert.Equal(t, zap.WarnLevel, cfg.Level)
+}
+
+func TestNew_JSONSampled(t *testing.T) {
+	logFile := filepath.Join(t.TempDir(), "app.log")
+	var l *zap.Logger
+	output := captureOutput(func() {
+		var err error
+		l, err = New(Config{
+			Level:              zap.InfoLevel,
+			Encoding:           "json",
+			Outputs:            []string{"stdout", logFile},
+			SamplingInitial:    2,
+			SamplingThereafter: 100,
+		})
+		require.NoError(t, err)
+		for range 10 {
+			l.Info("repeated")
+		}
+		l.Sync()
+	})
+
+	assert.Equal(t, 2, strings.Count(output, `"msg":"repeated"`), "only the first entries each second are logged")
+	content, err := os.ReadFile(logFile)
+	require.NoError(t, err)
+	assert.Equal(t, 2, strings.Count(string(content), `"msg":"repeated"`))
+	assert.Contains(t, string(content), `"go_version"`)
+
+	_, err = New(Config{Encoding: "xml", Outputs: []string{"stdout"}})
+	assert.Error(t, err)
+}
+
+func TestConfigure(t *testing.T) {
+	defer ResetForTest()
+
+	var buf bytes.Buffer
+	require.NoError(t, Configure(Config{Level: zap.DebugLevel, Encoding: "json", Writers: []zapcore.WriteSyncer{zapcore.AddSync(&buf)}}))
+	Get().Debug("configured", zap.String("sink", "buffer"))
+	assert.Contains(t, buf.String(), `"msg":"configured"`)
+	assert.Contains(t, buf.String(), `"sink":"buffer"`)
+	assert.Same(t, Get(), FromCtx(context.Background()))
+
+	assert.Error(t, Configure(Config{}), "a logger needs an output")
+	assert.Contains(t, buf.String(), "configured", "a failed Configure keeps the logger")
+
+	ResetForTest()
+	t.Setenv("LOG_OUTPUT", "stderr")
+	buf.Reset()
+	Get().Info("not in the buffer")
+	assert.Empty(t, buf.String(), "after a reset the logger comes from the environment again")
+}
+
+func TestRotatedFiles(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{
+		"app.log",
+		"app-2026-10-17T00-36-38.018.log.gz",
+		"app-2026-10-16T09-00-00.000.log",
+		"app-notatime.log",
+		"other-2026-10-16T09-00-00.000.log",
+	} {
+		require.NoError(t, os.WriteFile(filepath.Join(dir, name), nil, 0644))
+	}
+
+	rotated, err := RotatedFiles(filepath.Join(dir, "app.log"))
+	require.NoError(t, err)
+	assert.Equal(t, []string{
+		filepath.Join(dir, "app-2026-10-16T09-00-00.000.log"),
+		filepath.Join(dir, "app-2026-10-17T00-36-38.018.log.gz"),
+	}, rotated)
+
+	rotated, err = RotatedFiles(filepath.Join(dir, "missing", "app.log"))
+	require.NoError(t, err)
+	assert.Empty(t, rotated)
+
+	cfg := Config{Outputs: []string{"stdout", "logs/app.log", "syslog://local"}}
+	assert.Equal(t, []string{"logs/app.log"}, cfg.Files())
+}
+
+func TestConfigFromEnv_TestsLogToStdout(t *testing.T) {
+	t.Setenv("LOG_OUTPUT", "")
+	cfg, err := ConfigFromEnv()
+	require.NoError(t, err)
+	assert.Equal(t, []string{"stdout"}, cfg.Outputs, "tests leave no log files behind")
+	assert.Equal(t, []string{"stdout", "logs/app.log"}, DefaultConfig().Outputs)
+}
@@ -0,0 +1,191 @@
+// Command kappa-admin runs maintenance tasks against a kappa installation
+// from the host it runs on, reading the same environment as the service.
+//
+//	kappa-admin backup [-o archive] [-skip-secrets]
+//	kappa-admin restore [-force] archive
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"kappa-v2/service/internal/artifact"
+	"kappa-v2/service/internal/backup"
+	"kappa-v2/service/internal/database"
+	"kappa-v2/service/internal/repository"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// migrateTimeout bounds migrating the schema of the database restored into
+const migrateTimeout = 5 * time.Minute
+
+func main() {
+	if len(os.Args) < 2 {
+		usage()
+		os.Exit(2)
+	}
+	var err error
+	switch os.Args[1] {
+	case "backup":
+		err = runBackup(os.Args[2:])
+	case "restore":
+		err = runRestore(os.Args[2:])
+	case "-h", "-help", "--help", "help":
+		usage()
+		return
+	default:
+		fmt.Fprintf(os.Stderr, "unknown command %q\n", os.Args[1])
+		usage()
+		os.Exit(2)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "kappa-admin %s: %v\n", os.Args[1], err)
+		os.Exit(1)
+	}
+}
+
+func usage() {
+	fmt.Fprintln(os.Stderr, `Usage:
+  kappa-admin backup [-o archive] [-skip-secrets]
+      Write the function registry, schedules, audit trail, secrets and
+      artifacts to an archive, kappa-backup-<time>.tar.gz by default, or
+      stdout for -o -. Secrets are encrypted with KAPPA_BACKUP_KEY.
+  kappa-admin restore [-force] archive
+      Restore an archive onto this host, which must have no functions
+      registered unless -force. Run it with the service stopped.`)
+}
+
+// openInstallation opens the state the service keeps, where the service
+// would find it: KAPPA_DATABASE_URL, KAPPA_ARTIFACT_DIR,
+// KAPPA_REGISTRY_FILE and KAPPA_SECRETS_DIR, with the same defaults. The
+// database's schema is migrated when migrate is set. The returned func
+// closes what was opened.
+func openInstallation(migrate bool) (backup.Installation, func(), error) {
+	artifactDir := os.Getenv("KAPPA_ARTIFACT_DIR")
+	if artifactDir == "" {
+		artifactDir = "artifacts"
+	}
+	secretsDir := os.Getenv("KAPPA_SECRETS_DIR")
+	if secretsDir == "" {
+		secretsDir = "secrets"
+	}
+	artifacts, err := artifact.NewStore(artifactDir)
+	if err != nil {
+		return backup.Installation{}, nil, err
+	}
+	sealer, err := backup.KeyFromEnv()
+	if err != nil {
+		return backup.Installation{}, nil, err
+	}
+	inst := backup.Installation{Artifacts: artifacts, SecretsDir: secretsDir, Sealer: sealer}
+
+	db, err := database.FromEnv()
+	if err != nil {
+		return backup.Installation{}, nil, err
+	}
+	if db == nil {
+		registryPath := os.Getenv("KAPPA_REGISTRY_FILE")
+		if registryPath == "" {
+			registryPath = filepath.Join(artifactDir, "functions.json")
+		}
+		if inst.Registry, err = repository.OpenFile(registryPath); err != nil {
+			return backup.Installation{}, nil, err
+		}
+		return inst, func() {}, nil
+	}
+	if migrate {
+		ctx, cancel := context.WithTimeout(context.Background(), migrateTimeout)
+		defer cancel()
+		if _, err := database.Migrate(ctx, db); err != nil {
+			db.Close()
+			return backup.Installation{}, nil, err
+		}
+	}
+	inst.Postgres = repository.NewPostgres(db)
+	inst.Registry = inst.Postgres
+	return inst, func() { db.Close() }, nil
+}
+
+func runBackup(args []string) error {
+	flags := flag.NewFlagSet("backup", flag.ExitOnError)
+	out := flags.String("o", "", "archive to write, - for stdout")
+	skipSecrets := flags.Bool("skip-secrets", false, "leave the secrets out")
+	flags.Parse(args)
+
+	inst, closeInst, err := openInstallation(false)
+	if err != nil {
+		return err
+	}
+	defer closeInst()
+
+	if *out == "" {
+		*out = fmt.Sprintf("kappa-backup-%s.tar.gz", time.Now().UTC().Format("20060102T150405Z"))
+	}
+	var w io.Writer = os.Stdout
+	var file *os.File
+	if *out != "-" {
+		// Written aside and moved into place, so a failed backup leaves no
+		// archive that looks complete
+		if file, err = os.CreateTemp(filepath.Dir(*out), filepath.Base(*out)+".tmp-*"); err != nil {
+			return fmt.Errorf("failed to create archive: %w", err)
+		}
+		defer os.Remove(file.Name())
+		defer file.Close()
+		if err := file.Chmod(0600); err != nil {
+			return fmt.Errorf("failed to create archive: %w", err)
+		}
+		w = file
+	}
+
+	manifest, err := backup.Create(w, inst, *skipSecrets)
+	if err != nil {
+		return err
+	}
+	if file != nil {
+		if err := file.Close(); err != nil {
+			return fmt.Errorf("failed to write archive: %w", err)
+		}
+		if err := os.Rename(file.Name(), *out); err != nil {
+			return fmt.Errorf("failed to write archive: %w", err)
+		}
+	}
+	fmt.Fprintf(os.Stderr, "Backed up %d functions, %d schedules, %d audit events, %d secrets and %d artifacts to %s\n",
+		manifest.Functions, manifest.Schedules, manifest.AuditEvents, manifest.Secrets, manifest.Artifacts, *out)
+	return nil
+}
+
+func runRestore(args []string) error {
+	flags := flag.NewFlagSet("restore", flag.ExitOnError)
+	force := flags.Bool("force", false, "restore onto an installation with functions, replacing those of the same names")
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		return fmt.Errorf("expected the archive to restore")
+	}
+
+	var r io.Reader = os.Stdin
+	if name := flags.Arg(0); name != "-" {
+		file, err := os.Open(name)
+		if err != nil {
+			return fmt.Errorf("failed to open archive: %w", err)
+		}
+		defer file.Close()
+		r = file
+	}
+
+	inst, closeInst, err := openInstallation(true)
+	if err != nil {
+		return err
+	}
+	defer closeInst()
+
+	manifest, err := backup.Restore(r, inst, *force)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "Restored %d functions, %d schedules, %d audit events, %d secrets and %d artifacts from the backup of %s taken %s\n",
+		manifest.Functions, manifest.Schedules, manifest.AuditEvents, manifest.Secrets, manifest.Artifacts, manifest.Host, manifest.CreatedAt.Format(time.RFC3339))
+	return nil
+}
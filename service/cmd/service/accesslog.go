@@ -0,0 +1,92 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"kappa-v2/pkg/logger"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"go.uber.org/zap"
+)
+
+// headerRequestID carries a request's ID, taken from the caller when given
+const headerRequestID = "X-Request-ID"
+
+type requestIDKey struct{}
+
+// requestID returns the ID accessLog gave the request, if any.
+func requestID(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+// statusRecorder remembers the status and size of a response.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+	bytes  int
+	// plainError is set for plain text error responses, like those written
+	// by http.Error, which get the request ID appended
+	plainError bool
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	if r.status == 0 {
+		r.status = status
+		// Function responses, which carry X-Kappa-Attempts, are passed on as is
+		r.plainError = status >= 400 && strings.HasPrefix(r.Header().Get("Content-Type"), "text/plain") &&
+			r.Header().Get("X-Kappa-Attempts") == ""
+	}
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *statusRecorder) Write(b []byte) (int, error) {
+	if r.status == 0 {
+		r.status = http.StatusOK
+	}
+	n, err := r.ResponseWriter.Write(b)
+	r.bytes += n
+	return n, err
+}
+
+func (r *statusRecorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
+
+// accessLog logs every request with its status and latency. Each request
+// gets an ID, the caller's X-Request-ID when sent, which is returned in the
+// response and in error messages, tags everything logged for the request
+// and becomes the ID of any invocation it makes.
+func accessLog(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		started := time.Now()
+		id := r.Header.Get(headerRequestID)
+		if id == "" {
+			id = uuid.New().String()
+		}
+		w.Header().Set(headerRequestID, id)
+		l := logger.Get().With(zap.String("requestId", id))
+		ctx := context.WithValue(r.Context(), requestIDKey{}, id)
+		r = r.WithContext(logger.WithCtx(ctx, l))
+
+		recorder := &statusRecorder{ResponseWriter: w}
+		next.ServeHTTP(recorder, r)
+		if recorder.status == 0 {
+			recorder.status = http.StatusOK
+		}
+		if recorder.plainError {
+			fmt.Fprintf(recorder, "Request ID: %s\n", id)
+		}
+
+		l.Info("Request",
+			zap.String("method", r.Method),
+			zap.String("path", r.URL.Path),
+			zap.Int("status", recorder.status),
+			zap.Int("bytes", recorder.bytes),
+			zap.Duration("latency", time.Since(started)),
+			zap.String("remoteAddr", r.RemoteAddr))
+	})
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"encoding/json"
+	"kappa-v2/service/internal/admission"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// concurrencyRetryAfter is how long callers turned away by a function's
+// concurrency limit are told to wait
+const concurrencyRetryAfter = time.Second
+
+// priority returns the admission priority of the named function.
+func (s *KappaService) priority(name string) admission.Priority {
+	p, _ := admission.ParsePriority(s.config(name).Priority)
+	return p
+}
+
+// shedInvocation answers an invocation the service is too busy to run with
+// 503, or the function's page for it, and a Retry-After hint.
+func (s *KappaService) shedInvocation(w http.ResponseWriter, name string) {
+	seconds := int(math.Ceil(s.admission.RetryAfter().Seconds()))
+	w.Header().Set("Retry-After", strconv.Itoa(max(seconds, 1)))
+	s.invocationError(w, name, errorSaturated, "Service is saturated, retry later", http.StatusServiceUnavailable)
+}
+
+// HTTP handler for the invocation limit's saturation stats
+func (s *KappaService) getAdmission(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(s.admission.Stats())
+}
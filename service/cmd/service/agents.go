@@ -0,0 +1,159 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"kappa-v2/pkg/logger"
+	"kappa-v2/service/internal/audit"
+	"kappa-v2/service/internal/kappa"
+	"net/http"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// Runtimes attaching to external functions hold a lease they renew by
+// attaching again, a minute long unless they ask for another between these
+// bounds
+const (
+	defaultAgentLease = time.Minute
+	minAgentLease     = 5 * time.Second
+	maxAgentLease     = 10 * time.Minute
+)
+
+// agentSubject is who the agent token authenticates, in the audit log
+const agentSubject = "agent"
+
+// agentOnly wraps the handlers runtimes started outside the service call to
+// attach themselves. They are off unless KAPPA_AGENT_TOKEN is set, and then
+// need it as a bearer token.
+func (s *KappaService) agentOnly(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if s.agentToken == "" {
+			http.Error(w, "Agent handshake is disabled, set KAPPA_AGENT_TOKEN to enable it", http.StatusForbidden)
+			return
+		}
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || subtle.ConstantTimeCompare([]byte(token), []byte(s.agentToken)) != 1 {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next(w, r)
+	}
+}
+
+// agentHandshake is what a runtime sends to attach itself.
+type agentHandshake struct {
+	// Function is the external function the runtime serves, registered
+	// in Project when it isn't yet
+	Function string `json:"function"`
+	Project  string `json:"project,omitempty"`
+	// URL is where the service reaches the runtime, sending Token as a
+	// bearer token when set
+	URL   string `json:"url"`
+	Token string `json:"token,omitempty"`
+	// LeaseSeconds is how long the runtime stays attached unless it
+	// attaches again
+	LeaseSeconds int `json:"leaseSeconds,omitempty"`
+}
+
+func (h agentHandshake) lease() (time.Duration, error) {
+	if h.LeaseSeconds == 0 {
+		return defaultAgentLease, nil
+	}
+	lease := time.Duration(h.LeaseSeconds) * time.Second
+	if lease < minAgentLease || lease > maxAgentLease {
+		return 0, fmt.Errorf("leaseSeconds must be between %d and %d", int(minAgentLease.Seconds()), int(maxAgentLease.Seconds()))
+	}
+	return lease, nil
+}
+
+// HTTP handler for a runtime started by a supervisor of its own attaching
+// itself, so the function's invocations are sent to it. A function that
+// isn't registered yet is registered as external, with defaults.
+func (s *KappaService) attachAgent(w http.ResponseWriter, r *http.Request) {
+	var req agentHandshake
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, fmt.Sprintf("Invalid request: %v", err), http.StatusBadRequest)
+		return
+	}
+	if req.Function == "" || req.URL == "" {
+		http.Error(w, "Missing required fields: function, url", http.StatusBadRequest)
+		return
+	}
+	lease, err := req.lease()
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Invalid lease: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	status := "attached"
+	fn, _, exists := s.lookup(req.Function)
+	if !exists {
+		if s.maintenanceMode().Enabled {
+			http.Error(w, "Service is in maintenance mode", http.StatusServiceUnavailable)
+			return
+		}
+		config := KappaFunctionConfig{Name: req.Function, Project: req.Project, Mode: string(kappa.ModeExternal)}
+		prepared, regErr := s.prepareFunction(&config)
+		if regErr != nil {
+			http.Error(w, regErr.msg, regErr.status)
+			return
+		}
+		s.commitFunction(config, prepared)
+		s.audit.Record(audit.Entry{
+			Actor:    agentSubject,
+			Action:   "function.selfRegister",
+			Function: req.Function,
+			Project:  req.Project,
+			Detail:   map[string]any{"url": req.URL},
+		})
+		fn, status = prepared, "registered"
+	} else if fn.Mode() != kappa.ModeExternal {
+		http.Error(w, fmt.Sprintf("Function %s is run by the service, register it with mode external to attach runtimes", req.Function), http.StatusConflict)
+		return
+	}
+
+	if err := fn.Attach(req.URL, req.Token, lease); err != nil {
+		http.Error(w, fmt.Sprintf("Failed to attach runtime: %v", err), http.StatusBadRequest)
+		return
+	}
+	attached, _ := fn.Attached()
+	logger.FromCtx(r.Context()).Info("Runtime attached", zap.String("name", req.Function), zap.String("url", attached.URL), zap.Time("expiresAt", attached.ExpiresAt))
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{
+		"name":         req.Function,
+		"status":       status,
+		"url":          attached.URL,
+		"expiresAt":    attached.ExpiresAt,
+		"leaseSeconds": int(lease.Seconds()),
+	})
+}
+
+// HTTP handler for a runtime detaching itself before it stops
+func (s *KappaService) detachAgent(w http.ResponseWriter, r *http.Request) {
+	var req agentHandshake
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, fmt.Sprintf("Invalid request: %v", err), http.StatusBadRequest)
+		return
+	}
+	fn, _, exists := s.lookup(req.Function)
+	if !exists {
+		http.Error(w, fmt.Sprintf("Function not found: %s", req.Function), http.StatusNotFound)
+		return
+	}
+	if !fn.Detach(req.URL) {
+		http.Error(w, fmt.Sprintf("Runtime not attached: %s", req.URL), http.StatusNotFound)
+		return
+	}
+	logger.FromCtx(r.Context()).Info("Runtime detached", zap.String("name", req.Function), zap.String("url", req.URL))
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{
+		"name":   req.Function,
+		"status": "detached",
+	})
+}
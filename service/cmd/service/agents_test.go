@@ -0,0 +1,90 @@
+package main
+
+import (
+	"kappa-v2/service/internal/audit"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAttachAgent(t *testing.T) {
+	s := newTestService(t)
+	runtime := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"statusCode":200,"body":"served"}`))
+	}))
+	defer runtime.Close()
+	agent := []string{"Authorization", "Bearer " + testAgentToken}
+
+	// An unknown function is registered as external by its first runtime
+	rec := do(t, s, "POST", "/agents/attach", map[string]any{"function": "orders", "project": "", "url": runtime.URL}, agent...)
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	attached := decode(t, rec)
+	assert.Equal(t, "registered", attached["status"])
+	assert.Equal(t, float64(60), attached["leaseSeconds"])
+	assert.Equal(t, "external", s.config("orders").Mode)
+	entries := s.audit.List(func(e audit.Entry) bool { return e.Action == "function.selfRegister" })
+	require.Len(t, entries, 1)
+	assert.Equal(t, agentSubject, entries[0].Actor)
+
+	rec = do(t, s, "POST", "/functions/orders", map[string]any{})
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+
+	// Attaching again renews the lease
+	rec = do(t, s, "POST", "/agents/attach", map[string]any{"function": "orders", "url": runtime.URL, "leaseSeconds": 30}, agent...)
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	assert.Equal(t, "attached", decode(t, rec)["status"])
+	assert.Equal(t, float64(30), decode(t, rec)["leaseSeconds"])
+
+	rec = do(t, s, "POST", "/agents/detach", map[string]any{"function": "orders", "url": runtime.URL}, agent...)
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	assert.Equal(t, "detached", decode(t, rec)["status"])
+	fn, _, _ := s.lookup("orders")
+	_, stillAttached := fn.Attached()
+	assert.False(t, stillAttached)
+	rec = do(t, s, "POST", "/agents/detach", map[string]any{"function": "orders", "url": runtime.URL}, agent...)
+	assert.Equal(t, http.StatusNotFound, rec.Code)
+}
+
+func TestAttachAgent_Errors(t *testing.T) {
+	s := newTestService(t)
+	registerFake(t, s, map[string]any{"name": "managed"}, func(w http.ResponseWriter, r *http.Request) {})
+	agent := []string{"Authorization", "Bearer " + testAgentToken}
+
+	tests := []struct {
+		name   string
+		path   string
+		body   any
+		header []string
+		want   int
+	}{
+		{"no token", "/agents/attach", map[string]any{"function": "orders", "url": "http://127.0.0.1:1"}, nil, http.StatusUnauthorized},
+		{"wrong token", "/agents/attach", map[string]any{"function": "orders", "url": "http://127.0.0.1:1"}, []string{"Authorization", "Bearer nope"}, http.StatusUnauthorized},
+		{"invalid body", "/agents/attach", "{", agent, http.StatusBadRequest},
+		{"missing url", "/agents/attach", map[string]any{"function": "orders"}, agent, http.StatusBadRequest},
+		{"lease too short", "/agents/attach", map[string]any{"function": "orders", "url": "http://127.0.0.1:1", "leaseSeconds": 1}, agent, http.StatusBadRequest},
+		{"lease too long", "/agents/attach", map[string]any{"function": "orders", "url": "http://127.0.0.1:1", "leaseSeconds": 3600}, agent, http.StatusBadRequest},
+		{"function run by the service", "/agents/attach", map[string]any{"function": "managed", "url": "http://127.0.0.1:1"}, agent, http.StatusConflict},
+		{"detach unknown function", "/agents/detach", map[string]any{"function": "orders", "url": "http://127.0.0.1:1"}, agent, http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := do(t, s, "POST", tt.path, tt.body, tt.header...)
+			assert.Equal(t, tt.want, rec.Code, rec.Body.String())
+		})
+	}
+	_, _, exists := s.lookup("orders")
+	assert.False(t, exists, "failed handshakes register nothing")
+
+	// Nothing registers itself during maintenance
+	rec := do(t, s, "PUT", "/maintenance", map[string]any{"enabled": true})
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	rec = do(t, s, "POST", "/agents/attach", map[string]any{"function": "orders", "url": "http://127.0.0.1:1"}, agent...)
+	assert.Equal(t, http.StatusServiceUnavailable, rec.Code)
+
+	s.agentToken = ""
+	rec = do(t, s, "POST", "/agents/attach", map[string]any{"function": "orders", "url": "http://127.0.0.1:1"}, agent...)
+	assert.Equal(t, http.StatusForbidden, rec.Code)
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"kappa-v2/pkg/logger"
+	"kappa-v2/service/internal/kappa"
+	"kappa-v2/service/internal/results"
+	"net/http"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+	"go.uber.org/zap"
+)
+
+// HTTP handler for invoking a function without waiting for it. The event is
+// stored as a pending job and invoked in the background, the caller gets
+// the job's ID to poll GET /jobs/{id} with.
+func (s *KappaService) invokeFunctionAsync(w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["name"]
+
+	fn, _, exists := s.lookup(name)
+	if !exists {
+		http.Error(w, fmt.Sprintf("Function not found: %s", name), http.StatusNotFound)
+		return
+	}
+	if fn.Mode() == kappa.ModeTCP {
+		http.Error(w, fmt.Sprintf("Function takes connections on its exposed port: %s", name), http.StatusBadRequest)
+		return
+	}
+	if s.rejectDisabled(w, name, fn) {
+		return
+	}
+
+	event := eventFromRequest(r)
+	templates := s.transform(name)
+	if templates.HasRequest() {
+		if err := transformRequest(templates, r, &event); err != nil {
+			http.Error(w, fmt.Sprintf("Failed to transform request: %v", err), http.StatusBadRequest)
+			return
+		}
+	} else if err := json.NewDecoder(r.Body).Decode(&event.Body); err != nil {
+		http.Error(w, fmt.Sprintf("Invalid request body: %v", err), http.StatusBadRequest)
+		return
+	}
+	encoded, err := kappa.EncodeEvent(event)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Invalid request body: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	now := time.Now().UTC()
+	job := results.Result{
+		ID:        uuid.NewString(),
+		Function:  name,
+		Project:   s.config(name).Project,
+		Status:    results.Pending,
+		CreatedAt: now,
+		ExpiresAt: now.Add(s.resultTTL(name)),
+	}
+	if err := s.results.Put(job); err != nil {
+		http.Error(w, fmt.Sprintf("Failed to enqueue invocation: %v", err), http.StatusInternalServerError)
+		return
+	}
+	go s.runJob(job, encoded)
+
+	w.Header().Set("Location", "/jobs/"+job.ID)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(map[string]string{
+		"id":     job.ID,
+		"status": string(job.Status),
+	})
+}
+
+// resultTTL is how long the named function's results are kept.
+func (s *KappaService) resultTTL(name string) time.Duration {
+	return time.Duration(s.effectiveSettings(s.config(name)).ResultTTLMs.Value) * time.Millisecond
+}
+
+// runJob invokes the job's function once admitted, storing its response,
+// redacted and sealed, as the job's result. The function is looked up again
+// so a job runs what is registered by the time it is admitted.
+func (s *KappaService) runJob(job results.Result, event *kappa.EncodedEvent) {
+	log := logger.Get().With(zap.String("job", job.ID), zap.String("name", job.Function))
+	finish := func(status results.Status) {
+		completed := time.Now().UTC()
+		job.Status = status
+		job.CompletedAt = &completed
+		if err := s.results.Put(job); err != nil {
+			log.Error("Failed to store job result", zap.Error(err))
+		}
+	}
+
+	if err := s.admission.Acquire(context.Background(), s.priority(job.Function)); err != nil {
+		job.Error = fmt.Sprintf("Service is saturated: %v", err)
+		finish(results.Failed)
+		return
+	}
+	defer s.admission.Release()
+
+	fn, _, exists := s.lookup(job.Function)
+	if !exists {
+		job.Error = fmt.Sprintf("Function not found: %s", job.Function)
+		finish(results.Failed)
+		return
+	}
+	job.Status = results.Running
+	if err := s.results.Put(job); err != nil {
+		log.Warn("Failed to mark job running", zap.Error(err))
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), fn.Timeout())
+	defer cancel()
+	resp, err := s.invokeWithFaults(ctx, job.Function, fn, event)
+	if err != nil {
+		job.Error = fmt.Sprintf("Function invocation failed: %v", err)
+		finish(results.Failed)
+		return
+	}
+
+	policy := s.config(job.Function).Redact
+	job.StatusCode = resp.StatusCode
+	job.Headers = policy.RedactHeaders(resp.Headers)
+	if body := policy.RedactBody(resp.Body); body != nil {
+		if job.Body, err = s.payloads.Seal(body); err != nil {
+			job.Error = fmt.Sprintf("Failed to seal response: %v", err)
+			finish(results.Failed)
+			return
+		}
+	}
+	if resp.StatusCode >= 400 {
+		finish(results.Failed)
+		return
+	}
+	finish(results.Succeeded)
+}
+
+// failInterruptedJobs fails the jobs that were pending or running when the
+// service last stopped, as nothing is going to finish them.
+func (s *KappaService) failInterruptedJobs() {
+	for _, status := range []results.Status{results.Pending, results.Running} {
+		jobs, err := s.results.List(results.Filter{Status: status})
+		if err != nil {
+			logger.Get().Error("Failed to list interrupted jobs", zap.Error(err))
+			return
+		}
+		for _, job := range jobs {
+			completed := time.Now().UTC()
+			job.Status = results.Failed
+			job.Error = "Interrupted by the service restarting"
+			job.CompletedAt = &completed
+			if err := s.results.Put(job); err != nil {
+				logger.Get().Error("Failed to fail interrupted job", zap.String("job", job.ID), zap.Error(err))
+			}
+		}
+		if len(jobs) > 0 {
+			logger.Get().Warn("Failed interrupted jobs", zap.String("status", string(status)), zap.Int("count", len(jobs)))
+		}
+	}
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"kappa-v2/service/internal/results"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// awaitJob polls a job until it is no longer pending or running.
+func awaitJob(t *testing.T, s *KappaService, location string) map[string]any {
+	t.Helper()
+	var job map[string]any
+	require.Eventually(t, func() bool {
+		rec := do(t, s, "GET", location, nil)
+		require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+		job = decode(t, rec)
+		return job["status"] != string(results.Pending) && job["status"] != string(results.Running)
+	}, 5*time.Second, 20*time.Millisecond)
+	return job
+}
+
+func TestInvokeFunctionAsync(t *testing.T) {
+	s := newTestService(t)
+	attachRuntime(t, s, "orders", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"ok":true}`))
+	})
+
+	rec := do(t, s, "POST", "/functions/orders/invoke-async", map[string]any{"n": 1})
+	require.Equal(t, http.StatusAccepted, rec.Code, rec.Body.String())
+	accepted := decode(t, rec)
+	assert.Equal(t, string(results.Pending), accepted["status"])
+	location := rec.Header().Get("Location")
+	assert.Equal(t, "/jobs/"+accepted["id"].(string), location)
+
+	job := awaitJob(t, s, location)
+	assert.Equal(t, string(results.Succeeded), job["status"])
+	assert.Equal(t, float64(http.StatusOK), job["statusCode"])
+	assert.Equal(t, map[string]any{"ok": true}, job["body"])
+	assert.Equal(t, "orders", job["function"])
+}
+
+func TestInvokeFunctionAsync_Errors(t *testing.T) {
+	s := newTestService(t)
+	attachRuntime(t, s, "orders", func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "boom", http.StatusInternalServerError)
+	})
+
+	// A function answering with an error fails the job
+	rec := do(t, s, "POST", "/functions/orders/invoke-async", map[string]any{})
+	require.Equal(t, http.StatusAccepted, rec.Code, rec.Body.String())
+	job := awaitJob(t, s, rec.Header().Get("Location"))
+	assert.Equal(t, string(results.Failed), job["status"])
+	assert.Equal(t, float64(http.StatusInternalServerError), job["statusCode"])
+
+	rec = do(t, s, "POST", "/functions/orders/invoke-async", "{")
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+	rec = do(t, s, "POST", "/functions/missing/invoke-async", map[string]any{})
+	assert.Equal(t, http.StatusNotFound, rec.Code)
+	rec = do(t, s, "GET", "/jobs/missing", nil)
+	assert.Equal(t, http.StatusNotFound, rec.Code)
+
+	rec = do(t, s, "POST", "/functions/orders/disable", nil)
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	rec = do(t, s, "POST", "/functions/orders/invoke-async", map[string]any{})
+	assert.Equal(t, http.StatusServiceUnavailable, rec.Code)
+}
+
+func TestFailInterruptedJobs(t *testing.T) {
+	dir := t.TempDir()
+	s := newTestServiceIn(t, dir)
+	now := time.Now().UTC()
+	require.NoError(t, s.results.Put(results.Result{
+		ID: "interrupted", Function: "orders", Status: results.Running, CreatedAt: now, ExpiresAt: now.Add(time.Hour),
+	}))
+	stopTestService(s)
+
+	s = newTestServiceIn(t, dir)
+	rec := do(t, s, "GET", "/jobs/interrupted", nil)
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	job := decode(t, rec)
+	assert.Equal(t, string(results.Failed), job["status"])
+	assert.Equal(t, "Interrupted by the service restarting", job["error"])
+}
@@ -0,0 +1,314 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"kappa-v2/pkg/logger"
+	"kappa-v2/service/internal/kappa"
+	"kappa-v2/service/internal/rbac"
+	"net/http"
+	"strconv"
+	"sync"
+
+	"github.com/gorilla/mux"
+	"go.uber.org/zap"
+)
+
+const (
+	// defaultBatchConcurrency is how many events of a batch run at once
+	// unless the request asks for another limit
+	defaultBatchConcurrency = 4
+	maxBatchConcurrency     = 32
+	maxBatchSize            = 1000
+)
+
+// batchItemResult is the outcome of one function in a batch registration.
+type batchItemResult struct {
+	Name   string `json:"name"`
+	Status string `json:"status"`
+	SHA256 string `json:"sha256,omitempty"`
+	Error  string `json:"error,omitempty"`
+}
+
+// HTTP handler for registering or updating many functions at once. Either
+// every function is registered or, if any of them is rejected, none are.
+func (s *KappaService) batchRegisterFunctions(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Functions []KappaFunctionConfig `json:"functions"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, fmt.Sprintf("Invalid request: %v", err), http.StatusBadRequest)
+		return
+	}
+	if len(req.Functions) == 0 || len(req.Functions) > maxBatchSize {
+		http.Error(w, fmt.Sprintf("A batch needs between 1 and %d functions", maxBatchSize), http.StatusBadRequest)
+		return
+	}
+
+	results := make([]batchItemResult, len(req.Functions))
+	prepared := make([]*kappa.KappaFunction, len(req.Functions))
+	seen := make(map[string]bool)
+	failed := false
+	for i := range req.Functions {
+		config := &req.Functions[i]
+		results[i].Name = config.Name
+
+		if seen[config.Name] {
+			results[i].Status = "error"
+			results[i].Error = fmt.Sprintf("Duplicate function in batch: %s", config.Name)
+			failed = true
+			continue
+		}
+		seen[config.Name] = true
+
+		if !s.allowed(r.Context(), rbac.Deploy, s.deployTargets(config.Name, config.Project)...) {
+			results[i].Status = "error"
+			results[i].Error = fmt.Sprintf("Forbidden: may not deploy %s to %s", config.Name, projectLabel(config.Project))
+			failed = true
+			continue
+		}
+		fn, regErr := s.prepareFunction(config)
+		if regErr != nil {
+			results[i].Status = "error"
+			results[i].Error = regErr.msg
+			failed = true
+			continue
+		}
+		prepared[i] = fn
+		results[i].SHA256 = fn.ArtifactDigest
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+
+	if failed {
+		// Roll back, dropping the references taken on the binaries
+		for i, fn := range prepared {
+			if fn == nil {
+				continue
+			}
+			s.releaseFunction(fn)
+			results[i].Status = "rolledBack"
+		}
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]any{
+			"status":    "failed",
+			"functions": results,
+		})
+		return
+	}
+
+	for i, fn := range prepared {
+		s.commitFunction(req.Functions[i], fn)
+		results[i].Status = "registered"
+	}
+	logger.FromCtx(r.Context()).Info("Function batch registered", zap.Int("count", len(prepared)))
+
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(map[string]any{
+		"status":    "registered",
+		"functions": results,
+	})
+}
+
+// invokeResult is the outcome of invoking a function with one event of a batch.
+type invokeResult struct {
+	Index      int               `json:"index"`
+	StatusCode int               `json:"statusCode,omitempty"`
+	Headers    map[string]string `json:"headers,omitempty"`
+	// Body is the handler's JSON response, or a string when it isn't JSON
+	Body     any    `json:"body,omitempty"`
+	Attempts int    `json:"attempts,omitempty"`
+	Error    string `json:"error,omitempty"`
+}
+
+// failed reports whether the invocation errored or the handler returned an error status.
+func (r invokeResult) failed() bool {
+	return r.Error != "" || r.StatusCode >= 400
+}
+
+// fanOut invokes fn once per body, at most concurrency at a time, returning
+// the results in the order of bodies. What the invocations share of the
+// event is encoded once, only each body is encoded on its own.
+func (s *KappaService) fanOut(ctx context.Context, fn *kappa.KappaFunction, base kappa.KappaEvent, bodies []map[string]any, concurrency int) []invokeResult {
+	results := make([]invokeResult, len(bodies))
+	shared, err := kappa.EncodeEvent(base)
+	if err != nil {
+		for i := range results {
+			results[i] = invokeResult{Index: i, Error: err.Error()}
+		}
+		return results
+	}
+	sem := make(chan struct{}, concurrency)
+	var wg sync.WaitGroup
+	for i, body := range bodies {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func() {
+			defer wg.Done()
+			defer func() { <-sem }()
+
+			event, err := shared.WithBody(body)
+			if err != nil {
+				results[i] = invokeResult{Index: i, Error: err.Error()}
+				return
+			}
+			if base.RequestID != "" {
+				// Each invocation gets its own ID under the request's
+				event = event.WithRequestID(fmt.Sprintf("%s-%d", base.RequestID, i))
+			}
+			results[i] = s.invoke(ctx, fn, i, event)
+		}()
+	}
+	wg.Wait()
+	return results
+}
+
+func (s *KappaService) invoke(ctx context.Context, fn *kappa.KappaFunction, index int, event *kappa.EncodedEvent) invokeResult {
+	result := invokeResult{Index: index}
+	if err := s.admission.Acquire(ctx, s.priority(fn.Name)); err != nil {
+		result.StatusCode = http.StatusServiceUnavailable
+		result.Error = err.Error()
+		return result
+	}
+	defer s.admission.Release()
+
+	ctx, cancel := context.WithTimeout(ctx, fn.Timeout())
+	defer cancel()
+
+	resp, err := s.invokeWithFaults(ctx, fn.Name, fn, event)
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+
+	result.StatusCode = resp.StatusCode
+	result.Headers = resp.Headers
+	result.Attempts = resp.Attempts
+	if json.Valid(resp.Body) {
+		result.Body = resp.Body
+	} else if len(resp.Body) > 0 {
+		result.Body = string(resp.Body)
+	}
+	return result
+}
+
+// concurrencyLimit bounds a requested concurrency to what the service allows.
+func concurrencyLimit(requested int) int {
+	if requested <= 0 {
+		return defaultBatchConcurrency
+	}
+	return min(requested, maxBatchConcurrency)
+}
+
+// HTTP handler for invoking a function with a list of events, returning
+// the result of each
+func (s *KappaService) batchInvokeFunction(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	name := vars["name"]
+
+	fn, _, exists := s.lookup(name)
+	if !exists {
+		http.Error(w, fmt.Sprintf("Function not found: %s", name), http.StatusNotFound)
+		return
+	}
+	if s.rejectDisabled(w, name, fn) {
+		return
+	}
+
+	var req struct {
+		Events      []map[string]any `json:"events"`
+		Concurrency int              `json:"concurrency"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, fmt.Sprintf("Invalid request body: %v", err), http.StatusBadRequest)
+		return
+	}
+	if len(req.Events) == 0 || len(req.Events) > maxBatchSize {
+		http.Error(w, fmt.Sprintf("A batch needs between 1 and %d events", maxBatchSize), http.StatusBadRequest)
+		return
+	}
+
+	results := s.fanOut(r.Context(), fn, eventFromRequest(r), req.Events, concurrencyLimit(req.Concurrency))
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{
+		"results": results,
+	})
+}
+
+// mapFailure describes an element whose invocation failed.
+type mapFailure struct {
+	Index      int    `json:"index"`
+	StatusCode int    `json:"statusCode,omitempty"`
+	Body       any    `json:"body,omitempty"`
+	Error      string `json:"error,omitempty"`
+}
+
+// HTTP handler for mapping a function over a JSON array, invoking it once
+// per element concurrently and aggregating the results. Object elements are
+// the event body as is, anything else is passed as {"item": element}.
+func (s *KappaService) mapFunction(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	name := vars["name"]
+
+	fn, _, exists := s.lookup(name)
+	if !exists {
+		http.Error(w, fmt.Sprintf("Function not found: %s", name), http.StatusNotFound)
+		return
+	}
+	if s.rejectDisabled(w, name, fn) {
+		return
+	}
+
+	parallelism := 0
+	if v := r.URL.Query().Get("parallelism"); v != "" {
+		var err error
+		if parallelism, err = strconv.Atoi(v); err != nil || parallelism < 1 {
+			http.Error(w, fmt.Sprintf("Invalid parallelism: %s", v), http.StatusBadRequest)
+			return
+		}
+	}
+
+	var items []json.RawMessage
+	if err := json.NewDecoder(r.Body).Decode(&items); err != nil {
+		http.Error(w, fmt.Sprintf("Invalid request body, expected a JSON array: %v", err), http.StatusBadRequest)
+		return
+	}
+	if len(items) == 0 || len(items) > maxBatchSize {
+		http.Error(w, fmt.Sprintf("A map needs between 1 and %d elements", maxBatchSize), http.StatusBadRequest)
+		return
+	}
+
+	bodies := make([]map[string]any, len(items))
+	for i, item := range items {
+		if err := json.Unmarshal(item, &bodies[i]); err != nil || bodies[i] == nil {
+			bodies[i] = map[string]any{"item": item}
+		}
+	}
+
+	results := s.fanOut(r.Context(), fn, eventFromRequest(r), bodies, concurrencyLimit(parallelism))
+
+	outputs := make([]any, len(results))
+	failures := make([]mapFailure, 0)
+	for i, result := range results {
+		if result.failed() {
+			failures = append(failures, mapFailure{
+				Index:      i,
+				StatusCode: result.StatusCode,
+				Body:       result.Body,
+				Error:      result.Error,
+			})
+			continue
+		}
+		outputs[i] = result.Body
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{
+		"results":   outputs,
+		"succeeded": len(results) - len(failures),
+		"failed":    len(failures),
+		"failures":  failures,
+	})
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBatchRegisterFunctions(t *testing.T) {
+	s := newTestService(t)
+
+	rec := do(t, s, "POST", "/functions:batch", map[string]any{"functions": []map[string]any{
+		{"name": "orders", "mode": "external"},
+		{"name": "billing", "mode": "external"},
+	}})
+	require.Equal(t, http.StatusCreated, rec.Code, rec.Body.String())
+	var registered struct {
+		Status    string            `json:"status"`
+		Functions []batchItemResult `json:"functions"`
+	}
+	require.NoError(t, decodeInto(rec, &registered))
+	assert.Equal(t, "registered", registered.Status)
+	require.Len(t, registered.Functions, 2)
+	assert.Equal(t, "registered", registered.Functions[1].Status)
+	for _, name := range []string{"orders", "billing"} {
+		_, _, exists := s.lookup(name)
+		assert.True(t, exists, name)
+	}
+
+	// One function rejected rolls the others back
+	rec = do(t, s, "POST", "/functions:batch", map[string]any{"functions": []map[string]any{
+		{"name": "shipping", "mode": "external"},
+		{"name": "shipping", "mode": "external"},
+	}})
+	require.Equal(t, http.StatusBadRequest, rec.Code, rec.Body.String())
+	var failed struct {
+		Status    string            `json:"status"`
+		Functions []batchItemResult `json:"functions"`
+	}
+	require.NoError(t, decodeInto(rec, &failed))
+	assert.Equal(t, "failed", failed.Status)
+	assert.Equal(t, "rolledBack", failed.Functions[0].Status)
+	assert.Equal(t, "error", failed.Functions[1].Status)
+	assert.Contains(t, failed.Functions[1].Error, "Duplicate function in batch: shipping")
+	_, _, exists := s.lookup("shipping")
+	assert.False(t, exists)
+
+	rec = do(t, s, "POST", "/functions:batch", map[string]any{"functions": []map[string]any{}})
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+}
+
+func TestBatchInvokeFunction(t *testing.T) {
+	s := newTestService(t)
+	register(t, s, map[string]any{"name": "echo", "mode": "external"})
+	attachRuntime(t, s, "echo", func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(w, r.Body)
+	})
+
+	rec := do(t, s, "POST", "/functions/echo/invoke:batch", map[string]any{
+		"events":      []map[string]any{{"n": 0}, {"n": 1}, {"n": 2}},
+		"concurrency": 2,
+	})
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	var batch struct {
+		Results []struct {
+			Index      int `json:"index"`
+			StatusCode int `json:"statusCode"`
+			Body       struct {
+				Body map[string]any `json:"body"`
+			} `json:"body"`
+			Error string `json:"error"`
+		} `json:"results"`
+	}
+	require.NoError(t, decodeInto(rec, &batch))
+	require.Len(t, batch.Results, 3)
+	for i, result := range batch.Results {
+		assert.Equal(t, i, result.Index)
+		assert.Empty(t, result.Error)
+		assert.Equal(t, http.StatusOK, result.StatusCode)
+		assert.Equal(t, float64(i), result.Body.Body["n"], "results are in the order of the events")
+	}
+
+	rec = do(t, s, "POST", "/functions/echo/invoke:batch", map[string]any{"events": []map[string]any{}})
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+	rec = do(t, s, "POST", "/functions/missing/invoke:batch", map[string]any{"events": []map[string]any{{}}})
+	assert.Equal(t, http.StatusNotFound, rec.Code)
+}
+
+func TestMapFunction(t *testing.T) {
+	s := newTestService(t)
+	register(t, s, map[string]any{"name": "double", "mode": "external"})
+	attachRuntime(t, s, "double", func(w http.ResponseWriter, r *http.Request) {
+		var event struct {
+			Body struct {
+				Item float64 `json:"item"`
+			} `json:"body"`
+		}
+		body, _ := io.ReadAll(r.Body)
+		if err := json.Unmarshal(body, &event); err != nil || event.Body.Item < 0 {
+			w.WriteHeader(http.StatusUnprocessableEntity)
+			w.Write([]byte(`{"error":"negative"}`))
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]float64{"doubled": event.Body.Item * 2})
+	})
+
+	rec := do(t, s, "POST", "/functions/double/map?parallelism=2", "[1, 2, -3, 4]")
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	var mapped struct {
+		Results   []map[string]float64 `json:"results"`
+		Succeeded int                  `json:"succeeded"`
+		Failed    int                  `json:"failed"`
+		Failures  []mapFailure         `json:"failures"`
+	}
+	require.NoError(t, decodeInto(rec, &mapped))
+	assert.Equal(t, 3, mapped.Succeeded)
+	assert.Equal(t, 1, mapped.Failed)
+	require.Len(t, mapped.Results, 4)
+	assert.Equal(t, map[string]float64{"doubled": 2}, mapped.Results[0])
+	assert.Equal(t, map[string]float64{"doubled": 8}, mapped.Results[3])
+	assert.Nil(t, mapped.Results[2], "failed elements are listed under failures")
+	require.Len(t, mapped.Failures, 1)
+	assert.Equal(t, 2, mapped.Failures[0].Index)
+	assert.Equal(t, http.StatusUnprocessableEntity, mapped.Failures[0].StatusCode)
+
+	rec = do(t, s, "POST", "/functions/double/map", `{"not": "an array"}`)
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+	rec = do(t, s, "POST", "/functions/double/map?parallelism=0", "[1]")
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+	rec = do(t, s, "POST", "/functions/missing/map", "[1]")
+	assert.Equal(t, http.StatusNotFound, rec.Code)
+}
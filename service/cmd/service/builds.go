@@ -0,0 +1,113 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"kappa-v2/service/internal/rbac"
+	"net/http"
+
+	"github.com/gorilla/mux"
+)
+
+// HTTP handler for building a runtime function's code into an image,
+// registering the function to run from it once the image is pushed
+func (s *KappaService) startBuild(w http.ResponseWriter, r *http.Request) {
+	if s.builds == nil {
+		http.Error(w, "Builds are not configured, set KAPPA_BUILD_REGISTRY", http.StatusNotImplemented)
+		return
+	}
+
+	var config KappaFunctionConfig
+	if err := json.NewDecoder(r.Body).Decode(&config); err != nil {
+		http.Error(w, fmt.Sprintf("Invalid request: %v", err), http.StatusBadRequest)
+		return
+	}
+	if config.Runtime == nil {
+		http.Error(w, "Missing required fields: runtime", http.StatusBadRequest)
+		return
+	}
+	if config.Runtime.Image != "" {
+		http.Error(w, "Invalid runtime: image is set by the build", http.StatusBadRequest)
+		return
+	}
+	if !s.allowed(r.Context(), rbac.Deploy, s.deployTargets(config.Name, config.Project)...) {
+		http.Error(w, fmt.Sprintf("Forbidden: may not deploy %s to %s", config.Name, projectLabel(config.Project)), http.StatusForbidden)
+		return
+	}
+
+	// Check the function would register before building it, it is
+	// registered again with the image once the build is done
+	if _, regErr := s.prepareFunction(&config); regErr != nil {
+		http.Error(w, regErr.msg, regErr.status)
+		return
+	}
+
+	b, err := s.builds.Start(config.Name, config.Project, *config.Runtime, func(image string) error {
+		built := config
+		runtime := *config.Runtime
+		runtime.Image = image
+		built.Runtime = &runtime
+		fn, regErr := s.prepareFunction(&built)
+		if regErr != nil {
+			return errors.New(regErr.msg)
+		}
+		s.commitFunction(built, fn)
+		return nil
+	})
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Invalid runtime: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Location", "/builds/"+b.ID)
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(b)
+}
+
+// HTTP handler for listing recent builds, without their logs
+func (s *KappaService) listBuilds(w http.ResponseWriter, r *http.Request) {
+	if s.builds == nil {
+		http.Error(w, "Builds are not configured, set KAPPA_BUILD_REGISTRY", http.StatusNotImplemented)
+		return
+	}
+
+	builds := s.builds.List()
+	visible := builds[:0]
+	for _, b := range builds {
+		if s.allowed(r.Context(), rbac.Read, b.Project) {
+			visible = append(visible, b)
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{
+		"builds": visible,
+	})
+}
+
+// HTTP handler for getting a build with its logs
+func (s *KappaService) getBuild(w http.ResponseWriter, r *http.Request) {
+	if s.builds == nil {
+		http.Error(w, "Builds are not configured, set KAPPA_BUILD_REGISTRY", http.StatusNotImplemented)
+		return
+	}
+
+	id := mux.Vars(r)["id"]
+	b, ok := s.builds.Get(id)
+	if !ok {
+		http.Error(w, fmt.Sprintf("Build not found: %s", id), http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(b)
+}
+
+// buildProject is the project of the build a request is about
+func (s *KappaService) buildProject(r *http.Request) string {
+	if s.builds == nil {
+		return ""
+	}
+	b, _ := s.builds.Get(mux.Vars(r)["id"])
+	return b.Project
+}
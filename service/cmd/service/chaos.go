@@ -0,0 +1,262 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"kappa-v2/pkg/logger"
+	"kappa-v2/service/internal/kappa"
+	"kappa-v2/service/internal/rbac"
+	"maps"
+	"math/rand/v2"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"go.uber.org/zap"
+)
+
+// maxFaultDuration bounds how long a fault can be injected for, so a
+// forgotten experiment ends on its own
+const maxFaultDuration = 24 * time.Hour
+
+// Fault is injected into a function's invocations for a while, to check
+// retries and circuit breakers cope. Each percentage applies independently.
+type Fault struct {
+	// LatencyMs is added before every invocation
+	LatencyMs int `json:"latencyMs,omitempty"`
+	// ErrorPercent of invocations fail with a 500 without reaching the function
+	ErrorPercent float64 `json:"errorPercent,omitempty"`
+	// ColdStartPercent of invocations stop the runtime first, forcing a cold start
+	ColdStartPercent float64 `json:"coldStartPercent,omitempty"`
+	// KillPercent of invocations kill the runtime as if it crashed, so
+	// they hit a dead runtime
+	KillPercent float64 `json:"killPercent,omitempty"`
+	// DurationMs is how long the fault lasts
+	DurationMs int       `json:"durationMs"`
+	ExpiresAt  time.Time `json:"expiresAt"`
+	// Injected counts the invocations the fault changed
+	Injected map[string]uint64 `json:"injected,omitempty"`
+}
+
+func (f Fault) validate() error {
+	if f.DurationMs <= 0 || time.Duration(f.DurationMs)*time.Millisecond > maxFaultDuration {
+		return fmt.Errorf("durationMs must be above 0 and at most %s", maxFaultDuration)
+	}
+	if f.LatencyMs < 0 {
+		return fmt.Errorf("latencyMs must not be negative")
+	}
+	for name, p := range map[string]float64{
+		"errorPercent":     f.ErrorPercent,
+		"coldStartPercent": f.ColdStartPercent,
+		"killPercent":      f.KillPercent,
+	} {
+		if p < 0 || p > 100 {
+			return fmt.Errorf("%s must be between 0 and 100", name)
+		}
+	}
+	return nil
+}
+
+// faults are the faults being injected, by function name.
+type faults struct {
+	mu     sync.Mutex
+	active map[string]*Fault
+}
+
+// get returns the named function's fault, dropping it once expired.
+func (f *faults) get(name string) *Fault {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	fault, exists := f.active[name]
+	if !exists {
+		return nil
+	}
+	if time.Now().After(fault.ExpiresAt) {
+		delete(f.active, name)
+		return nil
+	}
+	return fault
+}
+
+// count records that a kind of fault was injected for name.
+func (f *faults) count(name, kind string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if fault, exists := f.active[name]; exists {
+		fault.Injected[kind]++
+	}
+}
+
+// chance reports whether an event with the given percentage happens.
+func chance(percent float64) bool {
+	return percent > 0 && rand.Float64()*100 < percent
+}
+
+// invokeWithFaults invokes fn, first applying any fault injected into it.
+// Injected faults are listed in the response's X-Kappa-Fault header.
+func (s *KappaService) invokeWithFaults(ctx context.Context, name string, fn *kappa.KappaFunction, event *kappa.EncodedEvent) (*kappa.KappaResponse, error) {
+	fault := s.faults.get(name)
+	if fault == nil {
+		return fn.InvokeEncoded(ctx, event)
+	}
+
+	var injected []string
+	inject := func(kind string) {
+		injected = append(injected, kind)
+		s.faults.count(name, kind)
+	}
+
+	if fault.LatencyMs > 0 {
+		inject("latency")
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(time.Duration(fault.LatencyMs) * time.Millisecond):
+		}
+	}
+	if chance(fault.ErrorPercent) {
+		inject("error")
+		return &kappa.KappaResponse{
+			StatusCode: http.StatusInternalServerError,
+			Headers: map[string]string{
+				"Content-Type":  "application/json",
+				"X-Kappa-Fault": strings.Join(injected, ","),
+			},
+			Body:     json.RawMessage(`{"error":"injected fault"}`),
+			Attempts: 1,
+		}, nil
+	}
+	if chance(fault.ColdStartPercent) {
+		inject("coldStart")
+		_ = fn.Stop()
+	}
+	if chance(fault.KillPercent) {
+		inject("kill")
+		_ = fn.Kill()
+	}
+
+	resp, err := fn.InvokeEncoded(ctx, event)
+	if err == nil && len(injected) > 0 {
+		if resp.Headers == nil {
+			resp.Headers = make(map[string]string)
+		}
+		resp.Headers["X-Kappa-Fault"] = strings.Join(injected, ",")
+	}
+	return resp, err
+}
+
+// adminOnly wraps a handler only operators may call. The admin API is off
+// unless KAPPA_ADMIN_TOKEN or an auth provider is set, and then needs the
+// admin token as a bearer token, credentials with the admin scope, or with
+// RBAC the key of a subject who is admin in every project.
+func (s *KappaService) adminOnly(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if s.adminToken == "" && s.authn == nil {
+			http.Error(w, "Admin API is disabled, set KAPPA_ADMIN_TOKEN or an auth provider to enable it", http.StatusForbidden)
+			return
+		}
+		subject, ok := s.authenticate(r)
+		if !ok {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		if !subject.Allowed(rbac.Manage, "") {
+			http.Error(w, fmt.Sprintf("Forbidden: %s may not %s", subject.Name, rbac.Manage), http.StatusForbidden)
+			return
+		}
+		next(w, r.WithContext(context.WithValue(r.Context(), subjectKey{}, subject)))
+	}
+}
+
+// HTTP handler for listing the faults being injected
+func (s *KappaService) listFaults(w http.ResponseWriter, r *http.Request) {
+	s.faults.mu.Lock()
+	now := time.Now()
+	names := make([]string, 0, len(s.faults.active))
+	for name, fault := range s.faults.active {
+		if now.After(fault.ExpiresAt) {
+			delete(s.faults.active, name)
+			continue
+		}
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	active := make(map[string]Fault, len(names))
+	for _, name := range names {
+		fault := *s.faults.active[name]
+		fault.Injected = maps.Clone(fault.Injected)
+		active[name] = fault
+	}
+	s.faults.mu.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{
+		"faults": active,
+	})
+}
+
+// HTTP handler for injecting a fault into a function for a while,
+// replacing any it already has
+func (s *KappaService) putFault(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	name := vars["name"]
+
+	if _, _, exists := s.lookup(name); !exists {
+		http.Error(w, fmt.Sprintf("Function not found: %s", name), http.StatusNotFound)
+		return
+	}
+
+	var fault Fault
+	if err := json.NewDecoder(r.Body).Decode(&fault); err != nil {
+		http.Error(w, fmt.Sprintf("Invalid request: %v", err), http.StatusBadRequest)
+		return
+	}
+	if err := fault.validate(); err != nil {
+		http.Error(w, fmt.Sprintf("Invalid fault: %v", err), http.StatusBadRequest)
+		return
+	}
+	fault.ExpiresAt = time.Now().Add(time.Duration(fault.DurationMs) * time.Millisecond)
+	active := fault
+	active.Injected = make(map[string]uint64)
+
+	s.faults.mu.Lock()
+	s.faults.active[name] = &active
+	s.faults.mu.Unlock()
+
+	logger.FromCtx(r.Context()).Warn("Fault injected",
+		zap.String("name", name),
+		zap.Int("latencyMs", fault.LatencyMs),
+		zap.Float64("errorPercent", fault.ErrorPercent),
+		zap.Float64("coldStartPercent", fault.ColdStartPercent),
+		zap.Float64("killPercent", fault.KillPercent),
+		zap.Time("expiresAt", fault.ExpiresAt))
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(fault)
+}
+
+// HTTP handler for ending a function's fault early
+func (s *KappaService) deleteFault(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	name := vars["name"]
+
+	s.faults.mu.Lock()
+	_, exists := s.faults.active[name]
+	delete(s.faults.active, name)
+	s.faults.mu.Unlock()
+	if !exists {
+		http.Error(w, fmt.Sprintf("No fault injected: %s", name), http.StatusNotFound)
+		return
+	}
+	logger.FromCtx(r.Context()).Info("Fault removed", zap.String("name", name))
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{
+		"name":   name,
+		"status": "removed",
+	})
+}
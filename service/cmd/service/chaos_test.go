@@ -0,0 +1,82 @@
+package main
+
+import (
+	"net/http"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFaults(t *testing.T) {
+	t.Setenv("KAPPA_ADMIN_TOKEN", testAdminToken)
+	s := newTestService(t)
+	admin := []string{"Authorization", "Bearer " + testAdminToken}
+	var reached atomic.Int32
+	registerFake(t, s, map[string]any{"name": "orders"}, func(w http.ResponseWriter, r *http.Request) {
+		reached.Add(1)
+		w.Write([]byte(`{}`))
+	})
+
+	rec := do(t, s, "PUT", "/admin/faults/orders", map[string]any{"errorPercent": 100, "latencyMs": 10, "durationMs": 60000}, admin...)
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	assert.NotEmpty(t, decode(t, rec)["expiresAt"])
+
+	// Every invocation fails without reaching the function
+	rec = do(t, s, "POST", "/functions/orders", map[string]any{})
+	assert.Equal(t, http.StatusInternalServerError, rec.Code)
+	assert.Equal(t, "latency,error", rec.Header().Get("X-Kappa-Fault"))
+	assert.Zero(t, reached.Load())
+
+	rec = do(t, s, "GET", "/admin/faults", nil, admin...)
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	var listed struct {
+		Faults map[string]Fault `json:"faults"`
+	}
+	require.NoError(t, decodeInto(rec, &listed))
+	require.Contains(t, listed.Faults, "orders")
+	assert.Equal(t, map[string]uint64{"latency": 1, "error": 1}, listed.Faults["orders"].Injected)
+
+	rec = do(t, s, "DELETE", "/admin/faults/orders", nil, admin...)
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	assert.Equal(t, "removed", decode(t, rec)["status"])
+	rec = do(t, s, "POST", "/functions/orders", map[string]any{})
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Empty(t, rec.Header().Get("X-Kappa-Fault"))
+	assert.Equal(t, int32(1), reached.Load())
+}
+
+func TestFaults_Rejected(t *testing.T) {
+	t.Setenv("KAPPA_ADMIN_TOKEN", testAdminToken)
+	s := newTestService(t)
+	admin := []string{"Authorization", "Bearer " + testAdminToken}
+	registerFake(t, s, map[string]any{"name": "orders"}, func(w http.ResponseWriter, r *http.Request) {})
+
+	tests := []struct {
+		name   string
+		method string
+		path   string
+		body   any
+		header []string
+		want   int
+	}{
+		{"no token", "PUT", "/admin/faults/orders", map[string]any{"durationMs": 1000}, nil, http.StatusUnauthorized},
+		{"unknown function", "PUT", "/admin/faults/missing", map[string]any{"durationMs": 1000}, admin, http.StatusNotFound},
+		{"no duration", "PUT", "/admin/faults/orders", map[string]any{"errorPercent": 50}, admin, http.StatusBadRequest},
+		{"percent above 100", "PUT", "/admin/faults/orders", map[string]any{"killPercent": 150, "durationMs": 1000}, admin, http.StatusBadRequest},
+		{"negative latency", "PUT", "/admin/faults/orders", map[string]any{"latencyMs": -1, "durationMs": 1000}, admin, http.StatusBadRequest},
+		{"nothing to remove", "DELETE", "/admin/faults/orders", nil, admin, http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := do(t, s, tt.method, tt.path, tt.body, tt.header...)
+			assert.Equal(t, tt.want, rec.Code, rec.Body.String())
+		})
+	}
+
+	// The admin API is off without an admin token
+	s.adminToken = ""
+	rec := do(t, s, "GET", "/admin/faults", nil, admin...)
+	assert.Equal(t, http.StatusForbidden, rec.Code)
+}
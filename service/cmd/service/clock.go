@@ -0,0 +1,37 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"kappa-v2/service/internal/kappa"
+	"time"
+)
+
+// clockInfoTimeout bounds asking a runtime for its clock while inspecting
+const clockInfoTimeout = 2 * time.Second
+
+// clockInfo describes a function's configured clock and, while it runs,
+// its runtime's, with how far that is off the service's.
+func clockInfo(ctx context.Context, fn *kappa.KappaFunction, config *kappa.ClockConfig) map[string]any {
+	info := map[string]any{}
+	if config != nil {
+		info["config"] = config
+	}
+	ctx, cancel := context.WithTimeout(ctx, clockInfoTimeout)
+	defer cancel()
+	clock, err := fn.Clock(ctx)
+	switch {
+	case errors.Is(err, kappa.ErrNotRunning):
+	case err != nil:
+		info["error"] = err.Error()
+	default:
+		info["runtime"] = map[string]any{
+			"time":        clock.Time,
+			"timezone":    clock.Timezone,
+			"locale":      clock.Locale,
+			"skewMs":      clock.Skew.Milliseconds(),
+			"roundTripMs": clock.RoundTrip.Milliseconds(),
+		}
+	}
+	return info
+}
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+// Defaults of a CORS policy not listing its methods or headers
+var (
+	defaultCORSMethods = []string{http.MethodGet, http.MethodPost}
+	defaultCORSHeaders = []string{"Authorization", "Content-Type"}
+)
+
+// CORSConfig lets browsers on other origins call a function on its HTTP
+// routes. AllowedOrigins are origins like https://app.example.com, with *
+// for any origin or https://*.example.com for its subdomains.
+type CORSConfig struct {
+	AllowedOrigins []string `json:"allowedOrigins"`
+	// AllowedMethods default to GET and POST
+	AllowedMethods []string `json:"allowedMethods,omitempty"`
+	// AllowedHeaders are the request headers callers may send, Authorization
+	// and Content-Type by default
+	AllowedHeaders []string `json:"allowedHeaders,omitempty"`
+	// ExposedHeaders are the response headers scripts may read, past the
+	// few browsers always let them
+	ExposedHeaders []string `json:"exposedHeaders,omitempty"`
+	// AllowCredentials lets browsers send cookies and credentials
+	AllowCredentials bool `json:"allowCredentials,omitempty"`
+	// MaxAgeSeconds is how long browsers may cache a preflight's answer
+	MaxAgeSeconds int `json:"maxAgeSeconds,omitempty"`
+}
+
+func validateCORS(c *CORSConfig) error {
+	if c == nil {
+		return nil
+	}
+	for _, origin := range c.AllowedOrigins {
+		if origin == "*" {
+			if c.AllowCredentials {
+				return fmt.Errorf("allowCredentials needs the allowed origins listed, not *")
+			}
+			continue
+		}
+		u, err := url.Parse(strings.Replace(origin, "*.", "", 1))
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" || u.Path != "" || u.RawQuery != "" {
+			return fmt.Errorf("invalid origin %q, expected a scheme and host like https://app.example.com", origin)
+		}
+		if strings.Contains(origin, "*") && !strings.HasPrefix(origin, u.Scheme+"://*.") {
+			return fmt.Errorf("invalid origin %q, only subdomains like https://*.example.com may be wildcards", origin)
+		}
+	}
+	for _, method := range c.AllowedMethods {
+		if method == "" || strings.ToUpper(method) != method || strings.ContainsAny(method, " ,") {
+			return fmt.Errorf("invalid method %q", method)
+		}
+	}
+	if c.MaxAgeSeconds < 0 {
+		return fmt.Errorf("maxAgeSeconds can't be negative")
+	}
+	return nil
+}
+
+// corsFromEnv reads the service's CORS policy, applying to functions
+// without one of their own, from KAPPA_CORS_ALLOWED_ORIGINS and the other
+// KAPPA_CORS_ variables. It is nil when no origins are allowed.
+func corsFromEnv() (*CORSConfig, error) {
+	origins := envList("KAPPA_CORS_ALLOWED_ORIGINS")
+	if len(origins) == 0 {
+		return nil, nil
+	}
+	c := &CORSConfig{
+		AllowedOrigins:   origins,
+		AllowedMethods:   envList("KAPPA_CORS_ALLOWED_METHODS"),
+		AllowedHeaders:   envList("KAPPA_CORS_ALLOWED_HEADERS"),
+		ExposedHeaders:   envList("KAPPA_CORS_EXPOSED_HEADERS"),
+		AllowCredentials: os.Getenv("KAPPA_CORS_ALLOW_CREDENTIALS") == "true",
+	}
+	if v := os.Getenv("KAPPA_CORS_MAX_AGE_SECONDS"); v != "" {
+		maxAge, err := strconv.Atoi(v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid KAPPA_CORS_MAX_AGE_SECONDS: %s", v)
+		}
+		c.MaxAgeSeconds = maxAge
+	}
+	if err := validateCORS(c); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// envList splits the comma separated list in the environment variable key.
+func envList(key string) []string {
+	var list []string
+	for _, item := range strings.Split(os.Getenv(key), ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
+
+// allowsOrigin reports whether the policy lets origin call.
+func (c *CORSConfig) allowsOrigin(origin string) bool {
+	for _, allowed := range c.AllowedOrigins {
+		if allowed == "*" || allowed == origin {
+			return true
+		}
+		scheme, domain, wildcard := strings.Cut(allowed, "://*.")
+		if wildcard && strings.HasPrefix(origin, scheme+"://") && strings.HasSuffix(origin, "."+domain) {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *CORSConfig) methods() []string {
+	if len(c.AllowedMethods) == 0 {
+		return defaultCORSMethods
+	}
+	return c.AllowedMethods
+}
+
+func (c *CORSConfig) headers() []string {
+	if len(c.AllowedHeaders) == 0 {
+		return defaultCORSHeaders
+	}
+	return c.AllowedHeaders
+}
+
+// allowOrigin sets the headers letting origin read the response.
+func (c *CORSConfig) allowOrigin(h http.Header, origin string) {
+	if slices.Contains(c.AllowedOrigins, "*") {
+		h.Set("Access-Control-Allow-Origin", "*")
+	} else {
+		h.Set("Access-Control-Allow-Origin", origin)
+	}
+	if c.AllowCredentials {
+		h.Set("Access-Control-Allow-Credentials", "true")
+	}
+}
+
+// corsPolicy is the named function's CORS policy, its own or the
+// service's, nil when it has none.
+func (s *KappaService) corsPolicy(name string) *CORSConfig {
+	if _, config, exists := s.lookup(name); exists && config.CORS != nil {
+		return config.CORS
+	}
+	return s.cors
+}
+
+// isPreflight reports whether r is a browser asking whether it may make a
+// cross-origin request.
+func isPreflight(r *http.Request) bool {
+	return r.Method == http.MethodOptions && r.Header.Get("Origin") != "" && r.Header.Get("Access-Control-Request-Method") != ""
+}
+
+// withCORS answers preflights to the named function's HTTP routes by its
+// CORS policy, before credentials are asked for as browsers don't send
+// them with preflights, and lets allowed origins read the responses of the
+// requests that follow. Requests from origins the policy doesn't allow go
+// through without, for the browser to block.
+func (s *KappaService) withCORS(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		origin := r.Header.Get("Origin")
+		if origin == "" {
+			next(w, r)
+			return
+		}
+		w.Header().Add("Vary", "Origin")
+		policy := s.corsPolicy(mux.Vars(r)["name"])
+		allowed := policy != nil && policy.allowsOrigin(origin)
+		if !isPreflight(r) {
+			if allowed {
+				policy.allowOrigin(w.Header(), origin)
+				if len(policy.ExposedHeaders) > 0 {
+					w.Header().Set("Access-Control-Expose-Headers", strings.Join(policy.ExposedHeaders, ", "))
+				}
+			}
+			next(w, r)
+			return
+		}
+
+		w.Header().Add("Vary", "Access-Control-Request-Method")
+		w.Header().Add("Vary", "Access-Control-Request-Headers")
+		if !allowed {
+			http.Error(w, fmt.Sprintf("Origin not allowed: %s", origin), http.StatusForbidden)
+			return
+		}
+		if method := r.Header.Get("Access-Control-Request-Method"); !slices.Contains(policy.methods(), method) {
+			http.Error(w, fmt.Sprintf("Method not allowed: %s", method), http.StatusForbidden)
+			return
+		}
+		policy.allowOrigin(w.Header(), origin)
+		w.Header().Set("Access-Control-Allow-Methods", strings.Join(policy.methods(), ", "))
+		w.Header().Set("Access-Control-Allow-Headers", strings.Join(policy.headers(), ", "))
+		if policy.MaxAgeSeconds > 0 {
+			w.Header().Set("Access-Control-Max-Age", strconv.Itoa(policy.MaxAgeSeconds))
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCORSConfig_AllowsOrigin(t *testing.T) {
+	policy := &CORSConfig{AllowedOrigins: []string{"https://app.example.com", "https://*.example.org"}}
+	tests := []struct {
+		origin  string
+		allowed bool
+	}{
+		{"https://app.example.com", true},
+		{"https://other.example.com", false},
+		{"http://app.example.com", false},
+		{"https://a.example.org", true},
+		{"https://a.b.example.org", true},
+		{"https://example.org", false},
+		{"http://a.example.org", false},
+		{"https://example.org.evil.io", false},
+		{"https://evilexample.org", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.origin, func(t *testing.T) {
+			assert.Equal(t, tt.allowed, policy.allowsOrigin(tt.origin))
+		})
+	}
+	assert.True(t, (&CORSConfig{AllowedOrigins: []string{"*"}}).allowsOrigin("https://anywhere.io"))
+}
+
+func TestValidateCORS(t *testing.T) {
+	tests := []struct {
+		name    string
+		config  CORSConfig
+		wantErr bool
+	}{
+		{"listed origins", CORSConfig{AllowedOrigins: []string{"https://app.example.com", "https://*.example.com"}, AllowCredentials: true}, false},
+		{"any origin", CORSConfig{AllowedOrigins: []string{"*"}}, false},
+		{"any origin with credentials", CORSConfig{AllowedOrigins: []string{"*"}, AllowCredentials: true}, true},
+		{"no scheme", CORSConfig{AllowedOrigins: []string{"app.example.com"}}, true},
+		{"path", CORSConfig{AllowedOrigins: []string{"https://app.example.com/"}}, true},
+		{"wildcard inside", CORSConfig{AllowedOrigins: []string{"https://app.*.example.com"}}, true},
+		{"lowercase method", CORSConfig{AllowedOrigins: []string{"*"}, AllowedMethods: []string{"get"}}, true},
+		{"negative max age", CORSConfig{AllowedOrigins: []string{"*"}, MaxAgeSeconds: -1}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := validateCORS(&tt.config)
+			if tt.wantErr {
+				assert.Error(t, err)
+			} else {
+				assert.NoError(t, err)
+			}
+		})
+	}
+}
+
+func TestWithCORS(t *testing.T) {
+	s := newTestService(t)
+	register(t, s, map[string]any{
+		"name": "orders",
+		"mode": "external",
+		"cors": map[string]any{
+			"allowedOrigins": []string{"https://*.example.com"},
+			"exposedHeaders": []string{"X-Total"},
+			"maxAgeSeconds":  600,
+		},
+	})
+	attachRuntime(t, s, "orders", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"ok":true}`))
+	})
+
+	rec := do(t, s, "OPTIONS", "/functions/orders", nil,
+		"Origin", "https://app.example.com", "Access-Control-Request-Method", "POST")
+	require.Equal(t, http.StatusNoContent, rec.Code, rec.Body.String())
+	assert.Equal(t, "https://app.example.com", rec.Header().Get("Access-Control-Allow-Origin"))
+	assert.Equal(t, "GET, POST", rec.Header().Get("Access-Control-Allow-Methods"))
+	assert.Equal(t, "Authorization, Content-Type", rec.Header().Get("Access-Control-Allow-Headers"))
+	assert.Equal(t, "600", rec.Header().Get("Access-Control-Max-Age"))
+	assert.Contains(t, rec.Header().Values("Vary"), "Origin")
+
+	rec = do(t, s, "OPTIONS", "/functions/orders", nil,
+		"Origin", "https://example.com.evil.io", "Access-Control-Request-Method", "POST")
+	assert.Equal(t, http.StatusForbidden, rec.Code)
+	assert.Empty(t, rec.Header().Get("Access-Control-Allow-Origin"))
+
+	rec = do(t, s, "OPTIONS", "/functions/orders", nil,
+		"Origin", "https://app.example.com", "Access-Control-Request-Method", "DELETE")
+	assert.Equal(t, http.StatusForbidden, rec.Code)
+	assert.Empty(t, rec.Header().Get("Access-Control-Allow-Origin"))
+
+	// The requests that follow can be read by allowed origins only
+	rec = do(t, s, "POST", "/functions/orders", map[string]any{}, "Origin", "https://app.example.com")
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	assert.Equal(t, "https://app.example.com", rec.Header().Get("Access-Control-Allow-Origin"))
+	assert.Equal(t, "X-Total", rec.Header().Get("Access-Control-Expose-Headers"))
+	rec = do(t, s, "POST", "/functions/orders", map[string]any{}, "Origin", "https://example.com.evil.io")
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	assert.Empty(t, rec.Header().Get("Access-Control-Allow-Origin"))
+
+	rec = do(t, s, "POST", "/functions", map[string]any{
+		"name": "credentialed",
+		"mode": "external",
+		"cors": map[string]any{"allowedOrigins": []string{"*"}, "allowCredentials": true},
+	})
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+}
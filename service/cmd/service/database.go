@@ -0,0 +1,63 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"kappa-v2/pkg/logger"
+	"kappa-v2/service/internal/database"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// migrateTimeout bounds migrating the schema on start
+const migrateTimeout = 5 * time.Minute
+
+// openDatabase connects to the database at KAPPA_DATABASE_URL and migrates
+// its schema, nil when none is configured. Failing either is fatal, the
+// service doesn't run against a schema it doesn't know.
+func openDatabase() *sql.DB {
+	db, err := database.FromEnv()
+	if err != nil {
+		logger.Get().Fatal("Failed to open database", zap.Error(err))
+	}
+	if db == nil {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), migrateTimeout)
+	defer cancel()
+	status, err := database.Migrate(ctx, db)
+	if err != nil {
+		logger.Get().Fatal("Failed to migrate database", zap.Error(err))
+	}
+	if status.Version > status.Latest {
+		logger.Get().Warn("Database schema is newer than the service", zap.Int("version", status.Version), zap.Int("latest", status.Latest))
+	}
+	logger.Get().Info("Database ready", zap.Int("schemaVersion", status.Version))
+	return db
+}
+
+// runMigrateOnly migrates the database's schema and exits, for running
+// migrations as a deploy step ahead of the replicas.
+func runMigrateOnly() int {
+	l := logger.Get()
+	db, err := database.FromEnv()
+	if err != nil {
+		l.Error("Failed to open database", zap.Error(err))
+		return 1
+	}
+	if db == nil {
+		l.Error("Migrating needs KAPPA_DATABASE_URL")
+		return 1
+	}
+	defer db.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), migrateTimeout)
+	defer cancel()
+	status, err := database.Migrate(ctx, db)
+	if err != nil {
+		l.Error("Failed to migrate database", zap.Error(err))
+		return 1
+	}
+	l.Info("Database migrated", zap.Int("version", status.Version), zap.Int("latest", status.Latest))
+	return 0
+}
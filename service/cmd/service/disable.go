@@ -0,0 +1,135 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"kappa-v2/pkg/logger"
+	"kappa-v2/service/internal/kappa"
+	"math"
+	"net/http"
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+	"go.uber.org/zap"
+)
+
+func validateDisabled(windows []kappa.DisabledWindow) error {
+	for i, w := range windows {
+		if w.From != nil && w.Until != nil && !w.Until.After(*w.From) {
+			return fmt.Errorf("window %d ends before it starts", i)
+		}
+	}
+	return nil
+}
+
+// disabledError answers an invocation turned away as its function is
+// disabled, telling callers when to come back if the window ends. It
+// reports whether err was such an error.
+func (s *KappaService) disabledError(w http.ResponseWriter, name string, err error) bool {
+	var disabled *kappa.DisabledError
+	if !errors.As(err, &disabled) {
+		return false
+	}
+	if until := disabled.Window.Until; until != nil {
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(time.Until(*until).Seconds()))))
+	}
+	s.invocationError(w, name, errorDisabled, fmt.Sprintf("Function invocation failed: %v", err), http.StatusServiceUnavailable)
+	return true
+}
+
+// rejectDisabled turns an invocation away before it is accepted when fn is
+// disabled now, reporting whether it did.
+func (s *KappaService) rejectDisabled(w http.ResponseWriter, name string, fn *kappa.KappaFunction) bool {
+	window, disabled := fn.DisabledAt(time.Now())
+	if !disabled {
+		return false
+	}
+	return s.disabledError(w, name, &kappa.DisabledError{Window: window})
+}
+
+// HTTP handler for disabling a function, now or in a window given in the
+// body, added to any windows it already has
+func (s *KappaService) disableFunction(w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["name"]
+	if _, _, exists := s.lookup(name); !exists {
+		http.Error(w, fmt.Sprintf("Function not found: %s", name), http.StatusNotFound)
+		return
+	}
+
+	var window kappa.DisabledWindow
+	if err := json.NewDecoder(r.Body).Decode(&window); err != nil && !errors.Is(err, io.EOF) {
+		http.Error(w, fmt.Sprintf("Invalid request: %v", err), http.StatusBadRequest)
+		return
+	}
+	if window.Until != nil && !window.Until.After(time.Now()) {
+		http.Error(w, "Invalid window: it is already over", http.StatusBadRequest)
+		return
+	}
+	if err := validateDisabled([]kappa.DisabledWindow{window}); err != nil {
+		http.Error(w, fmt.Sprintf("Invalid window: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	// Windows that are over are dropped as others are added
+	now := time.Now()
+	s.setDisabled(w, r, name, func(windows []kappa.DisabledWindow) []kappa.DisabledWindow {
+		windows = slices.DeleteFunc(slices.Clone(windows), func(w kappa.DisabledWindow) bool {
+			return w.Until != nil && !w.Until.After(now)
+		})
+		return append(windows, window)
+	})
+}
+
+// HTTP handler for enabling a function again, dropping its windows,
+// scheduled ones included
+func (s *KappaService) enableFunction(w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["name"]
+	if _, _, exists := s.lookup(name); !exists {
+		http.Error(w, fmt.Sprintf("Function not found: %s", name), http.StatusNotFound)
+		return
+	}
+	s.setDisabled(w, r, name, func([]kappa.DisabledWindow) []kappa.DisabledWindow { return nil })
+}
+
+// setDisabled replaces the named function's windows in its config and on
+// the running function with those update makes of them, without
+// redeploying it.
+//
+// Disabling is how operators stop a misbehaving function, so unlike other
+// changes it is allowed while the function or its project is locked and
+// while the service is in maintenance mode. It leaves the function's code
+// and settings as they are, which is what locks and maintenance protect.
+func (s *KappaService) setDisabled(w http.ResponseWriter, r *http.Request, name string, update func([]kappa.DisabledWindow) []kappa.DisabledWindow) {
+	fn, _, _ := s.lookup(name)
+	config, err := s.updateConfig(name, func(config *KappaFunctionConfig) error {
+		config.Disabled = update(config.Disabled)
+		return nil
+	})
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Function not found: %s", name), http.StatusNotFound)
+		return
+	}
+	windows := config.Disabled
+	fn.SetDisabled(windows)
+	s.persistFunction(config, fn)
+
+	_, disabled := fn.DisabledAt(time.Now())
+	logger.FromCtx(r.Context()).Info("Function disablement changed",
+		zap.String("name", name),
+		zap.Int("windows", len(windows)),
+		zap.Bool("disabled", disabled))
+
+	if windows == nil {
+		windows = []kappa.DisabledWindow{}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{
+		"name":     name,
+		"disabled": disabled,
+		"windows":  windows,
+	})
+}
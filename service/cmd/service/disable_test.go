@@ -0,0 +1,64 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDisableFunction(t *testing.T) {
+	s := newTestService(t)
+	attachRuntime(t, s, "orders", func(w http.ResponseWriter, r *http.Request) { w.Write([]byte(`{}`)) })
+
+	rec := do(t, s, "POST", "/functions/orders/disable", nil)
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	assert.Equal(t, true, decode(t, rec)["disabled"])
+	rec = do(t, s, "POST", "/functions/orders", map[string]any{})
+	assert.Equal(t, http.StatusServiceUnavailable, rec.Code)
+
+	// A scheduled window is added to the one already there, and kept in the
+	// current version
+	from := time.Now().Add(time.Hour)
+	rec = do(t, s, "POST", "/functions/orders/disable", map[string]any{"from": from, "until": from.Add(time.Hour)})
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	assert.Len(t, decode(t, rec)["windows"], 2)
+	history, _ := s.versionHistory("orders")
+	require.NotEmpty(t, history)
+	assert.Len(t, history[len(history)-1].Config.Disabled, 2)
+
+	rec = do(t, s, "POST", "/functions/orders/enable", nil)
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	assert.Equal(t, map[string]any{"name": "orders", "disabled": false, "windows": []any{}}, decode(t, rec))
+	assert.Empty(t, s.config("orders").Disabled)
+	rec = do(t, s, "POST", "/functions/orders", map[string]any{})
+	assert.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+
+	rec = do(t, s, "POST", "/functions/orders/disable", map[string]any{"until": time.Now().Add(-time.Minute)})
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+	rec = do(t, s, "POST", "/functions/orders/disable", map[string]any{"from": from, "until": from.Add(-time.Hour)})
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+	rec = do(t, s, "POST", "/functions/missing/disable", nil)
+	assert.Equal(t, http.StatusNotFound, rec.Code)
+	rec = do(t, s, "POST", "/functions/missing/enable", nil)
+	assert.Equal(t, http.StatusNotFound, rec.Code)
+}
+
+func TestDisableFunction_LockedAndMaintenance(t *testing.T) {
+	s := newTestService(t)
+	register(t, s, map[string]any{"name": "orders", "mode": "external"})
+	rec := do(t, s, "POST", "/functions/orders/lock", nil)
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	rec = do(t, s, "PUT", "/maintenance", map[string]any{"enabled": true})
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+
+	// Operators can still stop a function during a change freeze
+	rec = do(t, s, "POST", "/functions/orders/disable", nil)
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	assert.Equal(t, true, decode(t, rec)["disabled"])
+	rec = do(t, s, "POST", "/functions/orders/enable", nil)
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	assert.Equal(t, false, decode(t, rec)["disabled"])
+}
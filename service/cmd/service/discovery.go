@@ -0,0 +1,20 @@
+package main
+
+import (
+	"kappa-v2/pkg/logger"
+
+	"go.uber.org/zap"
+)
+
+// updateDiscovery names the registered functions in the hosts file their
+// instances resolve each other through.
+func (s *KappaService) updateDiscovery() {
+	functions, _ := s.snapshot()
+	names := make([]string, 0, len(functions))
+	for name := range functions {
+		names = append(names, name)
+	}
+	if err := s.discovery.Update(names); err != nil {
+		logger.Get().Error("Failed to update function discovery", zap.Error(err))
+	}
+}
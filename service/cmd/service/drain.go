@@ -0,0 +1,37 @@
+package main
+
+import (
+	"context"
+	"kappa-v2/pkg/logger"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// defaultShutdownTimeout is how long shutting down waits for invocations in
+// flight, unless KAPPA_SHUTDOWN_TIMEOUT_MS says otherwise
+const defaultShutdownTimeout = 10 * time.Second
+
+// drainFunctions waits for every function's invocations in flight to
+// finish, turning new ones away, until ctx is done. Functions still running
+// some then are stopped under them.
+func (s *KappaService) drainFunctions(ctx context.Context) {
+	started := time.Now()
+	var wg sync.WaitGroup
+	functions, _ := s.snapshot()
+	for name, fn := range functions {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := fn.Drain(ctx); err != nil {
+				logger.Get().Warn("Stopping function with invocations in flight",
+					zap.String("name", name),
+					zap.Int("inFlight", fn.InFlight()),
+					zap.Error(err))
+			}
+		}()
+	}
+	wg.Wait()
+	logger.Get().Info("Functions drained", zap.Duration("took", time.Since(started)))
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// registerBlocking registers a function whose invocations block until
+// release is closed, signalling started as each one begins.
+func registerBlocking(t *testing.T, s *KappaService, name string) (started chan struct{}, release chan struct{}) {
+	t.Helper()
+	started, release = make(chan struct{}, 1), make(chan struct{})
+	registerFake(t, s, map[string]any{"name": name}, func(w http.ResponseWriter, r *http.Request) {
+		started <- struct{}{}
+		<-release
+		w.Write([]byte(`{}`))
+	})
+	return started, release
+}
+
+func TestDrainFunctions(t *testing.T) {
+	s := newTestService(t)
+	started, release := registerBlocking(t, s, "orders")
+
+	inFlight := make(chan int)
+	go func() { inFlight <- do(t, s, "POST", "/functions/orders", map[string]any{}).Code }()
+	<-started
+
+	drained := make(chan struct{})
+	go func() {
+		s.drainFunctions(context.Background())
+		close(drained)
+	}()
+	require.Eventually(t, func() bool {
+		// New invocations are turned away while the one in flight finishes
+		rec := do(t, s, "POST", "/functions/orders", map[string]any{})
+		return rec.Code == http.StatusServiceUnavailable && rec.Header().Get("X-Kappa-Error") == errorDraining
+	}, 5*time.Second, 10*time.Millisecond)
+	select {
+	case <-drained:
+		t.Fatal("drained with an invocation in flight")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	close(release)
+	assert.Equal(t, http.StatusOK, <-inFlight)
+	select {
+	case <-drained:
+	case <-time.After(5 * time.Second):
+		t.Fatal("not drained once the invocation finished")
+	}
+}
+
+func TestDrainFunctions_Timeout(t *testing.T) {
+	s := newTestService(t)
+	started, release := registerBlocking(t, s, "orders")
+
+	done := make(chan struct{})
+	go func() {
+		do(t, s, "POST", "/functions/orders", map[string]any{})
+		close(done)
+	}()
+	<-started
+
+	// Draining gives up on invocations still in flight when ctx ends
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	begun := time.Now()
+	s.drainFunctions(ctx)
+	assert.GreaterOrEqual(t, time.Since(begun), 100*time.Millisecond)
+	fn, _, _ := s.lookup("orders")
+	assert.Equal(t, 1, fn.InFlight())
+	close(release)
+	<-done
+}
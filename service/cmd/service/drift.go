@@ -0,0 +1,128 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"kappa-v2/pkg/logger"
+	"kappa-v2/service/internal/drift"
+	"kappa-v2/service/internal/kappa"
+	"net/http"
+	"os"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// checkDrift compares the registered functions against the containers,
+// snapshots and temp dirs on the host, repairing what it finds when asked.
+func (s *KappaService) checkDrift(repair bool) drift.Report {
+	functions, _ := s.snapshot()
+	desired := make(map[string]kappa.Footprint, len(functions))
+	for name, fn := range functions {
+		desired[name] = fn.Footprint()
+	}
+
+	var actual drift.Actual
+	var errs []string
+	if s.inventory != nil {
+		resources, err := s.inventory.Resources()
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("containers: %v", err))
+		} else {
+			actual.Resources = resources
+		}
+	}
+	tmpDirs, err := drift.ScanTmpDirs(os.TempDir())
+	if err != nil {
+		errs = append(errs, fmt.Sprintf("temp dirs: %v", err))
+	}
+	actual.TmpDirs = tmpDirs
+
+	report := drift.Compare(desired, actual, time.Now(), drift.DefaultGrace)
+	report.Errors = errs
+	if repair {
+		s.repairDrift(&report)
+	}
+	return report
+}
+
+// repairDrift removes orphans and stops functions whose instance is missing
+// or runs the wrong image, so their next invocation starts afresh. Jobs are
+// left to fail on their own.
+func (s *KappaService) repairDrift(report *drift.Report) {
+	for i := range report.Orphans {
+		f := &report.Orphans[i]
+		var err error
+		switch {
+		case f.Kind == drift.KindTmpDir:
+			err = os.RemoveAll(f.ID)
+		case s.inventory != nil:
+			err = s.inventory.RemoveResource(kappa.Resource{Kind: f.Kind, ID: f.ID})
+		default:
+			err = fmt.Errorf("no container backend")
+		}
+		f.Repair = repairOutcome("removed", err)
+	}
+
+	stopped := make(map[string]error)
+	for _, findings := range [][]drift.Finding{report.Missing, report.Mismatched} {
+		for i := range findings {
+			f := &findings[i]
+			if f.Job {
+				f.Repair = "left to the job"
+				continue
+			}
+			err, done := stopped[f.Function]
+			if !done {
+				if fn, _, exists := s.lookup(f.Function); exists {
+					err = fn.Stop()
+				} else {
+					err = fmt.Errorf("function not found")
+				}
+				stopped[f.Function] = err
+			}
+			f.Repair = repairOutcome("stopped", err)
+		}
+	}
+
+	if report.Drifted() {
+		logger.Get().Warn("Repaired drift",
+			zap.Int("orphans", len(report.Orphans)),
+			zap.Int("missing", len(report.Missing)),
+			zap.Int("mismatched", len(report.Mismatched)))
+	}
+}
+
+func repairOutcome(action string, err error) string {
+	if err != nil {
+		return fmt.Sprintf("failed: %v", err)
+	}
+	return action
+}
+
+// repairDriftEvery checks for and repairs drift on an interval until stop
+// is closed.
+func (s *KappaService) repairDriftEvery(interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			s.checkDrift(true)
+		}
+	}
+}
+
+// HTTP handler for comparing the registry against what is on the host
+func (s *KappaService) getDrift(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(s.checkDrift(false))
+}
+
+// HTTP handler for repairing the drift between the registry and the host
+func (s *KappaService) repairDriftNow(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(s.checkDrift(true))
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"kappa-v2/pkg/logger"
+	"kappa-v2/service/internal/audit"
+	"kappa-v2/service/internal/settings"
+	"maps"
+	"net/http"
+	"slices"
+	"sort"
+	"strings"
+
+	"github.com/gorilla/mux"
+	"go.uber.org/zap"
+)
+
+// envPatch changes a function's own env entries, leaving the rest of its
+// config as it is.
+type envPatch struct {
+	// Set adds or replaces entries
+	Set map[string]string `json:"set"`
+	// Unset removes entries, those the function's project or environment
+	// set show through again
+	Unset []string `json:"unset"`
+	// Secret marks entries secret, their values masked in what the API
+	// shows from then on
+	Secret []string `json:"secret"`
+}
+
+func (p envPatch) validate() error {
+	if len(p.Set) == 0 && len(p.Unset) == 0 && len(p.Secret) == 0 {
+		return fmt.Errorf("expected env entries to set, unset or mark secret")
+	}
+	for _, key := range append(slices.Collect(maps.Keys(p.Set)), append(p.Unset, p.Secret...)...) {
+		if key == "" || strings.Contains(key, "=") {
+			return fmt.Errorf("invalid env key %q", key)
+		}
+	}
+	for _, key := range p.Unset {
+		if _, set := p.Set[key]; set {
+			return fmt.Errorf("env key %s is both set and unset", key)
+		}
+	}
+	return nil
+}
+
+// apply returns s with the patch applied to its env and secret keys.
+func (p envPatch) apply(s settings.Settings) settings.Settings {
+	drop := func(key string) bool {
+		_, set := p.Set[key]
+		return set || slices.Contains(p.Unset, key)
+	}
+	env := make([]string, 0, len(s.Env)+len(p.Set))
+	for _, kv := range s.Env {
+		if key, _, _ := strings.Cut(kv, "="); !drop(key) {
+			env = append(env, kv)
+		}
+	}
+	for key, value := range p.Set {
+		env = append(env, key+"="+value)
+	}
+	sort.Strings(env)
+
+	var secret []string
+	for _, key := range append(slices.Clone(s.SecretEnv), p.Secret...) {
+		if !slices.Contains(p.Unset, key) && !slices.Contains(secret, key) {
+			secret = append(secret, key)
+		}
+	}
+	sort.Strings(secret)
+
+	s.Env, s.SecretEnv = env, secret
+	return s
+}
+
+// maskedConfig is config as the API shows it, the values of env entries
+// marked secret at any level and the secrets of webhooks masked.
+func (s *KappaService) maskedConfig(config KappaFunctionConfig) KappaFunctionConfig {
+	config.Settings = config.Settings.Masked(s.effectiveSettings(config).SecretEnv)
+	config.Triggers = maskedTriggers(config.Triggers)
+	return config
+}
+
+// HTTP handler for changing a function's env without registering it again.
+// The change is kept in its config, and a running instance is replaced to
+// pick it up once it has no invocations in flight.
+func (s *KappaService) patchEnv(w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["name"]
+	fn, config, exists := s.lookup(name)
+	if !exists {
+		http.Error(w, fmt.Sprintf("Function not found: %s", name), http.StatusNotFound)
+		return
+	}
+	if reason := s.lockReason(name, config.Project); reason != "" {
+		http.Error(w, fmt.Sprintf("Function is locked: %s", reason), http.StatusLocked)
+		return
+	}
+	if !checkPreconditions(w, r, s.functionETag(name)) {
+		return
+	}
+
+	var patch envPatch
+	if err := json.NewDecoder(r.Body).Decode(&patch); err != nil {
+		http.Error(w, fmt.Sprintf("Invalid request: %v", err), http.StatusBadRequest)
+		return
+	}
+	if err := patch.validate(); err != nil {
+		http.Error(w, fmt.Sprintf("Invalid request: %v", err), http.StatusBadRequest)
+		return
+	}
+	// The patch applies to the settings as they are when it is stored, not
+	// as they were looked up, so patches sent at the same time all apply
+	var previous KappaFunctionConfig
+	config, err := s.updateConfig(name, func(config *KappaFunctionConfig) error {
+		updated := patch.apply(config.Settings)
+		if err := updated.Validate(); err != nil {
+			return fmt.Errorf("invalid settings: %w", err)
+		}
+		if err := s.envRefs.Validate(updated.Env); err != nil {
+			return fmt.Errorf("invalid env: %w", err)
+		}
+		previous = *config
+		config.Settings = updated
+		return nil
+	})
+	if errors.Is(err, errNotRegistered) {
+		http.Error(w, fmt.Sprintf("Function not found: %s", name), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Invalid request: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	before := s.effectiveSettings(previous).EnvList()
+	effective := s.effectiveSettings(config)
+	applySettings(fn, effective)
+	s.persistFunction(config, fn)
+	changed := !slices.Equal(before, effective.EnvList())
+	if changed {
+		fn.RestartLazily()
+	}
+
+	// Only keys are recorded, values may be secrets
+	set := slices.Sorted(maps.Keys(patch.Set))
+	logger.FromCtx(r.Context()).Info("Function env changed",
+		zap.String("name", name),
+		zap.Strings("set", set),
+		zap.Strings("unset", patch.Unset),
+		zap.Bool("restart", changed))
+	s.audit.Record(audit.Entry{
+		Actor:    actor(r.Context()),
+		Action:   "function.env",
+		Function: name,
+		Project:  config.Project,
+		Detail: map[string]any{
+			"set":    set,
+			"unset":  patch.Unset,
+			"secret": patch.Secret,
+		},
+	})
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("ETag", s.functionETag(name))
+	json.NewEncoder(w).Encode(map[string]any{
+		"name":           name,
+		"env":            effective.Masked().Env,
+		"restartPending": fn.RestartPending(),
+	})
+}
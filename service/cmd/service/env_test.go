@@ -0,0 +1,99 @@
+package main
+
+import (
+	"fmt"
+	"kappa-v2/service/internal/settings"
+	"net/http"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPatchEnv_RestartsOnce(t *testing.T) {
+	s := newTestService(t)
+	backend := registerFake(t, s, map[string]any{"name": "orders", "env": []string{"MODE=old"}},
+		func(w http.ResponseWriter, r *http.Request) { w.Write([]byte(`{}`)) })
+
+	rec := do(t, s, "POST", "/functions/orders", map[string]any{})
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	require.Len(t, backend.runs(), 1)
+
+	rec = do(t, s, "PATCH", "/functions/orders/env", map[string]any{"set": map[string]string{"MODE": "new"}})
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	assert.Equal(t, true, decode(t, rec)["restartPending"])
+
+	for i := 0; i < 3; i++ {
+		rec = do(t, s, "POST", "/functions/orders", map[string]any{})
+		require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	}
+	runs := backend.runs()
+	require.Len(t, runs, 2, "the instance is replaced once")
+	assert.Contains(t, runs[1].Env, "MODE=new")
+	assert.NotContains(t, runs[1].Env, "MODE=old")
+
+	// Patching nothing the function runs with leaves it be
+	rec = do(t, s, "PATCH", "/functions/orders/env", map[string]any{"set": map[string]string{"MODE": "new"}})
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	assert.Equal(t, false, decode(t, rec)["restartPending"])
+
+	rec = do(t, s, "PATCH", "/functions/orders/env", map[string]any{})
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+	rec = do(t, s, "PATCH", "/functions/missing/env", map[string]any{"set": map[string]string{"MODE": "new"}})
+	assert.Equal(t, http.StatusNotFound, rec.Code)
+}
+
+func TestPatchEnv_MasksSecrets(t *testing.T) {
+	s := newTestService(t)
+	register(t, s, map[string]any{"name": "orders", "mode": "external"})
+
+	rec := do(t, s, "PATCH", "/functions/orders/env", map[string]any{
+		"set":    map[string]string{"TOKEN": "hunter2", "REGION": "eu"},
+		"secret": []string{"TOKEN"},
+	})
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	assert.NotContains(t, rec.Body.String(), "hunter2")
+
+	rec = do(t, s, "GET", "/functions/orders", nil)
+	require.Equal(t, http.StatusOK, rec.Code)
+	assert.NotContains(t, rec.Body.String(), "hunter2")
+	var config KappaFunctionConfig
+	require.NoError(t, decodeInto(rec, &config))
+	assert.Contains(t, config.Env, "REGION=eu")
+	assert.Contains(t, config.Env, "TOKEN="+settings.Masked)
+	fn, _, _ := s.lookup("orders")
+	assert.Contains(t, fn.Environ(), "TOKEN=hunter2", "the function runs with the value")
+}
+
+func TestPatchEnv_Concurrent(t *testing.T) {
+	s := newTestService(t)
+	register(t, s, map[string]any{"name": "orders", "mode": "external"})
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			rec := do(t, s, "PATCH", "/functions/orders/env", map[string]any{
+				"set": map[string]string{fmt.Sprintf("KEY_%d", i): "value"},
+			})
+			assert.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+		}()
+	}
+	wg.Wait()
+
+	// No patch is lost to another sent at the same time
+	config := s.config("orders")
+	for i := 0; i < 10; i++ {
+		assert.Contains(t, config.Env, fmt.Sprintf("KEY_%d=value", i))
+	}
+	history, _ := s.versionHistory("orders")
+	require.NotEmpty(t, history)
+	assert.Equal(t, config.Env, history[len(history)-1].Config.Env)
+
+	rec := do(t, s, "PATCH", "/functions/orders/env", map[string]any{"set": map[string]string{"BAD": "${vault:key}"}})
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+	assert.Contains(t, rec.Body.String(), "invalid env")
+	assert.NotContains(t, s.config("orders").Env, "BAD=${vault:key}")
+}
@@ -0,0 +1,318 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"kappa-v2/pkg/logger"
+	"kappa-v2/service/internal/audit"
+	"kappa-v2/service/internal/rbac"
+	"kappa-v2/service/internal/settings"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"go.uber.org/zap"
+)
+
+// Environment is a stage functions are promoted through, like dev, staging
+// and prod. Its overrides take precedence over the settings of functions in
+// it, so a function promoted between environments picks up each one's env
+// and secrets without its own config changing.
+type Environment struct {
+	Name string `json:"name"`
+	// Next is the environment functions in this one are promoted to
+	Next      string            `json:"next,omitempty"`
+	Overrides settings.Settings `json:"overrides"`
+}
+
+// masked is the environment as the API shows it, the values of its secret
+// env entries masked.
+func (e Environment) masked() Environment {
+	e.Overrides = e.Overrides.Masked(e.Overrides.SecretEnv)
+	return e
+}
+
+// Provenance is where a promoted function came from.
+type Provenance struct {
+	Function    string    `json:"function"`
+	Environment string    `json:"environment"`
+	Version     int       `json:"version"`
+	Digest      string    `json:"sha256,omitempty"`
+	PromotedAt  time.Time `json:"promotedAt"`
+	PromotedBy  string    `json:"promotedBy,omitempty"`
+}
+
+// promotedName is what a function is called in the environment it is
+// promoted to: its name with the environment suffix swapped, like
+// checkout-dev to checkout-staging, or suffixed when it has none.
+func promotedName(name, from, to string) string {
+	return strings.TrimSuffix(name, "-"+from) + "-" + to
+}
+
+// HTTP handler for listing environments
+func (s *KappaService) listEnvironments(w http.ResponseWriter, r *http.Request) {
+	s.mu.RLock()
+	environments := make([]Environment, 0, len(s.environments))
+	for _, environment := range s.environments {
+		environments = append(environments, environment.masked())
+	}
+	s.mu.RUnlock()
+	sort.Slice(environments, func(i, j int) bool { return environments[i].Name < environments[j].Name })
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{
+		"environments": environments,
+	})
+}
+
+// HTTP handler for getting an environment
+func (s *KappaService) getEnvironment(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	name := vars["name"]
+
+	environment, exists := s.environment(name)
+	if !exists {
+		http.Error(w, fmt.Sprintf("Environment not found: %s", name), http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(environment.masked())
+}
+
+// HTTP handler for creating an environment or replacing it, its overrides
+// are applied to its functions straight away
+func (s *KappaService) putEnvironment(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	name := vars["name"]
+
+	var environment Environment
+	if err := json.NewDecoder(r.Body).Decode(&environment); err != nil {
+		http.Error(w, fmt.Sprintf("Invalid request: %v", err), http.StatusBadRequest)
+		return
+	}
+	environment.Name = name
+	if existing, exists := s.environment(name); exists {
+		environment.Overrides = environment.Overrides.Unmasked(existing.Overrides)
+	}
+	if err := environment.Overrides.Validate(); err != nil {
+		http.Error(w, fmt.Sprintf("Invalid overrides: %v", err), http.StatusBadRequest)
+		return
+	}
+	if err := s.envRefs.Validate(environment.Overrides.Env); err != nil {
+		http.Error(w, fmt.Sprintf("Invalid env: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	// Promotions have to end somewhere
+	for next, seen := environment.Next, map[string]bool{name: true}; next != ""; {
+		if seen[next] {
+			http.Error(w, fmt.Sprintf("Invalid next: promoting to %s leads back to %s", environment.Next, next), http.StatusBadRequest)
+			return
+		}
+		seen[next] = true
+		following, exists := s.environment(next)
+		if !exists {
+			http.Error(w, fmt.Sprintf("Environment not found: %s", next), http.StatusBadRequest)
+			return
+		}
+		next = following.Next
+	}
+
+	s.mu.Lock()
+	_, existed := s.environments[name]
+	s.environments[name] = &environment
+	s.mu.Unlock()
+	s.persistResource(resourceEnvironment, name, environment)
+
+	functions, configs := s.snapshot()
+	for fnName, config := range configs {
+		if config.Environment == name {
+			applySettings(functions[fnName], s.effectiveSettings(config))
+		}
+	}
+
+	logger.FromCtx(r.Context()).Info("Environment saved", zap.String("name", name))
+
+	status := http.StatusOK
+	if !existed {
+		status = http.StatusCreated
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(environment.masked())
+}
+
+// HTTP handler for deleting an environment no function is in and no other
+// environment promotes to
+func (s *KappaService) deleteEnvironment(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	name := vars["name"]
+
+	s.mu.Lock()
+	if _, exists := s.environments[name]; !exists {
+		s.mu.Unlock()
+		http.Error(w, fmt.Sprintf("Environment not found: %s", name), http.StatusNotFound)
+		return
+	}
+	for fnName, config := range s.configs {
+		if config.Environment == name {
+			s.mu.Unlock()
+			http.Error(w, fmt.Sprintf("Environment %s still has functions, like %s", name, fnName), http.StatusConflict)
+			return
+		}
+	}
+	for _, other := range s.environments {
+		if other.Next == name {
+			s.mu.Unlock()
+			http.Error(w, fmt.Sprintf("Environment %s promotes to %s", other.Name, name), http.StatusConflict)
+			return
+		}
+	}
+	delete(s.environments, name)
+	s.mu.Unlock()
+	s.forgetResource(resourceEnvironment, name)
+
+	logger.FromCtx(r.Context()).Info("Environment deleted", zap.String("name", name))
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{
+		"name":   name,
+		"status": "deleted",
+	})
+}
+
+// promoteRequest picks the version to promote, the current one when 0, and
+// the function to promote it to, named by promotedName when empty
+type promoteRequest struct {
+	Version int    `json:"version"`
+	Name    string `json:"name"`
+}
+
+// HTTP handler for promoting a function's version to the next environment.
+// The config and binary are copied as they are, the target environment's
+// overrides take the place of the source's, and where it came from is
+// recorded on the promoted function and in the audit log.
+func (s *KappaService) promoteFunction(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	name := vars["name"]
+
+	history, exists := s.versionHistory(name)
+	if !exists {
+		http.Error(w, fmt.Sprintf("Function not found: %s", name), http.StatusNotFound)
+		return
+	}
+	var req promoteRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil && !errors.Is(err, io.EOF) {
+		http.Error(w, fmt.Sprintf("Invalid request: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	source := history[len(history)-1]
+	if req.Version != 0 {
+		found := false
+		for _, v := range history {
+			if v.Version == req.Version {
+				source, found = v, true
+			}
+		}
+		if !found {
+			http.Error(w, fmt.Sprintf("Version not found: %d", req.Version), http.StatusNotFound)
+			return
+		}
+	}
+
+	from := s.config(name).Environment
+	if from == "" {
+		http.Error(w, fmt.Sprintf("Function %s is not in an environment", name), http.StatusBadRequest)
+		return
+	}
+	next, _ := s.environment(from)
+	to := next.Next
+	if to == "" {
+		http.Error(w, fmt.Sprintf("Environment %s is not promoted anywhere", from), http.StatusConflict)
+		return
+	}
+	target := req.Name
+	if target == "" {
+		target = promotedName(name, from, to)
+	}
+	if _, existing, exists := s.lookup(target); exists && existing.Environment != to {
+		http.Error(w, fmt.Sprintf("Function %s exists outside %s", target, to), http.StatusConflict)
+		return
+	}
+
+	config := source.Config
+	if !s.allowed(r.Context(), rbac.Deploy, s.deployTargets(target, config.Project)...) {
+		http.Error(w, fmt.Sprintf("Forbidden: may not deploy %s to %s", target, projectLabel(config.Project)), http.StatusForbidden)
+		return
+	}
+	config.Name = target
+	config.Environment = to
+	// Mirroring copies traffic to a function in the source environment
+	config.Mirror = nil
+	config.PromotedFrom = &Provenance{
+		Function:    name,
+		Environment: from,
+		Version:     source.Version,
+		Digest:      source.Digest,
+		PromotedAt:  time.Now(),
+		PromotedBy:  actor(r.Context()),
+	}
+
+	fn, regErr := s.prepareFunctionFrom(&config, source.Digest)
+	if regErr != nil {
+		http.Error(w, regErr.msg, regErr.status)
+		return
+	}
+
+	// Fail now rather than on the first start when the environment's
+	// secrets aren't there
+	ctx, cancel := context.WithTimeout(r.Context(), 10*time.Second)
+	_, err := s.envRefs.ResolveEnv(ctx, fn.Environ())
+	cancel()
+	if err != nil {
+		s.releaseFunction(fn)
+		http.Error(w, fmt.Sprintf("Failed to resolve env in %s: %v", to, err), http.StatusBadRequest)
+		return
+	}
+
+	_, _, existed := s.lookup(target)
+	s.commitFunction(config, fn)
+	promoted, _ := s.versionHistory(target)
+	version := promoted[len(promoted)-1].Version
+
+	s.audit.Record(audit.Entry{
+		Actor:    actor(r.Context()),
+		Action:   "function.promote",
+		Function: target,
+		Project:  config.Project,
+		Detail: map[string]any{
+			"from":        name,
+			"fromVersion": source.Version,
+			"environment": to,
+			"version":     version,
+			"sha256":      source.Digest,
+		},
+	})
+
+	status := http.StatusOK
+	if !existed {
+		status = http.StatusCreated
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("ETag", s.functionETag(target))
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]any{
+		"name":         target,
+		"status":       "promoted",
+		"environment":  to,
+		"version":      version,
+		"promotedFrom": config.PromotedFrom,
+	})
+}
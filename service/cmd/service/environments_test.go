@@ -0,0 +1,92 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEnvironments(t *testing.T) {
+	s := newTestService(t)
+	rec := do(t, s, "PUT", "/environments/prod", map[string]any{
+		"overrides": map[string]any{"env": []string{"STAGE=prod", "DB_PASSWORD=hunter2"}, "secretEnv": []string{"DB_PASSWORD"}},
+	})
+	require.Equal(t, http.StatusCreated, rec.Code, rec.Body.String())
+	rec = do(t, s, "PUT", "/environments/staging", map[string]any{
+		"next":      "prod",
+		"overrides": map[string]any{"env": []string{"STAGE=staging"}},
+	})
+	require.Equal(t, http.StatusCreated, rec.Code, rec.Body.String())
+
+	rec = do(t, s, "GET", "/environments/prod", nil)
+	require.Equal(t, http.StatusOK, rec.Code)
+	assert.NotContains(t, rec.Body.String(), "hunter2")
+	rec = do(t, s, "GET", "/environments", nil)
+	require.Equal(t, http.StatusOK, rec.Code)
+	var list struct {
+		Environments []Environment `json:"environments"`
+	}
+	require.NoError(t, decodeInto(rec, &list))
+	require.Len(t, list.Environments, 2)
+	assert.Equal(t, "prod", list.Environments[0].Name)
+	assert.Equal(t, "prod", list.Environments[1].Next)
+
+	// Promotions have to end somewhere
+	rec = do(t, s, "PUT", "/environments/prod", map[string]any{"next": "staging"})
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+	rec = do(t, s, "PUT", "/environments/dev", map[string]any{"next": "qa"})
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+	rec = do(t, s, "GET", "/environments/missing", nil)
+	assert.Equal(t, http.StatusNotFound, rec.Code)
+
+	register(t, s, map[string]any{"name": "checkout", "mode": "external", "environment": "staging"})
+	fn, _, _ := s.lookup("checkout")
+	assert.Contains(t, fn.Environ(), "STAGE=staging")
+
+	rec = do(t, s, "DELETE", "/environments/staging", nil)
+	assert.Equal(t, http.StatusConflict, rec.Code, "it still has functions")
+	rec = do(t, s, "DELETE", "/environments/prod", nil)
+	assert.Equal(t, http.StatusConflict, rec.Code, "staging promotes to it")
+	rec = do(t, s, "DELETE", "/environments/missing", nil)
+	assert.Equal(t, http.StatusNotFound, rec.Code)
+}
+
+func TestPromoteFunction(t *testing.T) {
+	s := newTestService(t)
+	rec := do(t, s, "PUT", "/environments/prod", map[string]any{"overrides": map[string]any{"env": []string{"STAGE=prod"}}})
+	require.Equal(t, http.StatusCreated, rec.Code, rec.Body.String())
+	rec = do(t, s, "PUT", "/environments/staging", map[string]any{"next": "prod", "overrides": map[string]any{"env": []string{"STAGE=staging"}}})
+	require.Equal(t, http.StatusCreated, rec.Code, rec.Body.String())
+	register(t, s, map[string]any{"name": "checkout-staging", "mode": "external", "environment": "staging", "env": []string{"REGION=eu"}})
+
+	rec = do(t, s, "POST", "/functions/checkout-staging/promote", nil)
+	require.Equal(t, http.StatusCreated, rec.Code, rec.Body.String())
+	body := decode(t, rec)
+	assert.Equal(t, "checkout-prod", body["name"])
+	assert.Equal(t, "prod", body["environment"])
+
+	fn, config, exists := s.lookup("checkout-prod")
+	require.True(t, exists)
+	assert.Equal(t, "prod", config.Environment)
+	require.NotNil(t, config.PromotedFrom)
+	assert.Equal(t, "checkout-staging", config.PromotedFrom.Function)
+	assert.Equal(t, 1, config.PromotedFrom.Version)
+	assert.Contains(t, fn.Environ(), "STAGE=prod")
+	assert.Contains(t, fn.Environ(), "REGION=eu")
+
+	// Promoting again replaces the promoted function
+	rec = do(t, s, "POST", "/functions/checkout-staging/promote", nil)
+	assert.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+
+	rec = do(t, s, "POST", "/functions/checkout-prod/promote", nil)
+	assert.Equal(t, http.StatusConflict, rec.Code, "prod isn't promoted anywhere")
+	rec = do(t, s, "POST", "/functions/checkout-staging/promote", map[string]any{"version": 9})
+	assert.Equal(t, http.StatusNotFound, rec.Code)
+	register(t, s, map[string]any{"name": "loose", "mode": "external"})
+	rec = do(t, s, "POST", "/functions/loose/promote", nil)
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+	rec = do(t, s, "POST", "/functions/missing/promote", nil)
+	assert.Equal(t, http.StatusNotFound, rec.Code)
+}
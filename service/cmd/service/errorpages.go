@@ -0,0 +1,110 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"kappa-v2/service/internal/kappa"
+	"net/http"
+	"slices"
+)
+
+// Kinds of platform errors an invocation can fail with, which functions can
+// map to their own responses
+const (
+	errorTimeout = "timeout"
+	// errorCircuitOpen is a function failing to start being failed fast
+	// until its cold start backoff is over
+	errorCircuitOpen      = "circuitOpen"
+	errorStartFailed      = "startFailed"
+	errorSaturated        = "saturated"
+	errorInvocationFailed = "invocationFailed"
+	// errorNotAttached is an external function without a runtime attached
+	errorNotAttached = "notAttached"
+	// errorConcurrencyLimit is a function running as many invocations as
+	// it allows, with its queue full
+	errorConcurrencyLimit = "concurrencyLimit"
+	// errorDisabled is a function disabled by an operator
+	errorDisabled = "disabled"
+	// errorRateLimited is a caller invoking a function faster than its
+	// rate limit allows
+	errorRateLimited = "rateLimited"
+	// errorDraining is an invocation arriving as the service shuts down,
+	// after those in flight were waited for
+	errorDraining = "draining"
+)
+
+var errorKinds = []string{errorTimeout, errorCircuitOpen, errorStartFailed, errorSaturated, errorInvocationFailed, errorNotAttached, errorConcurrencyLimit, errorDisabled, errorRateLimited, errorDraining}
+
+// ErrorPage is what clients get for a kind of platform error instead of the
+// service's plain text message. Status replaces the error's status when set
+// and Body its message, sent as ContentType, text/plain by default.
+type ErrorPage struct {
+	Status      int    `json:"status,omitempty"`
+	Body        string `json:"body,omitempty"`
+	ContentType string `json:"contentType,omitempty"`
+}
+
+// ErrorPages maps kinds of platform errors, like "timeout", to pages.
+type ErrorPages map[string]ErrorPage
+
+func (p ErrorPages) validate() error {
+	for kind, page := range p {
+		if !slices.Contains(errorKinds, kind) {
+			return fmt.Errorf("unknown error %q, expected one of %v", kind, errorKinds)
+		}
+		if page.Status != 0 && (page.Status < 400 || page.Status > 599) {
+			return fmt.Errorf("status for %s must be a 4xx or 5xx code", kind)
+		}
+	}
+	return nil
+}
+
+// errorKind classifies an error an invocation failed with.
+func errorKind(err error) string {
+	var startErr *kappa.StartError
+	switch {
+	case errors.Is(err, kappa.ErrStartBackoff):
+		return errorCircuitOpen
+	case errors.Is(err, kappa.ErrNotAttached):
+		return errorNotAttached
+	case errors.Is(err, kappa.ErrConcurrencyLimit):
+		return errorConcurrencyLimit
+	case errors.Is(err, kappa.ErrDisabled):
+		return errorDisabled
+	case errors.Is(err, kappa.ErrDraining):
+		return errorDraining
+	case errors.As(err, &startErr):
+		return errorStartFailed
+	case errors.Is(err, context.DeadlineExceeded):
+		return errorTimeout
+	}
+	return errorInvocationFailed
+}
+
+// invocationError answers an invocation that failed with a platform error
+// of kind, through the function's page for it when it has one. The kind is
+// always reported in X-Kappa-Error for whoever is debugging.
+func (s *KappaService) invocationError(w http.ResponseWriter, name, kind, message string, status int) {
+	w.Header().Set("X-Kappa-Error", kind)
+	page, exists := s.config(name).Errors[kind]
+	if !exists {
+		http.Error(w, message, status)
+		return
+	}
+	if page.Status != 0 {
+		status = page.Status
+	}
+	if page.Body == "" {
+		http.Error(w, message, status)
+		return
+	}
+	contentType := page.ContentType
+	if contentType == "" {
+		contentType = "text/plain; charset=utf-8"
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(status)
+	w.Write([]byte(page.Body))
+}
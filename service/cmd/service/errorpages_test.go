@@ -0,0 +1,67 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"kappa-v2/service/internal/kappa"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestErrorKind(t *testing.T) {
+	tests := []struct {
+		err  error
+		kind string
+	}{
+		{fmt.Errorf("invoke: %w", context.DeadlineExceeded), errorTimeout},
+		{kappa.ErrStartBackoff, errorCircuitOpen},
+		{&kappa.StartError{Err: errors.New("exec format error")}, errorStartFailed},
+		{kappa.ErrNotAttached, errorNotAttached},
+		{kappa.ErrDisabled, errorDisabled},
+		{errors.New("connection reset"), errorInvocationFailed},
+	}
+	for _, tt := range tests {
+		t.Run(tt.kind, func(t *testing.T) {
+			assert.Equal(t, tt.kind, errorKind(tt.err))
+		})
+	}
+}
+
+func TestErrorPages(t *testing.T) {
+	s := newTestService(t)
+	register(t, s, map[string]any{
+		"name": "orders",
+		"mode": "external",
+		"errors": map[string]any{
+			"notAttached": map[string]any{"status": 502, "body": `{"error":"unavailable"}`, "contentType": "application/json"},
+			"disabled":    map[string]any{"status": 410},
+		},
+	})
+
+	// No runtime is attached
+	rec := do(t, s, "POST", "/functions/orders", map[string]any{})
+	assert.Equal(t, http.StatusBadGateway, rec.Code)
+	assert.Equal(t, `{"error":"unavailable"}`, rec.Body.String())
+	assert.Equal(t, "application/json", rec.Header().Get("Content-Type"))
+	assert.Equal(t, errorNotAttached, rec.Header().Get("X-Kappa-Error"))
+
+	// Without a body the service's message is kept
+	rec = do(t, s, "POST", "/functions/orders/disable", nil)
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	rec = do(t, s, "POST", "/functions/orders", map[string]any{})
+	assert.Equal(t, http.StatusGone, rec.Code)
+	assert.Equal(t, errorDisabled, rec.Header().Get("X-Kappa-Error"))
+	assert.NotEmpty(t, rec.Body.String())
+
+	for _, pages := range []map[string]any{
+		{"meltdown": map[string]any{"status": 500}},
+		{"timeout": map[string]any{"status": 302}},
+	} {
+		rec = do(t, s, "POST", "/functions", map[string]any{"name": "billing", "mode": "external", "errors": pages})
+		assert.Equal(t, http.StatusBadRequest, rec.Code, rec.Body.String())
+	}
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"strings"
+)
+
+// functionETag identifies a revision of a function's registered config and
+// binary, changing whenever either does.
+func (s *KappaService) functionETag(name string) string {
+	fn, _, exists := s.lookup(name)
+	if !exists {
+		return ""
+	}
+	config, _ := json.Marshal(s.config(name))
+	h := sha256.New()
+	h.Write(config)
+	h.Write([]byte(fn.ArtifactDigest))
+	return `"` + hex.EncodeToString(h.Sum(nil))[:32] + `"`
+}
+
+// etagMatches reports whether a comma separated If-Match or If-None-Match
+// header lists etag. With weak set, W/ prefixes are ignored.
+func etagMatches(header, etag string, weak bool) bool {
+	for _, candidate := range strings.Split(header, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" {
+			return etag != ""
+		}
+		if weak {
+			candidate = strings.TrimPrefix(candidate, "W/")
+		}
+		if etag != "" && candidate == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// checkPreconditions enforces If-Match and If-None-Match on a request that
+// changes a function, writing 412 and returning false when they fail. An
+// empty etag means the function doesn't exist yet.
+func checkPreconditions(w http.ResponseWriter, r *http.Request, etag string) bool {
+	if ifMatch := r.Header.Get("If-Match"); ifMatch != "" && !etagMatches(ifMatch, etag, false) {
+		http.Error(w, "Function has changed, If-Match failed", http.StatusPreconditionFailed)
+		return false
+	}
+	if ifNoneMatch := r.Header.Get("If-None-Match"); ifNoneMatch != "" && etagMatches(ifNoneMatch, etag, true) {
+		http.Error(w, "Function already exists, If-None-Match failed", http.StatusPreconditionFailed)
+		return false
+	}
+	return true
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEtagMatches(t *testing.T) {
+	const etag = `"abc"`
+	tests := []struct {
+		name   string
+		header string
+		weak   bool
+		match  bool
+	}{
+		{"same", `"abc"`, false, true},
+		{"listed", `"xyz", "abc"`, false, true},
+		{"other", `"xyz"`, false, false},
+		{"any", "*", false, true},
+		{"weak compared weakly", `W/"abc"`, true, true},
+		{"weak compared strongly", `W/"abc"`, false, false},
+		{"unquoted", "abc", true, false},
+		{"garbage", "not an etag", true, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.match, etagMatches(tt.header, etag, tt.weak))
+		})
+	}
+	assert.False(t, etagMatches("*", "", false), "nothing matches a function that doesn't exist")
+}
+
+func TestFunctionETag_Preconditions(t *testing.T) {
+	s := newTestService(t)
+	register(t, s, map[string]any{"name": "orders", "mode": "external"})
+
+	rec := do(t, s, "GET", "/functions/orders", nil)
+	require.Equal(t, http.StatusOK, rec.Code)
+	etag := rec.Header().Get("ETag")
+	require.NotEmpty(t, etag)
+
+	rec = do(t, s, "GET", "/functions/orders", nil, "If-None-Match", etag)
+	assert.Equal(t, http.StatusNotModified, rec.Code)
+	assert.Empty(t, rec.Body.String())
+	rec = do(t, s, "GET", "/functions/orders", nil, "If-None-Match", "W/"+etag)
+	assert.Equal(t, http.StatusNotModified, rec.Code)
+	rec = do(t, s, "GET", "/functions/orders", nil, "If-None-Match", "garbage")
+	assert.Equal(t, http.StatusOK, rec.Code)
+
+	rec = do(t, s, "PUT", "/functions/orders", map[string]any{"mode": "external", "timeoutMs": 1000}, "If-Match", etag)
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	current := rec.Header().Get("ETag")
+	assert.NotEqual(t, etag, current, "changing the function changes its etag")
+
+	// The etag fetched before the change is stale now
+	rec = do(t, s, "PUT", "/functions/orders", map[string]any{"mode": "external"}, "If-Match", etag)
+	assert.Equal(t, http.StatusPreconditionFailed, rec.Code)
+	rec = do(t, s, "DELETE", "/functions/orders", nil, "If-Match", etag)
+	assert.Equal(t, http.StatusPreconditionFailed, rec.Code)
+	// If-Match compares strongly
+	rec = do(t, s, "DELETE", "/functions/orders", nil, "If-Match", "W/"+current)
+	assert.Equal(t, http.StatusPreconditionFailed, rec.Code)
+	rec = do(t, s, "DELETE", "/functions/orders", nil, "If-Match", "garbage")
+	assert.Equal(t, http.StatusPreconditionFailed, rec.Code)
+	_, _, exists := s.lookup("orders")
+	assert.True(t, exists)
+
+	rec = do(t, s, "DELETE", "/functions/orders", nil, "If-Match", current)
+	assert.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+}
+
+func TestRegisterFunction_Preconditions(t *testing.T) {
+	s := newTestService(t)
+	config := map[string]any{"name": "orders", "mode": "external"}
+
+	// Only creates the function if it doesn't exist yet
+	rec := do(t, s, "POST", "/functions", config, "If-None-Match", "*")
+	require.Equal(t, http.StatusCreated, rec.Code, rec.Body.String())
+	etag := rec.Header().Get("ETag")
+	assert.NotEmpty(t, etag)
+	rec = do(t, s, "POST", "/functions", config, "If-None-Match", "*")
+	assert.Equal(t, http.StatusPreconditionFailed, rec.Code)
+
+	rec = do(t, s, "GET", "/functions/orders", nil)
+	require.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, etag, rec.Header().Get("ETag"))
+	var registered KappaFunctionConfig
+	require.NoError(t, decodeInto(rec, &registered))
+	assert.Equal(t, "orders", registered.Name)
+
+	rec = do(t, s, "GET", "/functions/missing", nil)
+	assert.Equal(t, http.StatusNotFound, rec.Code)
+	// Nothing to match when the function doesn't exist
+	rec = do(t, s, "POST", "/functions", map[string]any{"name": "billing", "mode": "external"}, "If-Match", etag)
+	assert.Equal(t, http.StatusPreconditionFailed, rec.Code)
+}
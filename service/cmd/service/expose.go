@@ -0,0 +1,163 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"kappa-v2/pkg/logger"
+	"kappa-v2/service/internal/kappa"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+	"go.uber.org/zap"
+)
+
+// defaultTCPIdleTimeout replaces the built in idle timeout for tcp
+// functions, whose clients tend to hold connections and reconnect
+const defaultTCPIdleTimeout = 30 * time.Minute
+
+// exposure is a host port the service listens on for a tcp function,
+// proxying connections to its runtime. It outlives the function's instances,
+// so connecting starts the function again after it was stopped for idling.
+type exposure struct {
+	listener net.Listener
+	port     int
+}
+
+// expose has the service listen for connections to a tcp function, on
+// hostPort or a port allocated for it. A function that is already exposed
+// keeps its port unless another is asked for.
+func (s *KappaService) expose(name string, hostPort int) (int, error) {
+	s.exposuresMu.Lock()
+	existing, exists := s.exposures[name]
+	s.exposuresMu.Unlock()
+	if exists && (hostPort == 0 || hostPort == existing.port) {
+		return existing.port, nil
+	}
+
+	listener, err := s.ports.Listen(name, hostPort)
+	if err != nil {
+		return 0, err
+	}
+	if exists {
+		s.unexpose(name)
+	}
+	e := &exposure{listener: listener, port: listener.Addr().(*net.TCPAddr).Port}
+	s.exposuresMu.Lock()
+	s.exposures[name] = e
+	s.exposuresMu.Unlock()
+	go s.acceptConnections(name, e)
+
+	logger.Get().Info("Function exposed", zap.String("name", name), zap.Int("port", e.port))
+	return e.port, nil
+}
+
+// unexpose stops listening for a function's connections, those already
+// proxied are left to finish.
+func (s *KappaService) unexpose(name string) {
+	s.exposuresMu.Lock()
+	e, exists := s.exposures[name]
+	delete(s.exposures, name)
+	s.exposuresMu.Unlock()
+	if !exists {
+		return
+	}
+	e.listener.Close()
+	s.ports.Release(e.port)
+}
+
+func (s *KappaService) acceptConnections(name string, e *exposure) {
+	for {
+		conn, err := e.listener.Accept()
+		if errors.Is(err, net.ErrClosed) {
+			return
+		}
+		if err != nil {
+			logger.Get().Warn("Failed to accept connection", zap.String("name", name), zap.Error(err))
+			time.Sleep(100 * time.Millisecond)
+			continue
+		}
+		go s.proxyConnection(name, conn)
+	}
+}
+
+// proxyConnection passes a client's bytes to the function's runtime and
+// back, starting the function if needed, until either side closes.
+func (s *KappaService) proxyConnection(name string, client net.Conn) {
+	defer client.Close()
+	l := logger.Get().With(zap.String("name", name), zap.String("remoteAddr", client.RemoteAddr().String()))
+
+	fn, _, exists := s.lookup(name)
+	if !exists {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), fn.Timeout())
+	target, _, release, err := fn.Connect(ctx, kappa.HTTP1)
+	cancel()
+	if err != nil {
+		l.Warn("Failed to connect to function", zap.Error(err))
+		return
+	}
+	defer release()
+
+	runtime, err := net.DialTimeout("tcp", target.Host, fn.Timeout())
+	if err != nil {
+		l.Warn("Failed to reach function", zap.Error(err))
+		return
+	}
+	defer runtime.Close()
+
+	// Close both once either side is done, so the other copy returns too
+	done := make(chan struct{}, 2)
+	pipe := func(dst, src net.Conn) {
+		io.Copy(dst, src)
+		done <- struct{}{}
+	}
+	go pipe(runtime, client)
+	go pipe(client, runtime)
+	<-done
+}
+
+// closeExposures stops listening for every function's connections.
+func (s *KappaService) closeExposures() {
+	s.exposuresMu.Lock()
+	names := make([]string, 0, len(s.exposures))
+	for name := range s.exposures {
+		names = append(names, name)
+	}
+	s.exposuresMu.Unlock()
+	for _, name := range names {
+		s.unexpose(name)
+	}
+}
+
+// HTTP handler for getting the host port a tcp function is exposed on
+func (s *KappaService) getExposure(w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["name"]
+
+	fn, _, exists := s.lookup(name)
+	if !exists {
+		http.Error(w, fmt.Sprintf("Function not found: %s", name), http.StatusNotFound)
+		return
+	}
+	s.exposuresMu.Lock()
+	e, exposed := s.exposures[name]
+	s.exposuresMu.Unlock()
+	if !exposed {
+		http.Error(w, fmt.Sprintf("Function isn't exposed: %s", name), http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{
+		"name":        name,
+		"hostPort":    e.port,
+		"targetPort":  fn.Port,
+		"connections": fn.Connections(),
+		"isRunning":   fn.IsRunning(),
+	})
+}
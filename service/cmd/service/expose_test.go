@@ -0,0 +1,59 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGetExposure(t *testing.T) {
+	s := newTestService(t)
+	backend := registerFake(t, s, map[string]any{"name": "cache", "mode": "tcp"}, func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("from the runtime"))
+	})
+
+	rec := do(t, s, "GET", "/functions/cache/exposure", nil)
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	exposure := decode(t, rec)
+	assert.Equal(t, "cache", exposure["name"])
+	hostPort := int(exposure["hostPort"].(float64))
+	assert.NotZero(t, hostPort)
+
+	// Connecting to the host port starts the function and reaches it
+	resp, err := http.Get("http://127.0.0.1:" + strconv.Itoa(hostPort) + "/")
+	require.NoError(t, err)
+	body, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	require.NoError(t, err)
+	assert.Equal(t, "from the runtime", string(body))
+	assert.Len(t, backend.runs(), 1)
+
+	rec = do(t, s, "GET", "/functions/cache/exposure", nil)
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	assert.Equal(t, true, decode(t, rec)["isRunning"])
+
+	// Deleting the function stops listening for it
+	rec = do(t, s, "DELETE", "/functions/cache", nil)
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	_, err = http.Get("http://127.0.0.1:" + strconv.Itoa(hostPort) + "/")
+	assert.Error(t, err)
+}
+
+func TestGetExposure_NotExposed(t *testing.T) {
+	s := newTestService(t)
+	registerFake(t, s, map[string]any{"name": "orders"}, func(w http.ResponseWriter, r *http.Request) {})
+
+	rec := do(t, s, "GET", "/functions/missing/exposure", nil)
+	assert.Equal(t, http.StatusNotFound, rec.Code)
+	rec = do(t, s, "GET", "/functions/orders/exposure", nil)
+	assert.Equal(t, http.StatusNotFound, rec.Code)
+	assert.Contains(t, rec.Body.String(), "Function isn't exposed")
+
+	// Only tcp functions take a host port
+	rec = do(t, s, "POST", "/functions", map[string]any{"name": "billing", "mode": "external", "hostPort": 9000})
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+}
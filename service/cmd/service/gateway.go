@@ -0,0 +1,102 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"kappa-v2/service/internal/gateway"
+	"kappa-v2/service/internal/rbac"
+	"net/http"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+// pathParamsKey carries the parameters of the gateway route a request came
+// in on
+type pathParamsKey struct{}
+
+// pathParams returns the parameters of the gateway route the request came
+// in on, nil for requests to the service's own routes.
+func pathParams(r *http.Request) map[string]string {
+	params, _ := r.Context().Value(pathParamsKey{}).(map[string]string)
+	return params
+}
+
+// httpRoutes are the gateway routes of a function's http triggers.
+func httpRoutes(function string, triggers []Trigger) []gateway.Route {
+	var routes []gateway.Route
+	for i, t := range triggers {
+		if t.Type == triggerHTTP {
+			routes = append(routes, gateway.Route{Method: t.Method, Path: t.Path, Function: function, Trigger: triggerName(t, i)})
+		}
+	}
+	return routes
+}
+
+// checkRoutes checks the function's http triggers neither shadow the
+// service's own routes nor take another function's.
+func (s *KappaService) checkRoutes(function string, triggers []Trigger) error {
+	routes := httpRoutes(function, triggers)
+	for _, route := range routes {
+		method := route.Method
+		if method == "" {
+			method = http.MethodGet
+		}
+		// Routes of the service matching the path for another method are
+		// as good as taken, it answers 405 for them
+		req, err := http.NewRequest(method, route.Sample(), nil)
+		if err != nil {
+			return err
+		}
+		var m mux.RouteMatch
+		matched := s.router.Match(req, &m)
+		if (matched && m.MatchErr == nil) || m.MatchErr == mux.ErrMethodMismatch {
+			return fmt.Errorf("%w: %s is one of the service's routes", gateway.ErrConflict, route)
+		}
+	}
+	return s.gateway.Check(function, routes)
+}
+
+// serveGateway serves the requests no route of the service matches, through
+// the function whose http trigger does, like invoking it directly.
+func (s *KappaService) serveGateway(w http.ResponseWriter, r *http.Request) {
+	method := r.Method
+	if isPreflight(r) {
+		// Answered by the policy of the function the request would go to
+		method = r.Header.Get("Access-Control-Request-Method")
+	}
+	route, params, allowed := s.gateway.Match(method, r.URL.Path)
+	if route.Function == "" && method == http.MethodHead {
+		// HEAD goes where GET does, its response without the body
+		route, params, allowed = s.gateway.Match(http.MethodGet, r.URL.Path)
+	}
+	if route.Function == "" {
+		if len(allowed) > 0 {
+			w.Header().Set("Allow", strings.Join(allowed, ", "))
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		http.NotFound(w, r)
+		return
+	}
+
+	r = mux.SetURLVars(r, map[string]string{"name": route.Function})
+	r = r.WithContext(context.WithValue(r.Context(), pathParamsKey{}, params))
+	r.Header.Set("X-Kappa-Route", route.String())
+	s.withCORS(s.withResponseHeaders(s.proxied(s.rateLimited(s.invokeFunction))))(w, r)
+}
+
+// HTTP handler for listing the gateway's routes, in the order they are
+// matched
+func (s *KappaService) listRoutes(w http.ResponseWriter, r *http.Request) {
+	routes := s.gateway.Routes()
+	visible := routes[:0]
+	for _, route := range routes {
+		if s.allowed(r.Context(), rbac.Read, s.config(route.Function).Project) {
+			visible = append(visible, route)
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{"routes": visible})
+}
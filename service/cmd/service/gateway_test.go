@@ -0,0 +1,57 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestServeGateway(t *testing.T) {
+	s := newTestService(t)
+	register(t, s, map[string]any{"name": "users", "mode": "external", "triggers": []map[string]any{
+		{"type": "http", "method": "GET", "path": "/users/{id}"},
+	}})
+	attachRuntime(t, s, "users", func(w http.ResponseWriter, r *http.Request) {
+		var event struct {
+			PathParams map[string]string `json:"pathParams"`
+			Headers    map[string]string `json:"headers"`
+		}
+		json.NewDecoder(r.Body).Decode(&event)
+		json.NewEncoder(w).Encode(map[string]string{"id": event.PathParams["id"], "route": event.Headers["X-Kappa-Route"]})
+	})
+
+	rec := do(t, s, "GET", "/users/42", nil)
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	assert.JSONEq(t, `{"id":"42","route":"GET /users/{id}"}`, rec.Body.String())
+	rec = do(t, s, "HEAD", "/users/42", nil)
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Empty(t, rec.Body.String())
+
+	rec = do(t, s, "GET", "/routes", nil)
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	assert.JSONEq(t, `{"routes":[{"method":"GET","path":"/users/{id}","function":"users","trigger":"http-0"}]}`, rec.Body.String())
+}
+
+func TestServeGateway_Unrouted(t *testing.T) {
+	s := newTestService(t)
+	register(t, s, map[string]any{"name": "users", "mode": "external", "triggers": []map[string]any{
+		{"type": "http", "method": "GET", "path": "/users/{id}"},
+	}})
+
+	rec := do(t, s, "POST", "/users/42", nil)
+	assert.Equal(t, http.StatusMethodNotAllowed, rec.Code)
+	assert.Equal(t, "GET", rec.Header().Get("Allow"))
+	rec = do(t, s, "GET", "/orders/42", nil)
+	assert.Equal(t, http.StatusNotFound, rec.Code)
+
+	// Routes are neither the service's own nor another function's
+	for _, path := range []string{"/users/{name}", "/functions/{name}"} {
+		rec = do(t, s, "POST", "/functions", map[string]any{"name": "admin", "mode": "external", "triggers": []map[string]any{
+			{"type": "http", "method": "GET", "path": path},
+		}})
+		assert.Equal(t, http.StatusConflict, rec.Code, path)
+	}
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"fmt"
+	"kappa-v2/pkg/logger"
+	"kappa-v2/service/internal/kappa"
+	"net/http"
+	"net/http/httputil"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/mux"
+	"go.uber.org/zap"
+)
+
+// gRPC status codes the service answers calls it can't pass on with
+const (
+	grpcNotFound      = 5
+	grpcUnimplemented = 12
+	grpcUnavailable   = 14
+)
+
+// GRPCConfig opts a function into having gRPC calls at /grpc/{name}/
+// proxied to its runtime, which serves them on its port over HTTP/2.
+// Services are the fully qualified services it registers, like
+// "helloworld.Greeter", and calls to others are answered Unimplemented
+// without reaching it. Without any every call is passed on.
+type GRPCConfig struct {
+	Services []string `json:"services,omitempty"`
+}
+
+func (c *GRPCConfig) validate() error {
+	for _, service := range c.Services {
+		if service == "" || strings.Contains(service, "/") {
+			return fmt.Errorf("invalid service %q", service)
+		}
+	}
+	return nil
+}
+
+// grpcError answers a call with a gRPC status and no messages, which gRPC
+// clients expect instead of HTTP errors.
+func grpcError(w http.ResponseWriter, code int, message string) {
+	w.Header().Set("Content-Type", "application/grpc")
+	w.Header().Set("Grpc-Status", strconv.Itoa(code))
+	w.Header().Set("Grpc-Message", message)
+	w.WriteHeader(http.StatusOK)
+}
+
+// HTTP handler for proxying gRPC calls to a function. The call's path past
+// /grpc/{name}, its /package.Service/Method, is what the runtime sees, and
+// streams are passed through as they are written.
+func (s *KappaService) proxyGRPC(w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["name"]
+
+	if r.ProtoMajor != 2 || !strings.HasPrefix(r.Header.Get("Content-Type"), "application/grpc") {
+		http.Error(w, "Expected a gRPC call over HTTP/2", http.StatusUnsupportedMediaType)
+		return
+	}
+	fn, _, exists := s.lookup(name)
+	if !exists {
+		grpcError(w, grpcNotFound, fmt.Sprintf("function not found: %s", name))
+		return
+	}
+	config := s.config(name).GRPC
+	if config == nil {
+		grpcError(w, grpcUnimplemented, fmt.Sprintf("function doesn't serve gRPC: %s", name))
+		return
+	}
+	method := strings.TrimPrefix(r.URL.Path, "/grpc/"+name)
+	service, _, ok := strings.Cut(strings.TrimPrefix(method, "/"), "/")
+	if !ok {
+		grpcError(w, grpcUnimplemented, fmt.Sprintf("malformed method: %s", method))
+		return
+	}
+	if len(config.Services) > 0 && !slices.Contains(config.Services, service) {
+		grpcError(w, grpcUnimplemented, fmt.Sprintf("unknown service %s", service))
+		return
+	}
+
+	target, transport, release, err := fn.Connect(r.Context(), kappa.HTTP2)
+	if err != nil {
+		w.Header().Set("X-Kappa-Error", errorKind(err))
+		grpcError(w, grpcUnavailable, fmt.Sprintf("failed to connect to function: %v", err))
+		return
+	}
+	defer release()
+
+	proxy := &httputil.ReverseProxy{
+		Rewrite: func(pr *httputil.ProxyRequest) {
+			pr.SetURL(target)
+			pr.Out.URL.Path = method
+			pr.Out.URL.RawPath = ""
+			pr.Out.Header.Set("X-Request-Id", requestID(r.Context()))
+		},
+		Transport:     transport,
+		FlushInterval: -1,
+		ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
+			logger.FromCtx(r.Context()).Warn("gRPC proxy failed", zap.String("function", name), zap.Error(err))
+			grpcError(w, grpcUnavailable, fmt.Sprintf("failed to reach function: %v", err))
+		},
+	}
+	proxy.ServeHTTP(w, r)
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/status"
+)
+
+// dialProxy serves s's router over HTTP/2 without TLS and returns a gRPC
+// connection to it, whose calls name the function in their method.
+func dialProxy(t *testing.T, s *KappaService) *grpc.ClientConn {
+	t.Helper()
+	server := httptest.NewUnstartedServer(s.router)
+	server.Config.Protocols = new(http.Protocols)
+	server.Config.Protocols.SetUnencryptedHTTP2(true)
+	server.Start()
+	t.Cleanup(server.Close)
+
+	conn, err := grpc.Dial(strings.TrimPrefix(server.URL, "http://"), grpc.WithTransportCredentials(insecure.NewCredentials()))
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+// registerGRPC registers a function whose runtime serves the gRPC health
+// service.
+func registerGRPC(t *testing.T, s *KappaService, config map[string]any) {
+	t.Helper()
+	runtime := grpc.NewServer()
+	healthpb.RegisterHealthServer(runtime, health.NewServer())
+	t.Cleanup(runtime.Stop)
+	registerFake(t, s, config, runtime.ServeHTTP)
+}
+
+func TestProxyGRPC(t *testing.T) {
+	s := newTestService(t)
+	registerGRPC(t, s, map[string]any{"name": "greeter", "grpc": map[string]any{"services": []string{"grpc.health.v1.Health"}}})
+	conn := dialProxy(t, s)
+
+	var resp healthpb.HealthCheckResponse
+	err := conn.Invoke(context.Background(), "/grpc/greeter/grpc.health.v1.Health/Check", &healthpb.HealthCheckRequest{}, &resp)
+	require.NoError(t, err)
+	assert.Equal(t, healthpb.HealthCheckResponse_SERVING, resp.GetStatus())
+}
+
+func TestProxyGRPC_Rejected(t *testing.T) {
+	s := newTestService(t)
+	registerGRPC(t, s, map[string]any{"name": "greeter", "grpc": map[string]any{"services": []string{"helloworld.Greeter"}}})
+	registerFake(t, s, map[string]any{"name": "orders"}, func(w http.ResponseWriter, r *http.Request) {})
+	conn := dialProxy(t, s)
+
+	tests := map[string]codes.Code{
+		"/grpc/missing/grpc.health.v1.Health/Check": codes.NotFound,
+		"/grpc/orders/grpc.health.v1.Health/Check":  codes.Unimplemented,
+		"/grpc/greeter/grpc.health.v1.Health/Check": codes.Unimplemented,
+	}
+	for method, code := range tests {
+		var resp healthpb.HealthCheckResponse
+		err := conn.Invoke(context.Background(), method, &healthpb.HealthCheckRequest{}, &resp)
+		assert.Equal(t, code, status.Code(err), method)
+	}
+
+	// Calls have to be gRPC over HTTP/2
+	rec := do(t, s, "POST", "/grpc/greeter/helloworld.Greeter/SayHello", map[string]any{})
+	assert.Equal(t, http.StatusUnsupportedMediaType, rec.Code)
+
+	rec = do(t, s, "POST", "/functions", map[string]any{"name": "bad", "binaryPath": "/bin/true", "grpc": map[string]any{"services": []string{"a/b"}}})
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+}
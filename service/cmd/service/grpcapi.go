@@ -0,0 +1,388 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"kappa-v2/pkg/kappapb"
+	"kappa-v2/pkg/logger"
+	"kappa-v2/service/internal/kappa"
+	"kappa-v2/service/internal/rbac"
+	"net"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"go.uber.org/zap"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+// grpcErrorKey is the metadata key unary invocations report their platform
+// error kind in, like X-Kappa-Error on the REST API
+const grpcErrorKey = "x-kappa-error"
+
+// grpcAPI serves the service's gRPC API, kappapb.Kappa, on the same
+// functions as the REST API.
+type grpcAPI struct {
+	kappapb.UnimplementedKappaServer
+	s *KappaService
+}
+
+// startGRPC serves the gRPC API on grpcAddr, over TLS when the service has
+// a certificate.
+func (s *KappaService) startGRPC() error {
+	opts := []grpc.ServerOption{
+		grpc.ChainUnaryInterceptor(s.grpcUnary),
+		grpc.ChainStreamInterceptor(s.grpcStream),
+	}
+	if s.tlsCert != "" {
+		cert, err := tls.LoadX509KeyPair(s.tlsCert, s.tlsKey)
+		if err != nil {
+			return fmt.Errorf("failed to load TLS certificate: %w", err)
+		}
+		config := s.serverTLSConfig()
+		config.Certificates = []tls.Certificate{cert}
+		opts = append(opts, grpc.Creds(credentials.NewTLS(config)))
+	}
+	ln, err := net.Listen("tcp", s.grpcAddr)
+	if err != nil {
+		return fmt.Errorf("failed to listen on gRPC address: %w", err)
+	}
+	s.grpcServer = grpc.NewServer(opts...)
+	kappapb.RegisterKappaServer(s.grpcServer, &grpcAPI{s: s})
+
+	logger.Get().Info("Starting gRPC API", zap.String("address", s.grpcAddr), zap.Bool("tls", s.tlsCert != ""))
+	go func() {
+		if err := s.grpcServer.Serve(ln); err != nil {
+			logger.Get().Fatal("gRPC API failed", zap.Error(err))
+		}
+	}()
+	return nil
+}
+
+// stopGRPC lets calls in progress finish until ctx ends, then cuts them off.
+func (s *KappaService) stopGRPC(ctx context.Context) {
+	stopped := make(chan struct{})
+	go func() {
+		s.grpcServer.GracefulStop()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-ctx.Done():
+		s.grpcServer.Stop()
+	}
+}
+
+// grpcAuthenticate returns ctx with the subject a call's credentials
+// authenticate as, the bearer token in its authorization metadata or its
+// client certificate. Calls without credentials go on without a subject,
+// which only public functions may be invoked by.
+func (s *KappaService) grpcAuthenticate(ctx context.Context) (context.Context, error) {
+	if !s.authRequired() {
+		return ctx, nil
+	}
+	// The providers read credentials off HTTP requests
+	r := &http.Request{Header: make(http.Header)}
+	md, _ := metadata.FromIncomingContext(ctx)
+	for _, v := range md.Get("authorization") {
+		r.Header.Add("Authorization", v)
+	}
+	if p, ok := peer.FromContext(ctx); ok {
+		if info, ok := p.AuthInfo.(credentials.TLSInfo); ok {
+			r.TLS = &info.State
+		}
+	}
+	if r.Header.Get("Authorization") == "" && (r.TLS == nil || len(r.TLS.VerifiedChains) == 0) {
+		return ctx, nil
+	}
+	subject, ok := s.authenticate(r)
+	if !ok {
+		return nil, status.Error(codes.Unauthenticated, "Unauthorized")
+	}
+	return context.WithValue(ctx, subjectKey{}, subject), nil
+}
+
+// grpcCaller is who a call is rate limited as, like callerIdentity.
+func grpcCaller(ctx context.Context) string {
+	var addr string
+	if p, ok := peer.FromContext(ctx); ok {
+		addr = p.Addr.String()
+	}
+	return callerIdentity(ctx, addr)
+}
+
+// grpcDenied is the error for a call whose subject may not do what it
+// asked, or that has no subject at all.
+func grpcDenied(ctx context.Context, format string, args ...any) error {
+	if _, ok := ctx.Value(subjectKey{}).(rbac.Subject); !ok {
+		return status.Error(codes.Unauthenticated, "Unauthorized")
+	}
+	return status.Errorf(codes.PermissionDenied, "Forbidden: "+format, args...)
+}
+
+// grpcUnary authenticates and logs unary calls
+func (s *KappaService) grpcUnary(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+	started := time.Now()
+	ctx, err := s.grpcAuthenticate(ctx)
+	var resp any
+	if err == nil {
+		resp, err = handler(ctx, req)
+	}
+	logGRPC(info.FullMethod, started, err)
+	return resp, err
+}
+
+// grpcStream authenticates and logs streaming calls
+func (s *KappaService) grpcStream(srv any, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	started := time.Now()
+	ctx, err := s.grpcAuthenticate(ss.Context())
+	if err == nil {
+		err = handler(srv, &authenticatedStream{ServerStream: ss, ctx: ctx})
+	}
+	logGRPC(info.FullMethod, started, err)
+	return err
+}
+
+// authenticatedStream is a stream whose context carries its subject
+type authenticatedStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (a *authenticatedStream) Context() context.Context {
+	return a.ctx
+}
+
+func logGRPC(method string, started time.Time, err error) {
+	logger.Get().Info("gRPC call",
+		zap.String("method", method),
+		zap.String("code", status.Code(err).String()),
+		zap.Duration("latency", time.Since(started)))
+}
+
+// grpcCode is the status code for a failed registration's HTTP status
+func grpcCode(httpStatus int) codes.Code {
+	switch httpStatus {
+	case http.StatusBadRequest:
+		return codes.InvalidArgument
+	case http.StatusNotFound:
+		return codes.NotFound
+	case http.StatusForbidden:
+		return codes.PermissionDenied
+	case http.StatusConflict:
+		return codes.AlreadyExists
+	case http.StatusLocked, http.StatusPreconditionFailed:
+		return codes.FailedPrecondition
+	case http.StatusServiceUnavailable:
+		return codes.Unavailable
+	}
+	return codes.Internal
+}
+
+// errorKindCodes are the status codes invocations failing with each kind of
+// platform error end with
+var errorKindCodes = map[string]codes.Code{
+	errorTimeout:          codes.DeadlineExceeded,
+	errorCircuitOpen:      codes.Unavailable,
+	errorStartFailed:      codes.Unavailable,
+	errorSaturated:        codes.ResourceExhausted,
+	errorInvocationFailed: codes.Internal,
+	errorNotAttached:      codes.Unavailable,
+	errorConcurrencyLimit: codes.ResourceExhausted,
+	errorDisabled:         codes.Unavailable,
+	errorRateLimited:      codes.ResourceExhausted,
+}
+
+func (a *grpcAPI) RegisterFunction(ctx context.Context, req *kappapb.RegisterFunctionRequest) (*kappapb.RegisterFunctionResponse, error) {
+	s := a.s
+	var config KappaFunctionConfig
+	if err := json.Unmarshal([]byte(req.GetConfig()), &config); err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "Invalid config: %v", err)
+	}
+	if maintenance := s.maintenanceMode(); maintenance.Enabled {
+		return nil, status.Error(codes.Unavailable, maintenance.message())
+	}
+	if !s.allowed(ctx, rbac.Deploy, s.deployTargets(config.Name, config.Project)...) {
+		return nil, grpcDenied(ctx, "may not deploy %s to %s", config.Name, projectLabel(config.Project))
+	}
+
+	fn, regErr := s.prepareFunction(&config)
+	if regErr != nil {
+		return nil, status.Error(grpcCode(regErr.status), regErr.msg)
+	}
+	s.commitFunction(config, fn)
+
+	return &kappapb.RegisterFunctionResponse{
+		Name:   config.Name,
+		Status: "registered",
+		Sha256: fn.ArtifactDigest,
+	}, nil
+}
+
+func (a *grpcAPI) ListFunctions(ctx context.Context, req *kappapb.ListFunctionsRequest) (*kappapb.ListFunctionsResponse, error) {
+	s := a.s
+	resp := &kappapb.ListFunctionsResponse{}
+	now := time.Now()
+	functions, configs := s.snapshot()
+	for name, fn := range functions {
+		if !s.allowed(ctx, rbac.Read, configs[name].Project) {
+			continue
+		}
+		_, disabled := fn.DisabledAt(now)
+		resp.Functions = append(resp.Functions, &kappapb.FunctionSummary{
+			Name:       name,
+			IsRunning:  fn.IsRunning(),
+			Visibility: s.visibility(name),
+			Disabled:   disabled,
+			StartError: fn.StartStatus().LastError,
+		})
+	}
+	slices.SortFunc(resp.Functions, func(a, b *kappapb.FunctionSummary) int {
+		return strings.Compare(a.Name, b.Name)
+	})
+	return resp, nil
+}
+
+func (a *grpcAPI) Invoke(ctx context.Context, req *kappapb.InvokeRequest) (*kappapb.InvokeResponse, error) {
+	resp, kind, err := a.invoke(ctx, req)
+	if kind != "" {
+		grpc.SetHeader(ctx, metadata.Pairs(grpcErrorKey, kind))
+	}
+	return resp, err
+}
+
+func (a *grpcAPI) InvokeStream(stream kappapb.Kappa_InvokeStreamServer) error {
+	for {
+		req, err := stream.Recv()
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		resp, kind, err := a.invoke(stream.Context(), req)
+		if err != nil {
+			// One invocation failing doesn't end the stream
+			resp = &kappapb.InvokeResponse{
+				RequestId: req.GetRequestId(),
+				Error:     status.Convert(err).Message(),
+				ErrorKind: kind,
+			}
+		}
+		if err := stream.Send(resp); err != nil {
+			return err
+		}
+	}
+}
+
+// invoke invokes the function req names, returning the platform error kind
+// it failed with, if any, with a status error.
+func (a *grpcAPI) invoke(ctx context.Context, req *kappapb.InvokeRequest) (*kappapb.InvokeResponse, string, error) {
+	s := a.s
+	name := req.GetName()
+	fn, _, exists := s.lookup(name)
+	if !exists {
+		return nil, "", status.Errorf(codes.NotFound, "Function not found: %s", name)
+	}
+	if s.visibility(name) != visibilityPublic || ctx.Value(subjectKey{}) != nil {
+		if !s.allowed(ctx, rbac.Invoke, s.config(name).Project) {
+			return nil, "", grpcDenied(ctx, "may not invoke %s", name)
+		}
+	}
+	if fn.Mode() == kappa.ModeTCP {
+		return nil, "", status.Errorf(codes.FailedPrecondition, "Function takes connections on its exposed port: %s", name)
+	}
+	if ok, wait := s.takeRate(name, grpcCaller(ctx)); !ok {
+		return nil, errorRateLimited, status.Errorf(codes.ResourceExhausted, "Rate limit exceeded, retry in %s", wait.Round(time.Millisecond))
+	}
+	if window, disabled := fn.DisabledAt(time.Now()); disabled {
+		err := &kappa.DisabledError{Window: window}
+		return nil, errorDisabled, status.Errorf(codes.Unavailable, "Function invocation failed: %v", err)
+	}
+
+	event := kappa.KappaEvent{
+		Path:       "/functions/" + name,
+		HTTPMethod: http.MethodPost,
+		Headers:    req.GetHeaders(),
+		RequestID:  req.GetRequestId(),
+	}
+	if event.RequestID == "" {
+		event.RequestID = uuid.New().String()
+	}
+	if len(req.GetBody()) > 0 {
+		if err := json.Unmarshal(req.GetBody(), &event.Body); err != nil {
+			return nil, "", status.Errorf(codes.InvalidArgument, "Invalid body, expected a JSON object: %v", err)
+		}
+	}
+	encoded, err := kappa.EncodeEvent(event)
+	if err != nil {
+		return nil, "", status.Errorf(codes.InvalidArgument, "Invalid body: %v", err)
+	}
+
+	if err := s.admission.Acquire(ctx, s.priority(name)); err != nil {
+		return nil, errorSaturated, status.Error(codes.ResourceExhausted, "Service is saturated, retry later")
+	}
+	defer s.admission.Release()
+	s.maybeMirror(name, encoded)
+
+	ctx, cancel := context.WithTimeout(ctx, fn.Timeout())
+	defer cancel()
+	resp, err := s.invokeWithFaults(ctx, name, fn, encoded)
+	if err != nil {
+		kind := errorKind(err)
+		return nil, kind, status.Errorf(errorKindCodes[kind], "Function invocation failed: %v", err)
+	}
+	return &kappapb.InvokeResponse{
+		RequestId:  event.RequestID,
+		StatusCode: int32(resp.StatusCode),
+		Headers:    resp.Headers,
+		Body:       resp.Body,
+		Attempts:   int32(resp.Attempts),
+	}, "", nil
+}
+
+func (a *grpcAPI) StreamLogs(req *kappapb.StreamLogsRequest, stream kappapb.Kappa_StreamLogsServer) error {
+	s := a.s
+	ctx := stream.Context()
+	name := req.GetName()
+	fn, _, exists := s.lookup(name)
+	if !exists {
+		return status.Errorf(codes.NotFound, "Function not found: %s", name)
+	}
+	if !s.allowed(ctx, rbac.Read, s.config(name).Project) {
+		return grpcDenied(ctx, "may not read %s", name)
+	}
+
+	if !req.GetFollow() {
+		for _, line := range fn.GetLogs() {
+			if err := stream.Send(&kappapb.LogLine{Line: line}); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	backlog, lines := fn.FollowLogs(ctx)
+	for _, line := range backlog {
+		if err := stream.Send(&kappapb.LogLine{Line: line}); err != nil {
+			return err
+		}
+	}
+	for line := range lines {
+		if err := stream.Send(&kappapb.LogLine{Line: line}); err != nil {
+			return err
+		}
+	}
+	// Following ends with the call
+	return status.FromContextError(ctx.Err()).Err()
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"context"
+	"io"
+	"kappa-v2/pkg/kappapb"
+	"net"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+// dialGRPC serves s's gRPC API in memory, as startGRPC does without TLS,
+// and returns a client for it.
+func dialGRPC(t *testing.T, s *KappaService) kappapb.KappaClient {
+	t.Helper()
+	ln := bufconn.Listen(1 << 20)
+	server := grpc.NewServer(
+		grpc.ChainUnaryInterceptor(s.grpcUnary),
+		grpc.ChainStreamInterceptor(s.grpcStream),
+	)
+	kappapb.RegisterKappaServer(server, &grpcAPI{s: s})
+	go server.Serve(ln)
+	t.Cleanup(server.Stop)
+
+	conn, err := grpc.Dial("passthrough:///kappa",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) { return ln.DialContext(ctx) }),
+		grpc.WithTransportCredentials(insecure.NewCredentials()))
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+	return kappapb.NewKappaClient(conn)
+}
+
+func TestGRPCRegisterFunction(t *testing.T) {
+	s := newTestService(t)
+	client := dialGRPC(t, s)
+	ctx := context.Background()
+
+	resp, err := client.RegisterFunction(ctx, &kappapb.RegisterFunctionRequest{Config: `{"name":"orders","mode":"external"}`})
+	require.NoError(t, err)
+	assert.Equal(t, "orders", resp.GetName())
+	assert.Equal(t, "registered", resp.GetStatus())
+
+	list, err := client.ListFunctions(ctx, &kappapb.ListFunctionsRequest{})
+	require.NoError(t, err)
+	require.Len(t, list.GetFunctions(), 1)
+	assert.Equal(t, "orders", list.GetFunctions()[0].GetName())
+
+	_, err = client.RegisterFunction(ctx, &kappapb.RegisterFunctionRequest{Config: `{`})
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+	_, err = client.RegisterFunction(ctx, &kappapb.RegisterFunctionRequest{Config: `{"mode":"external"}`})
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+
+	rec := do(t, s, "PUT", "/maintenance", map[string]any{"enabled": true})
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	_, err = client.RegisterFunction(ctx, &kappapb.RegisterFunctionRequest{Config: `{"name":"billing","mode":"external"}`})
+	assert.Equal(t, codes.Unavailable, status.Code(err))
+}
+
+func TestGRPCInvoke(t *testing.T) {
+	s := newTestService(t)
+	attachRuntime(t, s, "orders", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"ok":true}`))
+	})
+	client := dialGRPC(t, s)
+	ctx := context.Background()
+
+	resp, err := client.Invoke(ctx, &kappapb.InvokeRequest{Name: "orders", Body: []byte(`{"id":1}`), RequestId: "req-1"})
+	require.NoError(t, err)
+	assert.Equal(t, int32(http.StatusOK), resp.GetStatusCode())
+	assert.Equal(t, "req-1", resp.GetRequestId())
+	assert.JSONEq(t, `{"ok":true}`, string(resp.GetBody()))
+
+	_, err = client.Invoke(ctx, &kappapb.InvokeRequest{Name: "missing"})
+	assert.Equal(t, codes.NotFound, status.Code(err))
+	_, err = client.Invoke(ctx, &kappapb.InvokeRequest{Name: "orders", Body: []byte(`[1]`)})
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+
+	// Platform errors say what kind they are in the call's header
+	rec := do(t, s, "POST", "/functions/orders/disable", map[string]any{})
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	var header metadata.MD
+	_, err = client.Invoke(ctx, &kappapb.InvokeRequest{Name: "orders"}, grpc.Header(&header))
+	assert.Equal(t, codes.Unavailable, status.Code(err))
+	assert.Equal(t, []string{errorDisabled}, header.Get(grpcErrorKey))
+}
+
+func TestGRPCInvokeStream(t *testing.T) {
+	s := newTestService(t)
+	attachRuntime(t, s, "orders", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{}`))
+	})
+	client := dialGRPC(t, s)
+
+	stream, err := client.InvokeStream(context.Background())
+	require.NoError(t, err)
+	for _, req := range []*kappapb.InvokeRequest{
+		{Name: "orders", RequestId: "first"},
+		{Name: "missing", RequestId: "second"},
+		{Name: "orders", RequestId: "third"},
+	} {
+		require.NoError(t, stream.Send(req))
+	}
+	require.NoError(t, stream.CloseSend())
+
+	var responses []*kappapb.InvokeResponse
+	for {
+		resp, err := stream.Recv()
+		if err == io.EOF {
+			break
+		}
+		require.NoError(t, err)
+		responses = append(responses, resp)
+	}
+	// A failed invocation is answered on the stream without ending it
+	require.Len(t, responses, 3)
+	assert.Equal(t, int32(http.StatusOK), responses[0].GetStatusCode())
+	assert.Equal(t, "second", responses[1].GetRequestId())
+	assert.Contains(t, responses[1].GetError(), "Function not found")
+	assert.Equal(t, "third", responses[2].GetRequestId())
+	assert.Equal(t, int32(http.StatusOK), responses[2].GetStatusCode())
+}
+
+func TestGRPCStreamLogs(t *testing.T) {
+	s := newTestService(t)
+	register(t, s, map[string]any{"name": "orders", "mode": "external", "invocationLogs": true})
+	attachRuntime(t, s, "orders", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{}`))
+	})
+	client := dialGRPC(t, s)
+	ctx := context.Background()
+
+	_, err := client.Invoke(ctx, &kappapb.InvokeRequest{Name: "orders", RequestId: "req-1"})
+	require.NoError(t, err)
+
+	stream, err := client.StreamLogs(ctx, &kappapb.StreamLogsRequest{Name: "orders"})
+	require.NoError(t, err)
+	var lines []string
+	for {
+		line, err := stream.Recv()
+		if err == io.EOF {
+			break
+		}
+		require.NoError(t, err)
+		lines = append(lines, line.GetLine())
+	}
+	assert.Contains(t, lines, "END RequestId: req-1")
+
+	stream, err = client.StreamLogs(ctx, &kappapb.StreamLogsRequest{Name: "missing"})
+	require.NoError(t, err)
+	_, err = stream.Recv()
+	assert.Equal(t, codes.NotFound, status.Code(err))
+}
+
+func TestGRPCAuthorize(t *testing.T) {
+	s, keys := newRBACService(t)
+	client := dialGRPC(t, s)
+	as := func(role string) context.Context {
+		return metadata.AppendToOutgoingContext(context.Background(), "authorization", "Bearer "+keys[role])
+	}
+
+	_, err := client.Invoke(as("invoker"), &kappapb.InvokeRequest{Name: "orders"})
+	assert.NoError(t, err)
+	_, err = client.Invoke(context.Background(), &kappapb.InvokeRequest{Name: "site"})
+	assert.NoError(t, err, "public functions take anonymous calls")
+
+	_, err = client.Invoke(context.Background(), &kappapb.InvokeRequest{Name: "orders"})
+	assert.Equal(t, codes.Unauthenticated, status.Code(err))
+	_, err = client.Invoke(as("viewer"), &kappapb.InvokeRequest{Name: "orders"})
+	assert.Equal(t, codes.PermissionDenied, status.Code(err))
+	_, err = client.Invoke(as("invoker"), &kappapb.InvokeRequest{Name: "billing"})
+	assert.Equal(t, codes.PermissionDenied, status.Code(err))
+	_, err = client.Invoke(metadata.AppendToOutgoingContext(context.Background(), "authorization", "Bearer nope"), &kappapb.InvokeRequest{Name: "site"})
+	assert.Equal(t, codes.Unauthenticated, status.Code(err))
+
+	// Functions the caller can't read aren't listed
+	list, err := client.ListFunctions(as("viewer"), &kappapb.ListFunctionsRequest{})
+	require.NoError(t, err)
+	var names []string
+	for _, fn := range list.GetFunctions() {
+		names = append(names, fn.GetName())
+	}
+	assert.Equal(t, []string{"orders", "site"}, names)
+}
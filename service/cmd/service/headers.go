@@ -0,0 +1,21 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/gorilla/mux"
+)
+
+// withResponseHeaders sets the named function's response headers, from its
+// effective settings, on every response of its HTTP routes, errors
+// included. Invocations don't override them with the function's own.
+func (s *KappaService) withResponseHeaders(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if _, config, exists := s.lookup(mux.Vars(r)["name"]); exists {
+			for name, value := range s.effectiveSettings(config).ResponseHeaders {
+				w.Header().Set(name, value.Value)
+			}
+		}
+		next(w, r)
+	}
+}
@@ -0,0 +1,238 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"kappa-v2/service/internal/database"
+	"kappa-v2/service/internal/kappa"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// healthTimeout bounds the checks of a health request
+const healthTimeout = 2 * time.Second
+
+// functionReadiness is whether a function can take invocations, for
+// /readyz.
+type functionReadiness struct {
+	// Status is running, stopped, disabled or failing, or for a function
+	// whose runtime didn't answer its health check, unhealthy
+	Status string `json:"status"`
+	// Ready is whether invocations are served, stopped functions are ready
+	// as they start on their first
+	Ready bool   `json:"ready"`
+	Error string `json:"error,omitempty"`
+}
+
+// healthCheckers returns the checkers of the backends the functions run on,
+// one per backend, or of the default backend while there are no functions.
+func (s *KappaService) healthCheckers() []kappa.HealthChecker {
+	_, configs := s.snapshot()
+	names := []string{""}
+	if len(configs) > 0 {
+		names = names[:0]
+	}
+	for _, config := range configs {
+		names = append(names, config.Backend)
+	}
+	seen := make(map[string]bool)
+	var checkers []kappa.HealthChecker
+	for _, name := range names {
+		backend, err := kappa.BackendByName(name)
+		if err != nil {
+			continue
+		}
+		checker, ok := backend.(kappa.HealthChecker)
+		if !ok || seen[fmt.Sprintf("%T", checker)] {
+			continue
+		}
+		seen[fmt.Sprintf("%T", checker)] = true
+		checkers = append(checkers, checker)
+	}
+	return checkers
+}
+
+// checkHealth runs the database's and backends' checks in parallel,
+// returning them by name and whether they all passed.
+func (s *KappaService) checkHealth(ctx context.Context) (map[string]kappa.Check, bool) {
+	ctx, cancel := context.WithTimeout(ctx, healthTimeout)
+	defer cancel()
+
+	var (
+		mu     sync.Mutex
+		wg     sync.WaitGroup
+		checks = make(map[string]kappa.Check)
+	)
+	if s.db != nil {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			check := kappa.Check{}
+			if schema, err := database.SchemaStatus(ctx, s.db); err != nil {
+				check.Error = err.Error()
+			} else {
+				check.Details = map[string]any{"schema": schema}
+			}
+			mu.Lock()
+			checks["database"] = check
+			mu.Unlock()
+		}()
+	}
+	for _, checker := range s.healthCheckers() {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			results := checker.CheckHealth(ctx)
+			mu.Lock()
+			for name, check := range results {
+				checks[name] = check
+			}
+			mu.Unlock()
+		}()
+	}
+	wg.Wait()
+
+	healthy := true
+	for _, check := range checks {
+		healthy = healthy && check.OK()
+	}
+	return checks, healthy
+}
+
+// readiness reports whether each function can take invocations now.
+func (s *KappaService) readiness() map[string]functionReadiness {
+	now := time.Now()
+	registered, _ := s.snapshot()
+	functions := make(map[string]functionReadiness, len(registered))
+	for name, fn := range registered {
+		functions[name] = readinessOf(fn, now)
+	}
+	return functions
+}
+
+// readinessOf is whether fn can take invocations at now.
+func readinessOf(fn *kappa.KappaFunction, now time.Time) functionReadiness {
+	_, disabled := fn.DisabledAt(now)
+	startError := fn.StartStatus().LastError
+	switch {
+	case disabled:
+		return functionReadiness{Status: "disabled"}
+	case startError != "":
+		return functionReadiness{Status: "failing", Error: startError}
+	case fn.IsRunning():
+		return functionReadiness{Status: "running", Ready: true}
+	default:
+		return functionReadiness{Status: "stopped", Ready: true}
+	}
+}
+
+// shuttingDown reports whether the service is draining to stop.
+func (s *KappaService) shuttingDown() bool {
+	select {
+	case <-s.stop:
+		return true
+	default:
+		return false
+	}
+}
+
+// HTTP handler for the service's liveness: the database, the containerd
+// socket and the image store of the backends in use. It answers 503 when a
+// check fails.
+func (s *KappaService) getHealth(w http.ResponseWriter, r *http.Request) {
+	checks, healthy := s.checkHealth(r.Context())
+	health := map[string]any{"status": "ok", "checks": checks}
+	statusCode := http.StatusOK
+	if !healthy {
+		health["status"] = "unavailable"
+		statusCode = http.StatusServiceUnavailable
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(statusCode)
+	json.NewEncoder(w).Encode(health)
+}
+
+// HTTP handler for the service's readiness to take traffic: the checks of
+// /healthz, not shutting down, and each function's readiness. A function
+// that can't serve doesn't make the service unready, unless it is the one
+// asked after with ?function=.
+func (s *KappaService) getReady(w http.ResponseWriter, r *http.Request) {
+	checks, healthy := s.checkHealth(r.Context())
+	functions := s.readiness()
+	ready := map[string]any{"status": "ready", "checks": checks, "functions": functions}
+	statusCode := http.StatusOK
+	switch {
+	case s.shuttingDown():
+		ready["status"] = "shutting down"
+		statusCode = http.StatusServiceUnavailable
+	case !healthy:
+		ready["status"] = "unavailable"
+		statusCode = http.StatusServiceUnavailable
+	}
+	if name := r.URL.Query().Get("function"); name != "" {
+		readiness, exists := functions[name]
+		if !exists {
+			http.Error(w, fmt.Sprintf("Function not found: %s", name), http.StatusNotFound)
+			return
+		}
+		ready["functions"] = map[string]functionReadiness{name: readiness}
+		if statusCode == http.StatusOK && !readiness.Ready {
+			ready["status"] = readiness.Status
+			statusCode = http.StatusServiceUnavailable
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(statusCode)
+	json.NewEncoder(w).Encode(ready)
+}
+
+// HTTP handler for one function's health, for load balancers to check it
+// on its own. It answers 503 when the function is disabled or failing to
+// start, or the service is shutting down. Functions with forwardHealth set
+// are asked for their own /health while they run, whose status and body
+// are passed on; runtimes without the route are answered for as above.
+func (s *KappaService) getFunctionHealth(w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["name"]
+	fn, _, exists := s.lookup(name)
+	if !exists {
+		http.Error(w, fmt.Sprintf("Function not found: %s", name), http.StatusNotFound)
+		return
+	}
+
+	readiness := readinessOf(fn, time.Now())
+	if readiness.Ready && !s.shuttingDown() && s.config(name).ForwardHealth {
+		ctx, cancel := context.WithTimeout(r.Context(), healthTimeout)
+		defer cancel()
+		health, err := fn.Health(ctx)
+		switch {
+		case err == nil && health.StatusCode != http.StatusNotFound:
+			if health.ContentType != "" {
+				w.Header().Set("Content-Type", health.ContentType)
+			}
+			w.Header().Set("X-Kappa-Health", "runtime")
+			w.WriteHeader(health.StatusCode)
+			w.Write(health.Body)
+			return
+		case err != nil && !errors.Is(err, kappa.ErrNotRunning):
+			readiness = functionReadiness{Status: "unhealthy", Error: err.Error()}
+		}
+	}
+
+	statusCode := http.StatusOK
+	switch {
+	case s.shuttingDown():
+		readiness = functionReadiness{Status: "shutting down"}
+		statusCode = http.StatusServiceUnavailable
+	case !readiness.Ready:
+		statusCode = http.StatusServiceUnavailable
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Kappa-Health", "service")
+	w.WriteHeader(statusCode)
+	json.NewEncoder(w).Encode(readiness)
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHealthAndReadiness(t *testing.T) {
+	// Process backends have no daemon to check
+	t.Setenv("KAPPA_BACKEND", "process")
+	s := newTestService(t)
+	register(t, s, map[string]any{"name": "orders", "mode": "external"})
+	register(t, s, map[string]any{"name": "billing", "mode": "external"})
+
+	rec := do(t, s, "GET", "/healthz", nil)
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	assert.Equal(t, "ok", decode(t, rec)["status"])
+
+	rec = doOn(t, s.control, "POST", "/functions/billing/disable", nil)
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	rec = do(t, s, "GET", "/readyz", nil)
+	require.Equal(t, http.StatusOK, rec.Code, "a function that can't serve doesn't make the service unready")
+	var ready struct {
+		Status    string                       `json:"status"`
+		Functions map[string]functionReadiness `json:"functions"`
+	}
+	require.NoError(t, decodeInto(rec, &ready))
+	assert.Equal(t, "ready", ready.Status)
+	assert.Equal(t, functionReadiness{Status: "stopped", Ready: true}, ready.Functions["orders"])
+	assert.Equal(t, functionReadiness{Status: "disabled"}, ready.Functions["billing"])
+
+	rec = do(t, s, "GET", "/readyz?function=orders", nil)
+	assert.Equal(t, http.StatusOK, rec.Code)
+	rec = do(t, s, "GET", "/readyz?function=billing", nil)
+	assert.Equal(t, http.StatusServiceUnavailable, rec.Code, "unless it is the one asked after")
+	assert.Equal(t, "disabled", decode(t, rec)["status"])
+	rec = do(t, s, "GET", "/readyz?function=missing", nil)
+	assert.Equal(t, http.StatusNotFound, rec.Code)
+
+	stopTestService(s)
+	rec = do(t, s, "GET", "/readyz", nil)
+	assert.Equal(t, http.StatusServiceUnavailable, rec.Code)
+	assert.Equal(t, "shutting down", decode(t, rec)["status"])
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"kappa-v2/pkg/logger"
+	"kappa-v2/service/internal/audit"
+	"net/http"
+
+	"github.com/gorilla/mux"
+	"go.uber.org/zap"
+)
+
+// foldIdleTimeout moves the config's idleTimeoutSeconds into its settings'
+// idleTimeoutMs, which is what the function is run with, rejecting the two
+// set to different timeouts.
+func foldIdleTimeout(config *KappaFunctionConfig) error {
+	if config.IdleTimeoutSeconds == nil {
+		return nil
+	}
+	seconds := *config.IdleTimeoutSeconds
+	if seconds <= 0 {
+		return fmt.Errorf("must be positive")
+	}
+	ms := seconds * 1000
+	if config.IdleTimeoutMs != nil && *config.IdleTimeoutMs != ms {
+		return fmt.Errorf("%ds disagrees with idleTimeoutMs %d", seconds, *config.IdleTimeoutMs)
+	}
+	config.IdleTimeoutMs = &ms
+	config.IdleTimeoutSeconds = nil
+	return nil
+}
+
+// HTTP handler for changing how long a function idles before it is
+// stopped. The timeout is kept in its config, and the idle timer of a
+// running instance starts over with it, so tuning scale-to-zero takes no
+// redeploy.
+func (s *KappaService) setIdleTimeout(w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["name"]
+	fn, config, exists := s.lookup(name)
+	if !exists {
+		http.Error(w, fmt.Sprintf("Function not found: %s", name), http.StatusNotFound)
+		return
+	}
+	if reason := s.lockReason(name, config.Project); reason != "" {
+		http.Error(w, fmt.Sprintf("Function is locked: %s", reason), http.StatusLocked)
+		return
+	}
+	if !checkPreconditions(w, r, s.functionETag(name)) {
+		return
+	}
+
+	var body struct {
+		IdleTimeoutSeconds *int `json:"idleTimeoutSeconds"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		http.Error(w, fmt.Sprintf("Invalid request: %v", err), http.StatusBadRequest)
+		return
+	}
+	if body.IdleTimeoutSeconds == nil {
+		http.Error(w, "Invalid request: idleTimeoutSeconds is required", http.StatusBadRequest)
+		return
+	}
+	if *body.IdleTimeoutSeconds <= 0 {
+		http.Error(w, "Invalid idleTimeoutSeconds: must be positive", http.StatusBadRequest)
+		return
+	}
+
+	var previous KappaFunctionConfig
+	ms := *body.IdleTimeoutSeconds * 1000
+	config, err := s.updateConfig(name, func(config *KappaFunctionConfig) error {
+		previous = *config
+		config.Settings.IdleTimeoutMs = &ms
+		return nil
+	})
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Function not found: %s", name), http.StatusNotFound)
+		return
+	}
+	from := s.effectiveSettings(previous).IdleTimeoutMs.Value
+	effective := s.effectiveSettings(config)
+	applySettings(fn, effective)
+	s.persistFunction(config, fn)
+
+	logger.FromCtx(r.Context()).Info("Function idle timeout changed",
+		zap.String("name", name),
+		zap.Int("fromMs", from),
+		zap.Int("toMs", effective.IdleTimeoutMs.Value))
+	s.audit.Record(audit.Entry{
+		Actor:    actor(r.Context()),
+		Action:   "function.idle-timeout",
+		Function: name,
+		Project:  config.Project,
+		Detail: map[string]any{
+			"fromMs": from,
+			"toMs":   effective.IdleTimeoutMs.Value,
+		},
+	})
+
+	// An environment overriding the timeout still decides it, the response
+	// says which applies
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("ETag", s.functionETag(name))
+	json.NewEncoder(w).Encode(map[string]any{
+		"name":          name,
+		"idleTimeoutMs": effective.IdleTimeoutMs,
+		"running":       fn.IsRunning(),
+	})
+}
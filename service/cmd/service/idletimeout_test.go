@@ -0,0 +1,97 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFoldIdleTimeout(t *testing.T) {
+	seconds, ms := 30, 30000
+	config := KappaFunctionConfig{IdleTimeoutSeconds: &seconds}
+	require.NoError(t, foldIdleTimeout(&config))
+	assert.Nil(t, config.IdleTimeoutSeconds)
+	require.NotNil(t, config.IdleTimeoutMs)
+	assert.Equal(t, 30000, *config.IdleTimeoutMs)
+
+	config = KappaFunctionConfig{IdleTimeoutSeconds: &seconds}
+	config.IdleTimeoutMs = &ms
+	assert.NoError(t, foldIdleTimeout(&config), "the two may agree")
+
+	other := 1000
+	config = KappaFunctionConfig{IdleTimeoutSeconds: &seconds}
+	config.IdleTimeoutMs = &other
+	assert.Error(t, foldIdleTimeout(&config))
+	zero := 0
+	assert.Error(t, foldIdleTimeout(&KappaFunctionConfig{IdleTimeoutSeconds: &zero}))
+}
+
+func TestSetIdleTimeout(t *testing.T) {
+	s := newTestService(t)
+	registerFake(t, s, map[string]any{"name": "orders", "idleTimeoutSeconds": 300},
+		func(w http.ResponseWriter, r *http.Request) { w.Write([]byte(`{}`)) })
+	_, config, _ := s.lookup("orders")
+	require.NotNil(t, config.IdleTimeoutMs)
+	assert.Equal(t, 300000, *config.IdleTimeoutMs)
+	rec := do(t, s, "POST", "/functions/orders", map[string]any{})
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	fn, _, _ := s.lookup("orders")
+	require.True(t, fn.IsRunning())
+
+	// The running instance's idle timer starts over with the new timeout
+	rec = doOn(t, s.control, "PATCH", "/functions/orders/idle-timeout", map[string]any{"idleTimeoutSeconds": 1})
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	var changed struct {
+		IdleTimeoutMs struct {
+			Value int `json:"value"`
+		} `json:"idleTimeoutMs"`
+		Running bool `json:"running"`
+	}
+	require.NoError(t, decodeInto(rec, &changed))
+	assert.Equal(t, 1000, changed.IdleTimeoutMs.Value)
+	assert.True(t, changed.Running)
+	assert.Equal(t, 1000, *s.config("orders").IdleTimeoutMs)
+	assert.Eventually(t, func() bool { return !fn.IsRunning() }, 5*time.Second, 50*time.Millisecond)
+
+	rec = doOn(t, s.control, "PATCH", "/functions/orders/idle-timeout", map[string]any{"idleTimeoutSeconds": 0})
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+	rec = doOn(t, s.control, "PATCH", "/functions/orders/idle-timeout", map[string]any{})
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+	rec = doOn(t, s.control, "PATCH", "/functions/missing/idle-timeout", map[string]any{"idleTimeoutSeconds": 60})
+	assert.Equal(t, http.StatusNotFound, rec.Code)
+	rec = doOn(t, s.control, "POST", "/functions", map[string]any{"name": "billing", "mode": "external", "idleTimeoutSeconds": 30, "idleTimeoutMs": 1000})
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+}
+
+func TestSetIdleTimeout_Guarded(t *testing.T) {
+	s := newTestService(t)
+	register(t, s, map[string]any{"name": "orders", "mode": "external"})
+	rec := do(t, s, "POST", "/functions/orders/lock", nil)
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+
+	rec = do(t, s, "PATCH", "/functions/orders/idle-timeout", map[string]any{"idleTimeoutSeconds": 60})
+	assert.Equal(t, http.StatusLocked, rec.Code)
+	assert.Contains(t, rec.Body.String(), "Function is locked: function orders is locked")
+	rec = do(t, s, "POST", "/functions/orders/unlock", nil)
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+
+	rec = do(t, s, "PUT", "/maintenance", map[string]any{"enabled": true})
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	rec = do(t, s, "PATCH", "/functions/orders/idle-timeout", map[string]any{"idleTimeoutSeconds": 60})
+	assert.Equal(t, http.StatusServiceUnavailable, rec.Code)
+	rec = do(t, s, "PUT", "/maintenance", map[string]any{"enabled": false})
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	assert.Nil(t, s.config("orders").IdleTimeoutMs, "nothing changed while guarded")
+
+	// A stale If-Match loses to the change made since
+	etag := s.functionETag("orders")
+	rec = do(t, s, "PATCH", "/functions/orders/idle-timeout", map[string]any{"idleTimeoutSeconds": 60}, "If-Match", etag)
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	assert.Equal(t, s.functionETag("orders"), rec.Header().Get("ETag"))
+	rec = do(t, s, "PATCH", "/functions/orders/idle-timeout", map[string]any{"idleTimeoutSeconds": 120}, "If-Match", etag)
+	assert.Equal(t, http.StatusPreconditionFailed, rec.Code)
+	assert.Equal(t, 60000, *s.config("orders").IdleTimeoutMs)
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"kappa-v2/pkg/logger"
+	"kappa-v2/service/internal/history"
+	"kappa-v2/service/internal/rbac"
+	"kappa-v2/service/internal/results"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+	"go.uber.org/zap"
+)
+
+// resultPruneInterval is how often expired results are dropped from the
+// result store
+const resultPruneInterval = time.Minute
+
+// resultProject is the project of the function whose result a request is
+// about
+func (s *KappaService) resultProject(r *http.Request) string {
+	result, err := s.results.Get(mux.Vars(r)["id"])
+	if err != nil {
+		return ""
+	}
+	return result.Project
+}
+
+// HTTP handler for listing stored invocation results, filtered by status
+// and function, without their bodies
+func (s *KappaService) listInvocations(w http.ResponseWriter, r *http.Request) {
+	params := r.URL.Query()
+	filter := results.Filter{Function: params.Get("function")}
+	if v := params.Get("status"); v != "" {
+		status, err := results.ParseStatus(v)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Invalid status: %v", err), http.StatusBadRequest)
+			return
+		}
+		filter.Status = status
+	}
+
+	list, err := s.results.List(filter)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to list invocations: %v", err), http.StatusInternalServerError)
+		return
+	}
+	visible := make([]results.Result, 0, len(list))
+	for _, result := range list {
+		if s.allowed(r.Context(), rbac.Read, result.Project) {
+			visible = append(visible, result)
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{
+		"invocations": visible,
+	})
+}
+
+// defaultInvocationLimit is how many invocations of a function are listed
+// without a ?limit
+const defaultInvocationLimit = 100
+
+// HTTP handler for listing a function's recorded invocations, newest
+// first. ?status filters them, ?limit caps them and ?before pages back
+// through older ones.
+func (s *KappaService) listFunctionInvocations(w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["name"]
+	if _, _, exists := s.lookup(name); !exists {
+		http.Error(w, fmt.Sprintf("Function not found: %s", name), http.StatusNotFound)
+		return
+	}
+	params := r.URL.Query()
+	filter := history.Filter{Limit: defaultInvocationLimit}
+	if v := params.Get("status"); v != "" {
+		status, err := history.ParseStatus(v)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Invalid status: %v", err), http.StatusBadRequest)
+			return
+		}
+		filter.Status = status
+	}
+	limit, err := queryInt(params, "limit", 1)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if limit > 0 {
+		filter.Limit = limit
+	}
+	if v := params.Get("before"); v != "" {
+		before, err := time.Parse(time.RFC3339Nano, v)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Invalid before: %s, expected an RFC 3339 time", v), http.StatusBadRequest)
+			return
+		}
+		filter.Before = before
+	}
+
+	invocations, err := s.history.List(name, filter)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to list invocations: %v", err), http.StatusInternalServerError)
+		return
+	}
+	resp := map[string]any{"invocations": invocations}
+	if len(invocations) == filter.Limit {
+		resp["nextBefore"] = invocations[len(invocations)-1].Started
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+// HTTP handler for getting a stored invocation result with its response
+func (s *KappaService) getInvocation(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	result, err := s.results.Get(id)
+	if errors.Is(err, results.ErrNotFound) {
+		http.Error(w, fmt.Sprintf("Invocation not found: %s", id), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to get invocation: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	// Bodies are kept sealed, and returned as JSON when they are JSON
+	var body any
+	if result.Body != nil {
+		plain, err := s.payloads.Open(result.Body)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Failed to open invocation result: %v", err), http.StatusInternalServerError)
+			return
+		}
+		if json.Valid(plain) {
+			body = json.RawMessage(plain)
+		} else {
+			body = string(plain)
+		}
+	}
+	result.Body = nil
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(struct {
+		results.Result
+		Body any `json:"body,omitempty"`
+	}{result, body})
+}
+
+// HTTP handler for deleting a stored invocation result
+func (s *KappaService) deleteInvocation(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	err := s.results.Delete(id)
+	if errors.Is(err, results.ErrNotFound) {
+		http.Error(w, fmt.Sprintf("Invocation not found: %s", id), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to delete invocation: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{
+		"id":     id,
+		"status": "deleted",
+	})
+}
+
+// HTTP handler for the result store's size and how many results it expired
+// and evicted
+func (s *KappaService) getResultStats(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(s.results.Stats())
+}
+
+// pruneResultsEvery drops expired invocation results on an interval until
+// stop is closed.
+func (s *KappaService) pruneResultsEvery(interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case now := <-ticker.C:
+			pruned, err := s.results.Prune(now)
+			if err != nil {
+				logger.Get().Warn("Failed to prune invocation results", zap.Error(err))
+			}
+			if pruned > 0 {
+				logger.Get().Info("Pruned invocation results", zap.Int("count", pruned))
+			}
+		}
+	}
+}
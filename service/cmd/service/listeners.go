@@ -0,0 +1,91 @@
+package main
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"kappa-v2/pkg/logger"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+
+	"go.uber.org/zap"
+)
+
+// adminSocketMode lets the service's user and group use the admin socket
+const adminSocketMode = 0o660
+
+// newServer creates a server of handler on addr, speaking TLS when the
+// service has a certificate.
+func (s *KappaService) newServer(addr string, handler http.Handler) *http.Server {
+	server := &http.Server{
+		Addr:    addr,
+		Handler: accessLog(handler),
+	}
+	// gRPC clients speak HTTP/2 without TLS to proxied functions
+	protocols := new(http.Protocols)
+	protocols.SetHTTP1(true)
+	protocols.SetUnencryptedHTTP2(true)
+	server.Protocols = protocols
+
+	if s.tlsCert != "" {
+		server.TLSConfig = s.serverTLSConfig()
+		protocols.SetHTTP2(true)
+	}
+	return server
+}
+
+// serverTLSConfig is the TLS config the service's listeners share, asking
+// for client certificates when the mtls provider is on. They are asked for,
+// not required, so callers can still use bearer tokens.
+func (s *KappaService) serverTLSConfig() *tls.Config {
+	config := &tls.Config{MinVersion: tls.VersionTLS12}
+	if pool := s.authn.ClientCAs(); pool != nil {
+		config.ClientCAs = pool
+		config.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+	return config
+}
+
+// startAdmin serves the management routes on adminAddr, a TCP address or
+// unix:path for a unix socket. Sockets are served without TLS, the
+// filesystem guards them.
+func (s *KappaService) startAdmin() error {
+	s.adminServer = s.newServer(s.adminAddr, s.control)
+
+	var ln net.Listener
+	var err error
+	path, isSocket := strings.CutPrefix(s.adminAddr, "unix:")
+	if isSocket {
+		// A socket left behind by a service that didn't stop cleanly
+		// would make listening fail
+		if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return fmt.Errorf("failed to remove stale admin socket: %w", err)
+		}
+		if ln, err = net.Listen("unix", path); err != nil {
+			return fmt.Errorf("failed to listen on admin socket: %w", err)
+		}
+		if err := os.Chmod(path, adminSocketMode); err != nil {
+			ln.Close()
+			return fmt.Errorf("failed to restrict admin socket: %w", err)
+		}
+	} else if ln, err = net.Listen("tcp", s.adminAddr); err != nil {
+		return fmt.Errorf("failed to listen on admin address: %w", err)
+	}
+
+	useTLS := s.tlsCert != "" && !isSocket
+	logger.Get().Info("Starting admin listener", zap.String("address", s.adminAddr), zap.Bool("tls", useTLS))
+	go func() {
+		var err error
+		if useTLS {
+			err = s.adminServer.ServeTLS(ln, s.tlsCert, s.tlsKey)
+		} else {
+			err = s.adminServer.Serve(ln)
+		}
+		if err != nil && !errors.Is(err, http.ErrServerClosed) {
+			logger.Get().Fatal("Admin listener failed", zap.Error(err))
+		}
+	}()
+	return nil
+}
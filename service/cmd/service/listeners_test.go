@@ -0,0 +1,63 @@
+package main
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAdminListener_SplitsRoutes(t *testing.T) {
+	t.Setenv("KAPPA_ADMIN_ADDR", "127.0.0.1:0")
+	s := newTestService(t)
+
+	// Management routes are only on the admin listener
+	rec := do(t, s, "POST", "/functions", map[string]any{"name": "orders", "mode": "external"})
+	assert.Contains(t, []int{http.StatusNotFound, http.StatusMethodNotAllowed}, rec.Code)
+	register(t, s, map[string]any{"name": "orders", "mode": "external"})
+	rec = do(t, s, "GET", "/functions/orders", nil)
+	assert.Contains(t, []int{http.StatusNotFound, http.StatusMethodNotAllowed}, rec.Code)
+	rec = doOn(t, s.control, "GET", "/functions/orders", nil)
+	assert.Equal(t, http.StatusOK, rec.Code)
+
+	// Invocations are only on the public one
+	attachRuntime(t, s, "orders", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"ok":true}`))
+	})
+	rec = do(t, s, "POST", "/functions/orders", map[string]any{})
+	assert.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	rec = doOn(t, s.control, "POST", "/functions/orders", map[string]any{})
+	assert.Contains(t, []int{http.StatusNotFound, http.StatusMethodNotAllowed}, rec.Code)
+}
+
+func TestStartAdmin_Socket(t *testing.T) {
+	s := newTestService(t)
+	s.adminAddr = "not an address"
+	assert.Error(t, s.startAdmin())
+
+	path := filepath.Join(t.TempDir(), "admin.sock")
+	// A socket left behind is replaced
+	require.NoError(t, os.WriteFile(path, nil, 0o600))
+	s.adminAddr = "unix:" + path
+	require.NoError(t, s.startAdmin())
+
+	info, err := os.Stat(path)
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(adminSocketMode), info.Mode().Perm())
+
+	client := &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			var dialer net.Dialer
+			return dialer.DialContext(ctx, "unix", path)
+		},
+	}}
+	resp, err := client.Get("http://admin/functions")
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+}
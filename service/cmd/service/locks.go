@@ -0,0 +1,157 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"kappa-v2/pkg/logger"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+	"go.uber.org/zap"
+)
+
+// Maintenance is a service wide change freeze, rejecting every change to
+// functions and projects while they can still be invoked.
+type Maintenance struct {
+	Enabled bool       `json:"enabled"`
+	Reason  string     `json:"reason,omitempty"`
+	Since   *time.Time `json:"since,omitempty"`
+}
+
+// mutation wraps a handler that changes functions or projects, so it is
+// rejected while the service is in maintenance mode.
+func (s *KappaService) mutation(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if maintenance := s.maintenanceMode(); maintenance.Enabled {
+			http.Error(w, maintenance.message(), http.StatusServiceUnavailable)
+			return
+		}
+		next(w, r)
+	}
+}
+
+// message is what changes rejected in maintenance mode are told
+func (m Maintenance) message() string {
+	msg := "Service is in maintenance mode"
+	if m.Reason != "" {
+		msg += ": " + m.Reason
+	}
+	return msg
+}
+
+// lockReason says why the named function can't be changed, either because
+// it, the project it is in or the project it is moving to is locked. It is
+// empty when the function can be changed.
+func (s *KappaService) lockReason(name, project string) string {
+	current := s.config(name).Project
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.locked[name] {
+		return fmt.Sprintf("function %s is locked", name)
+	}
+	for _, p := range []string{current, project} {
+		if p == "" {
+			continue
+		}
+		if existing, exists := s.projects[p]; exists && existing.Locked {
+			return fmt.Sprintf("project %s is locked", p)
+		}
+	}
+	return ""
+}
+
+// HTTP handler for locking a function against updates and deletion
+func (s *KappaService) lockFunction(w http.ResponseWriter, r *http.Request) {
+	s.setFunctionLock(w, r, true)
+}
+
+// HTTP handler for unlocking a function
+func (s *KappaService) unlockFunction(w http.ResponseWriter, r *http.Request) {
+	s.setFunctionLock(w, r, false)
+}
+
+func (s *KappaService) setFunctionLock(w http.ResponseWriter, r *http.Request, locked bool) {
+	vars := mux.Vars(r)
+	name := vars["name"]
+
+	if _, _, exists := s.lookup(name); !exists {
+		http.Error(w, fmt.Sprintf("Function not found: %s", name), http.StatusNotFound)
+		return
+	}
+
+	s.mu.Lock()
+	if locked {
+		s.locked[name] = true
+	} else {
+		delete(s.locked, name)
+	}
+	s.mu.Unlock()
+	if locked {
+		s.persistResource(resourceLock, name, true)
+	} else {
+		s.forgetResource(resourceLock, name)
+	}
+	logger.FromCtx(r.Context()).Info("Function lock changed", zap.String("name", name), zap.Bool("locked", locked))
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{
+		"name":   name,
+		"locked": locked,
+	})
+}
+
+// HTTP handler for locking a project and its functions
+func (s *KappaService) lockProject(w http.ResponseWriter, r *http.Request) {
+	s.setProjectLock(w, r, true)
+}
+
+// HTTP handler for unlocking a project
+func (s *KappaService) unlockProject(w http.ResponseWriter, r *http.Request) {
+	s.setProjectLock(w, r, false)
+}
+
+func (s *KappaService) setProjectLock(w http.ResponseWriter, r *http.Request, locked bool) {
+	vars := mux.Vars(r)
+	name := vars["name"]
+
+	s.mu.Lock()
+	existing, exists := s.projects[name]
+	if !exists {
+		s.mu.Unlock()
+		http.Error(w, fmt.Sprintf("Project not found: %s", name), http.StatusNotFound)
+		return
+	}
+	existing.Locked = locked
+	project := *existing
+	s.mu.Unlock()
+
+	s.persistResource(resourceProject, name, project)
+	logger.FromCtx(r.Context()).Info("Project lock changed", zap.String("name", name), zap.Bool("locked", locked))
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(project.masked())
+}
+
+// HTTP handler for getting the maintenance mode
+func (s *KappaService) getMaintenance(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(s.maintenanceMode())
+}
+
+// HTTP handler for entering or leaving maintenance mode
+func (s *KappaService) putMaintenance(w http.ResponseWriter, r *http.Request) {
+	var maintenance Maintenance
+	if err := json.NewDecoder(r.Body).Decode(&maintenance); err != nil {
+		http.Error(w, fmt.Sprintf("Invalid request: %v", err), http.StatusBadRequest)
+		return
+	}
+	maintenance = s.setMaintenance(maintenance)
+
+	logger.FromCtx(r.Context()).Info("Maintenance mode changed",
+		zap.Bool("enabled", maintenance.Enabled),
+		zap.String("reason", maintenance.Reason))
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(maintenance)
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"net/http"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFunctionLock(t *testing.T) {
+	dir := t.TempDir()
+	s := newTestServiceIn(t, dir)
+	register(t, s, map[string]any{"name": "orders", "mode": "external"})
+
+	rec := do(t, s, "POST", "/functions/orders/lock", nil)
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	assert.Equal(t, true, decode(t, rec)["locked"])
+
+	rec = do(t, s, "PUT", "/functions/orders", map[string]any{"mode": "external", "timeoutMs": 1000})
+	assert.Equal(t, http.StatusLocked, rec.Code)
+	assert.Contains(t, rec.Body.String(), "Function is locked: function orders is locked")
+	rec = do(t, s, "DELETE", "/functions/orders", nil)
+	assert.Equal(t, http.StatusLocked, rec.Code)
+	_, _, exists := s.lookup("orders")
+	assert.True(t, exists)
+
+	// Unlocking sticks across a restart
+	rec = do(t, s, "POST", "/functions/orders/unlock", nil)
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	stopTestService(s)
+	s = newTestServiceIn(t, dir)
+	rec = do(t, s, "PUT", "/functions/orders", map[string]any{"mode": "external"})
+	assert.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	rec = do(t, s, "DELETE", "/functions/orders", nil)
+	assert.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+
+	rec = do(t, s, "POST", "/functions/missing/lock", nil)
+	assert.Equal(t, http.StatusNotFound, rec.Code)
+}
+
+func TestProjectLock(t *testing.T) {
+	s := newTestService(t)
+	rec := do(t, s, "PUT", "/projects/shop", map[string]any{})
+	require.Equal(t, http.StatusCreated, rec.Code, rec.Body.String())
+	register(t, s, map[string]any{"name": "orders", "mode": "external", "project": "shop"})
+
+	rec = do(t, s, "POST", "/projects/shop/lock", nil)
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	assert.Equal(t, true, decode(t, rec)["locked"])
+
+	rec = do(t, s, "PUT", "/functions/orders", map[string]any{"mode": "external", "project": "shop"})
+	assert.Equal(t, http.StatusLocked, rec.Code)
+	assert.Contains(t, rec.Body.String(), "project shop is locked")
+	rec = do(t, s, "DELETE", "/functions/orders", nil)
+	assert.Equal(t, http.StatusLocked, rec.Code)
+	rec = do(t, s, "PUT", "/projects/shop", map[string]any{})
+	assert.Equal(t, http.StatusLocked, rec.Code)
+	// Nor can functions be moved into it
+	register(t, s, map[string]any{"name": "billing", "mode": "external"})
+	rec = do(t, s, "PUT", "/functions/billing", map[string]any{"mode": "external", "project": "shop"})
+	assert.Equal(t, http.StatusLocked, rec.Code)
+
+	rec = do(t, s, "POST", "/projects/shop/unlock", nil)
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	rec = do(t, s, "DELETE", "/functions/orders", nil)
+	assert.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+
+	rec = do(t, s, "POST", "/projects/missing/lock", nil)
+	assert.Equal(t, http.StatusNotFound, rec.Code)
+}
+
+func TestLockReason_Concurrent(t *testing.T) {
+	s := newTestService(t)
+	register(t, s, map[string]any{"name": "orders", "mode": "external"})
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			path := "/functions/orders/lock"
+			if i%2 == 1 {
+				path = "/functions/orders/unlock"
+			}
+			do(t, s, "POST", path, nil)
+		}()
+		go func() {
+			defer wg.Done()
+			s.lockReason("orders", "")
+		}()
+	}
+	wg.Wait()
+}
+
+func TestMaintenance(t *testing.T) {
+	s := newTestService(t)
+	register(t, s, map[string]any{"name": "orders", "mode": "external"})
+
+	rec := do(t, s, "PUT", "/maintenance", map[string]any{"enabled": true, "reason": "migrating"})
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	since := decode(t, rec)["since"]
+	require.NotNil(t, since)
+
+	rec = do(t, s, "PUT", "/functions/orders", map[string]any{"mode": "external"})
+	assert.Equal(t, http.StatusServiceUnavailable, rec.Code)
+	assert.Contains(t, rec.Body.String(), "Service is in maintenance mode: migrating")
+	rec = do(t, s, "POST", "/functions", map[string]any{"name": "billing", "mode": "external"})
+	assert.Equal(t, http.StatusServiceUnavailable, rec.Code)
+
+	// Staying in maintenance keeps when it was entered
+	rec = do(t, s, "PUT", "/maintenance", map[string]any{"enabled": true, "reason": "still migrating"})
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	assert.Equal(t, since, decode(t, rec)["since"])
+	rec = do(t, s, "GET", "/maintenance", nil)
+	assert.Equal(t, "still migrating", decode(t, rec)["reason"])
+
+	rec = do(t, s, "PUT", "/maintenance", map[string]any{"enabled": false, "reason": "ignored"})
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	assert.Equal(t, map[string]any{"enabled": false}, decode(t, rec))
+	rec = do(t, s, "PUT", "/functions/orders", map[string]any{"mode": "external"})
+	assert.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+
+	rec = do(t, s, "PUT", "/maintenance", "{")
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+}
+
+func TestMaintenance_Concurrent(t *testing.T) {
+	s := newTestService(t)
+	register(t, s, map[string]any{"name": "orders", "mode": "external"})
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			do(t, s, "PUT", "/maintenance", map[string]any{"enabled": i%2 == 0})
+		}()
+		go func() {
+			defer wg.Done()
+			do(t, s, "POST", "/functions/orders/lock", nil)
+		}()
+	}
+	wg.Wait()
+}
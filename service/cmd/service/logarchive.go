@@ -0,0 +1,76 @@
+package main
+
+import (
+	"context"
+	"kappa-v2/pkg/logger"
+	"os"
+	"path/filepath"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+const (
+	// logArchiveInterval is how often rotated log files are moved to the
+	// bucket
+	logArchiveInterval = time.Minute
+	// logArchiveSettle is how long a rotated file is left alone, as it may
+	// still be being compressed
+	logArchiveSettle = time.Minute
+)
+
+// archiveLogsEvery moves the service's rotated log files to the bucket on
+// an interval until stop is closed, so they outlive the node.
+func (s *KappaService) archiveLogsEvery(interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			s.archiveLogs()
+		}
+	}
+}
+
+// archiveLogs uploads every rotated file of the log outputs under
+// logs/{host}/, removing it once uploaded.
+func (s *KappaService) archiveLogs() {
+	cfg, _ := logger.ConfigFromEnv()
+	host, err := os.Hostname()
+	if err != nil {
+		host = "unknown"
+	}
+	for _, file := range cfg.Files() {
+		rotated, err := logger.RotatedFiles(file)
+		if err != nil {
+			logger.Get().Warn("Failed to list rotated logs", zap.String("file", file), zap.Error(err))
+			continue
+		}
+		for _, path := range rotated {
+			if info, err := os.Stat(path); err != nil || time.Since(info.ModTime()) < logArchiveSettle {
+				continue
+			}
+			if err := s.archiveLog(host, path); err != nil {
+				logger.Get().Warn("Failed to archive log", zap.String("file", path), zap.Error(err))
+				continue
+			}
+			logger.Get().Info("Archived log", zap.String("file", path))
+		}
+	}
+}
+
+func (s *KappaService) archiveLog(host, path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), logArchiveInterval)
+	defer cancel()
+	if err := s.bucket.Put(ctx, "logs/"+host+"/"+filepath.Base(path), f); err != nil {
+		return err
+	}
+	return os.Remove(path)
+}
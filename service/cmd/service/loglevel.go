@@ -0,0 +1,79 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"kappa-v2/pkg/handler"
+	"kappa-v2/pkg/logger"
+	"net/http"
+	"strings"
+
+	"github.com/gorilla/mux"
+	"go.uber.org/zap"
+)
+
+func validateLogLevel(level string) error {
+	if level == "" {
+		return nil
+	}
+	_, err := handler.ParseLogLevel(level)
+	return err
+}
+
+// HTTP handler for changing the level a function's runtime logs at. The
+// level is kept in its config for instances started later, and a running
+// runtime is told right away, so getting debug logs takes no redeploy.
+func (s *KappaService) setLogLevel(w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["name"]
+	fn, _, exists := s.lookup(name)
+	if !exists {
+		http.Error(w, fmt.Sprintf("Function not found: %s", name), http.StatusNotFound)
+		return
+	}
+
+	var body struct {
+		Level string `json:"level"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		http.Error(w, fmt.Sprintf("Invalid request: %v", err), http.StatusBadRequest)
+		return
+	}
+	if body.Level == "" {
+		http.Error(w, "Invalid request: level is required", http.StatusBadRequest)
+		return
+	}
+	if err := validateLogLevel(body.Level); err != nil {
+		http.Error(w, fmt.Sprintf("Invalid level: %v", err), http.StatusBadRequest)
+		return
+	}
+	level := strings.ToLower(body.Level)
+
+	config, err := s.updateConfig(name, func(config *KappaFunctionConfig) error {
+		config.LogLevel = level
+		return nil
+	})
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Function not found: %s", name), http.StatusNotFound)
+		return
+	}
+	applied, err := fn.SetLogLevel(r.Context(), level)
+	s.persistFunction(config, fn)
+
+	log := logger.FromCtx(r.Context())
+	if err != nil {
+		log.Warn("Failed to change runtime log level", zap.String("name", name), zap.String("level", level), zap.Error(err))
+		http.Error(w, fmt.Sprintf("%v, new instances will start at %s", err, level), http.StatusBadGateway)
+		return
+	}
+	log.Info("Function log level changed",
+		zap.String("name", name),
+		zap.String("level", level),
+		zap.Bool("applied", applied))
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{
+		"name":     name,
+		"logLevel": level,
+		"applied":  applied,
+	})
+}
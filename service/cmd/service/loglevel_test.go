@@ -0,0 +1,46 @@
+package main
+
+import (
+	"encoding/json"
+	"kappa-v2/pkg/handler"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSetLogLevel(t *testing.T) {
+	s := newTestService(t)
+	levels := make(chan string, 1)
+	attachRuntime(t, s, "orders", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != handler.LogLevelPath {
+			return
+		}
+		var body struct {
+			Level string `json:"level"`
+		}
+		json.NewDecoder(r.Body).Decode(&body)
+		levels <- body.Level
+	})
+
+	rec := do(t, s, "PATCH", "/functions/orders/log-level", map[string]any{"level": "DEBUG"})
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	assert.Equal(t, map[string]any{"name": "orders", "logLevel": "debug", "applied": true}, decode(t, rec))
+	assert.Equal(t, "debug", <-levels, "the running runtime is told")
+
+	// The level is kept for instances started later, the current version
+	// included
+	assert.Equal(t, "debug", s.config("orders").LogLevel)
+	history, _ := s.versionHistory("orders")
+	require.NotEmpty(t, history)
+	assert.Equal(t, "debug", history[len(history)-1].Config.LogLevel)
+
+	rec = do(t, s, "PATCH", "/functions/orders/log-level", map[string]any{"level": "loud"})
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+	rec = do(t, s, "PATCH", "/functions/orders/log-level", map[string]any{})
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+	assert.Equal(t, "debug", s.config("orders").LogLevel)
+	rec = do(t, s, "PATCH", "/functions/missing/log-level", map[string]any{"level": "debug"})
+	assert.Equal(t, http.StatusNotFound, rec.Code)
+}
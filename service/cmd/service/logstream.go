@@ -0,0 +1,113 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/mux"
+	"golang.org/x/net/websocket"
+)
+
+// logStream is the stream a function's log line was written to, stdout or
+// stderr, empty for lines the service wrote itself.
+func logStream(line string) string {
+	for _, stream := range []string{"stdout", "stderr"} {
+		// Lines of init steps and sidecars carry their own prefix first
+		tag := "[" + stream + "] "
+		if strings.HasPrefix(line, tag) || strings.Contains(line, "] "+tag) {
+			return stream
+		}
+	}
+	return ""
+}
+
+// HTTP handler for following a function's logs over a WebSocket, sending
+// each line as a text message as it is written. ?stream=stdout or stderr
+// only sends that stream's lines, and ?tail=N starts with the N latest
+// lines rather than every one kept.
+func (s *KappaService) streamFunctionLogs(w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["name"]
+
+	fn, _, exists := s.lookup(name)
+	if !exists {
+		http.Error(w, fmt.Sprintf("Function not found: %s", name), http.StatusNotFound)
+		return
+	}
+	query := r.URL.Query()
+	stream := query.Get("stream")
+	if stream != "" && stream != "stdout" && stream != "stderr" {
+		http.Error(w, fmt.Sprintf("Invalid stream: %s, expected stdout or stderr", stream), http.StatusBadRequest)
+		return
+	}
+	tail := -1
+	if v := query.Get("tail"); v != "" {
+		var err error
+		if tail, err = strconv.Atoi(v); err != nil || tail < 0 {
+			http.Error(w, fmt.Sprintf("Invalid tail: %s", v), http.StatusBadRequest)
+			return
+		}
+	}
+	if !isWebSocket(r) {
+		http.Error(w, "Expected a WebSocket upgrade", http.StatusBadRequest)
+		return
+	}
+
+	wanted := func(line string) bool {
+		return stream == "" || logStream(line) == stream
+	}
+	server := websocket.Server{
+		// Any client may follow logs, not only browsers sending an Origin
+		Handshake: func(*websocket.Config, *http.Request) error { return nil },
+		Handler: func(ws *websocket.Conn) {
+			// The request's context isn't ended by the client going away
+			// once the connection is hijacked, reading notices it instead
+			ctx, cancel := context.WithCancel(r.Context())
+			defer cancel()
+			go func() {
+				io.Copy(io.Discard, ws)
+				cancel()
+			}()
+
+			backlog, lines := fn.FollowLogs(ctx)
+			var kept []string
+			for _, line := range backlog {
+				if wanted(line) {
+					kept = append(kept, line)
+				}
+			}
+			if tail >= 0 && len(kept) > tail {
+				kept = kept[len(kept)-tail:]
+			}
+			for _, line := range kept {
+				if err := websocket.Message.Send(ws, line); err != nil {
+					return
+				}
+			}
+			for line := range lines {
+				if !wanted(line) {
+					continue
+				}
+				if err := websocket.Message.Send(ws, line); err != nil {
+					return
+				}
+			}
+		},
+	}
+	server.ServeHTTP(hijackable{w}, r)
+}
+
+// hijackable lets connections be hijacked through response writers that
+// wrap the server's, like the access log's.
+type hijackable struct {
+	http.ResponseWriter
+}
+
+func (h hijackable) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	return http.NewResponseController(h.ResponseWriter).Hijack()
+}
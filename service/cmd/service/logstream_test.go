@@ -0,0 +1,64 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/websocket"
+)
+
+func TestLogStream(t *testing.T) {
+	tests := map[string]string{
+		"[stdout] hello":                 "stdout",
+		"[stderr] oops":                  "stderr",
+		"[init migrate] [stderr] failed": "stderr",
+		"REPORT RequestId: 1":            "",
+	}
+	for line, stream := range tests {
+		assert.Equal(t, stream, logStream(line), line)
+	}
+}
+
+func TestStreamFunctionLogs(t *testing.T) {
+	s := newTestService(t)
+	backend := registerFake(t, s, map[string]any{"name": "orders"},
+		func(w http.ResponseWriter, r *http.Request) { w.Write([]byte(`{}`)) })
+	rec := do(t, s, "POST", "/functions/orders", map[string]any{})
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	instance := backend.runs()[0]
+	instance.OnLog("[stdout] first")
+	instance.OnLog("[stdout] second")
+	instance.OnLog("[stderr] oops")
+
+	server := httptest.NewServer(s.control)
+	defer server.Close()
+	url := "ws" + strings.TrimPrefix(server.URL, "http") + "/functions/orders/logs/stream?stream=stdout&tail=1"
+	ws, err := websocket.Dial(url, "", server.URL)
+	require.NoError(t, err)
+	defer ws.Close()
+	receive := func() string {
+		require.NoError(t, ws.SetReadDeadline(time.Now().Add(5*time.Second)))
+		var line string
+		require.NoError(t, websocket.Message.Receive(ws, &line))
+		return line
+	}
+
+	assert.Contains(t, receive(), "second", "only the latest kept line of the stream")
+	instance.OnLog("[stderr] ignored")
+	instance.OnLog("[stdout] third")
+	assert.Contains(t, receive(), "third")
+
+	rec = doOn(t, s.control, "GET", "/functions/orders/logs/stream?stream=syslog", nil)
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+	rec = doOn(t, s.control, "GET", "/functions/orders/logs/stream?tail=-1", nil)
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+	rec = doOn(t, s.control, "GET", "/functions/orders/logs/stream", nil)
+	assert.Equal(t, http.StatusBadRequest, rec.Code, "not a WebSocket upgrade")
+	rec = doOn(t, s.control, "GET", "/functions/missing/logs/stream", nil)
+	assert.Equal(t, http.StatusNotFound, rec.Code)
+}
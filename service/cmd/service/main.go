@@ -2,13 +2,50 @@ package main
 
 import (
 	"context"
+	"database/sql"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"kappa-v2/pkg/handler"
 	"kappa-v2/pkg/logger"
+	"kappa-v2/service/internal/admission"
+	"kappa-v2/service/internal/artifact"
+	"kappa-v2/service/internal/audit"
+	"kappa-v2/service/internal/auth"
+	"kappa-v2/service/internal/batch"
+	"kappa-v2/service/internal/blob"
+	"kappa-v2/service/internal/build"
+	"kappa-v2/service/internal/envref"
+	"kappa-v2/service/internal/errtrack"
+	"kappa-v2/service/internal/gateway"
+	"kappa-v2/service/internal/history"
 	"kappa-v2/service/internal/kappa"
+	"kappa-v2/service/internal/metrics"
+	"kappa-v2/service/internal/objstore"
+	"kappa-v2/service/internal/payload"
+	"kappa-v2/service/internal/ports"
+	"kappa-v2/service/internal/prewarm"
+	"kappa-v2/service/internal/ratelimit"
+	"kappa-v2/service/internal/rbac"
+	"kappa-v2/service/internal/redis"
+	"kappa-v2/service/internal/repository"
+	"kappa-v2/service/internal/results"
+	"kappa-v2/service/internal/runtimes"
+	"kappa-v2/service/internal/sbom"
+	"kappa-v2/service/internal/scheduler"
+	"kappa-v2/service/internal/settings"
+	"kappa-v2/service/internal/tracing"
+	"kappa-v2/service/internal/usage"
+	"math"
 	"net/http"
+	"net/url"
 	"os"
 	"os/signal"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
 	"syscall"
 	"time"
 
@@ -18,46 +55,764 @@ import (
 
 	_ "github.com/joho/godotenv/autoload"
 	"go.uber.org/zap"
+	"google.golang.org/grpc"
 )
 
 type KappaFunctionConfig struct {
-	Name       string   `json:"name"`
-	BinaryPath string   `json:"binaryPath"`
-	Image      string   `json:"image"`
-	Env        []string `json:"env"`
-	Port       int      `json:"port"`
+	Name       string `json:"name"`
+	BinaryPath string `json:"binaryPath"`
+	Image      string `json:"image"`
+	Port       int    `json:"port"`
+	// Project groups the function with others sharing its defaults
+	Project string `json:"project,omitempty"`
+	// Settings override the service and project defaults, including env
+	settings.Settings
+	// IdleTimeoutSeconds is the settings' idleTimeoutMs in seconds, how long
+	// the function idles before it is stopped, changed without a redeploy
+	// by PATCH /functions/{name}/idle-timeout
+	IdleTimeoutSeconds *int `json:"idleTimeoutSeconds,omitempty"`
+	// Retry overrides the default retry policy, which only retries connection errors
+	Retry *kappa.RetryPolicy `json:"retry,omitempty"`
+	// TLS serves the runtime over HTTPS, defaults to KAPPA_RUNTIME_TLS
+	TLS *bool `json:"tls,omitempty"`
+	// Host is where the runtime is reachable when it isn't on localhost
+	Host string `json:"host,omitempty"`
+	// Backend runs the function as a "containerd" container, a "vm" or a
+	// plain "process", defaults to KAPPA_BACKEND or the platform default
+	Backend string `json:"backend,omitempty"`
+	// Signature is the base64 ed25519 signature of the binary's sha256
+	// digest, required when KAPPA_SIGNING_PUBLIC_KEY is set
+	Signature []byte `json:"signature,omitempty"`
+	// Lockfiles are dependency lockfiles (package-lock.json, go.mod,
+	// requirements.txt) recorded in the function's SBOM
+	Lockfiles []string `json:"lockfiles,omitempty"`
+	// Runtime runs source code with an interpreted runtime instead of a binary
+	Runtime *runtimes.Config `json:"runtime,omitempty"`
+	// Mode is "http" for a runtime serving events, the default, or "job"
+	// to run the function to completion once per event
+	Mode string `json:"mode,omitempty"`
+	// Priority is "high", "normal", the default, or "low", deciding who is
+	// admitted first and shed last when the service is saturated
+	Priority string `json:"priority,omitempty"`
+	// MaxConcurrency is how many invocations the function runs at once,
+	// unlimited when 0
+	MaxConcurrency int `json:"maxConcurrency,omitempty"`
+	// QueueDepth is how many invocations over MaxConcurrency wait for one
+	// to finish, those past it are turned away with 429
+	QueueDepth int `json:"queueDepth,omitempty"`
+	// Visibility is "private", the default, for a function only invoked
+	// with credentials or by other functions, or "public" for one anyone
+	// may invoke on its HTTP, WebSocket and gRPC routes
+	Visibility string `json:"visibility,omitempty"`
+	// InvocationLogs adds START, END and REPORT lines around every
+	// invocation to the function's logs
+	InvocationLogs bool `json:"invocationLogs,omitempty"`
+	// Disabled are windows the function is disabled in, turning invocations
+	// away with 503 while it stays registered
+	Disabled []kappa.DisabledWindow `json:"disabled,omitempty"`
+	// LogLevel is the level the runtime logs at, debug, info, warn or
+	// error, changed without a redeploy by PATCH /functions/{name}/log-level
+	LogLevel string `json:"logLevel,omitempty"`
+	// Mirror copies a share of invocations to another function
+	Mirror *MirrorConfig `json:"mirror,omitempty"`
+	// Redact is what of the function's payloads is redacted before they
+	// are kept, on top of credentials in headers
+	Redact *payload.Policy `json:"redact,omitempty"`
+	// Environment is the stage the function is deployed to, whose
+	// overrides apply on top of its settings
+	Environment string `json:"environment,omitempty"`
+	// PromotedFrom is set on functions registered by a promotion
+	PromotedFrom *Provenance `json:"promotedFrom,omitempty"`
+	// Spillover returns large response bodies as links to the blob store
+	Spillover *SpilloverConfig `json:"spillover,omitempty"`
+	// RightSizing bounds the memory limit the service may set from the
+	// function's recommendations, and turns doing so on
+	RightSizing *RightSizingConfig `json:"rightSizing,omitempty"`
+	// Transform reshapes requests and responses on the function's HTTP
+	// route with templates
+	Transform *TransformConfig `json:"transform,omitempty"`
+	// Errors maps platform errors, like timeouts, to the statuses and
+	// bodies clients of the function get for them
+	Errors ErrorPages `json:"errors,omitempty"`
+	// WebSocket proxies WebSockets opened at /functions/{name}/ws to the
+	// function's runtime
+	WebSocket *WebSocketConfig `json:"webSocket,omitempty"`
+	// GRPC proxies gRPC calls at /grpc/{name}/ to the function's runtime
+	GRPC *GRPCConfig `json:"grpc,omitempty"`
+	// HostPort is the port a tcp function is exposed on, one is allocated
+	// from KAPPA_EXPOSED_PORTS without it
+	HostPort int `json:"hostPort,omitempty"`
+	// Init are steps run to completion, in order, before every start of the
+	// function's runtime
+	Init []kappa.InitStep `json:"init,omitempty"`
+	// Sidecars are started and stopped with the function's runtime
+	Sidecars []kappa.Sidecar `json:"sidecars,omitempty"`
+	// DNS replaces the host's resolver configuration in the function's
+	// instances
+	DNS *kappa.DNSConfig `json:"dns,omitempty"`
+	// ExtraHosts are added to the function's hosts file, hostname to IP
+	ExtraHosts map[string]string `json:"extraHosts,omitempty"`
+	// Clock sets the timezone and locale of the function's instances
+	Clock *kappa.ClockConfig `json:"clock,omitempty"`
+	// RateLimit limits how fast the function is invoked, beyond it callers
+	// get 429
+	RateLimit *RateLimitConfig `json:"rateLimit,omitempty"`
+	// TimeoutGraceMs is how long the runtime of an invocation that timed
+	// out gets to report a partial result, which isn't asked for when 0
+	TimeoutGraceMs int `json:"timeoutGraceMs,omitempty"`
+	// Triggers are the event sources invoking the function, set up when
+	// it is registered and torn down when it is deleted
+	Triggers []Trigger `json:"triggers,omitempty"`
+	// WarmInstances is how many instances of the function are kept
+	// started rather than stopped when idle, 0 or 1, changed without a
+	// redeploy by POST /functions/{name}/warm
+	WarmInstances int `json:"warmInstances,omitempty"`
+	// CORS lets browsers on other origins call the function, in place of
+	// the service's policy
+	CORS *CORSConfig `json:"cors,omitempty"`
+	// ForwardHealth answers GET /functions/{name}/health with the runtime's
+	// own /health while it runs
+	ForwardHealth bool `json:"forwardHealth,omitempty"`
+	// Sampling decides which of the function's traces are sampled, in
+	// place of the service's rate
+	Sampling *tracing.Policy `json:"sampling,omitempty"`
 }
 
 type KappaService struct {
-	functions   map[string]*kappa.KappaFunction
-	router      *mux.Router
-	server      *http.Server
+	// mu guards functions, configs, versions, locked, projects,
+	// environments and maintenance, which handlers, schedules and
+	// background loops share
+	mu           sync.RWMutex
+	functions    map[string]*kappa.KappaFunction
+	artifacts    *artifact.Store
+	repository   repository.Repository // Persists functions across restarts
+	verifier     *artifact.Verifier
+	runtimes     *runtimes.Matrix
+	envRefs      *envref.Resolver
+	defaults     settings.Settings
+	projects     map[string]*Project
+	environments map[string]*Environment
+	configs      map[string]KappaFunctionConfig
+	locked       map[string]bool
+	maintenance  Maintenance
+	scheduler    *scheduler.Scheduler
+	admission    *admission.Limiter
+	mirrors      map[string]*mirrorStats
+	mirrorsMu    sync.Mutex
+	faults       faults
+	adminToken   string
+	// agentToken authenticates runtimes attaching themselves to external
+	// functions, which is disabled without it
+	agentToken string
+	// authn asks the configured auth providers who a request is from, nil
+	// when none is configured
+	authn *auth.Authenticator
+	// callers sign the tokens functions invoke other functions with
+	callers   *callerTokens
+	inventory kappa.Inventory
+	prewarm   *prewarm.Warmer
+	// stop ends the background loops on shutdown
+	stop     chan struct{}
+	payloads *payload.Sealer
+	roles    *rbac.Store
+	usage    *usage.Meter
+	pricing  usage.Pricing
+	metrics  *metrics.Metrics
+	builds   *build.Manager
+	blobs    blob.Store
+	spiller  blobSpiller
+	// rateLimits keeps the token buckets of functions and their callers,
+	// in Redis when replicas share them, callerRateLimit is the limit of
+	// callers of functions without their own
+	rateLimits      ratelimit.Store
+	callerRateLimit *ratelimit.Limit
+	// cors is the CORS policy of functions without their own
+	cors *CORSConfig
+	// gateway routes requests to functions by their http triggers
+	gateway *gateway.Table
+	// batchers collect the deliveries of webhook triggers with a batch
+	// window, by function and trigger
+	batchers   map[string]*batch.Batcher
+	batchersMu sync.Mutex
+	// results keeps the outcomes of invocations nobody waits on across
+	// restarts
+	results results.Store
+	// bucket keeps the state of stateless nodes, nil to keep it on disk
+	bucket *objstore.S3
+	// db is the database at KAPPA_DATABASE_URL, nil without one
+	db *sql.DB
+	// history records every invocation, in the database when there is one
+	history history.Store
+	// errorTracker reports panics and failed invocations to the trackers
+	// of the projects configured with one
+	errorTracker *errtrack.Reporter
+	// postgres keeps schedules, versions and the audit trail in the
+	// database, nil without one
+	postgres *repository.Postgres
+	// spillThreshold is the response size functions with spillover spill
+	// above by default
+	spillThreshold int64
+	// compressMinBytes is the event and response size gzipped between the
+	// service and runtimes, 0 for never
+	compressMinBytes int
+	// traceSampleRate is the share of traces sampled of functions without
+	// a sampling policy
+	traceSampleRate float64
+	// maxUploadBytes is the largest code upload, and the largest binary
+	// extracted from an uploaded archive
+	maxUploadBytes int64
+	// ports are allocated to tcp functions, which the service listens on
+	// for as exposures
+	ports       *ports.Allocator
+	exposures   map[string]*exposure
+	exposuresMu sync.Mutex
+	// discovery names functions for each other in their hosts file
+	discovery *kappa.Discovery
+	// versions are each function's kept versions, oldest first, the last
+	// being the current one
+	versions     map[string][]functionVersion
+	keptVersions int
+	audit        *audit.Log
+	router       *mux.Router
+	// control routes management calls, router itself unless they are
+	// served on adminAddr
+	control     *mux.Router
+	adminAddr   string
+	adminServer *http.Server
+	// grpcAddr is where the gRPC API is served, not at all when empty
+	grpcAddr   string
+	grpcServer *grpc.Server
+	server     *http.Server
+	// tlsCert and tlsKey are the files the API is served over TLS with,
+	// empty to serve plain HTTP
+	tlsCert     string
+	tlsKey      string
 	newFunction func(name, binaryPath, image string, env []string, port int) kappa.Function
 }
 
 func NewKappaService() *KappaService {
+	// Artifacts, spilled responses, async results and rotated logs are kept
+	// in a bucket when nodes are to be stateless
+	bucket, err := objstore.FromEnv()
+	if err != nil {
+		logger.Get().Fatal("Failed to open storage backend", zap.Error(err))
+	}
+	if bucket != nil {
+		logger.Get().Info("Keeping state in bucket", zap.Stringer("bucket", bucket))
+	}
+
+	artifactDir := os.Getenv("KAPPA_ARTIFACT_DIR")
+	if artifactDir == "" {
+		artifactDir = "artifacts"
+	}
+	artifacts, err := artifact.NewStore(artifactDir)
+	if err != nil {
+		logger.Get().Fatal("Failed to open artifact store", zap.Error(err))
+	}
+	if bucket != nil {
+		artifacts.SetRemote(bucket)
+	}
+	// Registered functions are kept in the database when there is one, with
+	// their binaries unless told otherwise
+	db := openDatabase()
+	var repo repository.Repository
+	var postgres *repository.Postgres
+	if db != nil {
+		postgres = repository.NewPostgres(db)
+		repo = postgres
+	} else {
+		registryPath := os.Getenv("KAPPA_REGISTRY_FILE")
+		if registryPath == "" {
+			registryPath = filepath.Join(artifactDir, "functions.json")
+		}
+		if repo, err = repository.OpenFile(registryPath); err != nil {
+			logger.Get().Fatal("Failed to open function registry", zap.Error(err))
+		}
+	}
+
+	// Only run signed binaries when a signing key is configured
+	var verifier *artifact.Verifier
+	if keyPath := os.Getenv("KAPPA_SIGNING_PUBLIC_KEY"); keyPath != "" {
+		verifier, err = artifact.LoadVerifier(keyPath)
+		if err != nil {
+			logger.Get().Fatal("Failed to load signing public key", zap.Error(err))
+		}
+	}
+
+	matrix, err := runtimes.MatrixFromEnv()
+	if err != nil {
+		logger.Get().Fatal("Failed to load runtime matrix", zap.Error(err))
+	}
+
+	// Env values can reference secrets, shared config and other functions,
+	// resolved whenever a function starts
+	envRefs := envref.NewResolver()
+	secretsDir := os.Getenv("KAPPA_SECRETS_DIR")
+	if secretsDir == "" {
+		secretsDir = "secrets"
+	}
+	envRefs.Register("secret", envref.SecretDir(secretsDir))
+	sharedConfig := envref.Map{}
+	if configPath := os.Getenv("KAPPA_CONFIG_FILE"); configPath != "" {
+		sharedConfig, err = envref.LoadMap(configPath)
+		if err != nil {
+			logger.Get().Fatal("Failed to load config", zap.Error(err))
+		}
+	}
+	envRefs.Register("config", sharedConfig)
+
+	// Service wide defaults every project and function inherits
+	var defaults settings.Settings
+	if defaultsPath := os.Getenv("KAPPA_DEFAULTS_FILE"); defaultsPath != "" {
+		defaults, err = settings.LoadFile(defaultsPath)
+		if err != nil {
+			logger.Get().Fatal("Failed to load defaults", zap.Error(err))
+		}
+	}
+
+	// Bound the invocations in flight across every function
+	limiter, err := admission.FromEnv()
+	if err != nil {
+		logger.Get().Fatal("Failed to configure invocation limit", zap.Error(err))
+	}
+
+	// Schedules are evaluated in the service's timezone
+	location, err := scheduler.LocationFromEnv()
+	if err != nil {
+		logger.Get().Fatal("Failed to load timezone", zap.Error(err))
+	}
+
+	// Start frozen when deploying into a change freeze
+	var maintenance Maintenance
+	if os.Getenv("KAPPA_MAINTENANCE") == "true" {
+		since := time.Now()
+		maintenance = Maintenance{Enabled: true, Reason: "KAPPA_MAINTENANCE", Since: &since}
+	}
+
+	// Containers are checked for drift, and images can be pre-pulled, where
+	// the containerd backend exists
+	var inventory kappa.Inventory
+	var warmer *prewarm.Warmer
+	if backend, err := kappa.BackendByName("containerd"); err == nil {
+		inventory, _ = backend.(kappa.Inventory)
+		if puller, ok := backend.(kappa.ImagePuller); ok {
+			warmer = prewarm.NewWarmer(puller, prewarm.DefaultTimeout)
+		}
+	}
+	var repairInterval time.Duration
+	if v := os.Getenv("KAPPA_DRIFT_REPAIR_INTERVAL_MS"); v != "" {
+		ms, err := strconv.Atoi(v)
+		if err != nil || ms < 0 {
+			logger.Get().Fatal("Invalid KAPPA_DRIFT_REPAIR_INTERVAL_MS", zap.String("value", v))
+		}
+		repairInterval = time.Duration(ms) * time.Millisecond
+	}
+
+	// Payloads kept after an invocation are encrypted once a key is set
+	payloads, err := payload.SealerFromEnv()
+	if err != nil {
+		logger.Get().Fatal("Failed to load payload keys", zap.Error(err))
+	}
+	if !payloads.Encrypted() {
+		logger.Get().Info("No payload key set, kept payloads are not encrypted")
+	}
+
+	// Callers are rate limited by default when a limit is set
+	callerRateLimit, err := ratelimit.FromEnv()
+	if err != nil {
+		logger.Get().Fatal("Failed to configure rate limiting", zap.Error(err))
+	}
+	// Browsers on other origins may call functions when allowed
+	cors, err := corsFromEnv()
+	if err != nil {
+		logger.Get().Fatal("Failed to configure CORS", zap.Error(err))
+	}
+	// With Redis, replicas of the service share their rate limits
+	var rateLimits ratelimit.Store = ratelimit.New()
+	redisClient, err := redis.FromEnv()
+	if err != nil {
+		logger.Get().Fatal("Failed to connect to redis", zap.Error(err))
+	}
+	if redisClient != nil {
+		rateLimits = ratelimit.NewRedis(redisClient, redisRateLimitPrefix)
+		logger.Get().Info("Rate limits are kept in redis", zap.String("addr", redisClient.Addr()))
+	}
+
+	// Invocations are recorded for debugging them after the fact
+	invocationHistory, err := history.FromEnv(db)
+	if err != nil {
+		logger.Get().Fatal("Failed to configure invocation history", zap.Error(err))
+	}
+
+	// Invocations are metered for chargeback
+	meter, err := usage.FromEnv()
+	if err != nil {
+		logger.Get().Fatal("Failed to configure usage metering", zap.Error(err))
+	}
+	pricing, err := usage.PricingFromEnv()
+	if err != nil {
+		logger.Get().Fatal("Failed to load prices", zap.Error(err))
+	}
+
+	// Large responses of functions that opted in are spilled to blobs
+	var blobs blob.Store
+	if bucket != nil {
+		blobs = blob.NewBucket(bucket)
+	} else if blobs, err = blob.FromEnv(); err != nil {
+		logger.Get().Fatal("Failed to open blob store", zap.Error(err))
+	}
+	spillThreshold := int64(defaultSpillThreshold)
+	if v := os.Getenv("KAPPA_SPILL_THRESHOLD_BYTES"); v != "" {
+		spillThreshold, err = strconv.ParseInt(v, 10, 64)
+		if err != nil || spillThreshold < 0 {
+			logger.Get().Fatal("Invalid KAPPA_SPILL_THRESHOLD_BYTES", zap.String("value", v))
+		}
+	}
+	spillTTL := defaultSpillTTL
+	if v := os.Getenv("KAPPA_SPILL_TTL"); v != "" {
+		spillTTL, err = time.ParseDuration(v)
+		if err != nil || spillTTL <= 0 {
+			logger.Get().Fatal("Invalid KAPPA_SPILL_TTL", zap.String("value", v))
+		}
+	}
+	if bucket != nil && spillTTL > maxBucketSpillTTL {
+		logger.Get().Fatal("KAPPA_SPILL_TTL is longer than links to a bucket last", zap.Duration("max", maxBucketSpillTTL))
+	}
+	// Events and responses from this size are gzipped on the way to and
+	// from runtimes
+	compressMinBytes := handler.DefaultServerConfig().CompressMinBytes
+	if v := os.Getenv("KAPPA_COMPRESS_MIN_BYTES"); v != "" {
+		compressMinBytes, err = strconv.Atoi(v)
+		if err != nil || compressMinBytes < 0 {
+			logger.Get().Fatal("Invalid KAPPA_COMPRESS_MIN_BYTES", zap.String("value", v))
+		}
+	}
+	// Every trace is sampled unless the service or functions say otherwise
+	traceSampleRate := 1.0
+	if v := os.Getenv("KAPPA_TRACE_SAMPLE_RATE"); v != "" {
+		traceSampleRate, err = strconv.ParseFloat(v, 64)
+		if err != nil || traceSampleRate < 0 || traceSampleRate > 1 {
+			logger.Get().Fatal("Invalid KAPPA_TRACE_SAMPLE_RATE", zap.String("value", v))
+		}
+	}
+
+	// Results of invocations nobody waits on are kept on disk, expiring
+	// after their function's resultTtlMs
+	var resultStore results.Store
+	if bucket != nil {
+		resultStore = results.NewBucket(bucket)
+	} else if resultStore, err = results.FromEnv(); err != nil {
+		logger.Get().Fatal("Failed to open result store", zap.Error(err))
+	}
+
+	// Functions that opted in are right-sized on an interval
+	var rightSizeInterval time.Duration
+	if v := os.Getenv("KAPPA_RIGHTSIZE_INTERVAL_MS"); v != "" {
+		ms, err := strconv.Atoi(v)
+		if err != nil || ms < 0 {
+			logger.Get().Fatal("Invalid KAPPA_RIGHTSIZE_INTERVAL_MS", zap.String("value", v))
+		}
+		rightSizeInterval = time.Duration(ms) * time.Millisecond
+	}
+
+	// Functions in tcp mode are exposed on ports from a range
+	portAllocator, err := ports.FromEnv()
+	if err != nil {
+		logger.Get().Fatal("Invalid KAPPA_EXPOSED_PORTS", zap.Error(err))
+	}
+
+	// Functions resolve each other by name through a hosts file they share
+	discoveryDir, err := os.MkdirTemp("", "kappa-discovery-*")
+	if err != nil {
+		logger.Get().Fatal("Failed to create discovery directory", zap.Error(err))
+	}
+	discovery, err := kappa.NewDiscovery(filepath.Join(discoveryDir, "hosts"))
+	if err != nil {
+		logger.Get().Fatal("Failed to set up function discovery", zap.Error(err))
+	}
+
+	// Runtime functions can be built into images once there's a registry
+	builds, err := build.FromEnv(matrix)
+	if err != nil {
+		logger.Get().Fatal("Failed to configure builds", zap.Error(err))
+	}
+
+	// Earlier versions of functions are kept to roll back to
+	keptVersions := defaultKeptVersions
+	if v := os.Getenv("KAPPA_KEPT_VERSIONS"); v != "" {
+		keptVersions, err = strconv.Atoi(v)
+		if err != nil || keptVersions < 0 {
+			logger.Get().Fatal("Invalid KAPPA_KEPT_VERSIONS", zap.String("value", v))
+		}
+	}
+
+	// Audit events in the database are kept for good unless given a
+	// retention
+	var auditRetention time.Duration
+	if v := os.Getenv("KAPPA_AUDIT_RETENTION"); v != "" {
+		auditRetention, err = time.ParseDuration(v)
+		if err != nil || auditRetention <= 0 {
+			logger.Get().Fatal("Invalid KAPPA_AUDIT_RETENTION", zap.String("value", v))
+		}
+	}
+
+	// Code uploads are bounded, as they are spooled to disk
+	maxUploadBytes := int64(defaultMaxUploadBytes)
+	if v := os.Getenv("KAPPA_MAX_UPLOAD_BYTES"); v != "" {
+		maxUploadBytes, err = strconv.ParseInt(v, 10, 64)
+		if err != nil || maxUploadBytes <= 0 {
+			logger.Get().Fatal("Invalid KAPPA_MAX_UPLOAD_BYTES", zap.String("value", v))
+		}
+	}
+
+	// With RBAC every route needs a key, the admin token manages the rest
+	var roles *rbac.Store
+	if os.Getenv("KAPPA_RBAC") == "true" {
+		if os.Getenv("KAPPA_ADMIN_TOKEN") == "" {
+			logger.Get().Fatal("KAPPA_RBAC needs KAPPA_ADMIN_TOKEN to manage roles")
+		}
+		roles = rbac.NewStore()
+	}
+	// Auth providers make every route need credentials too, with their
+	// scope deciding what they may do
+	authn, err := auth.FromEnv()
+	if err != nil {
+		logger.Get().Fatal("Failed to configure API authentication", zap.Error(err))
+	}
+	if authn != nil {
+		logger.Get().Info("API authentication enabled", zap.Strings("providers", authn.Providers()))
+	}
+	callers, err := newCallerTokens()
+	if err != nil {
+		logger.Get().Fatal("Failed to create caller token key", zap.Error(err))
+	}
+	tlsCert, tlsKey := os.Getenv("KAPPA_TLS_CERT"), os.Getenv("KAPPA_TLS_KEY")
+	if (tlsCert == "") != (tlsKey == "") {
+		logger.Get().Fatal("KAPPA_TLS_CERT and KAPPA_TLS_KEY must be set together")
+	}
+	if authn.ClientCAs() != nil && tlsCert == "" {
+		logger.Get().Fatal("The mtls auth provider needs KAPPA_TLS_CERT and KAPPA_TLS_KEY to serve TLS")
+	}
+
+	// Management routes get a router of their own when they are served on
+	// the admin listener, the public one only invokes functions
+	adminAddr := os.Getenv("KAPPA_ADMIN_ADDR")
+	grpcAddr := os.Getenv("KAPPA_GRPC_ADDR")
 	router := mux.NewRouter()
+	control := router
+	if adminAddr != "" {
+		control = mux.NewRouter()
+	}
 	service := &KappaService{
-		functions: make(map[string]*kappa.KappaFunction),
-		router:    router,
+		artifacts:        artifacts,
+		repository:       repo,
+		verifier:         verifier,
+		runtimes:         matrix,
+		envRefs:          envRefs,
+		defaults:         defaults,
+		projects:         make(map[string]*Project),
+		environments:     make(map[string]*Environment),
+		configs:          make(map[string]KappaFunctionConfig),
+		locked:           make(map[string]bool),
+		maintenance:      maintenance,
+		admission:        limiter,
+		mirrors:          make(map[string]*mirrorStats),
+		faults:           faults{active: make(map[string]*Fault)},
+		adminToken:       os.Getenv("KAPPA_ADMIN_TOKEN"),
+		agentToken:       os.Getenv("KAPPA_AGENT_TOKEN"),
+		inventory:        inventory,
+		prewarm:          warmer,
+		ports:            portAllocator,
+		exposures:        make(map[string]*exposure),
+		discovery:        discovery,
+		stop:             make(chan struct{}),
+		payloads:         payloads,
+		roles:            roles,
+		authn:            authn,
+		callers:          callers,
+		tlsCert:          tlsCert,
+		tlsKey:           tlsKey,
+		usage:            meter,
+		rateLimits:       rateLimits,
+		gateway:          gateway.New(),
+		batchers:         make(map[string]*batch.Batcher),
+		callerRateLimit:  callerRateLimit,
+		cors:             cors,
+		pricing:          pricing,
+		builds:           builds,
+		blobs:            blobs,
+		spiller:          blobSpiller{store: blobs, ttl: spillTTL},
+		results:          resultStore,
+		bucket:           bucket,
+		db:               db,
+		history:          invocationHistory,
+		errorTracker:     errtrack.NewReporter(),
+		postgres:         postgres,
+		spillThreshold:   spillThreshold,
+		compressMinBytes: compressMinBytes,
+		traceSampleRate:  traceSampleRate,
+		versions:         make(map[string][]functionVersion),
+		keptVersions:     keptVersions,
+		maxUploadBytes:   maxUploadBytes,
+		audit:            audit.NewLog(audit.DefaultSize),
+		functions:        make(map[string]*kappa.KappaFunction),
+		router:           router,
+		control:          control,
+		adminAddr:        adminAddr,
+		grpcAddr:         grpcAddr,
 		newFunction: func(name, binaryPath, image string, env []string, port int) kappa.Function {
 			return realKappa.NewKappaFunction(name, binaryPath, image, env, port) // Default real implementation
 		},
 	}
-	router.HandleFunc("/functions", service.listFunctions).Methods("GET")
-	router.HandleFunc("/functions", service.registerFunction).Methods("POST")
-	router.HandleFunc("/functions/{name}", service.invokeFunction).Methods("POST")
-	router.HandleFunc("/functions/{name}", service.deleteFunction).Methods("DELETE")
-	router.HandleFunc("/functions/{name}/logs", service.getFunctionLogs).Methods("GET")
+	service.metrics = metrics.New(errorKind, service.runningInstances)
+	// Each route group needs a permission in the project it is about,
+	// checked with RBAC enabled
+	read, invoke, deploy := rbac.Read, rbac.Invoke, rbac.Deploy
+	fnProject, schedProject := service.functionProject, service.scheduleProject
+	control.HandleFunc("/functions", service.authorize(read, nil, service.listFunctions)).Methods("GET")
+	control.HandleFunc("/functions", service.authorize(deploy, nil, service.mutation(service.registerFunction))).Methods("POST")
+	control.HandleFunc("/functions:batch", service.authorize(deploy, nil, service.mutation(service.batchRegisterFunctions))).Methods("POST")
+	control.HandleFunc("/functions/{name}", service.authorize(read, fnProject, service.getFunction)).Methods("GET")
+	// Invocations are rate limited once their caller is known
+	limited := service.rateLimited
+	router.HandleFunc("/functions/{name}", service.withCORS(service.withResponseHeaders(service.proxied(limited(service.invokeFunction))))).Methods("POST", "HEAD", "OPTIONS")
+	router.HandleFunc("/functions/{name}/health", service.proxied(service.getFunctionHealth)).Methods("GET", "HEAD")
+	router.HandleFunc("/hooks/{name}/{trigger}", limited(service.invokeWebhook)).Methods("POST")
+	// Requests no route of the service matches go through the gateway
+	router.NotFoundHandler = http.HandlerFunc(service.serveGateway)
+	router.HandleFunc("/functions/{name}/invoke-async", service.authorize(invoke, fnProject, limited(service.invokeFunctionAsync))).Methods("POST")
+	router.HandleFunc("/functions/{name}/invoke:batch", service.authorize(invoke, fnProject, limited(service.batchInvokeFunction))).Methods("POST")
+	router.HandleFunc("/functions/{name}/map", service.authorize(invoke, fnProject, limited(service.mapFunction))).Methods("POST")
+	control.HandleFunc("/functions/{name}/exposure", service.authorize(read, fnProject, service.getExposure)).Methods("GET")
+	router.HandleFunc("/functions/{name}/ws", service.proxied(limited(service.proxyWebSocket))).Methods("GET")
+	router.PathPrefix("/grpc/{name}/").HandlerFunc(service.proxied(limited(service.proxyGRPC))).Methods("POST")
+	control.HandleFunc("/functions/{name}", service.authorize(deploy, fnProject, service.mutation(service.updateFunction))).Methods("PUT")
+	control.HandleFunc("/functions/{name}", service.authorize(deploy, fnProject, service.mutation(service.deleteFunction))).Methods("DELETE")
+	control.HandleFunc("/functions/{name}/code", service.authorize(deploy, nil, service.mutation(service.uploadFunctionCode))).Methods("POST")
+	control.HandleFunc("/functions/{name}/lock", service.authorize(deploy, fnProject, service.mutation(service.lockFunction))).Methods("POST")
+	control.HandleFunc("/functions/{name}/unlock", service.authorize(deploy, fnProject, service.mutation(service.unlockFunction))).Methods("POST")
+	// Disabling stays open while locked or in maintenance, see setDisabled
+	control.HandleFunc("/functions/{name}/disable", service.authorize(deploy, fnProject, service.disableFunction)).Methods("POST")
+	control.HandleFunc("/functions/{name}/enable", service.authorize(deploy, fnProject, service.enableFunction)).Methods("POST")
+	control.HandleFunc("/functions/{name}/log-level", service.authorize(deploy, fnProject, service.setLogLevel)).Methods("PATCH")
+	control.HandleFunc("/functions/{name}/warm", service.authorize(deploy, fnProject, service.warmFunction)).Methods("POST")
+	control.HandleFunc("/functions/{name}/idle-timeout", service.authorize(deploy, fnProject, service.mutation(service.setIdleTimeout))).Methods("PATCH")
+	control.HandleFunc("/functions/{name}/env", service.authorize(deploy, fnProject, service.mutation(service.patchEnv))).Methods("PATCH")
+	control.HandleFunc("/functions/{name}/sampling", service.authorize(read, fnProject, service.getSampling)).Methods("GET")
+	control.HandleFunc("/functions/{name}/sampling", service.authorize(deploy, fnProject, service.mutation(service.setSampling))).Methods("PUT")
+	control.HandleFunc("/functions/{name}/invocations", service.authorize(read, fnProject, service.listFunctionInvocations)).Methods("GET")
+	control.HandleFunc("/functions/{name}/logs", service.authorize(read, fnProject, service.getFunctionLogs)).Methods("GET")
+	control.HandleFunc("/functions/{name}/logs/stream", service.authorize(read, fnProject, service.streamFunctionLogs)).Methods("GET")
+	control.HandleFunc("/functions/{name}/sbom", service.authorize(read, fnProject, service.getFunctionSBOM)).Methods("GET")
+	control.HandleFunc("/functions/{name}/inspect", service.authorize(read, fnProject, service.inspectFunction)).Methods("GET")
+	control.HandleFunc("/functions/{name}/mirror", service.authorize(read, fnProject, service.getFunctionMirror)).Methods("GET")
+	control.HandleFunc("/functions/{name}/versions", service.authorize(read, fnProject, service.listVersions)).Methods("GET")
+	control.HandleFunc("/functions/{name}/rollback", service.authorize(deploy, fnProject, service.mutation(service.rollbackFunction))).Methods("POST")
+	control.HandleFunc("/functions/{name}/promote", service.authorize(deploy, fnProject, service.mutation(service.promoteFunction))).Methods("POST")
+	control.HandleFunc("/functions/{name}/cost-estimate", service.authorize(read, fnProject, service.getCostEstimate)).Methods("GET")
+	control.HandleFunc("/functions/{name}/memory-recommendation", service.authorize(read, fnProject, service.getMemoryRecommendation)).Methods("GET")
+	control.HandleFunc("/projects", service.authorize(read, nil, service.listProjects)).Methods("GET")
+	control.HandleFunc("/projects/{name}", service.authorize(read, namedProject, service.getProject)).Methods("GET")
+	control.HandleFunc("/projects/{name}", service.authorize(deploy, namedProject, service.mutation(service.putProject))).Methods("PUT")
+	control.HandleFunc("/projects/{name}/lock", service.authorize(deploy, namedProject, service.mutation(service.lockProject))).Methods("POST")
+	control.HandleFunc("/projects/{name}/unlock", service.authorize(deploy, namedProject, service.mutation(service.unlockProject))).Methods("POST")
+	control.HandleFunc("/environments", service.authorize(read, nil, service.listEnvironments)).Methods("GET")
+	control.HandleFunc("/environments/{name}", service.authorize(read, nil, service.getEnvironment)).Methods("GET")
+	control.HandleFunc("/environments/{name}", service.authorize(rbac.Manage, nil, service.mutation(service.putEnvironment))).Methods("PUT")
+	control.HandleFunc("/environments/{name}", service.authorize(rbac.Manage, nil, service.mutation(service.deleteEnvironment))).Methods("DELETE")
+	control.HandleFunc("/maintenance", service.authorize(read, nil, service.getMaintenance)).Methods("GET")
+	control.HandleFunc("/maintenance", service.authorize(rbac.Manage, nil, service.putMaintenance)).Methods("PUT")
+	control.HandleFunc("/builds", service.authorize(read, nil, service.listBuilds)).Methods("GET")
+	control.HandleFunc("/builds", service.authorize(deploy, nil, service.mutation(service.startBuild))).Methods("POST")
+	control.HandleFunc("/builds/{id}", service.authorize(read, service.buildProject, service.getBuild)).Methods("GET")
+	// Links to blobs in a bucket are presigned and point at it instead
+	if dir, ok := blobs.(*blob.Dir); ok {
+		router.PathPrefix("/blobs/").Handler(dir.Handler()).Methods("GET", "HEAD")
+	}
+	control.HandleFunc("/runtimes", service.authorize(read, nil, service.listRuntimes)).Methods("GET")
+	control.HandleFunc("/admission", service.authorize(read, nil, service.getAdmission)).Methods("GET")
+	control.HandleFunc("/admin/drift", service.adminOnly(service.getDrift)).Methods("GET")
+	control.HandleFunc("/admin/drift/repair", service.adminOnly(service.repairDriftNow)).Methods("POST")
+	control.HandleFunc("/admin/prewarm", service.adminOnly(service.getPrewarm)).Methods("GET")
+	control.HandleFunc("/admin/prewarm", service.adminOnly(service.startPrewarm)).Methods("POST")
+	control.HandleFunc("/admin/faults", service.adminOnly(service.listFaults)).Methods("GET")
+	control.HandleFunc("/admin/faults/{name}", service.adminOnly(service.putFault)).Methods("PUT")
+	control.HandleFunc("/admin/faults/{name}", service.adminOnly(service.deleteFault)).Methods("DELETE")
+	control.HandleFunc("/schedules", service.authorize(read, nil, service.listSchedules)).Methods("GET")
+	control.HandleFunc("/routes", service.authorize(read, nil, service.listRoutes)).Methods("GET")
+	control.HandleFunc("/schedules/{id}", service.authorize(read, schedProject, service.getSchedule)).Methods("GET")
+	control.HandleFunc("/schedules/{id}", service.authorize(deploy, nil, service.mutation(service.putSchedule))).Methods("PUT")
+	control.HandleFunc("/schedules/{id}", service.authorize(deploy, schedProject, service.mutation(service.deleteSchedule))).Methods("DELETE")
+	control.HandleFunc("/schedules/{id}/next", service.authorize(read, schedProject, service.nextScheduleRuns)).Methods("GET")
+	control.HandleFunc("/invocations", service.authorize(read, nil, service.listInvocations)).Methods("GET")
+	control.HandleFunc("/invocations/{id}", service.authorize(read, service.resultProject, service.getInvocation)).Methods("GET")
+	control.HandleFunc("/invocations/{id}", service.authorize(deploy, service.resultProject, service.deleteInvocation)).Methods("DELETE")
+	control.HandleFunc("/agents/attach", service.agentOnly(service.attachAgent)).Methods("POST")
+	control.HandleFunc("/agents/detach", service.agentOnly(service.detachAgent)).Methods("POST")
+	router.HandleFunc("/jobs/{id}", service.authorize(read, service.resultProject, service.getInvocation)).Methods("GET")
+	control.HandleFunc("/admin/results", service.adminOnly(service.getResultStats)).Methods("GET")
+	control.HandleFunc("/audit", service.authorize(read, nil, service.listAudit)).Methods("GET")
+	control.HandleFunc("/usage", service.authorize(read, nil, service.getUsage)).Methods("GET")
+	// Metrics cover every project's functions
+	control.Handle("/metrics", service.authorize(rbac.Manage, nil, service.metrics.Handler().ServeHTTP)).Methods("GET")
+	control.HandleFunc("/memory-recommendations", service.authorize(read, nil, service.listMemoryRecommendations)).Methods("GET")
+	control.HandleFunc("/roles", service.authorize(read, nil, service.listRoles)).Methods("GET")
+	control.HandleFunc("/roles/subjects", service.rolesAPI(service.listSubjects)).Methods("GET")
+	control.HandleFunc("/roles/subjects/{name}", service.rolesAPI(service.getSubject)).Methods("GET")
+	control.HandleFunc("/roles/subjects/{name}", service.rolesAPI(service.putSubject)).Methods("PUT")
+	control.HandleFunc("/roles/subjects/{name}", service.rolesAPI(service.deleteSubject)).Methods("DELETE")
+	control.HandleFunc("/roles/subjects/{name}/key", service.rolesAPI(service.rotateSubjectKey)).Methods("POST")
+	router.HandleFunc("/openapi.json", getOpenAPI).Methods("GET")
+	router.HandleFunc("/healthz", service.getHealth).Methods("GET")
+	router.HandleFunc("/readyz", service.getReady).Methods("GET")
+	if control != router {
+		control.HandleFunc("/openapi.json", getOpenAPI).Methods("GET")
+	}
+	envRefs.Register("function", envref.SourceFunc(service.lookupFunctionRef))
+	service.scheduler = scheduler.New(location, service.invokeScheduled)
+	if postgres != nil {
+		service.audit.SetSink(service.storeAuditEntry)
+		if auditRetention > 0 {
+			go service.pruneAuditEvery(auditRetention, auditPruneInterval, service.stop)
+		}
+	}
+	if repairInterval > 0 {
+		go service.repairDriftEvery(repairInterval, service.stop)
+	}
+	go service.pruneBlobsEvery(spillTTL/4, service.stop)
+	go service.pruneResultsEvery(resultPruneInterval, service.stop)
+	go service.keepWarmEvery(warmCheckInterval, service.stop)
+	if service.bucket != nil {
+		go service.archiveLogsEvery(logArchiveInterval, service.stop)
+	}
+	if rightSizeInterval > 0 {
+		go service.rightSizeEvery(rightSizeInterval, service.stop)
+	}
+	service.failInterruptedJobs()
+	service.restoreResources()
+	service.restoreFunctions()
+	service.restoreLocks()
+	service.restoreSchedules()
 	return service
 }
 
 func (s *KappaService) Start(addr string) error {
-	s.server = &http.Server{
-		Addr:    addr,
-		Handler: s.router,
+	s.server = s.newServer(addr, s.router)
+	if s.adminAddr != "" {
+		if err := s.startAdmin(); err != nil {
+			return err
+		}
+	}
+	if s.grpcAddr != "" {
+		if err := s.startGRPC(); err != nil {
+			return err
+		}
 	}
 
+	if s.tlsCert != "" {
+		logger.Get().Info("Starting Kappa service", zap.String("address", addr), zap.Bool("tls", true))
+		return s.server.ListenAndServeTLS(s.tlsCert, s.tlsKey)
+	}
 	logger.Get().Info("Starting Kappa service", zap.String("address", addr))
 	return s.server.ListenAndServe()
 }
@@ -65,16 +820,47 @@ func (s *KappaService) Start(addr string) error {
 func (s *KappaService) Shutdown(ctx context.Context) error {
 	logger.Get().Info("Shutting down Kappa service")
 
+	// Stop taking requests, those in flight carry on
+	serverDone := make(chan error, 1)
+	go func() { serverDone <- s.server.Shutdown(ctx) }()
+
+	// Stop firing schedules and taking connections before their functions
+	// go away, delivering the batches collected so far
+	s.scheduler.Stop()
+	s.closeBatchers()
+	s.closeExposures()
+	close(s.stop)
+
+	// Let the invocations in flight finish before stopping the functions
+	// running them
+	s.drainFunctions(ctx)
+
 	// Stop all running functions
-	for _, fn := range s.functions {
+	functions, _ := s.snapshot()
+	for _, fn := range functions {
 		if fn.IsRunning() {
 			if err := fn.Stop(); err != nil {
 				logger.Get().Warn("Failed to stop function", zap.String("name", fn.Name), zap.Error(err))
 			}
 		}
 	}
+	os.RemoveAll(filepath.Dir(s.discovery.Path()))
 
-	return s.server.Shutdown(ctx)
+	if s.adminServer != nil {
+		if err := s.adminServer.Shutdown(ctx); err != nil {
+			logger.Get().Warn("Failed to shut down admin listener", zap.Error(err))
+		}
+	}
+	if s.grpcServer != nil {
+		s.stopGRPC(ctx)
+	}
+	err := <-serverDone
+	s.errorTracker.Close()
+	s.history.Close()
+	if s.db != nil {
+		s.db.Close()
+	}
+	return err
 }
 
 // HTTP handler for registering a new function
@@ -84,38 +870,456 @@ func (s *KappaService) registerFunction(w http.ResponseWriter, r *http.Request)
 		http.Error(w, fmt.Sprintf("Invalid request: %v", err), http.StatusBadRequest)
 		return
 	}
+	if !s.allowed(r.Context(), rbac.Deploy, s.deployTargets(config.Name, config.Project)...) {
+		http.Error(w, fmt.Sprintf("Forbidden: may not deploy %s to %s", config.Name, projectLabel(config.Project)), http.StatusForbidden)
+		return
+	}
+	if !checkPreconditions(w, r, s.functionETag(config.Name)) {
+		return
+	}
+
+	fn, regErr := s.prepareFunction(&config)
+	if regErr != nil {
+		http.Error(w, regErr.msg, regErr.status)
+		return
+	}
+	s.commitFunction(config, fn)
+
+	// Return success
+	w.Header().Set("ETag", s.functionETag(config.Name))
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(map[string]string{
+		"name":   config.Name,
+		"status": "registered",
+		"sha256": fn.ArtifactDigest,
+	})
+}
+
+// HTTP handler for redeploying a registered function in place with a new
+// config. The function is swapped for the new one at once, keeping its
+// versions, mirror stats and faults, and the old one is stopped, so the next
+// invocation starts the new binary, image and env.
+func (s *KappaService) updateFunction(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	name := vars["name"]
+
+	old, _, exists := s.lookup(name)
+	if !exists {
+		http.Error(w, fmt.Sprintf("Function not found: %s", name), http.StatusNotFound)
+		return
+	}
 
-	// Validate the configuration
-	if config.Name == "" || config.BinaryPath == "" || config.Image == "" {
-		http.Error(w, "Missing required fields: name, binaryPath, image", http.StatusBadRequest)
+	var config KappaFunctionConfig
+	if err := json.NewDecoder(r.Body).Decode(&config); err != nil {
+		http.Error(w, fmt.Sprintf("Invalid request: %v", err), http.StatusBadRequest)
+		return
+	}
+	if config.Name == "" {
+		config.Name = name
+	}
+	if config.Name != name {
+		http.Error(w, fmt.Sprintf("Name %s doesn't match the function updated: %s", config.Name, name), http.StatusBadRequest)
+		return
+	}
+	if !s.allowed(r.Context(), rbac.Deploy, s.deployTargets(name, config.Project)...) {
+		http.Error(w, fmt.Sprintf("Forbidden: may not deploy %s to %s", name, projectLabel(config.Project)), http.StatusForbidden)
+		return
+	}
+	if !checkPreconditions(w, r, s.functionETag(name)) {
 		return
 	}
 
-	// Check if the binary exists
-	if _, err := os.Stat(config.BinaryPath); os.IsNotExist(err) {
-		http.Error(w, fmt.Sprintf("Binary not found: %s", config.BinaryPath), http.StatusBadRequest)
+	fn, regErr := s.prepareFunction(&config)
+	if regErr != nil {
+		http.Error(w, regErr.msg, regErr.status)
 		return
 	}
+	s.commitFunction(config, fn)
+	if old.IsRunning() {
+		if err := old.Stop(); err != nil {
+			logger.FromCtx(r.Context()).Warn("Failed to stop replaced function", zap.String("name", name), zap.Error(err))
+		}
+	}
+
+	w.Header().Set("ETag", s.functionETag(name))
+	w.Header().Set("Content-Type", "application/json")
+	history, _ := s.versionHistory(name)
+	json.NewEncoder(w).Encode(map[string]any{
+		"name":    name,
+		"status":  "updated",
+		"sha256":  fn.ArtifactDigest,
+		"version": history[len(history)-1].Version,
+	})
+}
+
+// registrationError is a rejected registration and the HTTP status it maps to.
+type registrationError struct {
+	status int
+	msg    string
+}
+
+func registrationErrorf(status int, format string, args ...any) *registrationError {
+	return &registrationError{status: status, msg: fmt.Sprintf(format, args...)}
+}
+
+// prepareFunction validates config and builds its function without
+// registering it, holding a reference on its binary until it is committed
+// or discarded. Defaults are filled into config.
+func (s *KappaService) prepareFunction(config *KappaFunctionConfig) (*kappa.KappaFunction, *registrationError) {
+	return s.prepareFunctionFrom(config, "")
+}
+
+// prepareFunctionFrom is prepareFunction running the stored binary with
+// digest instead of importing config's, when digest is set.
+func (s *KappaService) prepareFunctionFrom(config *KappaFunctionConfig, digest string) (*kappa.KappaFunction, *registrationError) {
+	// Validate the configuration, only containers need an image and
+	// runtimes bring their own
+	if config.Name == "" {
+		return nil, registrationErrorf(http.StatusBadRequest, "Missing required fields: name")
+	}
+	mode, err := kappa.ParseMode(config.Mode)
+	if err != nil {
+		return nil, registrationErrorf(http.StatusBadRequest, "Invalid mode: %v", err)
+	}
+	if mode == kappa.ModeExternal {
+		if config.BinaryPath != "" || config.Runtime != nil || len(config.Init) > 0 || len(config.Sidecars) > 0 || config.WebSocket != nil || config.GRPC != nil {
+			return nil, registrationErrorf(http.StatusBadRequest, "Invalid mode: external functions are run by their own supervisor, without a binary, runtime, init steps, sidecars or proxied connections")
+		}
+	} else if config.Runtime == nil && digest == "" {
+		if config.BinaryPath == "" || (config.Image == "" && config.Backend != "process" && config.Backend != "vm") {
+			return nil, registrationErrorf(http.StatusBadRequest, "Missing required fields: name, binaryPath, image")
+		}
+
+		// Check if the binary exists
+		if _, err := os.Stat(config.BinaryPath); os.IsNotExist(err) {
+			return nil, registrationErrorf(http.StatusBadRequest, "Binary not found: %s", config.BinaryPath)
+		}
+	}
+
+	// Configs fetched from the API come back with their secrets masked
+	if _, existing, exists := s.lookup(config.Name); exists {
+		config.Settings = config.Settings.Unmasked(existing.Settings)
+		config.Triggers = unmaskedTriggers(config.Triggers, existing.Triggers)
+	}
+	if err := foldIdleTimeout(config); err != nil {
+		return nil, registrationErrorf(http.StatusBadRequest, "Invalid idleTimeoutSeconds: %v", err)
+	}
+	if err := config.Settings.Validate(); err != nil {
+		return nil, registrationErrorf(http.StatusBadRequest, "Invalid settings: %v", err)
+	}
+	if config.Project != "" {
+		if _, exists := s.project(config.Project); !exists {
+			return nil, registrationErrorf(http.StatusBadRequest, "Project not found: %s", config.Project)
+		}
+	}
+	if err := s.envRefs.Validate(config.Env); err != nil {
+		return nil, registrationErrorf(http.StatusBadRequest, "Invalid env: %v", err)
+	}
+	if config.Environment != "" {
+		if _, exists := s.environment(config.Environment); !exists {
+			return nil, registrationErrorf(http.StatusBadRequest, "Environment not found: %s", config.Environment)
+		}
+	}
+	if reason := s.lockReason(config.Name, config.Project); reason != "" {
+		return nil, registrationErrorf(http.StatusLocked, "Function is locked: %s", reason)
+	}
+
+	if _, err := admission.ParsePriority(config.Priority); err != nil {
+		return nil, registrationErrorf(http.StatusBadRequest, "Invalid priority: %v", err)
+	}
+	if config.MaxConcurrency < 0 || config.QueueDepth < 0 {
+		return nil, registrationErrorf(http.StatusBadRequest, "Invalid concurrency: maxConcurrency and queueDepth must not be negative")
+	}
+	if err := validateVisibility(config.Visibility); err != nil {
+		return nil, registrationErrorf(http.StatusBadRequest, "Invalid visibility: %v", err)
+	}
+	if err := validateDisabled(config.Disabled); err != nil {
+		return nil, registrationErrorf(http.StatusBadRequest, "Invalid disabled: %v", err)
+	}
+	if err := validateLogLevel(config.LogLevel); err != nil {
+		return nil, registrationErrorf(http.StatusBadRequest, "Invalid logLevel: %v", err)
+	}
+	if config.QueueDepth > 0 && config.MaxConcurrency == 0 {
+		return nil, registrationErrorf(http.StatusBadRequest, "Invalid concurrency: queueDepth needs maxConcurrency")
+	}
+	if config.Spillover != nil && config.Spillover.ThresholdBytes < 0 {
+		return nil, registrationErrorf(http.StatusBadRequest, "Invalid spillover: thresholdBytes must not be negative")
+	}
+	if config.RightSizing != nil {
+		if err := config.RightSizing.Validate(); err != nil {
+			return nil, registrationErrorf(http.StatusBadRequest, "Invalid rightSizing: %v", err)
+		}
+	}
+	if _, err := config.Transform.compile(); err != nil {
+		return nil, registrationErrorf(http.StatusBadRequest, "Invalid transform: %v", err)
+	}
+	if err := config.Errors.validate(); err != nil {
+		return nil, registrationErrorf(http.StatusBadRequest, "Invalid errors: %v", err)
+	}
+	if config.WebSocket != nil {
+		if mode == kappa.ModeJob {
+			return nil, registrationErrorf(http.StatusBadRequest, "Invalid webSocket: jobs have no runtime to connect to")
+		}
+		if err := config.WebSocket.validate(); err != nil {
+			return nil, registrationErrorf(http.StatusBadRequest, "Invalid webSocket: %v", err)
+		}
+	}
+	if len(config.Init) > 0 {
+		if mode == kappa.ModeJob {
+			return nil, registrationErrorf(http.StatusBadRequest, "Invalid init: jobs don't start a runtime to run steps before")
+		}
+		if err := kappa.ValidateInitSteps(config.Init); err != nil {
+			return nil, registrationErrorf(http.StatusBadRequest, "Invalid init: %v", err)
+		}
+	}
+	if len(config.Sidecars) > 0 {
+		if mode == kappa.ModeJob {
+			return nil, registrationErrorf(http.StatusBadRequest, "Invalid sidecars: jobs don't start a runtime to run them with")
+		}
+		if err := kappa.ValidateSidecars(config.Sidecars); err != nil {
+			return nil, registrationErrorf(http.StatusBadRequest, "Invalid sidecars: %v", err)
+		}
+	}
+	if config.DNS != nil {
+		if err := kappa.ValidateDNS(*config.DNS); err != nil {
+			return nil, registrationErrorf(http.StatusBadRequest, "Invalid dns: %v", err)
+		}
+	}
+	if err := kappa.ValidateExtraHosts(config.ExtraHosts); err != nil {
+		return nil, registrationErrorf(http.StatusBadRequest, "Invalid extraHosts: %v", err)
+	}
+	if config.Retry != nil {
+		if err := kappa.ValidateRetryPolicy(*config.Retry); err != nil {
+			return nil, registrationErrorf(http.StatusBadRequest, "Invalid retry: %v", err)
+		}
+	}
+	if config.Clock != nil {
+		if err := kappa.ValidateClock(*config.Clock); err != nil {
+			return nil, registrationErrorf(http.StatusBadRequest, "Invalid clock: %v", err)
+		}
+	}
+	if err := validateRateLimit(config.RateLimit); err != nil {
+		return nil, registrationErrorf(http.StatusBadRequest, "Invalid rateLimit: %v", err)
+	}
+	if err := validateCORS(config.CORS); err != nil {
+		return nil, registrationErrorf(http.StatusBadRequest, "Invalid cors: %v", err)
+	}
+	if err := config.Sampling.Validate(); err != nil {
+		return nil, registrationErrorf(http.StatusBadRequest, "Invalid sampling: %v", err)
+	}
+	if err := validateTimeoutGrace(config.TimeoutGraceMs, mode); err != nil {
+		return nil, registrationErrorf(http.StatusBadRequest, "Invalid timeoutGraceMs: %v", err)
+	}
+	if err := validateWarmInstances(config.WarmInstances, mode); err != nil {
+		return nil, registrationErrorf(http.StatusBadRequest, "Invalid warmInstances: %v", err)
+	}
+	if err := validateTriggers(config.Name, config.Triggers, mode); err != nil {
+		return nil, registrationErrorf(http.StatusBadRequest, "Invalid triggers: %v", err)
+	}
+	if err := s.checkRoutes(config.Name, config.Triggers); err != nil {
+		return nil, registrationErrorf(http.StatusConflict, "Invalid triggers: %v", err)
+	}
+	if config.HostPort != 0 && mode != kappa.ModeTCP {
+		return nil, registrationErrorf(http.StatusBadRequest, "Invalid hostPort: only tcp functions are exposed")
+	}
+	if mode == kappa.ModeTCP {
+		if err := s.ports.Check(config.Name, config.HostPort); err != nil {
+			return nil, registrationErrorf(http.StatusConflict, "Failed to expose function: %v", err)
+		}
+	}
+	if config.GRPC != nil {
+		if mode == kappa.ModeJob {
+			return nil, registrationErrorf(http.StatusBadRequest, "Invalid grpc: jobs have no runtime to connect to")
+		}
+		if err := config.GRPC.validate(); err != nil {
+			return nil, registrationErrorf(http.StatusBadRequest, "Invalid grpc: %v", err)
+		}
+	}
+	if config.Mirror != nil {
+		if err := config.Mirror.validate(config.Name); err != nil {
+			return nil, registrationErrorf(http.StatusBadRequest, "Invalid mirror: %v", err)
+		}
+		if _, _, exists := s.lookup(config.Mirror.Function); !exists {
+			return nil, registrationErrorf(http.StatusBadRequest, "Mirror function not found: %s", config.Mirror.Function)
+		}
+	}
+
+	if err := config.Redact.Validate(); err != nil {
+		return nil, registrationErrorf(http.StatusBadRequest, "Invalid redact policy: %v", err)
+	}
 
 	// If no port specified, assign a default
 	if config.Port == 0 {
 		config.Port = 8080
 	}
 
+	backend, err := kappa.BackendByName(config.Backend)
+	if err != nil {
+		return nil, registrationErrorf(http.StatusBadRequest, "Invalid backend: %v", err)
+	}
+
+	var preparer kappa.Preparer
+	var binaryPath string
+	if config.Runtime != nil {
+		if preparer, err = runtimes.New(*config.Runtime, s.runtimes); err != nil {
+			return nil, registrationErrorf(http.StatusBadRequest, "Invalid runtime: %v", err)
+		}
+	} else if mode == kappa.ModeExternal {
+		// Nothing to store, the runtime attaches itself
+	} else if digest != "" {
+		if s.verifier != nil {
+			if err := s.verifier.Verify(digest, config.Signature); err != nil {
+				return nil, registrationErrorf(http.StatusBadRequest, "Signature verification failed: %v", err)
+			}
+		}
+		if err := s.artifacts.Acquire(digest); err != nil {
+			return nil, registrationErrorf(http.StatusInternalServerError, "Failed to load binary: %v", err)
+		}
+		binaryPath = s.artifacts.Path(digest)
+	} else {
+		// Keep our own content-addressed copy of the binary, so later changes
+		// to the original can't affect the function
+		if digest, err = s.artifacts.Import(config.BinaryPath); err != nil {
+			return nil, registrationErrorf(http.StatusInternalServerError, "Failed to store binary: %v", err)
+		}
+		if s.verifier != nil {
+			if err := s.verifier.Verify(digest, config.Signature); err != nil {
+				return nil, registrationErrorf(http.StatusBadRequest, "Signature verification failed: %v", err)
+			}
+		}
+		if err := s.artifacts.Acquire(digest); err != nil {
+			return nil, registrationErrorf(http.StatusInternalServerError, "Failed to store binary: %v", err)
+		}
+
+		// Record the dependencies the artifact was built with
+		bom, err := sbom.Generate(config.Name, config.BinaryPath, config.Lockfiles)
+		if err != nil {
+			s.artifacts.Release(digest)
+			return nil, registrationErrorf(http.StatusBadRequest, "Failed to generate SBOM: %v", err)
+		}
+		bomJSON, err := json.Marshal(bom)
+		if err == nil {
+			err = s.artifacts.PutMeta(digest, "sbom", bomJSON)
+		}
+		if err != nil {
+			logger.Get().Warn("Failed to store SBOM", zap.String("name", config.Name), zap.Error(err))
+		}
+		binaryPath = s.artifacts.Path(digest)
+	}
+
 	// Create a new kappa function
-	fn := kappa.NewKappaFunction(config.Name, config.BinaryPath, config.Image, config.Env, config.Port)
+	effective := s.effectiveSettings(*config)
+	fn := kappa.NewKappaFunction(config.Name, binaryPath, config.Image, effective.EnvList(), config.Port)
+	fn.SetMode(mode)
+	applySettings(fn, effective)
+	fn.ArtifactDigest = digest
+	if preparer != nil {
+		fn.SetPreparer(preparer)
+	}
+	fn.Signature = config.Signature
+	if s.verifier != nil {
+		fn.SetVerifier(s.verifier)
+	}
+	fn.SetBackend(backend)
+	fn.SetBinaryMounter(s.artifacts)
+	fn.SetInitSteps(config.Init)
+	fn.SetSidecars(config.Sidecars)
+	fn.SetDNS(config.DNS)
+	fn.SetClock(config.Clock)
+	fn.SetTimeoutGrace(time.Duration(config.TimeoutGraceMs) * time.Millisecond)
+	fn.SetWarm(config.WarmInstances > 0)
+	fn.SetExtraHosts(config.ExtraHosts)
+	fn.SetDiscovery(s.discovery)
+	if s.authRequired() {
+		fn.SetEnvResolver(callerEnv{next: s.envRefs, token: s.callers.token(config.Name)})
+	} else {
+		fn.SetEnvResolver(s.envRefs)
+	}
+	fn.SetUsageRecorder(s.errorTracker.Recorder(config.Project, config.Environment,
+		history.Recorder(s.history, s.metrics.Recorder(s.usage.Recorder(config.Project)))))
+	fn.SetCompression(s.compressMinBytes)
+	fn.SetConcurrency(config.MaxConcurrency, config.QueueDepth)
+	fn.SetDisabled(config.Disabled)
+	fn.SetInvocationLogs(config.InvocationLogs)
+	// Nothing runs yet, the level is only set in the runtime's environment
+	fn.SetLogLevel(context.Background(), config.LogLevel)
+	if config.Spillover != nil {
+		threshold := config.Spillover.ThresholdBytes
+		if threshold == 0 {
+			threshold = s.spillThreshold
+		}
+		fn.SetSpillover(threshold, s.spiller)
+	}
+	if config.Retry != nil {
+		fn.SetRetryPolicy(*config.Retry)
+	}
+	fn.Host = config.Host
+	fn.TLS = os.Getenv("KAPPA_RUNTIME_TLS") == "true"
+	if config.TLS != nil {
+		fn.TLS = *config.TLS
+	}
+
+	return fn, nil
+}
+
+// commitFunction adds a prepared function to the service, replacing any
+// function of the same name, and persists it and its new version.
+func (s *KappaService) commitFunction(config KappaFunctionConfig, fn *kappa.KappaFunction) {
+	s.addFunction(config, fn)
+	s.persistFunction(config, fn)
+	s.saveVersion(config.Name)
+}
+
+// addFunction adds a prepared function to the service without persisting it.
+func (s *KappaService) addFunction(config KappaFunctionConfig, fn *kappa.KappaFunction) {
+	// Replacing a function drops its reference on the old binary, and
+	// keeps the runtime attached to an external one
+	if old, _, exists := s.lookup(config.Name); exists {
+		s.releaseFunction(old)
+		fn.KeepAttachment(old)
+	}
 
 	// Add to the service
+	s.mu.Lock()
 	s.functions[config.Name] = fn
+	s.configs[config.Name] = config
+	s.mu.Unlock()
+	s.recordVersion(config, fn)
+	s.updateDiscovery()
+	s.reconcileTriggers(config.Name, config.Triggers)
+
+	// Functions switching to or from tcp gain or lose their port
+	if fn.Mode() == kappa.ModeTCP {
+		if _, err := s.expose(config.Name, config.HostPort); err != nil {
+			logger.Get().Error("Failed to expose function", zap.String("name", config.Name), zap.Error(err))
+		}
+	} else {
+		s.unexpose(config.Name)
+	}
 
 	logger.Get().Info("Function registered", zap.String("name", config.Name))
+}
 
-	// Return success
-	w.WriteHeader(http.StatusCreated)
-	json.NewEncoder(w).Encode(map[string]string{
-		"name":   config.Name,
-		"status": "registered",
-	})
+// HTTP handler for getting a function's registered config, answering
+// If-None-Match with 304 so clients can cheaply poll for changes
+func (s *KappaService) getFunction(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	name := vars["name"]
+
+	if _, _, exists := s.lookup(name); !exists {
+		http.Error(w, fmt.Sprintf("Function not found: %s", name), http.StatusNotFound)
+		return
+	}
+
+	etag := s.functionETag(name)
+	w.Header().Set("ETag", etag)
+	if etagMatches(r.Header.Get("If-None-Match"), etag, true) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(s.maskedConfig(s.config(name)))
 }
 
 // HTTP handler for invoking a function
@@ -124,77 +1328,290 @@ func (s *KappaService) invokeFunction(w http.ResponseWriter, r *http.Request) {
 	name := vars["name"]
 
 	// Find the function
-	fn, exists := s.functions[name]
+	fn, _, exists := s.lookup(name)
 	if !exists {
 		http.Error(w, fmt.Sprintf("Function not found: %s", name), http.StatusNotFound)
 		return
 	}
 
-	// Parse the event from the request body
-	var event kappa.KappaEvent
-	if err := json.NewDecoder(r.Body).Decode(&event.Body); err != nil {
-		http.Error(w, fmt.Sprintf("Invalid request body: %v", err), http.StatusBadRequest)
+	if fn.Mode() == kappa.ModeTCP {
+		http.Error(w, fmt.Sprintf("Function takes connections on its exposed port: %s", name), http.StatusBadRequest)
+		return
+	}
+	if s.rejectDisabled(w, name, fn) {
 		return
 	}
 
-	// Copy request info to the event
-	event.Path = r.URL.Path
-	event.HTTPMethod = r.Method
-	event.Headers = make(map[string]string)
-	for key, values := range r.Header {
-		if len(values) > 0 {
-			event.Headers[key] = values[0]
+	// Parse the event from the request body, or render it with the
+	// function's request template, carrying on the caller's trace
+	s.traceRequest(w, r, name)
+	event := eventFromRequest(r)
+	templates := s.transform(name)
+	if templates.HasRequest() {
+		if err := transformRequest(templates, r, &event); err != nil {
+			http.Error(w, fmt.Sprintf("Failed to transform request: %v", err), http.StatusBadRequest)
+			return
+		}
+	} else if !bodyless(r) && (r.Body != http.NoBody || event.PathParams == nil) {
+		// Gateway routes like GET /users/{id} are called without a body
+		if err := json.NewDecoder(r.Body).Decode(&event.Body); err != nil {
+			http.Error(w, fmt.Sprintf("Invalid request body: %v", err), http.StatusBadRequest)
+			return
 		}
 	}
+	// Encoded once for the invocation and its mirror
+	encoded, err := kappa.EncodeEvent(event)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Invalid request body: %v", err), http.StatusBadRequest)
+		return
+	}
 
-	event.QueryParams = make(map[string]string)
-	for key, values := range r.URL.Query() {
-		if len(values) > 0 {
-			event.QueryParams[key] = values[0]
-		}
+	// Wait for a slot by priority, or shed the invocation when the service is full
+	if err := s.admission.Acquire(r.Context(), s.priority(name)); err != nil {
+		s.shedInvocation(w, name)
+		return
 	}
+	defer s.admission.Release()
+	s.maybeMirror(name, encoded)
 
-	// Invoke the function
-	ctx, cancel := context.WithTimeout(r.Context(), 30*time.Second)
+	// Invoke the function, passing on what it streams as it comes unless
+	// the response is rendered with a template
+	ctx, cancel := context.WithTimeout(r.Context(), fn.Timeout())
 	defer cancel()
+	if !templates.HasResponse() {
+		ctx = kappa.WithStreaming(ctx)
+	}
 
-	resp, err := fn.Invoke(ctx, event)
+	resp, err := s.invokeWithFaults(ctx, name, fn, encoded)
+	if errors.Is(err, kappa.ErrStartBackoff) {
+		// Don't have clients hammer a function that can't start
+		if retryAt := fn.StartStatus().RetryAt; retryAt != nil {
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(time.Until(*retryAt).Seconds()))))
+		}
+		s.invocationError(w, name, errorCircuitOpen, fmt.Sprintf("Function invocation failed: %v", err), http.StatusServiceUnavailable)
+		return
+	}
+	if errors.Is(err, kappa.ErrNotAttached) {
+		s.invocationError(w, name, errorNotAttached, fmt.Sprintf("Function invocation failed: %v", err), http.StatusServiceUnavailable)
+		return
+	}
+	if s.disabledError(w, name, err) {
+		return
+	}
+	if errors.Is(err, kappa.ErrConcurrencyLimit) {
+		w.Header().Set("Retry-After", strconv.Itoa(int(concurrencyRetryAfter.Seconds())))
+		s.invocationError(w, name, errorConcurrencyLimit, fmt.Sprintf("Function invocation failed: %v", err), http.StatusTooManyRequests)
+		return
+	}
+	if errors.Is(err, kappa.ErrDraining) {
+		// Another replica takes it while this one shuts down
+		w.Header().Set("Connection", "close")
+		s.invocationError(w, name, errorDraining, fmt.Sprintf("Function invocation failed: %v", err), http.StatusServiceUnavailable)
+		return
+	}
+	var timeoutErr *kappa.TimeoutError
+	if errors.As(err, &timeoutErr) {
+		s.timeoutError(w, r, name, timeoutErr)
+		return
+	}
 	if err != nil {
-		http.Error(w, fmt.Sprintf("Function invocation failed: %v", err), http.StatusInternalServerError)
+		s.invocationError(w, name, errorKind(err), fmt.Sprintf("Function invocation failed: %v", err), http.StatusInternalServerError)
+		return
+	}
+	if resp.Stream != nil {
+		defer resp.Stream.Close()
+	}
+	if err := transformResponse(templates, s.config(name).Transform.contentType(), resp); err != nil {
+		http.Error(w, fmt.Sprintf("Failed to transform response: %v", err), http.StatusBadGateway)
 		return
 	}
 
-	// Set response headers
+	// Set response headers, leaving those set for the function as they are
+	policy := s.effectiveSettings(s.config(name)).ResponseHeaders
 	for key, value := range resp.Headers {
-		w.Header().Set(key, value)
+		if _, set := policy[http.CanonicalHeaderKey(key)]; !set {
+			w.Header().Set(key, value)
+		}
+	}
+	w.Header().Set("X-Kappa-Attempts", strconv.Itoa(resp.Attempts))
+	if resp.Attempts > 1 {
+		w.Header().Set("X-Kappa-Retried", "true")
+	}
+
+	if w.Header().Get("Content-Type") == "" && json.Valid(resp.Body) {
+		w.Header().Set("Content-Type", "application/json")
+	}
+
+	// HEAD is answered with the headers of the body it would get
+	if r.Method == http.MethodHead {
+		if resp.Stream == nil && resp.Headers["Content-Length"] == "" {
+			w.Header().Set("Content-Length", strconv.Itoa(len(resp.Body)))
+		}
+		w.WriteHeader(resp.StatusCode)
+		return
 	}
 
 	// Set status code
 	w.WriteHeader(resp.StatusCode)
 
-	// Write response body
-	json.NewEncoder(w).Encode(resp.Body)
+	if resp.Stream != nil {
+		copyStream(w, resp.Stream, name)
+		return
+	}
+	// Write the handler's body as is, it is already encoded
+	w.Write(resp.Body)
+}
+
+// bodyless reports whether r is a HEAD request, or an OPTIONS one without a
+// body, which invoke functions with an event without one.
+func bodyless(r *http.Request) bool {
+	return r.Method == http.MethodHead || (r.Method == http.MethodOptions && r.ContentLength <= 0)
+}
+
+// eventFromRequest copies the request info to an event without its body.
+func eventFromRequest(r *http.Request) kappa.KappaEvent {
+	event := kappa.KappaEvent{
+		Path:        r.URL.Path,
+		HTTPMethod:  r.Method,
+		Headers:     make(map[string]string),
+		QueryParams: make(map[string]string),
+		RequestID:   requestID(r.Context()),
+		PathParams:  pathParams(r),
+	}
+	for key, values := range r.Header {
+		if len(values) > 0 {
+			event.Headers[key] = values[0]
+		}
+	}
+	for key, values := range r.URL.Query() {
+		if len(values) > 0 {
+			event.QueryParams[key] = values[0]
+		}
+	}
+	return event
+}
+
+// queryInt parses the query parameter param as an integer of at least
+// least, 0 when it is missing.
+func queryInt(params url.Values, param string, least int) (int, error) {
+	v := params.Get(param)
+	if v == "" {
+		return 0, nil
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil || n < least {
+		return 0, fmt.Errorf("Invalid %s: %s", param, v)
+	}
+	return n, nil
 }
 
-// HTTP handler for listing functions
+// Statuses functions are listed by. Failing functions keep failing to
+// start.
+var functionStatuses = []string{"running", "stopped", "disabled", "failing"}
+
+// HTTP handler for listing functions, sorted by name. ?prefix and ?status
+// filter them, and ?limit and ?offset page through them, every function
+// being listed without a limit.
 func (s *KappaService) listFunctions(w http.ResponseWriter, r *http.Request) {
 	type functionInfo struct {
-		Name      string `json:"name"`
-		IsRunning bool   `json:"isRunning"`
+		Name       string `json:"name"`
+		Project    string `json:"project,omitempty"`
+		Image      string `json:"image,omitempty"`
+		Port       int    `json:"port,omitempty"`
+		Mode       string `json:"mode"`
+		IsRunning  bool   `json:"isRunning"`
+		Visibility string `json:"visibility"`
+		// Disabled is whether the function turns invocations away now
+		Disabled bool `json:"disabled,omitempty"`
+		// StartError is why the last cold start failed, while it keeps failing
+		StartError        string     `json:"startError,omitempty"`
+		LastInvoked       *time.Time `json:"lastInvoked,omitempty"`
+		RequestsProcessed int64      `json:"requestsProcessed"`
+	}
+
+	params := r.URL.Query()
+	status := params.Get("status")
+	if status != "" && !slices.Contains(functionStatuses, status) {
+		http.Error(w, fmt.Sprintf("Invalid status: %s, expected one of %v", status, functionStatuses), http.StatusBadRequest)
+		return
+	}
+	prefix := params.Get("prefix")
+	limit, err := queryInt(params, "limit", 1)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	offset, err := queryInt(params, "offset", 0)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	registered, configs := s.snapshot()
+	names := make([]string, 0, len(registered))
+	for name := range registered {
+		if strings.HasPrefix(name, prefix) && s.allowed(r.Context(), rbac.Read, configs[name].Project) {
+			names = append(names, name)
+		}
+	}
+	slices.Sort(names)
+
+	functions := make([]functionInfo, 0, len(names))
+	now := time.Now()
+	for _, name := range names {
+		fn := registered[name]
+		_, disabled := fn.DisabledAt(now)
+		info := functionInfo{
+			Name:              name,
+			Project:           configs[name].Project,
+			Image:             fn.Image,
+			Port:              fn.Port,
+			Mode:              string(fn.Mode()),
+			IsRunning:         fn.IsRunning(),
+			Visibility:        s.visibility(name),
+			Disabled:          disabled,
+			StartError:        fn.StartStatus().LastError,
+			RequestsProcessed: fn.RequestsProcessed(),
+		}
+		if last := fn.LastInvoked(); !last.IsZero() {
+			info.LastInvoked = &last
+		}
+		switch status {
+		case "running":
+			if !info.IsRunning {
+				continue
+			}
+		case "stopped":
+			if info.IsRunning {
+				continue
+			}
+		case "disabled":
+			if !info.Disabled {
+				continue
+			}
+		case "failing":
+			if info.StartError == "" {
+				continue
+			}
+		}
+		functions = append(functions, info)
 	}
 
-	functions := make([]functionInfo, 0, len(s.functions))
-	for name, fn := range s.functions {
-		functions = append(functions, functionInfo{
-			Name:      name,
-			IsRunning: fn.IsRunning(),
-		})
+	total := len(functions)
+	page := functions[min(offset, total):]
+	if limit > 0 && len(page) > limit {
+		page = page[:limit]
+	}
+	resp := map[string]any{
+		"functions": page,
+		"total":     total,
+	}
+	if next := offset + len(page); next < total {
+		resp["nextOffset"] = next
 	}
 
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(map[string]any{
-		"functions": functions,
-	})
+	json.NewEncoder(w).Encode(resp)
 }
 
 // HTTP handler for deleting a function
@@ -203,12 +1620,20 @@ func (s *KappaService) deleteFunction(w http.ResponseWriter, r *http.Request) {
 	name := vars["name"]
 
 	// Find the function
-	fn, exists := s.functions[name]
+	fn, _, exists := s.lookup(name)
 	if !exists {
 		http.Error(w, fmt.Sprintf("Function not found: %s", name), http.StatusNotFound)
 		return
 	}
 
+	if reason := s.lockReason(name, s.config(name).Project); reason != "" {
+		http.Error(w, fmt.Sprintf("Function is locked: %s", reason), http.StatusLocked)
+		return
+	}
+	if !checkPreconditions(w, r, s.functionETag(name)) {
+		return
+	}
+
 	// Stop the function if it's running
 	if fn.IsRunning() {
 		if err := fn.Stop(); err != nil {
@@ -218,9 +1643,28 @@ func (s *KappaService) deleteFunction(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Remove the function from the service
+	s.mu.Lock()
 	delete(s.functions, name)
+	delete(s.configs, name)
+	s.mu.Unlock()
+	s.mirrorsMu.Lock()
+	delete(s.mirrors, name)
+	s.mirrorsMu.Unlock()
+	s.faults.mu.Lock()
+	delete(s.faults.active, name)
+	s.faults.mu.Unlock()
+	s.unexpose(name)
+	s.releaseFunction(fn)
+	s.dropVersions(name)
+	s.updateDiscovery()
+	s.forgetFunction(name)
+	s.metrics.Forget(name)
+	if err := s.history.Forget(name); err != nil {
+		logger.FromCtx(r.Context()).Warn("Failed to delete invocation history", zap.String("name", name), zap.Error(err))
+	}
+	s.reconcileTriggers(name, nil)
 
-	logger.Get().Info("Function deleted", zap.String("name", name))
+	logger.FromCtx(r.Context()).Info("Function deleted", zap.String("name", name))
 
 	// Return success
 	w.WriteHeader(http.StatusOK)
@@ -230,13 +1674,23 @@ func (s *KappaService) deleteFunction(w http.ResponseWriter, r *http.Request) {
 	})
 }
 
+// releaseFunction drops the function's reference on its stored binary.
+func (s *KappaService) releaseFunction(fn *kappa.KappaFunction) {
+	if fn.ArtifactDigest == "" {
+		return
+	}
+	if err := s.artifacts.Release(fn.ArtifactDigest); err != nil {
+		logger.Get().Warn("Failed to release artifact", zap.String("name", fn.Name), zap.Error(err))
+	}
+}
+
 // HTTP handler for getting function logs
 func (s *KappaService) getFunctionLogs(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	name := vars["name"]
 
 	// Find the function
-	fn, exists := s.functions[name]
+	fn, _, exists := s.lookup(name)
 	if !exists {
 		http.Error(w, fmt.Sprintf("Function not found: %s", name), http.StatusNotFound)
 		return
@@ -253,7 +1707,38 @@ func (s *KappaService) getFunctionLogs(w http.ResponseWriter, r *http.Request) {
 	})
 }
 
+// HTTP handler for getting a function's software bill of materials
+func (s *KappaService) getFunctionSBOM(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	name := vars["name"]
+
+	// Find the function
+	fn, _, exists := s.lookup(name)
+	if !exists {
+		http.Error(w, fmt.Sprintf("Function not found: %s", name), http.StatusNotFound)
+		return
+	}
+
+	bom, err := s.artifacts.GetMeta(fn.ArtifactDigest, "sbom")
+	if err != nil {
+		http.Error(w, fmt.Sprintf("SBOM not available: %v", err), http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/vnd.cyclonedx+json")
+	w.Write(bom)
+}
+
 func main() {
+	// "service prewarm" pulls the runtime images at install time and exits
+	if len(os.Args) > 1 && os.Args[1] == "prewarm" {
+		os.Exit(runPrewarm())
+	}
+	// "service --migrate-only" migrates the database's schema and exits
+	if len(os.Args) > 1 && os.Args[1] == "--migrate-only" {
+		os.Exit(runMigrateOnly())
+	}
+
 	// Initialize logger
 	// Create and start the kappa service
 	service := NewKappaService()
@@ -277,7 +1762,15 @@ func main() {
 	l.Info("Shutting down...")
 
 	// Give it some time to complete in-flight requests
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	shutdownTimeout := defaultShutdownTimeout
+	if v := os.Getenv("KAPPA_SHUTDOWN_TIMEOUT_MS"); v != "" {
+		ms, err := strconv.Atoi(v)
+		if err != nil || ms < 0 {
+			l.Fatal("Invalid KAPPA_SHUTDOWN_TIMEOUT_MS", zap.String("value", v))
+		}
+		shutdownTimeout = time.Duration(ms) * time.Millisecond
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
 	defer cancel()
 
 	if err := service.Shutdown(ctx); err != nil {
@@ -286,3 +1779,35 @@ func main() {
 
 	l.Info("Server stopped")
 }
+
+// lookupFunctionRef resolves ${function:name.attr} env references. The only
+// attribute is url, where the function is invoked through this service.
+func (s *KappaService) lookupFunctionRef(ctx context.Context, key string) (string, error) {
+	i := strings.LastIndexByte(key, '.')
+	if i < 0 {
+		return "", fmt.Errorf("function reference %q needs an attribute, like name.url", key)
+	}
+	name, attr := key[:i], key[i+1:]
+	if _, _, exists := s.lookup(name); !exists {
+		return "", envref.ErrNotFound
+	}
+
+	switch attr {
+	case "url":
+		base := os.Getenv("KAPPA_PUBLIC_URL")
+		if base == "" {
+			base = "http://localhost:8000"
+		}
+		return strings.TrimSuffix(base, "/") + "/functions/" + name, nil
+	default:
+		return "", fmt.Errorf("unknown function attribute %q", attr)
+	}
+}
+
+// HTTP handler for listing the runtime versions functions can use
+func (s *KappaService) listRuntimes(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{
+		"runtimes": s.runtimes.Versions(),
+	})
+}
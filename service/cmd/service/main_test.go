@@ -0,0 +1,272 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"kappa-v2/pkg/handler"
+	"kappa-v2/service/internal/kappa"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testAgentToken authenticates the fake runtimes tests attach
+const testAgentToken = "test-agent-token"
+
+// newTestService creates a service keeping its state in a temp dir, shut
+// down when the test ends.
+func newTestService(t *testing.T) *KappaService {
+	t.Helper()
+	return newTestServiceIn(t, t.TempDir())
+}
+
+// newTestServiceIn creates a service keeping its state in dir, so a test
+// can restart it on the same state.
+func newTestServiceIn(t *testing.T, dir string) *KappaService {
+	t.Helper()
+	for key, value := range map[string]string{
+		"KAPPA_ARTIFACT_DIR": filepath.Join(dir, "artifacts"),
+		"KAPPA_SECRETS_DIR":  filepath.Join(dir, "secrets"),
+		"KAPPA_RESULTS_DIR":  filepath.Join(dir, "results"),
+		"KAPPA_BLOB_DIR":     filepath.Join(dir, "blobs"),
+		"KAPPA_AGENT_TOKEN":  testAgentToken,
+	} {
+		t.Setenv(key, value)
+	}
+
+	s := NewKappaService()
+	s.server = s.newServer("127.0.0.1:0", s.router)
+	t.Cleanup(func() { stopTestService(s) })
+	return s
+}
+
+// stopTestService shuts a test service down, unless it already is.
+func stopTestService(s *KappaService) {
+	select {
+	case <-s.stop:
+		return
+	default:
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	s.Shutdown(ctx)
+}
+
+// do sends a request with body encoded as JSON, unless it is a string or
+// nil, to the service and records the response.
+func do(t *testing.T, s *KappaService, method, path string, body any, header ...string) *httptest.ResponseRecorder {
+	t.Helper()
+	return doOn(t, s.router, method, path, body, header...)
+}
+
+// doOn is do sending the request to h, like the management routes of a
+// service with an admin listener.
+func doOn(t *testing.T, h http.Handler, method, path string, body any, header ...string) *httptest.ResponseRecorder {
+	t.Helper()
+	var reader io.Reader
+	switch b := body.(type) {
+	case nil:
+	case string:
+		reader = bytes.NewBufferString(b)
+	default:
+		encoded, err := json.Marshal(b)
+		require.NoError(t, err)
+		reader = bytes.NewReader(encoded)
+	}
+	req := httptest.NewRequest(method, path, reader)
+	for i := 0; i+1 < len(header); i += 2 {
+		req.Header.Set(header[i], header[i+1])
+	}
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	return rec
+}
+
+// decode decodes a recorded JSON response.
+func decode(t *testing.T, rec *httptest.ResponseRecorder) map[string]any {
+	t.Helper()
+	var body map[string]any
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &body), rec.Body.String())
+	return body
+}
+
+// register registers config, failing the test unless it is.
+func register(t *testing.T, s *KappaService, config map[string]any) {
+	t.Helper()
+	rec := doOn(t, s.control, "POST", "/functions", config)
+	require.Equal(t, http.StatusCreated, rec.Code, rec.Body.String())
+}
+
+// attachRuntime registers an external function and attaches a fake runtime
+// answering its invocations with respond.
+func attachRuntime(t *testing.T, s *KappaService, name string, respond http.HandlerFunc) *httptest.Server {
+	t.Helper()
+	runtime := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/health" {
+			return
+		}
+		w.Header().Set(handler.HeaderResponseFormat, handler.ResponseFormatRaw)
+		respond(w, r)
+	}))
+	t.Cleanup(runtime.Close)
+
+	rec := doOn(t, s.control, "POST", "/agents/attach", map[string]any{"function": name, "url": runtime.URL},
+		"Authorization", "Bearer "+testAgentToken)
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	return runtime
+}
+
+// decodeInto decodes a recorded JSON response into v.
+func decodeInto(rec *httptest.ResponseRecorder, v any) error {
+	return json.Unmarshal(rec.Body.Bytes(), v)
+}
+
+// fakeBackend runs instances as in-process servers on the function's port,
+// answering invocations with respond, and records the specs it runs.
+type fakeBackend struct {
+	addr    string
+	respond http.HandlerFunc
+
+	mu    sync.Mutex
+	specs []kappa.RunSpec
+}
+
+func (b *fakeBackend) Run(spec kappa.RunSpec) (kappa.Instance, error) {
+	listener, err := net.Listen("tcp", b.addr)
+	if err != nil {
+		return nil, err
+	}
+	b.mu.Lock()
+	b.specs = append(b.specs, spec)
+	b.mu.Unlock()
+	server := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/health" {
+			return
+		}
+		w.Header().Set(handler.HeaderResponseFormat, handler.ResponseFormatRaw)
+		b.respond(w, r)
+	})}
+	// Runtimes serving gRPC speak HTTP/2 without TLS
+	server.Protocols = new(http.Protocols)
+	server.Protocols.SetHTTP1(true)
+	server.Protocols.SetUnencryptedHTTP2(true)
+	go server.Serve(listener)
+	return &fakeInstance{server: server, stopped: make(chan struct{})}, nil
+}
+
+// runs returns the specs of the instances run so far.
+func (b *fakeBackend) runs() []kappa.RunSpec {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return append([]kappa.RunSpec(nil), b.specs...)
+}
+
+// fakeInstance serves until it is stopped
+type fakeInstance struct {
+	server  *http.Server
+	stopped chan struct{}
+	once    sync.Once
+}
+
+func (i *fakeInstance) Stop() error {
+	i.once.Do(func() {
+		i.server.Close()
+		close(i.stopped)
+	})
+	return nil
+}
+
+func (i *fakeInstance) Wait(ctx context.Context) (int, error) {
+	select {
+	case <-i.stopped:
+		return 0, nil
+	case <-ctx.Done():
+		return 0, ctx.Err()
+	}
+}
+
+// registerFake registers config as a function the service runs itself, on
+// a fake backend answering its invocations with respond.
+func registerFake(t *testing.T, s *KappaService, config map[string]any, respond http.HandlerFunc) *fakeBackend {
+	t.Helper()
+	binaryPath := filepath.Join(t.TempDir(), "main")
+	require.NoError(t, os.WriteFile(binaryPath, []byte("binary"), 0755))
+	// Nothing listens on the port until an instance is run
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	addr := listener.Addr().(*net.TCPAddr)
+	require.NoError(t, listener.Close())
+
+	config["binaryPath"] = binaryPath
+	config["backend"] = "process"
+	config["port"] = addr.Port
+	register(t, s, config)
+
+	backend := &fakeBackend{addr: addr.String(), respond: respond}
+	fn, _, exists := s.lookup(config["name"].(string))
+	require.True(t, exists)
+	fn.Host = addr.IP.String()
+	fn.SetBackend(backend)
+	return backend
+}
+
+func TestUpdateFunction(t *testing.T) {
+	s := newTestService(t)
+	registerFake(t, s, map[string]any{"name": "orders", "env": []string{"MODE=old"}},
+		func(w http.ResponseWriter, r *http.Request) { w.Write([]byte(`{}`)) })
+	rec := do(t, s, "POST", "/functions/orders", map[string]any{})
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	old, config, _ := s.lookup("orders")
+	require.True(t, old.IsRunning())
+
+	config.Env = []string{"MODE=new"}
+	config.Name = ""
+	rec = do(t, s, "PUT", "/functions/orders", config)
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	body := decode(t, rec)
+	assert.Equal(t, "updated", body["status"])
+	assert.Equal(t, float64(2), body["version"])
+	assert.False(t, old.IsRunning(), "the replaced instance is stopped")
+	fn, _, _ := s.lookup("orders")
+	assert.NotSame(t, old, fn)
+	assert.Contains(t, fn.Environ(), "MODE=new")
+	history, _ := s.versionHistory("orders")
+	assert.Len(t, history, 2, "versions are kept for rollback")
+
+	config.Name = "billing"
+	rec = do(t, s, "PUT", "/functions/orders", config)
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+	rec = do(t, s, "PUT", "/functions/orders", map[string]any{"mode": "sideways"})
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+	rec = do(t, s, "PUT", "/functions/missing", map[string]any{"mode": "external"})
+	assert.Equal(t, http.StatusNotFound, rec.Code)
+}
+
+func TestRegisterFunction_RetryPolicy(t *testing.T) {
+	s := newTestService(t)
+	register(t, s, map[string]any{"name": "orders", "mode": "external", "retry": map[string]any{"maxAttempts": 3, "backoffMs": 500}})
+	assert.Equal(t, 3, s.config("orders").Retry.MaxAttempts)
+
+	for _, retry := range []map[string]any{
+		{"maxAttempts": -1},
+		{"maxAttempts": 1000},
+		{"maxAttempts": 3, "backoffMs": -1},
+		{"maxAttempts": 3, "backoffMs": 3600000},
+	} {
+		rec := doOn(t, s.control, "POST", "/functions", map[string]any{"name": "billing", "mode": "external", "retry": retry})
+		assert.Equal(t, http.StatusBadRequest, rec.Code, retry)
+		assert.Contains(t, rec.Body.String(), "Invalid retry")
+	}
+	_, _, exists := s.lookup("billing")
+	assert.False(t, exists)
+}
@@ -0,0 +1,12 @@
+package main
+
+// runningInstances counts the live instances of every function, for the
+// running containers gauge.
+func (s *KappaService) runningInstances() map[string]int {
+	functions, _ := s.snapshot()
+	running := make(map[string]int, len(functions))
+	for name, fn := range functions {
+		running[name] = len(fn.Footprint().Instances)
+	}
+	return running
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"kappa-v2/pkg/logger"
+	"kappa-v2/service/internal/admission"
+	"kappa-v2/service/internal/kappa"
+	"math/rand/v2"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"go.uber.org/zap"
+)
+
+// MirrorConfig copies a share of a function's invocations to another
+// function, to try a rewrite on production traffic. Mirrored responses are
+// discarded and never affect the caller.
+type MirrorConfig struct {
+	Function string `json:"function"`
+	// Percent of invocations mirrored, above 0 and up to 100
+	Percent float64 `json:"percent"`
+}
+
+// validate checks the mirror target for the function named source.
+func (m MirrorConfig) validate(source string) error {
+	if m.Function == "" {
+		return fmt.Errorf("missing function")
+	}
+	if m.Function == source {
+		return fmt.Errorf("a function can't mirror to itself")
+	}
+	if m.Percent <= 0 || m.Percent > 100 {
+		return fmt.Errorf("percent must be above 0 and up to 100")
+	}
+	return nil
+}
+
+// mirrorStats counts a function's mirrored invocations.
+type mirrorStats struct {
+	mu          sync.Mutex
+	Mirrored    uint64     `json:"mirrored"`
+	Failed      uint64     `json:"failed"`
+	LastError   string     `json:"lastError,omitempty"`
+	LastErrorAt *time.Time `json:"lastErrorAt,omitempty"`
+}
+
+func (m *mirrorStats) record(err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.Mirrored++
+	if err != nil {
+		now := time.Now()
+		m.Failed++
+		m.LastError = err.Error()
+		m.LastErrorAt = &now
+	}
+}
+
+// snapshot copies the stats for encoding.
+func (m *mirrorStats) snapshot() mirrorStats {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return mirrorStats{Mirrored: m.Mirrored, Failed: m.Failed, LastError: m.LastError, LastErrorAt: m.LastErrorAt}
+}
+
+// mirrorStatsFor returns the stats of the named source function.
+func (s *KappaService) mirrorStatsFor(name string) *mirrorStats {
+	s.mirrorsMu.Lock()
+	defer s.mirrorsMu.Unlock()
+	stats, exists := s.mirrors[name]
+	if !exists {
+		stats = &mirrorStats{}
+		s.mirrors[name] = stats
+	}
+	return stats
+}
+
+// maybeMirror sends a copy of the event to the function's mirror target,
+// if it has one and this invocation is in the mirrored share. The copy runs
+// in the background at low priority.
+func (s *KappaService) maybeMirror(name string, event *kappa.EncodedEvent) {
+	mirror := s.config(name).Mirror
+	if mirror == nil || rand.Float64()*100 >= mirror.Percent {
+		return
+	}
+	target, _, exists := s.lookup(mirror.Function)
+	stats := s.mirrorStatsFor(name)
+	if !exists {
+		stats.record(fmt.Errorf("function not found: %s", mirror.Function))
+		return
+	}
+
+	event = event.WithHeader("X-Kappa-Mirror-Of", name)
+	go func() {
+		err := s.invokeMirror(target, event)
+		stats.record(err)
+		if err != nil {
+			logger.Get().Warn("Mirrored invocation failed",
+				zap.String("name", name),
+				zap.String("mirror", mirror.Function),
+				zap.Error(err))
+		}
+	}()
+}
+
+// invokeMirror invokes target with a mirrored event, detached from the
+// caller's request.
+func (s *KappaService) invokeMirror(target *kappa.KappaFunction, event *kappa.EncodedEvent) error {
+	ctx, cancel := context.WithTimeout(context.Background(), target.Timeout())
+	defer cancel()
+
+	if err := s.admission.Acquire(ctx, admission.Low); err != nil {
+		return err
+	}
+	defer s.admission.Release()
+
+	resp, err := target.InvokeEncoded(ctx, event)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode >= 500 {
+		return fmt.Errorf("function returned status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// HTTP handler for a function's mirror config and what happened to the
+// invocations it mirrored
+func (s *KappaService) getFunctionMirror(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	name := vars["name"]
+
+	if _, _, exists := s.lookup(name); !exists {
+		http.Error(w, fmt.Sprintf("Function not found: %s", name), http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{
+		"name":   name,
+		"mirror": s.config(name).Mirror,
+		"stats":  s.mirrorStatsFor(name).snapshot(),
+	})
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// mirrorCounts are the counts of a function's mirror stats.
+type mirrorCounts struct {
+	Mirrored  uint64 `json:"mirrored"`
+	Failed    uint64 `json:"failed"`
+	LastError string `json:"lastError"`
+}
+
+// mirrorStatsOf fetches a function's mirror stats.
+func mirrorStatsOf(t *testing.T, s *KappaService, name string) mirrorCounts {
+	t.Helper()
+	rec := do(t, s, "GET", "/functions/"+name+"/mirror", nil)
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	var body struct {
+		Stats mirrorCounts `json:"stats"`
+	}
+	require.NoError(t, decodeInto(rec, &body))
+	return body.Stats
+}
+
+func TestMirror(t *testing.T) {
+	s := newTestService(t)
+	mirrored := make(chan string, 1)
+	attachRuntime(t, s, "orders-v2", func(w http.ResponseWriter, r *http.Request) {
+		var event struct {
+			Headers map[string]string `json:"headers"`
+		}
+		json.NewDecoder(r.Body).Decode(&event)
+		mirrored <- event.Headers["X-Kappa-Mirror-Of"]
+		w.Write([]byte(`{"from":"orders-v2"}`))
+	})
+	register(t, s, map[string]any{"name": "orders", "mode": "external", "mirror": map[string]any{"function": "orders-v2", "percent": 100}})
+	attachRuntime(t, s, "orders", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"from":"orders"}`))
+	})
+
+	// The caller gets the source's response, the mirror's is discarded
+	rec := do(t, s, "POST", "/functions/orders", map[string]any{})
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	assert.JSONEq(t, `{"from":"orders"}`, rec.Body.String())
+	select {
+	case source := <-mirrored:
+		assert.Equal(t, "orders", source)
+	case <-time.After(5 * time.Second):
+		t.Fatal("invocation not mirrored")
+	}
+	require.Eventually(t, func() bool { return mirrorStatsOf(t, s, "orders").Mirrored == 1 }, 5*time.Second, 10*time.Millisecond)
+	assert.Zero(t, mirrorStatsOf(t, s, "orders").Failed)
+
+	rec = do(t, s, "GET", "/functions/orders/mirror", nil)
+	assert.Equal(t, map[string]any{"function": "orders-v2", "percent": 100.0}, decode(t, rec)["mirror"])
+}
+
+func TestMirror_Failures(t *testing.T) {
+	s := newTestService(t)
+	register(t, s, map[string]any{"name": "orders-v2", "mode": "external"})
+	register(t, s, map[string]any{"name": "orders", "mode": "external", "mirror": map[string]any{"function": "orders-v2", "percent": 100}})
+	attachRuntime(t, s, "orders", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{}`))
+	})
+	rec := do(t, s, "DELETE", "/functions/orders-v2", nil)
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+
+	// A mirror failing doesn't fail the caller, it's counted
+	rec = do(t, s, "POST", "/functions/orders", map[string]any{})
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	stats := mirrorStatsOf(t, s, "orders")
+	assert.Equal(t, uint64(1), stats.Failed)
+	assert.Equal(t, "function not found: orders-v2", stats.LastError)
+
+	rec = do(t, s, "GET", "/functions/missing/mirror", nil)
+	assert.Equal(t, http.StatusNotFound, rec.Code)
+	for _, mirror := range []map[string]any{
+		{"function": "billing", "percent": 100},
+		{"function": "missing", "percent": 100},
+		{"function": "orders-v2", "percent": 0},
+		{"percent": 50},
+	} {
+		rec = do(t, s, "POST", "/functions", map[string]any{"name": "billing", "mode": "external", "mirror": mirror})
+		assert.Equal(t, http.StatusBadRequest, rec.Code, mirror)
+	}
+}
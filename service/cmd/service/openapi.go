@@ -0,0 +1,13 @@
+package main
+
+import (
+	"kappa-v2/pkg/client"
+	"net/http"
+)
+
+// HTTP handler for the API's OpenAPI document, which pkg/client follows.
+// It is public, like the document describing how to authenticate.
+func getOpenAPI(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(client.OpenAPI)
+}
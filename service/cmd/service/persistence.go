@@ -0,0 +1,209 @@
+package main
+
+import (
+	"encoding/json"
+	"kappa-v2/pkg/logger"
+	"kappa-v2/service/internal/audit"
+	"kappa-v2/service/internal/repository"
+	"kappa-v2/service/internal/scheduler"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// auditPruneInterval is how often audit events past their retention are
+// dropped from the database
+const auditPruneInterval = time.Hour
+
+// saveSchedule stores a schedule in the database, when there is one, so it
+// is back after a restart. Those kept by triggers are left out, registering
+// their functions adds them again.
+func (s *KappaService) saveSchedule(schedule scheduler.Schedule) {
+	if s.postgres == nil || strings.HasPrefix(schedule.ID, triggerSchedulePrefix) {
+		return
+	}
+	spec, err := json.Marshal(schedule)
+	if err != nil {
+		logger.Get().Error("Failed to encode schedule", zap.String("id", schedule.ID), zap.Error(err))
+		return
+	}
+	err = s.postgres.SaveSchedule(repository.Schedule{
+		ID:        schedule.ID,
+		Function:  schedule.Function,
+		Spec:      spec,
+		UpdatedAt: time.Now(),
+	})
+	if err != nil {
+		logger.Get().Error("Failed to store schedule", zap.String("id", schedule.ID), zap.Error(err))
+	}
+}
+
+// forgetSchedule deletes a schedule from the database, when there is one.
+func (s *KappaService) forgetSchedule(id string) {
+	if s.postgres == nil {
+		return
+	}
+	if err := s.postgres.DeleteSchedule(id); err != nil {
+		logger.Get().Error("Failed to delete stored schedule", zap.String("id", id), zap.Error(err))
+	}
+}
+
+// restoreSchedules adds the schedules stored in the database back to the
+// scheduler.
+func (s *KappaService) restoreSchedules() {
+	if s.postgres == nil {
+		return
+	}
+	stored, err := s.postgres.ListSchedules()
+	if err != nil {
+		logger.Get().Error("Failed to list stored schedules", zap.Error(err))
+		return
+	}
+	for _, row := range stored {
+		var schedule scheduler.Schedule
+		if err := json.Unmarshal(row.Spec, &schedule); err != nil {
+			logger.Get().Error("Failed to decode stored schedule", zap.String("id", row.ID), zap.Error(err))
+			continue
+		}
+		if err := s.scheduler.Put(schedule); err != nil {
+			logger.Get().Error("Failed to restore schedule", zap.String("id", row.ID), zap.Error(err))
+		}
+	}
+	if len(stored) > 0 {
+		logger.Get().Info("Restored schedules", zap.Int("count", len(stored)))
+	}
+}
+
+// storeAuditEntry keeps an audit entry in the database, past the ones the
+// audit log keeps in memory.
+func (s *KappaService) storeAuditEntry(e audit.Entry) {
+	var detail json.RawMessage
+	if e.Detail != nil {
+		var err error
+		if detail, err = json.Marshal(e.Detail); err != nil {
+			logger.Get().Error("Failed to encode audit entry", zap.String("action", e.Action), zap.Error(err))
+			return
+		}
+	}
+	err := s.postgres.RecordAudit(repository.AuditEvent{
+		Time:     e.Time,
+		Actor:    e.Actor,
+		Action:   e.Action,
+		Function: e.Function,
+		Project:  e.Project,
+		Detail:   detail,
+	})
+	if err != nil {
+		logger.Get().Error("Failed to store audit entry", zap.String("action", e.Action), zap.Error(err))
+	}
+}
+
+// storedAudit lists the audit entries of function, or of every function
+// when empty, from the database, newest first.
+func (s *KappaService) storedAudit(function string) ([]audit.Entry, error) {
+	events, err := s.postgres.ListAudit(function, audit.DefaultSize)
+	if err != nil {
+		return nil, err
+	}
+	entries := make([]audit.Entry, len(events))
+	for i, e := range events {
+		entries[i] = audit.Entry{Time: e.Time, Actor: e.Actor, Action: e.Action, Function: e.Function, Project: e.Project}
+		if len(e.Detail) > 0 && string(e.Detail) != "{}" {
+			json.Unmarshal(e.Detail, &entries[i].Detail)
+		}
+	}
+	return entries, nil
+}
+
+// saveVersion stores a function's current version in the database, when
+// there is one, and drops the stored versions no longer kept.
+func (s *KappaService) saveVersion(name string) {
+	if s.postgres == nil {
+		return
+	}
+	history, exists := s.versionHistory(name)
+	if !exists {
+		return
+	}
+	v := history[len(history)-1]
+	config, err := json.Marshal(v.Config)
+	if err != nil {
+		logger.Get().Error("Failed to encode version", zap.String("name", name), zap.Int("version", v.Version), zap.Error(err))
+		return
+	}
+	err = s.postgres.SaveVersion(repository.Version{
+		Function:       name,
+		Version:        v.Version,
+		Config:         config,
+		Digest:         v.Digest,
+		DeployedAt:     v.DeployedAt,
+		RolledBackFrom: v.RolledBackFrom,
+	})
+	if err == nil {
+		err = s.postgres.PruneVersions(name, history[0].Version)
+	}
+	if err != nil {
+		logger.Get().Error("Failed to store version", zap.String("name", name), zap.Int("version", v.Version), zap.Error(err))
+	}
+}
+
+// forgetVersions deletes a function's versions from the database, when
+// there is one.
+func (s *KappaService) forgetVersions(name string) {
+	if s.postgres == nil {
+		return
+	}
+	if err := s.postgres.DeleteVersions(name); err != nil {
+		logger.Get().Error("Failed to delete stored versions", zap.String("name", name), zap.Error(err))
+	}
+}
+
+// storedVersions lists a function's versions stored in the database,
+// oldest first, none without one.
+func (s *KappaService) storedVersions(name string) []functionVersion {
+	if s.postgres == nil {
+		return nil
+	}
+	stored, err := s.postgres.ListVersions(name)
+	if err != nil {
+		logger.Get().Error("Failed to list stored versions", zap.String("name", name), zap.Error(err))
+		return nil
+	}
+	versions := make([]functionVersion, 0, len(stored))
+	for _, row := range stored {
+		v := functionVersion{
+			Version:        row.Version,
+			Digest:         row.Digest,
+			DeployedAt:     row.DeployedAt,
+			RolledBackFrom: row.RolledBackFrom,
+		}
+		if err := json.Unmarshal(row.Config, &v.Config); err != nil {
+			logger.Get().Error("Failed to decode stored version", zap.String("name", name), zap.Int("version", row.Version), zap.Error(err))
+			continue
+		}
+		versions = append(versions, v)
+	}
+	return versions
+}
+
+// pruneAuditEvery drops the audit events in the database older than
+// retention on an interval.
+func (s *KappaService) pruneAuditEvery(retention, interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case now := <-ticker.C:
+			pruned, err := s.postgres.PruneAudit(now.Add(-retention))
+			if err != nil {
+				logger.Get().Warn("Failed to prune audit events", zap.Error(err))
+			}
+			if pruned > 0 {
+				logger.Get().Info("Pruned audit events", zap.Int64("count", pruned))
+			}
+		}
+	}
+}
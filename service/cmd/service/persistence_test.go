@@ -0,0 +1,64 @@
+package main
+
+import (
+	"net/http"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// TestVersions_Postgres runs against the Postgres at
+// KAPPA_TEST_DATABASE_URL, which the service migrates.
+func TestVersions_Postgres(t *testing.T) {
+	url := os.Getenv("KAPPA_TEST_DATABASE_URL")
+	if url == "" {
+		t.Skip("KAPPA_TEST_DATABASE_URL is not set")
+	}
+	t.Setenv("KAPPA_DATABASE_URL", url)
+	t.Setenv("KAPPA_KEPT_VERSIONS", "2")
+	dir := t.TempDir()
+	s := newTestServiceIn(t, dir)
+	// Left from an earlier run
+	do(t, s, "DELETE", "/functions/versioned", nil)
+	s.forgetVersions("versioned")
+
+	for i := 0; i < 4; i++ {
+		register(t, s, map[string]any{"name": "versioned", "mode": "external", "timeoutMs": 1000 * (i + 1)})
+	}
+	rec := do(t, s, "POST", "/functions/versioned/rollback", map[string]any{"version": 3})
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	before, _ := s.versionHistory("versioned")
+	require.Len(t, before, 3, "two versions are kept before the current one")
+	assert.Equal(t, []int{3, 4, 5}, versionNumbers(before))
+
+	// The history is back after a restart, the rollback included
+	stopTestService(s)
+	s = newTestServiceIn(t, dir)
+	after, exists := s.versionHistory("versioned")
+	require.True(t, exists)
+	assert.Equal(t, []int{3, 4, 5}, versionNumbers(after))
+	assert.Equal(t, 4, after[2].RolledBackFrom)
+	require.NotNil(t, after[2].Config.TimeoutMs)
+	assert.Equal(t, 3000, *after[2].Config.TimeoutMs)
+
+	// Registering again carries on from the restored history
+	register(t, s, map[string]any{"name": "versioned", "mode": "external"})
+	after, _ = s.versionHistory("versioned")
+	assert.Equal(t, []int{4, 5, 6}, versionNumbers(after))
+	stored := s.storedVersions("versioned")
+	assert.Equal(t, []int{4, 5, 6}, versionNumbers(stored), "versions no longer kept are pruned")
+
+	rec = do(t, s, "DELETE", "/functions/versioned", nil)
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	assert.Empty(t, s.storedVersions("versioned"))
+}
+
+func versionNumbers(history []functionVersion) []int {
+	numbers := make([]int, len(history))
+	for i, v := range history {
+		numbers[i] = v.Version
+	}
+	return numbers
+}
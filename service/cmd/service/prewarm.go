@@ -0,0 +1,89 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"kappa-v2/pkg/logger"
+	"kappa-v2/service/internal/kappa"
+	"kappa-v2/service/internal/prewarm"
+	"kappa-v2/service/internal/runtimes"
+	"net/http"
+
+	"go.uber.org/zap"
+)
+
+// prewarmRequest replaces the images warmed on top of the runtime images
+type prewarmRequest struct {
+	Images []string `json:"images"`
+}
+
+// HTTP handler for pulling and unpacking the runtime images in the
+// background, so functions don't wait on a pull to start
+func (s *KappaService) startPrewarm(w http.ResponseWriter, r *http.Request) {
+	if s.prewarm == nil {
+		http.Error(w, "Pre-warming needs the containerd backend", http.StatusNotImplemented)
+		return
+	}
+	req := prewarmRequest{Images: prewarm.ExtraFromEnv()}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil && !errors.Is(err, io.EOF) {
+		http.Error(w, fmt.Sprintf("Invalid request: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	if !s.prewarm.Start(prewarm.Images(s.runtimes, req.Images)) {
+		http.Error(w, "Pre-warming is already running", http.StatusConflict)
+		return
+	}
+	logger.FromCtx(r.Context()).Info("Pre-warming images")
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(s.prewarm.Status())
+}
+
+// HTTP handler for the state of the running or last pre-warm
+func (s *KappaService) getPrewarm(w http.ResponseWriter, r *http.Request) {
+	if s.prewarm == nil {
+		http.Error(w, "Pre-warming needs the containerd backend", http.StatusNotImplemented)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(s.prewarm.Status())
+}
+
+// runPrewarm is the prewarm command, warming the images of the runtime
+// matrix for install scripts without starting the service. It returns the
+// exit code, failing when any image couldn't be warmed.
+func runPrewarm() int {
+	l := logger.Get()
+	matrix, err := runtimes.MatrixFromEnv()
+	if err != nil {
+		l.Error("Failed to load runtime matrix", zap.Error(err))
+		return 1
+	}
+	backend, err := kappa.BackendByName("containerd")
+	if err != nil {
+		l.Error("Pre-warming needs the containerd backend", zap.Error(err))
+		return 1
+	}
+	puller, ok := backend.(kappa.ImagePuller)
+	if !ok {
+		l.Error("Pre-warming needs the containerd backend")
+		return 1
+	}
+
+	report, _ := prewarm.NewWarmer(puller, prewarm.DefaultTimeout).Run(context.Background(), prewarm.Images(matrix, prewarm.ExtraFromEnv()))
+	code := 0
+	for _, img := range report.Images {
+		if img.State == prewarm.StateFailed {
+			l.Error("Failed to warm image", zap.String("image", img.Ref), zap.String("error", img.Error))
+			code = 1
+			continue
+		}
+		l.Info("Image warm", zap.String("image", img.Ref), zap.Bool("pulled", img.Pulled))
+	}
+	return code
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"kappa-v2/pkg/logger"
+	"kappa-v2/service/internal/errtrack"
+	"kappa-v2/service/internal/kappa"
+	"kappa-v2/service/internal/rbac"
+	"kappa-v2/service/internal/settings"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/gorilla/mux"
+	"go.uber.org/zap"
+)
+
+// Project groups functions that share defaults.
+type Project struct {
+	Name     string            `json:"name"`
+	Defaults settings.Settings `json:"defaults"`
+	// ErrorTrackerDSN is the DSN of a Sentry compatible error tracker the
+	// panics and failed invocations of the project's functions are
+	// reported to
+	ErrorTrackerDSN string `json:"errorTrackerDsn,omitempty"`
+	// Locked blocks changes to the project and its functions, only set
+	// through the lock and unlock endpoints
+	Locked bool `json:"locked"`
+}
+
+// masked is the project as the API shows it, the values of its secret env
+// entries masked.
+func (p Project) masked() Project {
+	p.Defaults = p.Defaults.Masked(p.Defaults.SecretEnv)
+	return p
+}
+
+// effectiveSettings resolves a function's settings through the service,
+// project and function levels, and its environment's overrides.
+func (s *KappaService) effectiveSettings(config KappaFunctionConfig) settings.Effective {
+	layers := []settings.Layer{{Source: settings.SourceService, Settings: s.defaults}}
+	if project, exists := s.project(config.Project); exists {
+		layers = append(layers, settings.Layer{Source: settings.SourceProject, Settings: project.Defaults})
+	}
+	layers = append(layers, settings.Layer{Source: settings.SourceFunction, Settings: config.Settings})
+	if environment, exists := s.environment(config.Environment); exists {
+		layers = append(layers, settings.Layer{Source: settings.SourceEnvironment, Settings: environment.Overrides})
+	}
+	return settings.Resolve(layers...)
+}
+
+// applySettings configures fn with its effective settings, env and memory
+// take effect on the next start.
+func applySettings(fn *kappa.KappaFunction, effective settings.Effective) {
+	fn.SetEnv(effective.EnvList())
+	fn.SetTimeout(time.Duration(effective.TimeoutMs.Value) * time.Millisecond)
+	fn.SetMemoryLimit(effective.MemoryMB.Value)
+	idleTimeout := time.Duration(effective.IdleTimeoutMs.Value) * time.Millisecond
+	// Clients of tcp functions hold connections and reconnect, so they idle
+	// for longer unless told otherwise
+	if fn.Mode() == kappa.ModeTCP && effective.IdleTimeoutMs.Source == settings.SourceBuiltin {
+		idleTimeout = defaultTCPIdleTimeout
+	}
+	fn.SetIdleTimeout(idleTimeout)
+	fn.SetLogRetention(effective.LogRetention.Value)
+}
+
+// HTTP handler for listing projects
+func (s *KappaService) listProjects(w http.ResponseWriter, r *http.Request) {
+	s.mu.RLock()
+	all := make([]Project, 0, len(s.projects))
+	for _, project := range s.projects {
+		all = append(all, *project)
+	}
+	s.mu.RUnlock()
+
+	projects := make([]Project, 0, len(all))
+	for _, project := range all {
+		if !s.allowed(r.Context(), rbac.Read, project.Name) {
+			continue
+		}
+		projects = append(projects, project.masked())
+	}
+	sort.Slice(projects, func(i, j int) bool { return projects[i].Name < projects[j].Name })
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{
+		"projects": projects,
+	})
+}
+
+// HTTP handler for getting a project
+func (s *KappaService) getProject(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	name := vars["name"]
+
+	project, exists := s.project(name)
+	if !exists {
+		http.Error(w, fmt.Sprintf("Project not found: %s", name), http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(project.masked())
+}
+
+// HTTP handler for creating a project or replacing its defaults, which are
+// applied to the project's functions straight away
+func (s *KappaService) putProject(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	name := vars["name"]
+
+	var project Project
+	if err := json.NewDecoder(r.Body).Decode(&project); err != nil {
+		http.Error(w, fmt.Sprintf("Invalid request: %v", err), http.StatusBadRequest)
+		return
+	}
+	project.Name = name
+	if existing, exists := s.project(name); exists {
+		project.Defaults = project.Defaults.Unmasked(existing.Defaults)
+	}
+	if err := project.Defaults.Validate(); err != nil {
+		http.Error(w, fmt.Sprintf("Invalid defaults: %v", err), http.StatusBadRequest)
+		return
+	}
+	if err := s.envRefs.Validate(project.Defaults.Env); err != nil {
+		http.Error(w, fmt.Sprintf("Invalid env: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	var dsn *errtrack.DSN
+	if project.ErrorTrackerDSN != "" {
+		var err error
+		if dsn, err = errtrack.ParseDSN(project.ErrorTrackerDSN); err != nil {
+			http.Error(w, fmt.Sprintf("Invalid errorTrackerDsn: %v", err), http.StatusBadRequest)
+			return
+		}
+	}
+
+	s.mu.Lock()
+	existing, existed := s.projects[name]
+	if existed && existing.Locked {
+		s.mu.Unlock()
+		http.Error(w, fmt.Sprintf("Project is locked: %s", name), http.StatusLocked)
+		return
+	}
+	project.Locked = false
+	s.projects[name] = &project
+	s.mu.Unlock()
+	s.persistResource(resourceProject, name, project)
+	s.errorTracker.SetDSN(name, dsn)
+
+	functions, configs := s.snapshot()
+	for fnName, config := range configs {
+		if config.Project == name {
+			applySettings(functions[fnName], s.effectiveSettings(config))
+		}
+	}
+
+	logger.FromCtx(r.Context()).Info("Project saved", zap.String("name", name))
+
+	status := http.StatusOK
+	if !existed {
+		status = http.StatusCreated
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(project.masked())
+}
+
+// HTTP handler for inspecting a function's configuration, showing the
+// effective value of each setting and where it was set
+func (s *KappaService) inspectFunction(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	name := vars["name"]
+
+	fn, config, exists := s.lookup(name)
+	if !exists {
+		http.Error(w, fmt.Sprintf("Function not found: %s", name), http.StatusNotFound)
+		return
+	}
+
+	info := map[string]any{
+		"name":       name,
+		"project":    config.Project,
+		"isRunning":  fn.IsRunning(),
+		"locked":     s.lockReason(name, config.Project) != "",
+		"sha256":     fn.ArtifactDigest,
+		"runtime":    config.Runtime,
+		"settings":   s.effectiveSettings(config).Masked(),
+		"start":      fn.StartStatus(),
+		"visibility": s.visibility(name),
+	}
+	if concurrency, limited := fn.Concurrency(); limited {
+		info["concurrency"] = concurrency
+	}
+	if window, disabled := fn.DisabledAt(time.Now()); disabled {
+		info["disabled"] = window
+	}
+	if fn.IsRunning() || config.Clock != nil {
+		info["clock"] = clockInfo(r.Context(), fn, config.Clock)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(info)
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"kappa-v2/service/internal/ratelimit"
+	"kappa-v2/service/internal/rbac"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// redisRateLimitPrefix starts the keys of the token buckets kept in Redis
+const redisRateLimitPrefix = "kappa:ratelimit:"
+
+// RateLimitConfig limits how fast a function is invoked. PerSecond and
+// Burst bound every caller together, unlimited when PerSecond is 0, and
+// PerCaller bounds each caller on its own, in place of the service's
+// default.
+type RateLimitConfig struct {
+	PerSecond float64          `json:"perSecond,omitempty"`
+	Burst     int              `json:"burst,omitempty"`
+	PerCaller *ratelimit.Limit `json:"perCaller,omitempty"`
+}
+
+func validateRateLimit(c *RateLimitConfig) error {
+	if c == nil {
+		return nil
+	}
+	if c.PerSecond != 0 || c.Burst != 0 {
+		if err := (ratelimit.Limit{PerSecond: c.PerSecond, Burst: c.Burst}).Validate(); err != nil {
+			return err
+		}
+	}
+	if c.PerCaller != nil {
+		if err := c.PerCaller.Validate(); err != nil {
+			return fmt.Errorf("perCaller: %w", err)
+		}
+	}
+	return nil
+}
+
+// callerIdentity is who a rate limit is kept for, the authenticated
+// subject, or the client's address for anonymous callers.
+func callerIdentity(ctx context.Context, remoteAddr string) string {
+	if subject, ok := ctx.Value(subjectKey{}).(rbac.Subject); ok {
+		return "subject:" + subject.Name
+	}
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		host = remoteAddr
+	}
+	return "ip:" + host
+}
+
+// takeRate takes a token for an invocation of the named function by
+// caller, reporting whether one was left and, when not, how long until
+// there will be. The caller's own limit goes first, so a caller over it
+// doesn't use up the function's.
+func (s *KappaService) takeRate(name, caller string) (bool, time.Duration) {
+	config := s.config(name).RateLimit
+	perCaller := s.callerRateLimit
+	if config != nil && config.PerCaller != nil {
+		perCaller = config.PerCaller
+	}
+	if perCaller != nil {
+		if ok, wait := s.rateLimits.Take(name+"\x00"+caller, *perCaller); !ok {
+			return false, wait
+		}
+	}
+	if config != nil && config.PerSecond > 0 {
+		return s.rateLimits.Take(name, ratelimit.Limit{PerSecond: config.PerSecond, Burst: config.Burst})
+	}
+	return true, 0
+}
+
+// rateLimited turns requests over the named function's rate limits away
+// with 429 and a Retry-After hint. Every request takes a token, batches
+// included.
+func (s *KappaService) rateLimited(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		name := mux.Vars(r)["name"]
+		if _, _, exists := s.lookup(name); exists {
+			if ok, wait := s.takeRate(name, callerIdentity(r.Context(), r.RemoteAddr)); !ok {
+				w.Header().Set("Retry-After", strconv.Itoa(max(int(math.Ceil(wait.Seconds())), 1)))
+				s.invocationError(w, name, errorRateLimited, "Rate limit exceeded, retry later", http.StatusTooManyRequests)
+				return
+			}
+		}
+		next(w, r)
+	}
+}
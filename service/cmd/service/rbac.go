@@ -0,0 +1,261 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"kappa-v2/pkg/logger"
+	"kappa-v2/service/internal/rbac"
+	"net/http"
+	"strings"
+
+	"github.com/gorilla/mux"
+	"go.uber.org/zap"
+)
+
+type subjectKey struct{}
+
+// adminSubject is who the admin token authenticates
+var adminSubject = rbac.Subject{
+	Name:     "admin",
+	Bindings: []rbac.Binding{{Role: rbac.Admin, Project: rbac.AllProjects}},
+}
+
+// authenticate returns the subject the request authenticates as: the admin
+// token or a function's caller token as a bearer token, the credentials of
+// a configured auth provider or, with RBAC enabled, a subject's key.
+func (s *KappaService) authenticate(r *http.Request) (rbac.Subject, bool) {
+	token, hasToken := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	hasToken = hasToken && token != ""
+	if hasToken && s.adminToken != "" && subtle.ConstantTimeCompare([]byte(token), []byte(s.adminToken)) == 1 {
+		return adminSubject, true
+	}
+	// Functions invoking others through the service
+	if hasToken && strings.HasPrefix(token, callerTokenPrefix) {
+		if name, ok := s.callers.verify(token); ok {
+			if _, _, exists := s.lookup(name); exists {
+				return callerSubject(name), true
+			}
+		}
+		return rbac.Subject{}, false
+	}
+	if s.authn != nil {
+		if subject, ok := s.authn.Authenticate(r); ok {
+			return subject, true
+		}
+	}
+	if !hasToken || s.roles == nil {
+		return rbac.Subject{}, false
+	}
+	return s.roles.Authenticate(token)
+}
+
+// authRequired reports whether every route needs credentials, with RBAC
+// enabled or an auth provider configured.
+func (s *KappaService) authRequired() bool {
+	return s.roles != nil || s.authn != nil
+}
+
+// authorize wraps a handler when auth is required, so it is only called by
+// subjects with p in the project the request is about. With a nil project
+// p is needed in any project, and the handler checks the projects involved
+// itself with allowed.
+func (s *KappaService) authorize(p rbac.Permission, project func(*http.Request) string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !s.authRequired() {
+			next(w, r)
+			return
+		}
+		subject, ok := s.authenticate(r)
+		if !ok {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		if project == nil {
+			if !subject.AllowedAnywhere(p) {
+				http.Error(w, fmt.Sprintf("Forbidden: %s may not %s", subject.Name, p), http.StatusForbidden)
+				return
+			}
+		} else if name := project(r); !subject.Allowed(p, name) {
+			http.Error(w, fmt.Sprintf("Forbidden: %s may not %s in %s", subject.Name, p, projectLabel(name)), http.StatusForbidden)
+			return
+		}
+		// The key is the service's, functions don't get to see it
+		r.Header.Del("Authorization")
+		next(w, r.WithContext(context.WithValue(r.Context(), subjectKey{}, subject)))
+	}
+}
+
+// allowed reports whether the request's subject has p in every one of
+// projects. It is always true when auth isn't required.
+func (s *KappaService) allowed(ctx context.Context, p rbac.Permission, projects ...string) bool {
+	if !s.authRequired() {
+		return true
+	}
+	subject, ok := ctx.Value(subjectKey{}).(rbac.Subject)
+	if !ok {
+		return false
+	}
+	for _, project := range projects {
+		if !subject.Allowed(p, project) {
+			return false
+		}
+	}
+	return true
+}
+
+// actor is the name of the request's subject, empty when auth isn't
+// required.
+func actor(ctx context.Context) string {
+	subject, _ := ctx.Value(subjectKey{}).(rbac.Subject)
+	return subject.Name
+}
+
+// deployTargets are the projects registering a function touches, the one
+// it is registered in and the one it is moving from
+func (s *KappaService) deployTargets(name, project string) []string {
+	projects := []string{project}
+	if _, existing, exists := s.lookup(name); exists {
+		projects = append(projects, existing.Project)
+	}
+	return projects
+}
+
+func projectLabel(project string) string {
+	if project == "" {
+		return "functions outside any project"
+	}
+	return "project " + project
+}
+
+// functionProject is the project of the function a request is about
+func (s *KappaService) functionProject(r *http.Request) string {
+	return s.config(mux.Vars(r)["name"]).Project
+}
+
+// namedProject is the project a request is about
+func namedProject(r *http.Request) string {
+	return mux.Vars(r)["name"]
+}
+
+// scheduleProject is the project of the function a schedule invokes
+func (s *KappaService) scheduleProject(r *http.Request) string {
+	schedule, err := s.scheduler.Get(mux.Vars(r)["id"])
+	if err != nil {
+		return ""
+	}
+	return s.config(schedule.Function).Project
+}
+
+// rolesAPI wraps the handlers managing subjects, which need RBAC enabled
+func (s *KappaService) rolesAPI(next http.HandlerFunc) http.HandlerFunc {
+	return s.adminOnly(func(w http.ResponseWriter, r *http.Request) {
+		if s.roles == nil {
+			http.Error(w, "RBAC is disabled, set KAPPA_RBAC=true to enable it", http.StatusForbidden)
+			return
+		}
+		next(w, r)
+	})
+}
+
+// HTTP handler for listing the roles and their permissions
+func (s *KappaService) listRoles(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{
+		"roles":   rbac.Roles,
+		"enabled": s.roles != nil,
+	})
+}
+
+// HTTP handler for listing the subjects and their bindings
+func (s *KappaService) listSubjects(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{
+		"subjects": s.roles.List(),
+	})
+}
+
+// HTTP handler for getting a subject
+func (s *KappaService) getSubject(w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["name"]
+	subject, exists := s.roles.Get(name)
+	if !exists {
+		http.Error(w, fmt.Sprintf("Subject not found: %s", name), http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(subject)
+}
+
+// HTTP handler for creating a subject or replacing its bindings. New
+// subjects get a key, returned only in this response.
+func (s *KappaService) putSubject(w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["name"]
+
+	var req struct {
+		Bindings []rbac.Binding `json:"bindings"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, fmt.Sprintf("Invalid request: %v", err), http.StatusBadRequest)
+		return
+	}
+	key, err := s.roles.Put(name, req.Bindings)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Invalid subject: %v", err), http.StatusBadRequest)
+		return
+	}
+	subject, _ := s.roles.Get(name)
+	logger.FromCtx(r.Context()).Info("Subject saved", zap.String("subject", name), zap.Any("bindings", subject.Bindings))
+
+	w.Header().Set("Content-Type", "application/json")
+	if key == "" {
+		json.NewEncoder(w).Encode(subject)
+		return
+	}
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(map[string]any{
+		"name":      subject.Name,
+		"bindings":  subject.Bindings,
+		"createdAt": subject.CreatedAt,
+		"key":       key,
+	})
+}
+
+// HTTP handler for deleting a subject, revoking its key
+func (s *KappaService) deleteSubject(w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["name"]
+	if !s.roles.Delete(name) {
+		http.Error(w, fmt.Sprintf("Subject not found: %s", name), http.StatusNotFound)
+		return
+	}
+	logger.FromCtx(r.Context()).Info("Subject deleted", zap.String("subject", name))
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{
+		"name":   name,
+		"status": "deleted",
+	})
+}
+
+// HTTP handler for replacing a subject's key
+func (s *KappaService) rotateSubjectKey(w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["name"]
+	if _, exists := s.roles.Get(name); !exists {
+		http.Error(w, fmt.Sprintf("Subject not found: %s", name), http.StatusNotFound)
+		return
+	}
+	key, err := s.roles.RotateKey(name)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to rotate key: %v", err), http.StatusInternalServerError)
+		return
+	}
+	logger.FromCtx(r.Context()).Info("Subject key rotated", zap.String("subject", name))
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{
+		"name": name,
+		"key":  key,
+	})
+}
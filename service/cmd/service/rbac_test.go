@@ -0,0 +1,115 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const testAdminToken = "test-admin-token"
+
+// newRBACService creates a service with RBAC enabled, the functions orders
+// and site in project shop and billing in project ledger, and subjects
+// bound to each role in shop. It returns the subjects' keys by role.
+func newRBACService(t *testing.T) (*KappaService, map[string]string) {
+	t.Helper()
+	t.Setenv("KAPPA_RBAC", "true")
+	t.Setenv("KAPPA_ADMIN_TOKEN", testAdminToken)
+	s := newTestService(t)
+	admin := []string{"Authorization", "Bearer " + testAdminToken}
+
+	for _, project := range []string{"shop", "ledger"} {
+		rec := do(t, s, "PUT", "/projects/"+project, map[string]any{}, admin...)
+		require.Equal(t, http.StatusCreated, rec.Code, rec.Body.String())
+	}
+	for _, config := range []map[string]any{
+		{"name": "orders", "mode": "external", "project": "shop"},
+		{"name": "site", "mode": "external", "project": "shop", "visibility": "public"},
+		{"name": "billing", "mode": "external", "project": "ledger"},
+	} {
+		rec := do(t, s, "POST", "/functions", config, admin...)
+		require.Equal(t, http.StatusCreated, rec.Code, rec.Body.String())
+		attachRuntime(t, s, config["name"].(string), func(w http.ResponseWriter, r *http.Request) { w.Write([]byte(`{}`)) })
+	}
+
+	keys := map[string]string{}
+	for _, role := range []string{"viewer", "invoker", "deployer"} {
+		rec := do(t, s, "PUT", "/roles/subjects/"+role, map[string]any{
+			"bindings": []map[string]string{{"role": role, "project": "shop"}},
+		}, admin...)
+		require.Equal(t, http.StatusCreated, rec.Code, rec.Body.String())
+		keys[role] = decode(t, rec)["key"].(string)
+	}
+	keys["admin"] = testAdminToken
+	return s, keys
+}
+
+func TestAuthorize(t *testing.T) {
+	s, keys := newRBACService(t)
+
+	tests := []struct {
+		name   string
+		as     string
+		method string
+		path   string
+		body   any
+		want   int
+	}{
+		{"no token", "", "GET", "/functions/orders", nil, http.StatusUnauthorized},
+		{"unknown token", "not-a-key", "GET", "/functions/orders", nil, http.StatusUnauthorized},
+		{"read in project", "viewer", "GET", "/functions/orders", nil, http.StatusOK},
+		{"read in another project", "viewer", "GET", "/functions/billing", nil, http.StatusForbidden},
+		{"invoke without invoke", "viewer", "POST", "/functions/orders", map[string]any{}, http.StatusForbidden},
+		{"invoke", "invoker", "POST", "/functions/orders", map[string]any{}, http.StatusOK},
+		{"invoke in another project", "invoker", "POST", "/functions/billing", map[string]any{}, http.StatusForbidden},
+		{"deploy without deploy", "invoker", "PATCH", "/functions/orders/log-level", map[string]any{"level": "debug"}, http.StatusForbidden},
+		{"deploy", "deployer", "PATCH", "/functions/orders/log-level", map[string]any{"level": "debug"}, http.StatusOK},
+		{"deploy in another project", "deployer", "PATCH", "/functions/billing/log-level", map[string]any{"level": "debug"}, http.StatusForbidden},
+		{"register in another project", "deployer", "POST", "/functions", map[string]any{"name": "refunds", "mode": "external", "project": "ledger"}, http.StatusForbidden},
+		{"read anywhere", "deployer", "GET", "/maintenance", nil, http.StatusOK},
+		{"manage without manage", "deployer", "PUT", "/maintenance", map[string]any{"enabled": false}, http.StatusForbidden},
+		{"manage", "admin", "PUT", "/maintenance", map[string]any{"enabled": false}, http.StatusOK},
+		{"admin API without a token", "", "GET", "/admin/faults", nil, http.StatusUnauthorized},
+		{"admin API without manage", "deployer", "GET", "/admin/faults", nil, http.StatusForbidden},
+		{"admin API", "admin", "GET", "/admin/faults", nil, http.StatusOK},
+		{"roles API without manage", "deployer", "GET", "/roles/subjects", nil, http.StatusForbidden},
+		{"private function without a token", "", "POST", "/functions/orders", map[string]any{}, http.StatusUnauthorized},
+		{"public function without a token", "", "POST", "/functions/site", map[string]any{}, http.StatusOK},
+		{"public function with a bad token", "not-a-key", "POST", "/functions/site", map[string]any{}, http.StatusUnauthorized},
+		{"public function's config", "", "GET", "/functions/site", nil, http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var header []string
+			if tt.as != "" {
+				key := keys[tt.as]
+				if key == "" {
+					key = tt.as
+				}
+				header = []string{"Authorization", "Bearer " + key}
+			}
+			rec := do(t, s, tt.method, tt.path, tt.body, header...)
+			assert.Equal(t, tt.want, rec.Code, rec.Body.String())
+		})
+	}
+}
+
+func TestAuthorize_CallerTokens(t *testing.T) {
+	s, _ := newRBACService(t)
+
+	// Functions invoke others in any project with the token they are
+	// started with, but may do nothing else
+	token := s.callers.token("orders")
+	rec := do(t, s, "POST", "/functions/billing", map[string]any{}, "Authorization", "Bearer "+token)
+	assert.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	rec = do(t, s, "PATCH", "/functions/billing/log-level", map[string]any{"level": "debug"}, "Authorization", "Bearer "+token)
+	assert.Equal(t, http.StatusForbidden, rec.Code)
+
+	// A deleted function's token is no longer honoured
+	rec = do(t, s, "DELETE", "/functions/orders", nil, "Authorization", "Bearer "+testAdminToken)
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	rec = do(t, s, "POST", "/functions/billing", map[string]any{}, "Authorization", "Bearer "+token)
+	assert.Equal(t, http.StatusUnauthorized, rec.Code)
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"encoding/json"
+	"kappa-v2/pkg/logger"
+	"kappa-v2/service/internal/errtrack"
+	"kappa-v2/service/internal/kappa"
+	"kappa-v2/service/internal/repository"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// Kinds of resources the repository keeps besides functions
+const (
+	resourceProject     = "project"
+	resourceEnvironment = "environment"
+	// resourceLock is a locked function, kept apart from its config so
+	// locking it doesn't change it
+	resourceLock = "lock"
+)
+
+// persistFunction stores a function as registered, so it is registered
+// again when the service restarts.
+func (s *KappaService) persistFunction(config KappaFunctionConfig, fn *kappa.KappaFunction) {
+	data, err := json.Marshal(config)
+	if err == nil {
+		err = s.repository.Save(repository.Function{
+			Name:      config.Name,
+			Config:    data,
+			Digest:    fn.ArtifactDigest,
+			UpdatedAt: time.Now().UTC(),
+		})
+	}
+	if err != nil {
+		logger.Get().Error("Failed to persist function", zap.String("name", config.Name), zap.Error(err))
+	}
+}
+
+// forgetFunction drops a deleted function from the repository.
+func (s *KappaService) forgetFunction(name string) {
+	if err := s.repository.Delete(name); err != nil {
+		logger.Get().Error("Failed to forget function", zap.String("name", name), zap.Error(err))
+	}
+}
+
+// persistResource stores a project, environment or lock, so it is back
+// when the service restarts.
+func (s *KappaService) persistResource(kind, name string, spec any) {
+	data, err := json.Marshal(spec)
+	if err == nil {
+		err = s.repository.SaveResource(repository.Resource{
+			Kind:      kind,
+			Name:      name,
+			Spec:      data,
+			UpdatedAt: time.Now().UTC(),
+		})
+	}
+	if err != nil {
+		logger.Get().Error("Failed to persist "+kind, zap.String("name", name), zap.Error(err))
+	}
+}
+
+// forgetResource drops a deleted project, environment or lock from the
+// repository.
+func (s *KappaService) forgetResource(kind, name string) {
+	if err := s.repository.DeleteResource(kind, name); err != nil {
+		logger.Get().Error("Failed to forget "+kind, zap.String("name", name), zap.Error(err))
+	}
+}
+
+// restoreResources brings back the projects and environments stored before
+// the service last stopped. They are restored before functions, which are
+// only registered into projects and environments that exist.
+func (s *KappaService) restoreResources() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.restoreStored(resourceProject, func(stored repository.Resource) error {
+		var project Project
+		if err := json.Unmarshal(stored.Spec, &project); err != nil {
+			return err
+		}
+		if project.ErrorTrackerDSN != "" {
+			dsn, err := errtrack.ParseDSN(project.ErrorTrackerDSN)
+			if err != nil {
+				return err
+			}
+			s.errorTracker.SetDSN(project.Name, dsn)
+		}
+		// Locked projects take no functions, restoreLocks locks them
+		// again once their functions are back
+		project.Locked = false
+		s.projects[project.Name] = &project
+		return nil
+	})
+	s.restoreStored(resourceEnvironment, func(stored repository.Resource) error {
+		var environment Environment
+		if err := json.Unmarshal(stored.Spec, &environment); err != nil {
+			return err
+		}
+		s.environments[environment.Name] = &environment
+		return nil
+	})
+}
+
+// restoreLocks locks the functions and projects that were locked before
+// the service last stopped, once their functions are restored.
+func (s *KappaService) restoreLocks() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.restoreStored(resourceLock, func(stored repository.Resource) error {
+		s.locked[stored.Name] = true
+		return nil
+	})
+	s.restoreStored(resourceProject, func(stored repository.Resource) error {
+		var project Project
+		if err := json.Unmarshal(stored.Spec, &project); err != nil {
+			return err
+		}
+		if existing, exists := s.projects[project.Name]; exists {
+			existing.Locked = project.Locked
+		}
+		return nil
+	})
+}
+
+// restoreStored calls restore with each stored resource of kind, logging
+// those that fail.
+func (s *KappaService) restoreStored(kind string, restore func(stored repository.Resource) error) {
+	resources, err := s.repository.ListResources(kind)
+	if err != nil {
+		logger.Get().Error("Failed to list stored "+kind+"s", zap.Error(err))
+		return
+	}
+	for _, stored := range resources {
+		if err := restore(stored); err != nil {
+			logger.Get().Error("Failed to restore "+kind, zap.String("name", stored.Name), zap.Error(err))
+		}
+	}
+}
+
+// restoreFunctions registers the functions stored before the service last
+// stopped, running the binaries kept in the artifact store. Functions
+// depending on others, like mirrors, are retried once those are back.
+// Functions that no longer register, e.g. as their project is gone, are
+// logged and left stored.
+func (s *KappaService) restoreFunctions() {
+	pending, err := s.repository.List()
+	if err != nil {
+		logger.Get().Error("Failed to list stored functions", zap.Error(err))
+		return
+	}
+	restored := 0
+	for len(pending) > 0 {
+		var failed []repository.Function
+		var errs []string
+		for _, stored := range pending {
+			var config KappaFunctionConfig
+			if err := json.Unmarshal(stored.Config, &config); err != nil {
+				logger.Get().Error("Failed to decode stored function", zap.String("name", stored.Name), zap.Error(err))
+				continue
+			}
+			fn, regErr := s.prepareFunctionFrom(&config, stored.Digest)
+			if regErr != nil {
+				failed = append(failed, stored)
+				errs = append(errs, regErr.msg)
+				continue
+			}
+			s.addFunction(config, fn)
+			s.restoreVersions(config.Name)
+			restored++
+		}
+		if len(failed) == len(pending) {
+			for i, stored := range failed {
+				logger.Get().Error("Failed to restore function", zap.String("name", stored.Name), zap.String("error", errs[i]))
+			}
+			break
+		}
+		pending = failed
+	}
+	if restored > 0 {
+		logger.Get().Info("Restored functions", zap.Int("count", restored))
+	}
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRestoreResources(t *testing.T) {
+	dir := t.TempDir()
+	s := newTestServiceIn(t, dir)
+	rec := do(t, s, "PUT", "/projects/shop", map[string]any{"defaults": map[string]any{"env": []string{"REGION=eu"}}})
+	require.Equal(t, http.StatusCreated, rec.Code, rec.Body.String())
+	rec = do(t, s, "PUT", "/projects/billing", map[string]any{})
+	require.Equal(t, http.StatusCreated, rec.Code, rec.Body.String())
+	register(t, s, map[string]any{"name": "invoices", "mode": "external", "project": "billing"})
+	rec = do(t, s, "POST", "/projects/billing/lock", nil)
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	rec = do(t, s, "PUT", "/environments/prod", map[string]any{"overrides": map[string]any{"env": []string{"STAGE=prod"}}})
+	require.Equal(t, http.StatusCreated, rec.Code, rec.Body.String())
+	rec = do(t, s, "PUT", "/environments/dev", map[string]any{"next": "prod"})
+	require.Equal(t, http.StatusCreated, rec.Code, rec.Body.String())
+	rec = do(t, s, "DELETE", "/environments/dev", nil)
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	register(t, s, map[string]any{"name": "checkout", "mode": "external", "project": "shop", "environment": "prod"})
+	rec = do(t, s, "POST", "/functions/checkout/lock", nil)
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	stopTestService(s)
+
+	// Functions are only restored into their project and environment when
+	// they are back first, and locked ones once they are
+	s = newTestServiceIn(t, dir)
+	fn, config, exists := s.lookup("checkout")
+	require.True(t, exists)
+	assert.Equal(t, "shop", config.Project)
+	assert.Contains(t, fn.Environ(), "REGION=eu")
+	assert.Contains(t, fn.Environ(), "STAGE=prod")
+	assert.Equal(t, "function checkout is locked", s.lockReason("checkout", ""))
+
+	billing, exists := s.project("billing")
+	require.True(t, exists)
+	assert.True(t, billing.Locked)
+	_, _, exists = s.lookup("invoices")
+	assert.True(t, exists, "functions of locked projects are restored")
+	_, exists = s.environment("prod")
+	assert.True(t, exists)
+	_, exists = s.environment("dev")
+	assert.False(t, exists, "deleted environments stay deleted")
+}
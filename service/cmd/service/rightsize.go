@@ -0,0 +1,133 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"kappa-v2/pkg/logger"
+	"kappa-v2/service/internal/audit"
+	"kappa-v2/service/internal/rbac"
+	"kappa-v2/service/internal/settings"
+	"kappa-v2/service/internal/usage"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/gorilla/mux"
+	"go.uber.org/zap"
+)
+
+// RightSizingConfig lets the service apply memory recommendations to a
+// function itself, within bounds.
+type RightSizingConfig struct {
+	Auto bool `json:"auto"`
+	usage.Bounds
+}
+
+// memoryRecommendation recommends a memory limit for a function from its
+// recent peaks, within its right-sizing bounds.
+func (s *KappaService) memoryRecommendation(name string, config KappaFunctionConfig) usage.Recommendation {
+	var bounds usage.Bounds
+	if config.RightSizing != nil {
+		bounds = config.RightSizing.Bounds
+	}
+	return s.usage.Recommend(name, s.effectiveSettings(config).MemoryMB.Value, bounds)
+}
+
+// HTTP handler for recommending a function's memory limit from the peaks
+// its invocations were seen at
+func (s *KappaService) getMemoryRecommendation(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	name := vars["name"]
+
+	_, config, exists := s.lookup(name)
+	if !exists {
+		http.Error(w, fmt.Sprintf("Function not found: %s", name), http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(s.memoryRecommendation(name, config))
+}
+
+// HTTP handler for listing the functions in projects the caller may read
+// whose memory limit should change
+func (s *KappaService) listMemoryRecommendations(w http.ResponseWriter, r *http.Request) {
+	recommendations := []usage.Recommendation{}
+	_, configs := s.snapshot()
+	for name, config := range configs {
+		if !s.allowed(r.Context(), rbac.Read, config.Project) {
+			continue
+		}
+		if rec := s.memoryRecommendation(name, config); rec.RecommendedMB != 0 {
+			recommendations = append(recommendations, rec)
+		}
+	}
+	sort.Slice(recommendations, func(i, j int) bool { return recommendations[i].Function < recommendations[j].Function })
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{
+		"recommendations": recommendations,
+	})
+}
+
+// rightSize applies memory recommendations to the functions that opted in.
+// Functions that are locked, or whose limit is set by their environment,
+// are left alone. New limits take effect on the next start.
+func (s *KappaService) rightSize() {
+	if s.maintenanceMode().Enabled {
+		return
+	}
+	functions, configs := s.snapshot()
+	for name, config := range configs {
+		if config.RightSizing == nil || !config.RightSizing.Auto || s.lockReason(name, config.Project) != "" {
+			continue
+		}
+		if s.effectiveSettings(config).MemoryMB.Source == settings.SourceEnvironment {
+			continue
+		}
+		rec := s.memoryRecommendation(name, config)
+		if rec.RecommendedMB == 0 {
+			continue
+		}
+
+		memoryMB := rec.RecommendedMB
+		config, err := s.updateConfig(name, func(config *KappaFunctionConfig) error {
+			config.Settings.MemoryMB = &memoryMB
+			return nil
+		})
+		if err != nil {
+			// Deleted since the snapshot
+			continue
+		}
+		applySettings(functions[name], s.effectiveSettings(config))
+		s.persistFunction(config, functions[name])
+
+		logger.Get().Info("Right-sized function memory", zap.String("name", name), zap.Int("from", rec.LimitMB), zap.Int("to", memoryMB))
+		s.audit.Record(audit.Entry{
+			Action:   "function.rightsize",
+			Function: name,
+			Project:  config.Project,
+			Detail: map[string]any{
+				"fromMb":    rec.LimitMB,
+				"toMb":      memoryMB,
+				"p99PeakMb": rec.P99PeakMB,
+				"samples":   rec.Samples,
+			},
+		})
+	}
+}
+
+// rightSizeEvery applies memory recommendations on an interval until stop
+// is closed.
+func (s *KappaService) rightSizeEvery(interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			s.rightSize()
+		}
+	}
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"kappa-v2/service/internal/audit"
+	"kappa-v2/service/internal/kappa"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// recordPeaks records invocations of a function peaking at peakMB, enough
+// of them for a recommendation.
+func recordPeaks(s *KappaService, name string, peakMB int) {
+	for range 20 {
+		s.usage.Record("", kappa.Usage{Function: name, Started: time.Now(), Duration: time.Millisecond, PeakMemoryMB: peakMB})
+	}
+}
+
+func TestMemoryRecommendation(t *testing.T) {
+	s := newTestService(t)
+	register(t, s, map[string]any{"name": "orders", "mode": "external", "memoryMb": 1024})
+	register(t, s, map[string]any{"name": "billing", "mode": "external", "memoryMb": 1024})
+
+	rec := do(t, s, "GET", "/functions/orders/memory-recommendation", nil)
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	assert.Nil(t, decode(t, rec)["recommendedMb"], "too few samples to go by")
+
+	recordPeaks(s, "orders", 100)
+	rec = do(t, s, "GET", "/functions/orders/memory-recommendation", nil)
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	recommendation := decode(t, rec)
+	assert.Equal(t, 1024.0, recommendation["limitMb"])
+	assert.Equal(t, 100.0, recommendation["p99PeakMb"])
+	recommended := recommendation["recommendedMb"].(float64)
+	assert.Less(t, recommended, 1024.0)
+
+	// Only functions whose limit should change are listed
+	rec = do(t, s, "GET", "/memory-recommendations", nil)
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	listed := decode(t, rec)["recommendations"].([]any)
+	require.Len(t, listed, 1)
+	assert.Equal(t, "orders", listed[0].(map[string]any)["function"])
+
+	rec = do(t, s, "GET", "/functions/missing/memory-recommendation", nil)
+	assert.Equal(t, http.StatusNotFound, rec.Code)
+}
+
+func TestRightSize(t *testing.T) {
+	s := newTestService(t)
+	for _, name := range []string{"orders", "billing", "ledger"} {
+		config := map[string]any{"name": name, "mode": "external", "memoryMb": 1024}
+		if name != "ledger" {
+			config["rightSizing"] = map[string]any{"auto": true, "minMb": 256}
+		}
+		register(t, s, config)
+		recordPeaks(s, name, 100)
+	}
+	rec := do(t, s, "POST", "/functions/billing/lock", map[string]any{"reason": "quarter end"})
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+
+	s.rightSize()
+
+	// Only unlocked functions that opted in are resized, within bounds
+	assert.Equal(t, 256, *s.config("orders").Settings.MemoryMB)
+	assert.Equal(t, 1024, *s.config("billing").Settings.MemoryMB)
+	assert.Equal(t, 1024, *s.config("ledger").Settings.MemoryMB)
+	history, _ := s.versionHistory("orders")
+	assert.Equal(t, 256, *history[len(history)-1].Config.Settings.MemoryMB)
+	entries := s.audit.List(func(e audit.Entry) bool { return e.Action == "function.rightsize" })
+	require.Len(t, entries, 1)
+	assert.Equal(t, "orders", entries[0].Function)
+	assert.Equal(t, 1024, entries[0].Detail["fromMb"])
+	assert.Equal(t, 256, entries[0].Detail["toMb"])
+
+	// Nothing changes during maintenance
+	rec = do(t, s, "PUT", "/maintenance", map[string]any{"enabled": true})
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	recordPeaks(s, "orders", 250)
+	s.rightSize()
+	assert.Equal(t, 256, *s.config("orders").Settings.MemoryMB)
+}
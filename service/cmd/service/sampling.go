@@ -0,0 +1,105 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"kappa-v2/pkg/logger"
+	"kappa-v2/service/internal/audit"
+	"kappa-v2/service/internal/tracing"
+	"net/http"
+
+	"github.com/gorilla/mux"
+	"go.uber.org/zap"
+)
+
+// traceRequest decides whether the trace of an invocation of the named
+// function is sampled, by its sampling policy or the service's rate, and
+// passes the trace on to the runtime in r's traceparent header. Callers
+// get it back in traceresponse to find the trace by.
+func (s *KappaService) traceRequest(w http.ResponseWriter, r *http.Request, name string) {
+	parent, hasParent := tracing.Parse(r.Header.Get(tracing.Header))
+	if !hasParent {
+		parent = tracing.New()
+	}
+	decision := s.config(name).Sampling.Decide(r, parent, hasParent, s.traceSampleRate)
+	trace := parent.Child(decision.Sampled)
+	r.Header.Set(tracing.Header, trace.String())
+	w.Header().Set("Traceresponse", trace.String())
+}
+
+// HTTP handler for getting a function's sampling policy, and the service's
+// rate it falls back to
+func (s *KappaService) getSampling(w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["name"]
+	_, config, exists := s.lookup(name)
+	if !exists {
+		http.Error(w, fmt.Sprintf("Function not found: %s", name), http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{
+		"name":        name,
+		"policy":      config.Sampling,
+		"serviceRate": s.traceSampleRate,
+	})
+}
+
+// HTTP handler for replacing a function's sampling policy, applied to its
+// invocations straight away. An empty policy falls back to the service's
+// rate.
+func (s *KappaService) setSampling(w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["name"]
+	fn, config, exists := s.lookup(name)
+	if !exists {
+		http.Error(w, fmt.Sprintf("Function not found: %s", name), http.StatusNotFound)
+		return
+	}
+	if reason := s.lockReason(name, config.Project); reason != "" {
+		http.Error(w, fmt.Sprintf("Function is locked: %s", reason), http.StatusLocked)
+		return
+	}
+	if !checkPreconditions(w, r, s.functionETag(name)) {
+		return
+	}
+
+	var policy tracing.Policy
+	if err := json.NewDecoder(r.Body).Decode(&policy); err != nil {
+		http.Error(w, fmt.Sprintf("Invalid request: %v", err), http.StatusBadRequest)
+		return
+	}
+	if err := policy.Validate(); err != nil {
+		http.Error(w, fmt.Sprintf("Invalid sampling: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	config, err := s.updateConfig(name, func(config *KappaFunctionConfig) error {
+		config.Sampling = &policy
+		if policy.IsZero() {
+			config.Sampling = nil
+		}
+		return nil
+	})
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Function not found: %s", name), http.StatusNotFound)
+		return
+	}
+	s.persistFunction(config, fn)
+
+	logger.FromCtx(r.Context()).Info("Function sampling changed", zap.String("name", name))
+	s.audit.Record(audit.Entry{
+		Actor:    actor(r.Context()),
+		Action:   "function.sampling",
+		Function: name,
+		Project:  config.Project,
+		Detail:   map[string]any{"policy": config.Sampling},
+	})
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("ETag", s.functionETag(name))
+	json.NewEncoder(w).Encode(map[string]any{
+		"name":        name,
+		"policy":      config.Sampling,
+		"serviceRate": s.traceSampleRate,
+	})
+}
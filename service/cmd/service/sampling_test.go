@@ -0,0 +1,68 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSetSampling(t *testing.T) {
+	s := newTestService(t)
+	register(t, s, map[string]any{"name": "orders", "mode": "external"})
+
+	policy := map[string]any{"rate": 0.01, "rules": []any{map[string]any{"header": "X-Debug", "rate": 1.0}}}
+	rec := do(t, s, "PUT", "/functions/orders/sampling", policy)
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	assert.Equal(t, policy, decode(t, rec)["policy"])
+	config := s.config("orders")
+	require.NotNil(t, config.Sampling)
+	assert.Equal(t, 0.01, *config.Sampling.Rate)
+	history, _ := s.versionHistory("orders")
+	require.NotEmpty(t, history)
+	assert.Equal(t, config.Sampling, history[len(history)-1].Config.Sampling)
+
+	rec = do(t, s, "GET", "/functions/orders/sampling", nil)
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	assert.Equal(t, policy, decode(t, rec)["policy"])
+
+	// An empty policy falls back to the service's rate
+	rec = do(t, s, "PUT", "/functions/orders/sampling", map[string]any{})
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	assert.Nil(t, s.config("orders").Sampling)
+
+	rec = do(t, s, "PUT", "/functions/orders/sampling", map[string]any{"rate": 2})
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+	rec = do(t, s, "PUT", "/functions/missing/sampling", map[string]any{"rate": 0.5})
+	assert.Equal(t, http.StatusNotFound, rec.Code)
+	rec = do(t, s, "GET", "/functions/missing/sampling", nil)
+	assert.Equal(t, http.StatusNotFound, rec.Code)
+}
+
+func TestSetSampling_Guarded(t *testing.T) {
+	s := newTestService(t)
+	register(t, s, map[string]any{"name": "orders", "mode": "external"})
+	rec := do(t, s, "POST", "/functions/orders/lock", nil)
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+
+	rec = do(t, s, "PUT", "/functions/orders/sampling", map[string]any{"rate": 0.5})
+	assert.Equal(t, http.StatusLocked, rec.Code)
+	rec = do(t, s, "POST", "/functions/orders/unlock", nil)
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+
+	rec = do(t, s, "PUT", "/maintenance", map[string]any{"enabled": true})
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	rec = do(t, s, "PUT", "/functions/orders/sampling", map[string]any{"rate": 0.5})
+	assert.Equal(t, http.StatusServiceUnavailable, rec.Code)
+	rec = do(t, s, "PUT", "/maintenance", map[string]any{"enabled": false})
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	assert.Nil(t, s.config("orders").Sampling, "nothing changed while guarded")
+
+	etag := s.functionETag("orders")
+	rec = do(t, s, "PUT", "/functions/orders/sampling", map[string]any{"rate": 0.5}, "If-Match", etag)
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	rec = do(t, s, "PUT", "/functions/orders/sampling", map[string]any{"rate": 0.1}, "If-Match", etag)
+	assert.Equal(t, http.StatusPreconditionFailed, rec.Code)
+	assert.Equal(t, 0.5, *s.config("orders").Sampling.Rate)
+}
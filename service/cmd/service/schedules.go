@@ -0,0 +1,207 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"kappa-v2/pkg/logger"
+	"kappa-v2/service/internal/kappa"
+	"kappa-v2/service/internal/rbac"
+	"kappa-v2/service/internal/scheduler"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"go.uber.org/zap"
+)
+
+// Limits on how many fire times GET /schedules/{id}/next returns
+const (
+	defaultNextCount = 5
+	maxNextCount     = 100
+)
+
+// invokeScheduled invokes a schedule's function with its event.
+func (s *KappaService) invokeScheduled(ctx context.Context, schedule scheduler.Schedule) error {
+	fn, _, exists := s.lookup(schedule.Function)
+	if !exists {
+		return fmt.Errorf("function not found: %s", schedule.Function)
+	}
+
+	if err := s.admission.Acquire(ctx, s.priority(schedule.Function)); err != nil {
+		return err
+	}
+	defer s.admission.Release()
+
+	ctx, cancel := context.WithTimeout(ctx, fn.Timeout())
+	defer cancel()
+
+	event := kappa.KappaEvent{
+		Path:        "/schedules/" + schedule.ID,
+		HTTPMethod:  http.MethodPost,
+		Headers:     map[string]string{"X-Kappa-Schedule": schedule.ID},
+		QueryParams: make(map[string]string),
+		Body:        schedule.Event,
+	}
+	resp, err := fn.Invoke(ctx, event)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode >= 400 {
+		return fmt.Errorf("function returned status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// HTTP handler for listing schedules
+func (s *KappaService) listSchedules(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	schedules := s.scheduler.List()
+	visible := schedules[:0]
+	for _, schedule := range schedules {
+		if s.allowed(r.Context(), rbac.Read, s.config(schedule.Function).Project) {
+			visible = append(visible, schedule)
+		}
+	}
+	json.NewEncoder(w).Encode(map[string]any{
+		"schedules": visible,
+		"timezone":  s.scheduler.Location().String(),
+	})
+}
+
+// HTTP handler for getting a schedule
+func (s *KappaService) getSchedule(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	id := vars["id"]
+
+	schedule, err := s.scheduler.Get(id)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Schedule not found: %s", id), http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(schedule)
+}
+
+// HTTP handler for creating or replacing a schedule
+func (s *KappaService) putSchedule(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	id := vars["id"]
+
+	var schedule scheduler.Schedule
+	if err := json.NewDecoder(r.Body).Decode(&schedule); err != nil {
+		http.Error(w, fmt.Sprintf("Invalid request: %v", err), http.StatusBadRequest)
+		return
+	}
+	schedule.ID = id
+	if s.triggerSchedule(w, id) {
+		return
+	}
+	if err := schedule.Validate(); err != nil {
+		http.Error(w, fmt.Sprintf("Invalid schedule: %v", err), http.StatusBadRequest)
+		return
+	}
+	if _, _, exists := s.lookup(schedule.Function); !exists {
+		http.Error(w, fmt.Sprintf("Function not found: %s", schedule.Function), http.StatusBadRequest)
+		return
+	}
+	projects := []string{s.config(schedule.Function).Project}
+	if existing, err := s.scheduler.Get(id); err == nil {
+		projects = append(projects, s.config(existing.Function).Project)
+	}
+	if !s.allowed(r.Context(), rbac.Deploy, projects...) {
+		http.Error(w, fmt.Sprintf("Forbidden: may not schedule %s", schedule.Function), http.StatusForbidden)
+		return
+	}
+
+	if err := s.scheduler.Put(schedule); err != nil {
+		http.Error(w, fmt.Sprintf("Invalid schedule: %v", err), http.StatusBadRequest)
+		return
+	}
+	s.saveSchedule(schedule)
+	logger.FromCtx(r.Context()).Info("Schedule saved",
+		zap.String("id", id),
+		zap.String("function", schedule.Function),
+		zap.String("cron", schedule.Cron))
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(schedule)
+}
+
+// HTTP handler for deleting a schedule
+func (s *KappaService) deleteSchedule(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	id := vars["id"]
+
+	if s.triggerSchedule(w, id) {
+		return
+	}
+	if err := s.scheduler.Remove(id); err != nil {
+		http.Error(w, fmt.Sprintf("Schedule not found: %s", id), http.StatusNotFound)
+		return
+	}
+	s.forgetSchedule(id)
+	logger.FromCtx(r.Context()).Info("Schedule deleted", zap.String("id", id))
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{
+		"id":     id,
+		"status": "deleted",
+	})
+}
+
+// triggerSchedule refuses changes to a schedule kept by a function's cron
+// trigger, which registering the function would undo, reporting whether it
+// did.
+func (s *KappaService) triggerSchedule(w http.ResponseWriter, id string) bool {
+	if !strings.HasPrefix(id, triggerSchedulePrefix) {
+		return false
+	}
+	http.Error(w, fmt.Sprintf("Schedule is kept by a function's triggers, change them instead: %s", id), http.StatusConflict)
+	return true
+}
+
+// HTTP handler for previewing a schedule's upcoming fire times in its
+// timezone, before jitter
+func (s *KappaService) nextScheduleRuns(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	id := vars["id"]
+
+	count := defaultNextCount
+	if v := r.URL.Query().Get("count"); v != "" {
+		var err error
+		if count, err = strconv.Atoi(v); err != nil || count < 1 || count > maxNextCount {
+			http.Error(w, fmt.Sprintf("Invalid count: %s, expected 1-%d", v, maxNextCount), http.StatusBadRequest)
+			return
+		}
+	}
+
+	times, err := s.scheduler.Next(id, count)
+	if errors.Is(err, scheduler.ErrNotFound) {
+		http.Error(w, fmt.Sprintf("Schedule not found: %s", id), http.StatusNotFound)
+		return
+	}
+	schedule, _ := s.scheduler.Get(id)
+	timezone := schedule.Timezone
+	if timezone == "" {
+		timezone = s.scheduler.Location().String()
+	}
+
+	next := make([]string, len(times))
+	for i, t := range times {
+		next[i] = t.Format(time.RFC3339)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{
+		"id":       id,
+		"cron":     schedule.Cron,
+		"timezone": timezone,
+		"jitterMs": schedule.JitterMs,
+		"next":     next,
+	})
+}
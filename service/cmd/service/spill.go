@@ -0,0 +1,64 @@
+package main
+
+import (
+	"context"
+	"io"
+	"kappa-v2/pkg/logger"
+	"kappa-v2/service/internal/blob"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// Responses of functions with spillover are spilled above 6MB by default,
+// and linked to for an hour
+const (
+	defaultSpillThreshold = 6 << 20
+	defaultSpillTTL       = time.Hour
+	// maxBucketSpillTTL is the longest links to responses spilled to a
+	// bucket last, as long as presigned links do
+	maxBucketSpillTTL = 7 * 24 * time.Hour
+)
+
+// SpilloverConfig opts a function into having response bodies larger than
+// ThresholdBytes, or the service's threshold when 0, written to the blob
+// store and returned as a link. Only runtimes returning raw responses, like
+// pkg/handler and the runtime bootstraps, are spilled.
+type SpilloverConfig struct {
+	ThresholdBytes int64 `json:"thresholdBytes,omitempty"`
+}
+
+// blobSpiller spills responses to the blob store, linking to them for ttl.
+type blobSpiller struct {
+	store blob.Store
+	ttl   time.Duration
+}
+
+func (b blobSpiller) Spill(ctx context.Context, key string, body io.Reader) (string, time.Time, error) {
+	if _, err := b.store.Put(ctx, key, body); err != nil {
+		return "", time.Time{}, err
+	}
+	expiresAt := time.Now().Add(b.ttl)
+	url, err := b.store.URL(key, expiresAt)
+	return url, expiresAt, err
+}
+
+// pruneBlobsEvery deletes spilled responses whose links have expired on an
+// interval until stop is closed.
+func (s *KappaService) pruneBlobsEvery(interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			pruned, err := s.blobs.Prune(context.Background(), time.Now().Add(-s.spiller.ttl))
+			if err != nil {
+				logger.Get().Warn("Failed to prune spilled responses", zap.Error(err))
+			} else if pruned > 0 {
+				logger.Get().Info("Pruned spilled responses", zap.Int("count", pruned))
+			}
+		}
+	}
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"kappa-v2/service/internal/kappa"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSpillover(t *testing.T) {
+	dir := t.TempDir()
+	s := newTestServiceIn(t, dir)
+	large := strings.Repeat("x", 100)
+	respond := func(w http.ResponseWriter, r *http.Request) { w.Write([]byte(large)) }
+	register(t, s, map[string]any{"name": "report", "mode": "external", "spillover": map[string]any{"thresholdBytes": 16}})
+	attachRuntime(t, s, "report", respond)
+	attachRuntime(t, s, "orders", respond)
+
+	rec := do(t, s, "POST", "/functions/report", map[string]any{})
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	assert.NotEmpty(t, rec.Header().Get(kappa.HeaderSpilled))
+	var spilled kappa.SpilledBody
+	require.NoError(t, decodeInto(rec, &spilled))
+	assert.Equal(t, int64(len(large)), spilled.Size)
+	assert.WithinDuration(t, time.Now().Add(defaultSpillTTL), spilled.ExpiresAt, time.Minute)
+
+	// The link serves the body until it expires
+	rec = do(t, s, "GET", spilled.URL, nil)
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	assert.Equal(t, large, rec.Body.String())
+	rec = do(t, s, "GET", strings.Replace(spilled.URL, "signature=", "signature=0", 1), nil)
+	assert.NotEqual(t, http.StatusOK, rec.Code)
+
+	// Functions without spillover return their bodies whatever the size
+	rec = do(t, s, "POST", "/functions/orders", map[string]any{})
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	assert.Empty(t, rec.Header().Get(kappa.HeaderSpilled))
+	assert.Equal(t, large, rec.Body.String())
+
+	rec = do(t, s, "POST", "/functions", map[string]any{"name": "billing", "mode": "external", "spillover": map[string]any{"thresholdBytes": -1}})
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+}
+
+func TestPruneBlobs(t *testing.T) {
+	dir := t.TempDir()
+	s := newTestServiceIn(t, dir)
+	register(t, s, map[string]any{"name": "report", "mode": "external", "spillover": map[string]any{"thresholdBytes": 16}})
+	attachRuntime(t, s, "report", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(strings.Repeat("x", 100)))
+	})
+	s.spiller.ttl = 10 * time.Millisecond
+
+	rec := do(t, s, "POST", "/functions/report", map[string]any{})
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	blobs := func() int {
+		var count int
+		filepath.WalkDir(filepath.Join(dir, "blobs"), func(path string, d os.DirEntry, err error) error {
+			if err == nil && !d.IsDir() {
+				count++
+			}
+			return nil
+		})
+		return count
+	}
+	require.Equal(t, 1, blobs())
+
+	// Spilled responses are deleted once their links expire
+	stop := make(chan struct{})
+	defer close(stop)
+	go s.pruneBlobsEvery(10*time.Millisecond, stop)
+	assert.Eventually(t, func() bool { return blobs() == 0 }, 5*time.Second, 10*time.Millisecond)
+}
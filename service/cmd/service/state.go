@@ -0,0 +1,122 @@
+package main
+
+import (
+	"errors"
+	"kappa-v2/service/internal/kappa"
+	"maps"
+	"slices"
+	"time"
+)
+
+// lookup returns a registered function and its config.
+func (s *KappaService) lookup(name string) (*kappa.KappaFunction, KappaFunctionConfig, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	fn, exists := s.functions[name]
+	return fn, s.configs[name], exists
+}
+
+// snapshot copies the registered functions and their configs, for going
+// through them without holding the lock.
+func (s *KappaService) snapshot() (map[string]*kappa.KappaFunction, map[string]KappaFunctionConfig) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return maps.Clone(s.functions), maps.Clone(s.configs)
+}
+
+// setConfig replaces a registered function's config, and its current
+// version's.
+func (s *KappaService) setConfig(name string, config KappaFunctionConfig) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.configs[name] = config
+	if history := s.versions[name]; len(history) > 0 {
+		history[len(history)-1].Config = config
+	}
+}
+
+// errNotRegistered is what updateConfig fails with for a function that
+// isn't registered, or no longer is.
+var errNotRegistered = errors.New("function is not registered")
+
+// updateConfig changes a registered function's config, and its current
+// version's, with update under the lock, so changes made at the same time
+// aren't lost. update must not call the other accessors, and replaces the
+// config's slices and maps instead of changing them in place. The config
+// is left as it was when update fails.
+func (s *KappaService) updateConfig(name string, update func(*KappaFunctionConfig) error) (KappaFunctionConfig, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	config, exists := s.configs[name]
+	if !exists {
+		return KappaFunctionConfig{}, errNotRegistered
+	}
+	if err := update(&config); err != nil {
+		return s.configs[name], err
+	}
+	s.configs[name] = config
+	if history := s.versions[name]; len(history) > 0 {
+		history[len(history)-1].Config = config
+	}
+	return config, nil
+}
+
+// versionHistory copies a function's kept versions, oldest first.
+func (s *KappaService) versionHistory(name string) ([]functionVersion, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	history, exists := s.versions[name]
+	return slices.Clone(history), exists
+}
+
+// project returns a copy of a project.
+func (s *KappaService) project(name string) (Project, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if project, exists := s.projects[name]; exists {
+		return *project, true
+	}
+	return Project{}, false
+}
+
+// environment returns a copy of an environment.
+func (s *KappaService) environment(name string) (Environment, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if environment, exists := s.environments[name]; exists {
+		return *environment, true
+	}
+	return Environment{}, false
+}
+
+// config returns a registered function's config, the zero config when
+// there is none.
+func (s *KappaService) config(name string) KappaFunctionConfig {
+	_, config, _ := s.lookup(name)
+	return config
+}
+
+// maintenanceMode returns the service's maintenance mode.
+func (s *KappaService) maintenanceMode() Maintenance {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.maintenance
+}
+
+// setMaintenance enters or leaves maintenance mode, keeping when it was
+// entered if the service is already in it, and returns the new mode.
+func (s *KappaService) setMaintenance(maintenance Maintenance) Maintenance {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if maintenance.Enabled {
+		since := time.Now()
+		maintenance.Since = &since
+		if s.maintenance.Enabled {
+			maintenance.Since = s.maintenance.Since
+		}
+	} else {
+		maintenance = Maintenance{}
+	}
+	s.maintenance = maintenance
+	return maintenance
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"kappa-v2/pkg/logger"
+	"net/http"
+
+	"go.uber.org/zap"
+)
+
+// streamBufferSize is the most of a streamed response read at once
+const streamBufferSize = 32 * 1024
+
+// copyStream writes what a function streams to the caller, flushing it
+// through as it arrives. The status is already sent, so a stream cut short
+// by the function's timeout or failure is only logged.
+func copyStream(w http.ResponseWriter, stream io.Reader, name string) {
+	rc := http.NewResponseController(w)
+	buf := make([]byte, streamBufferSize)
+	for {
+		n, err := stream.Read(buf)
+		if n > 0 {
+			if _, err := w.Write(buf[:n]); err != nil {
+				// The caller went away
+				return
+			}
+			rc.Flush()
+		}
+		if errors.Is(err, io.EOF) {
+			return
+		}
+		if err != nil {
+			logger.Get().Warn("Function's response stream ended early", zap.String("name", name), zap.Error(err))
+			return
+		}
+	}
+}
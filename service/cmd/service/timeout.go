@@ -0,0 +1,57 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"kappa-v2/pkg/handler"
+	"kappa-v2/service/internal/kappa"
+	"kappa-v2/service/internal/rbac"
+	"net/http"
+	"time"
+)
+
+// validateTimeoutGrace checks a function's grace period for partial results.
+func validateTimeoutGrace(graceMs int, mode kappa.Mode) error {
+	if graceMs == 0 {
+		return nil
+	}
+	if graceMs < 0 || time.Duration(graceMs)*time.Millisecond > kappa.MaxTimeoutGrace {
+		return fmt.Errorf("must be between 0 and %d", kappa.MaxTimeoutGrace.Milliseconds())
+	}
+	if mode == kappa.ModeJob {
+		return fmt.Errorf("jobs are killed when they time out")
+	}
+	return nil
+}
+
+// timeoutError answers an invocation that timed out with what the function
+// had to show for it, its partial result and latest log lines, as JSON. The
+// function's error page for timeouts replaces it when it has one, and log
+// lines are only sent to callers who may read the function's logs.
+func (s *KappaService) timeoutError(w http.ResponseWriter, r *http.Request, name string, err *kappa.TimeoutError) {
+	message := fmt.Sprintf("Function invocation failed: %v", err)
+	if _, exists := s.config(name).Errors[errorTimeout]; exists {
+		s.invocationError(w, name, errorTimeout, message, http.StatusInternalServerError)
+		return
+	}
+
+	response := struct {
+		Error     string                 `json:"error"`
+		Kind      string                 `json:"kind"`
+		RequestID string                 `json:"requestId"`
+		Partial   *handler.PartialResult `json:"partial,omitempty"`
+		Logs      []string               `json:"logs,omitempty"`
+	}{
+		Error:     message,
+		Kind:      errorTimeout,
+		RequestID: err.RequestID,
+		Partial:   err.Partial,
+	}
+	if s.allowed(r.Context(), rbac.Read, s.config(name).Project) {
+		response.Logs = err.Logs
+	}
+	w.Header().Set("X-Kappa-Error", errorTimeout)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusInternalServerError)
+	json.NewEncoder(w).Encode(response)
+}
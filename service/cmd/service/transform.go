@@ -0,0 +1,84 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"kappa-v2/service/internal/kappa"
+	"kappa-v2/service/internal/transform"
+	"net/http"
+)
+
+// TransformConfig reshapes invocations over HTTP with Go templates, so a
+// handler can serve clients expecting another contract. Request renders the
+// event body, a JSON object, from the request; Response renders the body
+// returned from the handler's response. ContentType is set on transformed
+// responses, application/json by default when they are JSON.
+type TransformConfig struct {
+	Request     string `json:"request,omitempty"`
+	Response    string `json:"response,omitempty"`
+	ContentType string `json:"contentType,omitempty"`
+}
+
+func (c *TransformConfig) compile() (*transform.Transform, error) {
+	if c == nil {
+		return nil, nil
+	}
+	return transform.Compile(c.Request, c.Response)
+}
+
+func (c *TransformConfig) contentType() string {
+	if c == nil {
+		return ""
+	}
+	return c.ContentType
+}
+
+// transform returns a function's compiled templates, nil without any. They
+// were validated when it was registered.
+func (s *KappaService) transform(name string) *transform.Transform {
+	t, _ := s.config(name).Transform.compile()
+	return t
+}
+
+// transformRequest renders event's body from the request's through the
+// request template.
+func transformRequest(t *transform.Transform, r *http.Request, event *kappa.KappaEvent) error {
+	data, err := io.ReadAll(r.Body)
+	if err != nil {
+		return fmt.Errorf("failed to read request body: %w", err)
+	}
+	body, err := t.Request(transform.NewRequest(event.HTTPMethod, event.Path, event.Headers, event.QueryParams, data))
+	if err != nil {
+		return err
+	}
+	event.Body = body
+	return nil
+}
+
+// transformResponse replaces resp's body with the response template's
+// rendering. Spilled responses are left as links.
+func transformResponse(t *transform.Transform, contentType string, resp *kappa.KappaResponse) error {
+	if !t.HasResponse() || resp.Spilled != nil {
+		return nil
+	}
+	body, err := t.Response(transform.NewResponse(resp.StatusCode, resp.Headers, resp.Body))
+	if err != nil {
+		return err
+	}
+	headers := make(map[string]string, len(resp.Headers))
+	for key, value := range resp.Headers {
+		if http.CanonicalHeaderKey(key) != "Content-Type" {
+			headers[key] = value
+		}
+	}
+	if contentType == "" && json.Valid(body) {
+		contentType = "application/json"
+	}
+	if contentType != "" {
+		headers["Content-Type"] = contentType
+	}
+	resp.Headers = headers
+	resp.Body = body
+	return nil
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"kappa-v2/service/internal/batch"
+	"kappa-v2/service/internal/kappa"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// batcherKey is the key of a function's trigger's batcher.
+func batcherKey(function, trigger string) string {
+	return function + "\x00" + trigger
+}
+
+// reconcileBatchers keeps a batcher for every webhook trigger of the
+// function with a batch window. Batchers whose trigger is gone or whose
+// window changed are closed, delivering what they collected.
+func (s *KappaService) reconcileBatchers(function string, triggers []Trigger) {
+	wanted := make(map[string]batch.Window)
+	for i, t := range triggers {
+		if t.Type == triggerWebhook && t.Batch != nil {
+			wanted[triggerName(t, i)] = *t.Batch
+		}
+	}
+
+	s.batchersMu.Lock()
+	var closing []*batch.Batcher
+	for key, b := range s.batchers {
+		trigger, ok := strings.CutPrefix(key, batcherKey(function, ""))
+		if !ok {
+			continue
+		}
+		if window, keep := wanted[trigger]; keep && window == b.Window() {
+			delete(wanted, trigger)
+			continue
+		}
+		closing = append(closing, b)
+		delete(s.batchers, key)
+	}
+	for trigger, window := range wanted {
+		s.batchers[batcherKey(function, trigger)] = batch.New(function+"/"+trigger, window, s.deliverBatch(function, trigger))
+	}
+	s.batchersMu.Unlock()
+
+	// Deliveries may take the function's timeout, registering doesn't wait
+	for _, b := range closing {
+		go b.Close()
+	}
+}
+
+// closeBatchers delivers what every batcher collected, for shutting down.
+func (s *KappaService) closeBatchers() {
+	s.batchersMu.Lock()
+	batchers := s.batchers
+	s.batchers = make(map[string]*batch.Batcher)
+	s.batchersMu.Unlock()
+	for _, b := range batchers {
+		b.Close()
+	}
+}
+
+// deliverBatch invokes the function with a batch of its trigger's items,
+// as the event body's items. The function reports the items that failed
+// in the failedItems of its response, the rest are done.
+func (s *KappaService) deliverBatch(function, trigger string) batch.Deliver {
+	return func(ctx context.Context, items []batch.Item) ([]string, error) {
+		fn, _, exists := s.lookup(function)
+		if !exists {
+			return nil, fmt.Errorf("function not found: %s", function)
+		}
+		if err := s.admission.Acquire(ctx, s.priority(function)); err != nil {
+			return nil, err
+		}
+		defer s.admission.Release()
+
+		ctx, cancel := context.WithTimeout(ctx, fn.Timeout())
+		defer cancel()
+		event := kappa.KappaEvent{
+			Path:       "/hooks/" + function + "/" + trigger,
+			HTTPMethod: http.MethodPost,
+			Headers: map[string]string{
+				"X-Kappa-Trigger":    trigger,
+				"X-Kappa-Batch-Size": strconv.Itoa(len(items)),
+			},
+			QueryParams: make(map[string]string),
+			Body:        map[string]any{"items": items},
+		}
+		resp, err := fn.Invoke(ctx, event)
+		if err != nil {
+			return nil, err
+		}
+		if resp.StatusCode >= 400 {
+			return nil, fmt.Errorf("function returned status %d", resp.StatusCode)
+		}
+		// Responses without failedItems, or that aren't objects, mark
+		// the whole batch done
+		var result struct {
+			FailedItems []string `json:"failedItems"`
+		}
+		json.Unmarshal(resp.Body, &result)
+		return result.FailedItems, nil
+	}
+}
+
+// batchWebhook adds a webhook delivery to its trigger's next batch,
+// answering 202 with the ID the item is delivered with.
+func (s *KappaService) batchWebhook(w http.ResponseWriter, r *http.Request, name, trigger string, body []byte) {
+	if !json.Valid(body) {
+		http.Error(w, "Invalid request body: batched deliveries must be JSON", http.StatusBadRequest)
+		return
+	}
+	s.batchersMu.Lock()
+	b, exists := s.batchers[batcherKey(name, trigger)]
+	s.batchersMu.Unlock()
+	id := requestID(r.Context())
+	if !exists || !b.Add(batch.Item{ID: id, Body: body}) {
+		http.Error(w, fmt.Sprintf("Webhook is not batching: %s/%s", name, trigger), http.StatusServiceUnavailable)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(map[string]string{
+		"id":     id,
+		"status": "batched",
+	})
+}
@@ -0,0 +1,276 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"kappa-v2/pkg/logger"
+	"kappa-v2/service/internal/batch"
+	"kappa-v2/service/internal/gateway"
+	"kappa-v2/service/internal/kappa"
+	"kappa-v2/service/internal/scheduler"
+	"kappa-v2/service/internal/settings"
+	"net/http"
+	"regexp"
+	"slices"
+	"strings"
+
+	"github.com/gorilla/mux"
+	"go.uber.org/zap"
+)
+
+// Kinds of event sources a function's triggers set up
+const (
+	// triggerCron invokes the function on a cron schedule
+	triggerCron = "cron"
+	// triggerWebhook invokes the function with requests signed with the
+	// trigger's secret at /hooks/{name}/{trigger}
+	triggerWebhook = "webhook"
+	// triggerHTTP invokes the function with requests to a route of the
+	// service's gateway, like GET /users/{id}
+	triggerHTTP = "http"
+)
+
+var triggerTypes = []string{triggerCron, triggerWebhook, triggerHTTP}
+
+// Webhook deliveries are signed like GitHub's, with the hex HMAC-SHA256 of
+// the body under the trigger's secret
+const (
+	signatureHeader = "X-Kappa-Signature"
+	signaturePrefix = "sha256="
+	// minWebhookSecret is the shortest secret a webhook is signed with
+	minWebhookSecret = 16
+)
+
+// triggerSchedulePrefix starts the ids of schedules kept by cron triggers,
+// followed by the function's name and the trigger's
+const triggerSchedulePrefix = "trigger:"
+
+var validTriggerName = regexp.MustCompile(`^[a-z0-9]([a-z0-9-]{0,61}[a-z0-9])?$`)
+
+// Trigger is an event source invoking the function, set up when the
+// function is registered and torn down when it is deleted.
+type Trigger struct {
+	// Name tells the function's triggers apart, it defaults to the type
+	// and the trigger's position, like cron-0
+	Name string `json:"name,omitempty"`
+	// Type is "cron", "webhook" or "http"
+	Type string `json:"type"`
+	// Cron, Timezone, JitterMs and Event are a cron trigger's schedule
+	Cron     string         `json:"cron,omitempty"`
+	Timezone string         `json:"timezone,omitempty"`
+	JitterMs int            `json:"jitterMs,omitempty"`
+	Event    map[string]any `json:"event,omitempty"`
+	// Secret signs a webhook trigger's deliveries, and Batch delivers them
+	// in batches rather than one invocation each
+	Secret string        `json:"secret,omitempty"`
+	Batch  *batch.Window `json:"batch,omitempty"`
+	// Method and Path are an http trigger's route, every method when
+	// Method is empty
+	Method string `json:"method,omitempty"`
+	Path   string `json:"path,omitempty"`
+}
+
+// triggerName is the trigger's name, or the default for its position.
+func triggerName(t Trigger, i int) string {
+	if t.Name != "" {
+		return t.Name
+	}
+	return fmt.Sprintf("%s-%d", t.Type, i)
+}
+
+// triggerScheduleID is the id of the schedule a cron trigger keeps.
+func triggerScheduleID(function, trigger string) string {
+	return triggerSchedulePrefix + function + ":" + trigger
+}
+
+// schedule is the schedule a cron trigger of the function keeps.
+func (t Trigger) schedule(function, name string) scheduler.Schedule {
+	return scheduler.Schedule{
+		ID:       triggerScheduleID(function, name),
+		Function: function,
+		Cron:     t.Cron,
+		Timezone: t.Timezone,
+		JitterMs: t.JitterMs,
+		Event:    t.Event,
+	}
+}
+
+// validateTriggers checks a function's triggers are of known types, named
+// uniquely and configured for their type.
+func validateTriggers(function string, triggers []Trigger, mode kappa.Mode) error {
+	if len(triggers) > 0 && mode == kappa.ModeTCP {
+		return fmt.Errorf("tcp functions take connections, not events")
+	}
+	names := make(map[string]bool, len(triggers))
+	for i, t := range triggers {
+		if !slices.Contains(triggerTypes, t.Type) {
+			return fmt.Errorf("unknown type %q, expected one of %v", t.Type, triggerTypes)
+		}
+		name := triggerName(t, i)
+		if !validTriggerName.MatchString(name) {
+			return fmt.Errorf("invalid name %q, expected lowercase letters, digits and dashes", name)
+		}
+		if names[name] {
+			return fmt.Errorf("duplicate name %q", name)
+		}
+		names[name] = true
+
+		if t.Type != triggerHTTP && (t.Method != "" || t.Path != "") {
+			return fmt.Errorf("%s: method and path are only for http triggers", name)
+		}
+		switch t.Type {
+		case triggerCron:
+			if t.Secret != "" || t.Batch != nil {
+				return fmt.Errorf("%s: secret and batch are only for webhook triggers", name)
+			}
+			if err := t.schedule(function, name).Validate(); err != nil {
+				return fmt.Errorf("%s: %w", name, err)
+			}
+		case triggerWebhook:
+			if t.Cron != "" || t.Timezone != "" || t.JitterMs != 0 || t.Event != nil {
+				return fmt.Errorf("%s: cron, timezone, jitterMs and event are only for cron triggers", name)
+			}
+			if len(t.Secret) < minWebhookSecret {
+				return fmt.Errorf("%s: webhooks need a secret of at least %d characters", name, minWebhookSecret)
+			}
+			if t.Batch != nil {
+				if err := t.Batch.Validate(); err != nil {
+					return fmt.Errorf("%s: invalid batch: %w", name, err)
+				}
+			}
+		case triggerHTTP:
+			if t.Cron != "" || t.Timezone != "" || t.JitterMs != 0 || t.Event != nil || t.Secret != "" || t.Batch != nil {
+				return fmt.Errorf("%s: http triggers only take a method and a path", name)
+			}
+			if t.Path == "" {
+				return fmt.Errorf("%s: missing path", name)
+			}
+			if err := (gateway.Route{Method: t.Method, Path: t.Path}).Validate(); err != nil {
+				return fmt.Errorf("%s: %w", name, err)
+			}
+		}
+	}
+	return nil
+}
+
+// maskedTriggers is triggers as the API shows them, the secrets of webhooks
+// masked.
+func maskedTriggers(triggers []Trigger) []Trigger {
+	masked := slices.Clone(triggers)
+	for i := range masked {
+		if masked[i].Secret != "" {
+			masked[i].Secret = settings.Masked
+		}
+	}
+	return masked
+}
+
+// unmaskedTriggers returns triggers with secrets still masked, as read from
+// the API, set back to the secrets of the previous triggers of the same
+// name. A masked secret without one is left to fail validation.
+func unmaskedTriggers(triggers, previous []Trigger) []Trigger {
+	secrets := make(map[string]string, len(previous))
+	for i, t := range previous {
+		secrets[triggerName(t, i)] = t.Secret
+	}
+	unmasked := slices.Clone(triggers)
+	for i := range unmasked {
+		if secret, exists := secrets[triggerName(unmasked[i], i)]; exists && unmasked[i].Secret == settings.Masked {
+			unmasked[i].Secret = secret
+		}
+	}
+	return unmasked
+}
+
+// reconcileTriggers makes the trigger subsystems match the function's
+// triggers, setting up the new ones, updating the changed ones and tearing
+// down those it no longer has. Deleted functions are reconciled with none.
+func (s *KappaService) reconcileTriggers(function string, triggers []Trigger) {
+	wanted := make(map[string]bool)
+	for i, t := range triggers {
+		if t.Type != triggerCron {
+			continue
+		}
+		schedule := t.schedule(function, triggerName(t, i))
+		wanted[schedule.ID] = true
+		if err := s.scheduler.Put(schedule); err != nil {
+			logger.Get().Error("Failed to schedule trigger", zap.String("name", function), zap.String("id", schedule.ID), zap.Error(err))
+		}
+	}
+	if err := s.gateway.Set(function, httpRoutes(function, triggers)); err != nil {
+		logger.Get().Error("Failed to route trigger", zap.String("name", function), zap.Error(err))
+	}
+	s.reconcileBatchers(function, triggers)
+	// Webhooks are looked up in the function's config as they are called
+	prefix := triggerScheduleID(function, "")
+	for _, schedule := range s.scheduler.List() {
+		if strings.HasPrefix(schedule.ID, prefix) && !wanted[schedule.ID] {
+			s.scheduler.Remove(schedule.ID)
+		}
+	}
+}
+
+// webhook finds the named function's webhook trigger.
+func (s *KappaService) webhook(function, name string) (Trigger, bool) {
+	for i, t := range s.config(function).Triggers {
+		if t.Type == triggerWebhook && triggerName(t, i) == name {
+			return t, true
+		}
+	}
+	return Trigger{}, false
+}
+
+// validSignature checks a webhook delivery's signature header. Anyone can
+// sign with an empty secret, so nothing signed with one is valid.
+func validSignature(secret string, body []byte, header string) bool {
+	if secret == "" {
+		return false
+	}
+	sum, err := hex.DecodeString(strings.TrimPrefix(header, signaturePrefix))
+	if err != nil || !strings.HasPrefix(header, signaturePrefix) {
+		return false
+	}
+	m := hmac.New(sha256.New, []byte(secret))
+	m.Write(body)
+	return hmac.Equal(sum, m.Sum(nil))
+}
+
+// HTTP handler for webhook triggers, invoking the function with deliveries
+// signed with the trigger's secret. They take no credentials, the
+// signature is proof enough, whatever the function's visibility.
+func (s *KappaService) invokeWebhook(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	name, trigger := vars["name"], vars["trigger"]
+
+	hook, exists := s.webhook(name, trigger)
+	if !exists {
+		http.Error(w, fmt.Sprintf("Webhook not found: %s/%s", name, trigger), http.StatusNotFound)
+		return
+	}
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to read request: %v", err), http.StatusBadRequest)
+		return
+	}
+	if !validSignature(hook.Secret, body, r.Header.Get(signatureHeader)) {
+		http.Error(w, "Invalid signature", http.StatusUnauthorized)
+		return
+	}
+
+	if hook.Batch != nil {
+		if fn, _, _ := s.lookup(name); s.rejectDisabled(w, name, fn) {
+			return
+		}
+		s.batchWebhook(w, r, name, trigger, body)
+		return
+	}
+
+	r.Body = io.NopCloser(bytes.NewReader(body))
+	r.Header.Del("Authorization")
+	r.Header.Set("X-Kappa-Trigger", trigger)
+	s.invokeFunction(w, r)
+}
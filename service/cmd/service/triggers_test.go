@@ -0,0 +1,112 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"kappa-v2/service/internal/settings"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const testWebhookSecret = "0123456789abcdef"
+
+func TestMaskedTriggers(t *testing.T) {
+	triggers := []Trigger{
+		{Type: triggerWebhook, Secret: testWebhookSecret},
+		{Type: triggerCron, Cron: "* * * * *"},
+	}
+	masked := maskedTriggers(triggers)
+	assert.Equal(t, settings.Masked, masked[0].Secret)
+	assert.Empty(t, masked[1].Secret)
+	assert.Equal(t, testWebhookSecret, triggers[0].Secret, "the triggers masked are left alone")
+
+	assert.Equal(t, triggers, unmaskedTriggers(masked, triggers))
+	// Only triggers of the same name get their secret back
+	renamed := maskedTriggers(triggers)
+	renamed[0].Name = "other"
+	assert.Equal(t, settings.Masked, unmaskedTriggers(renamed, triggers)[0].Secret)
+}
+
+func TestWebhookSecretsMasked(t *testing.T) {
+	s := newTestService(t)
+	register(t, s, map[string]any{
+		"name":     "hooked",
+		"mode":     "external",
+		"triggers": []map[string]any{{"type": "webhook", "secret": testWebhookSecret}},
+	})
+
+	rec := do(t, s, "GET", "/functions/hooked", nil)
+	require.Equal(t, http.StatusOK, rec.Code)
+	assert.NotContains(t, rec.Body.String(), testWebhookSecret)
+	var config KappaFunctionConfig
+	require.NoError(t, decodeInto(rec, &config))
+	assert.Equal(t, settings.Masked, config.Triggers[0].Secret)
+
+	rec = do(t, s, "GET", "/functions/hooked/versions", nil)
+	require.Equal(t, http.StatusOK, rec.Code)
+	assert.NotContains(t, rec.Body.String(), testWebhookSecret)
+
+	// Sending the config back as fetched keeps the secret
+	rec = do(t, s, "PUT", "/functions/hooked", config)
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	hook, exists := s.webhook("hooked", "webhook-0")
+	require.True(t, exists)
+	assert.Equal(t, testWebhookSecret, hook.Secret)
+}
+
+// sign signs body the way webhook senders do
+func sign(secret, body string) string {
+	m := hmac.New(sha256.New, []byte(secret))
+	m.Write([]byte(body))
+	return signaturePrefix + hex.EncodeToString(m.Sum(nil))
+}
+
+func TestValidSignature(t *testing.T) {
+	body := `{"event":"push"}`
+	tests := []struct {
+		name   string
+		secret string
+		header string
+		valid  bool
+	}{
+		{"good signature", testWebhookSecret, sign(testWebhookSecret, body), true},
+		{"other body", testWebhookSecret, sign(testWebhookSecret, `{"event":"pull"}`), false},
+		{"other secret", testWebhookSecret, sign("fedcba9876543210", body), false},
+		{"no prefix", testWebhookSecret, strings.TrimPrefix(sign(testWebhookSecret, body), signaturePrefix), false},
+		{"not hex", testWebhookSecret, signaturePrefix + "zz", false},
+		{"missing header", testWebhookSecret, "", false},
+		{"trigger without a secret", "", sign("", body), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.valid, validSignature(tt.secret, []byte(body), tt.header))
+		})
+	}
+}
+
+func TestInvokeWebhook(t *testing.T) {
+	s := newTestService(t)
+	register(t, s, map[string]any{
+		"name":     "hooked",
+		"mode":     "external",
+		"triggers": []map[string]any{{"type": "webhook", "secret": testWebhookSecret}},
+	})
+	attachRuntime(t, s, "hooked", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"ok":true}`))
+	})
+	body := `{"event":"push"}`
+
+	rec := do(t, s, "POST", "/hooks/hooked/webhook-0", body, signatureHeader, sign(testWebhookSecret, body))
+	assert.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	rec = do(t, s, "POST", "/hooks/hooked/webhook-0", body, signatureHeader, sign("fedcba9876543210", body))
+	assert.Equal(t, http.StatusUnauthorized, rec.Code)
+	rec = do(t, s, "POST", "/hooks/hooked/webhook-0", body)
+	assert.Equal(t, http.StatusUnauthorized, rec.Code)
+	rec = do(t, s, "POST", "/hooks/hooked/missing", body, signatureHeader, sign(testWebhookSecret, body))
+	assert.Equal(t, http.StatusNotFound, rec.Code)
+}
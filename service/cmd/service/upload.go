@@ -0,0 +1,140 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"kappa-v2/pkg/logger"
+	"kappa-v2/service/internal/artifact"
+	"kappa-v2/service/internal/kappa"
+	"kappa-v2/service/internal/rbac"
+	"kappa-v2/service/internal/sbom"
+	"net/http"
+
+	"github.com/gorilla/mux"
+	"go.uber.org/zap"
+)
+
+const (
+	// defaultMaxUploadBytes is the largest code upload, binary or archive,
+	// and the largest binary extracted from an archive
+	defaultMaxUploadBytes = 256 << 20
+	// uploadMemoryBytes of an upload are kept in memory, the rest is
+	// spooled to disk while the form is parsed
+	uploadMemoryBytes = 32 << 20
+)
+
+// HTTP handler for registering or redeploying a function with uploaded
+// code rather than a binary already on the service's host. The request is
+// a multipart form whose code file is the binary or a zip archive, whose
+// entry field names the archive's file to run, bootstrap by default, and
+// whose config field is the function's config as JSON, without a
+// binaryPath. The code is kept in the artifact store like imported
+// binaries.
+func (s *KappaService) uploadFunctionCode(w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["name"]
+
+	r.Body = http.MaxBytesReader(w, r.Body, s.maxUploadBytes)
+	if err := r.ParseMultipartForm(uploadMemoryBytes); err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			http.Error(w, fmt.Sprintf("Upload is larger than %d bytes", s.maxUploadBytes), http.StatusRequestEntityTooLarge)
+			return
+		}
+		http.Error(w, fmt.Sprintf("Invalid request: %v", err), http.StatusBadRequest)
+		return
+	}
+	defer r.MultipartForm.RemoveAll()
+
+	var config KappaFunctionConfig
+	if data := r.FormValue("config"); data != "" {
+		if err := json.Unmarshal([]byte(data), &config); err != nil {
+			http.Error(w, fmt.Sprintf("Invalid config: %v", err), http.StatusBadRequest)
+			return
+		}
+	}
+	if config.Name == "" {
+		config.Name = name
+	}
+	if config.Name != name {
+		http.Error(w, fmt.Sprintf("Name %s doesn't match the function uploaded: %s", config.Name, name), http.StatusBadRequest)
+		return
+	}
+	if config.BinaryPath != "" || config.Runtime != nil {
+		http.Error(w, "Invalid config: the uploaded code replaces binaryPath and runtime", http.StatusBadRequest)
+		return
+	}
+	if mode, err := kappa.ParseMode(config.Mode); err == nil && mode == kappa.ModeExternal {
+		http.Error(w, "Invalid mode: external functions are run by their own supervisor, without uploaded code", http.StatusBadRequest)
+		return
+	}
+	if config.Image == "" && config.Backend != "process" && config.Backend != "vm" {
+		http.Error(w, "Missing required fields: image", http.StatusBadRequest)
+		return
+	}
+	if !s.allowed(r.Context(), rbac.Deploy, s.deployTargets(name, config.Project)...) {
+		http.Error(w, fmt.Sprintf("Forbidden: may not deploy %s to %s", name, projectLabel(config.Project)), http.StatusForbidden)
+		return
+	}
+	if !checkPreconditions(w, r, s.functionETag(name)) {
+		return
+	}
+
+	file, _, err := r.FormFile("code")
+	if err != nil {
+		http.Error(w, "Missing required fields: code", http.StatusBadRequest)
+		return
+	}
+	defer file.Close()
+	digest, err := s.artifacts.PutUpload(file, r.FormValue("entry"), s.maxUploadBytes)
+	if errors.Is(err, artifact.ErrInvalidUpload) {
+		http.Error(w, fmt.Sprintf("Invalid code: %v", err), http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to store code: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	// Record the dependencies the binary was built with, as for imported ones
+	bom, err := sbom.Generate(name, s.artifacts.Path(digest), config.Lockfiles)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to generate SBOM: %v", err), http.StatusBadRequest)
+		return
+	}
+	bomJSON, err := json.Marshal(bom)
+	if err == nil {
+		err = s.artifacts.PutMeta(digest, "sbom", bomJSON)
+	}
+	if err != nil {
+		logger.Get().Warn("Failed to store SBOM", zap.String("name", name), zap.Error(err))
+	}
+
+	old, _, exists := s.lookup(name)
+	fn, regErr := s.prepareFunctionFrom(&config, digest)
+	if regErr != nil {
+		http.Error(w, regErr.msg, regErr.status)
+		return
+	}
+	s.commitFunction(config, fn)
+	status, statusCode := "registered", http.StatusCreated
+	if exists {
+		status, statusCode = "updated", http.StatusOK
+		if old.IsRunning() {
+			if err := old.Stop(); err != nil {
+				logger.FromCtx(r.Context()).Warn("Failed to stop replaced function", zap.String("name", name), zap.Error(err))
+			}
+		}
+	}
+
+	w.Header().Set("ETag", s.functionETag(name))
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(statusCode)
+	history, _ := s.versionHistory(name)
+	json.NewEncoder(w).Encode(map[string]any{
+		"name":    name,
+		"status":  status,
+		"sha256":  fn.ArtifactDigest,
+		"version": history[len(history)-1].Version,
+	})
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// upload uploads code for a function, with the form's other fields, and
+// records the response.
+func upload(t *testing.T, s *KappaService, name string, code []byte, fields map[string]string, header ...string) *httptest.ResponseRecorder {
+	t.Helper()
+	var body bytes.Buffer
+	form := multipart.NewWriter(&body)
+	for key, value := range fields {
+		require.NoError(t, form.WriteField(key, value))
+	}
+	if code != nil {
+		part, err := form.CreateFormFile("code", "code")
+		require.NoError(t, err)
+		part.Write(code)
+	}
+	require.NoError(t, form.Close())
+	return do(t, s, "POST", "/functions/"+name+"/code", body.String(), append([]string{"Content-Type", form.FormDataContentType()}, header...)...)
+}
+
+// zipped returns a zip archive of the files.
+func zipped(t *testing.T, files map[string]string) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	archive := zip.NewWriter(&buf)
+	for name, content := range files {
+		w, err := archive.Create(name)
+		require.NoError(t, err)
+		w.Write([]byte(content))
+	}
+	require.NoError(t, archive.Close())
+	return buf.Bytes()
+}
+
+func TestUploadFunctionCode(t *testing.T) {
+	s := newTestService(t)
+	config := map[string]string{"config": `{"backend":"process"}`}
+
+	rec := upload(t, s, "orders", []byte("binary"), config)
+	require.Equal(t, http.StatusCreated, rec.Code, rec.Body.String())
+	registered := decode(t, rec)
+	assert.Equal(t, "registered", registered["status"])
+	assert.Equal(t, 1.0, registered["version"])
+	assert.NotEmpty(t, registered["sha256"])
+	etag := rec.Header().Get("ETag")
+	assert.NotEmpty(t, etag)
+	fn, _, exists := s.lookup("orders")
+	require.True(t, exists)
+	assert.Equal(t, registered["sha256"], fn.ArtifactDigest)
+
+	// An archive runs the entry it names
+	rec = upload(t, s, "orders", zipped(t, map[string]string{"bin/run": "binary v2"}), map[string]string{
+		"config": `{"backend":"process"}`,
+		"entry":  "bin/run",
+	}, "If-Match", etag)
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	updated := decode(t, rec)
+	assert.Equal(t, "updated", updated["status"])
+	assert.Equal(t, 2.0, updated["version"])
+	assert.NotEqual(t, registered["sha256"], updated["sha256"])
+}
+
+func TestUploadFunctionCode_Rejected(t *testing.T) {
+	s := newTestService(t)
+	rec := upload(t, s, "orders", []byte("binary"), map[string]string{"config": `{"backend":"process"}`})
+	require.Equal(t, http.StatusCreated, rec.Code, rec.Body.String())
+
+	tests := []struct {
+		name   string
+		code   []byte
+		fields map[string]string
+		header []string
+		want   int
+	}{
+		{"no code", nil, map[string]string{"config": `{"backend":"process"}`}, nil, http.StatusBadRequest},
+		{"invalid config", []byte("binary"), map[string]string{"config": `{`}, nil, http.StatusBadRequest},
+		{"another function's name", []byte("binary"), map[string]string{"config": `{"name":"billing","backend":"process"}`}, nil, http.StatusBadRequest},
+		{"binary path", []byte("binary"), map[string]string{"config": `{"backend":"process","binaryPath":"/bin/true"}`}, nil, http.StatusBadRequest},
+		{"external", []byte("binary"), map[string]string{"config": `{"mode":"external"}`}, nil, http.StatusBadRequest},
+		{"no image", []byte("binary"), nil, nil, http.StatusBadRequest},
+		{"archive without the entry", zipped(t, map[string]string{"main": "binary"}), map[string]string{"config": `{"backend":"process"}`}, nil, http.StatusBadRequest},
+		{"stale etag", []byte("binary"), map[string]string{"config": `{"backend":"process"}`}, []string{"If-Match", `"stale"`}, http.StatusPreconditionFailed},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := upload(t, s, "orders", tt.code, tt.fields, tt.header...)
+			assert.Equal(t, tt.want, rec.Code, rec.Body.String())
+		})
+	}
+
+	rec = do(t, s, "POST", "/functions/orders/code", map[string]any{"backend": "process"})
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+	s.maxUploadBytes = 64
+	rec = upload(t, s, "orders", bytes.Repeat([]byte("x"), 128), map[string]string{"config": `{"backend":"process"}`})
+	assert.Equal(t, http.StatusRequestEntityTooLarge, rec.Code)
+
+	history, _ := s.versionHistory("orders")
+	assert.Len(t, history, 1, "rejected uploads deploy nothing")
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"kappa-v2/service/internal/rbac"
+	"kappa-v2/service/internal/usage"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// defaultUsageWindow is how far back usage is reported without a from
+const defaultUsageWindow = 24 * time.Hour
+
+// HTTP handler for reporting usage per function or project over a window,
+// as JSON or CSV
+func (s *KappaService) getUsage(w http.ResponseWriter, r *http.Request) {
+	params := r.URL.Query()
+	q := usage.Query{
+		To:       time.Now(),
+		Function: params.Get("function"),
+		Project:  params.Get("project"),
+	}
+	var err error
+	if v := params.Get("to"); v != "" {
+		if q.To, err = time.Parse(time.RFC3339, v); err != nil {
+			http.Error(w, fmt.Sprintf("Invalid to: %s, expected RFC 3339", v), http.StatusBadRequest)
+			return
+		}
+	}
+	q.From = q.To.Add(-defaultUsageWindow)
+	if v := params.Get("from"); v != "" {
+		if q.From, err = time.Parse(time.RFC3339, v); err != nil {
+			http.Error(w, fmt.Sprintf("Invalid from: %s, expected RFC 3339", v), http.StatusBadRequest)
+			return
+		}
+	}
+	if v := params.Get("interval"); v != "" {
+		if q.Interval, err = time.ParseDuration(v); err != nil {
+			http.Error(w, fmt.Sprintf("Invalid interval: %s", v), http.StatusBadRequest)
+			return
+		}
+	}
+	if q.GroupBy, err = usage.ParseGroupBy(params.Get("groupBy")); err != nil {
+		http.Error(w, fmt.Sprintf("Invalid groupBy: %v", err), http.StatusBadRequest)
+		return
+	}
+	if err := q.Validate(); err != nil {
+		http.Error(w, fmt.Sprintf("Invalid window: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	rows := s.usage.Query(q)
+	visible := rows[:0]
+	for _, row := range rows {
+		if s.allowed(r.Context(), rbac.Read, row.Project) {
+			visible = append(visible, row)
+		}
+	}
+
+	format := params.Get("format")
+	if format == "" && strings.Contains(r.Header.Get("Accept"), "text/csv") {
+		format = "csv"
+	}
+	switch format {
+	case "csv":
+		w.Header().Set("Content-Type", "text/csv")
+		w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="usage-%s.csv"`, q.From.UTC().Format("20060102T1504")))
+		usage.WriteCSV(w, visible, q.GroupBy)
+	case "", "json":
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]any{
+			"from":    q.From,
+			"to":      q.To,
+			"groupBy": q.GroupBy,
+			"usage":   visible,
+		})
+	default:
+		http.Error(w, fmt.Sprintf("Invalid format: %s, expected json or csv", format), http.StatusBadRequest)
+	}
+}
+
+// defaultEstimateWindow is how much recent usage cost estimates project from
+const defaultEstimateWindow = 7 * 24 * time.Hour
+
+// HTTP handler for projecting a function's monthly usage and cost from its
+// recent invocations, suggesting a lower memory limit when it uses far less
+func (s *KappaService) getCostEstimate(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	name := vars["name"]
+
+	_, config, exists := s.lookup(name)
+	if !exists {
+		http.Error(w, fmt.Sprintf("Function not found: %s", name), http.StatusNotFound)
+		return
+	}
+	window := defaultEstimateWindow
+	if v := r.URL.Query().Get("window"); v != "" {
+		var err error
+		if window, err = time.ParseDuration(v); err != nil || window < time.Hour {
+			http.Error(w, fmt.Sprintf("Invalid window: %s, expected a duration of at least 1h", v), http.StatusBadRequest)
+			return
+		}
+	}
+
+	memoryMB := s.effectiveSettings(config).MemoryMB.Value
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(s.usage.Estimate(name, window, memoryMB, s.pricing))
+}
@@ -0,0 +1,296 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"kappa-v2/pkg/logger"
+	"kappa-v2/service/internal/audit"
+	"kappa-v2/service/internal/kappa"
+	"kappa-v2/service/internal/rbac"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+	"go.uber.org/zap"
+)
+
+// defaultKeptVersions is how many versions before the current one are kept
+// to roll back to
+const defaultKeptVersions = 5
+
+// functionVersion is a config a function was registered with, and the
+// binary it ran.
+type functionVersion struct {
+	Version    int                 `json:"version"`
+	Config     KappaFunctionConfig `json:"config"`
+	Digest     string              `json:"sha256,omitempty"`
+	DeployedAt time.Time           `json:"deployedAt"`
+	// RolledBackFrom is the version that was current when this one was
+	// restored by a rollback
+	RolledBackFrom int `json:"rolledBackFrom,omitempty"`
+}
+
+// recordVersion adds a newly committed function to its history, holding a
+// reference on its binary until the version is dropped, and drops versions
+// past the kept ones.
+func (s *KappaService) recordVersion(config KappaFunctionConfig, fn *kappa.KappaFunction) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	history := s.versions[config.Name]
+	v := functionVersion{
+		Version:    1,
+		Config:     config,
+		Digest:     fn.ArtifactDigest,
+		DeployedAt: time.Now(),
+	}
+	if len(history) > 0 {
+		v.Version = history[len(history)-1].Version + 1
+	}
+	// Its instances are named after the version
+	fn.SetVersion(v.Version)
+	if v.Digest != "" {
+		if err := s.artifacts.Acquire(v.Digest); err != nil {
+			logger.Get().Warn("Failed to keep binary for rollback", zap.String("name", config.Name), zap.Error(err))
+			v.Digest = ""
+		}
+	}
+	history = append(history, v)
+
+	for len(history) > s.keptVersions+1 {
+		s.releaseVersion(history[0])
+		history = history[1:]
+	}
+	s.versions[config.Name] = history
+}
+
+// restoreVersions brings back the history stored for a function restored
+// on start, in place of the version registering it recorded. The stored
+// current version takes the config the function was restored with.
+// Functions stored without a history start theirs with that version.
+func (s *KappaService) restoreVersions(name string) {
+	stored := s.storedVersions(name)
+	if len(stored) == 0 {
+		s.saveVersion(name)
+		return
+	}
+	earlier := stored[:len(stored)-1]
+	for i := range earlier {
+		if earlier[i].Digest == "" {
+			continue
+		}
+		if err := s.artifacts.Acquire(earlier[i].Digest); err != nil {
+			logger.Get().Warn("Failed to keep binary for rollback", zap.String("name", name), zap.Int("version", earlier[i].Version), zap.Error(err))
+			earlier[i].Digest = ""
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	history := s.versions[name]
+	if len(history) == 0 {
+		return
+	}
+	current := history[len(history)-1]
+	last := stored[len(stored)-1]
+	current.Version, current.DeployedAt, current.RolledBackFrom = last.Version, last.DeployedAt, last.RolledBackFrom
+	s.functions[name].SetVersion(current.Version)
+	history = append(earlier, current)
+	for len(history) > s.keptVersions+1 {
+		s.releaseVersion(history[0])
+		history = history[1:]
+	}
+	s.versions[name] = history
+}
+
+// dropVersions forgets a deleted function's history, stored too.
+func (s *KappaService) dropVersions(name string) {
+	s.mu.Lock()
+	history := s.versions[name]
+	delete(s.versions, name)
+	s.mu.Unlock()
+	for _, v := range history {
+		s.releaseVersion(v)
+	}
+	s.forgetVersions(name)
+}
+
+func (s *KappaService) releaseVersion(v functionVersion) {
+	if v.Digest == "" {
+		return
+	}
+	if err := s.artifacts.Release(v.Digest); err != nil {
+		logger.Get().Warn("Failed to release artifact", zap.String("name", v.Config.Name), zap.Error(err))
+	}
+}
+
+// HTTP handler for listing the versions a function can be rolled back to,
+// newest first
+func (s *KappaService) listVersions(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	name := vars["name"]
+
+	history, exists := s.versionHistory(name)
+	if !exists {
+		http.Error(w, fmt.Sprintf("Function not found: %s", name), http.StatusNotFound)
+		return
+	}
+
+	versions := make([]functionVersion, 0, len(history))
+	for i := len(history) - 1; i >= 0; i-- {
+		v := history[i]
+		v.Config = s.maskedConfig(v.Config)
+		versions = append(versions, v)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{
+		"current":  history[len(history)-1].Version,
+		"versions": versions,
+	})
+}
+
+// rollbackRequest picks the version to roll back to, the one before the
+// current one when 0
+type rollbackRequest struct {
+	Version int `json:"version"`
+}
+
+// HTTP handler for rolling a function back to a kept version. The version
+// is started before the function is re-pointed at it, so the rollback
+// doesn't fail over to a cold start, and recorded as a new version.
+func (s *KappaService) rollbackFunction(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	name := vars["name"]
+
+	history, exists := s.versionHistory(name)
+	if !exists {
+		http.Error(w, fmt.Sprintf("Function not found: %s", name), http.StatusNotFound)
+		return
+	}
+	var req rollbackRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil && !errors.Is(err, io.EOF) {
+		http.Error(w, fmt.Sprintf("Invalid request: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	current := history[len(history)-1]
+	var target *functionVersion
+	for i := len(history) - 2; i >= 0; i-- {
+		if req.Version == 0 || history[i].Version == req.Version {
+			target = &history[i]
+			break
+		}
+	}
+	if target == nil {
+		if req.Version == current.Version {
+			http.Error(w, fmt.Sprintf("Version %d is already current", req.Version), http.StatusConflict)
+			return
+		}
+		if req.Version == 0 {
+			http.Error(w, fmt.Sprintf("No earlier version of %s to roll back to", name), http.StatusConflict)
+			return
+		}
+		http.Error(w, fmt.Sprintf("Version not found: %d", req.Version), http.StatusNotFound)
+		return
+	}
+
+	config := target.Config
+	if !s.allowed(r.Context(), rbac.Deploy, config.Project) {
+		http.Error(w, fmt.Sprintf("Forbidden: may not deploy %s to %s", name, projectLabel(config.Project)), http.StatusForbidden)
+		return
+	}
+	if !checkPreconditions(w, r, s.functionETag(name)) {
+		return
+	}
+
+	fn, regErr := s.prepareFunctionFrom(&config, target.Digest)
+	if regErr != nil {
+		http.Error(w, regErr.msg, regErr.status)
+		return
+	}
+
+	// Warm the old version up before switching to it, keeping the current
+	// one when it doesn't start
+	if fn.Mode() == kappa.ModeHTTP {
+		ctx, cancel := context.WithTimeout(r.Context(), fn.Timeout())
+		err := fn.Start(ctx)
+		cancel()
+		if err != nil {
+			s.releaseFunction(fn)
+			http.Error(w, fmt.Sprintf("Failed to start version %d: %v", target.Version, err), http.StatusBadGateway)
+			return
+		}
+	}
+
+	// The version is stored once it says what it was rolled back from
+	old, _, _ := s.lookup(name)
+	s.addFunction(config, fn)
+	s.persistFunction(config, fn)
+	s.mu.Lock()
+	history = s.versions[name]
+	history[len(history)-1].RolledBackFrom = current.Version
+	version := history[len(history)-1].Version
+	s.mu.Unlock()
+	s.saveVersion(name)
+	if old != nil && old.IsRunning() {
+		if err := old.Stop(); err != nil {
+			logger.FromCtx(r.Context()).Warn("Failed to stop replaced function", zap.String("name", name), zap.Error(err))
+		}
+	}
+
+	s.audit.Record(audit.Entry{
+		Actor:    actor(r.Context()),
+		Action:   "function.rollback",
+		Function: name,
+		Project:  config.Project,
+		Detail: map[string]any{
+			"from":     current.Version,
+			"to":       target.Version,
+			"version":  version,
+			"sha256":   target.Digest,
+			"previous": current.Digest,
+		},
+	})
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("ETag", s.functionETag(name))
+	json.NewEncoder(w).Encode(map[string]any{
+		"name":       name,
+		"status":     "rolled back",
+		"version":    version,
+		"restored":   target.Version,
+		"rolledBack": current.Version,
+		"sha256":     target.Digest,
+	})
+}
+
+// HTTP handler for listing recorded changes to functions in projects the
+// caller may read, newest first, from the database when there is one
+func (s *KappaService) listAudit(w http.ResponseWriter, r *http.Request) {
+	function := r.URL.Query().Get("function")
+	visible := func(e audit.Entry) bool {
+		return (function == "" || e.Function == function) && s.allowed(r.Context(), rbac.Read, e.Project)
+	}
+	var entries []audit.Entry
+	if s.postgres != nil {
+		stored, err := s.storedAudit(function)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Failed to list audit entries: %v", err), http.StatusInternalServerError)
+			return
+		}
+		entries = []audit.Entry{}
+		for _, e := range stored {
+			if visible(e) {
+				entries = append(entries, e)
+			}
+		}
+	} else {
+		entries = s.audit.List(visible)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{
+		"entries": entries,
+	})
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"kappa-v2/service/internal/audit"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRollbackFunction(t *testing.T) {
+	s := newTestService(t)
+	for _, timeout := range []int{1000, 2000, 3000} {
+		register(t, s, map[string]any{"name": "orders", "mode": "external", "timeoutMs": timeout})
+	}
+
+	rec := do(t, s, "GET", "/functions/orders/versions", nil)
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	var listed struct {
+		Current  int               `json:"current"`
+		Versions []functionVersion `json:"versions"`
+	}
+	require.NoError(t, decodeInto(rec, &listed))
+	assert.Equal(t, 3, listed.Current)
+	assert.Equal(t, []int{3, 2, 1}, versionNumbers(listed.Versions), "newest first")
+
+	// Without a body the version before the current one is restored, as a
+	// new version
+	rec = do(t, s, "POST", "/functions/orders/rollback", nil)
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	assert.Equal(t, map[string]any{
+		"name": "orders", "status": "rolled back", "version": float64(4), "restored": float64(2), "rolledBack": float64(3), "sha256": "",
+	}, decode(t, rec))
+	assert.Equal(t, 2000, *s.config("orders").TimeoutMs)
+
+	rec = do(t, s, "POST", "/functions/orders/rollback", map[string]any{"version": 1})
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	assert.Equal(t, float64(5), decode(t, rec)["version"])
+	assert.Equal(t, 1000, *s.config("orders").TimeoutMs)
+
+	history, _ := s.versionHistory("orders")
+	require.Len(t, history, 5)
+	assert.Equal(t, 3, history[3].RolledBackFrom)
+	assert.Equal(t, 4, history[4].RolledBackFrom)
+	assert.Zero(t, history[2].RolledBackFrom)
+	entries := s.audit.List(func(e audit.Entry) bool { return e.Action == "function.rollback" })
+	require.Len(t, entries, 2)
+	assert.Equal(t, 4, entries[0].Detail["from"])
+	assert.Equal(t, 1, entries[0].Detail["to"])
+
+	rec = do(t, s, "POST", "/functions/orders/rollback", map[string]any{"version": 5})
+	assert.Equal(t, http.StatusConflict, rec.Code)
+	assert.Contains(t, rec.Body.String(), "Version 5 is already current")
+	rec = do(t, s, "POST", "/functions/orders/rollback", map[string]any{"version": 42})
+	assert.Equal(t, http.StatusNotFound, rec.Code)
+	rec = do(t, s, "POST", "/functions/orders/rollback", "{")
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+	rec = do(t, s, "POST", "/functions/missing/rollback", nil)
+	assert.Equal(t, http.StatusNotFound, rec.Code)
+	rec = do(t, s, "GET", "/functions/missing/versions", nil)
+	assert.Equal(t, http.StatusNotFound, rec.Code)
+
+	register(t, s, map[string]any{"name": "billing", "mode": "external"})
+	rec = do(t, s, "POST", "/functions/billing/rollback", nil)
+	assert.Equal(t, http.StatusConflict, rec.Code)
+	assert.Contains(t, rec.Body.String(), "No earlier version of billing")
+}
+
+func TestRollbackFunction_FailedStartKeepsCurrent(t *testing.T) {
+	s := newTestService(t)
+	respond := func(w http.ResponseWriter, r *http.Request) { w.Write([]byte(`{}`)) }
+	registerFake(t, s, map[string]any{"name": "orders", "env": []string{"MODE=old"}}, respond)
+	registerFake(t, s, map[string]any{"name": "orders", "env": []string{"MODE=new"}}, respond)
+	current, _, _ := s.lookup("orders")
+
+	// Version 1 runs on the real process backend, where its binary isn't
+	// one, so it never starts
+	rec := do(t, s, "POST", "/functions/orders/rollback", nil)
+	assert.Equal(t, http.StatusBadGateway, rec.Code)
+	assert.Contains(t, rec.Body.String(), "Failed to start version 1")
+
+	fn, config, _ := s.lookup("orders")
+	assert.Same(t, current, fn)
+	assert.Equal(t, []string{"MODE=new"}, config.Env)
+	history, _ := s.versionHistory("orders")
+	assert.Equal(t, []int{1, 2}, versionNumbers(history))
+	rec = do(t, s, "POST", "/functions/orders", map[string]any{})
+	assert.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+}
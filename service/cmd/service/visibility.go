@@ -0,0 +1,122 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"kappa-v2/pkg/handler"
+	"kappa-v2/service/internal/kappa"
+	"kappa-v2/service/internal/rbac"
+	"net/http"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+// Who may invoke a function when the service requires credentials. Private
+// functions, the default, need them like every route. Public ones also take
+// anonymous calls on their HTTP, WebSocket and gRPC routes.
+const (
+	visibilityPrivate = "private"
+	visibilityPublic  = "public"
+)
+
+func validateVisibility(v string) error {
+	if v != "" && v != visibilityPrivate && v != visibilityPublic {
+		return fmt.Errorf("unknown visibility %q, expected private or public", v)
+	}
+	return nil
+}
+
+// visibility is the named function's visibility, private unless set
+func (s *KappaService) visibility(name string) string {
+	if v := s.config(name).Visibility; v != "" {
+		return v
+	}
+	return visibilityPrivate
+}
+
+// proxied wraps a function's proxy routes. Public functions take calls
+// without credentials on them, calls with credentials and calls to private
+// functions need the invoke permission as usual.
+func (s *KappaService) proxied(next http.HandlerFunc) http.HandlerFunc {
+	authorized := s.authorize(rbac.Invoke, s.functionProject, next)
+	return func(w http.ResponseWriter, r *http.Request) {
+		if s.visibility(mux.Vars(r)["name"]) == visibilityPublic && r.Header.Get("Authorization") == "" {
+			next(w, r)
+			return
+		}
+		authorized(w, r)
+	}
+}
+
+// callerTokenPrefix starts the tokens functions invoke others with
+const callerTokenPrefix = "kfn."
+
+// callerTokens sign the tokens functions get to invoke other functions,
+// private ones included, with a key made when the service starts. Instances
+// are started by the service, so they never hold a token of another key.
+type callerTokens struct {
+	key []byte
+}
+
+func newCallerTokens() (*callerTokens, error) {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return nil, err
+	}
+	return &callerTokens{key: key}, nil
+}
+
+func (c *callerTokens) mac(name string) []byte {
+	m := hmac.New(sha256.New, c.key)
+	m.Write([]byte(name))
+	return m.Sum(nil)
+}
+
+// token is the named function's caller token.
+func (c *callerTokens) token(name string) string {
+	return callerTokenPrefix + name + "." + hex.EncodeToString(c.mac(name))
+}
+
+// verify returns the function token was made for.
+func (c *callerTokens) verify(token string) (string, bool) {
+	rest, ok := strings.CutPrefix(token, callerTokenPrefix)
+	i := strings.LastIndexByte(rest, '.')
+	if !ok || i < 0 {
+		return "", false
+	}
+	name := rest[:i]
+	sum, err := hex.DecodeString(rest[i+1:])
+	if err != nil || !hmac.Equal(sum, c.mac(name)) {
+		return "", false
+	}
+	return name, true
+}
+
+// callerSubject is who a function invoking others is, allowed to invoke
+// functions in every project and nothing else.
+func callerSubject(name string) rbac.Subject {
+	return rbac.Subject{
+		Name:     "function:" + name,
+		Bindings: []rbac.Binding{{Role: rbac.Invoker, Project: rbac.AllProjects}},
+	}
+}
+
+// callerEnv adds a function's caller token to its resolved env, so it
+// never shows in the function's settings.
+type callerEnv struct {
+	next  kappa.EnvResolver
+	token string
+}
+
+func (c callerEnv) ResolveEnv(ctx context.Context, env []string) ([]string, error) {
+	resolved, err := c.next.ResolveEnv(ctx, env)
+	if err != nil {
+		return nil, err
+	}
+	return append(resolved, handler.EnvCallerToken+"="+c.token), nil
+}
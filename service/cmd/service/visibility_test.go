@@ -0,0 +1,53 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCallerTokens(t *testing.T) {
+	tokens, err := newCallerTokens()
+	require.NoError(t, err)
+	valid := tokens.token("orders")
+	// Tokens don't expire on their own, they go with the key the service
+	// made when it started
+	restarted, err := newCallerTokens()
+	require.NoError(t, err)
+	forged := hmac.New(sha256.New, make([]byte, 32))
+	forged.Write([]byte("orders"))
+	tampered := valid[:len(valid)-1] + "0"
+	if strings.HasSuffix(valid, "0") {
+		tampered = valid[:len(valid)-1] + "1"
+	}
+
+	tests := []struct {
+		name   string
+		token  string
+		caller string
+		ok     bool
+	}{
+		{"valid", valid, "orders", true},
+		{"dotted name", tokens.token("shop.orders"), "shop.orders", true},
+		{"tampered name", strings.Replace(valid, "orders", "billing", 1), "", false},
+		{"tampered mac", tampered, "", false},
+		{"issued before a restart", restarted.token("orders"), "", false},
+		{"wrong key", callerTokenPrefix + "orders." + hex.EncodeToString(forged.Sum(nil)), "", false},
+		{"not hex", callerTokenPrefix + "orders.zz", "", false},
+		{"no mac", callerTokenPrefix + "orders", "", false},
+		{"no prefix", strings.TrimPrefix(valid, callerTokenPrefix), "", false},
+		{"empty", "", "", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			caller, ok := tokens.verify(tt.token)
+			assert.Equal(t, tt.ok, ok)
+			assert.Equal(t, tt.caller, caller)
+		})
+	}
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"kappa-v2/pkg/logger"
+	"kappa-v2/service/internal/kappa"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+	"go.uber.org/zap"
+)
+
+const (
+	// maxWarmInstances is how many instances a function is kept warm with.
+	// Functions run a single instance serving their invocations
+	// concurrently, so there is no pool of them to keep warm.
+	maxWarmInstances = 1
+	// warmCheckInterval is how often warm functions that aren't running
+	// are started
+	warmCheckInterval = 10 * time.Second
+	// warmStartTimeout bounds starting a warm function in the background
+	warmStartTimeout = 2 * time.Minute
+)
+
+func validateWarmInstances(instances int, mode kappa.Mode) error {
+	if instances == 0 {
+		return nil
+	}
+	if instances < 0 || instances > maxWarmInstances {
+		return fmt.Errorf("must be between 0 and %d, a function runs one instance serving invocations concurrently", maxWarmInstances)
+	}
+	if mode == kappa.ModeJob || mode == kappa.ModeExternal {
+		return fmt.Errorf("%s functions have no instance the service keeps started", mode)
+	}
+	return nil
+}
+
+// HTTP handler for setting how many instances of a function are kept
+// started, eliminating its cold starts. The function is started right
+// away, and kept in its config for restarts and redeploys.
+func (s *KappaService) warmFunction(w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["name"]
+	fn, _, exists := s.lookup(name)
+	if !exists {
+		http.Error(w, fmt.Sprintf("Function not found: %s", name), http.StatusNotFound)
+		return
+	}
+
+	var body struct {
+		Instances *int `json:"instances"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		http.Error(w, fmt.Sprintf("Invalid request: %v", err), http.StatusBadRequest)
+		return
+	}
+	if body.Instances == nil {
+		http.Error(w, "Invalid request: instances is required", http.StatusBadRequest)
+		return
+	}
+	instances := *body.Instances
+	if err := validateWarmInstances(instances, fn.Mode()); err != nil {
+		http.Error(w, fmt.Sprintf("Invalid instances: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	config, err := s.updateConfig(name, func(config *KappaFunctionConfig) error {
+		config.WarmInstances = instances
+		return nil
+	})
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Function not found: %s", name), http.StatusNotFound)
+		return
+	}
+	fn.SetWarm(instances > 0)
+	s.persistFunction(config, fn)
+
+	log := logger.FromCtx(r.Context())
+	if instances > 0 && !fn.IsRunning() {
+		if err := fn.Start(r.Context()); err != nil {
+			log.Warn("Failed to start warm function", zap.String("name", name), zap.Error(err))
+			http.Error(w, fmt.Sprintf("Failed to start function: %v, starting it is retried in the background", err), http.StatusBadGateway)
+			return
+		}
+	}
+	log.Info("Function warm instances changed", zap.String("name", name), zap.Int("instances", instances))
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{
+		"name":          name,
+		"warmInstances": instances,
+		"running":       fn.IsRunning(),
+	})
+}
+
+// keepWarmEvery starts the warm functions that aren't running on an
+// interval: those just registered, and those whose instance exited or
+// failed to start.
+func (s *KappaService) keepWarmEvery(interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			functions, _ := s.snapshot()
+			for name, fn := range functions {
+				if fn.Warm() && !fn.IsRunning() {
+					go startWarm(name, fn)
+				}
+			}
+		}
+	}
+}
+
+// startWarm starts a warm function in the background.
+func startWarm(name string, fn *kappa.KappaFunction) {
+	ctx, cancel := context.WithTimeout(context.Background(), warmStartTimeout)
+	defer cancel()
+	if err := fn.Start(ctx); err != nil {
+		logger.Get().Warn("Failed to start warm function", zap.String("name", name), zap.Error(err))
+		return
+	}
+	logger.Get().Info("Warm function started", zap.String("name", name))
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWarmFunction(t *testing.T) {
+	s := newTestService(t)
+	backend := registerFake(t, s, map[string]any{"name": "orders"},
+		func(w http.ResponseWriter, r *http.Request) { w.Write([]byte(`{}`)) })
+
+	rec := do(t, s, "POST", "/functions/orders/warm", map[string]any{"instances": 1})
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	assert.Equal(t, map[string]any{"name": "orders", "warmInstances": float64(1), "running": true}, decode(t, rec))
+	assert.Len(t, backend.runs(), 1, "the function is started right away")
+	fn, config, _ := s.lookup("orders")
+	assert.True(t, fn.Warm())
+	assert.Equal(t, 1, config.WarmInstances)
+	history, _ := s.versionHistory("orders")
+	require.NotEmpty(t, history)
+	assert.Equal(t, 1, history[len(history)-1].Config.WarmInstances)
+
+	// A function runs a single instance, so there is no more to keep warm
+	rec = do(t, s, "POST", "/functions/orders/warm", map[string]any{"instances": 2})
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+	rec = do(t, s, "POST", "/functions/orders/warm", map[string]any{})
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+
+	rec = do(t, s, "POST", "/functions/orders/warm", map[string]any{"instances": 0})
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	assert.False(t, fn.Warm())
+	assert.Equal(t, 0, s.config("orders").WarmInstances)
+
+	register(t, s, map[string]any{"name": "billing", "mode": "external"})
+	rec = do(t, s, "POST", "/functions/billing/warm", map[string]any{"instances": 1})
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+	rec = do(t, s, "POST", "/functions/missing/warm", map[string]any{"instances": 1})
+	assert.Equal(t, http.StatusNotFound, rec.Code)
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"fmt"
+	"kappa-v2/pkg/logger"
+	"kappa-v2/service/internal/kappa"
+	"net/http"
+	"net/http/httputil"
+	"strings"
+
+	"github.com/gorilla/mux"
+	"go.uber.org/zap"
+)
+
+// defaultWebSocketPath is where runtimes accept WebSockets unless configured
+const defaultWebSocketPath = "/ws"
+
+// WebSocketConfig opts a function into having WebSockets proxied to its
+// runtime, which accepts them at Path, /ws by default.
+type WebSocketConfig struct {
+	Path string `json:"path,omitempty"`
+}
+
+func (c *WebSocketConfig) validate() error {
+	if c.Path != "" && !strings.HasPrefix(c.Path, "/") {
+		return fmt.Errorf("path must start with /")
+	}
+	return nil
+}
+
+func (c *WebSocketConfig) path() string {
+	if c.Path == "" {
+		return defaultWebSocketPath
+	}
+	return c.Path
+}
+
+// isWebSocket reports whether r asks to upgrade to a WebSocket.
+func isWebSocket(r *http.Request) bool {
+	return strings.EqualFold(r.Header.Get("Upgrade"), "websocket") &&
+		strings.Contains(strings.ToLower(r.Header.Get("Connection")), "upgrade")
+}
+
+// HTTP handler for proxying a WebSocket to a function. Frames are passed
+// through as is for as long as either side keeps the socket open, and the
+// function isn't stopped for being idle in the meantime.
+func (s *KappaService) proxyWebSocket(w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["name"]
+
+	fn, _, exists := s.lookup(name)
+	if !exists {
+		http.Error(w, fmt.Sprintf("Function not found: %s", name), http.StatusNotFound)
+		return
+	}
+	config := s.config(name).WebSocket
+	if config == nil {
+		http.Error(w, fmt.Sprintf("Function doesn't accept WebSockets: %s", name), http.StatusNotFound)
+		return
+	}
+	if !isWebSocket(r) {
+		http.Error(w, "Expected a WebSocket upgrade", http.StatusBadRequest)
+		return
+	}
+	if s.rejectDisabled(w, name, fn) {
+		return
+	}
+
+	target, transport, release, err := fn.Connect(r.Context(), kappa.HTTP1)
+	if err != nil {
+		s.invocationError(w, name, errorKind(err), fmt.Sprintf("Failed to connect to function: %v", err), http.StatusInternalServerError)
+		return
+	}
+	defer release()
+
+	proxy := &httputil.ReverseProxy{
+		Rewrite: func(pr *httputil.ProxyRequest) {
+			pr.SetURL(target)
+			pr.Out.URL.Path = config.path()
+			pr.Out.URL.RawPath = ""
+			pr.Out.Header.Set("X-Request-Id", requestID(r.Context()))
+		},
+		Transport: transport,
+		ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
+			logger.FromCtx(r.Context()).Warn("WebSocket proxy failed", zap.String("function", name), zap.Error(err))
+			http.Error(w, fmt.Sprintf("Failed to reach function: %v", err), http.StatusBadGateway)
+		},
+	}
+	proxy.ServeHTTP(w, r)
+}
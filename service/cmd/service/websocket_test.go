@@ -0,0 +1,55 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/websocket"
+)
+
+func TestProxyWebSocket(t *testing.T) {
+	s := newTestService(t)
+	echo := websocket.Handler(func(ws *websocket.Conn) { io.Copy(ws, ws) })
+	paths := make(chan string, 1)
+	registerFake(t, s, map[string]any{"name": "chat", "webSocket": map[string]any{"path": "/socket"}}, func(w http.ResponseWriter, r *http.Request) {
+		paths <- r.URL.Path
+		echo.ServeHTTP(w, r)
+	})
+
+	server := httptest.NewServer(s.router)
+	defer server.Close()
+	ws, err := websocket.Dial("ws"+strings.TrimPrefix(server.URL, "http")+"/functions/chat/ws", "", server.URL)
+	require.NoError(t, err)
+	defer ws.Close()
+
+	require.NoError(t, ws.SetDeadline(time.Now().Add(5*time.Second)))
+	require.NoError(t, websocket.Message.Send(ws, "hello"))
+	var reply string
+	require.NoError(t, websocket.Message.Receive(ws, &reply))
+	assert.Equal(t, "hello", reply)
+	assert.Equal(t, "/socket", <-paths)
+}
+
+func TestProxyWebSocket_Rejected(t *testing.T) {
+	s := newTestService(t)
+	registerFake(t, s, map[string]any{"name": "chat", "webSocket": map[string]any{}}, func(w http.ResponseWriter, r *http.Request) {})
+	registerFake(t, s, map[string]any{"name": "orders"}, func(w http.ResponseWriter, r *http.Request) {})
+	upgrade := []string{"Upgrade", "websocket", "Connection", "Upgrade"}
+
+	rec := do(t, s, "GET", "/functions/missing/ws", nil, upgrade...)
+	assert.Equal(t, http.StatusNotFound, rec.Code)
+	rec = do(t, s, "GET", "/functions/orders/ws", nil, upgrade...)
+	assert.Equal(t, http.StatusNotFound, rec.Code)
+	assert.Contains(t, rec.Body.String(), "doesn't accept WebSockets")
+	rec = do(t, s, "GET", "/functions/chat/ws", nil)
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+
+	rec = do(t, s, "POST", "/functions", map[string]any{"name": "bad", "binaryPath": "/bin/true", "webSocket": map[string]any{"path": "socket"}})
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+}
@@ -0,0 +1,336 @@
+// Package admission bounds how many invocations the service runs at once,
+// queueing a few by priority and shedding the rest instead of piling up
+// goroutines and containers.
+package admission
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// ErrSaturated is returned when an invocation is shed because the service
+// is already running as many as it allows and its queue has no room.
+var ErrSaturated = errors.New("service is saturated")
+
+// Priority orders invocations waiting for a slot.
+type Priority int
+
+const (
+	High Priority = iota
+	Normal
+	Low
+)
+
+var priorityNames = [...]string{"high", "normal", "low"}
+
+// priorities lists every class from the first admitted to the first shed.
+var priorities = []Priority{High, Normal, Low}
+
+func (p Priority) String() string {
+	return priorityNames[p]
+}
+
+// ParsePriority returns the priority for name, an empty name being Normal.
+func ParsePriority(name string) (Priority, error) {
+	if name == "" {
+		return Normal, nil
+	}
+	i := slices.Index(priorityNames[:], name)
+	if i < 0 {
+		return 0, fmt.Errorf("unknown priority %q, expected high, normal or low", name)
+	}
+	return Priority(i), nil
+}
+
+// waiter is an invocation queued for a slot, told over ready whether it got
+// one or was shed.
+type waiter struct {
+	priority Priority
+	ready    chan error
+}
+
+// classStats counts what happened to invocations of one priority.
+type classStats struct {
+	admitted uint64
+	queued   uint64
+	shed     uint64
+	waited   time.Duration
+	// waits is how many queued invocations went on to be admitted
+	waits uint64
+}
+
+// Limiter admits invocations up to a maximum in flight. Above it they wait
+// in a bounded queue, where higher priorities are admitted first and lower
+// ones are shed first to make room.
+type Limiter struct {
+	max          int
+	queueSize    int
+	queueTimeout time.Duration
+	retryAfter   time.Duration
+	mu           sync.Mutex
+	inFlight     int
+	peak         int
+	queues       [len(priorityNames)][]*waiter
+	classes      [len(priorityNames)]classStats
+	lastShed     time.Time
+}
+
+// Options configure a limiter.
+type Options struct {
+	// MaxInFlight is how many invocations run at once, 0 for no limit
+	MaxInFlight int
+	// QueueSize is how many invocations can wait for a slot, 0 sheds
+	// straight away
+	QueueSize int
+	// QueueTimeout is how long an invocation waits before it is shed
+	QueueTimeout time.Duration
+	// RetryAfter is how long shed callers are told to wait
+	RetryAfter time.Duration
+}
+
+// New creates a limiter.
+func New(opts Options) *Limiter {
+	return &Limiter{
+		max:          opts.MaxInFlight,
+		queueSize:    opts.QueueSize,
+		queueTimeout: opts.QueueTimeout,
+		retryAfter:   opts.RetryAfter,
+	}
+}
+
+// FromEnv configures a limiter from KAPPA_MAX_IN_FLIGHT, unlimited by
+// default, KAPPA_ADMISSION_QUEUE, 0 by default, KAPPA_ADMISSION_QUEUE_TIMEOUT_MS,
+// 5 seconds by default, and KAPPA_SHED_RETRY_AFTER_MS, 1 second by default.
+func FromEnv() (*Limiter, error) {
+	opts := Options{QueueTimeout: 5 * time.Second, RetryAfter: time.Second}
+	var err error
+	if opts.MaxInFlight, err = intFromEnv("KAPPA_MAX_IN_FLIGHT", 0); err != nil {
+		return nil, err
+	}
+	if opts.QueueSize, err = intFromEnv("KAPPA_ADMISSION_QUEUE", 0); err != nil {
+		return nil, err
+	}
+	ms, err := intFromEnv("KAPPA_ADMISSION_QUEUE_TIMEOUT_MS", int(opts.QueueTimeout.Milliseconds()))
+	if err != nil {
+		return nil, err
+	}
+	opts.QueueTimeout = time.Duration(ms) * time.Millisecond
+	if ms, err = intFromEnv("KAPPA_SHED_RETRY_AFTER_MS", int(opts.RetryAfter.Milliseconds())); err != nil {
+		return nil, err
+	}
+	opts.RetryAfter = time.Duration(ms) * time.Millisecond
+	return New(opts), nil
+}
+
+// intFromEnv reads a non-negative integer variable, def when unset.
+func intFromEnv(name string, def int) (int, error) {
+	v := os.Getenv(name)
+	if v == "" {
+		return def, nil
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid %s %q", name, v)
+	}
+	return n, nil
+}
+
+// Acquire takes a slot for an invocation, waiting in the queue when none
+// are free. It returns ErrSaturated when the invocation is shed, or the
+// context's error if it ends first. Every successful Acquire must be
+// matched by a Release.
+func (l *Limiter) Acquire(ctx context.Context, priority Priority) error {
+	l.mu.Lock()
+	if l.max == 0 || l.inFlight < l.max {
+		l.inFlight++
+		l.peak = max(l.peak, l.inFlight)
+		l.classes[priority].admitted++
+		l.mu.Unlock()
+		return nil
+	}
+
+	if l.queued() >= l.queueSize {
+		// Make room by shedding the newest of the lowest priority waiters,
+		// as long as they are below this invocation
+		victim := l.lowestBelow(priority)
+		if victim == nil {
+			l.shed(priority)
+			l.mu.Unlock()
+			return ErrSaturated
+		}
+		l.remove(victim)
+		l.shed(victim.priority)
+		victim.ready <- ErrSaturated
+	}
+
+	w := &waiter{priority: priority, ready: make(chan error, 1)}
+	l.queues[priority] = append(l.queues[priority], w)
+	l.classes[priority].queued++
+	l.mu.Unlock()
+
+	started := time.Now()
+	timer := time.NewTimer(l.queueTimeout)
+	defer timer.Stop()
+
+	var err error
+	select {
+	case err = <-w.ready:
+		l.mu.Lock()
+		defer l.mu.Unlock()
+		return l.waited(w, started, err)
+	case <-timer.C:
+		err = ErrSaturated
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.remove(w) {
+		if errors.Is(err, ErrSaturated) {
+			l.shed(priority)
+		}
+		return err
+	}
+	// It was handed a slot or shed while giving up, go with that
+	return l.waited(w, started, <-w.ready)
+}
+
+// waited records how long an admitted waiter queued for, passing on err.
+// The lock must be held.
+func (l *Limiter) waited(w *waiter, started time.Time, err error) error {
+	if err == nil {
+		l.classes[w.priority].waited += time.Since(started)
+		l.classes[w.priority].waits++
+	}
+	return err
+}
+
+// Release frees a slot taken by Acquire, handing it straight to the first
+// waiter of the highest priority.
+func (l *Limiter) Release() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for _, p := range priorities {
+		if len(l.queues[p]) > 0 {
+			w := l.queues[p][0]
+			l.queues[p] = l.queues[p][1:]
+			l.classes[p].admitted++
+			w.ready <- nil
+			return
+		}
+	}
+	l.inFlight--
+}
+
+// queued returns how many invocations are waiting. The lock must be held.
+func (l *Limiter) queued() int {
+	n := 0
+	for _, q := range l.queues {
+		n += len(q)
+	}
+	return n
+}
+
+// lowestBelow returns the newest waiter of the lowest priority below p, or
+// nil if there is none. The lock must be held.
+func (l *Limiter) lowestBelow(p Priority) *waiter {
+	for c := Low; c > p; c-- {
+		if q := l.queues[c]; len(q) > 0 {
+			return q[len(q)-1]
+		}
+	}
+	return nil
+}
+
+// remove takes w out of its queue, reporting whether it was there. The lock
+// must be held.
+func (l *Limiter) remove(w *waiter) bool {
+	q := l.queues[w.priority]
+	i := slices.Index(q, w)
+	if i < 0 {
+		return false
+	}
+	l.queues[w.priority] = slices.Delete(q, i, i+1)
+	return true
+}
+
+// shed counts a shed invocation. The lock must be held.
+func (l *Limiter) shed(p Priority) {
+	l.classes[p].shed++
+	l.lastShed = time.Now()
+}
+
+// RetryAfter is how long shed callers should wait before trying again.
+func (l *Limiter) RetryAfter() time.Duration {
+	return l.retryAfter
+}
+
+// ClassStats are the counters for one priority.
+type ClassStats struct {
+	QueueDepth int    `json:"queueDepth"`
+	Admitted   uint64 `json:"admitted"`
+	Queued     uint64 `json:"queued"`
+	Shed       uint64 `json:"shed"`
+	// MeanWaitMs is the mean time queued invocations waited for a slot
+	MeanWaitMs float64 `json:"meanWaitMs"`
+}
+
+// Stats is a snapshot of the limiter, to see whether the limit binds.
+type Stats struct {
+	// MaxInFlight is the configured limit, 0 when unlimited
+	MaxInFlight  int `json:"maxInFlight"`
+	InFlight     int `json:"inFlight"`
+	PeakInFlight int `json:"peakInFlight"`
+	// Utilization is InFlight over MaxInFlight, 0 when unlimited
+	Utilization float64               `json:"utilization"`
+	QueueSize   int                   `json:"queueSize"`
+	QueueDepth  int                   `json:"queueDepth"`
+	Admitted    uint64                `json:"admitted"`
+	Shed        uint64                `json:"shed"`
+	LastShed    *time.Time            `json:"lastShed,omitempty"`
+	Classes     map[string]ClassStats `json:"classes"`
+}
+
+// Stats returns the limiter's current state and counters.
+func (l *Limiter) Stats() Stats {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	stats := Stats{
+		MaxInFlight:  l.max,
+		InFlight:     l.inFlight,
+		PeakInFlight: l.peak,
+		QueueSize:    l.queueSize,
+		QueueDepth:   l.queued(),
+		Classes:      make(map[string]ClassStats, len(priorities)),
+	}
+	if l.max > 0 {
+		stats.Utilization = float64(l.inFlight) / float64(l.max)
+	}
+	if !l.lastShed.IsZero() {
+		lastShed := l.lastShed
+		stats.LastShed = &lastShed
+	}
+	for _, p := range priorities {
+		c := l.classes[p]
+		class := ClassStats{
+			QueueDepth: len(l.queues[p]),
+			Admitted:   c.admitted,
+			Queued:     c.queued,
+			Shed:       c.shed,
+		}
+		if c.waits > 0 {
+			class.MeanWaitMs = float64(c.waited.Milliseconds()) / float64(c.waits)
+		}
+		stats.Classes[p.String()] = class
+		stats.Admitted += c.admitted
+		stats.Shed += c.shed
+	}
+	return stats
+}
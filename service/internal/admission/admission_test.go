@@ -0,0 +1,121 @@
+package admission
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLimiter_ShedsAboveMax(t *testing.T) {
+	ctx := context.Background()
+	l := New(Options{MaxInFlight: 2, RetryAfter: 3 * time.Second})
+	require.NoError(t, l.Acquire(ctx, Normal))
+	require.NoError(t, l.Acquire(ctx, Normal))
+	assert.ErrorIs(t, l.Acquire(ctx, High), ErrSaturated, "without a queue even high priority is shed")
+
+	stats := l.Stats()
+	assert.Equal(t, 2, stats.InFlight)
+	assert.Equal(t, 1.0, stats.Utilization)
+	assert.Equal(t, uint64(2), stats.Admitted)
+	assert.Equal(t, uint64(1), stats.Shed)
+	assert.Equal(t, uint64(1), stats.Classes["high"].Shed)
+	assert.NotNil(t, stats.LastShed)
+
+	l.Release()
+	require.NoError(t, l.Acquire(ctx, Normal))
+	assert.Equal(t, 2, l.Stats().PeakInFlight)
+	assert.Equal(t, 3*time.Second, l.RetryAfter())
+}
+
+func TestLimiter_Unlimited(t *testing.T) {
+	l := New(Options{})
+	for range 100 {
+		require.NoError(t, l.Acquire(context.Background(), Low))
+	}
+	stats := l.Stats()
+	assert.Equal(t, 100, stats.InFlight)
+	assert.Zero(t, stats.Utilization)
+	assert.Nil(t, stats.LastShed)
+}
+
+// queue starts an Acquire in the background and waits for it to be queued.
+func queue(t *testing.T, l *Limiter, p Priority) <-chan error {
+	t.Helper()
+	queued := l.Stats().Classes[p.String()].Queued
+	done := make(chan error, 1)
+	go func() { done <- l.Acquire(context.Background(), p) }()
+	require.Eventually(t, func() bool { return l.Stats().Classes[p.String()].Queued > queued }, time.Second, time.Millisecond)
+	return done
+}
+
+func TestLimiter_PriorityQueue(t *testing.T) {
+	l := New(Options{MaxInFlight: 1, QueueSize: 2, QueueTimeout: 10 * time.Second})
+	require.NoError(t, l.Acquire(context.Background(), Normal))
+
+	low := queue(t, l, Low)
+	normal := queue(t, l, Normal)
+
+	// The queue is full, so a high priority invocation sheds the low one
+	high := queue(t, l, High)
+	assert.ErrorIs(t, <-low, ErrSaturated)
+	assert.ErrorIs(t, l.Acquire(context.Background(), Low), ErrSaturated, "low can't displace anyone")
+
+	// Slots go to high before normal
+	l.Release()
+	require.NoError(t, <-high)
+	select {
+	case <-normal:
+		t.Fatal("normal admitted before high released")
+	default:
+	}
+	l.Release()
+	require.NoError(t, <-normal)
+
+	stats := l.Stats()
+	assert.Equal(t, 1, stats.InFlight)
+	assert.Zero(t, stats.QueueDepth)
+	assert.Equal(t, uint64(2), stats.Classes["low"].Shed)
+	assert.Equal(t, uint64(1), stats.Classes["high"].Queued)
+	assert.Equal(t, uint64(1), stats.Classes["high"].Admitted)
+	assert.Equal(t, uint64(2), stats.Classes["normal"].Admitted)
+}
+
+func TestLimiter_QueueTimeout(t *testing.T) {
+	l := New(Options{MaxInFlight: 1, QueueSize: 1, QueueTimeout: 10 * time.Millisecond})
+	require.NoError(t, l.Acquire(context.Background(), Normal))
+	assert.ErrorIs(t, l.Acquire(context.Background(), Normal), ErrSaturated)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	assert.ErrorIs(t, l.Acquire(ctx, Normal), context.Canceled)
+	assert.Zero(t, l.Stats().QueueDepth)
+}
+
+func TestParsePriority(t *testing.T) {
+	p, err := ParsePriority("")
+	require.NoError(t, err)
+	assert.Equal(t, Normal, p)
+	p, err = ParsePriority("high")
+	require.NoError(t, err)
+	assert.Equal(t, High, p)
+	_, err = ParsePriority("urgent")
+	assert.Error(t, err)
+}
+
+func TestFromEnv(t *testing.T) {
+	t.Setenv("KAPPA_MAX_IN_FLIGHT", "8")
+	t.Setenv("KAPPA_ADMISSION_QUEUE", "16")
+	t.Setenv("KAPPA_SHED_RETRY_AFTER_MS", "2500")
+	l, err := FromEnv()
+	require.NoError(t, err)
+	assert.Equal(t, 8, l.Stats().MaxInFlight)
+	assert.Equal(t, 16, l.Stats().QueueSize)
+	assert.Equal(t, 2500*time.Millisecond, l.RetryAfter())
+
+	t.Setenv("KAPPA_MAX_IN_FLIGHT", "-1")
+	_, err = FromEnv()
+	assert.Error(t, err)
+}
@@ -0,0 +1,236 @@
+package artifact
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"kappa-v2/pkg/logger"
+	"kappa-v2/service/internal/objstore"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"go.uber.org/zap"
+)
+
+// ErrNotFound is returned for digests that aren't in the store
+var ErrNotFound = errors.New("artifact not found")
+
+// Store keeps function artifacts content-addressed by their sha256 digest, so
+// functions sharing a binary share one copy on disk. Blobs are reference
+// counted and removed once nothing uses them.
+type Store struct {
+	dir  string
+	mu   sync.Mutex
+	refs map[string]int
+	// mountMu serializes making mount directories
+	mountMu sync.Mutex
+	// remote keeps blobs for other nodes, nil to keep them on this one
+	remote objstore.Store
+}
+
+// NewStore creates a store rooted at dir, creating it if needed.
+func NewStore(dir string) (*Store, error) {
+	if err := os.MkdirAll(filepath.Join(dir, "sha256"), 0755); err != nil {
+		return nil, fmt.Errorf("failed to create artifact directory: %w", err)
+	}
+	if err := os.MkdirAll(filepath.Join(dir, "mounts"), 0755); err != nil {
+		return nil, fmt.Errorf("failed to create artifact directory: %w", err)
+	}
+	return &Store{
+		dir:  dir,
+		refs: make(map[string]int),
+	}, nil
+}
+
+// Put writes the content of r to the store and returns its digest. Content
+// already in the store isn't written twice.
+func (s *Store) Put(r io.Reader) (string, error) {
+	tmp, err := os.CreateTemp(s.dir, "upload-*")
+	if err != nil {
+		return "", fmt.Errorf("failed to create temp file: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	h := sha256.New()
+	if _, err := io.Copy(io.MultiWriter(tmp, h), r); err != nil {
+		tmp.Close()
+		return "", fmt.Errorf("failed to write artifact: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return "", fmt.Errorf("failed to write artifact: %w", err)
+	}
+	digest := hex.EncodeToString(h.Sum(nil))
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	dest := s.Path(digest)
+	if _, err := os.Stat(dest); err == nil {
+		logger.Get().Debug("Artifact already stored", zap.String("digest", digest))
+		return digest, nil
+	}
+	if err := os.Chmod(tmp.Name(), 0555); err != nil {
+		return "", fmt.Errorf("failed to set artifact permissions: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), dest); err != nil {
+		return "", fmt.Errorf("failed to store artifact: %w", err)
+	}
+	if err := s.upload(digest, dest); err != nil {
+		os.Remove(dest)
+		return "", err
+	}
+
+	logger.Get().Info("Artifact stored", zap.String("digest", digest))
+	return digest, nil
+}
+
+// Import copies the file at path into the store.
+func (s *Store) Import(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", fmt.Errorf("failed to open artifact: %w", err)
+	}
+	defer f.Close()
+	return s.Put(f)
+}
+
+// Path returns where the blob for digest lives.
+func (s *Store) Path(digest string) string {
+	return filepath.Join(s.dir, "sha256", digest)
+}
+
+// PutMeta stores a named piece of metadata alongside digest's blob, such as
+// its SBOM. Metadata is removed together with the blob.
+func (s *Store) PutMeta(digest, name string, data []byte) error {
+	if err := os.WriteFile(s.metaPath(digest, name), data, 0644); err != nil {
+		return fmt.Errorf("failed to write artifact metadata: %w", err)
+	}
+	return s.upload(digest+"."+name, s.metaPath(digest, name))
+}
+
+// GetMeta reads metadata stored with PutMeta.
+func (s *Store) GetMeta(digest, name string) ([]byte, error) {
+	data, err := os.ReadFile(s.metaPath(digest, name))
+	if os.IsNotExist(err) && s.remote != nil {
+		data, err = s.fetchMeta(digest, name)
+	}
+	if os.IsNotExist(err) {
+		return nil, fmt.Errorf("%w: %s %s", ErrNotFound, digest, name)
+	}
+	return data, err
+}
+
+func (s *Store) metaPath(digest, name string) string {
+	return s.Path(digest) + "." + name
+}
+
+// Acquire takes a reference on digest, preventing it from being removed.
+// Blobs kept in the remote store alone are fetched first.
+func (s *Store) Acquire(digest string) error {
+	if err := s.fetch(digest); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, err := os.Stat(s.Path(digest)); err != nil {
+		return fmt.Errorf("%w: %s", ErrNotFound, digest)
+	}
+	s.refs[digest]++
+	return nil
+}
+
+// Release drops a reference on digest, removing the blob when it was the last.
+func (s *Store) Release(digest string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.refs[digest] > 1 {
+		s.refs[digest]--
+		return nil
+	}
+	delete(s.refs, digest)
+
+	if err := os.Remove(s.Path(digest)); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to remove artifact: %w", err)
+	}
+	// Instances still mounting it keep their view of the directory
+	if err := os.RemoveAll(s.mountPath(digest)); err != nil {
+		return fmt.Errorf("failed to remove artifact mount directory: %w", err)
+	}
+	meta, _ := filepath.Glob(s.Path(digest) + ".*")
+	for _, path := range meta {
+		if err := os.Remove(path); err != nil {
+			return fmt.Errorf("failed to remove artifact metadata: %w", err)
+		}
+	}
+	logger.Get().Info("Artifact removed", zap.String("digest", digest))
+	return nil
+}
+
+// Blobs returns the digests of the blobs kept on this node, sorted.
+func (s *Store) Blobs() ([]string, error) {
+	entries, err := os.ReadDir(filepath.Join(s.dir, "sha256"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to list artifacts: %w", err)
+	}
+	var digests []string
+	for _, entry := range entries {
+		if entry.Type().IsRegular() && !strings.Contains(entry.Name(), ".") {
+			digests = append(digests, entry.Name())
+		}
+	}
+	return digests, nil
+}
+
+// Meta returns the names of the metadata stored with digest's blob, sorted.
+func (s *Store) Meta(digest string) ([]string, error) {
+	paths, err := filepath.Glob(s.Path(digest) + ".*")
+	if err != nil {
+		return nil, fmt.Errorf("failed to list artifact metadata: %w", err)
+	}
+	names := make([]string, len(paths))
+	for i, path := range paths {
+		names[i] = strings.TrimPrefix(filepath.Base(path), digest+".")
+	}
+	return names, nil
+}
+
+// Refs returns the number of references held on digest.
+func (s *Store) Refs(digest string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.refs[digest]
+}
+
+// Verify checks the blob still hashes to its digest.
+func (s *Store) Verify(digest string) error {
+	return VerifyFile(s.Path(digest), digest)
+}
+
+// VerifyFile checks the file at path hashes to the expected sha256 digest.
+func VerifyFile(path, digest string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return fmt.Errorf("%w: %s", ErrNotFound, digest)
+		}
+		return fmt.Errorf("failed to open artifact: %w", err)
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return fmt.Errorf("failed to read artifact: %w", err)
+	}
+
+	actual := hex.EncodeToString(h.Sum(nil))
+	if !strings.EqualFold(actual, digest) {
+		return fmt.Errorf("artifact %s failed integrity check, content hashes to %s", digest, actual)
+	}
+	return nil
+}
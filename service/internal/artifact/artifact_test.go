@@ -0,0 +1,236 @@
+package artifact
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"kappa-v2/service/internal/objstore"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStore_PutDeduplicates(t *testing.T) {
+	store, err := NewStore(t.TempDir())
+	require.NoError(t, err)
+
+	first, err := store.Put(strings.NewReader("binary"))
+	require.NoError(t, err)
+	second, err := store.Put(strings.NewReader("binary"))
+	require.NoError(t, err)
+	other, err := store.Put(strings.NewReader("other binary"))
+	require.NoError(t, err)
+
+	assert.Equal(t, first, second)
+	assert.NotEqual(t, first, other)
+	// sha256("binary")
+	assert.Equal(t, "9a3a45d01531a20e89ac6ae10b0b0beb0492acd7216a368aa062d1a5fecaf9cd", first)
+
+	entries, err := os.ReadDir(filepath.Join(store.dir, "sha256"))
+	require.NoError(t, err)
+	assert.Len(t, entries, 2)
+}
+
+func TestStore_Blobs(t *testing.T) {
+	store, err := NewStore(t.TempDir())
+	require.NoError(t, err)
+	blobs, err := store.Blobs()
+	require.NoError(t, err)
+	assert.Empty(t, blobs)
+
+	digest, err := store.Put(strings.NewReader("binary"))
+	require.NoError(t, err)
+	require.NoError(t, store.PutMeta(digest, "sbom", []byte("{}")))
+	require.NoError(t, store.PutMeta(digest, "config", []byte("{}")))
+
+	blobs, err = store.Blobs()
+	require.NoError(t, err)
+	assert.Equal(t, []string{digest}, blobs, "metadata isn't a blob")
+	meta, err := store.Meta(digest)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"config", "sbom"}, meta)
+}
+
+func TestStore_RefCounting(t *testing.T) {
+	store, err := NewStore(t.TempDir())
+	require.NoError(t, err)
+
+	digest, err := store.Put(strings.NewReader("binary"))
+	require.NoError(t, err)
+
+	require.NoError(t, store.Acquire(digest))
+	require.NoError(t, store.Acquire(digest))
+	assert.Equal(t, 2, store.Refs(digest))
+
+	require.NoError(t, store.Release(digest))
+	assert.FileExists(t, store.Path(digest))
+
+	require.NoError(t, store.PutMeta(digest, "sbom", []byte("{}")))
+	meta, err := store.GetMeta(digest, "sbom")
+	require.NoError(t, err)
+	assert.Equal(t, "{}", string(meta))
+
+	require.NoError(t, store.Release(digest))
+	assert.NoFileExists(t, store.Path(digest))
+	_, err = store.GetMeta(digest, "sbom")
+	assert.ErrorIs(t, err, ErrNotFound)
+
+	assert.ErrorIs(t, store.Acquire(digest), ErrNotFound)
+}
+
+func TestStore_Verify(t *testing.T) {
+	store, err := NewStore(t.TempDir())
+	require.NoError(t, err)
+
+	digest, err := store.Put(strings.NewReader("binary"))
+	require.NoError(t, err)
+	require.NoError(t, store.Verify(digest))
+
+	// Tamper with the blob
+	path := store.Path(digest)
+	require.NoError(t, os.Chmod(path, 0644))
+	require.NoError(t, os.WriteFile(path, []byte("tampered"), 0644))
+	assert.ErrorContains(t, store.Verify(digest), "failed integrity check")
+}
+
+func TestStore_MountDir(t *testing.T) {
+	store, err := NewStore(t.TempDir())
+	require.NoError(t, err)
+	digest, err := store.Put(strings.NewReader("binary"))
+	require.NoError(t, err)
+	require.NoError(t, store.Acquire(digest))
+
+	dir, err := store.MountDir(context.Background(), digest)
+	require.NoError(t, err)
+	again, err := store.MountDir(context.Background(), digest)
+	require.NoError(t, err)
+	assert.Equal(t, dir, again)
+
+	// The blob is linked rather than copied
+	blob, err := os.Stat(store.Path(digest))
+	require.NoError(t, err)
+	main, err := os.Stat(filepath.Join(dir, "main"))
+	require.NoError(t, err)
+	assert.True(t, os.SameFile(blob, main))
+
+	_, err = store.MountDir(context.Background(), strings.Repeat("0", 64))
+	assert.ErrorIs(t, err, ErrNotFound)
+
+	require.NoError(t, store.Release(digest))
+	assert.NoDirExists(t, dir)
+}
+
+func TestStore_PutUpload(t *testing.T) {
+	store, err := NewStore(t.TempDir())
+	require.NoError(t, err)
+	binary, err := store.Put(strings.NewReader("binary"))
+	require.NoError(t, err)
+
+	// Binaries are stored as is
+	digest, err := store.PutUpload(strings.NewReader("binary"), "", 1<<20)
+	require.NoError(t, err)
+	assert.Equal(t, binary, digest)
+
+	var archive bytes.Buffer
+	zw := zip.NewWriter(&archive)
+	for name, content := range map[string]string{"bootstrap": "binary", "bin/other": "other binary"} {
+		w, err := zw.Create(name)
+		require.NoError(t, err)
+		w.Write([]byte(content))
+	}
+	require.NoError(t, zw.Close())
+
+	// Archives store their entry, the bootstrap by default
+	digest, err = store.PutUpload(bytes.NewReader(archive.Bytes()), "", 1<<20)
+	require.NoError(t, err)
+	assert.Equal(t, binary, digest)
+	digest, err = store.PutUpload(bytes.NewReader(archive.Bytes()), "./bin/other", 1<<20)
+	require.NoError(t, err)
+	assert.NotEqual(t, binary, digest)
+
+	_, err = store.PutUpload(bytes.NewReader(archive.Bytes()), "missing", 1<<20)
+	assert.ErrorIs(t, err, ErrInvalidUpload)
+	_, err = store.PutUpload(bytes.NewReader(archive.Bytes()), "", 3)
+	assert.ErrorIs(t, err, ErrInvalidUpload, "entries over the limit are rejected")
+	_, err = store.PutUpload(strings.NewReader("binary"), "bootstrap", 1<<20)
+	assert.ErrorIs(t, err, ErrInvalidUpload, "only archives have entries")
+	_, err = store.PutUpload(strings.NewReader("PK\x03\x04 truncated"), "", 1<<20)
+	assert.ErrorIs(t, err, ErrInvalidUpload)
+}
+
+func TestCopyBlob_GivesUpWhenCancelled(t *testing.T) {
+	src := filepath.Join(t.TempDir(), "blob")
+	require.NoError(t, os.WriteFile(src, []byte("binary"), 0555))
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	assert.ErrorIs(t, copyBlob(ctx, src, filepath.Join(t.TempDir(), "main")), context.Canceled)
+}
+
+func TestVerifier(t *testing.T) {
+	pub, priv, err := ed25519.GenerateKey(nil)
+	require.NoError(t, err)
+
+	der, err := x509.MarshalPKIXPublicKey(pub)
+	require.NoError(t, err)
+	keyPath := filepath.Join(t.TempDir(), "key.pem")
+	require.NoError(t, os.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}), 0644))
+
+	verifier, err := LoadVerifier(keyPath)
+	require.NoError(t, err)
+
+	digest := "9a3a45d01531a20e89ac6ae10b0b0beb0492acd7216a368aa062d1a5fecaf9cd"
+	sum, _ := hex.DecodeString(digest)
+	signature := ed25519.Sign(priv, sum)
+
+	assert.NoError(t, verifier.Verify(digest, signature))
+	assert.ErrorIs(t, verifier.Verify(digest, nil), ErrInvalidSignature)
+
+	otherDigest := "0000000000000000000000000000000000000000000000000000000000000000"
+	assert.ErrorIs(t, verifier.Verify(otherDigest, signature), ErrInvalidSignature)
+}
+
+func TestStore_Remote(t *testing.T) {
+	remote, err := objstore.NewDir(t.TempDir())
+	require.NoError(t, err)
+	first, err := NewStore(t.TempDir())
+	require.NoError(t, err)
+	first.SetRemote(remote)
+	digest, err := first.Put(strings.NewReader("binary"))
+	require.NoError(t, err)
+	require.NoError(t, first.PutMeta(digest, "sbom", []byte(`{}`)))
+
+	// A node replacing the first finds its blobs in the remote store
+	second, err := NewStore(t.TempDir())
+	require.NoError(t, err)
+	second.SetRemote(remote)
+	require.NoError(t, second.Acquire(digest))
+	data, err := os.ReadFile(second.Path(digest))
+	require.NoError(t, err)
+	assert.Equal(t, "binary", string(data))
+	meta, err := second.GetMeta(digest, "sbom")
+	require.NoError(t, err)
+	assert.Equal(t, `{}`, string(meta))
+
+	require.NoError(t, second.Release(digest))
+	_, err = os.Stat(second.Path(digest))
+	assert.True(t, os.IsNotExist(err))
+	objects, err := remote.List(context.Background(), remotePrefix)
+	require.NoError(t, err)
+	assert.Len(t, objects, 2, "other nodes may still run the blob")
+
+	// Blobs that don't hash to their digest aren't run
+	other, err := NewStore(t.TempDir())
+	require.NoError(t, err)
+	other.SetRemote(remote)
+	require.NoError(t, remote.Put(context.Background(), remotePrefix+digest, strings.NewReader("tampered")))
+	assert.ErrorContains(t, other.Acquire(digest), "integrity check")
+	assert.ErrorIs(t, other.Acquire(strings.Repeat("0", 64)), ErrNotFound)
+}
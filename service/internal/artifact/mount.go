@@ -0,0 +1,89 @@
+package artifact
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"kappa-v2/pkg/logger"
+	"os"
+	"path/filepath"
+
+	"go.uber.org/zap"
+)
+
+// mountBinary is the name a blob has in its mount directory
+const mountBinary = "main"
+
+// MountDir returns a directory holding digest's blob as main, for instances
+// to bind mount read only instead of each copying the binary on start. It is
+// made on first use by hard linking the blob, copying it only where the link
+// fails, and removed with the blob.
+func (s *Store) MountDir(ctx context.Context, digest string) (string, error) {
+	s.mountMu.Lock()
+	defer s.mountMu.Unlock()
+
+	dir := s.mountPath(digest)
+	if _, err := os.Stat(filepath.Join(dir, mountBinary)); err == nil {
+		return dir, nil
+	}
+	blob := s.Path(digest)
+	if _, err := os.Stat(blob); err != nil {
+		return "", fmt.Errorf("%w: %s", ErrNotFound, digest)
+	}
+
+	// Made aside and renamed into place, so a half made directory is never
+	// mounted
+	tmp, err := os.MkdirTemp(filepath.Dir(dir), "tmp-*")
+	if err != nil {
+		return "", fmt.Errorf("failed to create mount directory: %w", err)
+	}
+	defer os.RemoveAll(tmp)
+	if err := os.Link(blob, filepath.Join(tmp, mountBinary)); err != nil {
+		logger.Get().Debug("Failed to link artifact, copying it", zap.String("digest", digest), zap.Error(err))
+		if err := copyBlob(ctx, blob, filepath.Join(tmp, mountBinary)); err != nil {
+			return "", fmt.Errorf("failed to copy artifact: %w", err)
+		}
+	}
+	if err := os.Chmod(tmp, 0755); err != nil {
+		return "", fmt.Errorf("failed to set mount directory permissions: %w", err)
+	}
+	if err := os.Rename(tmp, dir); err != nil {
+		return "", fmt.Errorf("failed to create mount directory: %w", err)
+	}
+	return dir, nil
+}
+
+func (s *Store) mountPath(digest string) string {
+	return filepath.Join(s.dir, "mounts", digest)
+}
+
+// copyBlob copies a blob, giving up once ctx is done
+func copyBlob(ctx context.Context, src, dst string) error {
+	source, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer source.Close()
+	dest, err := os.OpenFile(dst, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0555)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(dest, ctxReader{ctx: ctx, r: source}); err != nil {
+		dest.Close()
+		return err
+	}
+	return dest.Close()
+}
+
+// ctxReader fails reads once its context is done
+type ctxReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (r ctxReader) Read(p []byte) (int, error) {
+	if err := r.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return r.r.Read(p)
+}
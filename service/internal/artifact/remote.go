@@ -0,0 +1,119 @@
+package artifact
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"kappa-v2/pkg/logger"
+	"kappa-v2/service/internal/objstore"
+	"os"
+	"strings"
+
+	"go.uber.org/zap"
+)
+
+// remotePrefix starts the keys of blobs and their metadata in the remote
+// store, followed by the digest
+const remotePrefix = "artifacts/sha256/"
+
+// SetRemote keeps the store's blobs and metadata in remote too, for other
+// nodes to run them, making the local directory a cache of it. Blobs
+// missing locally, like on a node replacing another, are fetched as they
+// are acquired. Releasing a blob removes the local copy alone, as other
+// nodes may still run it.
+func (s *Store) SetRemote(remote objstore.Store) {
+	s.remote = remote
+}
+
+// upload copies the file at path to the remote store under name.
+func (s *Store) upload(name, path string) error {
+	if s.remote == nil {
+		return nil
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("failed to open artifact: %w", err)
+	}
+	defer f.Close()
+	if err := s.remote.Put(context.Background(), remotePrefix+name, f); err != nil {
+		return fmt.Errorf("failed to upload artifact: %w", err)
+	}
+	return nil
+}
+
+// fetch downloads digest's blob from the remote store unless it is already
+// here, checking it hashes to its digest before moving it into place.
+func (s *Store) fetch(digest string) error {
+	if s.remote == nil || !validDigest(digest) {
+		return nil
+	}
+	if _, err := os.Stat(s.Path(digest)); err == nil {
+		return nil
+	}
+	rc, err := s.remote.Get(context.Background(), remotePrefix+digest)
+	if errors.Is(err, objstore.ErrNotFound) {
+		return fmt.Errorf("%w: %s", ErrNotFound, digest)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to fetch artifact: %w", err)
+	}
+	defer rc.Close()
+
+	tmp, err := os.CreateTemp(s.dir, "fetch-*")
+	if err != nil {
+		return fmt.Errorf("failed to create temp file: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+	h := sha256.New()
+	_, err = io.Copy(io.MultiWriter(tmp, h), rc)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return fmt.Errorf("failed to fetch artifact: %w", err)
+	}
+	if actual := hex.EncodeToString(h.Sum(nil)); actual != strings.ToLower(digest) {
+		return fmt.Errorf("artifact %s failed integrity check, content hashes to %s", digest, actual)
+	}
+	if err := os.Chmod(tmp.Name(), 0555); err != nil {
+		return fmt.Errorf("failed to set artifact permissions: %w", err)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := os.Rename(tmp.Name(), s.Path(digest)); err != nil {
+		return fmt.Errorf("failed to store artifact: %w", err)
+	}
+	logger.Get().Info("Artifact fetched", zap.String("digest", digest))
+	return nil
+}
+
+// fetchMeta reads metadata from the remote store, caching it locally.
+// Metadata that isn't there either is reported as os.ErrNotExist.
+func (s *Store) fetchMeta(digest, name string) ([]byte, error) {
+	rc, err := s.remote.Get(context.Background(), remotePrefix+digest+"."+name)
+	if errors.Is(err, objstore.ErrNotFound) {
+		return nil, os.ErrNotExist
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch artifact metadata: %w", err)
+	}
+	defer rc.Close()
+	data, err := io.ReadAll(rc)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch artifact metadata: %w", err)
+	}
+	if err := os.WriteFile(s.metaPath(digest, name), data, 0644); err != nil {
+		logger.Get().Warn("Failed to cache artifact metadata", zap.String("digest", digest), zap.Error(err))
+	}
+	return data, nil
+}
+
+// validDigest keeps digests to hex, as they name files and keys
+func validDigest(digest string) bool {
+	_, err := hex.DecodeString(digest)
+	return err == nil && len(digest) == sha256.Size*2
+}
@@ -0,0 +1,67 @@
+package artifact
+
+import (
+	"crypto/ed25519"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+)
+
+// ErrInvalidSignature is returned when an artifact's signature doesn't match
+var ErrInvalidSignature = errors.New("invalid artifact signature")
+
+// Verifier checks detached artifact signatures against a trusted ed25519
+// public key. Signatures are made over the raw sha256 digest of the artifact,
+// so large binaries never have to be held in memory.
+type Verifier struct {
+	key ed25519.PublicKey
+}
+
+// NewVerifier creates a verifier trusting key.
+func NewVerifier(key ed25519.PublicKey) *Verifier {
+	return &Verifier{key: key}
+}
+
+// LoadVerifier reads a PEM encoded ed25519 public key from path.
+func LoadVerifier(path string) (*Verifier, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read public key: %w", err)
+	}
+
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("no PEM data found in %s", path)
+	}
+
+	pub, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse public key: %w", err)
+	}
+
+	key, ok := pub.(ed25519.PublicKey)
+	if !ok {
+		return nil, fmt.Errorf("public key must be ed25519, got %T", pub)
+	}
+	return NewVerifier(key), nil
+}
+
+// Verify checks signature was made over digest with the trusted key.
+func (v *Verifier) Verify(digest string, signature []byte) error {
+	if len(signature) == 0 {
+		return fmt.Errorf("%w: no signature provided", ErrInvalidSignature)
+	}
+
+	sum, err := hex.DecodeString(digest)
+	if err != nil {
+		return fmt.Errorf("invalid digest %q: %w", digest, err)
+	}
+
+	if !ed25519.Verify(v.key, sum, signature) {
+		return fmt.Errorf("%w: %s", ErrInvalidSignature, digest)
+	}
+	return nil
+}
@@ -0,0 +1,80 @@
+package artifact
+
+import (
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+)
+
+// DefaultEntry is the file of an uploaded zip archive the function runs
+// when no other is named, like a custom runtime's bootstrap
+const DefaultEntry = "bootstrap"
+
+// ErrInvalidUpload is returned for uploads that hold no binary to run
+var ErrInvalidUpload = errors.New("invalid upload")
+
+// zipMagic starts the local file header zip archives start with
+var zipMagic = []byte("PK\x03\x04")
+
+// PutUpload stores an uploaded function: a binary as is, or the entry file
+// of a zip archive, DefaultEntry when entry is empty. Archives are told
+// apart by their content rather than their name. Entries larger than
+// maxSize are rejected, checked against the archive's directory and again
+// by the zip reader as they are extracted.
+func (s *Store) PutUpload(r io.Reader, entry string, maxSize int64) (string, error) {
+	br := bufio.NewReader(r)
+	if magic, _ := br.Peek(len(zipMagic)); !bytes.Equal(magic, zipMagic) {
+		if entry != "" {
+			return "", fmt.Errorf("%w: entry %s names a file of a zip archive, the upload isn't one", ErrInvalidUpload, entry)
+		}
+		return s.Put(br)
+	}
+
+	// Archives are read from their end, so they are spooled to disk first
+	tmp, err := os.CreateTemp(s.dir, "archive-*")
+	if err != nil {
+		return "", fmt.Errorf("failed to create temp file: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+	size, err := io.Copy(tmp, br)
+	if err != nil {
+		return "", fmt.Errorf("failed to write archive: %w", err)
+	}
+	archive, err := zip.NewReader(tmp, size)
+	if err != nil {
+		return "", fmt.Errorf("%w: %v", ErrInvalidUpload, err)
+	}
+
+	if entry == "" {
+		entry = DefaultEntry
+	}
+	entry = path.Clean(entry)
+	for _, f := range archive.File {
+		if path.Clean(f.Name) != entry {
+			continue
+		}
+		if f.FileInfo().IsDir() {
+			return "", fmt.Errorf("%w: entry %s is a directory", ErrInvalidUpload, entry)
+		}
+		if f.UncompressedSize64 > uint64(maxSize) {
+			return "", fmt.Errorf("%w: entry %s is larger than %d bytes", ErrInvalidUpload, entry, maxSize)
+		}
+		rc, err := f.Open()
+		if err != nil {
+			return "", fmt.Errorf("%w: %v", ErrInvalidUpload, err)
+		}
+		defer rc.Close()
+		digest, err := s.Put(rc)
+		if errors.Is(err, zip.ErrFormat) || errors.Is(err, zip.ErrChecksum) {
+			return "", fmt.Errorf("%w: %v", ErrInvalidUpload, err)
+		}
+		return digest, err
+	}
+	return "", fmt.Errorf("%w: no entry %s in the archive", ErrInvalidUpload, entry)
+}
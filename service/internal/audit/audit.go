@@ -0,0 +1,84 @@
+// Package audit records who changed what in the service, kept in memory for
+// the API and written to the log for retention elsewhere.
+package audit
+
+import (
+	"kappa-v2/pkg/logger"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// DefaultSize is how many entries a log keeps
+const DefaultSize = 1000
+
+// Entry is one recorded change.
+type Entry struct {
+	Time time.Time `json:"time"`
+	// Actor is the subject who made the change, empty without RBAC
+	Actor    string `json:"actor,omitempty"`
+	Action   string `json:"action"`
+	Function string `json:"function,omitempty"`
+	Project  string `json:"project,omitempty"`
+	// Detail says what changed, like the versions rolled back between
+	Detail map[string]any `json:"detail,omitempty"`
+}
+
+// Log keeps the most recent entries.
+type Log struct {
+	mu      sync.Mutex
+	entries []Entry
+	size    int
+	sink    func(Entry)
+}
+
+// NewLog creates a log keeping size entries.
+func NewLog(size int) *Log {
+	return &Log{size: size}
+}
+
+// SetSink has every entry recorded passed to sink as well, for keeping
+// more than the log does.
+func (l *Log) SetSink(sink func(Entry)) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.sink = sink
+}
+
+// Record adds an entry, timestamping it, and writes it to the "audit" logger.
+func (l *Log) Record(e Entry) {
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+	logger.Get().Named("audit").Info(e.Action,
+		zap.String("actor", e.Actor),
+		zap.String("function", e.Function),
+		zap.String("project", e.Project),
+		zap.Any("detail", e.Detail),
+	)
+
+	l.mu.Lock()
+	l.entries = append(l.entries, e)
+	if len(l.entries) > l.size {
+		l.entries = append([]Entry(nil), l.entries[len(l.entries)-l.size:]...)
+	}
+	sink := l.sink
+	l.mu.Unlock()
+	if sink != nil {
+		sink(e)
+	}
+}
+
+// List returns the entries matching keep, newest first.
+func (l *Log) List(keep func(Entry) bool) []Entry {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	entries := []Entry{}
+	for i := len(l.entries) - 1; i >= 0; i-- {
+		if keep == nil || keep(l.entries[i]) {
+			entries = append(entries, l.entries[i])
+		}
+	}
+	return entries
+}
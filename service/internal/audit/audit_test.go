@@ -0,0 +1,37 @@
+package audit
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLog(t *testing.T) {
+	l := NewLog(2)
+	l.Record(Entry{Action: "rollback", Function: "a", Project: "shop"})
+	l.Record(Entry{Action: "rollback", Function: "b"})
+	l.Record(Entry{Action: "rollback", Function: "c", Project: "shop"})
+
+	entries := l.List(nil)
+	require.Len(t, entries, 2, "only the most recent entries are kept")
+	assert.Equal(t, "c", entries[0].Function)
+	assert.False(t, entries[0].Time.IsZero())
+
+	shop := l.List(func(e Entry) bool { return e.Project == "shop" })
+	require.Len(t, shop, 1)
+	assert.Equal(t, "c", shop[0].Function)
+	assert.NotNil(t, l.List(func(Entry) bool { return false }))
+}
+
+func TestLog_Sink(t *testing.T) {
+	l := NewLog(1)
+	var sunk []Entry
+	l.SetSink(func(e Entry) { sunk = append(sunk, e) })
+	l.Record(Entry{Action: "rollback", Function: "a"})
+	l.Record(Entry{Action: "rollback", Function: "b"})
+
+	require.Len(t, sunk, 2, "the sink gets the entries the log drops")
+	assert.Equal(t, "a", sunk[0].Function)
+	assert.False(t, sunk[0].Time.IsZero())
+}
@@ -0,0 +1,184 @@
+// Package auth authenticates callers of the service API without managing
+// subjects through the RBAC API. Providers each check one kind of
+// credential: static API keys from configuration, JWTs signed with a
+// configured key, tokens from an OpenID Connect identity provider and TLS
+// client certificates. Each credential carries scopes, which bind the
+// matching roles in every project.
+package auth
+
+import (
+	"crypto/x509"
+	"fmt"
+	"kappa-v2/service/internal/rbac"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+)
+
+// Scope is what a key or token may do, named after the role it binds.
+type Scope string
+
+const (
+	// ScopeRead only looks at functions, projects and schedules
+	ScopeRead Scope = "read"
+	// ScopeInvoke calls functions, without changing them
+	ScopeInvoke Scope = "invoke"
+	// ScopeDeploy changes functions, projects and schedules
+	ScopeDeploy Scope = "deploy"
+	// ScopeAdmin does everything, including the admin API
+	ScopeAdmin Scope = "admin"
+)
+
+var scopeRoles = map[Scope]rbac.Role{
+	ScopeRead:   rbac.Viewer,
+	ScopeInvoke: rbac.Invoker,
+	ScopeDeploy: rbac.Deployer,
+	ScopeAdmin:  rbac.Admin,
+}
+
+// ParseScope returns the scope named name.
+func ParseScope(name string) (Scope, error) {
+	if _, ok := scopeRoles[Scope(name)]; !ok {
+		return "", fmt.Errorf("unknown scope %q, expected read, invoke, deploy or admin", name)
+	}
+	return Scope(name), nil
+}
+
+// subjectFor is who name is with scopes, bound in every project.
+func subjectFor(name string, scopes []Scope) rbac.Subject {
+	subject := rbac.Subject{Name: name}
+	for _, scope := range scopes {
+		subject.Bindings = append(subject.Bindings, rbac.Binding{Role: scopeRoles[scope], Project: rbac.AllProjects})
+	}
+	return subject
+}
+
+// Provider authenticates API requests by one kind of credential.
+type Provider interface {
+	// Name is what the provider is selected by in KAPPA_AUTH_PROVIDERS
+	Name() string
+	// Authenticate returns the subject the request's credentials
+	// authenticate, false when it carries none the provider accepts
+	Authenticate(r *http.Request) (rbac.Subject, bool)
+}
+
+// providerNames are the providers FromEnv knows, in the order they are
+// asked when KAPPA_AUTH_PROVIDERS doesn't pick one
+var providerNames = []string{"static", "jwt", "oidc", "mtls"}
+
+// providerFromEnv creates the named provider from its environment
+// variables, returning nil when they aren't set.
+func providerFromEnv(name string) (Provider, error) {
+	switch name {
+	case "static":
+		if p, err := StaticFromEnv(); p != nil || err != nil {
+			return p, err
+		}
+	case "jwt":
+		if p, err := JWTFromEnv(); p != nil || err != nil {
+			return p, err
+		}
+	case "oidc":
+		if p, err := OIDCFromEnv(); p != nil || err != nil {
+			return p, err
+		}
+	case "mtls":
+		if p, err := MTLSFromEnv(); p != nil || err != nil {
+			return p, err
+		}
+	default:
+		return nil, fmt.Errorf("unknown auth provider %q, expected %s", name, strings.Join(providerNames, ", "))
+	}
+	return nil, nil
+}
+
+// Authenticator asks its providers in turn who a request is from.
+type Authenticator struct {
+	providers []Provider
+}
+
+// New creates an authenticator asking providers in order.
+func New(providers ...Provider) *Authenticator {
+	return &Authenticator{providers: providers}
+}
+
+// FromEnv creates an authenticator from the providers named in
+// KAPPA_AUTH_PROVIDERS, a comma separated list of static, jwt, oidc and
+// mtls, each configured by its own environment variables. Without it every
+// configured provider is used. It returns nil when no provider is
+// configured.
+func FromEnv() (*Authenticator, error) {
+	names := providerNames
+	selected := os.Getenv("KAPPA_AUTH_PROVIDERS") != ""
+	if selected {
+		names = nil
+		for _, name := range strings.Split(os.Getenv("KAPPA_AUTH_PROVIDERS"), ",") {
+			if name = strings.TrimSpace(name); name != "" && !slices.Contains(names, name) {
+				names = append(names, name)
+			}
+		}
+	}
+
+	var providers []Provider
+	for _, name := range names {
+		p, err := providerFromEnv(name)
+		if err != nil {
+			return nil, err
+		}
+		if p == nil {
+			if selected {
+				return nil, fmt.Errorf("auth provider %s is selected but not configured", name)
+			}
+			continue
+		}
+		providers = append(providers, p)
+	}
+	if len(providers) == 0 {
+		return nil, nil
+	}
+	return New(providers...), nil
+}
+
+// Authenticate returns the subject the first provider accepting the
+// request's credentials authenticates.
+func (a *Authenticator) Authenticate(r *http.Request) (rbac.Subject, bool) {
+	for _, p := range a.providers {
+		if subject, ok := p.Authenticate(r); ok {
+			return subject, true
+		}
+	}
+	return rbac.Subject{}, false
+}
+
+// Providers returns the names of the providers asked, in order.
+func (a *Authenticator) Providers() []string {
+	if a == nil {
+		return nil
+	}
+	names := make([]string, len(a.providers))
+	for i, p := range a.providers {
+		names[i] = p.Name()
+	}
+	return names
+}
+
+// ClientCAs returns the authorities client certificates are checked
+// against when the mtls provider is used, nil otherwise.
+func (a *Authenticator) ClientCAs() *x509.CertPool {
+	if a == nil {
+		return nil
+	}
+	for _, p := range a.providers {
+		if m, ok := p.(*MTLS); ok {
+			return m.clientCAs
+		}
+	}
+	return nil
+}
+
+// bearerToken returns the request's bearer token.
+func bearerToken(r *http.Request) (string, bool) {
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	return token, ok && token != ""
+}
@@ -0,0 +1,219 @@
+package auth
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"kappa-v2/service/internal/rbac"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var testSecret = []byte("0123456789abcdef0123456789abcdef")
+
+func signHS256(t *testing.T, claims map[string]any) string {
+	t.Helper()
+	signed := segment(t, map[string]any{"alg": "HS256", "typ": "JWT"}) + "." + segment(t, claims)
+	mac := hmac.New(sha256.New, testSecret)
+	mac.Write([]byte(signed))
+	return signed + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func bearer(token string) *http.Request {
+	r := httptest.NewRequest(http.MethodGet, "/functions", nil)
+	r.Header.Set("Authorization", "Bearer "+token)
+	return r
+}
+
+func segment(t *testing.T, v any) string {
+	data, err := json.Marshal(v)
+	require.NoError(t, err)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+func TestParseKey(t *testing.T) {
+	key, err := ParseKey("ci:invoke:abc:def")
+	require.NoError(t, err)
+	assert.Equal(t, Key{Name: "ci", Scope: ScopeInvoke, Key: "abc:def"}, key)
+
+	_, err = ParseKey("ci:owner:abc")
+	assert.Error(t, err)
+	_, err = ParseKey("ci:invoke")
+	assert.Error(t, err)
+}
+
+func TestStatic(t *testing.T) {
+	a, err := NewStatic([]Key{
+		{Name: "ci", Scope: ScopeInvoke, Key: "invoke-key"},
+		{Name: "ops", Scope: ScopeAdmin, Key: "admin-key"},
+	})
+	require.NoError(t, err)
+
+	subject, ok := a.Authenticate(bearer("invoke-key"))
+	require.True(t, ok)
+	assert.Equal(t, "ci", subject.Name)
+	assert.True(t, subject.Allowed(rbac.Invoke, "shop"))
+	assert.False(t, subject.Allowed(rbac.Deploy, "shop"))
+	assert.False(t, subject.AllowedAnywhere(rbac.Manage))
+
+	subject, ok = a.Authenticate(bearer("admin-key"))
+	require.True(t, ok)
+	assert.True(t, subject.Allowed(rbac.Manage, ""))
+
+	_, ok = a.Authenticate(bearer("wrong"))
+	assert.False(t, ok)
+
+	_, err = NewStatic([]Key{{Name: "a", Scope: ScopeRead, Key: "k"}, {Name: "b", Scope: ScopeAdmin, Key: "k"}})
+	assert.Error(t, err, "one key can't have two scopes")
+}
+
+func TestJWTVerifier_Authenticate(t *testing.T) {
+	a, err := NewHMACVerifier(testSecret)
+	require.NoError(t, err)
+	a.Issuer = "https://idp.example.com"
+	a.Audience = "kappa"
+	now := time.Unix(1_700_000_000, 0)
+	a.now = func() time.Time { return now }
+
+	claims := map[string]any{
+		"sub":   "alice",
+		"iss":   "https://idp.example.com",
+		"aud":   []string{"kappa", "other"},
+		"exp":   now.Add(time.Hour).Unix(),
+		"scope": "openid invoke deploy",
+	}
+	subject, ok := a.Authenticate(bearer(signHS256(t, claims)))
+	require.True(t, ok)
+	assert.Equal(t, "alice", subject.Name)
+	assert.True(t, subject.Allowed(rbac.Deploy, "shop"))
+	assert.False(t, subject.AllowedAnywhere(rbac.Manage))
+
+	tests := []struct {
+		name   string
+		change func(map[string]any)
+	}{
+		{"expired", func(c map[string]any) { c["exp"] = now.Add(-time.Hour).Unix() }},
+		{"no expiry", func(c map[string]any) { delete(c, "exp") }},
+		{"not yet valid", func(c map[string]any) { c["nbf"] = now.Add(time.Hour).Unix() }},
+		{"wrong issuer", func(c map[string]any) { c["iss"] = "https://evil.example.com" }},
+		{"wrong audience", func(c map[string]any) { c["aud"] = "other" }},
+		{"no subject", func(c map[string]any) { delete(c, "sub") }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			changed := make(map[string]any)
+			for k, v := range claims {
+				changed[k] = v
+			}
+			tt.change(changed)
+			_, ok := a.Authenticate(bearer(signHS256(t, changed)))
+			assert.False(t, ok)
+		})
+	}
+
+	t.Run("tampered", func(t *testing.T) {
+		token := signHS256(t, claims)
+		parts := strings.Split(token, ".")
+		parts[1] = segment(t, map[string]any{"sub": "alice", "exp": now.Add(time.Hour).Unix(), "scope": "admin"})
+		_, ok := a.Authenticate(bearer(parts[0] + "." + parts[1] + "." + parts[2]))
+		assert.False(t, ok)
+	})
+
+	t.Run("unsigned", func(t *testing.T) {
+		token := segment(t, map[string]any{"alg": "none"}) + "." + segment(t, claims) + "."
+		_, ok := a.Authenticate(bearer(token))
+		assert.False(t, ok)
+	})
+}
+
+func TestJWTVerifier_ES256(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	der, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	require.NoError(t, err)
+	verifier, err := NewPublicKeyVerifier(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}))
+	require.NoError(t, err)
+
+	now := time.Now()
+	signed := segment(t, map[string]any{"alg": "ES256"}) + "." + segment(t, map[string]any{"sub": "ci", "exp": now.Add(time.Minute).Unix(), "scp": []string{"invoke"}})
+	digest := sha256.Sum256([]byte(signed))
+	r, s, err := ecdsa.Sign(rand.Reader, key, digest[:])
+	require.NoError(t, err)
+	signature := make([]byte, 64)
+	r.FillBytes(signature[:32])
+	s.FillBytes(signature[32:])
+
+	claims, err := verifier.Verify(signed+"."+base64.RawURLEncoding.EncodeToString(signature), now)
+	require.NoError(t, err)
+	assert.Equal(t, []Scope{ScopeInvoke}, claims.Scopes())
+
+	// A token can't switch to HMAC with the public key as the secret
+	hsSigned := segment(t, map[string]any{"alg": "HS256"}) + "." + segment(t, map[string]any{"sub": "ci", "exp": now.Add(time.Minute).Unix()})
+	mac := hmac.New(sha256.New, der)
+	mac.Write([]byte(hsSigned))
+	_, err = verifier.Verify(hsSigned+"."+base64.RawURLEncoding.EncodeToString(mac.Sum(nil)), now)
+	assert.Error(t, err)
+}
+
+func TestFromEnv(t *testing.T) {
+	t.Setenv("KAPPA_API_KEYS", "")
+	t.Setenv("KAPPA_API_KEYS_FILE", "")
+	t.Setenv("KAPPA_JWT_SECRET", "")
+	t.Setenv("KAPPA_JWT_PUBLIC_KEY", "")
+	t.Setenv("KAPPA_OIDC_ISSUER", "")
+	t.Setenv("KAPPA_MTLS_CLIENT_CA", "")
+	t.Setenv("KAPPA_AUTH_PROVIDERS", "")
+	a, err := FromEnv()
+	require.NoError(t, err)
+	assert.Nil(t, a, "nothing configured leaves the API open")
+
+	path := filepath.Join(t.TempDir(), "keys")
+	require.NoError(t, os.WriteFile(path, []byte("# CI pipeline\nci:invoke:k1\n\nops:admin:k2\n"), 0o600))
+	t.Setenv("KAPPA_API_KEYS_FILE", path)
+	a, err = FromEnv()
+	require.NoError(t, err)
+	_, ok := a.Authenticate(bearer("k2"))
+	assert.True(t, ok)
+	assert.Equal(t, []string{"static"}, a.Providers())
+
+	t.Setenv("KAPPA_API_KEYS", "ci:nope:k1")
+	_, err = FromEnv()
+	assert.Error(t, err)
+
+	t.Setenv("KAPPA_API_KEYS", "")
+	t.Setenv("KAPPA_API_KEYS_FILE", "")
+	t.Setenv("KAPPA_JWT_SECRET", "short")
+	_, err = FromEnv()
+	assert.Error(t, err)
+
+	// Selecting providers leaves the others out, and needs them configured
+	t.Setenv("KAPPA_JWT_SECRET", string(testSecret))
+	t.Setenv("KAPPA_API_KEYS", "ci:invoke:k1")
+	t.Setenv("KAPPA_AUTH_PROVIDERS", "jwt")
+	a, err = FromEnv()
+	require.NoError(t, err)
+	assert.Equal(t, []string{"jwt"}, a.Providers())
+	_, ok = a.Authenticate(bearer("k1"))
+	assert.False(t, ok)
+
+	t.Setenv("KAPPA_AUTH_PROVIDERS", "static,oidc")
+	_, err = FromEnv()
+	assert.Error(t, err, "oidc isn't configured")
+	t.Setenv("KAPPA_AUTH_PROVIDERS", "ldap")
+	_, err = FromEnv()
+	assert.Error(t, err)
+}
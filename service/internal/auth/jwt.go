@@ -0,0 +1,269 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"kappa-v2/service/internal/rbac"
+	"math/big"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+	"time"
+)
+
+// leeway is how far the issuer's clock may be off from ours
+const leeway = 30 * time.Second
+
+// Claims are the JWT claims the service reads. Scopes are in scope, space
+// separated as in OAuth 2, or in scp as a list.
+type Claims struct {
+	Subject   string   `json:"sub"`
+	Issuer    string   `json:"iss"`
+	Audience  audience `json:"aud"`
+	ExpiresAt int64    `json:"exp"`
+	NotBefore int64    `json:"nbf"`
+	Scope     string   `json:"scope"`
+	Scp       []string `json:"scp"`
+
+	// raw are all the claims, for those named by configuration
+	raw map[string]json.RawMessage
+}
+
+// Scopes returns the claimed scopes the service knows, ignoring those meant
+// for others, like openid.
+func (c Claims) Scopes() []Scope {
+	var scopes []Scope
+	for _, name := range append(strings.Fields(c.Scope), c.Scp...) {
+		if scope, err := ParseScope(name); err == nil && !slices.Contains(scopes, scope) {
+			scopes = append(scopes, scope)
+		}
+	}
+	return scopes
+}
+
+// Strings returns the claim named name, a list of strings or a space
+// separated string.
+func (c Claims) Strings(name string) []string {
+	var many []string
+	if err := json.Unmarshal(c.raw[name], &many); err == nil {
+		return many
+	}
+	var one string
+	if err := json.Unmarshal(c.raw[name], &one); err == nil {
+		return strings.Fields(one)
+	}
+	return nil
+}
+
+// audience is the aud claim, a single string or a list.
+type audience []string
+
+func (a *audience) UnmarshalJSON(data []byte) error {
+	var one string
+	if err := json.Unmarshal(data, &one); err == nil {
+		*a = audience{one}
+		return nil
+	}
+	var many []string
+	if err := json.Unmarshal(data, &many); err != nil {
+		return fmt.Errorf("aud must be a string or a list of strings")
+	}
+	*a = many
+	return nil
+}
+
+// JWTVerifier checks JWTs signed with HS256 using a shared secret, or with
+// RS256 or ES256 using the issuer's public key.
+type JWTVerifier struct {
+	secret    []byte
+	publicKey crypto.PublicKey
+	// Issuer and Audience, when set, must match the token's claims
+	Issuer   string
+	Audience string
+
+	now func() time.Time
+}
+
+// NewHMACVerifier creates a verifier of HS256 tokens.
+func NewHMACVerifier(secret []byte) (*JWTVerifier, error) {
+	if len(secret) < 32 {
+		return nil, fmt.Errorf("JWT secret is %d bytes, expected at least 32", len(secret))
+	}
+	return &JWTVerifier{secret: secret, now: time.Now}, nil
+}
+
+// NewPublicKeyVerifier creates a verifier of RS256 or ES256 tokens from a
+// PEM encoded public key.
+func NewPublicKeyVerifier(pemData []byte) (*JWTVerifier, error) {
+	block, _ := pem.Decode(pemData)
+	if block == nil {
+		return nil, fmt.Errorf("JWT public key is not PEM encoded")
+	}
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("invalid JWT public key: %w", err)
+	}
+	return newKeyVerifier(key)
+}
+
+// newKeyVerifier creates a verifier of tokens signed with the private half
+// of key, RS256 for RSA keys and ES256 for ECDSA ones.
+func newKeyVerifier(key crypto.PublicKey) (*JWTVerifier, error) {
+	switch k := key.(type) {
+	case *rsa.PublicKey:
+	case *ecdsa.PublicKey:
+		if k.Curve.Params().BitSize != 256 {
+			return nil, fmt.Errorf("JWT public key must be on P-256 for ES256")
+		}
+	default:
+		return nil, fmt.Errorf("JWT public key must be RSA or ECDSA, got %T", key)
+	}
+	return &JWTVerifier{publicKey: key, now: time.Now}, nil
+}
+
+// JWTFromEnv creates a verifier from KAPPA_JWT_SECRET, a shared secret, or
+// KAPPA_JWT_PUBLIC_KEY, the path of the issuer's PEM public key, checking
+// KAPPA_JWT_ISSUER and KAPPA_JWT_AUDIENCE when set. It returns nil when
+// neither key is set.
+func JWTFromEnv() (*JWTVerifier, error) {
+	var v *JWTVerifier
+	var err error
+	if secret := os.Getenv("KAPPA_JWT_SECRET"); secret != "" {
+		v, err = NewHMACVerifier([]byte(secret))
+	} else if path := os.Getenv("KAPPA_JWT_PUBLIC_KEY"); path != "" {
+		var data []byte
+		if data, err = os.ReadFile(path); err != nil {
+			return nil, fmt.Errorf("failed to read JWT public key: %w", err)
+		}
+		v, err = NewPublicKeyVerifier(data)
+	} else {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	v.Issuer = os.Getenv("KAPPA_JWT_ISSUER")
+	v.Audience = os.Getenv("KAPPA_JWT_AUDIENCE")
+	return v, nil
+}
+
+func (v *JWTVerifier) Name() string { return "jwt" }
+
+// Authenticate returns the subject of the JWT the request's bearer token
+// is, with the scopes it claims.
+func (v *JWTVerifier) Authenticate(r *http.Request) (rbac.Subject, bool) {
+	token, ok := bearerToken(r)
+	if !ok || strings.Count(token, ".") != 2 {
+		return rbac.Subject{}, false
+	}
+	claims, err := v.Verify(token, v.now())
+	if err != nil {
+		return rbac.Subject{}, false
+	}
+	return subjectFor(claims.Subject, claims.Scopes()), true
+}
+
+// Verify checks the token's signature and claims at now, returning its
+// claims.
+func (v *JWTVerifier) Verify(token string, now time.Time) (Claims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return Claims{}, errors.New("malformed token")
+	}
+	var header struct {
+		Alg string `json:"alg"`
+	}
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return Claims{}, fmt.Errorf("invalid header: %w", err)
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return Claims{}, fmt.Errorf("invalid signature: %w", err)
+	}
+	if err := v.verifySignature(header.Alg, parts[0]+"."+parts[1], signature); err != nil {
+		return Claims{}, err
+	}
+
+	var claims Claims
+	if err := decodeSegment(parts[1], &claims); err != nil {
+		return Claims{}, fmt.Errorf("invalid claims: %w", err)
+	}
+	if err := decodeSegment(parts[1], &claims.raw); err != nil {
+		return Claims{}, fmt.Errorf("invalid claims: %w", err)
+	}
+	if claims.Subject == "" {
+		return Claims{}, errors.New("token has no subject")
+	}
+	if claims.ExpiresAt == 0 {
+		return Claims{}, errors.New("token has no expiry")
+	}
+	if now.After(time.Unix(claims.ExpiresAt, 0).Add(leeway)) {
+		return Claims{}, errors.New("token expired")
+	}
+	if claims.NotBefore != 0 && now.Before(time.Unix(claims.NotBefore, 0).Add(-leeway)) {
+		return Claims{}, errors.New("token not valid yet")
+	}
+	if v.Issuer != "" && claims.Issuer != v.Issuer {
+		return Claims{}, fmt.Errorf("token issued by %q, expected %q", claims.Issuer, v.Issuer)
+	}
+	if v.Audience != "" && !slices.Contains(claims.Audience, v.Audience) {
+		return Claims{}, fmt.Errorf("token not meant for %q", v.Audience)
+	}
+	return claims, nil
+}
+
+// verifySignature checks signature over signed with alg, which must be the
+// algorithm of the verifier's key so tokens can't pick a weaker one.
+func (v *JWTVerifier) verifySignature(alg, signed string, signature []byte) error {
+	digest := sha256.Sum256([]byte(signed))
+	switch key := v.publicKey.(type) {
+	case nil:
+		if alg != "HS256" {
+			return fmt.Errorf("unexpected algorithm %q, expected HS256", alg)
+		}
+		mac := hmac.New(sha256.New, v.secret)
+		mac.Write([]byte(signed))
+		if !hmac.Equal(mac.Sum(nil), signature) {
+			return errors.New("invalid signature")
+		}
+	case *rsa.PublicKey:
+		if alg != "RS256" {
+			return fmt.Errorf("unexpected algorithm %q, expected RS256", alg)
+		}
+		if err := rsa.VerifyPKCS1v15(key, crypto.SHA256, digest[:], signature); err != nil {
+			return errors.New("invalid signature")
+		}
+	case *ecdsa.PublicKey:
+		if alg != "ES256" {
+			return fmt.Errorf("unexpected algorithm %q, expected ES256", alg)
+		}
+		// JWS signatures are r and s concatenated, not ASN.1
+		if len(signature) != 64 {
+			return errors.New("invalid signature")
+		}
+		r := new(big.Int).SetBytes(signature[:32])
+		s := new(big.Int).SetBytes(signature[32:])
+		if !ecdsa.Verify(key, digest[:], r, s) {
+			return errors.New("invalid signature")
+		}
+	}
+	return nil
+}
+
+func decodeSegment(segment string, v any) error {
+	data, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
@@ -0,0 +1,100 @@
+package auth
+
+import (
+	"crypto/x509"
+	"fmt"
+	"kappa-v2/service/internal/rbac"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// Identity is a client certificate's common name and what it may do.
+type Identity struct {
+	CommonName string
+	Scope      Scope
+}
+
+// ParseIdentity parses an identity written as commonName:scope.
+func ParseIdentity(s string) (Identity, error) {
+	name, scope, ok := strings.Cut(strings.TrimSpace(s), ":")
+	if !ok || name == "" {
+		return Identity{}, fmt.Errorf("invalid client identity, expected commonName:scope")
+	}
+	parsed, err := ParseScope(scope)
+	if err != nil {
+		return Identity{}, fmt.Errorf("invalid client identity %s: %w", name, err)
+	}
+	return Identity{CommonName: name, Scope: parsed}, nil
+}
+
+// MTLS authenticates requests by the TLS client certificate they were made
+// with, once it is verified against the client authorities. Certificates
+// whose common name isn't one of its identities aren't accepted.
+type MTLS struct {
+	clientCAs  *x509.CertPool
+	identities map[string][]Scope
+}
+
+// NewMTLS creates a provider of certificates issued by clientCAs to
+// identities. A common name given several scopes gets them all.
+func NewMTLS(clientCAs *x509.CertPool, identities []Identity) *MTLS {
+	m := &MTLS{clientCAs: clientCAs, identities: make(map[string][]Scope)}
+	for _, id := range identities {
+		m.identities[id.CommonName] = append(m.identities[id.CommonName], id.Scope)
+	}
+	return m
+}
+
+// MTLSFromEnv creates a provider of certificates issued by the authorities
+// in KAPPA_MTLS_CLIENT_CA, a PEM file, to KAPPA_MTLS_IDENTITIES, a comma
+// separated list of commonName:scope. It returns nil when no authority is
+// set.
+func MTLSFromEnv() (*MTLS, error) {
+	path := os.Getenv("KAPPA_MTLS_CLIENT_CA")
+	if path == "" {
+		return nil, nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read client CA: %w", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("client CA %s has no PEM certificates", path)
+	}
+
+	var identities []Identity
+	for _, v := range strings.Split(os.Getenv("KAPPA_MTLS_IDENTITIES"), ",") {
+		if strings.TrimSpace(v) == "" {
+			continue
+		}
+		id, err := ParseIdentity(v)
+		if err != nil {
+			return nil, err
+		}
+		identities = append(identities, id)
+	}
+	if len(identities) == 0 {
+		return nil, fmt.Errorf("KAPPA_MTLS_CLIENT_CA needs KAPPA_MTLS_IDENTITIES, no client would be accepted")
+	}
+	return NewMTLS(pool, identities), nil
+}
+
+func (m *MTLS) Name() string { return "mtls" }
+
+// Authenticate returns the subject of the request's verified client
+// certificate, named by its common name.
+func (m *MTLS) Authenticate(r *http.Request) (rbac.Subject, bool) {
+	// The TLS handshake verified the chain against clientCAs, requests
+	// without verified chains sent no certificate
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 || len(r.TLS.VerifiedChains[0]) == 0 {
+		return rbac.Subject{}, false
+	}
+	name := r.TLS.VerifiedChains[0][0].Subject.CommonName
+	scopes, ok := m.identities[name]
+	if !ok {
+		return rbac.Subject{}, false
+	}
+	return subjectFor(name, scopes), true
+}
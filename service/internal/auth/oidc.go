@@ -0,0 +1,242 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"kappa-v2/service/internal/rbac"
+	"math/big"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// jwksRefreshInterval is how often the identity provider's keys may be
+// fetched again for a token signed with a key we don't know, so rotated
+// keys are picked up without tokens forcing a fetch each
+const jwksRefreshInterval = time.Minute
+
+// OIDC authenticates ID and access tokens issued by an OpenID Connect
+// identity provider, with the signing keys it publishes. The provider's
+// configuration is discovered from its issuer URL on first use.
+type OIDC struct {
+	Issuer   string
+	Audience string
+	// ScopesClaim names a claim, like groups or roles, whose values are
+	// scopes too, for identity providers that can't issue scope claims
+	ScopesClaim string
+
+	client *http.Client
+	now    func() time.Time
+
+	mu        sync.Mutex
+	verifiers map[string]*JWTVerifier
+	fetchedAt time.Time
+}
+
+// NewOIDC creates a provider of tokens issued by issuer for audience,
+// usually the client ID the service is registered with.
+func NewOIDC(issuer, audience string) (*OIDC, error) {
+	if !strings.HasPrefix(issuer, "https://") && !strings.HasPrefix(issuer, "http://") {
+		return nil, fmt.Errorf("invalid OIDC issuer %q, expected a URL", issuer)
+	}
+	if audience == "" {
+		return nil, errors.New("OIDC needs an audience, the client ID tokens are issued for")
+	}
+	return &OIDC{
+		Issuer:   strings.TrimSuffix(issuer, "/"),
+		Audience: audience,
+		client:   &http.Client{Timeout: 10 * time.Second},
+		now:      time.Now,
+	}, nil
+}
+
+// OIDCFromEnv creates a provider of tokens issued by KAPPA_OIDC_ISSUER for
+// KAPPA_OIDC_AUDIENCE, reading scopes from KAPPA_OIDC_SCOPES_CLAIM too when
+// set. It returns nil when no issuer is set.
+func OIDCFromEnv() (*OIDC, error) {
+	issuer := os.Getenv("KAPPA_OIDC_ISSUER")
+	if issuer == "" {
+		return nil, nil
+	}
+	o, err := NewOIDC(issuer, os.Getenv("KAPPA_OIDC_AUDIENCE"))
+	if err != nil {
+		return nil, err
+	}
+	o.ScopesClaim = os.Getenv("KAPPA_OIDC_SCOPES_CLAIM")
+	return o, nil
+}
+
+func (o *OIDC) Name() string { return "oidc" }
+
+// Authenticate returns the subject of the token the request's bearer token
+// is, with the scopes it claims.
+func (o *OIDC) Authenticate(r *http.Request) (rbac.Subject, bool) {
+	token, ok := bearerToken(r)
+	if !ok || strings.Count(token, ".") != 2 {
+		return rbac.Subject{}, false
+	}
+	var header struct {
+		Kid string `json:"kid"`
+	}
+	if err := decodeSegment(token[:strings.Index(token, ".")], &header); err != nil {
+		return rbac.Subject{}, false
+	}
+	v, err := o.verifier(header.Kid)
+	if err != nil {
+		return rbac.Subject{}, false
+	}
+	claims, err := v.Verify(token, o.now())
+	if err != nil {
+		return rbac.Subject{}, false
+	}
+
+	scopes := claims.Scopes()
+	if o.ScopesClaim != "" {
+		for _, name := range claims.Strings(o.ScopesClaim) {
+			if scope, err := ParseScope(name); err == nil {
+				scopes = append(scopes, scope)
+			}
+		}
+	}
+	return subjectFor(claims.Subject, scopes), true
+}
+
+// verifier returns the verifier of tokens signed with the key kid, the
+// only key when tokens don't say. Keys are fetched again when kid isn't
+// known, at most once every jwksRefreshInterval.
+func (o *OIDC) verifier(kid string) (*JWTVerifier, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if v := o.lookup(kid); v != nil {
+		return v, nil
+	}
+	if o.verifiers != nil && o.now().Sub(o.fetchedAt) < jwksRefreshInterval {
+		return nil, fmt.Errorf("unknown signing key %q", kid)
+	}
+	verifiers, err := o.fetchKeys()
+	if err != nil {
+		return nil, err
+	}
+	o.verifiers, o.fetchedAt = verifiers, o.now()
+	if v := o.lookup(kid); v != nil {
+		return v, nil
+	}
+	return nil, fmt.Errorf("unknown signing key %q", kid)
+}
+
+// lookup returns the verifier for kid. The caller must hold mu.
+func (o *OIDC) lookup(kid string) *JWTVerifier {
+	if kid == "" && len(o.verifiers) == 1 {
+		for _, v := range o.verifiers {
+			return v
+		}
+	}
+	return o.verifiers[kid]
+}
+
+// fetchKeys discovers the identity provider's key set and creates a
+// verifier for each signing key in it.
+func (o *OIDC) fetchKeys() (map[string]*JWTVerifier, error) {
+	var discovery struct {
+		Issuer  string `json:"issuer"`
+		JWKSURI string `json:"jwks_uri"`
+	}
+	if err := o.getJSON(o.Issuer+"/.well-known/openid-configuration", &discovery); err != nil {
+		return nil, fmt.Errorf("failed to discover OIDC configuration: %w", err)
+	}
+	if strings.TrimSuffix(discovery.Issuer, "/") != o.Issuer {
+		return nil, fmt.Errorf("OIDC configuration is for issuer %q, expected %q", discovery.Issuer, o.Issuer)
+	}
+	var set struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err := o.getJSON(discovery.JWKSURI, &set); err != nil {
+		return nil, fmt.Errorf("failed to fetch OIDC signing keys: %w", err)
+	}
+
+	verifiers := make(map[string]*JWTVerifier)
+	for _, k := range set.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		key, err := k.publicKey()
+		if err != nil {
+			// Keys of kinds we don't verify with are skipped, like
+			// those only meant for other algorithms
+			continue
+		}
+		v, err := newKeyVerifier(key)
+		if err != nil {
+			continue
+		}
+		v.Issuer, v.Audience = discovery.Issuer, o.Audience
+		verifiers[k.Kid] = v
+	}
+	if len(verifiers) == 0 {
+		return nil, errors.New("OIDC key set has no RSA or P-256 signing keys")
+	}
+	return verifiers, nil
+}
+
+func (o *OIDC) getJSON(url string, v any) error {
+	resp, err := o.client.Get(url)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("GET %s: %s", url, resp.Status)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// jwk is a public key in a JSON Web Key Set.
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	Crv string `json:"crv"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+func (k jwk) publicKey() (crypto.PublicKey, error) {
+	switch k.Kty {
+	case "RSA":
+		n, err := base64.RawURLEncoding.DecodeString(k.N)
+		if err != nil {
+			return nil, fmt.Errorf("invalid RSA modulus: %w", err)
+		}
+		e, err := base64.RawURLEncoding.DecodeString(k.E)
+		if err != nil || len(e) > 4 {
+			return nil, errors.New("invalid RSA exponent")
+		}
+		return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}, nil
+	case "EC":
+		if k.Crv != "P-256" {
+			return nil, fmt.Errorf("unsupported curve %q", k.Crv)
+		}
+		x, errX := base64.RawURLEncoding.DecodeString(k.X)
+		y, errY := base64.RawURLEncoding.DecodeString(k.Y)
+		if errX != nil || errY != nil {
+			return nil, errors.New("invalid EC point")
+		}
+		key := &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+		if !key.Curve.IsOnCurve(key.X, key.Y) {
+			return nil, errors.New("EC point is not on P-256")
+		}
+		return key, nil
+	default:
+		return nil, fmt.Errorf("unsupported key type %q", k.Kty)
+	}
+}
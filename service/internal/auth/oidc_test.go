@@ -0,0 +1,138 @@
+package auth
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/json"
+	"kappa-v2/service/internal/rbac"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func signES256(t *testing.T, key *ecdsa.PrivateKey, kid string, claims map[string]any) string {
+	t.Helper()
+	signed := segment(t, map[string]any{"alg": "ES256", "kid": kid}) + "." + segment(t, claims)
+	digest := sha256.Sum256([]byte(signed))
+	r, s, err := ecdsa.Sign(rand.Reader, key, digest[:])
+	require.NoError(t, err)
+	signature := make([]byte, 64)
+	r.FillBytes(signature[:32])
+	s.FillBytes(signature[32:])
+	return signed + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+// identityProvider serves an OIDC configuration and the public halves of
+// keys, counting how often the key set is fetched.
+func identityProvider(t *testing.T, keys map[string]*ecdsa.PrivateKey) (*httptest.Server, *int) {
+	fetches := 0
+	var server *httptest.Server
+	server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/.well-known/openid-configuration":
+			json.NewEncoder(w).Encode(map[string]string{"issuer": server.URL, "jwks_uri": server.URL + "/jwks"})
+		case "/jwks":
+			fetches++
+			var set []map[string]string
+			for kid, key := range keys {
+				set = append(set, map[string]string{
+					"kty": "EC", "crv": "P-256", "kid": kid, "use": "sig",
+					"x": base64.RawURLEncoding.EncodeToString(key.X.FillBytes(make([]byte, 32))),
+					"y": base64.RawURLEncoding.EncodeToString(key.Y.FillBytes(make([]byte, 32))),
+				})
+			}
+			json.NewEncoder(w).Encode(map[string]any{"keys": set})
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	t.Cleanup(server.Close)
+	return server, &fetches
+}
+
+func TestOIDC(t *testing.T) {
+	first, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	keys := map[string]*ecdsa.PrivateKey{"first": first}
+	server, fetches := identityProvider(t, keys)
+
+	o, err := NewOIDC(server.URL, "kappa")
+	require.NoError(t, err)
+	o.ScopesClaim = "groups"
+	now := time.Now()
+	o.now = func() time.Time { return now }
+
+	claims := map[string]any{
+		"sub":    "alice",
+		"iss":    server.URL,
+		"aud":    "kappa",
+		"exp":    now.Add(time.Hour).Unix(),
+		"scope":  "openid invoke",
+		"groups": []string{"engineering", "deploy"},
+	}
+	subject, ok := o.Authenticate(bearer(signES256(t, first, "first", claims)))
+	require.True(t, ok)
+	assert.Equal(t, "alice", subject.Name)
+	assert.True(t, subject.Allowed(rbac.Invoke, "shop"))
+	assert.True(t, subject.Allowed(rbac.Deploy, "shop"), "scopes come from the groups claim too")
+	assert.False(t, subject.AllowedAnywhere(rbac.Manage))
+	assert.Equal(t, 1, *fetches)
+
+	claims["aud"] = "other"
+	_, ok = o.Authenticate(bearer(signES256(t, first, "first", claims)))
+	assert.False(t, ok, "tokens for other clients aren't accepted")
+	claims["aud"] = "kappa"
+
+	// Rotated keys are fetched, but not more than once a refresh interval
+	second, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	keys["second"] = second
+	_, ok = o.Authenticate(bearer(signES256(t, second, "second", claims)))
+	assert.False(t, ok)
+	assert.Equal(t, 1, *fetches)
+
+	now = now.Add(jwksRefreshInterval)
+	claims["exp"] = now.Add(time.Hour).Unix()
+	_, ok = o.Authenticate(bearer(signES256(t, second, "second", claims)))
+	assert.True(t, ok)
+	assert.Equal(t, 2, *fetches)
+
+	_, err = NewOIDC(server.URL, "")
+	assert.Error(t, err, "an audience is required")
+}
+
+func TestMTLS(t *testing.T) {
+	id, err := ParseIdentity("deployer:deploy")
+	require.NoError(t, err)
+	m := NewMTLS(x509.NewCertPool(), []Identity{id, {CommonName: "deployer", Scope: ScopeRead}})
+	a := New(m)
+
+	withCert := func(name string) *http.Request {
+		r := httptest.NewRequest(http.MethodGet, "/functions", nil)
+		r.TLS = &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{{Subject: pkix.Name{CommonName: name}}}}}
+		return r
+	}
+	subject, ok := a.Authenticate(withCert("deployer"))
+	require.True(t, ok)
+	assert.Equal(t, "deployer", subject.Name)
+	assert.True(t, subject.Allowed(rbac.Deploy, "shop"))
+
+	_, ok = a.Authenticate(withCert("stranger"))
+	assert.False(t, ok)
+	_, ok = a.Authenticate(bearer("token"))
+	assert.False(t, ok, "requests without a verified certificate aren't accepted")
+	assert.NotNil(t, a.ClientCAs())
+
+	_, err = ParseIdentity("deployer:root")
+	assert.Error(t, err)
+}
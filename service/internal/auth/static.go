@@ -0,0 +1,101 @@
+package auth
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"fmt"
+	"kappa-v2/service/internal/rbac"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// Key is a static API key and what it may do.
+type Key struct {
+	Name  string
+	Scope Scope
+	Key   string
+}
+
+// ParseKey parses a key written as name:scope:key.
+func ParseKey(s string) (Key, error) {
+	parts := strings.SplitN(strings.TrimSpace(s), ":", 3)
+	if len(parts) != 3 || parts[0] == "" || parts[2] == "" {
+		return Key{}, fmt.Errorf("invalid API key, expected name:scope:key")
+	}
+	scope, err := ParseScope(parts[1])
+	if err != nil {
+		return Key{}, fmt.Errorf("invalid API key %s: %w", parts[0], err)
+	}
+	return Key{Name: parts[0], Scope: scope, Key: parts[2]}, nil
+}
+
+// Static authenticates bearer tokens that are one of its API keys. Only a
+// hash of each key is kept.
+type Static struct {
+	keys map[[sha256.Size]byte]rbac.Subject
+}
+
+// NewStatic creates a provider of keys.
+func NewStatic(keys []Key) (*Static, error) {
+	s := &Static{keys: make(map[[sha256.Size]byte]rbac.Subject, len(keys))}
+	for _, k := range keys {
+		hash := sha256.Sum256([]byte(k.Key))
+		if _, exists := s.keys[hash]; exists {
+			return nil, fmt.Errorf("API key %s is used twice", k.Name)
+		}
+		s.keys[hash] = subjectFor(k.Name, []Scope{k.Scope})
+	}
+	return s, nil
+}
+
+// StaticFromEnv creates a provider of the keys in KAPPA_API_KEYS, a comma
+// separated list of name:scope:key, or KAPPA_API_KEYS_FILE, a file with one
+// per line. It returns nil when there are no keys.
+func StaticFromEnv() (*Static, error) {
+	var lines []string
+	if v := os.Getenv("KAPPA_API_KEYS"); v != "" {
+		lines = strings.Split(v, ",")
+	} else if path := os.Getenv("KAPPA_API_KEYS_FILE"); path != "" {
+		file, err := os.Open(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read API keys: %w", err)
+		}
+		defer file.Close()
+		scanner := bufio.NewScanner(file)
+		for scanner.Scan() {
+			lines = append(lines, scanner.Text())
+		}
+		if err := scanner.Err(); err != nil {
+			return nil, fmt.Errorf("failed to read API keys: %w", err)
+		}
+	}
+
+	var keys []Key
+	for _, line := range lines {
+		if line = strings.TrimSpace(line); line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		key, err := ParseKey(line)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+	if len(keys) == 0 {
+		return nil, nil
+	}
+	return NewStatic(keys)
+}
+
+func (s *Static) Name() string { return "static" }
+
+// Authenticate returns the subject of the key the request's bearer token is.
+func (s *Static) Authenticate(r *http.Request) (rbac.Subject, bool) {
+	token, ok := bearerToken(r)
+	if !ok {
+		return rbac.Subject{}, false
+	}
+	subject, ok := s.keys[sha256.Sum256([]byte(token))]
+	return subject, ok
+}
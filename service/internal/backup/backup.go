@@ -0,0 +1,409 @@
+// Package backup snapshots what an installation needs to come back on a
+// fresh host into a single archive, and restores it: the function registry,
+// the schedules and audit trail kept with it in Postgres, the secrets
+// functions reference, encrypted, and the artifact store.
+package backup
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"kappa-v2/service/internal/artifact"
+	"kappa-v2/service/internal/payload"
+	"kappa-v2/service/internal/repository"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Format is the version of the archive layout, restores refuse archives of
+// a newer one
+const Format = 1
+
+// Entries of an archive. The manifest comes first, artifacts last.
+const (
+	manifestEntry  = "manifest.json"
+	functionsEntry = "registry/functions.json"
+	schedulesEntry = "registry/schedules.json"
+	auditEntry     = "registry/audit.json"
+	secretsDir     = "secrets/"
+	artifactsDir   = "artifacts/sha256/"
+)
+
+// ErrNotEmpty is returned when restoring onto an installation that already
+// has functions, without forcing it.
+var ErrNotEmpty = errors.New("installation already has functions")
+
+// Manifest describes an archive.
+type Manifest struct {
+	Format    int       `json:"format"`
+	CreatedAt time.Time `json:"createdAt"`
+	Host      string    `json:"host,omitempty"`
+	// Registry is where the functions were kept, file or postgres
+	Registry    string `json:"registry"`
+	Functions   int    `json:"functions"`
+	Schedules   int    `json:"schedules"`
+	AuditEvents int    `json:"auditEvents"`
+	Artifacts   int    `json:"artifacts"`
+	Secrets     int    `json:"secrets"`
+}
+
+// Installation is where a service keeps its state.
+type Installation struct {
+	// Registry keeps the registered functions
+	Registry repository.Repository
+	// Postgres keeps schedules and the audit trail, nil without a database
+	Postgres  *repository.Postgres
+	Artifacts *artifact.Store
+	// SecretsDir holds one file per secret
+	SecretsDir string
+	// Sealer encrypts secrets in the archive. Backing up secrets without one
+	// fails rather than write them in the clear.
+	Sealer *payload.Sealer
+}
+
+// KeyFromEnv creates the sealer secrets are encrypted with from
+// KAPPA_BACKUP_KEY, a base64 32 byte key, or KAPPA_BACKUP_KEY_FILE, a file
+// holding one. It returns nil when neither is set.
+func KeyFromEnv() (*payload.Sealer, error) {
+	encoded := os.Getenv("KAPPA_BACKUP_KEY")
+	if encoded == "" {
+		keyPath := os.Getenv("KAPPA_BACKUP_KEY_FILE")
+		if keyPath == "" {
+			return nil, nil
+		}
+		data, err := os.ReadFile(keyPath)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read backup key: %w", err)
+		}
+		encoded = string(data)
+	}
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(encoded))
+	if err != nil {
+		return nil, fmt.Errorf("invalid backup key: %w", err)
+	}
+	return payload.NewSealer(key)
+}
+
+// Create writes an archive of inst to w, skipping its secrets when told to.
+func Create(w io.Writer, inst Installation, skipSecrets bool) (Manifest, error) {
+	functions, err := inst.Registry.List()
+	if err != nil {
+		return Manifest{}, err
+	}
+	var schedules []repository.Schedule
+	var events []repository.AuditEvent
+	registry := "file"
+	if inst.Postgres != nil {
+		registry = "postgres"
+		if schedules, err = inst.Postgres.ListSchedules(); err != nil {
+			return Manifest{}, err
+		}
+		if events, err = inst.Postgres.ListAudit("", 0); err != nil {
+			return Manifest{}, err
+		}
+	}
+	var secrets []string
+	if !skipSecrets {
+		if secrets, err = listSecrets(inst.SecretsDir); err != nil {
+			return Manifest{}, err
+		}
+		if len(secrets) > 0 && inst.Sealer == nil {
+			return Manifest{}, fmt.Errorf("backing up %d secrets needs a key to encrypt them with, set KAPPA_BACKUP_KEY or skip them", len(secrets))
+		}
+	}
+	digests, err := inst.Artifacts.Blobs()
+	if err != nil {
+		return Manifest{}, err
+	}
+
+	host, _ := os.Hostname()
+	manifest := Manifest{
+		Format:      Format,
+		CreatedAt:   time.Now().UTC(),
+		Host:        host,
+		Registry:    registry,
+		Functions:   len(functions),
+		Schedules:   len(schedules),
+		AuditEvents: len(events),
+		Artifacts:   len(digests),
+		Secrets:     len(secrets),
+	}
+
+	gz := gzip.NewWriter(w)
+	tw := tar.NewWriter(gz)
+	if err := writeJSON(tw, manifestEntry, manifest); err != nil {
+		return Manifest{}, err
+	}
+	if err := writeJSON(tw, functionsEntry, functions); err != nil {
+		return Manifest{}, err
+	}
+	if inst.Postgres != nil {
+		if err := writeJSON(tw, schedulesEntry, schedules); err != nil {
+			return Manifest{}, err
+		}
+		if err := writeJSON(tw, auditEntry, events); err != nil {
+			return Manifest{}, err
+		}
+	}
+	for _, name := range secrets {
+		data, err := os.ReadFile(filepath.Join(inst.SecretsDir, name))
+		if err != nil {
+			return Manifest{}, fmt.Errorf("failed to read secret %s: %w", name, err)
+		}
+		sealed, err := inst.Sealer.Seal(data)
+		if err != nil {
+			return Manifest{}, fmt.Errorf("failed to encrypt secret %s: %w", name, err)
+		}
+		if err := writeBytes(tw, secretsDir+name, sealed); err != nil {
+			return Manifest{}, err
+		}
+	}
+	for _, digest := range digests {
+		if err := writeFile(tw, artifactsDir+digest, inst.Artifacts.Path(digest)); err != nil {
+			return Manifest{}, err
+		}
+		meta, err := inst.Artifacts.Meta(digest)
+		if err != nil {
+			return Manifest{}, err
+		}
+		for _, name := range meta {
+			if err := writeFile(tw, artifactsDir+digest+"."+name, inst.Artifacts.Path(digest)+"."+name); err != nil {
+				return Manifest{}, err
+			}
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return Manifest{}, fmt.Errorf("failed to write archive: %w", err)
+	}
+	if err := gz.Close(); err != nil {
+		return Manifest{}, fmt.Errorf("failed to write archive: %w", err)
+	}
+	return manifest, nil
+}
+
+// listSecrets returns the names of the secrets in dir, none when it doesn't
+// exist.
+func listSecrets(dir string) ([]string, error) {
+	entries, err := os.ReadDir(dir)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to list secrets: %w", err)
+	}
+	var names []string
+	for _, entry := range entries {
+		// Kubernetes mounts secrets as symlinks into a hidden directory
+		if strings.HasPrefix(entry.Name(), ".") || entry.IsDir() {
+			continue
+		}
+		names = append(names, entry.Name())
+	}
+	return names, nil
+}
+
+func writeJSON(tw *tar.Writer, name string, v any) error {
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode %s: %w", name, err)
+	}
+	return writeBytes(tw, name, data)
+}
+
+func writeBytes(tw *tar.Writer, name string, data []byte) error {
+	header := &tar.Header{Name: name, Mode: 0600, Size: int64(len(data)), ModTime: time.Now()}
+	if err := tw.WriteHeader(header); err != nil {
+		return fmt.Errorf("failed to write %s: %w", name, err)
+	}
+	if _, err := tw.Write(data); err != nil {
+		return fmt.Errorf("failed to write %s: %w", name, err)
+	}
+	return nil
+}
+
+func writeFile(tw *tar.Writer, name, filePath string) error {
+	f, err := os.Open(filePath)
+	if err != nil {
+		return fmt.Errorf("failed to read %s: %w", name, err)
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return fmt.Errorf("failed to read %s: %w", name, err)
+	}
+	header := &tar.Header{Name: name, Mode: 0644, Size: info.Size(), ModTime: info.ModTime()}
+	if err := tw.WriteHeader(header); err != nil {
+		return fmt.Errorf("failed to write %s: %w", name, err)
+	}
+	if _, err := io.Copy(tw, f); err != nil {
+		return fmt.Errorf("failed to write %s: %w", name, err)
+	}
+	return nil
+}
+
+// Restore reads an archive from r into inst. Artifacts are checked against
+// their digests and the registry is written last, so a failed restore
+// leaves no function pointing at a missing binary. It refuses to restore
+// onto an installation that has functions unless forced, replacing those of
+// the same names when it is.
+func Restore(r io.Reader, inst Installation, force bool) (Manifest, error) {
+	existing, err := inst.Registry.List()
+	if err != nil {
+		return Manifest{}, err
+	}
+	if len(existing) > 0 && !force {
+		return Manifest{}, fmt.Errorf("%w: %d registered", ErrNotEmpty, len(existing))
+	}
+
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		return Manifest{}, fmt.Errorf("failed to read archive: %w", err)
+	}
+	defer gz.Close()
+	tr := tar.NewReader(gz)
+
+	var manifest Manifest
+	var functions []repository.Function
+	var schedules []repository.Schedule
+	var events []repository.AuditEvent
+	restored := Manifest{}
+	for first := true; ; first = false {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return Manifest{}, fmt.Errorf("failed to read archive: %w", err)
+		}
+		name := path.Clean(header.Name)
+		if first != (name == manifestEntry) {
+			return Manifest{}, fmt.Errorf("archive doesn't start with its manifest")
+		}
+		switch {
+		case name == manifestEntry:
+			if err := json.NewDecoder(tr).Decode(&manifest); err != nil {
+				return Manifest{}, fmt.Errorf("invalid manifest: %w", err)
+			}
+			if manifest.Format < 1 || manifest.Format > Format {
+				return Manifest{}, fmt.Errorf("archive format %d isn't supported, expected at most %d", manifest.Format, Format)
+			}
+		case name == functionsEntry:
+			if err := json.NewDecoder(tr).Decode(&functions); err != nil {
+				return Manifest{}, fmt.Errorf("invalid %s: %w", name, err)
+			}
+		case name == schedulesEntry:
+			if err := json.NewDecoder(tr).Decode(&schedules); err != nil {
+				return Manifest{}, fmt.Errorf("invalid %s: %w", name, err)
+			}
+		case name == auditEntry:
+			if err := json.NewDecoder(tr).Decode(&events); err != nil {
+				return Manifest{}, fmt.Errorf("invalid %s: %w", name, err)
+			}
+		case strings.HasPrefix(name, secretsDir):
+			if err := restoreSecret(tr, inst, strings.TrimPrefix(name, secretsDir)); err != nil {
+				return Manifest{}, err
+			}
+			restored.Secrets++
+		case strings.HasPrefix(name, artifactsDir):
+			isBlob, err := restoreArtifact(tr, inst.Artifacts, strings.TrimPrefix(name, artifactsDir))
+			if err != nil {
+				return Manifest{}, err
+			}
+			if isBlob {
+				restored.Artifacts++
+			}
+		default:
+			return Manifest{}, fmt.Errorf("unexpected archive entry %s", header.Name)
+		}
+	}
+	if manifest.Format == 0 {
+		return Manifest{}, fmt.Errorf("archive has no manifest")
+	}
+
+	if (len(schedules) > 0 || len(events) > 0) && inst.Postgres == nil {
+		return Manifest{}, fmt.Errorf("archive has schedules and audit events, restoring them needs a database")
+	}
+	if inst.Postgres != nil {
+		for _, schedule := range schedules {
+			if err := inst.Postgres.SaveSchedule(schedule); err != nil {
+				return Manifest{}, err
+			}
+			restored.Schedules++
+		}
+		for _, event := range events {
+			if err := inst.Postgres.RecordAudit(event); err != nil {
+				return Manifest{}, err
+			}
+			restored.AuditEvents++
+		}
+	}
+	for _, fn := range functions {
+		if err := inst.Registry.Save(fn); err != nil {
+			return Manifest{}, err
+		}
+		restored.Functions++
+	}
+
+	restored.Format = manifest.Format
+	restored.CreatedAt = manifest.CreatedAt
+	restored.Host = manifest.Host
+	restored.Registry = manifest.Registry
+	return restored, nil
+}
+
+// restoreSecret decrypts a secret into the secrets directory.
+func restoreSecret(r io.Reader, inst Installation, name string) error {
+	if name != filepath.Base(name) || strings.HasPrefix(name, ".") {
+		return fmt.Errorf("invalid secret name %q", name)
+	}
+	if inst.Sealer == nil {
+		return fmt.Errorf("restoring secrets needs the key they were encrypted with, set KAPPA_BACKUP_KEY")
+	}
+	sealed, err := io.ReadAll(r)
+	if err != nil {
+		return fmt.Errorf("failed to read secret %s: %w", name, err)
+	}
+	data, err := inst.Sealer.Open(sealed)
+	if err != nil {
+		return fmt.Errorf("failed to decrypt secret %s: %w", name, err)
+	}
+	if err := os.MkdirAll(inst.SecretsDir, 0700); err != nil {
+		return fmt.Errorf("failed to create secrets directory: %w", err)
+	}
+	if err := os.WriteFile(filepath.Join(inst.SecretsDir, name), data, 0600); err != nil {
+		return fmt.Errorf("failed to write secret %s: %w", name, err)
+	}
+	return nil
+}
+
+// restoreArtifact adds a blob or its metadata to the store, checking blobs
+// hash to the digest they are named after. It reports whether it was a
+// blob.
+func restoreArtifact(r io.Reader, store *artifact.Store, name string) (bool, error) {
+	digest, meta, isMeta := strings.Cut(name, ".")
+	if name != filepath.Base(name) || digest == "" {
+		return false, fmt.Errorf("invalid artifact name %q", name)
+	}
+	if isMeta {
+		data, err := io.ReadAll(r)
+		if err != nil {
+			return false, fmt.Errorf("failed to read artifact metadata %s: %w", name, err)
+		}
+		return false, store.PutMeta(digest, meta, data)
+	}
+	got, err := store.Put(r)
+	if err != nil {
+		return false, err
+	}
+	if got != digest {
+		return false, fmt.Errorf("artifact %s is corrupt, it hashes to %s", digest, got)
+	}
+	return true, nil
+}
@@ -0,0 +1,151 @@
+package backup
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"io"
+	"kappa-v2/service/internal/artifact"
+	"kappa-v2/service/internal/payload"
+	"kappa-v2/service/internal/repository"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newInstallation creates an empty installation in a temp directory.
+func newInstallation(t *testing.T, sealer *payload.Sealer) Installation {
+	dir := t.TempDir()
+	registry, err := repository.OpenFile(filepath.Join(dir, "functions.json"))
+	require.NoError(t, err)
+	artifacts, err := artifact.NewStore(filepath.Join(dir, "artifacts"))
+	require.NoError(t, err)
+	return Installation{
+		Registry:   registry,
+		Artifacts:  artifacts,
+		SecretsDir: filepath.Join(dir, "secrets"),
+		Sealer:     sealer,
+	}
+}
+
+func testSealer(t *testing.T) *payload.Sealer {
+	sealer, err := payload.NewSealer(bytes.Repeat([]byte{7}, 32))
+	require.NoError(t, err)
+	return sealer
+}
+
+func TestCreateRestore(t *testing.T) {
+	sealer := testSealer(t)
+	src := newInstallation(t, sealer)
+	digest, err := src.Artifacts.Put(strings.NewReader("binary"))
+	require.NoError(t, err)
+	require.NoError(t, src.Artifacts.PutMeta(digest, "sbom", []byte(`{"packages":[]}`)))
+	now := time.Now().UTC().Truncate(time.Second)
+	require.NoError(t, src.Registry.Save(repository.Function{Name: "orders", Config: json.RawMessage(`{"name":"orders"}`), Digest: digest, UpdatedAt: now}))
+	require.NoError(t, os.MkdirAll(src.SecretsDir, 0700))
+	require.NoError(t, os.WriteFile(filepath.Join(src.SecretsDir, "db-password"), []byte("hunter2\n"), 0600))
+
+	var archive bytes.Buffer
+	manifest, err := Create(&archive, src, false)
+	require.NoError(t, err)
+	assert.Equal(t, Format, manifest.Format)
+	assert.Equal(t, "file", manifest.Registry)
+	assert.Equal(t, 1, manifest.Functions)
+	assert.Equal(t, 1, manifest.Artifacts)
+	assert.Equal(t, 1, manifest.Secrets)
+	assert.NotContains(t, gunzip(t, archive.Bytes()), "hunter2", "secrets are encrypted")
+
+	dst := newInstallation(t, sealer)
+	restored, err := Restore(bytes.NewReader(archive.Bytes()), dst, false)
+	require.NoError(t, err)
+	assert.Equal(t, 1, restored.Functions)
+	assert.Equal(t, 1, restored.Artifacts)
+	assert.Equal(t, 1, restored.Secrets)
+
+	functions, err := dst.Registry.List()
+	require.NoError(t, err)
+	require.Len(t, functions, 1)
+	assert.Equal(t, digest, functions[0].Digest)
+	require.NoError(t, dst.Artifacts.Verify(digest))
+	sbom, err := dst.Artifacts.GetMeta(digest, "sbom")
+	require.NoError(t, err)
+	assert.JSONEq(t, `{"packages":[]}`, string(sbom))
+	secret, err := os.ReadFile(filepath.Join(dst.SecretsDir, "db-password"))
+	require.NoError(t, err)
+	assert.Equal(t, "hunter2\n", string(secret))
+	info, err := os.Stat(filepath.Join(dst.SecretsDir, "db-password"))
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0600), info.Mode().Perm())
+
+	// Restoring again onto the installation needs forcing
+	_, err = Restore(bytes.NewReader(archive.Bytes()), dst, false)
+	assert.ErrorIs(t, err, ErrNotEmpty)
+	_, err = Restore(bytes.NewReader(archive.Bytes()), dst, true)
+	assert.NoError(t, err)
+}
+
+func TestCreate_SecretsNeedAKey(t *testing.T) {
+	src := newInstallation(t, nil)
+	require.NoError(t, os.MkdirAll(src.SecretsDir, 0700))
+	require.NoError(t, os.WriteFile(filepath.Join(src.SecretsDir, "token"), []byte("x"), 0600))
+
+	_, err := Create(io.Discard, src, false)
+	assert.ErrorContains(t, err, "KAPPA_BACKUP_KEY")
+	manifest, err := Create(io.Discard, src, true)
+	require.NoError(t, err)
+	assert.Zero(t, manifest.Secrets)
+}
+
+func TestRestore_WrongKey(t *testing.T) {
+	src := newInstallation(t, testSealer(t))
+	require.NoError(t, os.MkdirAll(src.SecretsDir, 0700))
+	require.NoError(t, os.WriteFile(filepath.Join(src.SecretsDir, "token"), []byte("x"), 0600))
+	var archive bytes.Buffer
+	_, err := Create(&archive, src, false)
+	require.NoError(t, err)
+
+	other, err := payload.NewSealer(bytes.Repeat([]byte{8}, 32))
+	require.NoError(t, err)
+	_, err = Restore(&archive, newInstallation(t, other), false)
+	assert.ErrorContains(t, err, "failed to decrypt secret token")
+}
+
+func TestRestore_CorruptArtifact(t *testing.T) {
+	var archive bytes.Buffer
+	gz := gzip.NewWriter(&archive)
+	tw := tar.NewWriter(gz)
+	require.NoError(t, writeJSON(tw, manifestEntry, Manifest{Format: Format}))
+	// sha256("binary") with other content
+	require.NoError(t, writeBytes(tw, artifactsDir+"9a3a45d01531a20e89ac6ae10b0b0beb0492acd7216a368aa062d1a5fecaf9cd", []byte("tampered")))
+	require.NoError(t, tw.Close())
+	require.NoError(t, gz.Close())
+
+	_, err := Restore(&archive, newInstallation(t, nil), false)
+	assert.ErrorContains(t, err, "is corrupt")
+}
+
+func TestRestore_RejectsNewerFormats(t *testing.T) {
+	var archive bytes.Buffer
+	gz := gzip.NewWriter(&archive)
+	tw := tar.NewWriter(gz)
+	require.NoError(t, writeJSON(tw, manifestEntry, Manifest{Format: Format + 1}))
+	require.NoError(t, tw.Close())
+	require.NoError(t, gz.Close())
+
+	_, err := Restore(&archive, newInstallation(t, nil), false)
+	assert.ErrorContains(t, err, "isn't supported")
+}
+
+func gunzip(t *testing.T, data []byte) string {
+	gz, err := gzip.NewReader(bytes.NewReader(data))
+	require.NoError(t, err)
+	plain, err := io.ReadAll(gz)
+	require.NoError(t, err)
+	return string(plain)
+}
@@ -0,0 +1,198 @@
+// Package batch collects events into batches, delivered when a batch is
+// full or its window closes, and retries the items a delivery reports as
+// failed in later batches.
+package batch
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"kappa-v2/pkg/logger"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// Limits on batch windows
+const (
+	MaxItems           = 10000
+	MaxWindow          = 5 * time.Minute
+	defaultMaxAttempts = 3
+)
+
+// Window is when a batch is delivered: once it holds MaxItems items or
+// WindowMs after its first one, whichever is first. Items are delivered
+// MaxAttempts times at most, 3 when 0.
+type Window struct {
+	MaxItems    int `json:"maxItems"`
+	WindowMs    int `json:"windowMs"`
+	MaxAttempts int `json:"maxAttempts,omitempty"`
+}
+
+// Validate checks the window delivers batches.
+func (w Window) Validate() error {
+	if w.MaxItems < 1 || w.MaxItems > MaxItems {
+		return fmt.Errorf("maxItems must be between 1 and %d", MaxItems)
+	}
+	if w.WindowMs < 1 || time.Duration(w.WindowMs)*time.Millisecond > MaxWindow {
+		return fmt.Errorf("windowMs must be between 1 and %d", MaxWindow.Milliseconds())
+	}
+	if w.MaxAttempts < 0 {
+		return fmt.Errorf("maxAttempts must not be negative")
+	}
+	return nil
+}
+
+func (w Window) maxAttempts() int {
+	if w.MaxAttempts > 0 {
+		return w.MaxAttempts
+	}
+	return defaultMaxAttempts
+}
+
+// Item is an event in a batch. Attempt counts its deliveries, from 1.
+type Item struct {
+	ID      string          `json:"id"`
+	Body    json.RawMessage `json:"body"`
+	Attempt int             `json:"attempt"`
+}
+
+// Deliver delivers a batch, returning the IDs of the items that failed. An
+// error fails every item.
+type Deliver func(ctx context.Context, items []Item) (failed []string, err error)
+
+// Batcher collects items into batches for its Deliver, one delivery at a
+// time so items are delivered in the order they were added.
+type Batcher struct {
+	name    string
+	window  Window
+	deliver Deliver
+
+	mu      sync.Mutex
+	pending []Item
+	timer   *time.Timer
+	closed  bool
+
+	delivering sync.Mutex
+	inflight   sync.WaitGroup
+	// dropped counts the items given up on after their last attempt
+	dropped int
+}
+
+// New returns a batcher, name telling it apart in logs.
+func New(name string, window Window, deliver Deliver) *Batcher {
+	return &Batcher{name: name, window: window, deliver: deliver}
+}
+
+// Window returns the batcher's window.
+func (b *Batcher) Window() Window {
+	return b.window
+}
+
+// Add adds an item to the next batch, delivering it when it is full.
+// Items added once the batcher is closed are dropped, reporting false.
+func (b *Batcher) Add(item Item) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed {
+		return false
+	}
+	b.addLocked(item)
+	return true
+}
+
+func (b *Batcher) addLocked(item Item) {
+	b.pending = append(b.pending, item)
+	if len(b.pending) >= b.window.MaxItems {
+		b.flushLocked()
+		return
+	}
+	if b.timer == nil {
+		b.timer = time.AfterFunc(time.Duration(b.window.WindowMs)*time.Millisecond, b.Flush)
+	}
+}
+
+// Flush delivers the items collected so far without waiting for the
+// batch to fill up.
+func (b *Batcher) Flush() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.flushLocked()
+}
+
+// flushLocked starts delivering the pending items. The caller must hold mu.
+func (b *Batcher) flushLocked() {
+	if b.timer != nil {
+		b.timer.Stop()
+		b.timer = nil
+	}
+	if len(b.pending) == 0 {
+		return
+	}
+	items := b.pending
+	b.pending = nil
+	b.inflight.Add(1)
+	go func() {
+		defer b.inflight.Done()
+		b.deliverBatch(items)
+	}()
+}
+
+// deliverBatch delivers items and puts the failed ones back for the next
+// batch, unless they had their last attempt.
+func (b *Batcher) deliverBatch(items []Item) {
+	b.delivering.Lock()
+	defer b.delivering.Unlock()
+
+	for i := range items {
+		items[i].Attempt++
+	}
+	failed, err := b.deliver(context.Background(), items)
+	if err != nil {
+		logger.Get().Warn("Batch delivery failed", zap.String("batch", b.name), zap.Int("items", len(items)), zap.Error(err))
+		failed = make([]string, len(items))
+		for i, item := range items {
+			failed[i] = item.ID
+		}
+	}
+	if len(failed) == 0 {
+		return
+	}
+	retry := make(map[string]bool, len(failed))
+	for _, id := range failed {
+		retry[id] = true
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for _, item := range items {
+		if !retry[item.ID] {
+			continue
+		}
+		if b.closed || item.Attempt >= b.window.maxAttempts() {
+			b.dropped++
+			logger.Get().Warn("Dropping batch item", zap.String("batch", b.name), zap.String("id", item.ID), zap.Int("attempts", item.Attempt))
+			continue
+		}
+		b.addLocked(item)
+	}
+}
+
+// Stats returns how many items wait for a batch and how many were dropped
+// after their last attempt.
+func (b *Batcher) Stats() (pending, dropped int) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return len(b.pending), b.dropped
+}
+
+// Close delivers the items collected so far, waiting for deliveries in
+// flight, and takes no more. Items failing from then on aren't retried.
+func (b *Batcher) Close() {
+	b.mu.Lock()
+	b.closed = true
+	b.flushLocked()
+	b.mu.Unlock()
+	b.inflight.Wait()
+}
@@ -0,0 +1,116 @@
+package batch
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// recorder is a Deliver keeping the batches it got
+type recorder struct {
+	mu      sync.Mutex
+	batches [][]Item
+	fail    func(items []Item) ([]string, error)
+	got     chan struct{}
+}
+
+func newRecorder() *recorder {
+	return &recorder{got: make(chan struct{}, 100)}
+}
+
+func (r *recorder) deliver(ctx context.Context, items []Item) ([]string, error) {
+	r.mu.Lock()
+	r.batches = append(r.batches, append([]Item(nil), items...))
+	fail := r.fail
+	r.mu.Unlock()
+	defer func() { r.got <- struct{}{} }()
+	if fail != nil {
+		return fail(items)
+	}
+	return nil, nil
+}
+
+func (r *recorder) wait(t *testing.T, n int) [][]Item {
+	t.Helper()
+	for range n {
+		select {
+		case <-r.got:
+		case <-time.After(5 * time.Second):
+			t.Fatal("timed out waiting for a batch")
+		}
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.batches
+}
+
+func item(id string) Item {
+	return Item{ID: id, Body: []byte(`{"id":"` + id + `"}`)}
+}
+
+func TestWindow_Validate(t *testing.T) {
+	assert.NoError(t, Window{MaxItems: 10, WindowMs: 100}.Validate())
+	assert.Error(t, Window{MaxItems: 0, WindowMs: 100}.Validate())
+	assert.Error(t, Window{MaxItems: 10}.Validate())
+	assert.Error(t, Window{MaxItems: 10, WindowMs: int(time.Hour.Milliseconds())}.Validate())
+	assert.Error(t, Window{MaxItems: 10, WindowMs: 100, MaxAttempts: -1}.Validate())
+}
+
+func TestBatcher_FullAndWindow(t *testing.T) {
+	r := newRecorder()
+	b := New("test", Window{MaxItems: 3, WindowMs: 50}, r.deliver)
+	defer b.Close()
+
+	for i := range 4 {
+		require.True(t, b.Add(item(fmt.Sprint(i))))
+	}
+	// Three make a full batch, the fourth waits for the window
+	batches := r.wait(t, 2)
+	require.Len(t, batches, 2)
+	assert.Len(t, batches[0], 3)
+	assert.Equal(t, "3", batches[1][0].ID)
+	assert.Equal(t, 1, batches[1][0].Attempt)
+}
+
+func TestBatcher_RetriesFailedItems(t *testing.T) {
+	r := newRecorder()
+	r.fail = func(items []Item) ([]string, error) {
+		// b always fails, the batch fails once as a whole
+		if len(items) == 2 && items[0].Attempt == 1 {
+			return nil, errors.New("runtime down")
+		}
+		for _, item := range items {
+			if item.ID == "b" {
+				return []string{"b"}, nil
+			}
+		}
+		return nil, nil
+	}
+	b := New("test", Window{MaxItems: 2, WindowMs: 20, MaxAttempts: 3}, r.deliver)
+	b.Add(item("a"))
+	b.Add(item("b"))
+
+	batches := r.wait(t, 3)
+	assert.Len(t, batches[0], 2)
+	assert.Len(t, batches[1], 2, "a failed batch is retried whole")
+	assert.Equal(t, []Item{{ID: "b", Body: []byte(`{"id":"b"}`), Attempt: 3}}, batches[2])
+	b.Close()
+	pending, dropped := b.Stats()
+	assert.Zero(t, pending)
+	assert.Equal(t, 1, dropped, "b is dropped after its last attempt")
+}
+
+func TestBatcher_Close(t *testing.T) {
+	r := newRecorder()
+	b := New("test", Window{MaxItems: 100, WindowMs: int(time.Minute.Milliseconds())}, r.deliver)
+	b.Add(item("a"))
+	b.Close()
+	assert.Len(t, r.wait(t, 1), 1, "closing delivers what was collected")
+	assert.False(t, b.Add(item("b")))
+}
@@ -0,0 +1,226 @@
+// Package blob stores objects too large to pass through the service, like
+// big invocation responses, and hands out expiring links to them.
+package blob
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ErrNotFound is returned for keys that aren't stored
+var ErrNotFound = errors.New("blob not found")
+
+// Store keeps blobs by key.
+type Store interface {
+	// Put stores r under key, returning how many bytes were stored
+	Put(ctx context.Context, key string, r io.Reader) (int64, error)
+	Delete(ctx context.Context, key string) error
+	// URL returns a link anyone holding it can fetch key with until expires
+	URL(key string, expires time.Time) (string, error)
+	// Prune deletes the blobs stored before a time, returning how many
+	Prune(ctx context.Context, before time.Time) (int, error)
+}
+
+// validKey keeps keys to relative paths of safe segments
+var validKey = regexp.MustCompile(`^[A-Za-z0-9._-]+(/[A-Za-z0-9._-]+)*$`)
+
+// Dir is a Store keeping blobs as files under a directory. Its links point
+// at the service, which serves them with Handler.
+type Dir struct {
+	dir string
+	key []byte
+	// baseURL is prepended to links, which are relative to the service
+	// without it
+	baseURL string
+}
+
+// NewDir creates a store in dir, signing links with key.
+func NewDir(dir string, key []byte, baseURL string) (*Dir, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, fmt.Errorf("failed to create blob directory: %w", err)
+	}
+	return &Dir{dir: dir, key: key, baseURL: strings.TrimSuffix(baseURL, "/")}, nil
+}
+
+// FromEnv opens the store in KAPPA_BLOB_DIR, "blobs" by default, signing
+// links with the base64 KAPPA_BLOB_SIGNING_KEY. Without a key one is made
+// up, so links stop working when the service restarts. Links are prefixed
+// with KAPPA_BLOB_BASE_URL, the service's external address.
+func FromEnv() (*Dir, error) {
+	dir := os.Getenv("KAPPA_BLOB_DIR")
+	if dir == "" {
+		dir = "blobs"
+	}
+	var key []byte
+	if v := os.Getenv("KAPPA_BLOB_SIGNING_KEY"); v != "" {
+		var err error
+		if key, err = base64.StdEncoding.DecodeString(v); err != nil {
+			return nil, fmt.Errorf("invalid KAPPA_BLOB_SIGNING_KEY: %w", err)
+		}
+	} else {
+		key = make([]byte, 32)
+		if _, err := rand.Read(key); err != nil {
+			return nil, fmt.Errorf("failed to generate blob signing key: %w", err)
+		}
+	}
+	return NewDir(dir, key, os.Getenv("KAPPA_BLOB_BASE_URL"))
+}
+
+func (d *Dir) path(key string) (string, error) {
+	if !validKey.MatchString(key) || strings.Contains(key, "..") {
+		return "", fmt.Errorf("invalid blob key: %q", key)
+	}
+	return filepath.Join(d.dir, filepath.FromSlash(key)), nil
+}
+
+// Put writes r to a temp file and moves it into place once complete, so a
+// blob is never seen half written.
+func (d *Dir) Put(ctx context.Context, key string, r io.Reader) (int64, error) {
+	path, err := d.path(key)
+	if err != nil {
+		return 0, err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return 0, fmt.Errorf("failed to create blob directory: %w", err)
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".put-*")
+	if err != nil {
+		return 0, fmt.Errorf("failed to create blob: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	n, err := io.Copy(tmp, contextReader{ctx, r})
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return n, fmt.Errorf("failed to write blob: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return n, fmt.Errorf("failed to store blob: %w", err)
+	}
+	return n, nil
+}
+
+// Delete removes a blob, it is not an error if it doesn't exist.
+func (d *Dir) Delete(ctx context.Context, key string) error {
+	path, err := d.path(key)
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to delete blob: %w", err)
+	}
+	return nil
+}
+
+// URL returns a link to the blob signed until expires.
+func (d *Dir) URL(key string, expires time.Time) (string, error) {
+	if _, err := d.path(key); err != nil {
+		return "", err
+	}
+	exp := strconv.FormatInt(expires.Unix(), 10)
+	q := url.Values{"expires": {exp}, "signature": {d.sign(key, exp)}}
+	return fmt.Sprintf("%s/blobs/%s?%s", d.baseURL, key, q.Encode()), nil
+}
+
+func (d *Dir) sign(key, expires string) string {
+	mac := hmac.New(sha256.New, d.key)
+	mac.Write([]byte(key + "\n" + expires))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// Prune deletes blobs last written before a time.
+func (d *Dir) Prune(ctx context.Context, before time.Time) (int, error) {
+	pruned := 0
+	err := filepath.WalkDir(d.dir, func(path string, entry os.DirEntry, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if entry.IsDir() {
+			return nil
+		}
+		info, err := entry.Info()
+		if err != nil || !info.ModTime().Before(before) {
+			return nil
+		}
+		if err := os.Remove(path); err == nil {
+			pruned++
+		}
+		return nil
+	})
+	if err != nil {
+		return pruned, fmt.Errorf("failed to prune blobs: %w", err)
+	}
+	return pruned, nil
+}
+
+// Handler serves blobs at /blobs/{key} to holders of a link that hasn't
+// expired.
+func (d *Dir) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key := strings.TrimPrefix(r.URL.Path, "/blobs/")
+		exp := r.URL.Query().Get("expires")
+		unix, err := strconv.ParseInt(exp, 10, 64)
+		if err != nil || !hmac.Equal([]byte(d.sign(key, exp)), []byte(r.URL.Query().Get("signature"))) {
+			http.Error(w, "Invalid blob link", http.StatusForbidden)
+			return
+		}
+		if time.Now().Unix() > unix {
+			http.Error(w, "Blob link expired", http.StatusGone)
+			return
+		}
+		path, err := d.path(key)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		file, err := os.Open(path)
+		if err != nil {
+			http.Error(w, ErrNotFound.Error(), http.StatusNotFound)
+			return
+		}
+		defer file.Close()
+		info, err := file.Stat()
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Failed to read blob: %v", err), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/octet-stream")
+		http.ServeContent(w, r, "", info.ModTime(), file)
+	})
+}
+
+// contextReader stops a copy once its context is done
+type contextReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (c contextReader) Read(p []byte) (int, error) {
+	if err := c.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return c.r.Read(p)
+}
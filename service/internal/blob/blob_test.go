@@ -0,0 +1,135 @@
+package blob
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"kappa-v2/service/internal/objstore"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDir(t *testing.T) {
+	d, err := NewDir(t.TempDir(), []byte("secret"), "http://kappa.example/")
+	require.NoError(t, err)
+	ctx := context.Background()
+
+	n, err := d.Put(ctx, "responses/hello/1", strings.NewReader("large body"))
+	require.NoError(t, err)
+	assert.Equal(t, int64(10), n)
+	_, err = d.Put(ctx, "../escape", strings.NewReader("x"))
+	assert.Error(t, err)
+
+	link, err := d.URL("responses/hello/1", time.Now().Add(time.Hour))
+	require.NoError(t, err)
+	assert.True(t, strings.HasPrefix(link, "http://kappa.example/blobs/responses/hello/1?"))
+
+	server := httptest.NewServer(d.Handler())
+	defer server.Close()
+	get := func(link string) (int, string) {
+		resp, err := http.Get(server.URL + strings.TrimPrefix(link, "http://kappa.example"))
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		return resp.StatusCode, string(body)
+	}
+
+	status, body := get(link)
+	assert.Equal(t, http.StatusOK, status)
+	assert.Equal(t, "large body", body)
+
+	status, _ = get(strings.Replace(link, "responses/hello/1", "responses/hello/2", 1))
+	assert.Equal(t, http.StatusForbidden, status, "the signature is for another key")
+
+	expired, err := d.URL("responses/hello/1", time.Now().Add(-time.Minute))
+	require.NoError(t, err)
+	status, _ = get(expired)
+	assert.Equal(t, http.StatusGone, status)
+
+	require.NoError(t, d.Delete(ctx, "responses/hello/1"))
+	status, _ = get(link)
+	assert.Equal(t, http.StatusNotFound, status)
+	assert.NoError(t, d.Delete(ctx, "responses/hello/1"))
+}
+
+func TestDir_Prune(t *testing.T) {
+	dir := t.TempDir()
+	d, err := NewDir(dir, []byte("secret"), "")
+	require.NoError(t, err)
+	ctx := context.Background()
+
+	_, err = d.Put(ctx, "old", strings.NewReader("x"))
+	require.NoError(t, err)
+	_, err = d.Put(ctx, "a/new", strings.NewReader("x"))
+	require.NoError(t, err)
+	old := time.Now().Add(-2 * time.Hour)
+	require.NoError(t, os.Chtimes(filepath.Join(dir, "old"), old, old))
+
+	pruned, err := d.Prune(ctx, time.Now().Add(-time.Hour))
+	require.NoError(t, err)
+	assert.Equal(t, 1, pruned)
+	assert.FileExists(t, filepath.Join(dir, "a", "new"))
+}
+
+func TestBucket(t *testing.T) {
+	var mu sync.Mutex
+	objects := make(map[string]string)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		key := strings.TrimPrefix(r.URL.Path, "/bucket/")
+		switch r.Method {
+		case http.MethodPut:
+			data, _ := io.ReadAll(r.Body)
+			objects[key] = string(data)
+		case http.MethodDelete:
+			delete(objects, key)
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			// Lists every object as written an hour ago
+			fmt.Fprint(w, "<ListBucketResult>")
+			for k := range objects {
+				fmt.Fprintf(w, "<Contents><Key>%s</Key><LastModified>%s</LastModified></Contents>", k, time.Now().Add(-time.Hour).UTC().Format(time.RFC3339))
+			}
+			fmt.Fprint(w, "</ListBucketResult>")
+		}
+	}))
+	defer server.Close()
+	s3, err := objstore.NewS3(objstore.S3Options{
+		Bucket:          "bucket",
+		Endpoint:        server.URL,
+		PathStyle:       true,
+		AccessKeyID:     "key",
+		SecretAccessKey: "secret",
+	})
+	require.NoError(t, err)
+	b := NewBucket(s3)
+	ctx := context.Background()
+
+	n, err := b.Put(ctx, "responses/hello/1", strings.NewReader("large body"))
+	require.NoError(t, err)
+	assert.Equal(t, int64(10), n)
+	assert.Equal(t, "large body", objects["blobs/responses/hello/1"])
+
+	link, err := b.URL("responses/hello/1", time.Now().Add(time.Hour))
+	require.NoError(t, err)
+	assert.True(t, strings.HasPrefix(link, server.URL+"/bucket/blobs/responses/hello/1?"))
+	assert.Contains(t, link, "X-Amz-Signature=")
+
+	pruned, err := b.Prune(ctx, time.Now().Add(-2*time.Hour))
+	require.NoError(t, err)
+	assert.Zero(t, pruned)
+	pruned, err = b.Prune(ctx, time.Now())
+	require.NoError(t, err)
+	assert.Equal(t, 1, pruned)
+	assert.Empty(t, objects)
+}
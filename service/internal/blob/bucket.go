@@ -0,0 +1,75 @@
+package blob
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"kappa-v2/service/internal/objstore"
+	"net/http"
+	"time"
+)
+
+// bucketPrefix starts the keys of blobs in a bucket
+const bucketPrefix = "blobs/"
+
+// Bucket is a Store keeping blobs in an S3-compatible bucket. Its links are
+// presigned, so blobs are fetched from the bucket rather than the service.
+type Bucket struct {
+	s3 *objstore.S3
+}
+
+// NewBucket keeps blobs in the bucket.
+func NewBucket(s3 *objstore.S3) *Bucket {
+	return &Bucket{s3: s3}
+}
+
+func (b *Bucket) Put(ctx context.Context, key string, r io.Reader) (int64, error) {
+	counter := &countingReader{r: r}
+	if err := b.s3.Put(ctx, bucketPrefix+key, counter); err != nil {
+		return counter.n, fmt.Errorf("failed to store blob: %w", err)
+	}
+	return counter.n, nil
+}
+
+func (b *Bucket) Delete(ctx context.Context, key string) error {
+	if err := b.s3.Delete(ctx, bucketPrefix+key); err != nil {
+		return fmt.Errorf("failed to delete blob: %w", err)
+	}
+	return nil
+}
+
+// URL presigns a link to the blob until expires, a week away at most.
+func (b *Bucket) URL(key string, expires time.Time) (string, error) {
+	return b.s3.Presign(http.MethodGet, bucketPrefix+key, expires)
+}
+
+// Prune deletes blobs last written before a time.
+func (b *Bucket) Prune(ctx context.Context, before time.Time) (int, error) {
+	objects, err := b.s3.List(ctx, bucketPrefix)
+	if err != nil {
+		return 0, fmt.Errorf("failed to prune blobs: %w", err)
+	}
+	pruned := 0
+	for _, object := range objects {
+		if !object.LastModified.Before(before) {
+			continue
+		}
+		if err := b.s3.Delete(ctx, object.Key); err != nil {
+			return pruned, fmt.Errorf("failed to prune blobs: %w", err)
+		}
+		pruned++
+	}
+	return pruned, nil
+}
+
+// countingReader counts the bytes read through it
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
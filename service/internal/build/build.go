@@ -0,0 +1,407 @@
+// Package build bakes function source into OCI images with buildkit and
+// pushes them to a registry, so runtime functions can be run from an image
+// like any other instead of mounting their code.
+package build
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"kappa-v2/pkg/logger"
+	"kappa-v2/service/internal/runtimes"
+	"os"
+	"os/exec"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// Limits on what is kept of builds
+const (
+	maxBuilds   = 100
+	maxLogLines = 200
+)
+
+// Defaults of a manager
+const (
+	DefaultTimeout     = 15 * time.Minute
+	DefaultConcurrency = 2
+	DefaultBuildkit    = "unix:///run/buildkit/buildkitd.sock"
+)
+
+// Status is where a build is at.
+type Status string
+
+const (
+	Queued    Status = "queued"
+	Running   Status = "running"
+	Succeeded Status = "succeeded"
+	Failed    Status = "failed"
+)
+
+// Build is one build of a function's source into an image.
+type Build struct {
+	ID       string `json:"id"`
+	Function string `json:"function"`
+	// Project is the project the function is built for
+	Project string `json:"project,omitempty"`
+	Status  Status `json:"status"`
+	// Image is the pushed image by digest, set once the build succeeds
+	Image string `json:"image,omitempty"`
+	Error string `json:"error,omitempty"`
+	// Logs are the last lines the builder wrote
+	Logs       []string   `json:"logs,omitempty"`
+	CreatedAt  time.Time  `json:"createdAt"`
+	StartedAt  *time.Time `json:"startedAt,omitempty"`
+	FinishedAt *time.Time `json:"finishedAt,omitempty"`
+}
+
+// Request is an image to build.
+type Request struct {
+	// ContextDir holds the Dockerfile and everything it copies
+	ContextDir string
+	// Ref is where the image is pushed
+	Ref  string
+	Args map[string]string
+	// CacheRef is an image layers are cached in between builds, none when
+	// empty
+	CacheRef string
+}
+
+// Builder builds the Dockerfile in a build context and pushes the image,
+// returning its digest.
+type Builder interface {
+	Build(ctx context.Context, req Request, onLog func(string)) (string, error)
+}
+
+// Buildkit builds with buildctl against a buildkitd, which pushes with the
+// registry credentials in the service's docker config.
+type Buildkit struct {
+	// Addr is the buildkitd address, like unix:///run/buildkit/buildkitd.sock
+	Addr string
+	// Buildctl is the buildctl binary, found on the PATH when empty
+	Buildctl string
+}
+
+// Build runs buildctl build with the dockerfile frontend, importing and
+// exporting every layer to the cache ref so builds on any buildkitd start
+// from the last one.
+func (b Buildkit) Build(ctx context.Context, req Request, onLog func(string)) (string, error) {
+	metadata, err := os.CreateTemp("", "kappa-build-metadata-*.json")
+	if err != nil {
+		return "", fmt.Errorf("failed to create metadata file: %w", err)
+	}
+	metadata.Close()
+	defer os.Remove(metadata.Name())
+
+	cmdArgs := []string{
+		"--addr", b.Addr,
+		"build",
+		"--frontend", "dockerfile.v0",
+		"--local", "context=" + req.ContextDir,
+		"--local", "dockerfile=" + req.ContextDir,
+		"--output", "type=image,name=" + req.Ref + ",push=true",
+		"--metadata-file", metadata.Name(),
+		"--progress", "plain",
+	}
+	if req.CacheRef != "" {
+		cmdArgs = append(cmdArgs,
+			"--import-cache", "type=registry,ref="+req.CacheRef,
+			"--export-cache", "type=registry,ref="+req.CacheRef+",mode=max",
+		)
+	}
+	keys := make([]string, 0, len(req.Args))
+	for k := range req.Args {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		cmdArgs = append(cmdArgs, "--opt", "build-arg:"+k+"="+req.Args[k])
+	}
+
+	buildctl := b.Buildctl
+	if buildctl == "" {
+		buildctl = "buildctl"
+	}
+	cmd := exec.CommandContext(ctx, buildctl, cmdArgs...)
+	stderr, err := cmd.StderrPipe()
+	if err != nil {
+		return "", fmt.Errorf("failed to start buildctl: %w", err)
+	}
+	if err := cmd.Start(); err != nil {
+		return "", fmt.Errorf("failed to start buildctl: %w", err)
+	}
+	scanner := bufio.NewScanner(stderr)
+	for scanner.Scan() {
+		onLog(scanner.Text())
+	}
+	if err := cmd.Wait(); err != nil {
+		if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			return "", ctx.Err()
+		}
+		return "", fmt.Errorf("buildctl failed: %w", err)
+	}
+
+	data, err := os.ReadFile(metadata.Name())
+	if err != nil {
+		return "", fmt.Errorf("failed to read build metadata: %w", err)
+	}
+	var result struct {
+		Digest string `json:"containerimage.digest"`
+	}
+	if err := json.Unmarshal(data, &result); err != nil || result.Digest == "" {
+		return "", fmt.Errorf("build metadata has no image digest")
+	}
+	return result.Digest, nil
+}
+
+// Manager runs builds in the background, a few at a time, and keeps the
+// most recent ones.
+type Manager struct {
+	builder  Builder
+	matrix   *runtimes.Matrix
+	registry string
+	timeout  time.Duration
+	slots    chan struct{}
+	// registryCache is whether layers are cached in the registry as well
+	// as buildkitd's cache mounts
+	registryCache bool
+
+	mu     sync.Mutex
+	builds map[string]*Build
+	order  []string
+}
+
+// NewManager creates a manager pushing images under registry, like
+// registry.example.com/kappa, building runtimes from matrix. With
+// registryCache, layers are also cached in the registry per project.
+func NewManager(builder Builder, matrix *runtimes.Matrix, registry string, timeout time.Duration, concurrency int, registryCache bool) *Manager {
+	return &Manager{
+		builder:       builder,
+		matrix:        matrix,
+		registry:      strings.TrimSuffix(registry, "/"),
+		timeout:       timeout,
+		slots:         make(chan struct{}, concurrency),
+		registryCache: registryCache,
+		builds:        make(map[string]*Build),
+	}
+}
+
+// FromEnv creates a manager building with buildkit at KAPPA_BUILDKIT_ADDR
+// and pushing to KAPPA_BUILD_REGISTRY, bounded by KAPPA_BUILD_TIMEOUT and
+// KAPPA_BUILD_CONCURRENCY. Layers are cached in the registry unless
+// KAPPA_BUILD_REGISTRY_CACHE is false. It returns nil when no registry is
+// set, leaving builds disabled.
+func FromEnv(matrix *runtimes.Matrix) (*Manager, error) {
+	registry := os.Getenv("KAPPA_BUILD_REGISTRY")
+	if registry == "" {
+		return nil, nil
+	}
+	builder := Buildkit{Addr: os.Getenv("KAPPA_BUILDKIT_ADDR")}
+	if builder.Addr == "" {
+		builder.Addr = DefaultBuildkit
+	}
+	timeout, concurrency := DefaultTimeout, DefaultConcurrency
+	if v := os.Getenv("KAPPA_BUILD_TIMEOUT"); v != "" {
+		var err error
+		if timeout, err = time.ParseDuration(v); err != nil || timeout <= 0 {
+			return nil, fmt.Errorf("invalid KAPPA_BUILD_TIMEOUT %q", v)
+		}
+	}
+	if v := os.Getenv("KAPPA_BUILD_CONCURRENCY"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			return nil, fmt.Errorf("invalid KAPPA_BUILD_CONCURRENCY %q", v)
+		}
+		concurrency = n
+	}
+	registryCache := true
+	if v := os.Getenv("KAPPA_BUILD_REGISTRY_CACHE"); v != "" {
+		var err error
+		if registryCache, err = strconv.ParseBool(v); err != nil {
+			return nil, fmt.Errorf("invalid KAPPA_BUILD_REGISTRY_CACHE %q", v)
+		}
+	}
+	return NewManager(builder, matrix, registry, timeout, concurrency, registryCache), nil
+}
+
+// Start writes the build context for the function's runtime and queues the
+// build, calling register with the pushed image once it succeeds. A build
+// whose register fails fails too. Errors are only returned for code that
+// can't be built at all.
+func (m *Manager) Start(function, project string, runtime runtimes.Config, register func(image string) error) (Build, error) {
+	dir, err := os.MkdirTemp("", "kappa-build-*")
+	if err != nil {
+		return Build{}, fmt.Errorf("failed to create build context: %w", err)
+	}
+	args, err := runtimes.WriteBuildContext(dir, runtime, m.matrix, cacheKey(project))
+	if err != nil {
+		os.RemoveAll(dir)
+		return Build{}, err
+	}
+	id, err := newID()
+	if err != nil {
+		os.RemoveAll(dir)
+		return Build{}, err
+	}
+
+	b := &Build{
+		ID:        id,
+		Function:  function,
+		Project:   project,
+		Status:    Queued,
+		CreatedAt: time.Now(),
+	}
+	m.mu.Lock()
+	m.builds[id] = b
+	m.order = append(m.order, id)
+	if len(m.order) > maxBuilds {
+		m.evict()
+	}
+	snapshot := b.clone()
+	m.mu.Unlock()
+
+	go m.run(b, dir, args, register)
+	return snapshot, nil
+}
+
+// evict drops the oldest finished builds past maxBuilds.
+func (m *Manager) evict() {
+	kept := m.order[:0]
+	excess := len(m.order) - maxBuilds
+	for _, id := range m.order {
+		if excess > 0 && m.builds[id].FinishedAt != nil {
+			delete(m.builds, id)
+			excess--
+			continue
+		}
+		kept = append(kept, id)
+	}
+	m.order = kept
+}
+
+func (m *Manager) run(b *Build, dir string, args map[string]string, register func(string) error) {
+	defer os.RemoveAll(dir)
+	m.slots <- struct{}{}
+	defer func() { <-m.slots }()
+
+	l := logger.Get()
+	m.update(b, func() {
+		now := time.Now()
+		b.Status = Running
+		b.StartedAt = &now
+	})
+	l.Info("Building function image", zap.String("function", b.Function), zap.String("build", b.ID))
+
+	ctx, cancel := context.WithTimeout(context.Background(), m.timeout)
+	defer cancel()
+	repo := m.registry + "/" + cacheKey(b.Function)
+	req := Request{ContextDir: dir, Ref: repo + ":" + b.ID, Args: args}
+	if m.registryCache {
+		req.CacheRef = m.registry + "/cache:" + cacheKey(b.Project)
+	}
+	digest, err := m.builder.Build(ctx, req, func(line string) {
+		m.update(b, func() {
+			b.Logs = append(b.Logs, line)
+			if len(b.Logs) > maxLogLines {
+				b.Logs = b.Logs[len(b.Logs)-maxLogLines:]
+			}
+		})
+	})
+
+	var image string
+	if err == nil {
+		// Run the image by digest so the tag moving can't change the function
+		image = repo + "@" + digest
+		if err = register(image); err != nil {
+			err = fmt.Errorf("failed to register function: %w", err)
+		}
+	} else if errors.Is(err, context.DeadlineExceeded) {
+		err = fmt.Errorf("build timed out after %s", m.timeout)
+	}
+
+	m.update(b, func() {
+		now := time.Now()
+		b.FinishedAt = &now
+		b.Image = image
+		if err != nil {
+			b.Status = Failed
+			b.Error = err.Error()
+			return
+		}
+		b.Status = Succeeded
+	})
+	if err != nil {
+		l.Warn("Function build failed", zap.String("function", b.Function), zap.String("build", b.ID), zap.Error(err))
+		return
+	}
+	l.Info("Function image built", zap.String("function", b.Function), zap.String("build", b.ID), zap.String("image", image))
+}
+
+func (m *Manager) update(b *Build, f func()) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	f()
+}
+
+// Get returns the build with id.
+func (m *Manager) Get(id string) (Build, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	b, ok := m.builds[id]
+	if !ok {
+		return Build{}, false
+	}
+	return b.clone(), true
+}
+
+// List returns the kept builds, newest first, without their logs.
+func (m *Manager) List() []Build {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	builds := make([]Build, 0, len(m.order))
+	for i := len(m.order) - 1; i >= 0; i-- {
+		b := *m.builds[m.order[i]]
+		b.Logs = nil
+		builds = append(builds, b)
+	}
+	return builds
+}
+
+func (b *Build) clone() Build {
+	c := *b
+	c.Logs = append([]string(nil), b.Logs...)
+	return c
+}
+
+// cacheKey turns a project or function name into something usable as an
+// image name, tag or cache ID, lowercase letters and digits joined by dashes.
+// Functions outside any project share a key.
+func cacheKey(name string) string {
+	key := []byte(strings.ToLower(name))
+	for i, c := range key {
+		if !(c >= 'a' && c <= 'z' || c >= '0' && c <= '9') {
+			key[i] = '-'
+		}
+	}
+	if trimmed := strings.Trim(string(key), "-"); trimmed != "" {
+		return trimmed
+	}
+	return "default"
+}
+
+func newID() (string, error) {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("failed to generate build ID: %w", err)
+	}
+	return hex.EncodeToString(b), nil
+}
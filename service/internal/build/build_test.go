@@ -0,0 +1,119 @@
+package build
+
+import (
+	"context"
+	"errors"
+	"kappa-v2/service/internal/runtimes"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeBuilder records the requests it builds and returns digest or err
+type fakeBuilder struct {
+	reqs   chan Request
+	digest string
+	err    error
+}
+
+func (b *fakeBuilder) Build(ctx context.Context, req Request, onLog func(string)) (string, error) {
+	if _, err := os.Stat(filepath.Join(req.ContextDir, "Dockerfile")); err != nil {
+		return "", err
+	}
+	onLog("#1 building")
+	b.reqs <- req
+	return b.digest, b.err
+}
+
+func waitFinished(t *testing.T, m *Manager, id string) Build {
+	t.Helper()
+	var b Build
+	require.Eventually(t, func() bool {
+		b, _ = m.Get(id)
+		return b.FinishedAt != nil
+	}, time.Second, 5*time.Millisecond)
+	return b
+}
+
+func nodeRuntime(t *testing.T) runtimes.Config {
+	codeDir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(codeDir, "index.js"), []byte("exports.handler = () => ({})"), 0644))
+	return runtimes.Config{Language: "nodejs", Version: "20", CodePath: codeDir}
+}
+
+func TestManager_Start(t *testing.T) {
+	builder := &fakeBuilder{reqs: make(chan Request, 1), digest: "sha256:abcd"}
+	m := NewManager(builder, runtimes.DefaultMatrix(), "registry.local/kappa/", time.Minute, 1, true)
+
+	var registered string
+	b, err := m.Start("Hello", "Web Shop", nodeRuntime(t), func(image string) error {
+		registered = image
+		return nil
+	})
+	require.NoError(t, err)
+	assert.Equal(t, Queued, b.Status)
+
+	req := <-builder.reqs
+	assert.Equal(t, "registry.local/kappa/hello:"+b.ID, req.Ref)
+	assert.Equal(t, "registry.local/kappa/cache:web-shop", req.CacheRef, "builds of a project share a cache")
+	b = waitFinished(t, m, b.ID)
+	assert.Equal(t, Succeeded, b.Status)
+	assert.Equal(t, "registry.local/kappa/hello@sha256:abcd", b.Image, "images are run by digest")
+	assert.Equal(t, b.Image, registered)
+	assert.Equal(t, []string{"#1 building"}, b.Logs)
+
+	list := m.List()
+	require.Len(t, list, 1)
+	assert.Nil(t, list[0].Logs)
+}
+
+func TestManager_StartFailures(t *testing.T) {
+	builder := &fakeBuilder{reqs: make(chan Request, 2), err: errors.New("npm ERR! 404")}
+	m := NewManager(builder, runtimes.DefaultMatrix(), "registry.local/kappa", time.Minute, 1, false)
+
+	b, err := m.Start("hello", "", nodeRuntime(t), func(string) error {
+		t.Error("failed builds aren't registered")
+		return nil
+	})
+	require.NoError(t, err)
+	assert.Empty(t, (<-builder.reqs).CacheRef)
+	b = waitFinished(t, m, b.ID)
+	assert.Equal(t, Failed, b.Status)
+	assert.Contains(t, b.Error, "npm ERR! 404")
+
+	builder.err = nil
+	builder.digest = "sha256:abcd"
+	b, err = m.Start("hello", "", nodeRuntime(t), func(string) error { return errors.New("function is locked") })
+	require.NoError(t, err)
+	b = waitFinished(t, m, b.ID)
+	assert.Equal(t, Failed, b.Status)
+	assert.Contains(t, b.Error, "failed to register function")
+
+	_, err = m.Start("hello", "", runtimes.Config{Language: "nodejs", Version: "20"}, nil)
+	assert.Error(t, err, "code is needed")
+	_, ok := m.Get("missing")
+	assert.False(t, ok)
+}
+
+func TestFromEnv(t *testing.T) {
+	t.Setenv("KAPPA_BUILD_REGISTRY", "")
+	m, err := FromEnv(runtimes.DefaultMatrix())
+	require.NoError(t, err)
+	assert.Nil(t, m, "builds are disabled without a registry")
+
+	t.Setenv("KAPPA_BUILD_REGISTRY", "registry.local/kappa")
+	t.Setenv("KAPPA_BUILD_CONCURRENCY", "0")
+	_, err = FromEnv(runtimes.DefaultMatrix())
+	assert.Error(t, err)
+}
+
+func TestCacheKey(t *testing.T) {
+	assert.Equal(t, "default", cacheKey(""))
+	assert.Equal(t, "web-shop", cacheKey("Web Shop"))
+	assert.Equal(t, "team-a", cacheKey("_team.a-"))
+	assert.Equal(t, "default", cacheKey("__"))
+}
@@ -1,3 +1,5 @@
+//go:build linux
+
 package cont
 
 import (
@@ -39,6 +41,14 @@ type ContainerConfig struct {
 	Env           []string `validate:"required"`
 	Mounts        []specs.Mount
 	RemoveOptions RemoveOptions
+	// User runs the process as "uid[:gid]" or a user name from the image
+	User string
+	// MemoryLimitMB caps the container's memory, the default is kept when 0
+	MemoryLimitMB int
+	// ResolvConf and HostsFile are mounted over /etc/resolv.conf and
+	// /etc/hosts in place of the host's when set
+	ResolvConf string
+	HostsFile  string
 }
 
 type RemoveOptions struct {
@@ -246,23 +256,40 @@ image_exists:
 		l.Debug("Mount:", zap.Int("id", k), zap.Any("mount", v))
 	}
 	l.Info("Creating new container instance")
+	memoryLimit := uint64(2000000 * 8)
+	if c.config.MemoryLimitMB > 0 {
+		memoryLimit = uint64(c.config.MemoryLimitMB) * 1024 * 1024
+	}
+	specOpts := []oci.SpecOpts{
+		oci.WithMemoryLimit(memoryLimit),
+		oci.WithCPUs("1"),
+		oci.WithImageConfig(image),
+		oci.WithEnv(c.config.Env),
+		oci.WithProcessArgs(c.config.Command...),
+		oci.WithMounts(c.mounts),
+		oci.WithProcessCwd("/app"),
+		oci.WithHostNamespace(specs.NetworkNamespace),
+	}
+	if c.config.HostsFile != "" {
+		specOpts = append(specOpts, withFile(c.config.HostsFile, "/etc/hosts"))
+	} else {
+		specOpts = append(specOpts, oci.WithHostHostsFile)
+	}
+	if c.config.ResolvConf != "" {
+		specOpts = append(specOpts, withFile(c.config.ResolvConf, "/etc/resolv.conf"))
+	} else {
+		specOpts = append(specOpts, oci.WithHostResolvconf)
+	}
+	if c.config.User != "" {
+		specOpts = append(specOpts, oci.WithUser(c.config.User))
+	}
+
 	container, err := c.client.NewContainer(
 		c.ctx,
 		c.id,
 		containerd.WithImage(image),
 		containerd.WithNewSnapshot(c.id+"-snapshot", image),
-		containerd.WithNewSpec(
-			oci.WithMemoryLimit(2000000*8),
-			oci.WithCPUs("1"),
-			oci.WithImageConfig(image),
-			oci.WithEnv(c.config.Env),
-			oci.WithProcessArgs(c.config.Command...),
-			oci.WithMounts(c.mounts),
-			oci.WithProcessCwd("/app"),
-			oci.WithHostHostsFile,
-			oci.WithHostResolvconf,
-			oci.WithHostNamespace(specs.NetworkNamespace),
-		),
+		containerd.WithNewSpec(specOpts...),
 	)
 	if err != nil {
 		l.Error("Failed to create container", zap.Error(err))
@@ -297,6 +324,16 @@ image_exists:
 	return nil
 }
 
+// withFile mounts a host file read only at dest
+func withFile(source, dest string) oci.SpecOpts {
+	return oci.WithMounts([]specs.Mount{{
+		Type:        "bind",
+		Source:      source,
+		Destination: dest,
+		Options:     []string{"rbind", "ro"},
+	}})
+}
+
 func (c *Container) SetupFinalizer() {
 	runtime.SetFinalizer(c, func(c *Container) {
 		if err := c.cleanup(); err != nil {
@@ -458,6 +495,31 @@ func (c *Container) processLogs(reader io.Reader, source string) {
 	l.Debug("Log processing completed", zap.String("source", source))
 }
 
+// Wait blocks until the task exits or the timeout passes, returning its exit code.
+func (c *Container) Wait(timeout time.Duration) (uint32, error) {
+	if c.task == nil {
+		return 0, fmt.Errorf("no task available")
+	}
+
+	statusC, err := c.task.Wait(c.ctx)
+	if err != nil {
+		return 0, fmt.Errorf("failed to wait for task: %w", err)
+	}
+
+	select {
+	case status := <-statusC:
+		code, _, err := status.Result()
+		if err != nil {
+			return 0, fmt.Errorf("failed to get exit status: %w", err)
+		}
+		// Give logs time to be processed
+		time.Sleep(100 * time.Millisecond)
+		return code, nil
+	case <-time.After(timeout):
+		return 0, fmt.Errorf("timeout waiting for container to complete")
+	}
+}
+
 func (c *Container) WaitForLogs(timeout time.Duration) error {
 	if c.task == nil {
 		return fmt.Errorf("no task available")
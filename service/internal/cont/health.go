@@ -0,0 +1,63 @@
+//go:build linux
+
+package cont
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/containerd/containerd"
+	"github.com/containerd/containerd/namespaces"
+)
+
+// healthDialTimeout bounds connecting for checks whose context has no
+// deadline
+const healthDialTimeout = 5 * time.Second
+
+// dial connects to containerd within ctx's deadline, so checks fail fast
+// when the daemon hangs.
+func dial(ctx context.Context) (*containerd.Client, error) {
+	if _, err := os.Stat(socketPath); err != nil {
+		return nil, fmt.Errorf("containerd is not running: %w", err)
+	}
+	timeout := healthDialTimeout
+	if deadline, ok := ctx.Deadline(); ok {
+		timeout = time.Until(deadline)
+	}
+	client, err := containerd.New(socketPath, containerd.WithTimeout(timeout))
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to containerd: %w", err)
+	}
+	return client, nil
+}
+
+// Ping checks containerd answers on its socket, returning its version.
+func Ping(ctx context.Context) (string, error) {
+	client, err := dial(ctx)
+	if err != nil {
+		return "", err
+	}
+	defer client.Close()
+	version, err := client.Version(ctx)
+	if err != nil {
+		return "", fmt.Errorf("containerd doesn't answer: %w", err)
+	}
+	return version.Version, nil
+}
+
+// CountImages counts the images in the namespace, checking the image store
+// can be read.
+func CountImages(ctx context.Context, namespace string) (int, error) {
+	client, err := dial(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer client.Close()
+	images, err := client.ImageService().List(namespaces.WithNamespace(ctx, namespace))
+	if err != nil {
+		return 0, fmt.Errorf("failed to list images: %w", err)
+	}
+	return len(images), nil
+}
@@ -0,0 +1,54 @@
+//go:build linux
+
+package cont
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"kappa-v2/pkg/logger"
+
+	"github.com/containerd/containerd"
+	"github.com/containerd/containerd/errdefs"
+	"github.com/containerd/containerd/namespaces"
+	"go.uber.org/zap"
+)
+
+// PullImage makes sure ref is in the namespace and unpacked into the
+// snapshotter, so containers created from it start without pulling. It
+// reports whether anything had to be pulled or unpacked.
+func PullImage(ctx context.Context, namespace, ref string) (bool, error) {
+	client, _, err := connect(namespace)
+	if err != nil {
+		return false, err
+	}
+	defer client.Close()
+	ctx = namespaces.WithNamespace(ctx, namespace)
+	l := logger.Get().With(zap.String("image", ref))
+
+	image, err := client.GetImage(ctx, ref)
+	if err != nil {
+		if !errors.Is(err, errdefs.ErrNotFound) {
+			return false, fmt.Errorf("failed to look up image %s: %w", ref, err)
+		}
+		l.Info("Pulling image")
+		if _, err := client.Pull(ctx, ref, containerd.WithPullUnpack, containerd.WithPullSnapshotter(snapshotter)); err != nil {
+			return false, fmt.Errorf("failed to pull image %s: %w", ref, err)
+		}
+		l.Info("Image pulled successfully")
+		return true, nil
+	}
+
+	unpacked, err := image.IsUnpacked(ctx, snapshotter)
+	if err != nil {
+		return false, fmt.Errorf("failed to check image %s is unpacked: %w", ref, err)
+	}
+	if unpacked {
+		return false, nil
+	}
+	l.Info("Unpacking image")
+	if err := image.Unpack(ctx, snapshotter); err != nil {
+		return false, fmt.Errorf("failed to unpack image %s: %w", ref, err)
+	}
+	return true, nil
+}
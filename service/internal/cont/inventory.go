@@ -0,0 +1,161 @@
+//go:build linux
+
+package cont
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"kappa-v2/pkg/logger"
+	"os"
+	"time"
+
+	"github.com/containerd/containerd"
+	"github.com/containerd/containerd/errdefs"
+	"github.com/containerd/containerd/namespaces"
+	"github.com/containerd/containerd/snapshots"
+	"go.uber.org/zap"
+)
+
+const socketPath = "/run/containerd/containerd.sock"
+
+// snapshotter is the snapshotter container root filesystems are created in
+const snapshotter = "overlayfs"
+
+// ContainerInfo describes a container containerd knows about.
+type ContainerInfo struct {
+	ID          string
+	Image       string
+	SnapshotKey string
+	Running     bool
+	CreatedAt   time.Time
+}
+
+// SnapshotInfo describes an active snapshot, the writable root filesystem
+// of a container.
+type SnapshotInfo struct {
+	Key       string
+	CreatedAt time.Time
+}
+
+// ID returns the container's containerd ID.
+func (c *Container) ID() string {
+	return c.id
+}
+
+// connect opens a client for the namespace.
+func connect(namespace string) (*containerd.Client, context.Context, error) {
+	if _, err := os.Stat(socketPath); err != nil {
+		return nil, nil, fmt.Errorf("containerd is not running: %w", err)
+	}
+	client, err := containerd.New(socketPath)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to connect to containerd: %w", err)
+	}
+	return client, namespaces.WithNamespace(context.Background(), namespace), nil
+}
+
+// ListContainers lists every container in the namespace, whether or not
+// this process created it.
+func ListContainers(namespace string) ([]ContainerInfo, error) {
+	client, ctx, err := connect(namespace)
+	if err != nil {
+		return nil, err
+	}
+	defer client.Close()
+
+	containers, err := client.Containers(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list containers: %w", err)
+	}
+	infos := make([]ContainerInfo, 0, len(containers))
+	for _, container := range containers {
+		info, err := container.Info(ctx)
+		if err != nil {
+			if errors.Is(err, errdefs.ErrNotFound) {
+				// Removed while listing
+				continue
+			}
+			return nil, fmt.Errorf("failed to read container %s: %w", container.ID(), err)
+		}
+		running := false
+		if task, err := container.Task(ctx, nil); err == nil {
+			if status, err := task.Status(ctx); err == nil {
+				running = status.Status == containerd.Running
+			}
+		}
+		infos = append(infos, ContainerInfo{
+			ID:          info.ID,
+			Image:       info.Image,
+			SnapshotKey: info.SnapshotKey,
+			Running:     running,
+			CreatedAt:   info.CreatedAt,
+		})
+	}
+	return infos, nil
+}
+
+// ListSnapshots lists the active snapshots in the namespace. Committed
+// snapshots are image layers and are left to containerd's garbage collector.
+func ListSnapshots(namespace string) ([]SnapshotInfo, error) {
+	client, ctx, err := connect(namespace)
+	if err != nil {
+		return nil, err
+	}
+	defer client.Close()
+
+	var infos []SnapshotInfo
+	err = client.SnapshotService(snapshotter).Walk(ctx, func(ctx context.Context, info snapshots.Info) error {
+		if info.Kind == snapshots.KindActive {
+			infos = append(infos, SnapshotInfo{Key: info.Name, CreatedAt: info.Created})
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list snapshots: %w", err)
+	}
+	return infos, nil
+}
+
+// RemoveContainer kills the container's task, if any, and deletes the
+// container along with its snapshot.
+func RemoveContainer(namespace, id string) error {
+	client, ctx, err := connect(namespace)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	container, err := client.LoadContainer(ctx, id)
+	if err != nil {
+		if errors.Is(err, errdefs.ErrNotFound) {
+			return nil
+		}
+		return fmt.Errorf("failed to load container: %w", err)
+	}
+	if task, err := container.Task(ctx, nil); err == nil {
+		if _, err := task.Delete(ctx, containerd.WithProcessKill); err != nil && !errors.Is(err, errdefs.ErrNotFound) {
+			return fmt.Errorf("failed to delete task: %w", err)
+		}
+	}
+	if err := container.Delete(ctx, containerd.WithSnapshotCleanup); err != nil && !errors.Is(err, errdefs.ErrNotFound) {
+		return fmt.Errorf("failed to delete container: %w", err)
+	}
+	logger.Get().Info("Container removed", zap.String("id", id))
+	return nil
+}
+
+// RemoveSnapshot deletes an active snapshot left behind by a container.
+func RemoveSnapshot(namespace, key string) error {
+	client, ctx, err := connect(namespace)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	if err := client.SnapshotService(snapshotter).Remove(ctx, key); err != nil && !errors.Is(err, errdefs.ErrNotFound) {
+		return fmt.Errorf("failed to remove snapshot: %w", err)
+	}
+	logger.Get().Info("Snapshot removed", zap.String("key", key))
+	return nil
+}
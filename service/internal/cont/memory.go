@@ -0,0 +1,36 @@
+//go:build linux
+
+package cont
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// cgroupRoot is where the cgroup filesystem is mounted
+const cgroupRoot = "/sys/fs/cgroup"
+
+// PeakMemoryBytes returns the most memory the container has used since it
+// started, read from its cgroup at containerd's default path.
+func (c *Container) PeakMemoryBytes() (uint64, error) {
+	cgroup := filepath.Join(c.config.Namespace, c.id)
+	for _, path := range []string{
+		// cgroup v2
+		filepath.Join(cgroupRoot, cgroup, "memory.peak"),
+		// cgroup v1
+		filepath.Join(cgroupRoot, "memory", cgroup, "memory.max_usage_in_bytes"),
+	} {
+		data, err := os.ReadFile(path)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return 0, fmt.Errorf("failed to read memory usage: %w", err)
+		}
+		return strconv.ParseUint(strings.TrimSpace(string(data)), 10, 64)
+	}
+	return 0, fmt.Errorf("no memory usage for cgroup %s", cgroup)
+}
@@ -0,0 +1,43 @@
+// Package database opens the Postgres database the service keeps its state
+// in when one is configured, and migrates its schema.
+package database
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"os"
+	"time"
+
+	// Registers the postgres driver
+	_ "github.com/lib/pq"
+)
+
+// connectTimeout bounds checking the database answers
+const connectTimeout = 10 * time.Second
+
+// Open connects to the Postgres database at url, like
+// postgres://kappa:password@db/kappa?sslmode=disable, having checked it
+// answers.
+func Open(url string) (*sql.DB, error) {
+	db, err := sql.Open("postgres", url)
+	if err != nil {
+		return nil, fmt.Errorf("invalid database URL: %w", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), connectTimeout)
+	defer cancel()
+	if err := db.PingContext(ctx); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to reach database: %w", err)
+	}
+	return db, nil
+}
+
+// FromEnv opens the database at KAPPA_DATABASE_URL, nil when unset.
+func FromEnv() (*sql.DB, error) {
+	url := os.Getenv("KAPPA_DATABASE_URL")
+	if url == "" {
+		return nil, nil
+	}
+	return Open(url)
+}
@@ -0,0 +1,65 @@
+package database
+
+import (
+	"context"
+	"os"
+	"testing"
+	"testing/fstest"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMigrations(t *testing.T) {
+	migrations, err := Migrations()
+	require.NoError(t, err)
+	require.NotEmpty(t, migrations)
+	assert.Equal(t, 1, migrations[0].Version)
+	assert.Equal(t, "create_functions", migrations[0].Name)
+	assert.Contains(t, migrations[0].SQL, "CREATE TABLE functions")
+}
+
+func TestLoadMigrations(t *testing.T) {
+	file := func(sql string) *fstest.MapFile { return &fstest.MapFile{Data: []byte(sql)} }
+
+	migrations, err := loadMigrations(fstest.MapFS{
+		"0002_add_b.sql": file("B"),
+		"0001_add_a.sql": file("A"),
+	})
+	require.NoError(t, err)
+	require.Len(t, migrations, 2)
+	assert.Equal(t, Migration{Version: 1, Name: "add_a", SQL: "A"}, migrations[0])
+	assert.Equal(t, 2, migrations[1].Version)
+
+	_, err = loadMigrations(fstest.MapFS{"0001_add_a.sql": file("A"), "0003_add_c.sql": file("C")})
+	assert.ErrorContains(t, err, "out of sequence")
+	_, err = loadMigrations(fstest.MapFS{"0001_add_a.sql": file("A"), "1_add_a_again.sql": file("A")})
+	assert.ErrorContains(t, err, "out of sequence")
+	_, err = loadMigrations(fstest.MapFS{"add_a.sql": file("A")})
+	assert.ErrorContains(t, err, "invalid migration name")
+}
+
+// TestMigrate runs against the Postgres at KAPPA_TEST_DATABASE_URL, whose
+// schema it creates.
+func TestMigrate(t *testing.T) {
+	url := os.Getenv("KAPPA_TEST_DATABASE_URL")
+	if url == "" {
+		t.Skip("KAPPA_TEST_DATABASE_URL is not set")
+	}
+	db, err := Open(url)
+	require.NoError(t, err)
+	defer db.Close()
+	ctx := context.Background()
+
+	status, err := Migrate(ctx, db)
+	require.NoError(t, err)
+	assert.Equal(t, status.Latest, status.Version)
+
+	// Migrating again applies nothing
+	again, err := Migrate(ctx, db)
+	require.NoError(t, err)
+	assert.Equal(t, status, again)
+	current, err := SchemaStatus(ctx, db)
+	require.NoError(t, err)
+	assert.Zero(t, current.Pending)
+}
@@ -0,0 +1,168 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"embed"
+	"fmt"
+	"io/fs"
+	"kappa-v2/pkg/logger"
+	"regexp"
+	"sort"
+	"strconv"
+
+	"go.uber.org/zap"
+)
+
+// migrationFiles are the schema's migrations, named like
+// 0001_create_functions.sql and applied in order of their number. Applied
+// migrations are never edited, changes go in a new one.
+//
+//go:embed migrations/*.sql
+var migrationFiles embed.FS
+
+// migrationLock is the key of the advisory lock migrating holds, so
+// replicas starting together migrate one at a time
+const migrationLock = 0x6b61707061
+
+var migrationName = regexp.MustCompile(`^(\d+)_([a-z0-9_]+)\.sql$`)
+
+// Migration is a change to the schema.
+type Migration struct {
+	Version int
+	Name    string
+	SQL     string
+}
+
+// Status is the version of a database's schema, the last migration
+// applied to it, and the latest this service knows.
+type Status struct {
+	Version int `json:"version"`
+	Latest  int `json:"latest"`
+	// Pending counts the migrations left to apply
+	Pending int `json:"pending"`
+}
+
+// Migrations returns the schema's migrations, in order.
+func Migrations() ([]Migration, error) {
+	sub, err := fs.Sub(migrationFiles, "migrations")
+	if err != nil {
+		return nil, err
+	}
+	return loadMigrations(sub)
+}
+
+// loadMigrations reads the migrations in fsys, checking they are numbered
+// from 1 without gaps.
+func loadMigrations(fsys fs.FS) ([]Migration, error) {
+	entries, err := fs.ReadDir(fsys, ".")
+	if err != nil {
+		return nil, fmt.Errorf("failed to read migrations: %w", err)
+	}
+	var migrations []Migration
+	for _, entry := range entries {
+		m := migrationName.FindStringSubmatch(entry.Name())
+		if m == nil {
+			return nil, fmt.Errorf("invalid migration name %q, expected like 0001_create_functions.sql", entry.Name())
+		}
+		data, err := fs.ReadFile(fsys, entry.Name())
+		if err != nil {
+			return nil, fmt.Errorf("failed to read migration %s: %w", entry.Name(), err)
+		}
+		version, _ := strconv.Atoi(m[1])
+		migrations = append(migrations, Migration{Version: version, Name: m[2], SQL: string(data)})
+	}
+	sort.Slice(migrations, func(i, j int) bool { return migrations[i].Version < migrations[j].Version })
+	for i, m := range migrations {
+		if m.Version != i+1 {
+			return nil, fmt.Errorf("migration %d_%s is out of sequence, expected version %d", m.Version, m.Name, i+1)
+		}
+	}
+	return migrations, nil
+}
+
+// Migrate applies the migrations the database hasn't had yet, each in its
+// own transaction, returning the schema's status after. A schema newer
+// than this service knows, migrated by a newer replica, is left alone.
+func Migrate(ctx context.Context, db *sql.DB) (Status, error) {
+	migrations, err := Migrations()
+	if err != nil {
+		return Status{}, err
+	}
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return Status{}, fmt.Errorf("failed to connect to database: %w", err)
+	}
+	defer conn.Close()
+
+	if _, err := conn.ExecContext(ctx, "SELECT pg_advisory_lock($1)", migrationLock); err != nil {
+		return Status{}, fmt.Errorf("failed to lock migrations: %w", err)
+	}
+	defer conn.ExecContext(context.Background(), "SELECT pg_advisory_unlock($1)", migrationLock)
+
+	if _, err := conn.ExecContext(ctx, `CREATE TABLE IF NOT EXISTS schema_migrations (
+		version    INTEGER PRIMARY KEY,
+		name       TEXT NOT NULL,
+		applied_at TIMESTAMPTZ NOT NULL DEFAULT now()
+	)`); err != nil {
+		return Status{}, fmt.Errorf("failed to create schema_migrations: %w", err)
+	}
+	version, err := currentVersion(ctx, conn)
+	if err != nil {
+		return Status{}, err
+	}
+
+	for _, m := range migrations[min(version, len(migrations)):] {
+		tx, err := conn.BeginTx(ctx, nil)
+		if err != nil {
+			return Status{}, fmt.Errorf("failed to begin migration %d_%s: %w", m.Version, m.Name, err)
+		}
+		if _, err := tx.ExecContext(ctx, m.SQL); err != nil {
+			tx.Rollback()
+			return Status{}, fmt.Errorf("failed to apply migration %d_%s: %w", m.Version, m.Name, err)
+		}
+		if _, err := tx.ExecContext(ctx, "INSERT INTO schema_migrations (version, name) VALUES ($1, $2)", m.Version, m.Name); err != nil {
+			tx.Rollback()
+			return Status{}, fmt.Errorf("failed to record migration %d_%s: %w", m.Version, m.Name, err)
+		}
+		if err := tx.Commit(); err != nil {
+			return Status{}, fmt.Errorf("failed to commit migration %d_%s: %w", m.Version, m.Name, err)
+		}
+		version = m.Version
+		logger.Get().Info("Applied migration", zap.Int("version", m.Version), zap.String("name", m.Name))
+	}
+	return Status{Version: version, Latest: len(migrations)}, nil
+}
+
+// SchemaStatus reports the version of the database's schema without
+// migrating it.
+func SchemaStatus(ctx context.Context, db *sql.DB) (Status, error) {
+	migrations, err := Migrations()
+	if err != nil {
+		return Status{}, err
+	}
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return Status{}, fmt.Errorf("failed to connect to database: %w", err)
+	}
+	defer conn.Close()
+	var exists bool
+	if err := conn.QueryRowContext(ctx, "SELECT to_regclass('schema_migrations') IS NOT NULL").Scan(&exists); err != nil {
+		return Status{}, fmt.Errorf("failed to read schema version: %w", err)
+	}
+	version := 0
+	if exists {
+		if version, err = currentVersion(ctx, conn); err != nil {
+			return Status{}, err
+		}
+	}
+	return Status{Version: version, Latest: len(migrations), Pending: max(len(migrations)-version, 0)}, nil
+}
+
+func currentVersion(ctx context.Context, conn *sql.Conn) (int, error) {
+	var version int
+	if err := conn.QueryRowContext(ctx, "SELECT COALESCE(MAX(version), 0) FROM schema_migrations").Scan(&version); err != nil {
+		return 0, fmt.Errorf("failed to read schema version: %w", err)
+	}
+	return version, nil
+}
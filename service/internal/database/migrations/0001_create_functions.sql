@@ -0,0 +1,6 @@
+CREATE TABLE functions (
+    name       TEXT PRIMARY KEY,
+    config     JSONB NOT NULL,
+    digest     TEXT NOT NULL DEFAULT '',
+    updated_at TIMESTAMPTZ NOT NULL
+);
@@ -0,0 +1,14 @@
+CREATE TABLE invocations (
+    id          BIGSERIAL PRIMARY KEY,
+    request_id  TEXT NOT NULL DEFAULT '',
+    function    TEXT NOT NULL,
+    started_at  TIMESTAMPTZ NOT NULL,
+    ended_at    TIMESTAMPTZ NOT NULL,
+    status      TEXT NOT NULL,
+    status_code INTEGER NOT NULL DEFAULT 0,
+    error       TEXT NOT NULL DEFAULT '',
+    cold_start  BOOLEAN NOT NULL DEFAULT false
+);
+
+CREATE INDEX invocations_function_started_at ON invocations (function, started_at DESC);
+CREATE INDEX invocations_started_at ON invocations (started_at);
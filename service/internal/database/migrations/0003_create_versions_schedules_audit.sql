@@ -0,0 +1,28 @@
+CREATE TABLE function_versions (
+    function         TEXT NOT NULL,
+    version          INTEGER NOT NULL,
+    config           JSONB NOT NULL,
+    digest           TEXT NOT NULL DEFAULT '',
+    deployed_at      TIMESTAMPTZ NOT NULL,
+    rolled_back_from INTEGER NOT NULL DEFAULT 0,
+    PRIMARY KEY (function, version)
+);
+
+CREATE TABLE schedules (
+    id         TEXT PRIMARY KEY,
+    function   TEXT NOT NULL,
+    spec       JSONB NOT NULL,
+    updated_at TIMESTAMPTZ NOT NULL
+);
+
+CREATE TABLE audit_events (
+    id       BIGSERIAL PRIMARY KEY,
+    time     TIMESTAMPTZ NOT NULL,
+    actor    TEXT NOT NULL DEFAULT '',
+    action   TEXT NOT NULL,
+    function TEXT NOT NULL DEFAULT '',
+    project  TEXT NOT NULL DEFAULT '',
+    detail   JSONB NOT NULL DEFAULT '{}'
+);
+
+CREATE INDEX audit_events_time ON audit_events (time DESC);
@@ -0,0 +1,7 @@
+CREATE TABLE resources (
+    kind       TEXT NOT NULL,
+    name       TEXT NOT NULL,
+    spec       JSONB NOT NULL,
+    updated_at TIMESTAMPTZ NOT NULL,
+    PRIMARY KEY (kind, name)
+);
@@ -0,0 +1,202 @@
+// Package drift compares what the registry says should be running against
+// what is actually on the host, to find containers, snapshots and temp dirs
+// the service has lost track of and instances it thinks are alive but aren't.
+package drift
+
+import (
+	"fmt"
+	"kappa-v2/service/internal/kappa"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+)
+
+// DefaultGrace is how old a resource must be before it counts as orphaned,
+// so ones created by a start that is still setting up aren't reported
+const DefaultGrace = 5 * time.Minute
+
+// Kinds of resource a finding is about
+const (
+	KindContainer = kappa.ResourceContainer
+	KindSnapshot  = kappa.ResourceSnapshot
+	KindTmpDir    = "tmpdir"
+)
+
+// TmpDir is a temp dir the service created for an instance.
+type TmpDir struct {
+	Path    string
+	ModTime time.Time
+}
+
+// ScanTmpDirs lists the service's temp dirs in dir, the ones named kappa-*.
+func ScanTmpDirs(dir string) ([]TmpDir, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read temp dir: %w", err)
+	}
+	var dirs []TmpDir
+	for _, entry := range entries {
+		if !entry.IsDir() || !strings.HasPrefix(entry.Name(), "kappa-") {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			// Removed while scanning
+			continue
+		}
+		dirs = append(dirs, TmpDir{Path: filepath.Join(dir, entry.Name()), ModTime: info.ModTime()})
+	}
+	return dirs, nil
+}
+
+// Actual is what is on the host.
+type Actual struct {
+	// Resources are what the container backend reports, nil when it
+	// couldn't be listed
+	Resources []kappa.Resource
+	TmpDirs   []TmpDir
+}
+
+// Finding is one difference between the registry and the host.
+type Finding struct {
+	Kind string `json:"kind"`
+	// ID is the container ID, snapshot key or temp dir path
+	ID       string `json:"id"`
+	Function string `json:"function,omitempty"`
+	// Job is set when the instance is running a job rather than serving
+	Job    bool   `json:"job,omitempty"`
+	Detail string `json:"detail"`
+	// Repair is what was done about the finding, when repairing
+	Repair string `json:"repair,omitempty"`
+}
+
+// Report lists the drift found by Compare.
+type Report struct {
+	CheckedAt time.Time `json:"checkedAt"`
+	// Orphans exist on the host but belong to no live instance
+	Orphans []Finding `json:"orphans"`
+	// Missing belong to a live instance but are gone from the host
+	Missing []Finding `json:"missing"`
+	// Mismatched run something other than what the registry says
+	Mismatched []Finding `json:"mismatched"`
+	// Errors are parts of the host that couldn't be checked
+	Errors []string `json:"errors,omitempty"`
+}
+
+// Drifted reports whether any difference was found.
+func (r *Report) Drifted() bool {
+	return len(r.Orphans)+len(r.Missing)+len(r.Mismatched) > 0
+}
+
+// Compare finds the drift between the functions' footprints, by function
+// name, and what is on the host. Orphans younger than grace are left out.
+// Containers are only compared when actual has resources listed.
+func Compare(desired map[string]kappa.Footprint, actual Actual, now time.Time, grace time.Duration) Report {
+	report := Report{
+		CheckedAt:  now,
+		Orphans:    []Finding{},
+		Missing:    []Finding{},
+		Mismatched: []Finding{},
+	}
+	old := func(t time.Time) bool {
+		return now.Sub(t) >= grace
+	}
+
+	type owner struct {
+		function string
+		instance kappa.InstanceFootprint
+	}
+	instances := make(map[string]owner)
+	tmpDirs := make(map[string]string)
+	names := make([]string, 0, len(desired))
+	for name := range desired {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	for _, name := range names {
+		for _, instance := range desired[name].Instances {
+			if instance.ID != "" {
+				instances[instance.ID] = owner{function: name, instance: instance}
+			}
+		}
+		for _, dir := range desired[name].TmpDirs {
+			tmpDirs[dir] = name
+		}
+	}
+
+	if actual.Resources != nil {
+		containers := make(map[string]kappa.Resource)
+		snapshots := make(map[string]bool)
+		for _, r := range actual.Resources {
+			if r.Kind == kappa.ResourceContainer {
+				containers[r.ID] = r
+				if r.Snapshot != "" {
+					snapshots[r.Snapshot] = true
+				}
+			}
+		}
+
+		for _, r := range actual.Resources {
+			switch r.Kind {
+			case kappa.ResourceContainer:
+				o, owned := instances[r.ID]
+				switch {
+				case !owned && old(r.CreatedAt):
+					detail := "no live instance uses this container"
+					if r.Running {
+						detail = "running container no live instance uses"
+					}
+					report.Orphans = append(report.Orphans, Finding{Kind: KindContainer, ID: r.ID, Detail: detail})
+				case owned && o.instance.Image != "" && r.Image != o.instance.Image:
+					report.Mismatched = append(report.Mismatched, Finding{
+						Kind:     KindContainer,
+						ID:       r.ID,
+						Function: o.function,
+						Job:      o.instance.Job,
+						Detail:   fmt.Sprintf("runs image %s instead of %s", r.Image, o.instance.Image),
+					})
+				}
+			case kappa.ResourceSnapshot:
+				if !snapshots[r.ID] && old(r.CreatedAt) {
+					report.Orphans = append(report.Orphans, Finding{Kind: KindSnapshot, ID: r.ID, Detail: "no container uses this snapshot"})
+				}
+			}
+		}
+
+		for _, name := range names {
+			for _, instance := range desired[name].Instances {
+				if instance.ID == "" {
+					continue
+				}
+				finding := Finding{Kind: KindContainer, ID: instance.ID, Function: name, Job: instance.Job}
+				if r, exists := containers[instance.ID]; !exists {
+					finding.Detail = "container not found"
+				} else if !r.Running {
+					finding.Detail = "container has no running task"
+				} else {
+					continue
+				}
+				report.Missing = append(report.Missing, finding)
+			}
+		}
+	}
+
+	found := make(map[string]bool, len(actual.TmpDirs))
+	for _, dir := range actual.TmpDirs {
+		found[dir.Path] = true
+		if _, owned := tmpDirs[dir.Path]; !owned && old(dir.ModTime) {
+			report.Orphans = append(report.Orphans, Finding{Kind: KindTmpDir, ID: dir.Path, Detail: "no live instance uses this temp dir"})
+		}
+	}
+	for _, name := range names {
+		for _, dir := range desired[name].TmpDirs {
+			if !found[dir] {
+				report.Missing = append(report.Missing, Finding{Kind: KindTmpDir, ID: dir, Function: name, Detail: "temp dir not found"})
+			}
+		}
+	}
+
+	return report
+}
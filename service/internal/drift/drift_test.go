@@ -0,0 +1,83 @@
+package drift
+
+import (
+	"kappa-v2/service/internal/kappa"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCompare(t *testing.T) {
+	now := time.Now()
+	old := now.Add(-time.Hour)
+	desired := map[string]kappa.Footprint{
+		"api": {
+			Running: true,
+			Instances: []kappa.InstanceFootprint{
+				{ID: "kappa-api-1", Image: "docker.io/library/alpine:latest"},
+				{ID: "kappa-api-job-2", Image: "docker.io/library/alpine:latest", Job: true},
+			},
+			TmpDirs: []string{"/tmp/kappa-api-1", "/tmp/kappa-api-gone"},
+		},
+		"web": {
+			Running:   true,
+			Instances: []kappa.InstanceFootprint{{ID: "kappa-web-1", Image: "docker.io/library/node:22"}},
+		},
+	}
+	actual := Actual{
+		Resources: []kappa.Resource{
+			{Kind: kappa.ResourceContainer, ID: "kappa-api-1", Image: "docker.io/library/alpine:latest", Running: true, Snapshot: "kappa-api-1-snapshot", CreatedAt: old},
+			{Kind: kappa.ResourceContainer, ID: "kappa-web-1", Image: "docker.io/library/node:20", Running: true, CreatedAt: old},
+			{Kind: kappa.ResourceContainer, ID: "kappa-old-1", Running: true, CreatedAt: old},
+			{Kind: kappa.ResourceContainer, ID: "kappa-starting-1", CreatedAt: now},
+			{Kind: kappa.ResourceSnapshot, ID: "kappa-api-1-snapshot", CreatedAt: old},
+			{Kind: kappa.ResourceSnapshot, ID: "kappa-old-2-snapshot", CreatedAt: old},
+		},
+		TmpDirs: []TmpDir{
+			{Path: "/tmp/kappa-api-1", ModTime: old},
+			{Path: "/tmp/kappa-old-1", ModTime: old},
+			{Path: "/tmp/kappa-new-1", ModTime: now},
+		},
+	}
+
+	report := Compare(desired, actual, now, DefaultGrace)
+	assert.True(t, report.Drifted())
+	assert.Equal(t, []Finding{
+		{Kind: KindContainer, ID: "kappa-old-1", Detail: "running container no live instance uses"},
+		{Kind: KindSnapshot, ID: "kappa-old-2-snapshot", Detail: "no container uses this snapshot"},
+		{Kind: KindTmpDir, ID: "/tmp/kappa-old-1", Detail: "no live instance uses this temp dir"},
+	}, report.Orphans, "resources inside the grace period are left alone")
+	assert.Equal(t, []Finding{
+		{Kind: KindContainer, ID: "kappa-api-job-2", Function: "api", Job: true, Detail: "container not found"},
+		{Kind: KindTmpDir, ID: "/tmp/kappa-api-gone", Function: "api", Detail: "temp dir not found"},
+	}, report.Missing)
+	assert.Equal(t, []Finding{
+		{Kind: KindContainer, ID: "kappa-web-1", Function: "web", Detail: "runs image docker.io/library/node:20 instead of docker.io/library/node:22"},
+	}, report.Mismatched)
+}
+
+func TestCompare_WithoutResources(t *testing.T) {
+	desired := map[string]kappa.Footprint{
+		"api": {Running: true, Instances: []kappa.InstanceFootprint{{ID: "kappa-api-1"}}},
+	}
+	report := Compare(desired, Actual{}, time.Now(), DefaultGrace)
+	assert.False(t, report.Drifted(), "containers can't be missing when they couldn't be listed")
+	assert.NotNil(t, report.Orphans)
+}
+
+func TestScanTmpDirs(t *testing.T) {
+	dir := t.TempDir()
+	require.NoError(t, os.Mkdir(filepath.Join(dir, "kappa-api-123"), 0755))
+	require.NoError(t, os.Mkdir(filepath.Join(dir, "other"), 0755))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "kappa-file"), nil, 0644))
+
+	dirs, err := ScanTmpDirs(dir)
+	require.NoError(t, err)
+	require.Len(t, dirs, 1)
+	assert.Equal(t, filepath.Join(dir, "kappa-api-123"), dirs[0].Path)
+	assert.False(t, dirs[0].ModTime.IsZero())
+}
@@ -0,0 +1,187 @@
+// Package envref expands references like ${secret:NAME} in function
+// environment values, so registered configs don't carry literal values and
+// can be promoted between environments unchanged.
+package envref
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// ErrNotFound is returned by a Source that has no value for a key.
+var ErrNotFound = errors.New("reference not found")
+
+// Source looks up the value of one kind of reference.
+type Source interface {
+	Lookup(ctx context.Context, key string) (string, error)
+}
+
+// SourceFunc adapts a function to a Source.
+type SourceFunc func(ctx context.Context, key string) (string, error)
+
+func (f SourceFunc) Lookup(ctx context.Context, key string) (string, error) {
+	return f(ctx, key)
+}
+
+// Resolver expands ${kind:key} references using the Source registered for
+// each kind. "$${" is a literal "${", and ${NAME} without a kind is left
+// alone so shell style values pass through.
+type Resolver struct {
+	sources map[string]Source
+}
+
+// NewResolver creates a resolver without any sources.
+func NewResolver() *Resolver {
+	return &Resolver{sources: make(map[string]Source)}
+}
+
+// Register resolves ${kind:key} references through src.
+func (r *Resolver) Register(kind string, src Source) {
+	r.sources[kind] = src
+}
+
+// ref is one ${kind:key} reference found in a value.
+type ref struct {
+	start, end int
+	kind, key  string
+}
+
+// parse finds the references in value. Literal "$${" escapes are returned
+// as refs with an empty kind.
+func parse(value string) ([]ref, error) {
+	var refs []ref
+	for i := 0; i < len(value); i++ {
+		if strings.HasPrefix(value[i:], "$${") {
+			refs = append(refs, ref{start: i, end: i + 1})
+			i += 2
+			continue
+		}
+		if !strings.HasPrefix(value[i:], "${") {
+			continue
+		}
+
+		end := strings.IndexByte(value[i:], '}')
+		if end < 0 {
+			return nil, fmt.Errorf("unterminated reference in %q", value)
+		}
+		body := value[i+2 : i+end]
+		kind, key, ok := strings.Cut(body, ":")
+		if ok {
+			if kind == "" || key == "" {
+				return nil, fmt.Errorf("invalid reference ${%s}", body)
+			}
+			refs = append(refs, ref{start: i, end: i + end + 1, kind: kind, key: key})
+		}
+		i += end
+	}
+	return refs, nil
+}
+
+// Validate checks that every reference in env is well formed and of a
+// registered kind, without looking any of them up.
+func (r *Resolver) Validate(env []string) error {
+	for _, kv := range env {
+		refs, err := parse(kv)
+		if err != nil {
+			return err
+		}
+		for _, ref := range refs {
+			if ref.kind == "" {
+				continue
+			}
+			if _, ok := r.sources[ref.kind]; !ok {
+				return fmt.Errorf("unknown reference kind %q in ${%s:%s}", ref.kind, ref.kind, ref.key)
+			}
+		}
+	}
+	return nil
+}
+
+// ResolveEnv returns env with every reference replaced by its value.
+func (r *Resolver) ResolveEnv(ctx context.Context, env []string) ([]string, error) {
+	resolved := make([]string, len(env))
+	for i, kv := range env {
+		value, err := r.expand(ctx, kv)
+		if err != nil {
+			key, _, _ := strings.Cut(kv, "=")
+			return nil, fmt.Errorf("failed to resolve %s: %w", key, err)
+		}
+		resolved[i] = value
+	}
+	return resolved, nil
+}
+
+func (r *Resolver) expand(ctx context.Context, value string) (string, error) {
+	refs, err := parse(value)
+	if err != nil {
+		return "", err
+	}
+
+	var sb strings.Builder
+	last := 0
+	for _, ref := range refs {
+		sb.WriteString(value[last:ref.start])
+		last = ref.end
+		if ref.kind == "" {
+			continue
+		}
+
+		src, ok := r.sources[ref.kind]
+		if !ok {
+			return "", fmt.Errorf("unknown reference kind %q", ref.kind)
+		}
+		v, err := src.Lookup(ctx, ref.key)
+		if err != nil {
+			return "", fmt.Errorf("${%s:%s}: %w", ref.kind, ref.key, err)
+		}
+		sb.WriteString(v)
+	}
+	sb.WriteString(value[last:])
+	return sb.String(), nil
+}
+
+// SecretDir reads secrets from one file per secret in a directory, the
+// layout used by Docker and Kubernetes secret mounts.
+type SecretDir string
+
+func (d SecretDir) Lookup(ctx context.Context, key string) (string, error) {
+	if key != filepath.Base(key) || strings.HasPrefix(key, ".") {
+		return "", fmt.Errorf("invalid secret name %q", key)
+	}
+	data, err := os.ReadFile(filepath.Join(string(d), key))
+	if errors.Is(err, os.ErrNotExist) {
+		return "", ErrNotFound
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to read secret: %w", err)
+	}
+	return strings.TrimRight(string(data), "\r\n"), nil
+}
+
+// Map looks references up in a fixed set of values.
+type Map map[string]string
+
+func (m Map) Lookup(ctx context.Context, key string) (string, error) {
+	if v, ok := m[key]; ok {
+		return v, nil
+	}
+	return "", ErrNotFound
+}
+
+// LoadMap reads a JSON object of string values.
+func LoadMap(path string) (Map, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read config: %w", err)
+	}
+	var m Map
+	if err := json.Unmarshal(data, &m); err != nil {
+		return nil, fmt.Errorf("failed to parse config: %w", err)
+	}
+	return m, nil
+}
@@ -0,0 +1,57 @@
+package envref
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestResolver_ResolveEnv(t *testing.T) {
+	secrets := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(secrets, "DB_PASSWORD"), []byte("hunter2\n"), 0600))
+
+	r := NewResolver()
+	r.Register("secret", SecretDir(secrets))
+	r.Register("config", Map{"region": "eu-west-1"})
+	r.Register("function", SourceFunc(func(ctx context.Context, key string) (string, error) {
+		return "http://kappa/functions/" + key, nil
+	}))
+
+	env, err := r.ResolveEnv(context.Background(), []string{
+		"PASSWORD=${secret:DB_PASSWORD}",
+		"URL=postgres://app:${secret:DB_PASSWORD}@db/${config:region}",
+		"PEER=${function:other.url}",
+		"SHELL_STYLE=${HOME}",
+		"ESCAPED=$${secret:DB_PASSWORD}",
+		"PLAIN=value",
+	})
+	require.NoError(t, err)
+	assert.Equal(t, []string{
+		"PASSWORD=hunter2",
+		"URL=postgres://app:hunter2@db/eu-west-1",
+		"PEER=http://kappa/functions/other.url",
+		"SHELL_STYLE=${HOME}",
+		"ESCAPED=${secret:DB_PASSWORD}",
+		"PLAIN=value",
+	}, env)
+
+	_, err = r.ResolveEnv(context.Background(), []string{"A=${secret:MISSING}"})
+	assert.ErrorIs(t, err, ErrNotFound)
+
+	_, err = r.ResolveEnv(context.Background(), []string{"A=${secret:../etc/passwd}"})
+	assert.Error(t, err)
+}
+
+func TestResolver_Validate(t *testing.T) {
+	r := NewResolver()
+	r.Register("secret", Map{})
+
+	assert.NoError(t, r.Validate([]string{"A=${secret:X}", "B=${HOME}", "C=$${vault:x}"}))
+	assert.Error(t, r.Validate([]string{"A=${vault:X}"}))
+	assert.Error(t, r.Validate([]string{"A=${secret:X"}))
+	assert.Error(t, r.Validate([]string{"A=${secret:}"}))
+}
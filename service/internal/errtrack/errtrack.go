@@ -0,0 +1,382 @@
+// Package errtrack reports handler panics and failed invocations to error
+// trackers speaking Sentry's protocol, like Sentry and GlitchTip, each
+// project reporting to the DSN it is configured with.
+package errtrack
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"kappa-v2/pkg/logger"
+	"kappa-v2/service/internal/kappa"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// Defaults of a reporter
+const (
+	// queueSize is how many events wait to be sent before more are dropped
+	queueSize = 256
+	// sendTimeout bounds sending one event
+	sendTimeout = 10 * time.Second
+	// closeTimeout is how long Close waits for the queued events to be sent
+	closeTimeout = 5 * time.Second
+)
+
+// Kinds of events
+const (
+	KindPanic  = "panic"
+	KindInvoke = "invoke"
+)
+
+// DSN is where a project's events go, as the tracker gives it:
+// https://<key>@<host>/<project id>
+type DSN struct {
+	raw string
+	key string
+	// endpoint is the tracker's envelope API for the project
+	endpoint string
+}
+
+// ParseDSN parses a tracker's DSN.
+func ParseDSN(raw string) (*DSN, error) {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return nil, fmt.Errorf("invalid DSN: %w", err)
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, fmt.Errorf("invalid DSN %q, expected an http or https URL", raw)
+	}
+	if u.User == nil || u.User.Username() == "" {
+		return nil, fmt.Errorf("invalid DSN %q, expected a key before the host", raw)
+	}
+	path := strings.TrimSuffix(u.Path, "/")
+	i := strings.LastIndex(path, "/")
+	if i < 0 || path[i+1:] == "" {
+		return nil, fmt.Errorf("invalid DSN %q, expected a project ID after the host", raw)
+	}
+	return &DSN{
+		raw:      raw,
+		key:      u.User.Username(),
+		endpoint: fmt.Sprintf("%s://%s%s/api/%s/envelope/", u.Scheme, u.Host, path[:i], path[i+1:]),
+	}, nil
+}
+
+func (d *DSN) String() string {
+	return d.raw
+}
+
+// Event is a failure to report.
+type Event struct {
+	Time time.Time
+	// Kind is KindPanic or KindInvoke
+	Kind        string
+	Project     string
+	Function    string
+	Version     int
+	Environment string
+	RequestID   string
+	Message     string
+	// Stack is the goroutine's stack as Go prints it, empty when there is
+	// none
+	Stack string
+}
+
+// Reporter sends events to their project's tracker in the background,
+// dropping them when it falls behind rather than holding up invocations.
+type Reporter struct {
+	mu       sync.RWMutex
+	dsns     map[string]*DSN
+	client   *http.Client
+	host     string
+	queue    chan queued
+	done     chan struct{}
+	dropped  atomic.Int64
+	closeMu  sync.Mutex
+	isClosed bool
+}
+
+type queued struct {
+	dsn   *DSN
+	event Event
+}
+
+// NewReporter creates a reporter sending events as they come.
+func NewReporter() *Reporter {
+	host, _ := os.Hostname()
+	r := &Reporter{
+		dsns:   make(map[string]*DSN),
+		client: &http.Client{Timeout: sendTimeout},
+		host:   host,
+		queue:  make(chan queued, queueSize),
+		done:   make(chan struct{}),
+	}
+	go r.run()
+	return r
+}
+
+// SetDSN has project's events sent to dsn, nil to stop reporting them.
+func (r *Reporter) SetDSN(project string, dsn *DSN) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if dsn == nil {
+		delete(r.dsns, project)
+		return
+	}
+	r.dsns[project] = dsn
+}
+
+// Report queues e to be sent to its project's tracker, reporting whether it
+// was. Events of projects without a DSN are ignored.
+func (r *Reporter) Report(e Event) bool {
+	r.mu.RLock()
+	dsn := r.dsns[e.Project]
+	r.mu.RUnlock()
+	if dsn == nil {
+		return false
+	}
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+
+	r.closeMu.Lock()
+	defer r.closeMu.Unlock()
+	if r.isClosed {
+		return false
+	}
+	select {
+	case r.queue <- queued{dsn: dsn, event: e}:
+		return true
+	default:
+		if r.dropped.Add(1) == 1 {
+			logger.Get().Warn("Error tracker can't keep up, dropping events", zap.String("project", e.Project))
+		}
+		return false
+	}
+}
+
+// Dropped is how many events were dropped for the queue being full.
+func (r *Reporter) Dropped() int64 {
+	return r.dropped.Load()
+}
+
+// Close stops taking events and waits a while for the queued ones to be
+// sent.
+func (r *Reporter) Close() {
+	r.closeMu.Lock()
+	if r.isClosed {
+		r.closeMu.Unlock()
+		return
+	}
+	r.isClosed = true
+	close(r.queue)
+	r.closeMu.Unlock()
+
+	select {
+	case <-r.done:
+	case <-time.After(closeTimeout):
+		logger.Get().Warn("Gave up sending events to the error tracker", zap.Int("queued", len(r.queue)))
+	}
+}
+
+func (r *Reporter) run() {
+	defer close(r.done)
+	for q := range r.queue {
+		if err := r.send(context.Background(), q.dsn, q.event); err != nil {
+			logger.Get().Warn("Failed to report to error tracker",
+				zap.String("project", q.event.Project),
+				zap.String("function", q.event.Function),
+				zap.Error(err))
+		}
+	}
+}
+
+// send posts e to the tracker as an envelope holding one event.
+func (r *Reporter) send(ctx context.Context, dsn *DSN, e Event) error {
+	body, err := r.envelope(dsn, e)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, dsn.endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-sentry-envelope")
+	req.Header.Set("X-Sentry-Auth", fmt.Sprintf("Sentry sentry_version=7, sentry_client=kappa/1.0, sentry_key=%s", dsn.key))
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("tracker answered %s", resp.Status)
+	}
+	return nil
+}
+
+// envelope encodes e as the tracker's envelope: a header, the item's header
+// and the event, a line each.
+func (r *Reporter) envelope(dsn *DSN, e Event) ([]byte, error) {
+	id := eventID()
+	event, err := json.Marshal(r.event(id, e))
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode event: %w", err)
+	}
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.Encode(map[string]string{
+		"event_id": id,
+		"dsn":      dsn.raw,
+		"sent_at":  time.Now().UTC().Format(time.RFC3339Nano),
+	})
+	enc.Encode(map[string]any{"type": "event", "length": len(event)})
+	buf.Write(event)
+	buf.WriteByte('\n')
+	return buf.Bytes(), nil
+}
+
+// event is e as the tracker's event payload
+func (r *Reporter) event(id string, e Event) map[string]any {
+	exceptionType := "InvocationError"
+	if e.Kind == KindPanic {
+		exceptionType = "panic"
+	}
+	exception := map[string]any{
+		"type":  exceptionType,
+		"value": e.Message,
+	}
+	if frames := parseStack(e.Stack); len(frames) > 0 {
+		exception["stacktrace"] = map[string]any{"frames": frames}
+	}
+	tags := map[string]string{
+		"function": e.Function,
+		"kind":     e.Kind,
+	}
+	if e.RequestID != "" {
+		tags["request_id"] = e.RequestID
+	}
+	event := map[string]any{
+		"event_id":    id,
+		"timestamp":   e.Time.UTC().Format(time.RFC3339Nano),
+		"platform":    "go",
+		"level":       "error",
+		"logger":      "kappa",
+		"server_name": r.host,
+		"transaction": e.Function,
+		"tags":        tags,
+		"exception":   map[string]any{"values": []any{exception}},
+	}
+	if e.Version > 0 {
+		tags["version"] = strconv.Itoa(e.Version)
+		event["release"] = fmt.Sprintf("%s@%d", e.Function, e.Version)
+	}
+	if e.Environment != "" {
+		event["environment"] = e.Environment
+	}
+	return event
+}
+
+// frame is one call of a stack trace, as the tracker takes it
+type frame struct {
+	Function string `json:"function"`
+	Filename string `json:"abs_path"`
+	Lineno   int    `json:"lineno,omitempty"`
+	InApp    bool   `json:"in_app"`
+}
+
+// parseStack reads the frames of a stack as Go prints it, a function's call
+// followed by an indented file:line, into the tracker's order, outermost
+// call first. Calls of the runtime, the standard library, dependencies and
+// the SDK aren't the handler's own.
+func parseStack(stack string) []frame {
+	lines := strings.Split(strings.TrimSpace(stack), "\n")
+	var frames []frame
+	for i := 0; i+1 < len(lines); i++ {
+		call, location := lines[i], lines[i+1]
+		if !strings.HasPrefix(location, "\t") || strings.HasPrefix(call, "\t") {
+			continue
+		}
+		i++
+		location = strings.TrimSpace(location)
+		if at := strings.LastIndex(location, " +0x"); at >= 0 {
+			location = location[:at]
+		}
+		// The goroutine's go statement reads "created by f in goroutine 1"
+		if created, ok := strings.CutPrefix(call, "created by "); ok {
+			call, _, _ = strings.Cut(created, " in goroutine ")
+		} else if paren := strings.LastIndex(call, "("); paren > 0 {
+			call = call[:paren]
+		}
+		f := frame{Function: call, Filename: location}
+		if colon := strings.LastIndex(location, ":"); colon > 0 {
+			if line, err := strconv.Atoi(location[colon+1:]); err == nil {
+				f.Filename, f.Lineno = location[:colon], line
+			}
+		}
+		f.InApp = f.Function != "panic" &&
+			!strings.HasPrefix(f.Function, "kappa-v2/pkg/handler.") &&
+			!strings.Contains(f.Filename, "/go/src/") &&
+			!strings.Contains(f.Filename, "/pkg/mod/")
+		frames = append(frames, f)
+	}
+	for i, j := 0, len(frames)-1; i < j; i, j = i+1, j-1 {
+		frames[i], frames[j] = frames[j], frames[i]
+	}
+	return frames
+}
+
+// eventID makes the 32 hex digit ID the tracker expects.
+func eventID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// Recorder reports the panics and failed invocations of a function in
+// project and environment, passing the usage of every invocation on to
+// next.
+func (r *Reporter) Recorder(project, environment string, next kappa.UsageRecorder) kappa.UsageRecorder {
+	return recorder{reporter: r, project: project, environment: environment, next: next}
+}
+
+type recorder struct {
+	reporter    *Reporter
+	project     string
+	environment string
+	next        kappa.UsageRecorder
+}
+
+func (r recorder) RecordUsage(u kappa.Usage) {
+	e := Event{
+		Time:        u.Started.Add(u.Duration),
+		Project:     r.project,
+		Function:    u.Function,
+		Version:     u.Version,
+		Environment: r.environment,
+		RequestID:   u.RequestID,
+	}
+	switch {
+	case u.Panic != nil:
+		e.Kind, e.Message, e.Stack = KindPanic, u.Panic.Message, u.Panic.Stack
+		r.reporter.Report(e)
+	// Callers giving up aren't the platform failing
+	case u.Err != nil && !errors.Is(u.Err, context.Canceled):
+		e.Kind, e.Message = KindInvoke, u.Err.Error()
+		r.reporter.Report(e)
+	}
+	if r.next != nil {
+		r.next.RecordUsage(u)
+	}
+}
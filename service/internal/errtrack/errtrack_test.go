@@ -0,0 +1,174 @@
+package errtrack
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"kappa-v2/pkg/handler"
+	"kappa-v2/service/internal/kappa"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseDSN(t *testing.T) {
+	dsn, err := ParseDSN("https://abc123@o1.ingest.example.com/42")
+	require.NoError(t, err)
+	assert.Equal(t, "abc123", dsn.key)
+	assert.Equal(t, "https://o1.ingest.example.com/api/42/envelope/", dsn.endpoint)
+
+	// Trackers served under a path keep it
+	dsn, err = ParseDSN("http://key@tracker.internal:9000/glitchtip/7")
+	require.NoError(t, err)
+	assert.Equal(t, "http://tracker.internal:9000/glitchtip/api/7/envelope/", dsn.endpoint)
+
+	for _, raw := range []string{"", "ftp://key@host/1", "https://host/1", "https://key@host", "https://key@host/"} {
+		_, err := ParseDSN(raw)
+		assert.Error(t, err, raw)
+	}
+}
+
+func TestParseStack(t *testing.T) {
+	stack := `goroutine 7 [running]:
+runtime/debug.Stack()
+	/usr/local/go/src/runtime/debug/stack.go:26 +0x5e
+kappa-v2/pkg/handler.callHandler.func1()
+	/src/pkg/handler/panic.go:30 +0x65
+panic({0x6c7a20?, 0x7c1b30?})
+	/usr/local/go/src/runtime/panic.go:785 +0x132
+main.handle({{0x0, 0x0}, ...})
+	/app/main.go:12 +0x1d
+kappa-v2/pkg/handler.callHandler(...)
+	/src/pkg/handler/panic.go:40 +0x9a
+github.com/acme/kit.(*Pool).run(0xc000010000)
+	/root/go/pkg/mod/github.com/acme/kit@v1.2.0/pool.go:80 +0x3f
+created by net/http.(*Server).Serve in goroutine 1
+	/usr/local/go/src/net/http/server.go:3454 +0x485
+`
+	frames := parseStack(stack)
+	require.Len(t, frames, 7)
+	// Outermost first
+	assert.Equal(t, frame{Function: "net/http.(*Server).Serve", Filename: "/usr/local/go/src/net/http/server.go", Lineno: 3454}, frames[0])
+	assert.Equal(t, "github.com/acme/kit.(*Pool).run", frames[1].Function)
+	assert.False(t, frames[1].InApp)
+	assert.Equal(t, frame{Function: "kappa-v2/pkg/handler.callHandler", Filename: "/src/pkg/handler/panic.go", Lineno: 40}, frames[2])
+	assert.Equal(t, frame{Function: "main.handle", Filename: "/app/main.go", Lineno: 12, InApp: true}, frames[3])
+	assert.False(t, frames[4].InApp)
+	assert.Equal(t, "runtime/debug.Stack", frames[6].Function)
+	assert.False(t, frames[6].InApp)
+
+	assert.Empty(t, parseStack(""))
+}
+
+// tracker records the envelopes posted to it
+type tracker struct {
+	*httptest.Server
+	envelopes chan []map[string]any
+	auth      chan string
+}
+
+func newTracker(t *testing.T) *tracker {
+	tr := &tracker{envelopes: make(chan []map[string]any, 10), auth: make(chan string, 10)}
+	tr.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/api/42/envelope/", r.URL.Path)
+		var lines []map[string]any
+		scanner := bufio.NewScanner(r.Body)
+		scanner.Buffer(nil, 1<<20)
+		for scanner.Scan() {
+			var line map[string]any
+			require.NoError(t, json.Unmarshal(scanner.Bytes(), &line))
+			lines = append(lines, line)
+		}
+		tr.auth <- r.Header.Get("X-Sentry-Auth")
+		tr.envelopes <- lines
+	}))
+	t.Cleanup(tr.Close)
+	return tr
+}
+
+func (tr *tracker) dsn(t *testing.T) *DSN {
+	dsn, err := ParseDSN(strings.Replace(tr.URL, "://", "://key@", 1) + "/42")
+	require.NoError(t, err)
+	return dsn
+}
+
+func (tr *tracker) next(t *testing.T) []map[string]any {
+	select {
+	case lines := <-tr.envelopes:
+		return lines
+	case <-time.After(5 * time.Second):
+		t.Fatal("no event reported")
+		return nil
+	}
+}
+
+func TestRecorder(t *testing.T) {
+	tr := newTracker(t)
+	r := NewReporter()
+	defer r.Close()
+	r.SetDSN("shop", tr.dsn(t))
+
+	var passed []kappa.Usage
+	recorder := r.Recorder("shop", "staging", usageFunc(func(u kappa.Usage) { passed = append(passed, u) }))
+	recorder.RecordUsage(kappa.Usage{
+		Function:   "checkout",
+		Version:    3,
+		RequestID:  "req-1",
+		Started:    time.Now(),
+		StatusCode: http.StatusInternalServerError,
+		Panic:      &handler.Panic{Message: "boom", Stack: "main.handle()\n\t/app/main.go:12 +0x1d\n"},
+	})
+
+	lines := tr.next(t)
+	require.Len(t, lines, 3)
+	assert.Contains(t, <-tr.auth, "sentry_key=key")
+	assert.Equal(t, "event", lines[1]["type"])
+	event := lines[2]
+	assert.Equal(t, lines[0]["event_id"], event["event_id"])
+	assert.Equal(t, "checkout@3", event["release"])
+	assert.Equal(t, "staging", event["environment"])
+	assert.Equal(t, map[string]any{"function": "checkout", "version": "3", "request_id": "req-1", "kind": "panic"}, event["tags"])
+	exception := event["exception"].(map[string]any)["values"].([]any)[0].(map[string]any)
+	assert.Equal(t, "panic", exception["type"])
+	assert.Equal(t, "boom", exception["value"])
+	frames := exception["stacktrace"].(map[string]any)["frames"].([]any)
+	assert.Equal(t, "main.handle", frames[0].(map[string]any)["function"])
+
+	// Invocations the platform failed are reported, callers giving up and
+	// successes aren't
+	recorder.RecordUsage(kappa.Usage{Function: "checkout", Failed: true, Err: context.Canceled})
+	recorder.RecordUsage(kappa.Usage{Function: "checkout", StatusCode: http.StatusOK})
+	recorder.RecordUsage(kappa.Usage{Function: "checkout", Failed: true, Err: errors.New("failed to start kappa function: exit status 1")})
+	event = tr.next(t)[2]
+	assert.Equal(t, "invoke", event["tags"].(map[string]any)["kind"])
+	exception = event["exception"].(map[string]any)["values"].([]any)[0].(map[string]any)
+	assert.Equal(t, "failed to start kappa function: exit status 1", exception["value"])
+	assert.Len(t, passed, 4, "every usage is passed on")
+
+	// Projects without a DSN report nothing
+	assert.False(t, r.Report(Event{Project: "other", Function: "f", Kind: KindPanic}))
+	r.SetDSN("shop", nil)
+	assert.False(t, r.Report(Event{Project: "shop", Function: "f", Kind: KindPanic}))
+}
+
+func TestReporter_Close(t *testing.T) {
+	tr := newTracker(t)
+	r := NewReporter()
+	r.SetDSN("shop", tr.dsn(t))
+	require.True(t, r.Report(Event{Project: "shop", Function: "f", Kind: KindPanic, Message: "boom"}))
+	r.Close()
+	// Queued events are sent before it returns
+	assert.Len(t, tr.envelopes, 1)
+	assert.False(t, r.Report(Event{Project: "shop", Function: "f", Kind: KindPanic}))
+	r.Close()
+}
+
+type usageFunc func(kappa.Usage)
+
+func (f usageFunc) RecordUsage(u kappa.Usage) { f(u) }
@@ -0,0 +1,294 @@
+// Package gateway maps HTTP routes, like GET /users/{id}, to the functions
+// serving them, so the service can front functions as an API gateway.
+package gateway
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// ErrConflict is a route another function already serves.
+var ErrConflict = errors.New("route conflict")
+
+// Methods routes may be limited to
+var methods = []string{
+	http.MethodGet, http.MethodHead, http.MethodPost, http.MethodPut,
+	http.MethodPatch, http.MethodDelete, http.MethodOptions,
+}
+
+var validParam = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// Route is an HTTP route a function serves. Path is matched segment by
+// segment: {name} matches any one segment and {name...}, last, matches the
+// rest of the path. Routes without a Method take every method.
+type Route struct {
+	Method   string `json:"method,omitempty"`
+	Path     string `json:"path"`
+	Function string `json:"function"`
+	// Trigger is the function's trigger the route was set up by
+	Trigger string `json:"trigger,omitempty"`
+}
+
+func (r Route) String() string {
+	method := r.Method
+	if method == "" {
+		method = "*"
+	}
+	return method + " " + r.Path
+}
+
+type segmentKind int
+
+// Segments of a path, in the order they take precedence in
+const (
+	literal segmentKind = iota
+	param
+	rest
+)
+
+type segment struct {
+	kind  segmentKind
+	value string // The literal, or the parameter's name
+}
+
+// pattern is a parsed route path.
+type pattern []segment
+
+// parse parses a route path, checking it is absolute, its parameters are
+// named once each and only the last one takes the rest of the path.
+func parse(path string) (pattern, error) {
+	if !strings.HasPrefix(path, "/") {
+		return nil, fmt.Errorf("path %q must start with /", path)
+	}
+	parts := strings.Split(strings.TrimPrefix(path, "/"), "/")
+	p := make(pattern, 0, len(parts))
+	names := make(map[string]bool)
+	for i, part := range parts {
+		name, isParam := strings.CutPrefix(part, "{")
+		if !isParam {
+			if strings.ContainsAny(part, "{}") {
+				return nil, fmt.Errorf("path %q: parameters must be a whole segment", path)
+			}
+			if part == "" && i < len(parts)-1 {
+				return nil, fmt.Errorf("path %q has an empty segment", path)
+			}
+			p = append(p, segment{kind: literal, value: part})
+			continue
+		}
+		name, closed := strings.CutSuffix(name, "}")
+		if !closed {
+			return nil, fmt.Errorf("path %q: parameters must be a whole segment", path)
+		}
+		kind := param
+		if n, isRest := strings.CutSuffix(name, "..."); isRest {
+			if i < len(parts)-1 {
+				return nil, fmt.Errorf("path %q: {%s} must be the last segment", path, name)
+			}
+			name, kind = n, rest
+		}
+		if !validParam.MatchString(name) {
+			return nil, fmt.Errorf("path %q: invalid parameter name %q", path, name)
+		}
+		if names[name] {
+			return nil, fmt.Errorf("path %q names %s twice", path, name)
+		}
+		names[name] = true
+		p = append(p, segment{kind: kind, value: name})
+	}
+	return p, nil
+}
+
+// Validate checks the route's method and path, without its function.
+func (r Route) Validate() error {
+	if r.Method != "" && !slices.Contains(methods, r.Method) {
+		return fmt.Errorf("unknown method %q, expected one of %v", r.Method, methods)
+	}
+	_, err := parse(r.Path)
+	return err
+}
+
+// Sample is a path the route matches, for checking what else would.
+func (r Route) Sample() string {
+	p, err := parse(r.Path)
+	if err != nil {
+		return r.Path
+	}
+	parts := make([]string, len(p))
+	for i, s := range p {
+		parts[i] = s.value
+	}
+	return "/" + strings.Join(parts, "/")
+}
+
+// shape is the pattern with its parameters' names left out, two routes of
+// the same shape match the same paths.
+func (p pattern) shape() string {
+	var b strings.Builder
+	for _, s := range p {
+		switch s.kind {
+		case literal:
+			b.WriteString("/" + s.value)
+		case param:
+			b.WriteString("/{}")
+		case rest:
+			b.WriteString("/{...}")
+		}
+	}
+	return b.String()
+}
+
+// match matches path against the pattern, returning its parameters.
+func (p pattern) match(path string) (map[string]string, bool) {
+	parts := strings.Split(strings.TrimPrefix(path, "/"), "/")
+	params := make(map[string]string)
+	for i, s := range p {
+		if s.kind == rest {
+			params[s.value] = strings.Join(parts[i:], "/")
+			return params, true
+		}
+		if i >= len(parts) {
+			return nil, false
+		}
+		switch s.kind {
+		case literal:
+			if parts[i] != s.value {
+				return nil, false
+			}
+		case param:
+			if parts[i] == "" {
+				return nil, false
+			}
+			params[s.value] = parts[i]
+		}
+	}
+	return params, len(parts) == len(p)
+}
+
+// before reports whether p takes precedence over q, comparing segment by
+// segment: literals come before parameters, which come before the rest.
+func (p pattern) before(q pattern) bool {
+	for i := 0; i < len(p) && i < len(q); i++ {
+		if p[i].kind != q[i].kind {
+			return p[i].kind < q[i].kind
+		}
+	}
+	return len(p) > len(q)
+}
+
+type entry struct {
+	route   Route
+	pattern pattern
+}
+
+// overlaps reports whether two routes match the same requests.
+func (e entry) overlaps(o entry) bool {
+	sameMethod := e.route.Method == "" || o.route.Method == "" || e.route.Method == o.route.Method
+	return sameMethod && e.pattern.shape() == o.pattern.shape()
+}
+
+// Table is the routes of every function, safe for concurrent use.
+type Table struct {
+	mu      sync.RWMutex
+	entries []entry
+}
+
+// New returns an empty table.
+func New() *Table {
+	return &Table{}
+}
+
+// compile parses routes, checking they don't overlap each other or
+// another function's in the table. The caller must hold mu.
+func (t *Table) compile(function string, routes []Route) ([]entry, error) {
+	compiled := make([]entry, 0, len(routes))
+	for _, route := range routes {
+		route.Function = function
+		if err := route.Validate(); err != nil {
+			return nil, err
+		}
+		p, _ := parse(route.Path)
+		e := entry{route: route, pattern: p}
+		for _, other := range compiled {
+			if e.overlaps(other) {
+				return nil, fmt.Errorf("%w: %s and %s match the same requests", ErrConflict, route, other.route)
+			}
+		}
+		for _, other := range t.entries {
+			if other.route.Function != function && e.overlaps(other) {
+				return nil, fmt.Errorf("%w: %s is served by %s as %s", ErrConflict, route, other.route.Function, other.route)
+			}
+		}
+		compiled = append(compiled, e)
+	}
+	return compiled, nil
+}
+
+// Check checks the function could serve routes, replacing its own.
+func (t *Table) Check(function string, routes []Route) error {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	_, err := t.compile(function, routes)
+	return err
+}
+
+// Set replaces the function's routes, none removing them.
+func (t *Table) Set(function string, routes []Route) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	compiled, err := t.compile(function, routes)
+	if err != nil {
+		return err
+	}
+	entries := make([]entry, 0, len(t.entries)+len(compiled))
+	for _, e := range t.entries {
+		if e.route.Function != function {
+			entries = append(entries, e)
+		}
+	}
+	entries = append(entries, compiled...)
+	// The first match wins, so the most specific routes go first
+	sort.SliceStable(entries, func(i, j int) bool {
+		return entries[i].pattern.before(entries[j].pattern)
+	})
+	t.entries = entries
+	return nil
+}
+
+// Match finds the route serving a request and the parameters of its path.
+// When routes match the path but not the method, it returns the methods
+// they take instead.
+func (t *Table) Match(method, path string) (Route, map[string]string, []string) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	var allowed []string
+	for _, e := range t.entries {
+		params, ok := e.pattern.match(path)
+		if !ok {
+			continue
+		}
+		if e.route.Method == "" || e.route.Method == method {
+			return e.route, params, nil
+		}
+		if !slices.Contains(allowed, e.route.Method) {
+			allowed = append(allowed, e.route.Method)
+		}
+	}
+	return Route{}, nil, allowed
+}
+
+// Routes returns every route, in the order they are matched.
+func (t *Table) Routes() []Route {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	routes := make([]Route, len(t.entries))
+	for i, e := range t.entries {
+		routes[i] = e.route
+	}
+	return routes
+}
@@ -0,0 +1,72 @@
+package gateway
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRoute_Validate(t *testing.T) {
+	assert.NoError(t, Route{Method: "GET", Path: "/users/{id}"}.Validate())
+	assert.NoError(t, Route{Path: "/static/{path...}"}.Validate())
+	assert.NoError(t, Route{Path: "/"}.Validate())
+	for _, route := range []Route{
+		{Method: "get", Path: "/users"},
+		{Path: "users"},
+		{Path: "/users//{id}"},
+		{Path: "/users/id-{id}"},
+		{Path: "/users/{id"},
+		{Path: "/users/{1d}"},
+		{Path: "/{id}/{id}"},
+		{Path: "/{path...}/edit"},
+	} {
+		assert.Error(t, route.Validate(), route.String())
+	}
+	assert.Equal(t, "/users/id/posts", Route{Path: "/users/{id}/posts"}.Sample())
+}
+
+func TestTable(t *testing.T) {
+	table := New()
+	require.NoError(t, table.Set("users", []Route{
+		{Method: "GET", Path: "/users/{id}", Trigger: "get"},
+		{Method: "DELETE", Path: "/users/{id}"},
+		{Method: "GET", Path: "/users/me"},
+	}))
+	require.NoError(t, table.Set("static", []Route{{Path: "/static/{path...}"}}))
+	require.NoError(t, table.Set("fallback", []Route{{Path: "/{section}/{id}"}}))
+
+	route, params, _ := table.Match("GET", "/users/7")
+	assert.Equal(t, "users", route.Function)
+	assert.Equal(t, "get", route.Trigger)
+	assert.Equal(t, map[string]string{"id": "7"}, params)
+
+	route, params, _ = table.Match("GET", "/users/me")
+	assert.Equal(t, "/users/me", route.Path, "literals take precedence")
+	assert.Empty(t, params)
+
+	route, _, _ = table.Match("PUT", "/users/7")
+	assert.Equal(t, "fallback", route.Function, "less specific routes take the other methods")
+
+	route, params, _ = table.Match("GET", "/static/css/site.css")
+	assert.Equal(t, "static", route.Function)
+	assert.Equal(t, map[string]string{"path": "css/site.css"}, params)
+
+	route, _, _ = table.Match("GET", "/users")
+	assert.Empty(t, route.Function)
+	route, _, _ = table.Match("GET", "/users/7/posts")
+	assert.Empty(t, route.Function)
+
+	// Another function can't take a route, the function itself can
+	err := table.Set("other", []Route{{Method: "GET", Path: "/users/{name}"}})
+	assert.ErrorIs(t, err, ErrConflict)
+	assert.ErrorIs(t, table.Check("static", []Route{{Method: "GET", Path: "/a"}, {Path: "/a"}}), ErrConflict)
+	assert.ErrorIs(t, table.Check("static", []Route{{Path: "/users/{id}"}}), ErrConflict, "every method includes GET")
+	assert.NoError(t, table.Check("users", []Route{{Method: "GET", Path: "/users/{name}"}}))
+
+	require.NoError(t, table.Set("fallback", nil))
+	route, _, allowed := table.Match("PUT", "/users/7")
+	assert.Empty(t, route.Function)
+	assert.Equal(t, []string{"GET", "DELETE"}, allowed)
+	assert.Len(t, table.Routes(), 4)
+}
@@ -0,0 +1,216 @@
+// Package history records the invocations of functions, when they ran, how
+// they ended and why they failed, so failed calls can be debugged after the
+// fact.
+package history
+
+import (
+	"database/sql"
+	"fmt"
+	"kappa-v2/service/internal/kappa"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Defaults of a history
+const (
+	// DefaultSize is how many invocations a ring keeps per function
+	DefaultSize = 100
+	// DefaultRetention is how long the database keeps invocations
+	DefaultRetention = 7 * 24 * time.Hour
+)
+
+// Status is how an invocation ended.
+type Status string
+
+const (
+	Succeeded Status = "succeeded"
+	Failed    Status = "failed"
+)
+
+// ParseStatus returns the status named name.
+func ParseStatus(name string) (Status, error) {
+	switch s := Status(name); s {
+	case Succeeded, Failed:
+		return s, nil
+	default:
+		return "", fmt.Errorf("unknown status %q, expected succeeded or failed", name)
+	}
+}
+
+// Invocation is one recorded invocation of a function.
+type Invocation struct {
+	RequestID string    `json:"requestId,omitempty"`
+	Function  string    `json:"function"`
+	Started   time.Time `json:"started"`
+	Ended     time.Time `json:"ended"`
+	// Status is failed when the function returned no response or a 5xx
+	Status     Status `json:"status"`
+	DurationMs int64  `json:"durationMs"`
+	// StatusCode is the function's response status, 0 when it returned
+	// none
+	StatusCode int    `json:"statusCode,omitempty"`
+	Error      string `json:"error,omitempty"`
+	ColdStart  bool   `json:"coldStart,omitempty"`
+}
+
+// FromUsage makes the invocation a function's usage was recorded for.
+func FromUsage(u kappa.Usage) Invocation {
+	inv := Invocation{
+		RequestID:  u.RequestID,
+		Function:   u.Function,
+		Started:    u.Started,
+		Ended:      u.Started.Add(u.Duration),
+		Status:     Succeeded,
+		DurationMs: u.Duration.Milliseconds(),
+		StatusCode: u.StatusCode,
+		ColdStart:  u.ColdStart,
+	}
+	if u.Err != nil {
+		inv.Error = u.Err.Error()
+	}
+	if u.Err != nil || u.StatusCode >= 500 {
+		inv.Status = Failed
+	}
+	return inv
+}
+
+// Filter selects invocations. Zero fields select everything.
+type Filter struct {
+	Status Status
+	// Before pages back through older invocations
+	Before time.Time
+	// Limit is the most invocations returned
+	Limit int
+}
+
+func (f Filter) keep(inv Invocation) bool {
+	return (f.Status == "" || inv.Status == f.Status) && (f.Before.IsZero() || inv.Started.Before(f.Before))
+}
+
+// Store keeps the history of every function.
+type Store interface {
+	// Add records an invocation, it must not block the invocation
+	Add(inv Invocation)
+	// List returns a function's invocations matching filter, newest first
+	List(function string, filter Filter) ([]Invocation, error)
+	// Forget drops a function's history, once it is deleted
+	Forget(function string) error
+	// Close writes what is left to write
+	Close() error
+}
+
+// FromEnv keeps history in db when there is one, for
+// KAPPA_INVOCATION_HISTORY_RETENTION_DAYS, 7 by default. Without, the last
+// KAPPA_INVOCATION_HISTORY_SIZE invocations of each function, 100 by
+// default, are kept in memory.
+func FromEnv(db *sql.DB) (Store, error) {
+	if db != nil {
+		retention := DefaultRetention
+		if v := os.Getenv("KAPPA_INVOCATION_HISTORY_RETENTION_DAYS"); v != "" {
+			days, err := strconv.Atoi(v)
+			if err != nil || days < 1 {
+				return nil, fmt.Errorf("invalid KAPPA_INVOCATION_HISTORY_RETENTION_DAYS %q", v)
+			}
+			retention = time.Duration(days) * 24 * time.Hour
+		}
+		return NewPostgres(db, retention), nil
+	}
+	size := DefaultSize
+	if v := os.Getenv("KAPPA_INVOCATION_HISTORY_SIZE"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			return nil, fmt.Errorf("invalid KAPPA_INVOCATION_HISTORY_SIZE %q", v)
+		}
+		size = n
+	}
+	return NewRing(size), nil
+}
+
+// Recorder returns a recorder adding every invocation to s before passing
+// it on to next.
+func Recorder(s Store, next kappa.UsageRecorder) kappa.UsageRecorder {
+	return recorder{store: s, next: next}
+}
+
+type recorder struct {
+	store Store
+	next  kappa.UsageRecorder
+}
+
+func (r recorder) RecordUsage(u kappa.Usage) {
+	r.store.Add(FromUsage(u))
+	if r.next != nil {
+		r.next.RecordUsage(u)
+	}
+}
+
+// Ring keeps the last invocations of each function in memory.
+type Ring struct {
+	mu        sync.Mutex
+	size      int
+	functions map[string]*ring
+}
+
+// ring is one function's invocations, next being where the following one
+// goes once it is full
+type ring struct {
+	invocations []Invocation
+	next        int
+}
+
+// NewRing creates a store keeping size invocations per function.
+func NewRing(size int) *Ring {
+	return &Ring{size: size, functions: make(map[string]*ring)}
+}
+
+func (r *Ring) Add(inv Invocation) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	fr, ok := r.functions[inv.Function]
+	if !ok {
+		fr = &ring{}
+		r.functions[inv.Function] = fr
+	}
+	if len(fr.invocations) < r.size {
+		fr.invocations = append(fr.invocations, inv)
+		return
+	}
+	fr.invocations[fr.next] = inv
+	fr.next = (fr.next + 1) % r.size
+}
+
+func (r *Ring) List(function string, filter Filter) ([]Invocation, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	invocations := []Invocation{}
+	fr, ok := r.functions[function]
+	if !ok {
+		return invocations, nil
+	}
+	// Newest first, from the one before next back around the ring
+	n := len(fr.invocations)
+	for i := 1; i <= n; i++ {
+		inv := fr.invocations[(fr.next-i+n)%n]
+		if !filter.keep(inv) {
+			continue
+		}
+		invocations = append(invocations, inv)
+		if filter.Limit > 0 && len(invocations) == filter.Limit {
+			break
+		}
+	}
+	return invocations, nil
+}
+
+func (r *Ring) Forget(function string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.functions, function)
+	return nil
+}
+
+func (r *Ring) Close() error {
+	return nil
+}
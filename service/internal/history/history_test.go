@@ -0,0 +1,112 @@
+package history
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"kappa-v2/service/internal/database"
+	"kappa-v2/service/internal/kappa"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFromUsage(t *testing.T) {
+	started := time.Now()
+	inv := FromUsage(kappa.Usage{Function: "orders", RequestID: "req-1", Started: started, Duration: 1500 * time.Millisecond, StatusCode: 200})
+	assert.Equal(t, Succeeded, inv.Status)
+	assert.Equal(t, "req-1", inv.RequestID)
+	assert.Equal(t, int64(1500), inv.DurationMs)
+	assert.Equal(t, started.Add(1500*time.Millisecond), inv.Ended)
+
+	inv = FromUsage(kappa.Usage{Function: "orders", Started: started, StatusCode: 502})
+	assert.Equal(t, Failed, inv.Status, "5xx responses failed")
+	inv = FromUsage(kappa.Usage{Function: "orders", Started: started, Failed: true, Err: errors.New("connection refused")})
+	assert.Equal(t, Failed, inv.Status)
+	assert.Equal(t, "connection refused", inv.Error)
+}
+
+// testStore runs the Store contract against s.
+func testStore(t *testing.T, s Store) {
+	start := time.Now().Add(-time.Hour).UTC().Truncate(time.Millisecond)
+	for i := range 5 {
+		inv := Invocation{
+			RequestID: fmt.Sprintf("req-%d", i),
+			Function:  "orders",
+			Started:   start.Add(time.Duration(i) * time.Minute),
+			Status:    Succeeded,
+		}
+		if i%2 == 1 {
+			inv.Status, inv.Error = Failed, "boom"
+		}
+		inv.Ended, inv.DurationMs = inv.Started.Add(time.Second), 1000
+		s.Add(inv)
+	}
+	s.Add(Invocation{Function: "billing", Started: start, Ended: start, Status: Succeeded})
+	require.NoError(t, s.Close())
+
+	invocations, err := s.List("orders", Filter{})
+	require.NoError(t, err)
+	require.Len(t, invocations, 5)
+	assert.Equal(t, "req-4", invocations[0].RequestID, "newest first")
+	assert.Equal(t, int64(1000), invocations[0].DurationMs)
+
+	invocations, err = s.List("orders", Filter{Status: Failed})
+	require.NoError(t, err)
+	require.Len(t, invocations, 2)
+	assert.Equal(t, "req-3", invocations[0].RequestID)
+	assert.Equal(t, "boom", invocations[0].Error)
+
+	invocations, err = s.List("orders", Filter{Before: invocations[0].Started, Limit: 2})
+	require.NoError(t, err)
+	require.Len(t, invocations, 2)
+	assert.Equal(t, "req-2", invocations[0].RequestID)
+	assert.Equal(t, "req-1", invocations[1].RequestID)
+
+	require.NoError(t, s.Forget("orders"))
+	invocations, err = s.List("orders", Filter{})
+	require.NoError(t, err)
+	assert.Empty(t, invocations)
+	invocations, err = s.List("billing", Filter{})
+	require.NoError(t, err)
+	assert.Len(t, invocations, 1)
+}
+
+func TestRing(t *testing.T) {
+	testStore(t, NewRing(DefaultSize))
+}
+
+func TestRing_KeepsTheLast(t *testing.T) {
+	r := NewRing(3)
+	for i := range 7 {
+		r.Add(Invocation{Function: "orders", RequestID: fmt.Sprintf("req-%d", i)})
+	}
+	invocations, err := r.List("orders", Filter{})
+	require.NoError(t, err)
+	var ids []string
+	for _, inv := range invocations {
+		ids = append(ids, inv.RequestID)
+	}
+	assert.Equal(t, []string{"req-6", "req-5", "req-4"}, ids)
+}
+
+// TestPostgres runs against the Postgres at KAPPA_TEST_DATABASE_URL, whose
+// schema it migrates.
+func TestPostgres(t *testing.T) {
+	url := os.Getenv("KAPPA_TEST_DATABASE_URL")
+	if url == "" {
+		t.Skip("KAPPA_TEST_DATABASE_URL is not set")
+	}
+	db, err := database.Open(url)
+	require.NoError(t, err)
+	defer db.Close()
+	_, err = database.Migrate(context.Background(), db)
+	require.NoError(t, err)
+	_, err = db.Exec("DELETE FROM invocations")
+	require.NoError(t, err)
+
+	testStore(t, NewPostgres(db, DefaultRetention))
+}
@@ -0,0 +1,145 @@
+package history
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"kappa-v2/pkg/logger"
+	"kappa-v2/service/internal/repository/queries"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+const (
+	// queryTimeout bounds each query
+	queryTimeout = 10 * time.Second
+	// queueSize is how many invocations wait to be written before more are
+	// dropped
+	queueSize = 4096
+	// pruneInterval is how often invocations past the retention are deleted
+	pruneInterval = time.Hour
+)
+
+// Postgres keeps invocations in the invocations table of a database whose
+// schema package database migrated. They are written in the background,
+// invocations being dropped from the history when the database falls
+// behind rather than slowed down.
+type Postgres struct {
+	q         *queries.Queries
+	retention time.Duration
+	queue     chan Invocation
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// NewPostgres keeps invocations in db for retention.
+func NewPostgres(db *sql.DB, retention time.Duration) *Postgres {
+	p := &Postgres{
+		q:         queries.New(db),
+		retention: retention,
+		queue:     make(chan Invocation, queueSize),
+		done:      make(chan struct{}),
+	}
+	go p.write()
+	return p
+}
+
+func (p *Postgres) Add(inv Invocation) {
+	select {
+	case p.queue <- inv:
+	default:
+		logger.Get().Warn("Invocation history is behind, dropping invocation", zap.String("function", inv.Function), zap.String("requestId", inv.RequestID))
+	}
+}
+
+// write inserts queued invocations until the queue is closed, pruning on
+// an interval.
+func (p *Postgres) write() {
+	defer close(p.done)
+	ticker := time.NewTicker(pruneInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case inv, ok := <-p.queue:
+			if !ok {
+				return
+			}
+			if err := p.insert(inv); err != nil {
+				logger.Get().Warn("Failed to record invocation", zap.String("function", inv.Function), zap.Error(err))
+			}
+		case now := <-ticker.C:
+			if err := p.prune(now); err != nil {
+				logger.Get().Warn("Failed to prune invocation history", zap.Error(err))
+			}
+		}
+	}
+}
+
+func (p *Postgres) insert(inv Invocation) error {
+	ctx, cancel := context.WithTimeout(context.Background(), queryTimeout)
+	defer cancel()
+	return p.q.InsertInvocation(ctx, queries.InsertInvocationParams{
+		RequestID:  inv.RequestID,
+		Function:   inv.Function,
+		StartedAt:  inv.Started,
+		EndedAt:    inv.Ended,
+		Status:     string(inv.Status),
+		StatusCode: int32(inv.StatusCode),
+		Error:      inv.Error,
+		ColdStart:  inv.ColdStart,
+	})
+}
+
+func (p *Postgres) prune(now time.Time) error {
+	ctx, cancel := context.WithTimeout(context.Background(), queryTimeout)
+	defer cancel()
+	_, err := p.q.DeleteInvocationsBefore(ctx, now.Add(-p.retention))
+	return err
+}
+
+func (p *Postgres) List(function string, filter Filter) ([]Invocation, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), queryTimeout)
+	defer cancel()
+	rows, err := p.q.ListInvocations(ctx, queries.ListInvocationsParams{
+		Function: function,
+		Status:   string(filter.Status),
+		Before:   sql.NullTime{Time: filter.Before, Valid: !filter.Before.IsZero()},
+		MaxRows:  int32(filter.Limit),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list invocations: %w", err)
+	}
+	invocations := make([]Invocation, len(rows))
+	for i, row := range rows {
+		invocations[i] = Invocation{
+			RequestID:  row.RequestID,
+			Function:   row.Function,
+			Started:    row.StartedAt,
+			Ended:      row.EndedAt,
+			Status:     Status(row.Status),
+			DurationMs: row.EndedAt.Sub(row.StartedAt).Milliseconds(),
+			StatusCode: int(row.StatusCode),
+			Error:      row.Error,
+			ColdStart:  row.ColdStart,
+		}
+	}
+	return invocations, nil
+}
+
+func (p *Postgres) Forget(function string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), queryTimeout)
+	defer cancel()
+	if err := p.q.DeleteFunctionInvocations(ctx, function); err != nil {
+		return fmt.Errorf("failed to delete invocations: %w", err)
+	}
+	return nil
+}
+
+// Close writes the invocations queued and stops the writer.
+func (p *Postgres) Close() error {
+	p.closeOnce.Do(func() { close(p.queue) })
+	<-p.done
+	return nil
+}
@@ -0,0 +1,100 @@
+package kappa
+
+import (
+	"context"
+	"os"
+	"time"
+
+	"github.com/opencontainers/runtime-spec/specs-go"
+)
+
+// RunSpec describes how a backend should run a function's binary.
+// Paths in Command and Env refer to locations inside the Mounts.
+type RunSpec struct {
+	Name    string
+	Image   string
+	Command []string
+	Env     []string
+	Mounts  []specs.Mount
+	WorkDir string
+	User    string
+	// MemoryMB limits the instance's memory where the backend supports it
+	MemoryMB int
+	// TmpDirs are removed once the instance has stopped
+	TmpDirs []string
+	OnLog   func(line string)
+	// ResolvConf and Hosts are host files replacing the instance's
+	// /etc/resolv.conf and /etc/hosts, where the backend has its own
+	ResolvConf string
+	Hosts      string
+}
+
+// stopGrace is how long an instance gets to finish its requests and exit
+// once told to stop, before it is killed
+const stopGrace = 10 * time.Second
+
+// The service's connections to a runtime. Idle ones are closed before the
+// runtime closes its end, so an invocation is never sent on a connection
+// that is going away, and enough are kept for concurrent invocations.
+const (
+	runtimeIdleConnTimeout = 90 * time.Second
+	runtimeMaxIdleConns    = 32
+	// runtimeTimeoutSlack is added to the function's timeout for the
+	// runtime's server, so the service times invocations out first
+	runtimeTimeoutSlack = 5 * time.Second
+)
+
+// Backend runs function binaries.
+type Backend interface {
+	Run(spec RunSpec) (Instance, error)
+}
+
+// ImagePuller is implemented by backends running functions in images, so
+// images can be pulled ahead of the first instance needing them.
+type ImagePuller interface {
+	// PullImage pulls and unpacks ref unless it already is, reporting
+	// whether it had to
+	PullImage(ctx context.Context, ref string) (bool, error)
+}
+
+// HealthChecker is implemented by backends depending on a daemon, so the
+// service can tell whether functions can start on them.
+type HealthChecker interface {
+	// CheckHealth runs the backend's checks, returning what each found by
+	// name, or why it failed
+	CheckHealth(ctx context.Context) map[string]Check
+}
+
+// Check is the outcome of a health check.
+type Check struct {
+	// Error is why the check failed, empty when it passed
+	Error string `json:"error,omitempty"`
+	// Details are what the check found, like a version
+	Details map[string]any `json:"details,omitempty"`
+}
+
+// OK reports whether the check passed.
+func (c Check) OK() bool {
+	return c.Error == ""
+}
+
+// Instance is a single running copy of a function.
+type Instance interface {
+	Stop() error
+	// Wait blocks until the instance exits or ctx is done and returns its exit code
+	Wait(ctx context.Context) (int, error)
+}
+
+// backendFromEnv returns the backend selected with KAPPA_BACKEND, or nil when
+// unset or unknown so the platform default is used.
+func backendFromEnv() Backend {
+	name := os.Getenv("KAPPA_BACKEND")
+	if name == "" {
+		return nil
+	}
+	b, err := BackendByName(name)
+	if err != nil {
+		return nil
+	}
+	return b
+}
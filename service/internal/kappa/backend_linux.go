@@ -0,0 +1,221 @@
+//go:build linux
+
+package kappa
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"kappa-v2/service/internal/cont"
+	"time"
+)
+
+// DefaultBackend returns the containerd backend unless KAPPA_BACKEND says otherwise.
+func DefaultBackend() Backend {
+	if b := backendFromEnv(); b != nil {
+		return b
+	}
+	return ContainerdBackend{}
+}
+
+// BackendByName returns the backend called name, an empty name gives the default.
+func BackendByName(name string) (Backend, error) {
+	switch name {
+	case "":
+		return DefaultBackend(), nil
+	case "containerd":
+		return ContainerdBackend{}, nil
+	case "process":
+		return ProcessBackend{}, nil
+	case "vm":
+		return VMBackendFromEnv(), nil
+	default:
+		return nil, fmt.Errorf("unknown backend: %s", name)
+	}
+}
+
+// ContainerdBackend runs functions as containerd containers.
+type ContainerdBackend struct{}
+
+type containerInstance struct {
+	container *cont.Container
+	tmpDirs   []string
+}
+
+// containerNamespace is the containerd namespace functions run in
+const containerNamespace = "kappa"
+
+// maxContainerID is the longest ID containerd accepts
+const maxContainerID = 76
+
+// containerName names the container for an instance after it, so it can be
+// told apart with ctr. Names too long for containerd are cut short and end
+// with a hash of the whole name instead, so they don't collide.
+func containerName(instance string) string {
+	name := "kappa-" + instance
+	if len(name) <= maxContainerID {
+		return name
+	}
+	sum := sha256.Sum256([]byte(name))
+	return name[:maxContainerID-9] + "-" + hex.EncodeToString(sum[:4])
+}
+
+// Run creates and starts a container for the function, named after the
+// instance. A container left behind with the same name is replaced, and one
+// that fails to start is removed again.
+func (ContainerdBackend) Run(spec RunSpec) (Instance, error) {
+	name := containerName(spec.Name)
+	container, err := cont.NewContainer(cont.ContainerConfig{
+		Image:         spec.Image,
+		Name:          name,
+		Command:       spec.Command,
+		Env:           spec.Env,
+		Namespace:     containerNamespace,
+		Mounts:        spec.Mounts,
+		User:          spec.User,
+		MemoryLimitMB: spec.MemoryMB,
+		ResolvConf:    spec.ResolvConf,
+		HostsFile:     spec.Hosts,
+		RemoveOptions: cont.RemoveOptions{
+			RemoveSnapshotIfExists:  true,
+			RemoveContainerIfExists: true,
+		},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to create container: %w", err)
+	}
+
+	for _, dir := range spec.TmpDirs {
+		container.RegisterTmpDir(dir)
+	}
+
+	// Start container
+	if err = container.Start(); err != nil {
+		container.Remove()
+		return nil, fmt.Errorf("failed to start container: %w", err)
+	}
+
+	// Stream logs
+	err = container.StreamLogs(cont.LogOptions{
+		Follow:   true,
+		Stdout:   true,
+		Stderr:   true,
+		Callback: spec.OnLog,
+	})
+	instance := &containerInstance{container: container, tmpDirs: spec.TmpDirs}
+	if err != nil {
+		instance.Stop()
+		return nil, fmt.Errorf("failed to stream logs: %w", err)
+	}
+
+	return instance, nil
+}
+
+// PullImage pulls and unpacks an image into the functions' namespace.
+func (ContainerdBackend) PullImage(ctx context.Context, ref string) (bool, error) {
+	return cont.PullImage(ctx, containerNamespace, ref)
+}
+
+// CheckHealth checks containerd answers on its socket and the functions'
+// images can be listed.
+func (ContainerdBackend) CheckHealth(ctx context.Context) map[string]Check {
+	checks := make(map[string]Check)
+	if version, err := cont.Ping(ctx); err != nil {
+		checks["containerd"] = Check{Error: err.Error()}
+	} else {
+		checks["containerd"] = Check{Details: map[string]any{"version": version}}
+	}
+	if images, err := cont.CountImages(ctx, containerNamespace); err != nil {
+		checks["imageCache"] = Check{Error: err.Error()}
+	} else {
+		checks["imageCache"] = Check{Details: map[string]any{"images": images}}
+	}
+	return checks
+}
+
+// Resources lists the containers and container snapshots in the functions'
+// namespace.
+func (ContainerdBackend) Resources() ([]Resource, error) {
+	containers, err := cont.ListContainers(containerNamespace)
+	if err != nil {
+		return nil, err
+	}
+	snapshots, err := cont.ListSnapshots(containerNamespace)
+	if err != nil {
+		return nil, err
+	}
+
+	resources := make([]Resource, 0, len(containers)+len(snapshots))
+	for _, c := range containers {
+		resources = append(resources, Resource{
+			Kind:      ResourceContainer,
+			ID:        c.ID,
+			Image:     c.Image,
+			Running:   c.Running,
+			Snapshot:  c.SnapshotKey,
+			CreatedAt: c.CreatedAt,
+		})
+	}
+	for _, s := range snapshots {
+		resources = append(resources, Resource{
+			Kind:      ResourceSnapshot,
+			ID:        s.Key,
+			CreatedAt: s.CreatedAt,
+		})
+	}
+	return resources, nil
+}
+
+// RemoveResource deletes a container, killing it if need be, or a snapshot.
+func (ContainerdBackend) RemoveResource(r Resource) error {
+	switch r.Kind {
+	case ResourceContainer:
+		return cont.RemoveContainer(containerNamespace, r.ID)
+	case ResourceSnapshot:
+		return cont.RemoveSnapshot(containerNamespace, r.ID)
+	default:
+		return fmt.Errorf("unknown resource kind: %s", r.Kind)
+	}
+}
+
+// Stop terminates the container, killing it if it hasn't exited within
+// stopGrace, and removes it along with its temp dirs.
+func (ci *containerInstance) Stop() error {
+	stopOpts := cont.StopOptions{
+		Timeout:      stopGrace,
+		RemoveOnStop: true,
+	}
+
+	if err := ci.container.Stop(stopOpts); err != nil {
+		return fmt.Errorf("failed to stop container: %w", err)
+	}
+	return nil
+}
+
+// ID returns the container's ID.
+func (ci *containerInstance) ID() string {
+	return ci.container.ID()
+}
+
+func (ci *containerInstance) ownedTmpDirs() []string {
+	return ci.tmpDirs
+}
+
+func (ci *containerInstance) peakMemoryMB() (int, error) {
+	peak, err := ci.container.PeakMemoryBytes()
+	if err != nil {
+		return 0, err
+	}
+	return int(peak >> 20), nil
+}
+
+// Wait blocks until the container's task exits.
+func (ci *containerInstance) Wait(ctx context.Context) (int, error) {
+	timeout := 24 * time.Hour
+	if deadline, ok := ctx.Deadline(); ok {
+		timeout = time.Until(deadline)
+	}
+	code, err := ci.container.Wait(timeout)
+	return int(code), err
+}
@@ -0,0 +1,27 @@
+//go:build !linux
+
+package kappa
+
+import "fmt"
+
+// DefaultBackend returns the process backend, containerd is only available on Linux.
+func DefaultBackend() Backend {
+	if b := backendFromEnv(); b != nil {
+		return b
+	}
+	return ProcessBackend{}
+}
+
+// BackendByName returns the backend called name, an empty name gives the default.
+func BackendByName(name string) (Backend, error) {
+	switch name {
+	case "":
+		return DefaultBackend(), nil
+	case "process":
+		return ProcessBackend{}, nil
+	case "containerd", "vm":
+		return nil, fmt.Errorf("%s backend is only available on linux", name)
+	default:
+		return nil, fmt.Errorf("unknown backend: %s", name)
+	}
+}
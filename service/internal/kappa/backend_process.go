@@ -0,0 +1,189 @@
+package kappa
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"kappa-v2/pkg/logger"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// ProcessBackend runs functions as plain host processes. It gives no
+// isolation and is meant for local development on hosts without containerd,
+// the function binary has to be built for the host's OS.
+type ProcessBackend struct{}
+
+type processInstance struct {
+	cmd     *exec.Cmd
+	done    chan struct{}
+	tmpDirs []string
+}
+
+// Run starts the function's command, mapping mount destinations in the
+// command and env back onto their host sources.
+func (ProcessBackend) Run(spec RunSpec) (Instance, error) {
+	if len(spec.Command) == 0 {
+		return nil, fmt.Errorf("no command to run")
+	}
+
+	args := make([]string, len(spec.Command))
+	for i, arg := range spec.Command {
+		args[i] = hostPath(spec, arg)
+	}
+
+	env := os.Environ()
+	for _, kv := range spec.Env {
+		key, value, _ := strings.Cut(kv, "=")
+		env = append(env, key+"="+hostPath(spec, value))
+	}
+
+	dir := ""
+	if spec.WorkDir != "" {
+		dir = hostPath(spec, spec.WorkDir)
+	}
+
+	return startProcess(spec, args, env, dir)
+}
+
+// startProcess runs args as a child process, forwarding its output to the
+// spec's log callback. Any temp dirs are removed once it stops.
+func startProcess(spec RunSpec, args, env []string, dir string) (*processInstance, error) {
+	cmd := exec.Command(args[0], args[1:]...)
+	cmd.Env = env
+	cmd.Dir = dir
+
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, fmt.Errorf("failed to open stdout: %w", err)
+	}
+	stderr, err := cmd.StderrPipe()
+	if err != nil {
+		return nil, fmt.Errorf("failed to open stderr: %w", err)
+	}
+
+	if err := cmd.Start(); err != nil {
+		return nil, fmt.Errorf("failed to start process: %w", err)
+	}
+
+	// Output is read to the end before waiting, so no lines are lost when
+	// the process exits
+	var scanners sync.WaitGroup
+	scanners.Add(2)
+	go func() {
+		defer scanners.Done()
+		scanLogs(stdout, "stdout", spec.OnLog)
+	}()
+	go func() {
+		defer scanners.Done()
+		scanLogs(stderr, "stderr", spec.OnLog)
+	}()
+
+	pi := &processInstance{cmd: cmd, done: make(chan struct{}), tmpDirs: spec.TmpDirs}
+	go func() {
+		scanners.Wait()
+		_ = cmd.Wait()
+		close(pi.done)
+	}()
+
+	logger.Get().Info("Process started", zap.String("name", spec.Name), zap.Int("pid", cmd.Process.Pid))
+	return pi, nil
+}
+
+// Stop interrupts the process, killing it if it hasn't exited within stopGrace.
+func (pi *processInstance) Stop() error {
+	signal := os.Interrupt
+	if runtime.GOOS == "windows" {
+		// Windows can't deliver interrupts to other processes
+		signal = os.Kill
+	}
+
+	var errs []error
+	if err := pi.cmd.Process.Signal(signal); err != nil && !errors.Is(err, os.ErrProcessDone) {
+		errs = append(errs, fmt.Errorf("failed to signal process: %w", err))
+	}
+
+	select {
+	case <-pi.done:
+	case <-time.After(stopGrace):
+		if err := pi.cmd.Process.Kill(); err != nil && !errors.Is(err, os.ErrProcessDone) {
+			errs = append(errs, fmt.Errorf("failed to kill process: %w", err))
+		}
+		<-pi.done
+	}
+
+	for _, dir := range pi.tmpDirs {
+		if err := os.RemoveAll(dir); err != nil {
+			errs = append(errs, fmt.Errorf("failed to remove temp dir %s: %w", dir, err))
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+func (pi *processInstance) ownedTmpDirs() []string {
+	return pi.tmpDirs
+}
+
+// peakMemoryMB reads the process's peak resident set size, where /proc
+// exists.
+func (pi *processInstance) peakMemoryMB() (int, error) {
+	status, err := os.ReadFile(fmt.Sprintf("/proc/%d/status", pi.cmd.Process.Pid))
+	if err != nil {
+		return 0, fmt.Errorf("failed to read process status: %w", err)
+	}
+	for _, line := range strings.Split(string(status), "\n") {
+		if v, ok := strings.CutPrefix(line, "VmHWM:"); ok {
+			kb, err := strconv.Atoi(strings.TrimSpace(strings.TrimSuffix(strings.TrimSpace(v), "kB")))
+			if err != nil {
+				return 0, fmt.Errorf("invalid VmHWM %q", v)
+			}
+			return kb >> 10, nil
+		}
+	}
+	return 0, fmt.Errorf("no VmHWM in process status")
+}
+
+// Wait blocks until the process exits.
+func (pi *processInstance) Wait(ctx context.Context) (int, error) {
+	select {
+	case <-pi.done:
+		return pi.cmd.ProcessState.ExitCode(), nil
+	case <-ctx.Done():
+		return 0, ctx.Err()
+	}
+}
+
+// hostPath rewrites a path inside one of the spec's mounts to the host path
+// backing it, anything else is returned unchanged.
+func hostPath(spec RunSpec, path string) string {
+	for _, m := range spec.Mounts {
+		if path == m.Destination {
+			return m.Source
+		}
+		if rest, ok := strings.CutPrefix(path, m.Destination+"/"); ok {
+			return filepath.Join(m.Source, filepath.FromSlash(rest))
+		}
+	}
+	return path
+}
+
+// scanLogs forwards each line of output in the same format as container logs.
+func scanLogs(reader io.Reader, source string, onLog func(string)) {
+	scanner := bufio.NewScanner(reader)
+	for scanner.Scan() {
+		if onLog != nil {
+			onLog(fmt.Sprintf("[%s] %s", source, scanner.Text()))
+		}
+	}
+}
@@ -0,0 +1,177 @@
+//go:build linux
+
+package kappa
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// VMBackend boots every function in its own QEMU virtual machine from the
+// NixOS image built by vm/ (make build-function). The image is generic, the
+// function's mounts are shared into the guest over 9p and a small start
+// script tells the guest how to run it, so no per function image build is
+// needed. The runtime's port is forwarded to the same port on the host.
+type VMBackend struct {
+	// Qemu is the emulator binary, defaults to qemu-system-x86_64
+	Qemu string
+	// ImageDir holds the kernel, initrd and system links from the image build
+	ImageDir string
+	MemoryMB int
+	CPUs     int
+}
+
+// VMBackendFromEnv configures the VM backend from KAPPA_VM_* variables.
+func VMBackendFromEnv() VMBackend {
+	b := VMBackend{
+		Qemu:     os.Getenv("KAPPA_VM_QEMU"),
+		ImageDir: os.Getenv("KAPPA_VM_IMAGE"),
+	}
+	b.MemoryMB, _ = strconv.Atoi(os.Getenv("KAPPA_VM_MEMORY_MB"))
+	b.CPUs, _ = strconv.Atoi(os.Getenv("KAPPA_VM_CPUS"))
+	return b
+}
+
+// vmMetaTag is the 9p tag of the directory holding the start script and mount list
+const vmMetaTag = "kappa"
+
+// Run boots a VM for the function.
+func (b VMBackend) Run(spec RunSpec) (Instance, error) {
+	if b.ImageDir == "" {
+		return nil, fmt.Errorf("no vm image configured, set KAPPA_VM_IMAGE")
+	}
+	if len(spec.Command) == 0 {
+		return nil, fmt.Errorf("no command to run")
+	}
+
+	system, err := filepath.EvalSymlinks(filepath.Join(b.ImageDir, "system"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to resolve vm system: %w", err)
+	}
+
+	metaDir, err := os.MkdirTemp("", fmt.Sprintf("kappa-%s-vm-*", spec.Name))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create vm metadata directory: %w", err)
+	}
+	spec.TmpDirs = append(slices.Clone(spec.TmpDirs), metaDir)
+
+	if err := os.WriteFile(filepath.Join(metaDir, "start.sh"), []byte(vmStartScript(spec)), 0755); err != nil {
+		os.RemoveAll(metaDir)
+		return nil, fmt.Errorf("failed to write start script: %w", err)
+	}
+	if err := os.WriteFile(filepath.Join(metaDir, "mounts"), []byte(vmMountList(spec)), 0644); err != nil {
+		os.RemoveAll(metaDir)
+		return nil, fmt.Errorf("failed to write mount list: %w", err)
+	}
+
+	port := 0
+	for _, kv := range spec.Env {
+		if value, ok := strings.CutPrefix(kv, "PORT="); ok {
+			port, _ = strconv.Atoi(value)
+		}
+	}
+
+	args := b.qemuArgs(spec, filepath.Join(system, "init"), metaDir, port)
+	pi, err := startProcess(spec, args, os.Environ(), "")
+	if err != nil {
+		os.RemoveAll(metaDir)
+		return nil, fmt.Errorf("failed to boot vm: %w", err)
+	}
+	return pi, nil
+}
+
+// qemuArgs builds the emulator command line. The function's output is sent
+// to a virtio console wired to qemu's stdout so it shows up as function logs,
+// while the kernel console goes to a file in the metadata dir.
+func (b VMBackend) qemuArgs(spec RunSpec, initPath, metaDir string, port int) []string {
+	qemu := b.Qemu
+	if qemu == "" {
+		qemu = "qemu-system-x86_64"
+	}
+	memory := b.MemoryMB
+	if spec.MemoryMB > 0 {
+		memory = spec.MemoryMB
+	}
+	if memory == 0 {
+		memory = 512
+	}
+	cpus := b.CPUs
+	if cpus == 0 {
+		cpus = 1
+	}
+
+	args := []string{
+		qemu,
+		"-m", strconv.Itoa(memory),
+		"-smp", strconv.Itoa(cpus),
+		"-nographic", "-no-reboot",
+		"-kernel", filepath.Join(b.ImageDir, "kernel"),
+		"-initrd", filepath.Join(b.ImageDir, "initrd"),
+		"-append", fmt.Sprintf("console=ttyS0 panic=-1 init=%s", initPath),
+		"-serial", "file:" + filepath.Join(metaDir, "console.log"),
+		"-device", "virtio-serial",
+		"-chardev", "stdio,id=out,signal=off",
+		"-device", "virtconsole,chardev=out",
+		"-virtfs", "local,path=/nix/store,security_model=none,mount_tag=nix-store,readonly=on",
+		"-virtfs", fmt.Sprintf("local,path=%s,security_model=none,mount_tag=%s,readonly=on", metaDir, vmMetaTag),
+	}
+	if _, err := os.Stat("/dev/kvm"); err == nil {
+		args = append(args, "-enable-kvm", "-cpu", "host")
+	}
+
+	for i, m := range spec.Mounts {
+		opt := fmt.Sprintf("local,path=%s,security_model=none,mount_tag=m%d", m.Source, i)
+		if slices.Contains(m.Options, "ro") {
+			opt += ",readonly=on"
+		}
+		args = append(args, "-virtfs", opt)
+	}
+
+	netdev := "user,id=net0"
+	if port != 0 {
+		netdev += fmt.Sprintf(",hostfwd=tcp:127.0.0.1:%d-:%d", port, port)
+	}
+	return append(args, "-netdev", netdev, "-device", "virtio-net-pci,netdev=net0")
+}
+
+// vmMountList tells the guest where to mount each shared directory, one
+// "tag destination mode" entry per line.
+func vmMountList(spec RunSpec) string {
+	var sb strings.Builder
+	for i, m := range spec.Mounts {
+		mode := "rw"
+		if slices.Contains(m.Options, "ro") {
+			mode = "ro"
+		}
+		fmt.Fprintf(&sb, "m%d %s %s\n", i, m.Destination, mode)
+	}
+	return sb.String()
+}
+
+// vmStartScript exports the function's env and execs its command in the guest.
+func vmStartScript(spec RunSpec) string {
+	var sb strings.Builder
+	sb.WriteString("#!/bin/sh\nset -e\n")
+	for _, kv := range spec.Env {
+		key, value, _ := strings.Cut(kv, "=")
+		fmt.Fprintf(&sb, "export %s=%s\n", key, shellQuote(value))
+	}
+	if spec.WorkDir != "" {
+		fmt.Fprintf(&sb, "cd %s\n", shellQuote(spec.WorkDir))
+	}
+	quoted := make([]string, len(spec.Command))
+	for i, arg := range spec.Command {
+		quoted[i] = shellQuote(arg)
+	}
+	fmt.Fprintf(&sb, "exec %s\n", strings.Join(quoted, " "))
+	return sb.String()
+}
+
+// shellQuote single quotes s for a POSIX shell.
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
@@ -0,0 +1,235 @@
+package kappa
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"kappa-v2/pkg/logger"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// ErrStartBackoff is returned while a function that keeps failing to start
+// is waiting out its backoff.
+var ErrStartBackoff = errors.New("cold start is backing off")
+
+// Cold start backoff, doubling from startBackoffBase with every consecutive
+// failure up to startBackoffMax
+const (
+	startBackoffBase = time.Second
+	startBackoffMax  = 5 * time.Minute
+)
+
+// startOutputLines is how much of a runtime's output is kept to explain a
+// failed start
+const startOutputLines = 20
+
+// StartError is a failed cold start with the last lines the runtime wrote,
+// so errors like "exec format error" or a missing module's stack trace are
+// visible to the invoker.
+type StartError struct {
+	Err    error
+	Output []string
+}
+
+func (e *StartError) Error() string {
+	if len(e.Output) == 0 {
+		return e.Err.Error()
+	}
+	return fmt.Sprintf("%v, last output:\n%s", e.Err, strings.Join(e.Output, "\n"))
+}
+
+func (e *StartError) Unwrap() error {
+	return e.Err
+}
+
+// outputTail keeps the last startOutputLines lines of an instance's output.
+type outputTail struct {
+	mu    sync.Mutex
+	lines []string
+}
+
+func (t *outputTail) add(line string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.lines = append(t.lines, line)
+	if len(t.lines) > startOutputLines {
+		t.lines = t.lines[len(t.lines)-startOutputLines:]
+	}
+}
+
+func (t *outputTail) Lines() []string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return slices.Clone(t.lines)
+}
+
+// startFailures tracks consecutive failed cold starts, guarded by isRunningMu.
+type startFailures struct {
+	count      int
+	lastErr    string
+	lastOutput []string
+	lastAt     time.Time
+	retryAt    time.Time
+}
+
+// instanceRun is one start of the function's instance, guarded by isRunningMu.
+type instanceRun struct {
+	instance Instance
+	// image is what the instance was launched from
+	image  string
+	output *outputTail
+	// healthy is set once the instance has answered a request, after which
+	// it exiting is no longer a failed start
+	healthy bool
+	// stoppedAt is when Stop was asked to stop the instance
+	stoppedAt time.Time
+	// sidecars were started with the instance and stop with it
+	sidecars []*instanceRun
+}
+
+// StartStatus describes a function's recent cold start failures.
+type StartStatus struct {
+	ConsecutiveFailures int    `json:"consecutiveFailures"`
+	LastError           string `json:"lastError,omitempty"`
+	// LastOutput is the end of what the runtime wrote before failing
+	LastOutput    []string   `json:"lastOutput,omitempty"`
+	LastFailureAt *time.Time `json:"lastFailureAt,omitempty"`
+	// RetryAt is when the next start will be attempted, while backing off
+	RetryAt *time.Time `json:"retryAt,omitempty"`
+	// Generation counts the function's starts, Instance names the running
+	// instance after it
+	Generation int    `json:"generation"`
+	Instance   string `json:"instance,omitempty"`
+}
+
+// StartStatus returns the function's cold start failures, if any.
+func (lf *KappaFunction) StartStatus() StartStatus {
+	lf.isRunningMu.Lock()
+	defer lf.isRunningMu.Unlock()
+
+	status := StartStatus{
+		ConsecutiveFailures: lf.startFailures.count,
+		LastError:           lf.startFailures.lastErr,
+		LastOutput:          slices.Clone(lf.startFailures.lastOutput),
+	}
+	if !lf.startFailures.lastAt.IsZero() {
+		lastAt := lf.startFailures.lastAt
+		status.LastFailureAt = &lastAt
+	}
+	if retryAt := lf.startFailures.retryAt; time.Now().Before(retryAt) {
+		status.RetryAt = &retryAt
+	}
+	status.Generation = lf.generation
+	if lf.isRunning {
+		status.Instance = lf.instanceName()
+	}
+	return status
+}
+
+// checkStartBackoff refuses a start while backing off. The caller must
+// hold isRunningMu.
+func (lf *KappaFunction) checkStartBackoff() error {
+	f := lf.startFailures
+	if f.count == 0 || !time.Now().Before(f.retryAt) {
+		return nil
+	}
+	return &StartError{
+		Err: fmt.Errorf("%w until %s after %d failures, last error: %s",
+			ErrStartBackoff, f.retryAt.Format(time.RFC3339), f.count, f.lastErr),
+		Output: slices.Clone(f.lastOutput),
+	}
+}
+
+// recordStartFailure counts a failed cold start and schedules the next
+// attempt. The caller must hold isRunningMu.
+func (lf *KappaFunction) recordStartFailure(err error) {
+	f := &lf.startFailures
+	f.count++
+	f.lastErr = err.Error()
+	f.lastOutput = nil
+	var startErr *StartError
+	if errors.As(err, &startErr) {
+		f.lastErr = startErr.Err.Error()
+		f.lastOutput = startErr.Output
+	}
+	f.lastAt = time.Now()
+
+	backoff := startBackoffBase << min(f.count-1, 20)
+	f.retryAt = f.lastAt.Add(min(backoff, startBackoffMax))
+
+	logger.Get().Warn("Kappa function failed to start",
+		zap.String("name", lf.Name),
+		zap.Int("consecutiveFailures", f.count),
+		zap.Time("retryAt", f.retryAt),
+		zap.Error(err))
+}
+
+// markHealthy records that the running instance answered a request,
+// clearing any earlier start failures.
+func (lf *KappaFunction) markHealthy() {
+	lf.isRunningMu.Lock()
+	defer lf.isRunningMu.Unlock()
+	if lf.run != nil {
+		lf.run.healthy = true
+	}
+	lf.startFailures = startFailures{}
+}
+
+// watchInstance notices the instance exiting on its own. Exiting before it
+// ever answered a request counts as a failed start, so a runtime that
+// crashes straight away backs off instead of being restarted on every request.
+func (lf *KappaFunction) watchInstance(run *instanceRun) {
+	code, err := run.instance.Wait(context.Background())
+	if err != nil {
+		// Not knowing whether it exited, leave it to the invoke retries
+		return
+	}
+	exitedAt := time.Now()
+
+	lf.isRunningMu.Lock()
+	if !run.stoppedAt.IsZero() && !exitedAt.Before(run.stoppedAt) {
+		// Stopped on purpose
+		lf.isRunningMu.Unlock()
+		return
+	}
+	current := lf.run == run && lf.isRunning
+	if current {
+		lf.isRunning = false
+	}
+	if !run.healthy {
+		lf.recordStartFailure(&StartError{
+			Err:    fmt.Errorf("runtime exited with code %d before becoming healthy", code),
+			Output: run.output.Lines(),
+		})
+	} else {
+		logger.Get().Warn("Kappa function exited", zap.String("name", lf.Name), zap.Int("exitCode", code))
+	}
+	lf.isRunningMu.Unlock()
+
+	if current {
+		lf.cancelIdleTimer()
+		// Clean up whatever the instance left behind
+		_ = run.instance.Stop()
+		stopSidecars(run.sidecars)
+	}
+}
+
+// Kill stops the running instance behind the function's back, as if it had
+// crashed, so fault injection can exercise the invoke retries and restarts.
+func (lf *KappaFunction) Kill() error {
+	lf.isRunningMu.Lock()
+	run := lf.run
+	running := lf.isRunning
+	lf.isRunningMu.Unlock()
+
+	if !running || run == nil {
+		return nil
+	}
+	logger.Get().Warn("Killing kappa function instance", zap.String("name", lf.Name))
+	return run.instance.Stop()
+}
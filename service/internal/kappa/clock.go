@@ -0,0 +1,178 @@
+package kappa
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"time"
+
+	"github.com/opencontainers/runtime-spec/specs-go"
+)
+
+// Where zoneinfo files are found on the host, and the file runtimes read
+// their timezone from when TZ isn't set
+const (
+	zoneinfoDir   = "/usr/share/zoneinfo"
+	localtimePath = "/etc/localtime"
+)
+
+// validLocale matches locale names like C, POSIX, en_US.UTF-8 or de_DE@euro
+var validLocale = regexp.MustCompile(`^(C|POSIX|[a-z]{2,3}(_[A-Z]{2})?)(\.[A-Za-z0-9-]+)?(@[A-Za-z0-9]+)?$`)
+
+// ClockConfig is the timezone and locale a function's instances run with.
+type ClockConfig struct {
+	// Timezone is an IANA name like "Europe/Berlin", set as TZ
+	Timezone string `json:"timezone,omitempty"`
+	// Locale is a name like "en_US.UTF-8", set as LANG and LC_ALL
+	Locale string `json:"locale,omitempty"`
+	// MountLocaltime binds the timezone's zoneinfo file, or the host's
+	// /etc/localtime without one, over the instance's /etc/localtime, for
+	// runtimes and tools that don't read TZ
+	MountLocaltime bool `json:"mountLocaltime,omitempty"`
+}
+
+// ValidateClock checks a clock configuration names a known timezone and a
+// well formed locale.
+func ValidateClock(c ClockConfig) error {
+	if c.Timezone == "" && c.Locale == "" && !c.MountLocaltime {
+		return fmt.Errorf("expected timezone, locale or mountLocaltime")
+	}
+	if c.Timezone != "" {
+		if _, err := time.LoadLocation(c.Timezone); err != nil {
+			return fmt.Errorf("unknown timezone %q", c.Timezone)
+		}
+	}
+	if c.Locale != "" && !validLocale.MatchString(c.Locale) {
+		return fmt.Errorf("invalid locale %q, expected a name like en_US.UTF-8", c.Locale)
+	}
+	if c.MountLocaltime {
+		if _, err := c.localtimeSource(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// SetClock sets the function's timezone and locale from its next start, nil
+// keeps the host's.
+func (lf *KappaFunction) SetClock(config *ClockConfig) {
+	lf.clock = config
+}
+
+// clockEnv is the environment setting the function's timezone and locale.
+func (lf *KappaFunction) clockEnv() []string {
+	if lf.clock == nil {
+		return nil
+	}
+	var env []string
+	if lf.clock.Timezone != "" {
+		env = append(env, "TZ="+lf.clock.Timezone)
+	}
+	if lf.clock.Locale != "" {
+		env = append(env, "LANG="+lf.clock.Locale, "LC_ALL="+lf.clock.Locale)
+	}
+	return env
+}
+
+// localtimeSource is the host file bound over /etc/localtime.
+func (c ClockConfig) localtimeSource() (string, error) {
+	source := localtimePath
+	if c.Timezone != "" {
+		source = filepath.Join(zoneinfoDir, c.Timezone)
+	}
+	// Bind mounts need the file itself, /etc/localtime is usually a link
+	resolved, err := filepath.EvalSymlinks(source)
+	if err != nil {
+		return "", fmt.Errorf("no localtime to mount: %w", err)
+	}
+	if info, err := os.Stat(resolved); err != nil || info.IsDir() {
+		return "", fmt.Errorf("no localtime to mount: %s is not a file", source)
+	}
+	return resolved, nil
+}
+
+// configureClock mounts the function's localtime into the launch when
+// asked to.
+func (lf *KappaFunction) configureClock(launch *Launch) error {
+	if lf.clock == nil || !lf.clock.MountLocaltime {
+		return nil
+	}
+	source, err := lf.clock.localtimeSource()
+	if err != nil {
+		return err
+	}
+	launch.Mounts = append(launch.Mounts, specs.Mount{
+		Type:        "bind",
+		Source:      source,
+		Destination: localtimePath,
+		Options:     []string{"rbind", "ro"},
+	})
+	return nil
+}
+
+// ClockStatus is the running runtime's clock as it reports it.
+type ClockStatus struct {
+	// Time is the runtime's wall clock, with its UTC offset
+	Time     time.Time `json:"time"`
+	Timezone string    `json:"timezone,omitempty"`
+	Locale   string    `json:"locale,omitempty"`
+	// Skew is how far the runtime's clock is ahead of the service's,
+	// behind when negative, give or take half of RoundTrip
+	Skew      time.Duration `json:"-"`
+	RoundTrip time.Duration `json:"-"`
+}
+
+// ErrNotRunning is asking a function's runtime about itself while it has none.
+var ErrNotRunning = errors.New("function is not running")
+
+// Clock asks the function's running runtime for its wall clock, timezone
+// and locale, through the runtime info endpoint of pkg/handler, without
+// starting it.
+func (lf *KappaFunction) Clock(ctx context.Context) (*ClockStatus, error) {
+	lf.isRunningMu.Lock()
+	var baseURL string
+	var client *http.Client
+	switch {
+	case lf.mode == ModeExternal:
+		if a := lf.attachedLocked(); a != nil {
+			baseURL, client = a.url, a.client
+		}
+	case lf.mode == ModeHTTP && lf.isRunning:
+		baseURL, client = lf.containerURL, lf.httpClient()
+	}
+	lf.isRunningMu.Unlock()
+	if baseURL == "" {
+		return nil, ErrNotRunning
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, baseURL+"/runtime/info", nil)
+	if err != nil {
+		return nil, err
+	}
+	sent := time.Now()
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	received := time.Now()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("runtime info answered %d", resp.StatusCode)
+	}
+	var info ClockStatus
+	if err := json.NewDecoder(resp.Body).Decode(&info); err != nil {
+		return nil, fmt.Errorf("invalid runtime info: %w", err)
+	}
+	if info.Time.IsZero() {
+		return nil, fmt.Errorf("the runtime doesn't report its clock")
+	}
+	// The runtime read its clock somewhere between sending and receiving
+	info.RoundTrip = received.Sub(sent)
+	info.Skew = info.Time.Sub(sent.Add(info.RoundTrip / 2))
+	return &info, nil
+}
@@ -0,0 +1,43 @@
+package kappa
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"kappa-v2/pkg/handler"
+	"net/http"
+	"strings"
+)
+
+// SetCompression sets the size from which events and responses are gzipped
+// between the service and the runtime, 0 to never compress them. It takes
+// effect on the next start.
+func (lf *KappaFunction) SetCompression(minBytes int) {
+	lf.compressMinBytes = minBytes
+}
+
+// compressEvent gzips an event big enough to be worth it, once the runtime
+// has said it reads gzipped events. It returns the payload to send and its
+// Content-Encoding. Responses need nothing, the transport asks for them
+// gzipped and decompresses them.
+func (lf *KappaFunction) compressEvent(payload []byte) ([]byte, string, error) {
+	if lf.compressMinBytes <= 0 || len(payload) < lf.compressMinBytes || !lf.gzipEvents.Load() {
+		return payload, "", nil
+	}
+	var buf bytes.Buffer
+	// Favour latency over ratio, the hop is local
+	gz, _ := gzip.NewWriterLevel(&buf, gzip.BestSpeed)
+	if _, err := gz.Write(payload); err != nil {
+		return nil, "", fmt.Errorf("failed to compress event: %w", err)
+	}
+	if err := gz.Close(); err != nil {
+		return nil, "", fmt.Errorf("failed to compress event: %w", err)
+	}
+	return buf.Bytes(), "gzip", nil
+}
+
+// noteEncodings remembers whether the runtime reads gzipped events, as
+// said by each of its responses.
+func (lf *KappaFunction) noteEncodings(resp *http.Response) {
+	lf.gzipEvents.Store(strings.Contains(resp.Header.Get(handler.HeaderAcceptEncoding), "gzip"))
+}
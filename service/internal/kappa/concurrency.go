@@ -0,0 +1,91 @@
+package kappa
+
+import (
+	"context"
+	"errors"
+	"sync"
+)
+
+// ErrConcurrencyLimit is returned when an invocation finds the function
+// running as many invocations as it allows and its queue full.
+var ErrConcurrencyLimit = errors.New("function is at its concurrency limit")
+
+// concurrencyLimit bounds how many invocations of a function run at once,
+// with a bounded queue of those waiting for one to finish.
+type concurrencyLimit struct {
+	slots   chan struct{}
+	queue   int
+	mu      sync.Mutex
+	waiting int
+}
+
+// ConcurrencyStats are how many invocations of a function are running and
+// waiting, against its limits.
+type ConcurrencyStats struct {
+	MaxConcurrency int `json:"maxConcurrency"`
+	InFlight       int `json:"inFlight"`
+	QueueDepth     int `json:"queueDepth"`
+	Queued         int `json:"queued"`
+}
+
+// SetConcurrency bounds how many invocations the function runs at once to
+// max, with up to queue more waiting for one to finish. Invocations past
+// that fail with ErrConcurrencyLimit. A max of 0 removes the limit.
+func (lf *KappaFunction) SetConcurrency(max, queue int) {
+	if max <= 0 {
+		lf.concurrency = nil
+		return
+	}
+	lf.concurrency = &concurrencyLimit{slots: make(chan struct{}, max), queue: queue}
+}
+
+// Concurrency returns the function's running and queued invocations, false
+// when it has no limit.
+func (lf *KappaFunction) Concurrency() (ConcurrencyStats, bool) {
+	c := lf.concurrency
+	if c == nil {
+		return ConcurrencyStats{}, false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return ConcurrencyStats{
+		MaxConcurrency: cap(c.slots),
+		InFlight:       len(c.slots),
+		QueueDepth:     c.queue,
+		Queued:         c.waiting,
+	}, true
+}
+
+// acquire takes a slot, waiting in the queue while none is free until ctx
+// ends. Every successful acquire must be matched by a release.
+func (c *concurrencyLimit) acquire(ctx context.Context) error {
+	select {
+	case c.slots <- struct{}{}:
+		return nil
+	default:
+	}
+
+	c.mu.Lock()
+	if c.waiting >= c.queue {
+		c.mu.Unlock()
+		return ErrConcurrencyLimit
+	}
+	c.waiting++
+	c.mu.Unlock()
+	defer func() {
+		c.mu.Lock()
+		c.waiting--
+		c.mu.Unlock()
+	}()
+
+	select {
+	case c.slots <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (c *concurrencyLimit) release() {
+	<-c.slots
+}
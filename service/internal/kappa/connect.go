@@ -0,0 +1,118 @@
+package kappa
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sync"
+)
+
+// ErrNoRuntime is returned when connecting to a job, which only runs for
+// the length of an invocation, or to an external function, whose runtime
+// only takes events. Jobs and tcp functions have no HTTP runtime to ask for
+// its health either.
+var ErrNoRuntime = errors.New("function has no runtime to connect to")
+
+// ErrNotInvocable is returned when invoking a function that is only
+// connected to, like those in ModeTCP.
+var ErrNotInvocable = errors.New("function takes connections rather than events")
+
+// Protocol is what a proxied connection speaks to the runtime.
+type Protocol int
+
+const (
+	HTTP1 Protocol = iota
+	// HTTP2 is spoken without TLS, unless the function serves it, as
+	// gRPC servers expect
+	HTTP2
+)
+
+// Connect starts the function when it isn't running and returns where its
+// runtime listens and a transport speaking proto to reach it with, for
+// proxying connections that outlive an invocation, like WebSockets and gRPC
+// streams. The function isn't stopped for being idle until every
+// connection's release is called.
+func (lf *KappaFunction) Connect(ctx context.Context, proto Protocol) (*url.URL, http.RoundTripper, func(), error) {
+	if lf.mode == ModeJob || lf.mode == ModeExternal {
+		return nil, nil, nil, ErrNoRuntime
+	}
+	if err := lf.checkDisabled(); err != nil {
+		return nil, nil, nil, err
+	}
+	started := !lf.IsRunning()
+	if err := lf.Start(ctx); err != nil {
+		return nil, nil, nil, fmt.Errorf("failed to start kappa function: %w", err)
+	}
+
+	lf.isRunningMu.Lock()
+	target, err := url.Parse(lf.containerURL)
+	transport := lf.transport
+	if proto == HTTP2 {
+		// Made on first use, most functions are never connected to over it
+		if lf.h2Transport == nil {
+			lf.h2Transport = lf.newH2Transport()
+		}
+		transport = lf.h2Transport
+	}
+	lf.isRunningMu.Unlock()
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("invalid runtime address: %w", err)
+	}
+	if transport == nil {
+		transport = lf.newTransport()
+	}
+	if started {
+		if err := lf.waitListening(ctx, target.Host); err != nil {
+			return nil, nil, nil, err
+		}
+	}
+
+	return target, transport, lf.hold(), nil
+}
+
+// hold keeps the function from being stopped for being idle until the
+// returned release is called, for connections and streamed responses.
+func (lf *KappaFunction) hold() func() {
+	lf.idleTimerMu.Lock()
+	lf.connections++
+	if lf.idleTimer != nil {
+		lf.idleTimer.Stop()
+	}
+	lf.idleTimerMu.Unlock()
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			lf.idleTimerMu.Lock()
+			lf.connections--
+			idle := lf.connections == 0
+			lf.idleTimerMu.Unlock()
+			// The idle timeout starts over once the last connection closes
+			if idle {
+				lf.resetIdleTimer()
+			}
+		})
+	}
+}
+
+// newH2Transport returns a transport speaking only HTTP/2 to the runtime.
+func (lf *KappaFunction) newH2Transport() *http.Transport {
+	transport := lf.newTransport()
+	protocols := new(http.Protocols)
+	if lf.TLS {
+		protocols.SetHTTP2(true)
+	} else {
+		protocols.SetUnencryptedHTTP2(true)
+	}
+	transport.Protocols = protocols
+	return transport
+}
+
+// Connections returns how many connections are open to the function.
+func (lf *KappaFunction) Connections() int {
+	lf.idleTimerMu.Lock()
+	defer lf.idleTimerMu.Unlock()
+	return lf.connections
+}
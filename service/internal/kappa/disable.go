@@ -0,0 +1,86 @@
+package kappa
+
+import (
+	"errors"
+	"slices"
+	"time"
+)
+
+// ErrDisabled is returned when an invocation finds the function disabled by
+// an operator, e.g. while the backend it depends on is migrated.
+var ErrDisabled = errors.New("function is disabled")
+
+// DisabledWindow is a period a function is disabled for. Either end may be
+// left open, a window with neither disables the function until removed.
+type DisabledWindow struct {
+	From  *time.Time `json:"from,omitempty"`
+	Until *time.Time `json:"until,omitempty"`
+	// Message is told to callers turned away during the window
+	Message string `json:"message,omitempty"`
+}
+
+// Contains reports whether t falls in the window.
+func (w DisabledWindow) Contains(t time.Time) bool {
+	if w.From != nil && t.Before(*w.From) {
+		return false
+	}
+	return w.Until == nil || t.Before(*w.Until)
+}
+
+// DisabledError is ErrDisabled with the window the function is disabled in.
+type DisabledError struct {
+	Window DisabledWindow
+}
+
+func (e *DisabledError) Error() string {
+	msg := ErrDisabled.Error()
+	if e.Window.Until != nil {
+		msg += " until " + e.Window.Until.Format(time.RFC3339)
+	}
+	if e.Window.Message != "" {
+		msg += ": " + e.Window.Message
+	}
+	return msg
+}
+
+func (e *DisabledError) Unwrap() error {
+	return ErrDisabled
+}
+
+// SetDisabled replaces the windows the function is disabled in. Invocations
+// during any of them fail with a *DisabledError, while the function stays
+// registered and its logs readable.
+func (lf *KappaFunction) SetDisabled(windows []DisabledWindow) {
+	windows = slices.Clone(windows)
+	lf.disabled.Store(&windows)
+}
+
+// DisabledAt returns the window the function is disabled in at t, false
+// when it is enabled. Of overlapping windows the one ending last is
+// returned, so callers are told when the function is back.
+func (lf *KappaFunction) DisabledAt(t time.Time) (DisabledWindow, bool) {
+	windows := lf.disabled.Load()
+	if windows == nil {
+		return DisabledWindow{}, false
+	}
+	var found DisabledWindow
+	disabled := false
+	for _, w := range *windows {
+		if !w.Contains(t) {
+			continue
+		}
+		if !disabled || found.Until != nil && (w.Until == nil || w.Until.After(*found.Until)) {
+			found = w
+		}
+		disabled = true
+	}
+	return found, disabled
+}
+
+// checkDisabled returns a *DisabledError when the function is disabled now.
+func (lf *KappaFunction) checkDisabled() error {
+	if w, disabled := lf.DisabledAt(time.Now()); disabled {
+		return &DisabledError{Window: w}
+	}
+	return nil
+}
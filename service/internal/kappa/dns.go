@@ -0,0 +1,287 @@
+package kappa
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"maps"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+)
+
+// InternalDomain is the domain functions are named under for each other
+const InternalDomain = "kappa.internal"
+
+// discoveryAddr is where functions reach each other, they share the host's
+// network so every function is on its loopback
+const discoveryAddr = "127.0.0.1"
+
+// Limits of the resolver reading resolv.conf
+const (
+	maxNameservers   = 3
+	maxSearchDomains = 6
+)
+
+var validDomain = regexp.MustCompile(`^([a-zA-Z0-9]([a-zA-Z0-9-]*[a-zA-Z0-9])?\.)*[a-zA-Z0-9]([a-zA-Z0-9-]*[a-zA-Z0-9])?$`)
+
+// DNSConfig is the resolver configuration written to a function's
+// resolv.conf in place of the host's. Nameservers default to the host's.
+type DNSConfig struct {
+	Nameservers []string `json:"nameservers,omitempty"`
+	Search      []string `json:"search,omitempty"`
+	// Options are resolver options like "ndots:2"
+	Options []string `json:"options,omitempty"`
+}
+
+// ValidateDNS checks a resolver configuration could be written to resolv.conf.
+func ValidateDNS(config DNSConfig) error {
+	if len(config.Nameservers) == 0 && len(config.Search) == 0 && len(config.Options) == 0 {
+		return fmt.Errorf("expected nameservers, search or options")
+	}
+	if len(config.Nameservers) > maxNameservers {
+		return fmt.Errorf("at most %d nameservers are used", maxNameservers)
+	}
+	for _, ns := range config.Nameservers {
+		if _, err := netip.ParseAddr(ns); err != nil {
+			return fmt.Errorf("invalid nameserver %q, expected an IP address", ns)
+		}
+	}
+	if len(config.Search) > maxSearchDomains {
+		return fmt.Errorf("at most %d search domains are used", maxSearchDomains)
+	}
+	for _, domain := range config.Search {
+		if !validDomain.MatchString(domain) {
+			return fmt.Errorf("invalid search domain %q", domain)
+		}
+	}
+	for _, option := range config.Options {
+		if option == "" || strings.ContainsAny(option, " \t\n") {
+			return fmt.Errorf("invalid option %q", option)
+		}
+	}
+	return nil
+}
+
+// SetDNS sets the function's resolver configuration from its next start,
+// nil keeps the host's.
+func (lf *KappaFunction) SetDNS(config *DNSConfig) {
+	lf.dns = config
+}
+
+// SetDiscovery has the function's instances resolve other functions through d.
+func (lf *KappaFunction) SetDiscovery(d *Discovery) {
+	lf.discovery = d
+}
+
+// resolvConf renders the configuration, taking nameservers from the host's
+// resolv.conf when it has none.
+func (c DNSConfig) resolvConf(host []byte) []byte {
+	nameservers := c.Nameservers
+	if len(nameservers) == 0 {
+		scanner := bufio.NewScanner(bytes.NewReader(host))
+		for scanner.Scan() {
+			fields := strings.Fields(scanner.Text())
+			if len(fields) >= 2 && fields[0] == "nameserver" {
+				nameservers = append(nameservers, fields[1])
+			}
+		}
+	}
+
+	var sb strings.Builder
+	for _, ns := range nameservers {
+		fmt.Fprintf(&sb, "nameserver %s\n", ns)
+	}
+	if len(c.Search) > 0 {
+		fmt.Fprintf(&sb, "search %s\n", strings.Join(c.Search, " "))
+	}
+	if len(c.Options) > 0 {
+		fmt.Fprintf(&sb, "options %s\n", strings.Join(c.Options, " "))
+	}
+	return []byte(sb.String())
+}
+
+// ValidateExtraHosts checks extra hosts map valid hostnames to IP addresses,
+// leaving InternalDomain to the functions.
+func ValidateExtraHosts(hosts map[string]string) error {
+	for hostname, ip := range hosts {
+		if !validDomain.MatchString(hostname) {
+			return fmt.Errorf("invalid hostname %q", hostname)
+		}
+		if hostname == InternalDomain || strings.HasSuffix(hostname, "."+InternalDomain) {
+			return fmt.Errorf("hostname %s is under %s, which names functions", hostname, InternalDomain)
+		}
+		if _, err := netip.ParseAddr(ip); err != nil {
+			return fmt.Errorf("invalid address %q for %s, expected an IP address", ip, hostname)
+		}
+	}
+	return nil
+}
+
+// SetExtraHosts sets hostnames added to the function's hosts file, mapped to
+// their IP addresses, from its next start.
+func (lf *KappaFunction) SetExtraHosts(hosts map[string]string) {
+	lf.extraHosts = hosts
+}
+
+// configureDNS points the launch at the function's resolv.conf and hosts
+// file. Those not kept by discovery are written to a directory removed with
+// the instance.
+func (lf *KappaFunction) configureDNS(launch *Launch) error {
+	if lf.discovery != nil {
+		path, err := lf.discovery.HostsFile(lf.Name, lf.extraHosts)
+		if err != nil {
+			return err
+		}
+		launch.Hosts = path
+	}
+	ownHosts := lf.discovery == nil && len(lf.extraHosts) > 0
+	if lf.dns == nil && !ownHosts {
+		return nil
+	}
+
+	dir, err := os.MkdirTemp("", fmt.Sprintf("kappa-%s-dns-*", lf.Name))
+	if err != nil {
+		return fmt.Errorf("failed to create dns directory: %w", err)
+	}
+	launch.TmpDirs = append(launch.TmpDirs, dir)
+	if lf.dns != nil {
+		host, _ := os.ReadFile("/etc/resolv.conf")
+		path := filepath.Join(dir, "resolv.conf")
+		if err := os.WriteFile(path, lf.dns.resolvConf(host), 0644); err != nil {
+			return fmt.Errorf("failed to write resolv.conf: %w", err)
+		}
+		launch.ResolvConf = path
+	}
+	if ownHosts {
+		path := filepath.Join(dir, "hosts")
+		if err := os.WriteFile(path, renderHosts(hostEntries(), nil, lf.extraHosts), 0644); err != nil {
+			return fmt.Errorf("failed to write hosts file: %w", err)
+		}
+		launch.Hosts = path
+	}
+	return nil
+}
+
+// InternalName is the name other functions resolve a function by.
+func InternalName(name string) string {
+	return name + "." + InternalDomain
+}
+
+// hostEntries reads the host's /etc/hosts, which hosts files start with
+func hostEntries() []byte {
+	base, _ := os.ReadFile("/etc/hosts")
+	if len(base) > 0 && !bytes.HasSuffix(base, []byte("\n")) {
+		base = append(base, '\n')
+	}
+	return base
+}
+
+// renderHosts writes a hosts file with the host's entries, then the
+// functions' names, then extra hosts sorted by hostname.
+func renderHosts(base []byte, names []string, extra map[string]string) []byte {
+	var sb strings.Builder
+	sb.Write(base)
+	sb.WriteString("# kappa functions\n")
+	for _, name := range names {
+		fmt.Fprintf(&sb, "%s %s\n", discoveryAddr, InternalName(name))
+	}
+	if len(extra) > 0 {
+		sb.WriteString("# extra hosts\n")
+		for _, hostname := range slices.Sorted(maps.Keys(extra)) {
+			fmt.Fprintf(&sb, "%s %s\n", extra[hostname], hostname)
+		}
+	}
+	return []byte(sb.String())
+}
+
+// Discovery keeps a hosts file naming every function under InternalDomain,
+// after the host's own entries. Instances have it in place of /etc/hosts, and
+// it is rewritten in place so running instances see functions come and go.
+// Functions with extra hosts get a file of their own next to it, kept the
+// same way.
+type Discovery struct {
+	path  string
+	base  []byte
+	names []string
+	// extra are the extra hosts of functions having their own file
+	extra map[string]map[string]string
+	mu    sync.Mutex
+}
+
+// NewDiscovery writes a hosts file at path, naming no functions yet.
+func NewDiscovery(path string) (*Discovery, error) {
+	d := &Discovery{path: path, base: hostEntries(), extra: make(map[string]map[string]string)}
+	if err := d.Update(nil); err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+// Path is the shared hosts file's path on the host.
+func (d *Discovery) Path() string {
+	return d.path
+}
+
+// HostsFile returns the path of the hosts file for a function, writing one
+// of its own when it has extra hosts.
+func (d *Discovery) HostsFile(name string, extra map[string]string) (string, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	path := d.ownPath(name)
+	if len(extra) == 0 {
+		if _, exists := d.extra[name]; exists {
+			delete(d.extra, name)
+			os.Remove(path)
+		}
+		return d.path, nil
+	}
+	d.extra[name] = extra
+	if err := d.write(path, extra); err != nil {
+		return "", err
+	}
+	return path, nil
+}
+
+// Update names exactly the given functions, dropping the files of those
+// gone.
+func (d *Discovery) Update(names []string) error {
+	names = slices.Clone(names)
+	slices.Sort(names)
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.names = names
+	if err := d.write(d.path, nil); err != nil {
+		return err
+	}
+	for name, extra := range d.extra {
+		if _, found := slices.BinarySearch(names, name); !found {
+			delete(d.extra, name)
+			os.Remove(d.ownPath(name))
+			continue
+		}
+		if err := d.write(d.ownPath(name), extra); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (d *Discovery) ownPath(name string) string {
+	return fmt.Sprintf("%s-%s", d.path, name)
+}
+
+// write writes a hosts file in place, a renamed file would leave instances
+// the old one. The caller must hold mu.
+func (d *Discovery) write(path string, extra map[string]string) error {
+	if err := os.WriteFile(path, renderHosts(d.base, d.names, extra), 0644); err != nil {
+		return fmt.Errorf("failed to write hosts file: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,115 @@
+package kappa
+
+import (
+	"context"
+	"errors"
+	"kappa-v2/pkg/logger"
+	"sync"
+
+	"go.uber.org/zap"
+)
+
+// ErrDraining is returned for invocations of a function being drained, as
+// the service shuts down.
+var ErrDraining = errors.New("function is draining")
+
+// inflight counts a function's invocations, so it can be drained of them
+// before it is stopped.
+type inflight struct {
+	mu       sync.Mutex
+	active   int
+	draining bool
+	// idle is closed once a draining function has no invocation left
+	idle chan struct{}
+	// restart is set when the running instance is to be replaced once
+	// nothing is in flight
+	restart bool
+}
+
+// begin counts an invocation in, unless the function is draining. When a
+// restart is pending and nothing is in flight, stop is called first, with
+// other invocations held until it returns.
+func (f *inflight) begin(stop func()) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.draining {
+		return ErrDraining
+	}
+	if f.restart && f.active == 0 {
+		f.restart = false
+		stop()
+	}
+	f.active++
+	return nil
+}
+
+// end counts an invocation out.
+func (f *inflight) end() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.active--
+	if f.draining && f.active == 0 {
+		close(f.idle)
+	}
+}
+
+// RestartLazily has the running instance replaced, to pick up changed
+// settings like env, without cutting invocations short: it is stopped as
+// the next invocation arrives with none in flight, and that invocation
+// starts a new one. Functions whose runtime the service doesn't keep
+// running are left alone.
+func (lf *KappaFunction) RestartLazily() {
+	if lf.mode != ModeHTTP || !lf.IsRunning() {
+		return
+	}
+	lf.inflight.mu.Lock()
+	defer lf.inflight.mu.Unlock()
+	lf.inflight.restart = true
+}
+
+// RestartPending reports whether the running instance is waiting to be
+// replaced.
+func (lf *KappaFunction) RestartPending() bool {
+	lf.inflight.mu.Lock()
+	defer lf.inflight.mu.Unlock()
+	return lf.inflight.restart
+}
+
+// stopForRestart stops the instance a restart was asked for.
+func (lf *KappaFunction) stopForRestart() {
+	logger.Get().Info("Restarting kappa function for changed settings", zap.String("name", lf.Name))
+	if err := lf.Stop(); err != nil {
+		logger.Get().Warn("Failed to stop kappa function for restart", zap.String("name", lf.Name), zap.Error(err))
+	}
+}
+
+// InFlight returns how many invocations of the function are running.
+func (lf *KappaFunction) InFlight() int {
+	lf.inflight.mu.Lock()
+	defer lf.inflight.mu.Unlock()
+	return lf.inflight.active
+}
+
+// Drain turns new invocations away with ErrDraining and waits for those
+// in flight to finish, or for ctx to be done, returning its error then.
+// Draining can't be undone, the function is about to be stopped.
+func (lf *KappaFunction) Drain(ctx context.Context) error {
+	f := &lf.inflight
+	f.mu.Lock()
+	if !f.draining {
+		f.draining = true
+		f.idle = make(chan struct{})
+		if f.active == 0 {
+			close(f.idle)
+		}
+	}
+	idle := f.idle
+	f.mu.Unlock()
+
+	select {
+	case <-idle:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
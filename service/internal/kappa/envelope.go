@@ -0,0 +1,120 @@
+package kappa
+
+import (
+	"encoding/json"
+	"fmt"
+	"maps"
+)
+
+// EncodedEvent is an event kept JSON encoded part by part, so an event
+// fanned out to many invocations is encoded once. Each copy re-encodes
+// only what it changes, a new body, request ID or header, and shares the
+// rest of the encoding.
+type EncodedEvent struct {
+	body        []byte
+	path        []byte
+	method      []byte
+	headers     map[string]string
+	headersJSON []byte
+	query       []byte
+	requestID   string
+	pathParams  []byte // Left out of the encoding when empty
+}
+
+// EncodeEvent encodes an event for invoking one or more functions with.
+func EncodeEvent(event KappaEvent) (*EncodedEvent, error) {
+	e := &EncodedEvent{headers: event.Headers, requestID: event.RequestID}
+	var err error
+	if e.body, err = json.Marshal(event.Body); err != nil {
+		return nil, fmt.Errorf("failed to marshal event body: %w", err)
+	}
+	if e.path, err = json.Marshal(event.Path); err != nil {
+		return nil, fmt.Errorf("failed to marshal event: %w", err)
+	}
+	if e.method, err = json.Marshal(event.HTTPMethod); err != nil {
+		return nil, fmt.Errorf("failed to marshal event: %w", err)
+	}
+	if e.headersJSON, err = json.Marshal(event.Headers); err != nil {
+		return nil, fmt.Errorf("failed to marshal event headers: %w", err)
+	}
+	if e.query, err = json.Marshal(event.QueryParams); err != nil {
+		return nil, fmt.Errorf("failed to marshal event: %w", err)
+	}
+	if len(event.PathParams) > 0 {
+		if e.pathParams, err = json.Marshal(event.PathParams); err != nil {
+			return nil, fmt.Errorf("failed to marshal event: %w", err)
+		}
+	}
+	return e, nil
+}
+
+// RequestID is the event's request ID, empty until one is set.
+func (e *EncodedEvent) RequestID() string {
+	return e.requestID
+}
+
+// Header returns the event's header named key.
+func (e *EncodedEvent) Header(key string) string {
+	return e.headers[key]
+}
+
+// WithBody returns a copy of the event with body in place of its own.
+func (e *EncodedEvent) WithBody(body map[string]any) (*EncodedEvent, error) {
+	encoded, err := json.Marshal(body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal event body: %w", err)
+	}
+	c := *e
+	c.body = encoded
+	return &c, nil
+}
+
+// WithRequestID returns a copy of the event with the given request ID.
+func (e *EncodedEvent) WithRequestID(id string) *EncodedEvent {
+	c := *e
+	c.requestID = id
+	return &c
+}
+
+// WithHeader returns a copy of the event with the header set, leaving the
+// event's own headers as they are.
+func (e *EncodedEvent) WithHeader(key, value string) *EncodedEvent {
+	headers := make(map[string]string, len(e.headers)+1)
+	maps.Copy(headers, e.headers)
+	headers[key] = value
+	c := *e
+	c.headers = headers
+	// A map of strings always encodes
+	c.headersJSON, _ = json.Marshal(headers)
+	return &c
+}
+
+// MarshalJSON encodes the event as json.Marshal encodes its KappaEvent.
+func (e *EncodedEvent) MarshalJSON() ([]byte, error) {
+	return e.appendJSON(nil), nil
+}
+
+// appendJSON appends the event's encoding to dst, growing it once
+func (e *EncodedEvent) appendJSON(dst []byte) []byte {
+	requestID, _ := json.Marshal(e.requestID)
+	n := len(e.body) + len(e.path) + len(e.method) + len(e.headersJSON) + len(e.query) + len(requestID) + len(e.pathParams)
+	dst = append(make([]byte, 0, len(dst)+n+80), dst...)
+
+	dst = append(dst, `{"body":`...)
+	dst = append(dst, e.body...)
+	dst = append(dst, `,"path":`...)
+	dst = append(dst, e.path...)
+	dst = append(dst, `,"httpMethod":`...)
+	dst = append(dst, e.method...)
+	dst = append(dst, `,"headers":`...)
+	dst = append(dst, e.headersJSON...)
+	dst = append(dst, `,"queryParams":`...)
+	dst = append(dst, e.query...)
+	dst = append(dst, `,"requestId":`...)
+	dst = append(dst, requestID...)
+	if e.pathParams != nil {
+		dst = append(dst, `,"pathParams":`...)
+		dst = append(dst, e.pathParams...)
+	}
+	return append(dst, '}')
+}
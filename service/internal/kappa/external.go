@@ -0,0 +1,150 @@
+package kappa
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// ErrNotAttached is returned when invoking an external function no runtime
+// is attached to, or whose runtime's lease ran out.
+var ErrNotAttached = errors.New("no runtime attached to the function")
+
+// attachment is an external runtime invocations are sent to until its lease
+// runs out.
+type attachment struct {
+	url       string
+	token     string
+	client    *http.Client
+	expiresAt time.Time
+}
+
+// Attachment describes the runtime attached to an external function.
+type Attachment struct {
+	URL       string    `json:"url"`
+	ExpiresAt time.Time `json:"expiresAt"`
+}
+
+// Attach sends the function's invocations to the runtime at rawURL, with
+// token as a bearer token when set, until lease has passed. Runtimes attach
+// again before then to keep their lease, attaching another runtime replaces
+// the one attached. Only functions in ModeExternal are attached to.
+func (lf *KappaFunction) Attach(rawURL, token string, lease time.Duration) error {
+	if lf.mode != ModeExternal {
+		return fmt.Errorf("function %s isn't external, its runtime is run by the service", lf.Name)
+	}
+	target, err := url.Parse(rawURL)
+	if err != nil || (target.Scheme != "http" && target.Scheme != "https") || target.Host == "" {
+		return fmt.Errorf("invalid runtime url %q, expected http(s)://host:port", rawURL)
+	}
+
+	rawURL = strings.TrimSuffix(rawURL, "/")
+
+	lf.isRunningMu.Lock()
+	defer lf.isRunningMu.Unlock()
+	expiresAt := time.Now().Add(lease)
+	// Renewing a lease keeps the connections to the runtime
+	if a := lf.attached; a != nil && a.url == rawURL && a.token == token {
+		a.expiresAt = expiresAt
+		return nil
+	}
+	if lf.attached != nil {
+		lf.attached.client.CloseIdleConnections()
+	}
+	var transport http.RoundTripper = lf.newTransport()
+	if token != "" {
+		transport = bearerTransport{token: token, next: transport}
+	}
+	lf.attached = &attachment{
+		url:       rawURL,
+		token:     token,
+		client:    &http.Client{Timeout: lf.timeout, Transport: transport},
+		expiresAt: expiresAt,
+	}
+	// A runtime attaching says it is ready
+	lf.startFailures = startFailures{}
+	return nil
+}
+
+// Detach stops sending invocations to the runtime at rawURL, reporting
+// whether it was attached.
+func (lf *KappaFunction) Detach(rawURL string) bool {
+	rawURL = strings.TrimSuffix(rawURL, "/")
+	lf.isRunningMu.Lock()
+	defer lf.isRunningMu.Unlock()
+	if lf.attached == nil || lf.attached.url != rawURL {
+		return false
+	}
+	lf.attached.client.CloseIdleConnections()
+	lf.attached = nil
+	return true
+}
+
+// Attached returns the runtime attached to the function while its lease
+// lasts.
+func (lf *KappaFunction) Attached() (Attachment, bool) {
+	lf.isRunningMu.Lock()
+	defer lf.isRunningMu.Unlock()
+	a := lf.attachedLocked()
+	if a == nil {
+		return Attachment{}, false
+	}
+	return Attachment{URL: a.url, ExpiresAt: a.expiresAt}, true
+}
+
+// KeepAttachment attaches the runtime attached to old, which fn replaces,
+// for the rest of its lease, so redeploying an external function doesn't
+// wait for its runtime to attach again.
+func (lf *KappaFunction) KeepAttachment(old *KappaFunction) {
+	if lf.mode != ModeExternal || old == lf {
+		return
+	}
+	old.isRunningMu.Lock()
+	a := old.attachedLocked()
+	old.isRunningMu.Unlock()
+	if a != nil {
+		lf.Attach(a.url, a.token, time.Until(a.expiresAt))
+	}
+}
+
+// attachedLocked returns the attachment unless its lease ran out. The
+// caller must hold isRunningMu.
+func (lf *KappaFunction) attachedLocked() *attachment {
+	if lf.attached == nil || time.Now().After(lf.attached.expiresAt) {
+		return nil
+	}
+	return lf.attached
+}
+
+// attachedRuntime returns where the attached runtime serves and a client
+// authenticating to it.
+func (lf *KappaFunction) attachedRuntime() (string, *http.Client, error) {
+	lf.isRunningMu.Lock()
+	defer lf.isRunningMu.Unlock()
+	a := lf.attachedLocked()
+	if a == nil {
+		return "", nil, ErrNotAttached
+	}
+	return a.url, a.client, nil
+}
+
+// bearerTransport authenticates requests to an external runtime
+type bearerTransport struct {
+	token string
+	next  http.RoundTripper
+}
+
+func (b bearerTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	req = req.Clone(req.Context())
+	req.Header.Set("Authorization", "Bearer "+b.token)
+	return b.next.RoundTrip(req)
+}
+
+func (b bearerTransport) CloseIdleConnections() {
+	if c, ok := b.next.(interface{ CloseIdleConnections() }); ok {
+		c.CloseIdleConnections()
+	}
+}
@@ -0,0 +1,118 @@
+package kappa
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"time"
+
+	"github.com/opencontainers/runtime-spec/specs-go"
+)
+
+// defaultInitTimeout bounds init steps that don't set a timeout
+const defaultInitTimeout = 5 * time.Minute
+
+// Init steps and the runtime share a writable directory, named by
+// KAPPA_SHARED_DIR, for passing on what the steps prepared
+const (
+	EnvSharedDir   = "KAPPA_SHARED_DIR"
+	sharedMountDir = "/kappa/shared"
+)
+
+// InitStep is a command run to completion in a short-lived instance before
+// the function's runtime starts, like migrating a database or downloading a
+// model. Steps run in order with the runtime's env and mounts, in its image
+// unless they name one.
+type InitStep struct {
+	Name    string   `json:"name"`
+	Command []string `json:"command"`
+	Image   string   `json:"image,omitempty"`
+	// TimeoutMs bounds the step, 5 minutes by default
+	TimeoutMs int `json:"timeoutMs,omitempty"`
+}
+
+var validStepName = regexp.MustCompile(`^[a-z0-9][a-z0-9-]*$`)
+
+// ValidateInitSteps checks steps are named uniquely and have something to run.
+func ValidateInitSteps(steps []InitStep) error {
+	seen := make(map[string]bool)
+	for _, step := range steps {
+		if !validStepName.MatchString(step.Name) {
+			return fmt.Errorf("invalid step name %q, expected lowercase letters, digits and dashes", step.Name)
+		}
+		if seen[step.Name] {
+			return fmt.Errorf("duplicate step %s", step.Name)
+		}
+		seen[step.Name] = true
+		if len(step.Command) == 0 {
+			return fmt.Errorf("step %s has no command", step.Name)
+		}
+		if step.TimeoutMs < 0 {
+			return fmt.Errorf("step %s timeoutMs must not be negative", step.Name)
+		}
+	}
+	return nil
+}
+
+// SetInitSteps sets the steps run before every start of the runtime.
+func (lf *KappaFunction) SetInitSteps(steps []InitStep) {
+	lf.initSteps = steps
+}
+
+// sharedMount mounts dir writable where init steps and the runtime share it
+func sharedMount(dir string) specs.Mount {
+	return specs.Mount{
+		Type:        "bind",
+		Source:      dir,
+		Destination: sharedMountDir,
+		Options:     []string{"rbind", "rw"},
+	}
+}
+
+// runInitSteps runs the function's init steps in order, stopping at the
+// first to fail. Their output is logged with the function's, prefixed with
+// the step, and kept in output to explain a failed start.
+func (lf *KappaFunction) runInitSteps(ctx context.Context, launch *Launch, env []string, mounts []specs.Mount, output *outputTail) error {
+	for _, step := range lf.initSteps {
+		timeout := defaultInitTimeout
+		if step.TimeoutMs > 0 {
+			timeout = time.Duration(step.TimeoutMs) * time.Millisecond
+		}
+		image := launch.Image
+		if step.Image != "" {
+			image = step.Image
+		}
+
+		prefix := fmt.Sprintf("[init %s] ", step.Name)
+		instance, err := lf.backend.Run(RunSpec{
+			Name:     fmt.Sprintf("%s-init-%s", lf.instanceName(), step.Name),
+			Image:    image,
+			Command:  step.Command,
+			Env:      env,
+			Mounts:   mounts,
+			WorkDir:  launch.WorkDir,
+			MemoryMB: lf.memoryMB,
+			OnLog: func(line string) {
+				lf.appendLog(prefix + line)
+				output.add(prefix + line)
+			},
+			ResolvConf: launch.ResolvConf,
+			Hosts:      launch.Hosts,
+		})
+		if err != nil {
+			return &StartError{Err: fmt.Errorf("failed to run init step %s: %w", step.Name, err), Output: output.Lines()}
+		}
+
+		stepCtx, cancel := context.WithTimeout(ctx, timeout)
+		code, err := instance.Wait(stepCtx)
+		cancel()
+		instance.Stop()
+		if err != nil {
+			return &StartError{Err: fmt.Errorf("init step %s did not complete: %w", step.Name, err), Output: output.Lines()}
+		}
+		if code != 0 {
+			return &StartError{Err: fmt.Errorf("init step %s exited with code %d", step.Name, code), Output: output.Lines()}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,103 @@
+package kappa
+
+import (
+	"slices"
+	"time"
+)
+
+// Kinds of resource a backend can report
+const (
+	ResourceContainer = "container"
+	ResourceSnapshot  = "snapshot"
+)
+
+// Resource is something a backend created on the host for an instance.
+type Resource struct {
+	Kind string
+	ID   string
+	// Image is what a container was created from
+	Image   string
+	Running bool
+	// Snapshot is the key of a container's root filesystem snapshot
+	Snapshot  string
+	CreatedAt time.Time
+}
+
+// Inventory is implemented by backends that can list what they created,
+// so resources the service has lost track of can be found and removed.
+type Inventory interface {
+	Resources() ([]Resource, error)
+	RemoveResource(r Resource) error
+}
+
+// identified is implemented by instances the backend has a name for, like
+// containers, to match them against its resources.
+type identified interface {
+	ID() string
+}
+
+// tmpDirOwner is implemented by instances that remove temp dirs when they stop.
+type tmpDirOwner interface {
+	ownedTmpDirs() []string
+}
+
+// Footprint is what a function's live instances hold on the host.
+type Footprint struct {
+	Running   bool
+	Instances []InstanceFootprint
+	TmpDirs   []string
+}
+
+// InstanceFootprint is one live instance, serving requests or running a job.
+type InstanceFootprint struct {
+	// ID is the backend's name for the instance, empty if it has none
+	ID    string
+	Image string
+	Job   bool
+}
+
+// Footprint returns what the function's live instances hold, to compare
+// against what the backend reports.
+func (lf *KappaFunction) Footprint() Footprint {
+	lf.isRunningMu.Lock()
+	defer lf.isRunningMu.Unlock()
+
+	footprint := Footprint{Running: lf.isRunning}
+	add := func(run *instanceRun, job bool) {
+		instance := InstanceFootprint{Image: run.image, Job: job}
+		if id, ok := run.instance.(identified); ok {
+			instance.ID = id.ID()
+		}
+		footprint.Instances = append(footprint.Instances, instance)
+		if owner, ok := run.instance.(tmpDirOwner); ok {
+			footprint.TmpDirs = append(footprint.TmpDirs, owner.ownedTmpDirs()...)
+		}
+	}
+	if lf.isRunning && lf.run != nil {
+		add(lf.run, false)
+		for _, sidecar := range lf.run.sidecars {
+			add(sidecar, false)
+		}
+	}
+	for job := range lf.jobs {
+		add(job, true)
+	}
+	slices.Sort(footprint.TmpDirs)
+	return footprint
+}
+
+// trackJob records a running job's instance until it is untracked.
+func (lf *KappaFunction) trackJob(run *instanceRun) {
+	lf.isRunningMu.Lock()
+	defer lf.isRunningMu.Unlock()
+	if lf.jobs == nil {
+		lf.jobs = make(map[*instanceRun]struct{})
+	}
+	lf.jobs[run] = struct{}{}
+}
+
+func (lf *KappaFunction) untrackJob(run *instanceRun) {
+	lf.isRunningMu.Lock()
+	defer lf.isRunningMu.Unlock()
+	delete(lf.jobs, run)
+}
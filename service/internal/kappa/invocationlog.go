@@ -0,0 +1,44 @@
+package kappa
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// SetInvocationLogs sets whether the function's log stream gets START, END
+// and REPORT lines around every invocation, so invocation boundaries show
+// when tailing it.
+func (lf *KappaFunction) SetInvocationLogs(enabled bool) {
+	lf.invocationLogs = enabled
+}
+
+// logInvocationStart writes an invocation's START line.
+func (lf *KappaFunction) logInvocationStart(requestID string) {
+	line := "START RequestId: " + requestID
+	if lf.version > 0 {
+		line += fmt.Sprintf(" Version: %d", lf.version)
+	}
+	lf.appendLog(line)
+}
+
+// logInvocationEnd writes an invocation's END line and its REPORT, with how
+// long it took and the memory the instance used.
+func (lf *KappaFunction) logInvocationEnd(requestID string, duration time.Duration, peakMemoryMB int, err error) {
+	lf.appendLog("END RequestId: " + requestID)
+
+	report := []string{
+		"REPORT RequestId: " + requestID,
+		fmt.Sprintf("Duration: %.2f ms", float64(duration.Microseconds())/1000),
+	}
+	if lf.memoryMB > 0 {
+		report = append(report, fmt.Sprintf("Memory Size: %d MB", lf.memoryMB))
+	}
+	if peakMemoryMB > 0 {
+		report = append(report, fmt.Sprintf("Max Memory Used: %d MB", peakMemoryMB))
+	}
+	if err != nil {
+		report = append(report, "Status: error")
+	}
+	lf.appendLog(strings.Join(report, "\t"))
+}
@@ -0,0 +1,194 @@
+package kappa
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/opencontainers/runtime-spec/specs-go"
+)
+
+// Mode is how a function is run when invoked.
+type Mode string
+
+const (
+	// ModeHTTP keeps a runtime running and sends it events over HTTP
+	ModeHTTP Mode = "http"
+	// ModeJob runs the function to completion once per event
+	ModeJob Mode = "job"
+	// ModeTCP keeps a runtime serving a protocol of its own, reached by
+	// connecting to it rather than by events
+	ModeTCP Mode = "tcp"
+	// ModeExternal sends events over HTTP to a runtime started outside the
+	// service, by a supervisor of its own, once it has attached itself
+	ModeExternal Mode = "external"
+)
+
+// ParseMode returns the mode for name, an empty name being ModeHTTP.
+func ParseMode(name string) (Mode, error) {
+	switch Mode(name) {
+	case "", ModeHTTP:
+		return ModeHTTP, nil
+	case ModeJob, ModeTCP, ModeExternal:
+		return Mode(name), nil
+	default:
+		return "", fmt.Errorf("unknown mode %q, expected http, job, tcp or external", name)
+	}
+}
+
+// SetMode sets how the function is run when invoked.
+func (lf *KappaFunction) SetMode(mode Mode) {
+	lf.mode = mode
+}
+
+// Mode returns how the function is run when invoked.
+func (lf *KappaFunction) Mode() Mode {
+	return lf.mode
+}
+
+// Paths the event is passed to job functions at
+const (
+	jobEventDir  = "/kappa/event"
+	jobEventFile = "event.json"
+)
+
+// JobResult is the outcome of running a job function to completion.
+type JobResult struct {
+	RequestID string
+	ExitCode  int
+	// Output is everything the job wrote to stdout
+	Output   []byte
+	Duration time.Duration
+}
+
+// Succeeded reports whether the job exited with code 0.
+func (r *JobResult) Succeeded() bool {
+	return r.ExitCode == 0
+}
+
+// RunJob runs the function once as a one-shot instance instead of an HTTP
+// runtime. The event is written to a file named by KAPPA_EVENT_FILE, the
+// exit code says whether the job succeeded and its stdout is the result.
+// Every call gets its own instance, so jobs can run concurrently.
+func (lf *KappaFunction) RunJob(ctx context.Context, event KappaEvent) (*JobResult, error) {
+	encoded, err := EncodeEvent(event)
+	if err != nil {
+		return nil, err
+	}
+	return lf.runJob(ctx, encoded)
+}
+
+func (lf *KappaFunction) runJob(ctx context.Context, event *EncodedEvent) (*JobResult, error) {
+	if event.RequestID() == "" {
+		event = event.WithRequestID(uuid.New().String())
+	}
+	payload := event.appendJSON(nil)
+
+	launch, env, err := lf.prepareLaunch(ctx, lf.Environ())
+	if err != nil {
+		return nil, err
+	}
+	tmpDirs := launch.TmpDirs
+
+	eventDir, err := os.MkdirTemp("", fmt.Sprintf("kappa-%s-event-*", lf.Name))
+	if err != nil {
+		removeAll(tmpDirs)
+		return nil, fmt.Errorf("failed to create event directory: %w", err)
+	}
+	tmpDirs = append(tmpDirs, eventDir)
+	if err := os.WriteFile(filepath.Join(eventDir, jobEventFile), payload, 0644); err != nil {
+		removeAll(tmpDirs)
+		return nil, fmt.Errorf("failed to write event: %w", err)
+	}
+
+	mounts := append(launch.Mounts, specs.Mount{
+		Type:        "bind",
+		Source:      eventDir,
+		Destination: jobEventDir,
+		Options:     []string{"rbind", "ro"},
+	})
+	env = append(env,
+		"KAPPA_EVENT_FILE="+jobEventDir+"/"+jobEventFile,
+		"KAPPA_REQUEST_ID="+event.RequestID(),
+	)
+
+	var outputMu sync.Mutex
+	var output strings.Builder
+	started := time.Now()
+	instance, err := lf.backend.Run(RunSpec{
+		Name:     fmt.Sprintf("%s-job-%s", lf.versionedName(), event.RequestID()[:8]),
+		Image:    launch.Image,
+		Command:  launch.Command,
+		Env:      env,
+		Mounts:   mounts,
+		WorkDir:  launch.WorkDir,
+		TmpDirs:  tmpDirs,
+		MemoryMB: lf.memoryMB,
+		OnLog: func(line string) {
+			lf.appendLog(line)
+			if text, ok := strings.CutPrefix(line, "[stdout] "); ok {
+				outputMu.Lock()
+				output.WriteString(text)
+				output.WriteByte('\n')
+				outputMu.Unlock()
+			}
+		},
+		ResolvConf: launch.ResolvConf,
+		Hosts:      launch.Hosts,
+	})
+	if err != nil {
+		removeAll(tmpDirs)
+		return nil, err
+	}
+	defer instance.Stop()
+	job := &instanceRun{instance: instance, image: launch.Image}
+	lf.trackJob(job)
+	defer lf.untrackJob(job)
+
+	code, err := instance.Wait(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("job did not complete: %w", err)
+	}
+
+	outputMu.Lock()
+	defer outputMu.Unlock()
+	return &JobResult{
+		RequestID: event.RequestID(),
+		ExitCode:  code,
+		Output:    []byte(strings.TrimSuffix(output.String(), "\n")),
+		Duration:  time.Since(started),
+	}, nil
+}
+
+// invokeJob runs a job for Invoke, turning its result into a response. A
+// zero exit code is a 200 and anything else a 500, with the exit code in
+// the X-Kappa-Exit-Code header and stdout as the body.
+func (lf *KappaFunction) invokeJob(ctx context.Context, event *EncodedEvent) (*KappaResponse, error) {
+	result, err := lf.runJob(ctx, event)
+	if err != nil {
+		return nil, fmt.Errorf("failed to run kappa job: %w", err)
+	}
+
+	resp := &KappaResponse{
+		StatusCode: http.StatusOK,
+		Headers: map[string]string{
+			"X-Kappa-Exit-Code": strconv.Itoa(result.ExitCode),
+		},
+		Body:      result.Output,
+		RequestID: result.RequestID,
+		Attempts:  1,
+		// Every job runs in an instance of its own
+		ColdStart: true,
+	}
+	if !result.Succeeded() {
+		resp.StatusCode = http.StatusInternalServerError
+	}
+	return resp, nil
+}
@@ -3,15 +3,19 @@ package kappa
 import (
 	"bytes"
 	"context"
+	"crypto/tls"
 	"encoding/json"
 	"fmt"
 	"io"
+	"kappa-v2/pkg/handler"
 	"kappa-v2/pkg/logger"
-	"kappa-v2/service/internal/cont"
+	"kappa-v2/service/internal/artifact"
 	"net/http"
 	"os"
 	"path/filepath"
+	"slices"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/google/uuid"
@@ -27,46 +31,198 @@ type KappaEvent struct {
 	Headers     map[string]string `json:"headers"`
 	QueryParams map[string]string `json:"queryParams"`
 	RequestID   string            `json:"requestId"`
+	// PathParams are the parameters of the gateway route the event came
+	// in on, like id for GET /users/{id}
+	PathParams map[string]string `json:"pathParams,omitempty"`
 }
 
 // KappaResponse represents the response from the kappa function.
+// Body holds the raw response body exactly as the handler produced it.
 type KappaResponse struct {
 	StatusCode int               `json:"statusCode"`
 	Headers    map[string]string `json:"headers"`
-	Body       map[string]any    `json:"body"`
+	Body       json.RawMessage   `json:"body"`
 	RequestID  string            `json:"requestId"`
+	// Attempts is the number of times the invocation was sent to the
+	// runtime, anything above 1 means the response came from a retry.
+	Attempts int `json:"-"`
+	// Spilled is where the body went when it was too large to return, Body
+	// holding it encoded as JSON
+	Spilled *SpilledBody `json:"-"`
+	// ColdStart is set when the function's instance was started for the
+	// invocation
+	ColdStart bool `json:"-"`
+	// Stream is the body, in place of Body, when the runtime streams it
+	// and the invocation was made WithStreaming
+	Stream io.ReadCloser `json:"-"`
+	// Panic is what the handler panicked with, when the runtime answered
+	// with one
+	Panic *handler.Panic `json:"-"`
 }
 
-// KappaFunction represents a containerized kappa function.
+// KappaFunction represents a kappa function, run in a container or as a
+// plain process depending on its backend.
 type KappaFunction struct {
 	Name              string
 	BinaryPath        string
 	Image             string
-	Env               []string
+	Env               []string // Changed with SetEnv once the function is in use, guarded by isRunningMu
 	Port              int
-	container         *cont.Container
+	Host              string // Address the runtime is reachable at, defaults to localhost
+	TLS               bool   // Serve the runtime over HTTPS with a per start self-signed cert
+	ArtifactDigest    string // sha256 of the binary, checked before every start when set
+	Signature         []byte // Detached signature over ArtifactDigest
+	verifier          *artifact.Verifier
+	preparer          Preparer
+	envResolver       EnvResolver
+	mounter           BinaryMounter
+	tlsConfig         *tls.Config
+	transport         *http.Transport
+	h2Transport       *http.Transport
+	backend           Backend
+	instance          Instance
 	containerURL      string
 	runtimeAPIPort    int
 	logs              []string
 	logsMu            sync.Mutex
+	logFollowers      map[chan string]struct{}
 	isRunning         bool
 	isRunningMu       sync.Mutex
-	requestsProcessed int
+	requestsProcessed atomic.Int64
+	lastInvoked       atomic.Int64 // Unix nanoseconds, 0 before the first invocation
 	idleTimeout       time.Duration
+	timeout           time.Duration
+	memoryMB          int
+	logRetention      int
 	idleTimer         *time.Timer
 	idleTimerMu       sync.Mutex
+	connections       int // Open to the runtime, pausing the idle timer
+	retryPolicy       RetryPolicy
+	mode              Mode
+	initSteps         []InitStep
+	sidecars          []Sidecar
+	dns               *DNSConfig
+	discovery         *Discovery
+	extraHosts        map[string]string
+	version           int
+	generation        int        // Starts so far, naming instances
+	restartMu         sync.Mutex // Held restarting a runtime an invocation found dead
+	startFailures     startFailures
+	run               *instanceRun
+	jobs              map[*instanceRun]struct{}
+	attached          *attachment // The runtime of an external function
+	usage             UsageRecorder
+	spiller           Spiller
+	spillThreshold    int64
+	compressMinBytes  int
+	gzipEvents        atomic.Bool // The runtime said it reads gzipped events
+	concurrency       *concurrencyLimit
+	invocationLogs    bool // START, END and REPORT lines around invocations
+	disabled          atomic.Pointer[[]DisabledWindow]
+	logLevel          atomic.Pointer[string] // Set in the runtime's env and on its control endpoint
+	clock             *ClockConfig
+	timeoutGrace      time.Duration // How long a timed out runtime gets to report a partial result
+	warm              atomic.Bool   // Kept started rather than stopped when idle
+	inflight          inflight      // Invocations running, drained before shutting down
 }
 
 // NewKappaFunction creates a new kappa function instance.
 func NewKappaFunction(name, binaryPath, image string, env []string, port int) *KappaFunction {
 	return &KappaFunction{
-		Name:        name,
-		BinaryPath:  binaryPath,
-		Image:       image,
-		Env:         env,
-		Port:        port,
-		isRunning:   false,
-		idleTimeout: 5 * time.Minute, // Default idle timeout: 5 minutes
+		Name:         name,
+		BinaryPath:   binaryPath,
+		Image:        image,
+		Env:          env,
+		Port:         port,
+		isRunning:    false,
+		backend:      DefaultBackend(),
+		idleTimeout:  5 * time.Minute, // Default idle timeout: 5 minutes
+		timeout:      30 * time.Second,
+		logRetention: 1000,
+		retryPolicy:  DefaultRetryPolicy(),
+		mode:         ModeHTTP,
+
+		compressMinBytes: handler.DefaultServerConfig().CompressMinBytes,
+	}
+}
+
+// SetEnv replaces the function's env, taking effect on the next start.
+func (lf *KappaFunction) SetEnv(env []string) {
+	lf.isRunningMu.Lock()
+	defer lf.isRunningMu.Unlock()
+	lf.Env = slices.Clone(env)
+}
+
+// Environ returns a copy of the function's env.
+func (lf *KappaFunction) Environ() []string {
+	lf.isRunningMu.Lock()
+	defer lf.isRunningMu.Unlock()
+	return slices.Clone(lf.Env)
+}
+
+// SetRetryPolicy sets which failed invocations are automatically retried.
+func (lf *KappaFunction) SetRetryPolicy(policy RetryPolicy) {
+	lf.retryPolicy = policy
+}
+
+// SetBackend sets what runs the function's binary, taking effect on the next start.
+func (lf *KappaFunction) SetBackend(backend Backend) {
+	lf.backend = backend
+}
+
+// SetVerifier requires the function's binary to be signed by the verifier's
+// key before it is started.
+func (lf *KappaFunction) SetVerifier(verifier *artifact.Verifier) {
+	lf.verifier = verifier
+}
+
+// EnvResolver expands references in a function's env, like secrets, when it
+// starts rather than when it is registered.
+type EnvResolver interface {
+	ResolveEnv(ctx context.Context, env []string) ([]string, error)
+}
+
+// SetEnvResolver resolves the function's env through r on every start.
+func (lf *KappaFunction) SetEnvResolver(r EnvResolver) {
+	lf.envResolver = r
+}
+
+// BinaryMounter keeps a directory per artifact holding its binary as main,
+// which instances of functions sharing the binary mount rather than each
+// copying it.
+type BinaryMounter interface {
+	MountDir(ctx context.Context, digest string) (string, error)
+}
+
+// SetBinaryMounter mounts the function's binary from m when it has an
+// artifact digest.
+func (lf *KappaFunction) SetBinaryMounter(m BinaryMounter) {
+	lf.mounter = m
+}
+
+// SetTimeout sets how long a single attempt to invoke the function may take.
+func (lf *KappaFunction) SetTimeout(timeout time.Duration) {
+	lf.timeout = timeout
+}
+
+// Timeout returns how long a single attempt to invoke the function may take.
+func (lf *KappaFunction) Timeout() time.Duration {
+	return lf.timeout
+}
+
+// SetMemoryLimit caps the function's memory in MB, taking effect on the next start.
+func (lf *KappaFunction) SetMemoryLimit(mb int) {
+	lf.memoryMB = mb
+}
+
+// SetLogRetention sets how many log lines are kept for the function.
+func (lf *KappaFunction) SetLogRetention(lines int) {
+	lf.logsMu.Lock()
+	defer lf.logsMu.Unlock()
+
+	lf.logRetention = lines
+	if len(lf.logs) > lines {
+		lf.logs = lf.logs[len(lf.logs)-lines:]
 	}
 }
 
@@ -81,7 +237,7 @@ func (lf *KappaFunction) SetIdleTimeout(duration time.Duration) {
 	}
 }
 
-// Start starts the kappa function container.
+// Start starts the kappa function.
 func (lf *KappaFunction) Start(ctx context.Context) error {
 	lf.isRunningMu.Lock()
 	defer lf.isRunningMu.Unlock()
@@ -89,96 +245,120 @@ func (lf *KappaFunction) Start(ctx context.Context) error {
 	if lf.isRunning {
 		return nil // Already running
 	}
+	if err := lf.checkStartBackoff(); err != nil {
+		return err
+	}
 
-	l := logger.Get()
+	if err := lf.start(ctx); err != nil {
+		// Giving up on the start isn't the function's fault
+		if ctx.Err() == nil {
+			lf.recordStartFailure(err)
+		}
+		return err
+	}
+	return nil
+}
+
+// start launches the function's instance. The caller must hold isRunningMu.
+func (lf *KappaFunction) start(ctx context.Context) error {
+	l := logger.FromCtx(ctx)
 	l.Info("Starting kappa function",
 		zap.String("name", lf.Name),
 		zap.String("binary", lf.BinaryPath))
-	// Create temp directory for the binary
-	tmpPath, err := os.MkdirTemp("", fmt.Sprintf("kappa-%s-*", lf.Name))
+	launch, env, err := lf.prepareLaunch(ctx, lf.Env)
 	if err != nil {
-		return fmt.Errorf("failed to create temp directory: %w", err)
+		return err
 	}
-
-	// Copy the binary to the temp directory
-	destBinary := filepath.Join(tmpPath, "main")
-	if err := os.Link(lf.BinaryPath, destBinary); err != nil {
-		if err := copyFile(lf.BinaryPath, destBinary); err != nil {
-			return fmt.Errorf("failed to copy binary: %w", err)
+	lf.generation++
+	// Until the new runtime says otherwise, it reads plain events only
+	lf.gzipEvents.Store(false)
+
+	mounts := launch.Mounts
+	tmpDirs := launch.TmpDirs
+
+	scheme := "http"
+	if lf.TLS {
+		tlsDir, err := os.MkdirTemp("", fmt.Sprintf("kappa-%s-tls-*", lf.Name))
+		if err != nil {
+			return fmt.Errorf("failed to create tls directory: %w", err)
+		}
+		tmpDirs = append(tmpDirs, tlsDir)
+		if lf.tlsConfig, err = lf.setupTLS(tlsDir); err != nil {
+			removeAll(tmpDirs)
+			return fmt.Errorf("failed to set up tls: %w", err)
 		}
+		mounts = append(mounts, specs.Mount{
+			Type:        "bind",
+			Source:      tlsDir,
+			Destination: tlsMountPath,
+			Options:     []string{"rbind", "ro"},
+		})
+		env = append(env,
+			fmt.Sprintf("%s=%s/%s", handler.EnvTLSCertFile, tlsMountPath, tlsCertFile),
+			fmt.Sprintf("%s=%s/%s", handler.EnvTLSKeyFile, tlsMountPath, tlsKeyFile),
+		)
+		scheme = "https"
 	}
 
-	// Make binary executable
-	if err := os.Chmod(destBinary, 0755); err != nil {
-		return fmt.Errorf("failed to make binary executable: %w", err)
-	}
+	// Keep the end of the output to explain a start that fails
+	output := &outputTail{}
 
-	// Base environment variables
-	env := append([]string{
-		fmt.Sprintf("PORT=%d", lf.Port),
-		"LAMBDA_TASK_ROOT=/app",
-		fmt.Sprintf("LAMBDA_FUNCTION_NAME=%s", lf.Name),
-		"KAPPA_RUNTIME_API=localhost:8080", // This will be used by Kappa SDK
-	}, lf.Env...)
-
-	// Create container
-	name := fmt.Sprintf("kappa-%s-%s", lf.Name, uuid.New().String())
-	if len(name) > 76{
-		name = name[0:75]
-	}
-	container, err := cont.NewContainer(cont.ContainerConfig{
-		Image:     lf.Image,
-		Name:      name,
-		Command:   []string{"/app/main"},
-		Env:       env,
-		Namespace: "kappa",
-		Mounts: []specs.Mount{
-			{
-				Type:        "bind",
-				Source:      tmpPath,
-				Destination: "/app",
-				Options:     []string{"rbind", "ro"}, // rw = read write, only ro for now
-			},
-		},
-		RemoveOptions: cont.RemoveOptions{
-			RemoveSnapshotIfExists:  true,
-			RemoveContainerIfExists: true,
-		},
-	})
-	if err != nil {
-		return fmt.Errorf("failed to create container: %w", err)
+	if len(lf.initSteps) > 0 || len(lf.sidecars) > 0 {
+		shared, err := os.MkdirTemp("", fmt.Sprintf("kappa-%s-shared-*", lf.Name))
+		if err != nil {
+			removeAll(tmpDirs)
+			return fmt.Errorf("failed to create shared directory: %w", err)
+		}
+		tmpDirs = append(tmpDirs, shared)
+		mounts = append(mounts, sharedMount(shared))
+		env = append(env, fmt.Sprintf("%s=%s", EnvSharedDir, sharedMountDir))
+		if err := lf.runInitSteps(ctx, launch, env, mounts, output); err != nil {
+			removeAll(tmpDirs)
+			return err
+		}
 	}
-
-	container.RegisterTmpDir(tmpPath)
-
-	// Start container
-	if err = container.Start(); err != nil {
-		return fmt.Errorf("failed to start container: %w", err)
+	sidecars, err := lf.startSidecars(launch, env, mounts, output)
+	if err != nil {
+		removeAll(tmpDirs)
+		return err
 	}
 
-	// Stream logs
-	err = container.StreamLogs(cont.LogOptions{
-		Follow: true,
-		Stdout: true,
-		Stderr: true,
-		Callback: func(line string) {
-			lf.logsMu.Lock()
-			lf.logs = append(lf.logs, line)
-			if len(lf.logs) > 1000 {
-				// Keep log buffer manageable
-				lf.logs = lf.logs[len(lf.logs)-1000:]
-			}
-			lf.logsMu.Unlock()
-			l.Info("Kappa log", zap.String("function", lf.Name), zap.String("log", line))
+	instance, err := lf.backend.Run(RunSpec{
+		Name:     lf.instanceName(),
+		Image:    launch.Image,
+		Command:  launch.Command,
+		Env:      env,
+		Mounts:   mounts,
+		WorkDir:  launch.WorkDir,
+		TmpDirs:  tmpDirs,
+		MemoryMB: lf.memoryMB,
+		OnLog: func(line string) {
+			lf.appendLog(line)
+			output.add(line)
 		},
+		ResolvConf: launch.ResolvConf,
+		Hosts:      launch.Hosts,
 	})
 	if err != nil {
-		return fmt.Errorf("failed to stream logs: %w", err)
+		stopSidecars(sidecars)
+		removeAll(tmpDirs)
+		return &StartError{Err: err, Output: output.Lines()}
 	}
 
-	lf.container = container
-	lf.containerURL = fmt.Sprintf("http://localhost:%d", lf.Port)
+	// Invocations reuse connections to the instance until it is replaced
+	if lf.transport != nil {
+		lf.transport.CloseIdleConnections()
+	}
+	lf.transport = lf.newTransport()
+	if lf.h2Transport != nil {
+		lf.h2Transport.CloseIdleConnections()
+	}
+	lf.h2Transport = nil
+	lf.instance = instance
+	lf.containerURL = fmt.Sprintf("%s://%s:%d", scheme, lf.host(), lf.Port)
 	lf.isRunning = true
+	lf.run = &instanceRun{instance: instance, image: launch.Image, output: output, sidecars: sidecars}
+	go lf.watchInstance(lf.run)
 
 	// Start idle timer
 	lf.resetIdleTimer()
@@ -190,26 +370,162 @@ func (lf *KappaFunction) Start(ctx context.Context) error {
 	return nil
 }
 
-// Stop stops the kappa function container.
+// prepareLaunch verifies the function's binary, resolves functionEnv, the
+// function's env, and works out how to launch it, returning the launch and
+// the full env to run it with.
+func (lf *KappaFunction) prepareLaunch(ctx context.Context, functionEnv []string) (*Launch, []string, error) {
+	// Make sure the binary hasn't been tampered with since it was registered
+	if lf.ArtifactDigest != "" {
+		if err := artifact.VerifyFile(lf.BinaryPath, lf.ArtifactDigest); err != nil {
+			return nil, nil, err
+		}
+	}
+	if lf.verifier != nil {
+		if lf.ArtifactDigest == "" {
+			return nil, nil, fmt.Errorf("function %s has no artifact digest to verify its signature against", lf.Name)
+		}
+		if err := lf.verifier.Verify(lf.ArtifactDigest, lf.Signature); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	// Resolve references in the function's env, so secrets are read fresh
+	// on every start and never stored with the function
+	if lf.envResolver != nil {
+		resolved, err := lf.envResolver.ResolveEnv(ctx, functionEnv)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to resolve environment: %w", err)
+		}
+		functionEnv = resolved
+	}
+
+	var launch *Launch
+	if lf.preparer != nil {
+		prepared, err := lf.preparer.Prepare(ctx, lf.backend, lf.Name)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to prepare runtime: %w", err)
+		}
+		launch = prepared
+	} else {
+		binary, err := lf.binaryLaunch(ctx)
+		if err != nil {
+			return nil, nil, err
+		}
+		launch = binary
+	}
+	if err := lf.configureDNS(launch); err != nil {
+		removeAll(launch.TmpDirs)
+		return nil, nil, err
+	}
+	if err := lf.configureClock(launch); err != nil {
+		removeAll(launch.TmpDirs)
+		return nil, nil, err
+	}
+
+	// Base environment variables
+	env := append([]string{
+		fmt.Sprintf("PORT=%d", lf.Port),
+		"LAMBDA_TASK_ROOT=/app",
+		fmt.Sprintf("LAMBDA_FUNCTION_NAME=%s", lf.Name),
+		"KAPPA_RUNTIME_API=localhost:8080", // This will be used by Kappa SDK
+	}, lf.serverConfig().Env()...)
+	env = append(env, launch.Env...)
+	env = append(env, functionEnv...)
+	env = append(env, lf.clockEnv()...)
+	env = append(env, lf.logLevelEnv()...)
+
+	return launch, env, nil
+}
+
+// appendLog records a line of the function's output.
+func (lf *KappaFunction) appendLog(line string) {
+	lf.logsMu.Lock()
+	lf.logs = append(lf.logs, line)
+	if len(lf.logs) > lf.logRetention {
+		// Keep log buffer manageable
+		lf.logs = lf.logs[len(lf.logs)-lf.logRetention:]
+	}
+	lf.sendToFollowers(line)
+	lf.logsMu.Unlock()
+	logger.Get().Info("Kappa log", zap.String("function", lf.Name), zap.String("log", line))
+}
+
+// binaryLaunch mounts the function's binary read only at /app and runs it in
+// the function's image. The binary is shared from the mounter when it can be,
+// and copied into a fresh directory otherwise.
+func (lf *KappaFunction) binaryLaunch(ctx context.Context) (*Launch, error) {
+	if lf.mounter != nil && lf.ArtifactDigest != "" {
+		dir, err := lf.mounter.MountDir(ctx, lf.ArtifactDigest)
+		if err == nil {
+			return lf.appLaunch(dir, nil), nil
+		}
+		if ctx.Err() != nil {
+			return nil, fmt.Errorf("failed to mount binary: %w", err)
+		}
+		logger.FromCtx(ctx).Warn("Failed to mount binary, copying it", zap.String("name", lf.Name), zap.Error(err))
+	}
+
+	// Create temp directory for the binary
+	tmpPath, err := os.MkdirTemp("", fmt.Sprintf("kappa-%s-*", lf.Name))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create temp directory: %w", err)
+	}
+
+	// Copy the binary to the temp directory
+	destBinary := filepath.Join(tmpPath, "main")
+	if err := os.Link(lf.BinaryPath, destBinary); err != nil {
+		if err := copyFile(lf.BinaryPath, destBinary); err != nil {
+			os.RemoveAll(tmpPath)
+			return nil, fmt.Errorf("failed to copy binary: %w", err)
+		}
+	}
+
+	// Make binary executable
+	if err := os.Chmod(destBinary, 0755); err != nil {
+		os.RemoveAll(tmpPath)
+		return nil, fmt.Errorf("failed to make binary executable: %w", err)
+	}
+
+	return lf.appLaunch(tmpPath, []string{tmpPath}), nil
+}
+
+// appLaunch runs main from dir, mounted at /app
+func (lf *KappaFunction) appLaunch(dir string, tmpDirs []string) *Launch {
+	return &Launch{
+		Image:   lf.Image,
+		Command: []string{"/app/main"},
+		Mounts: []specs.Mount{
+			{
+				Type:        "bind",
+				Source:      dir,
+				Destination: "/app",
+				Options:     []string{"rbind", "ro"}, // rw = read write, only ro for now
+			},
+		},
+		WorkDir: "/app",
+		TmpDirs: tmpDirs,
+	}
+}
+
+// Stop stops the kappa function.
 func (lf *KappaFunction) Stop() error {
 	lf.isRunningMu.Lock()
 	defer lf.isRunningMu.Unlock()
 
-	if !lf.isRunning || lf.container == nil {
+	if !lf.isRunning || lf.instance == nil {
 		return nil // Already stopped
 	}
 
-	stopOpts := cont.StopOptions{
-		Timeout:      10 * time.Second,
-		ForceKill:    true,
-		RemoveOnStop: true,
-	}
-
 	lf.cancelIdleTimer()
 
-	err := lf.container.Stop(stopOpts)
-	if err != nil {
-		return fmt.Errorf("failed to stop container: %w", err)
+	if lf.run != nil {
+		lf.run.stoppedAt = time.Now()
+	}
+	if err := lf.instance.Stop(); err != nil {
+		return err
+	}
+	if lf.run != nil {
+		stopSidecars(lf.run.sidecars)
 	}
 
 	lf.isRunning = false
@@ -227,6 +543,14 @@ func (lf *KappaFunction) resetIdleTimer() {
 	}
 
 	lf.idleTimer = time.AfterFunc(lf.idleTimeout, func() {
+		// Connections keep it busy, the timer starts over when they close
+		lf.idleTimerMu.Lock()
+		connected := lf.connections > 0
+		lf.idleTimerMu.Unlock()
+		if connected || lf.warm.Load() {
+			return
+		}
+
 		// Only stop if it's still running when the timer fires
 		lf.isRunningMu.Lock()
 		isRunning := lf.isRunning
@@ -250,94 +574,358 @@ func (lf *KappaFunction) cancelIdleTimer() {
 	}
 }
 
+// Usage is what one invocation used, for metering.
+type Usage struct {
+	Function string
+	Started  time.Time
+	Duration time.Duration
+	// MemoryMB is the function's memory limit, 0 when left to the backend
+	MemoryMB int
+	// EgressBytes is the size of the response body
+	EgressBytes int
+	// PeakMemoryMB is the most memory the instance has used since it
+	// started, 0 when the backend can't tell
+	PeakMemoryMB int
+	// Failed is set when the invocation returned no response
+	Failed bool
+	// Err is why the invocation failed, nil when it didn't
+	Err error
+	// StatusCode is the function's response status, 0 when it failed
+	StatusCode int
+	// ColdStart is set when the function's instance was started for the
+	// invocation
+	ColdStart bool
+	// RequestID is the ID of the request the invocation was made for
+	RequestID string
+	// Version is the function's version, 0 when it isn't versioned
+	Version int
+	// Panic is what the handler panicked with, nil when it didn't
+	Panic *handler.Panic
+}
+
+// memoryReporter is an instance that knows the most memory it has used
+type memoryReporter interface {
+	peakMemoryMB() (int, error)
+}
+
+// UsageRecorder records the usage of every invocation.
+type UsageRecorder interface {
+	RecordUsage(u Usage)
+}
+
+// SetUsageRecorder has the usage of every invocation recorded by r.
+func (lf *KappaFunction) SetUsageRecorder(r UsageRecorder) {
+	lf.usage = r
+}
+
 // Invoke invokes the kappa function with the given event.
 func (lf *KappaFunction) Invoke(ctx context.Context, event KappaEvent) (*KappaResponse, error) {
-	// First ensure the function is running
+	encoded, err := EncodeEvent(event)
+	if err != nil {
+		return nil, err
+	}
+	return lf.InvokeEncoded(ctx, encoded)
+}
+
+// InvokeEncoded invokes the kappa function with an event already encoded,
+// for invoking with copies of one event without encoding it again.
+func (lf *KappaFunction) InvokeEncoded(ctx context.Context, event *EncodedEvent) (*KappaResponse, error) {
+	if err := lf.checkDisabled(); err != nil {
+		return nil, err
+	}
+	if err := lf.inflight.begin(lf.stopForRestart); err != nil {
+		return nil, err
+	}
+	end := lf.inflight.end
+	lf.lastInvoked.Store(time.Now().UnixNano())
+	// Invocations over the function's limit wait their turn, and aren't
+	// metered while they do
+	if c := lf.concurrency; c != nil {
+		if err := c.acquire(ctx); err != nil {
+			end()
+			return nil, err
+		}
+		end = func() {
+			c.release()
+			lf.inflight.end()
+		}
+	}
+	if lf.invocationLogs {
+		lf.logInvocationStart(event.RequestID())
+	}
+	started := time.Now()
+	resp, err := lf.invoke(ctx, event)
+	if resp != nil && resp.Stream == nil {
+		takePanic(resp)
+	}
+
+	finish := func(egressBytes int) {
+		defer end()
+		if lf.usage == nil && !lf.invocationLogs {
+			return
+		}
+		duration := time.Since(started)
+		peakMemoryMB := lf.peakMemoryMB()
+		if lf.invocationLogs {
+			lf.logInvocationEnd(event.RequestID(), duration, peakMemoryMB, err)
+		}
+		if lf.usage == nil {
+			return
+		}
+		u := Usage{
+			Function:     lf.Name,
+			Started:      started,
+			Duration:     duration,
+			MemoryMB:     lf.memoryMB,
+			PeakMemoryMB: peakMemoryMB,
+			Failed:       err != nil,
+			Err:          err,
+			RequestID:    event.RequestID(),
+			EgressBytes:  egressBytes,
+			Version:      lf.version,
+		}
+		if resp != nil {
+			u.StatusCode = resp.StatusCode
+			u.ColdStart = resp.ColdStart
+			u.Panic = resp.Panic
+		}
+		lf.usage.RecordUsage(u)
+	}
+	switch {
+	case resp != nil && resp.Stream != nil:
+		// The invocation lasts until its caller is done with the stream
+		resp.Stream = &streamBody{ReadCloser: resp.Stream, done: func(n int64) { finish(int(n)) }}
+	case resp != nil && resp.Spilled != nil:
+		finish(int(resp.Spilled.Size))
+	case resp != nil:
+		finish(len(resp.Body))
+	default:
+		finish(0)
+	}
+	return resp, err
+}
+
+// peakMemoryMB returns the most memory the running instance has used, 0
+// when there is none or its backend can't tell.
+func (lf *KappaFunction) peakMemoryMB() int {
 	lf.isRunningMu.Lock()
-	isRunning := lf.isRunning
+	run := lf.run
 	lf.isRunningMu.Unlock()
+	if run == nil {
+		return 0
+	}
+	reporter, ok := run.instance.(memoryReporter)
+	if !ok {
+		return 0
+	}
+	peak, err := reporter.peakMemoryMB()
+	if err != nil {
+		return 0
+	}
+	return peak
+}
 
-	if !isRunning {
-		if err := lf.Start(ctx); err != nil {
-			return nil, fmt.Errorf("failed to start kappa function: %w", err)
+func (lf *KappaFunction) invoke(ctx context.Context, event *EncodedEvent) (*KappaResponse, error) {
+	// Jobs don't keep a runtime around, every invocation is a run of its own
+	if lf.mode == ModeJob {
+		return lf.invokeJob(ctx, event)
+	}
+	if lf.mode == ModeTCP {
+		return nil, ErrNotInvocable
+	}
+
+	var target runtimeTarget
+	coldStart := false
+	if lf.mode == ModeExternal {
+		// The runtime is its supervisor's to start, it has to be attached
+		var err error
+		if target.baseURL, target.client, err = lf.attachedRuntime(); err != nil {
+			return nil, err
 		}
+	} else {
+		// First ensure the function is running
+		lf.isRunningMu.Lock()
+		isRunning := lf.isRunning
+		lf.isRunningMu.Unlock()
 
-		// Give the container a moment to initialize
-		// time.Sleep(500 * time.Millisecond)
-	}
+		if !isRunning {
+			if err := lf.Start(ctx); err != nil {
+				return nil, fmt.Errorf("failed to start kappa function: %w", err)
+			}
+			// Send the invocation once the runtime serves
+			if err := lf.waitHealthy(ctx); err != nil {
+				return nil, fmt.Errorf("failed to start kappa function: %w", err)
+			}
+			coldStart = true
+		}
 
-	// Reset the idle timer since we're about to make a request
-	lf.resetIdleTimer()
+		// Reset the idle timer since we're about to make a request
+		lf.resetIdleTimer()
+		target = lf.runningTarget()
+	}
 
 	// Generate a request ID if not already present
-	if event.RequestID == "" {
-		event.RequestID = uuid.New().String()
+	if event.RequestID() == "" {
+		event = event.WithRequestID(uuid.New().String())
 	}
 
 	// Prepare the request
-	payload, err := json.Marshal(event)
+	payload, encoding, err := lf.compressEvent(event.appendJSON(nil))
 	if err != nil {
-		return nil, fmt.Errorf("failed to marshal event: %w", err)
+		return nil, err
 	}
 
 	// Make the HTTP request to the container
-	url := fmt.Sprintf("%s/2015-03-31/functions/function/invocations", lf.containerURL)
-	req, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewBuffer(payload))
+	resp, attempts, err := lf.doWithRetry(ctx, &target, payload, encoding, event.RequestID())
 	if err != nil {
-		return nil, fmt.Errorf("failed to create request: %w", err)
+		return nil, lf.timedOut(err, target.client, target.baseURL, event.RequestID())
+	}
+	lf.markHealthy()
+	lf.noteEncodings(resp)
+
+	// Parse the response, leaving streams to the caller to read when it
+	// takes them. The function isn't idle while they are read.
+	var kappaResp *KappaResponse
+	if streaming(ctx) && isStream(resp) {
+		kappaResp = streamResponse(resp)
+		release := lf.hold()
+		kappaResp.Stream = &streamBody{ReadCloser: resp.Body, done: func(int64) { release() }}
+	} else {
+		defer resp.Body.Close()
+		if kappaResp, err = decodeResponse(resp, lf.readBody(ctx)); err != nil {
+			return nil, err
+		}
+	}
+
+	// Set the request ID if not set in the response
+	if kappaResp.RequestID == "" {
+		kappaResp.RequestID = event.RequestID()
 	}
 
-	req.Header.Set("Content-Type", "application/json")
-	req.Header.Set("Kappa-Runtime-Aws-Request-Id", event.RequestID)
+	kappaResp.Attempts = attempts
+	kappaResp.ColdStart = coldStart
 
-	client := &http.Client{
-		Timeout: 30 * time.Second,
+	// Increment requests processed
+	lf.requestsProcessed.Add(1)
+
+	return kappaResp, nil
+}
+
+// hopHeaders are connection level headers that must not be propagated
+var hopHeaders = []string{
+	"Connection", "Keep-Alive", "Proxy-Authenticate", "Proxy-Authorization",
+	"Te", "Trailer", "Transfer-Encoding", "Upgrade", "Content-Length", "Date",
+}
+
+// decodeResponse reads the runtime's HTTP response. Runtimes using the raw
+// format set the real status, headers and body, read with readBody when
+// given, older runtimes wrap them in a JSON envelope with a 200 status.
+func decodeResponse(resp *http.Response, readBody func(*http.Response) ([]byte, *SpilledBody, error)) (*KappaResponse, error) {
+	if resp.Header.Get(handler.HeaderResponseFormat) != handler.ResponseFormatRaw {
+		var kappaResp KappaResponse
+		if err := json.NewDecoder(resp.Body).Decode(&kappaResp); err != nil {
+			return nil, fmt.Errorf("failed to decode response: %w", err)
+		}
+		return &kappaResp, nil
 	}
 
-	resp, err := client.Do(req)
+	var body []byte
+	var spilled *SpilledBody
+	var err error
+	if readBody != nil {
+		body, spilled, err = readBody(resp)
+	} else {
+		body, err = io.ReadAll(resp.Body)
+	}
 	if err != nil {
-		// If we get a connection error, maybe the container is not ready yet
-		// Try to restart it once
-		if lf.isRunning {
-			logger.Get().Warn("Failed to connect to kappa function, attempting to restart",
-				zap.String("name", lf.Name),
-				zap.Error(err))
-
-			// Stop and restart
-			_ = lf.Stop()
-			if err := lf.Start(ctx); err != nil {
-				return nil, fmt.Errorf("failed to restart kappa function: %w", err)
-			}
+		return nil, fmt.Errorf("failed to read response: %w", err)
+	}
 
-			// Wait for startup
-			time.Sleep(1 * time.Second)
+	headers, requestID := responseHeaders(resp)
+	if spilled != nil {
+		headers["Content-Type"] = "application/json"
+		headers[HeaderSpilled] = "true"
+		// Links carry their signature in the query, keep its & readable
+		var buf bytes.Buffer
+		enc := json.NewEncoder(&buf)
+		enc.SetEscapeHTML(false)
+		if err := enc.Encode(spilled); err != nil {
+			return nil, fmt.Errorf("failed to encode spilled response: %w", err)
+		}
+		body = bytes.TrimSuffix(buf.Bytes(), []byte("\n"))
+	}
 
-			// Try again
-			resp, err = client.Do(req)
-			if err != nil {
-				return nil, fmt.Errorf("failed to invoke kappa function after restart: %w", err)
-			}
-		} else {
-			return nil, fmt.Errorf("failed to invoke kappa function: %w", err)
+	return &KappaResponse{
+		StatusCode: resp.StatusCode,
+		Headers:    headers,
+		Body:       body,
+		RequestID:  requestID,
+		Spilled:    spilled,
+	}, nil
+}
+
+// responseHeaders returns the headers of a raw format response to pass on,
+// and the request ID it was for.
+func responseHeaders(resp *http.Response) (map[string]string, string) {
+	headers := make(map[string]string, len(resp.Header))
+	for key, values := range resp.Header {
+		if len(values) > 0 {
+			headers[key] = values[0]
 		}
 	}
-	defer resp.Body.Close()
+	for _, key := range hopHeaders {
+		delete(headers, key)
+	}
+	requestID := headers[handler.HeaderRequestID]
+	delete(headers, handler.HeaderRequestID)
+	delete(headers, handler.HeaderResponseFormat)
+	return headers, requestID
+}
 
-	// Parse the response
-	var kappaResp KappaResponse
-	if err := json.NewDecoder(resp.Body).Decode(&kappaResp); err != nil {
-		return nil, fmt.Errorf("failed to decode response: %w", err)
+// host returns the address the runtime is reachable at.
+func (lf *KappaFunction) host() string {
+	if lf.Host == "" {
+		return "localhost"
 	}
+	return lf.Host
+}
 
-	// Set the request ID if not set in the response
-	if kappaResp.RequestID == "" {
-		kappaResp.RequestID = event.RequestID
+// httpClient returns a client for talking to the runtime, trusting the
+// function's certificate when TLS is enabled.
+func (lf *KappaFunction) httpClient() *http.Client {
+	transport := lf.transport
+	if transport == nil {
+		transport = lf.newTransport()
 	}
+	return &http.Client{
+		Timeout:   lf.timeout,
+		Transport: transport,
+	}
+}
 
-	// Increment requests processed
-	lf.requestsProcessed++
+// newTransport returns a transport keeping enough idle connections to the
+// runtime for concurrent invocations, closing them before the runtime would.
+func (lf *KappaFunction) newTransport() *http.Transport {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.IdleConnTimeout = runtimeIdleConnTimeout
+	transport.MaxIdleConnsPerHost = runtimeMaxIdleConns
+	if lf.TLS && lf.tlsConfig != nil {
+		transport.TLSClientConfig = lf.tlsConfig
+	}
+	return transport
+}
 
-	return &kappaResp, nil
+// serverConfig tunes the runtime's HTTP server to the function: reading and
+// writing an invocation may take up to its timeout, idle connections outlive
+// the service's, and requests in flight get to finish when it is stopped.
+func (lf *KappaFunction) serverConfig() handler.ServerConfig {
+	c := handler.DefaultServerConfig()
+	c.ReadTimeout = lf.timeout + runtimeTimeoutSlack
+	c.WriteTimeout = lf.timeout + runtimeTimeoutSlack
+	c.IdleTimeout = runtimeIdleConnTimeout + 30*time.Second
+	c.DrainTimeout = stopGrace - 2*time.Second
+	c.CompressMinBytes = lf.compressMinBytes
+	return c
 }
 
 // GetLogs returns the logs from the container.
@@ -350,13 +938,40 @@ func (lf *KappaFunction) GetLogs() []string {
 	return logs
 }
 
-// IsRunning returns true if the kappa function is running.
+// RequestsProcessed returns how many invocations the function's runtime
+// has answered.
+func (lf *KappaFunction) RequestsProcessed() int64 {
+	return lf.requestsProcessed.Load()
+}
+
+// LastInvoked returns when the function was last invoked, the zero time if
+// it never was.
+func (lf *KappaFunction) LastInvoked() time.Time {
+	nanos := lf.lastInvoked.Load()
+	if nanos == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, nanos)
+}
+
+// IsRunning returns true if the kappa function is running, for external
+// functions while a runtime is attached.
 func (lf *KappaFunction) IsRunning() bool {
 	lf.isRunningMu.Lock()
 	defer lf.isRunningMu.Unlock()
+	if lf.mode == ModeExternal {
+		return lf.attachedLocked() != nil
+	}
 	return lf.isRunning
 }
 
+// removeAll cleans up temp dirs when a start fails part way.
+func removeAll(dirs []string) {
+	for _, dir := range dirs {
+		os.RemoveAll(dir)
+	}
+}
+
 // Utility function to copy files when hard linking fails
 func copyFile(src, dst string) error {
 	sourceFile, err := os.Open(src)
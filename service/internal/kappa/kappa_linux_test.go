@@ -0,0 +1,241 @@
+//go:build linux
+
+package kappa
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/opencontainers/runtime-spec/specs-go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func setupKappaTest(t *testing.T) string {
+	t.Helper()
+	if _, err := os.Stat(containerdSocket); os.IsNotExist(err) {
+		t.Skipf("containerd socket not found at %s, skipping kappa integration test", containerdSocket)
+	}
+
+	binaryPath, err := buildTestHandler() // Gets the global path set by TestMain
+	// TestMain exits on build error, but this check is a safeguard.
+	require.NoError(t, err, "Test handler binary should have been built successfully by TestMain.")
+	require.NotEmpty(t, binaryPath, "Test handler binary path (from TestMain) is empty.")
+
+	return binaryPath
+}
+
+// removeContainer is a fallback cleanup for when fn.Stop() failed and left the container behind.
+func removeContainer(fn *KappaFunction) {
+	if ci, ok := fn.instance.(*containerInstance); ok {
+		_ = ci.container.Remove()
+	}
+}
+
+func TestKappaFunction_StartStop_Lifecycle(t *testing.T) {
+	binaryPath := setupKappaTest(t)
+	fnName := "lifecycle-" + filepath.Base(t.Name())
+	if len(fnName) > 75 { // max len
+		fnName = fnName[0:74]
+	}
+	fn := NewKappaFunction(fnName, binaryPath, testKappaImage, nil, 9091) // Unique port
+
+	// Cleanup function resources
+	defer func() {
+		if fn.IsRunning() {
+			_ = fn.Stop()
+		}
+		// If container object exists, try to clean it up if stop failed.
+		// fn.Stop() should handle removal if RemoveOnStop is true in cont.StopOptions.
+		// This is a fallback.
+		// Check if already stopped to avoid error from removing a running container's resources.
+		// However, fn.Stop() handles this. If Stop failed, container might still exist.
+		removeContainer(fn)
+	}()
+
+	err := fn.Start(context.Background())
+	require.NoError(t, err, "fn.Start() failed")
+	assert.True(t, fn.IsRunning(), "Function should be running after Start")
+	assert.IsType(t, &containerInstance{}, fn.instance, "Container should be initialized")
+	assert.NotEmpty(t, fn.containerURL, "Container URL should be set")
+
+	// Check for some log indication of startup
+	require.Eventually(t, func() bool {
+		logs := fn.GetLogs()
+		for _, l := range logs {
+			if strings.Contains(l, fmt.Sprintf("Kappa function starting on port %d", fn.Port)) {
+				return true
+			}
+		}
+		return false
+	}, 10*time.Second, 250*time.Millisecond, "Startup log message not found. Logs: %v", fn.GetLogs()) // Increased timeout and added logs
+
+	err = fn.Stop()
+	require.NoError(t, err, "fn.Stop() failed")
+	assert.False(t, fn.IsRunning(), "Function should not be running after Stop")
+}
+
+func TestKappaFunction_Invoke_Success(t *testing.T) {
+	binaryPath := setupKappaTest(t)
+	fnName := "invoke-success-" + filepath.Base(t.Name())
+
+	if len(fnName) > 75 {
+		fnName = fnName[0:74]
+	}
+	fn := NewKappaFunction(fnName, binaryPath, testKappaImage, nil, 9092)
+
+	defer func() {
+		if fn.IsRunning() {
+			_ = fn.Stop()
+		}
+		removeContainer(fn)
+	}()
+
+	ctx := context.Background()
+	err := fn.Start(ctx)
+	require.NoError(t, err, "Failed to start function for invocation")
+
+	// Was an old delay, no longer
+	//time.Sleep(1 * time.Second) 
+
+	event := KappaEvent{
+		Body: map[string]any{"name": "TestUser"},
+	}
+	resp, errInvoke := fn.Invoke(ctx, event)
+	// Provide more context on Invoke failure
+	if errInvoke != nil {
+		logs := fn.GetLogs()
+		t.Logf("Invoke failed. Function logs: %v", logs)
+	}
+	require.NoError(t, errInvoke, "fn.Invoke() failed")
+	require.NotNil(t, resp)
+
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.NotEmpty(t, resp.RequestID)
+
+	body := decodeBody(t, resp)
+	expectedMessage := "Hello, TestUser! Welcome to your Kappa function!"
+	assert.Equal(t, expectedMessage, body["message"])
+
+	inputBody, ok := body["input"].(map[string]any)
+	require.True(t, ok)
+	assert.Equal(t, "TestUser", inputBody["name"])
+}
+
+func TestKappaFunction_Invoke_StartIfNeeded(t *testing.T) {
+	binaryPath := setupKappaTest(t)
+	fnName := "invoke-autostart-" + filepath.Base(t.Name())
+	if len(fnName) > 75 {
+		fnName = fnName[0:74]
+	}
+	fn := NewKappaFunction(fnName, binaryPath, testKappaImage, nil, 9093)
+	defer func() {
+		if fn.IsRunning() {
+			_ = fn.Stop()
+		}
+		removeContainer(fn)
+	}()
+
+	assert.False(t, fn.IsRunning(), "Function should not be running initially")
+
+	ctx := context.Background()
+	event := KappaEvent{
+		Body: map[string]any{"name": "AutoStartUser"},
+	}
+	resp, errInvoke := fn.Invoke(ctx, event)
+	if errInvoke != nil {
+		logs := fn.GetLogs()
+		t.Logf("Invoke (auto-start) failed. Function logs: %v", logs)
+	}
+	require.NoError(t, errInvoke, "fn.Invoke() failed on auto-start")
+	require.NotNil(t, resp)
+
+	assert.True(t, fn.IsRunning(), "Function should be running after first Invoke")
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Contains(t, decodeBody(t, resp)["message"], "AutoStartUser")
+}
+
+func TestKappaFunction_IdleTimeout(t *testing.T) {
+	binaryPath := setupKappaTest(t)
+	fnName := "idle-timeout-" + filepath.Base(t.Name())
+	if len(fnName) > 75 {
+		fnName = fnName[0:74]
+	}
+	fn := NewKappaFunction(fnName, binaryPath, testKappaImage, nil, 9094)
+	defer func() {
+		if fn.IsRunning() {
+			_ = fn.Stop()
+		}
+		removeContainer(fn)
+	}()
+
+	idleTestTimeout := 2 * time.Second // Short timeout for test, ensure it's longer than typical startup
+	fn.SetIdleTimeout(idleTestTimeout)
+
+	ctx := context.Background()
+	err := fn.Start(ctx)
+	require.NoError(t, err, "Failed to start function for idle test: %v", err)
+	assert.True(t, fn.IsRunning(), "Function should be running after start")
+
+	// Wait for longer than idle timeout, ensure this wait also accommodates container startup
+	time.Sleep(idleTestTimeout + 1*time.Second)
+
+	assert.False(t, fn.IsRunning(), "Function should be stopped by idle timeout")
+
+	// Try to invoke again, it should restart
+	event := KappaEvent{Body: map[string]any{"name": "AfterIdle"}}
+	resp, errInvoke := fn.Invoke(ctx, event)
+	if errInvoke != nil {
+		logs := fn.GetLogs() // Logs from previous run might be gone, these are from new run
+		t.Logf("Invoke (after idle) failed. Function logs: %v", logs)
+	}
+	require.NoError(t, errInvoke, "Invoke after idle stop failed")
+	require.NotNil(t, resp)
+	assert.True(t, fn.IsRunning(), "Function should restart on invoke after idle stop")
+	assert.Contains(t, decodeBody(t, resp)["message"], "AfterIdle")
+}
+
+func TestContainerName(t *testing.T) {
+	assert.Equal(t, "kappa-orders-v3-r0-g2", containerName("orders-v3-r0-g2"))
+
+	long := strings.Repeat("a", 80)
+	first := containerName(long + "-v1-r0-g1")
+	second := containerName(long + "-v1-r0-g2")
+	assert.Len(t, first, maxContainerID)
+	assert.NotEqual(t, first, second, "names cut short keep a hash of the whole")
+	assert.Equal(t, first, containerName(long+"-v1-r0-g1"))
+}
+
+func TestVMBackend_StartScriptAndArgs(t *testing.T) {
+	spec := RunSpec{
+		Name:    "vm",
+		Command: []string{"/app/main"},
+		Env:     []string{"PORT=9096", "GREETING=it's me"},
+		WorkDir: "/app",
+		Mounts: []specs.Mount{
+			{Source: "/tmp/app", Destination: "/app", Options: []string{"rbind", "ro"}},
+			{Source: "/tmp/data", Destination: "/data", Options: []string{"rbind"}},
+		},
+	}
+
+	script := vmStartScript(spec)
+	assert.Contains(t, script, "export PORT='9096'\n")
+	assert.Contains(t, script, `export GREETING='it'\''s me'`)
+	assert.Contains(t, script, "cd '/app'\nexec '/app/main'\n")
+
+	assert.Equal(t, "m0 /app ro\nm1 /data rw\n", vmMountList(spec))
+
+	args := strings.Join(VMBackend{ImageDir: "/img"}.qemuArgs(spec, "/nix/store/x-system/init", "/tmp/meta", 9096), " ")
+	assert.True(t, strings.HasPrefix(args, "qemu-system-x86_64 "))
+	assert.Contains(t, args, "-kernel /img/kernel -initrd /img/initrd")
+	assert.Contains(t, args, "init=/nix/store/x-system/init")
+	assert.Contains(t, args, "local,path=/tmp/app,security_model=none,mount_tag=m0,readonly=on")
+	assert.Contains(t, args, "local,path=/tmp/data,security_model=none,mount_tag=m1 ")
+	assert.Contains(t, args, "hostfwd=tcp:127.0.0.1:9096-:9096")
+}
@@ -1,17 +1,31 @@
 package kappa
 
 import (
+	"bytes"
+	"compress/gzip"
 	"context"
+	"errors"
+	"crypto/tls"
+	"encoding/json"
 	"fmt"
+	"io"
+	"kappa-v2/pkg/handler"
 	"kappa-v2/pkg/logger"
+	"net"
 	"net/http"
+	"net/http/httptest"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"runtime"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
+	"github.com/opencontainers/runtime-spec/specs-go"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
@@ -87,20 +101,13 @@ func buildTestHandler() (string, error) {
 	return globalTestHandlerBinaryPath, globalBuildBinaryErr
 }
 
-func setupKappaTest(t *testing.T) string {
+// decodeBody unmarshals a JSON response body for assertions.
+func decodeBody(t *testing.T, resp *KappaResponse) map[string]any {
 	t.Helper()
-	if _, err := os.Stat(containerdSocket); os.IsNotExist(err) {
-		t.Skipf("containerd socket not found at %s, skipping kappa integration test", containerdSocket)
-	}
-
-	binaryPath, err := buildTestHandler() // Gets the global path set by TestMain
-	// TestMain exits on build error, but this check is a safeguard.
-	require.NoError(t, err, "Test handler binary should have been built successfully by TestMain.")
-	require.NotEmpty(t, binaryPath, "Test handler binary path (from TestMain) is empty.")
-
-	return binaryPath
+	var body map[string]any
+	require.NoError(t, json.Unmarshal(resp.Body, &body), "body: %s", resp.Body)
+	return body
 }
-
 func TestNewKappaFunction(t *testing.T) {
 	fn := NewKappaFunction("testfn", "/path/to/bin", "img", []string{"E=V"}, 8080)
 	assert.Equal(t, "testfn", fn.Name)
@@ -120,173 +127,1407 @@ func TestKappaFunction_SetIdleTimeout(t *testing.T) {
 	// Test reset if timer was active (harder to test without exposing timer state)
 }
 
-func TestKappaFunction_StartStop_Lifecycle(t *testing.T) {
-	binaryPath := setupKappaTest(t)
-	fnName := "lifecycle-" + filepath.Base(t.Name())
-	if len(fnName) > 75 { // max len
-		fnName = fnName[0:74]
+func TestKappaFunction_SetLogRetention(t *testing.T) {
+	fn := NewKappaFunction("testfn", "", "", nil, 0)
+	assert.Equal(t, 30*time.Second, fn.Timeout()) // Default
+	fn.logs = []string{"1", "2", "3", "4"}
+
+	fn.SetLogRetention(2)
+	assert.Equal(t, []string{"3", "4"}, fn.GetLogs())
+}
+
+func TestEncodedEvent_MatchesMarshal(t *testing.T) {
+	events := []KappaEvent{
+		{},
+		{
+			Body:        map[string]any{"name": "<kappa> & co", "n": 1.5, "tags": []any{"a", "b"}},
+			Path:        "/orders/\"1\"",
+			HTTPMethod:  "POST",
+			Headers:     map[string]string{"Content-Type": "application/json", "X-Trace": "abc"},
+			QueryParams: map[string]string{"page": "2"},
+			RequestID:   "req-1",
+		},
+		{Path: "/users/7", PathParams: map[string]string{"id": "7"}},
+	}
+	for _, event := range events {
+		want, err := json.Marshal(event)
+		require.NoError(t, err)
+		encoded, err := EncodeEvent(event)
+		require.NoError(t, err)
+		got, err := json.Marshal(encoded)
+		require.NoError(t, err)
+		assert.JSONEq(t, string(want), string(got))
+		assert.Equal(t, want, encoded.appendJSON(nil))
+	}
+
+	base, err := EncodeEvent(events[1])
+	require.NoError(t, err)
+	copied := base.WithHeader("X-Kappa-Mirror-Of", "orders").WithRequestID("req-1-0")
+	copied, err = copied.WithBody(map[string]any{"n": 2})
+	require.NoError(t, err)
+
+	var decoded KappaEvent
+	require.NoError(t, json.Unmarshal(copied.appendJSON(nil), &decoded))
+	assert.Equal(t, map[string]any{"n": 2.0}, decoded.Body)
+	assert.Equal(t, "orders", decoded.Headers["X-Kappa-Mirror-Of"])
+	assert.Equal(t, "abc", decoded.Headers["X-Trace"])
+	assert.Equal(t, "req-1-0", decoded.RequestID)
+	assert.Equal(t, "/orders/\"1\"", decoded.Path)
+
+	// The copies leave the event they came from as it was
+	want, _ := json.Marshal(events[1])
+	assert.Equal(t, want, base.appendJSON(nil))
+	assert.NotContains(t, events[1].Headers, "X-Kappa-Mirror-Of")
+}
+
+// fanOutEvent is an event with a body of some size, as sent to many replicas
+func fanOutEvent() KappaEvent {
+	items := make([]any, 100)
+	for i := range items {
+		items[i] = map[string]any{"id": i, "sku": fmt.Sprintf("sku-%d", i), "quantity": i % 7, "price": 9.99}
+	}
+	return KappaEvent{
+		Body:        map[string]any{"order": "o-1", "items": items},
+		Path:        "/orders",
+		HTTPMethod:  "POST",
+		Headers:     map[string]string{"Content-Type": "application/json", "User-Agent": "bench"},
+		QueryParams: map[string]string{"dryRun": "false"},
+		RequestID:   "req",
+	}
+}
+
+const fanOutReplicas = 16
+
+// BenchmarkFanOut_MarshalEach encodes the whole event for every replica,
+// as every invocation did before events were encoded once
+func BenchmarkFanOut_MarshalEach(b *testing.B) {
+	event := fanOutEvent()
+	b.ReportAllocs()
+	for b.Loop() {
+		for i := range fanOutReplicas {
+			copied := event
+			copied.Headers = make(map[string]string, len(event.Headers)+1)
+			for k, v := range event.Headers {
+				copied.Headers[k] = v
+			}
+			copied.Headers["X-Kappa-Mirror-Of"] = "orders"
+			copied.RequestID = fmt.Sprintf("%s-%d", event.RequestID, i)
+			if _, err := json.Marshal(copied); err != nil {
+				b.Fatal(err)
+			}
+		}
 	}
-	fn := NewKappaFunction(fnName, binaryPath, testKappaImage, nil, 9091) // Unique port
+}
 
-	// Cleanup function resources
-	defer func() {
-		if fn.IsRunning() {
-			_ = fn.Stop()
+// BenchmarkFanOut_Encoded encodes the event once, each replica only its
+// request ID and headers
+func BenchmarkFanOut_Encoded(b *testing.B) {
+	event := fanOutEvent()
+	b.ReportAllocs()
+	for b.Loop() {
+		encoded, err := EncodeEvent(event)
+		if err != nil {
+			b.Fatal(err)
 		}
-		// If container object exists, try to clean it up if stop failed.
-		// fn.Stop() should handle removal if RemoveOnStop is true in cont.StopOptions.
-		// This is a fallback.
-		if fn.container != nil {
-			// Check if already stopped to avoid error from removing a running container's resources.
-			// However, fn.Stop() handles this. If Stop failed, container might still exist.
-			_ = fn.container.Remove()
+		for i := range fanOutReplicas {
+			copied := encoded.WithHeader("X-Kappa-Mirror-Of", "orders").WithRequestID(fmt.Sprintf("%s-%d", event.RequestID, i))
+			_ = copied.appendJSON(nil)
 		}
-	}()
+	}
+}
 
-	err := fn.Start(context.Background())
-	require.NoError(t, err, "fn.Start() failed")
-	assert.True(t, fn.IsRunning(), "Function should be running after Start")
-	assert.NotNil(t, fn.container, "Container should be initialized")
-	assert.NotEmpty(t, fn.containerURL, "Container URL should be set")
+func TestClassifyInvokeError(t *testing.T) {
+	assert.Equal(t, errKindNone, classifyInvokeError(&http.Response{StatusCode: http.StatusOK}, nil))
+	assert.Equal(t, errKindNone, classifyInvokeError(&http.Response{StatusCode: http.StatusNotFound}, nil))
+	assert.Equal(t, errKindServer, classifyInvokeError(&http.Response{StatusCode: http.StatusBadGateway}, nil))
+	assert.Equal(t, errKindTimeout, classifyInvokeError(nil, context.DeadlineExceeded))
+	assert.Equal(t, errKindOther, classifyInvokeError(nil, fmt.Errorf("boom")))
 
-	// Check for some log indication of startup
-	require.Eventually(t, func() bool {
-		logs := fn.GetLogs()
-		for _, l := range logs {
-			if strings.Contains(l, fmt.Sprintf("Kappa function starting on port %d", fn.Port)) {
-				return true
-			}
+	// Nothing listens on port 1, so dialing it is refused
+	_, err := http.Get("http://127.0.0.1:1")
+	require.Error(t, err)
+	assert.Equal(t, errKindConnect, classifyInvokeError(nil, err))
+}
+
+func TestKappaFunction_Invoke_RetryPolicy(t *testing.T) {
+	var calls int
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		if calls == 1 {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
 		}
-		return false
-	}, 10*time.Second, 250*time.Millisecond, "Startup log message not found. Logs: %v", fn.GetLogs()) // Increased timeout and added logs
+		w.Header().Set(handler.HeaderResponseFormat, handler.ResponseFormatRaw)
+		w.Write([]byte(`{"ok":true}`))
+	}))
+	defer server.Close()
 
-	err = fn.Stop()
-	require.NoError(t, err, "fn.Stop() failed")
-	assert.False(t, fn.IsRunning(), "Function should not be running after Stop")
+	newRunning := func() *KappaFunction {
+		fn := NewKappaFunction("retry", "", "", nil, 0)
+		fn.isRunning = true
+		fn.containerURL = server.URL
+		return fn
+	}
+
+	t.Run("5xx not retried by default", func(t *testing.T) {
+		calls = 0
+		fn := newRunning()
+		defer fn.cancelIdleTimer()
+		_, err := fn.Invoke(context.Background(), KappaEvent{})
+		require.Error(t, err) // empty 500 body can't be decoded
+		assert.Equal(t, 1, calls)
+	})
+
+	t.Run("5xx retried when enabled", func(t *testing.T) {
+		calls = 0
+		fn := newRunning()
+		defer fn.cancelIdleTimer()
+		fn.SetRetryPolicy(RetryPolicy{MaxAttempts: 3, RetryOn5xx: true})
+		resp, err := fn.Invoke(context.Background(), KappaEvent{})
+		require.NoError(t, err)
+		assert.Equal(t, 2, calls)
+		assert.Equal(t, 2, resp.Attempts)
+		assert.Equal(t, true, decodeBody(t, resp)["ok"])
+	})
 }
 
-func TestKappaFunction_Invoke_Success(t *testing.T) {
-	binaryPath := setupKappaTest(t)
-	fnName := "invoke-success-" + filepath.Base(t.Name())
+// listeningBackend runs instances as servers on addr answering every
+// invocation, counting the instances it runs
+type listeningBackend struct {
+	addr string
+	runs atomic.Int32
+}
 
-	if len(fnName) > 75 {
-		fnName = fnName[0:74]
+func (b *listeningBackend) Run(spec RunSpec) (Instance, error) {
+	listener, err := net.Listen("tcp", b.addr)
+	if err != nil {
+		return nil, err
 	}
-	fn := NewKappaFunction(fnName, binaryPath, testKappaImage, nil, 9092)
+	b.runs.Add(1)
+	server := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set(handler.HeaderResponseFormat, handler.ResponseFormatRaw)
+		w.Write([]byte(`{"ok":true}`))
+	})}
+	go server.Serve(listener)
+	instance := &noopInstance{stopped: make(chan struct{})}
+	go func() {
+		<-instance.stopped
+		server.Close()
+	}()
+	return instance, nil
+}
+
+func TestKappaFunction_Invoke_RestartsDeadRuntimeOnce(t *testing.T) {
+	binaryPath := filepath.Join(t.TempDir(), "main")
+	require.NoError(t, os.WriteFile(binaryPath, []byte("binary"), 0755))
+	// Nothing listens on the port until the runtime is restarted
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	port := listener.Addr().(*net.TCPAddr).Port
+	require.NoError(t, listener.Close())
+
+	backend := &listeningBackend{addr: listener.Addr().String()}
+	fn := NewKappaFunction("restart", binaryPath, "", nil, port)
+	fn.Host = "127.0.0.1"
+	fn.SetBackend(backend)
+	fn.SetRetryPolicy(RetryPolicy{MaxAttempts: 2})
+	// The runtime is running as far as the function knows, but died
+	fn.isRunning = true
+	fn.instance = &noopInstance{stopped: make(chan struct{})}
+	fn.containerURL = fmt.Sprintf("http://127.0.0.1:%d", port)
+	defer fn.Stop()
 
-	defer func() {
-		if fn.IsRunning() {
-			_ = fn.Stop()
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := fn.Invoke(context.Background(), KappaEvent{})
+			assert.NoError(t, err)
+		}()
+	}
+	wg.Wait()
+	assert.Equal(t, int32(1), backend.runs.Load(), "invocations finding the runtime dead restart it once")
+	assert.Equal(t, 1, fn.StartStatus().Generation)
+}
+
+func TestKappaFunction_Invoke_Compression(t *testing.T) {
+	// A runtime reading gzipped events and gzipping its responses
+	var encodings []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		encodings = append(encodings, r.Header.Get("Content-Encoding"))
+		body := r.Body
+		if r.Header.Get("Content-Encoding") == "gzip" {
+			gz, err := gzip.NewReader(r.Body)
+			require.NoError(t, err)
+			body = gz
 		}
-		if fn.container != nil {
-			_ = fn.container.Remove()
+		var event KappaEvent
+		require.NoError(t, json.NewDecoder(body).Decode(&event))
+		w.Header().Set(handler.HeaderAcceptEncoding, "gzip")
+		w.Header().Set(handler.HeaderResponseFormat, handler.ResponseFormatRaw)
+		if strings.Contains(r.Header.Get("Accept-Encoding"), "gzip") {
+			w.Header().Set("Content-Encoding", "gzip")
+			gz := gzip.NewWriter(w)
+			defer gz.Close()
+			json.NewEncoder(gz).Encode(event.Body)
+			return
 		}
-	}()
+		json.NewEncoder(w).Encode(event.Body)
+	}))
+	defer server.Close()
 
-	ctx := context.Background()
-	err := fn.Start(ctx)
-	require.NoError(t, err, "Failed to start function for invocation")
+	fn := NewKappaFunction("compressed", "", "", nil, 0)
+	defer fn.cancelIdleTimer()
+	fn.isRunning = true
+	fn.containerURL = server.URL
+	fn.SetCompression(1024)
 
-	// Was an old delay, no longer
-	//time.Sleep(1 * time.Second) 
-
-	event := KappaEvent{
-		Body: map[string]any{"name": "TestUser"},
+	large := KappaEvent{Body: map[string]any{"data": strings.Repeat("kappa", 1000)}}
+	for range 2 {
+		resp, err := fn.Invoke(context.Background(), large)
+		require.NoError(t, err)
+		assert.Equal(t, large.Body, decodeBody(t, resp))
+		assert.Empty(t, resp.Headers["Content-Encoding"], "responses are decompressed")
 	}
-	resp, errInvoke := fn.Invoke(ctx, event)
-	// Provide more context on Invoke failure
-	if errInvoke != nil {
-		logs := fn.GetLogs()
-		t.Logf("Invoke failed. Function logs: %v", logs)
+	_, err := fn.Invoke(context.Background(), KappaEvent{Body: map[string]any{"data": "small"}})
+	require.NoError(t, err)
+	// Events are only gzipped once the runtime said it reads them, and when large
+	assert.Equal(t, []string{"", "gzip", ""}, encodings)
+}
+
+type bufferSpiller struct {
+	key  string
+	body bytes.Buffer
+}
+
+func (s *bufferSpiller) Spill(ctx context.Context, key string, body io.Reader) (string, time.Time, error) {
+	s.key = key
+	_, err := io.Copy(&s.body, body)
+	return "https://blobs.example/" + key, time.Now().Add(time.Hour), err
+}
+
+func TestDecodeResponse(t *testing.T) {
+	t.Run("raw format", func(t *testing.T) {
+		rr := httptest.NewRecorder()
+		rr.Header().Set(handler.HeaderResponseFormat, handler.ResponseFormatRaw)
+		rr.Header().Set(handler.HeaderRequestID, "req-1")
+		rr.Header().Set("X-Custom", "yes")
+		rr.WriteHeader(http.StatusCreated)
+		rr.WriteString(`{"id":1}`)
+
+		resp, err := decodeResponse(rr.Result(), nil)
+		require.NoError(t, err)
+		assert.Equal(t, http.StatusCreated, resp.StatusCode)
+		assert.Equal(t, "req-1", resp.RequestID)
+		assert.Equal(t, "yes", resp.Headers["X-Custom"])
+		assert.NotContains(t, resp.Headers, handler.HeaderResponseFormat)
+		assert.JSONEq(t, `{"id":1}`, string(resp.Body))
+	})
+
+	t.Run("spilled", func(t *testing.T) {
+		spiller := &bufferSpiller{}
+		fn := NewKappaFunction("big", "", "", nil, 0)
+		fn.SetSpillover(4, spiller)
+		respond := func(body string) *http.Response {
+			rr := httptest.NewRecorder()
+			rr.Header().Set(handler.HeaderResponseFormat, handler.ResponseFormatRaw)
+			rr.Header().Set("Content-Type", "text/csv")
+			rr.WriteString(body)
+			return rr.Result()
+		}
+
+		resp, err := decodeResponse(respond("a,b"), fn.readBody(context.Background()))
+		require.NoError(t, err)
+		assert.Nil(t, resp.Spilled, "small enough to return")
+		assert.Equal(t, "a,b", string(resp.Body))
+
+		resp, err = decodeResponse(respond("a,b\n1,2\n"), fn.readBody(context.Background()))
+		require.NoError(t, err)
+		require.NotNil(t, resp.Spilled)
+		assert.Equal(t, "a,b\n1,2\n", spiller.body.String())
+		assert.Regexp(t, `^responses/big/`, spiller.key)
+		assert.Equal(t, int64(8), resp.Spilled.Size)
+		assert.Equal(t, "text/csv", resp.Spilled.ContentType)
+		assert.Equal(t, "application/json", resp.Headers["Content-Type"])
+		assert.Equal(t, "true", resp.Headers[HeaderSpilled])
+		assert.Contains(t, string(resp.Body), `"url":"https://blobs.example/`)
+	})
+
+	t.Run("legacy envelope", func(t *testing.T) {
+		rr := httptest.NewRecorder()
+		rr.WriteString(`{"statusCode":404,"headers":{"X-Custom":"yes"},"body":{"error":"nope"},"requestId":"req-2"}`)
+
+		resp, err := decodeResponse(rr.Result(), nil)
+		require.NoError(t, err)
+		assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+		assert.Equal(t, "req-2", resp.RequestID)
+		assert.JSONEq(t, `{"error":"nope"}`, string(resp.Body))
+	})
+}
+
+func TestGenerateFunctionCert_TLSRoundTrip(t *testing.T) {
+	dir := t.TempDir()
+	fn := NewKappaFunction("tls", "", "", nil, 0)
+	fn.TLS = true
+	tlsConfig, err := fn.setupTLS(dir)
+	require.NoError(t, err)
+	fn.tlsConfig = tlsConfig
+
+	cert, err := tls.LoadX509KeyPair(filepath.Join(dir, tlsCertFile), filepath.Join(dir, tlsKeyFile))
+	require.NoError(t, err)
+
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("secure"))
+	}))
+	server.TLS = &tls.Config{Certificates: []tls.Certificate{cert}}
+	server.StartTLS()
+	defer server.Close()
+
+	resp, err := fn.httpClient().Get(server.URL)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	// A client without the function's certificate must not trust it
+	_, err = http.Get(server.URL)
+	assert.Error(t, err)
+}
+
+func TestHostPath(t *testing.T) {
+	spec := RunSpec{Mounts: []specs.Mount{{Source: "/tmp/kappa-x", Destination: "/app"}}}
+	assert.Equal(t, filepath.Join("/tmp/kappa-x", "main"), hostPath(spec, "/app/main"))
+	assert.Equal(t, "/tmp/kappa-x", hostPath(spec, "/app"))
+	assert.Equal(t, "/application", hostPath(spec, "/application"))
+	assert.Equal(t, "8080", hostPath(spec, "8080"))
+}
+
+func TestKappaFunction_ProcessBackend_Invoke(t *testing.T) {
+	// The suite binary is built for linux/amd64
+	if runtime.GOOS != "linux" || runtime.GOARCH != "amd64" {
+		t.Skip("test handler binary is not built for this platform")
 	}
-	require.NoError(t, errInvoke, "fn.Invoke() failed")
-	require.NotNil(t, resp)
+	binaryPath, err := buildTestHandler()
+	require.NoError(t, err)
+
+	fn := NewKappaFunction("process-backend", binaryPath, "", nil, 9095)
+	fn.SetBackend(ProcessBackend{})
+	defer fn.Stop()
+
+	var resp *KappaResponse
+	require.Eventually(t, func() bool {
+		resp, err = fn.Invoke(context.Background(), KappaEvent{Body: map[string]any{"name": "Process"}})
+		return err == nil
+	}, 10*time.Second, 100*time.Millisecond, "invoke failed: %v", err)
 
 	assert.Equal(t, http.StatusOK, resp.StatusCode)
-	assert.NotEmpty(t, resp.RequestID)
+	assert.Contains(t, decodeBody(t, resp)["message"], "Process")
 
-	expectedMessage := "Hello, TestUser! Welcome to your Kappa function!"
-	assert.Equal(t, expectedMessage, resp.Body["message"])
+	require.NoError(t, fn.Stop())
+	assert.False(t, fn.IsRunning())
+}
 
-	inputBody, ok := resp.Body["input"].(map[string]any)
-	require.True(t, ok)
-	assert.Equal(t, "TestUser", inputBody["name"])
+func TestKappaFunction_RunJob(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("job script needs a posix shell")
+	}
+	// The job echoes its event and fails when asked to
+	script := "#!/bin/sh\ncat \"$KAPPA_EVENT_FILE\"\necho\necho working >&2\ngrep -q '\"fail\":true' \"$KAPPA_EVENT_FILE\" && exit 3\nexit 0\n"
+	binaryPath := filepath.Join(t.TempDir(), "main")
+	require.NoError(t, os.WriteFile(binaryPath, []byte(script), 0755))
+
+	fn := NewKappaFunction("job", binaryPath, "", nil, 0)
+	fn.SetBackend(ProcessBackend{})
+	fn.SetMode(ModeJob)
+
+	result, err := fn.RunJob(context.Background(), KappaEvent{RequestID: "job-request-1", Body: map[string]any{"n": 1}})
+	require.NoError(t, err)
+	assert.True(t, result.Succeeded())
+	assert.Equal(t, "job-request-1", result.RequestID)
+	var event KappaEvent
+	require.NoError(t, json.Unmarshal(result.Output, &event), "stdout is the result: %s", result.Output)
+	assert.Equal(t, map[string]any{"n": float64(1)}, event.Body)
+	assert.NotContains(t, string(result.Output), "working", "stderr is only logged")
+	assert.False(t, fn.IsRunning(), "jobs don't leave a runtime running")
+
+	resp, err := fn.Invoke(context.Background(), KappaEvent{Body: map[string]any{"fail": true}})
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusInternalServerError, resp.StatusCode)
+	assert.Equal(t, "3", resp.Headers["X-Kappa-Exit-Code"])
+	assert.True(t, resp.ColdStart, "every job starts an instance")
 }
 
-func TestKappaFunction_Invoke_StartIfNeeded(t *testing.T) {
-	binaryPath := setupKappaTest(t)
-	fnName := "invoke-autostart-" + filepath.Base(t.Name())
-	if len(fnName) > 75 {
-		fnName = fnName[0:74]
+func TestKappaFunction_Start_VerifiesArtifact(t *testing.T) {
+	binaryPath := filepath.Join(t.TempDir(), "main")
+	require.NoError(t, os.WriteFile(binaryPath, []byte("not the registered binary"), 0755))
+
+	fn := NewKappaFunction("tampered", binaryPath, "", nil, 0)
+	fn.ArtifactDigest = "9a3a45d01531a20e89ac6ae10b0b0beb0492acd7216a368aa062d1a5fecaf9cd"
+	fn.SetBackend(ProcessBackend{})
+
+	err := fn.Start(context.Background())
+	assert.ErrorContains(t, err, "failed integrity check")
+	assert.False(t, fn.IsRunning())
+}
+
+func TestKappaFunction_Footprint(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("runtime script needs a posix shell")
 	}
-	fn := NewKappaFunction(fnName, binaryPath, testKappaImage, nil, 9093)
-	defer func() {
-		if fn.IsRunning() {
-			_ = fn.Stop()
-		}
-		if fn.container != nil {
-			_ = fn.container.Remove()
+	binaryPath := filepath.Join(t.TempDir(), "main")
+	require.NoError(t, os.WriteFile(binaryPath, []byte("#!/bin/sh\nsleep 30\n"), 0755))
+
+	fn := NewKappaFunction("footprint", binaryPath, "", nil, 0)
+	fn.SetBackend(ProcessBackend{})
+	assert.Equal(t, Footprint{}, fn.Footprint())
+
+	require.NoError(t, fn.Start(context.Background()))
+	defer fn.Stop()
+	footprint := fn.Footprint()
+	assert.True(t, footprint.Running)
+	require.Len(t, footprint.Instances, 1)
+	assert.Empty(t, footprint.Instances[0].ID, "processes have no backend name")
+	require.Len(t, footprint.TmpDirs, 1)
+	assert.DirExists(t, footprint.TmpDirs[0])
+
+	require.NoError(t, fn.Stop())
+	assert.Equal(t, Footprint{}, fn.Footprint())
+	assert.NoDirExists(t, footprint.TmpDirs[0])
+}
+
+// recordingBackend captures the specs it is asked to run without running them
+type recordingBackend struct {
+	specs []RunSpec
+}
+
+func (b *recordingBackend) Run(spec RunSpec) (Instance, error) {
+	b.specs = append(b.specs, spec)
+	return &noopInstance{stopped: make(chan struct{})}, nil
+}
+
+// noopInstance runs until it is stopped
+type noopInstance struct {
+	stopped chan struct{}
+	once    sync.Once
+}
+
+func (i *noopInstance) Stop() error {
+	i.once.Do(func() { close(i.stopped) })
+	return nil
+}
+
+func (i *noopInstance) Wait(ctx context.Context) (int, error) {
+	select {
+	case <-i.stopped:
+		return 0, nil
+	case <-ctx.Done():
+		return 0, ctx.Err()
+	}
+}
+
+func TestKappaFunction_Start_NamesInstancesByGeneration(t *testing.T) {
+	binaryPath := filepath.Join(t.TempDir(), "main")
+	require.NoError(t, os.WriteFile(binaryPath, []byte("binary"), 0755))
+
+	backend := &recordingBackend{}
+	fn := NewKappaFunction("orders", binaryPath, "image", nil, 0)
+	fn.SetBackend(backend)
+	fn.SetVersion(3)
+	fn.SetSidecars([]Sidecar{{Name: "cache", Command: []string{"redis-server"}}})
+	defer fn.Stop()
+
+	require.NoError(t, fn.Start(context.Background()))
+	status := fn.StartStatus()
+	assert.Equal(t, 1, status.Generation)
+	assert.Equal(t, "orders-v3-r0-g1", status.Instance)
+	require.NoError(t, fn.Stop())
+	assert.Empty(t, fn.StartStatus().Instance)
+
+	// A restart is a new generation, not reusing the names of the last
+	require.NoError(t, fn.Start(context.Background()))
+	var names []string
+	for _, spec := range backend.specs {
+		names = append(names, spec.Name)
+	}
+	assert.Equal(t, []string{"orders-v3-r0-g1-sidecar-cache", "orders-v3-r0-g1", "orders-v3-r0-g2-sidecar-cache", "orders-v3-r0-g2"}, names)
+}
+
+type envResolverFunc func(ctx context.Context, env []string) ([]string, error)
+
+func (f envResolverFunc) ResolveEnv(ctx context.Context, env []string) ([]string, error) {
+	return f(ctx, env)
+}
+
+func TestKappaFunction_Start_ResolvesEnv(t *testing.T) {
+	binaryPath := filepath.Join(t.TempDir(), "main")
+	require.NoError(t, os.WriteFile(binaryPath, []byte("binary"), 0755))
+
+	backend := &recordingBackend{}
+	fn := NewKappaFunction("env-refs", binaryPath, "image", []string{"TOKEN=${secret:TOKEN}"}, 0)
+	fn.SetBackend(backend)
+	fn.SetEnvResolver(envResolverFunc(func(ctx context.Context, env []string) ([]string, error) {
+		return []string{"TOKEN=resolved"}, nil
+	}))
+
+	require.NoError(t, fn.Start(context.Background()))
+	defer fn.Stop()
+	require.Len(t, backend.specs, 1)
+	assert.Contains(t, backend.specs[0].Env, "TOKEN=resolved")
+	assert.Equal(t, []string{"TOKEN=${secret:TOKEN}"}, fn.Env, "the registered env keeps the reference")
+
+	require.NoError(t, fn.Stop())
+	fn.SetEnvResolver(envResolverFunc(func(ctx context.Context, env []string) ([]string, error) {
+		return nil, errors.New("secret not found")
+	}))
+	assert.ErrorContains(t, fn.Start(context.Background()), "secret not found")
+	assert.False(t, fn.IsRunning())
+}
+
+func TestKappaFunction_Start_TunesRuntimeServer(t *testing.T) {
+	binaryPath := filepath.Join(t.TempDir(), "main")
+	require.NoError(t, os.WriteFile(binaryPath, []byte("binary"), 0755))
+
+	backend := &recordingBackend{}
+	fn := NewKappaFunction("tuned", binaryPath, "image", []string{handler.EnvIdleTimeout + "=1000"}, 0)
+	fn.SetBackend(backend)
+	fn.SetTimeout(time.Minute)
+
+	require.NoError(t, fn.Start(context.Background()))
+	defer fn.Stop()
+	env := backend.specs[0].Env
+	assert.Contains(t, env, handler.EnvWriteTimeout+"=65000", "the function's timeout plus slack")
+	assert.Equal(t, handler.EnvIdleTimeout+"=1000", env[len(env)-1], "the function's env comes last to override")
+	assert.Equal(t, runtimeIdleConnTimeout, fn.httpClient().Transport.(*http.Transport).IdleConnTimeout)
+}
+
+func TestKappaFunction_Connect_PausesIdleTimer(t *testing.T) {
+	binaryPath := filepath.Join(t.TempDir(), "main")
+	require.NoError(t, os.WriteFile(binaryPath, []byte("binary"), 0755))
+
+	// Stands in for the runtime's server, which Connect waits for
+	listener, err := net.Listen("tcp", "localhost:0")
+	require.NoError(t, err)
+	defer listener.Close()
+	port := listener.Addr().(*net.TCPAddr).Port
+
+	fn := NewKappaFunction("sockets", binaryPath, "image", nil, port)
+	fn.SetBackend(&recordingBackend{})
+	fn.SetIdleTimeout(20 * time.Millisecond)
+	defer fn.Stop()
+
+	target, transport, release, err := fn.Connect(context.Background(), HTTP1)
+	require.NoError(t, err)
+	assert.Equal(t, fmt.Sprintf("localhost:%d", port), target.Host)
+	assert.NotNil(t, transport)
+	assert.Equal(t, 1, fn.Connections())
+
+	// Invocations arm the idle timer, which doesn't stop a connected function
+	fn.resetIdleTimer()
+	time.Sleep(100 * time.Millisecond)
+	assert.True(t, fn.IsRunning())
+
+	release()
+	release()
+	assert.Equal(t, 0, fn.Connections(), "releasing twice counts once")
+	require.Eventually(t, func() bool { return !fn.IsRunning() }, time.Second, 10*time.Millisecond)
+
+	fn.mode = ModeJob
+	_, _, _, err = fn.Connect(context.Background(), HTTP1)
+	assert.ErrorIs(t, err, ErrNoRuntime)
+}
+
+func TestReadinessBackoff(t *testing.T) {
+	first := readinessBackoff(0)
+	assert.GreaterOrEqual(t, first, readinessMinBackoff/2)
+	assert.LessOrEqual(t, first, readinessMinBackoff)
+	for _, probe := range []int{6, 10, 100} {
+		wait := readinessBackoff(probe)
+		assert.GreaterOrEqual(t, wait, readinessMaxBackoff/2)
+		assert.LessOrEqual(t, wait, readinessMaxBackoff)
+	}
+}
+
+func TestKappaFunction_WaitHealthy(t *testing.T) {
+	// A runtime that takes a few probes to become healthy
+	var probes atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/health", r.URL.Path)
+		if probes.Add(1) < 3 {
+			w.WriteHeader(http.StatusServiceUnavailable)
 		}
-	}()
+	}))
+	defer server.Close()
 
-	assert.False(t, fn.IsRunning(), "Function should not be running initially")
+	fn := NewKappaFunction("probed", "main", "image", nil, 0)
+	fn.isRunning = true
+	fn.containerURL = server.URL
+	started := time.Now()
+	require.NoError(t, fn.waitHealthy(context.Background()))
+	assert.Equal(t, int32(3), probes.Load())
+	assert.Less(t, time.Since(started), 500*time.Millisecond, "fast starts aren't kept waiting")
 
-	ctx := context.Background()
-	event := KappaEvent{
-		Body: map[string]any{"name": "AutoStartUser"},
+	// Probing gives up at the deadline, or once the runtime is gone
+	probes.Store(-100)
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	assert.ErrorContains(t, fn.waitHealthy(ctx), "runtime isn't ready: health check answered 503")
+	fn.isRunning = false
+	assert.ErrorIs(t, fn.waitHealthy(context.Background()), errExitedBeforeReady)
+}
+
+func TestKappaFunction_Start_RunsInitSteps(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("init step scripts need a posix shell")
 	}
-	resp, errInvoke := fn.Invoke(ctx, event)
-	if errInvoke != nil {
-		logs := fn.GetLogs()
-		t.Logf("Invoke (auto-start) failed. Function logs: %v", logs)
+	binaryPath := filepath.Join(t.TempDir(), "main")
+	require.NoError(t, os.WriteFile(binaryPath, []byte("#!/bin/sh\nexec sleep 60\n"), 0755))
+
+	fn := NewKappaFunction("with-init", binaryPath, "", nil, 9098)
+	fn.SetBackend(ProcessBackend{})
+	fn.SetInitSteps([]InitStep{
+		{Name: "download", Command: []string{"sh", "-c", "echo model > $KAPPA_SHARED_DIR/model"}},
+		{Name: "check", Command: []string{"sh", "-c", "cat $KAPPA_SHARED_DIR/model"}},
+	})
+	defer fn.Stop()
+
+	require.NoError(t, fn.Start(context.Background()))
+	assert.True(t, fn.IsRunning())
+	assert.Contains(t, fn.GetLogs(), "[init check] [stdout] model", "steps share a directory")
+	require.NoError(t, fn.Stop())
+
+	// A failing step aborts the start, saying why
+	fn.SetInitSteps([]InitStep{{Name: "migrate", Command: []string{"sh", "-c", "echo 'relation missing' >&2; exit 3"}}})
+	err := fn.Start(context.Background())
+	var startErr *StartError
+	require.ErrorAs(t, err, &startErr)
+	assert.ErrorContains(t, err, "init step migrate exited with code 3")
+	assert.Equal(t, []string{"[init migrate] [stderr] relation missing"}, startErr.Output)
+	assert.False(t, fn.IsRunning())
+	assert.Equal(t, 1, fn.StartStatus().ConsecutiveFailures)
+}
+
+func TestValidateInitSteps(t *testing.T) {
+	assert.NoError(t, ValidateInitSteps([]InitStep{{Name: "migrate", Command: []string{"migrate"}}}))
+	assert.ErrorContains(t, ValidateInitSteps([]InitStep{{Name: "Migrate", Command: []string{"migrate"}}}), "invalid step name")
+	assert.ErrorContains(t, ValidateInitSteps([]InitStep{{Name: "a", Command: []string{"x"}}, {Name: "a", Command: []string{"y"}}}), "duplicate")
+	assert.ErrorContains(t, ValidateInitSteps([]InitStep{{Name: "a"}}), "no command")
+}
+
+func TestKappaFunction_Start_RunsSidecars(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("sidecar scripts need a posix shell")
 	}
-	require.NoError(t, errInvoke, "fn.Invoke() failed on auto-start")
-	require.NotNil(t, resp)
+	binaryPath := filepath.Join(t.TempDir(), "main")
+	require.NoError(t, os.WriteFile(binaryPath, []byte("#!/bin/sh\nexec sleep 60\n"), 0755))
 
-	assert.True(t, fn.IsRunning(), "Function should be running after first Invoke")
-	assert.Equal(t, http.StatusOK, resp.StatusCode)
-	assert.Contains(t, resp.Body["message"], "AutoStartUser")
+	fn := NewKappaFunction("with-sidecar", binaryPath, "", nil, 9099)
+	fn.SetBackend(ProcessBackend{})
+	fn.SetSidecars([]Sidecar{
+		{Name: "cache", Command: []string{"sh", "-c", "echo \"$CACHE_SIZE\" > $KAPPA_SHARED_DIR/cache; echo ready; exec sleep 60"}, Env: []string{"CACHE_SIZE=64"}},
+	})
+	defer fn.Stop()
+
+	require.NoError(t, fn.Start(context.Background()))
+	assert.True(t, fn.IsRunning())
+	require.Eventually(t, func() bool {
+		return strings.Contains(strings.Join(fn.GetLogs(), "\n"), "[sidecar cache] [stdout] ready")
+	}, 5*time.Second, 10*time.Millisecond, "sidecar logs are labelled")
+	assert.Len(t, fn.Footprint().Instances, 2, "sidecars count as the function's")
+
+	require.NoError(t, fn.Stop())
+	assert.Empty(t, fn.Footprint().Instances)
+}
+
+func TestValidateSidecars(t *testing.T) {
+	assert.NoError(t, ValidateSidecars([]Sidecar{{Name: "redis", Command: []string{"redis-server"}}}))
+	assert.ErrorContains(t, ValidateSidecars([]Sidecar{{Name: "redis", Command: []string{"a"}}, {Name: "redis", Command: []string{"b"}}}), "duplicate")
+	assert.ErrorContains(t, ValidateSidecars([]Sidecar{{Name: "redis"}}), "no command")
+	assert.ErrorContains(t, ValidateSidecars([]Sidecar{{Name: "redis", Command: []string{"a"}, Env: []string{"PORT"}}}), "invalid env entry")
+}
+
+func TestDNSConfig_ResolvConf(t *testing.T) {
+	host := []byte("# from the host\nnameserver 10.0.0.2\nnameserver 10.0.0.3\nsearch corp.example\n")
+
+	config := DNSConfig{Search: []string{"svc.example", InternalDomain}, Options: []string{"ndots:2"}}
+	assert.Equal(t, "nameserver 10.0.0.2\nnameserver 10.0.0.3\nsearch svc.example kappa.internal\noptions ndots:2\n", string(config.resolvConf(host)), "nameservers default to the host's")
+	config = DNSConfig{Nameservers: []string{"1.1.1.1"}}
+	assert.Equal(t, "nameserver 1.1.1.1\n", string(config.resolvConf(host)))
+
+	assert.NoError(t, ValidateDNS(DNSConfig{Nameservers: []string{"1.1.1.1", "2606:4700::1111"}}))
+	assert.ErrorContains(t, ValidateDNS(DNSConfig{}), "expected nameservers")
+	assert.ErrorContains(t, ValidateDNS(DNSConfig{Nameservers: []string{"dns.example"}}), "invalid nameserver")
+	assert.ErrorContains(t, ValidateDNS(DNSConfig{Search: []string{"bad domain"}}), "invalid search domain")
+	assert.ErrorContains(t, ValidateDNS(DNSConfig{Options: []string{"ndots: 2"}}), "invalid option")
+}
+
+func TestDiscovery_Update(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "hosts")
+	d, err := NewDiscovery(path)
+	require.NoError(t, err)
+	before, err := os.Stat(path)
+	require.NoError(t, err)
+
+	require.NoError(t, d.Update([]string{"users", "orders"}))
+	hosts, err := os.ReadFile(path)
+	require.NoError(t, err)
+	assert.Contains(t, string(hosts), "# kappa functions\n127.0.0.1 orders.kappa.internal\n127.0.0.1 users.kappa.internal\n")
+
+	// Mounted instances keep seeing the file as it changes
+	after, err := os.Stat(path)
+	require.NoError(t, err)
+	assert.True(t, os.SameFile(before, after))
+
+	// Functions with extra hosts get their own file, kept up to date too
+	own, err := d.HostsFile("orders", map[string]string{"db.corp.example": "10.0.0.5"})
+	require.NoError(t, err)
+	assert.NotEqual(t, path, own)
+	require.NoError(t, d.Update([]string{"users", "orders", "billing"}))
+	hosts, err = os.ReadFile(own)
+	require.NoError(t, err)
+	assert.Contains(t, string(hosts), "127.0.0.1 billing.kappa.internal\n")
+	assert.True(t, strings.HasSuffix(string(hosts), "# extra hosts\n10.0.0.5 db.corp.example\n"))
+	hosts, err = os.ReadFile(path)
+	require.NoError(t, err)
+	assert.NotContains(t, string(hosts), "db.corp.example")
+
+	require.NoError(t, d.Update(nil))
+	hosts, err = os.ReadFile(path)
+	require.NoError(t, err)
+	assert.NotContains(t, string(hosts), "kappa.internal")
+	assert.NoFileExists(t, own, "deleted functions' files are removed")
+}
+
+func TestValidateExtraHosts(t *testing.T) {
+	assert.NoError(t, ValidateExtraHosts(map[string]string{"db.corp.example": "10.0.0.5", "cache": "fd00::5"}))
+	assert.ErrorContains(t, ValidateExtraHosts(map[string]string{"db corp": "10.0.0.5"}), "invalid hostname")
+	assert.ErrorContains(t, ValidateExtraHosts(map[string]string{"db": "corp"}), "invalid address")
+	assert.ErrorContains(t, ValidateExtraHosts(map[string]string{"users.kappa.internal": "10.0.0.5"}), "names functions")
+}
+
+func TestValidateRetryPolicy(t *testing.T) {
+	assert.NoError(t, ValidateRetryPolicy(DefaultRetryPolicy()))
+	assert.NoError(t, ValidateRetryPolicy(RetryPolicy{}), "zero attempts are one")
+	assert.NoError(t, ValidateRetryPolicy(RetryPolicy{MaxAttempts: MaxRetryAttempts, BackoffMs: MaxRetryBackoffMs}))
+	assert.ErrorContains(t, ValidateRetryPolicy(RetryPolicy{MaxAttempts: -1}), "maxAttempts")
+	assert.ErrorContains(t, ValidateRetryPolicy(RetryPolicy{MaxAttempts: MaxRetryAttempts + 1}), "maxAttempts")
+	assert.ErrorContains(t, ValidateRetryPolicy(RetryPolicy{MaxAttempts: 2, BackoffMs: -1}), "backoffMs")
+	assert.ErrorContains(t, ValidateRetryPolicy(RetryPolicy{MaxAttempts: 2, BackoffMs: MaxRetryBackoffMs + 1}), "backoffMs")
+}
+
+type stubMounter struct {
+	dir string
+	err error
+}
+
+func (m stubMounter) MountDir(ctx context.Context, digest string) (string, error) {
+	return m.dir, m.err
 }
 
-func TestKappaFunction_IdleTimeout(t *testing.T) {
-	binaryPath := setupKappaTest(t)
-	fnName := "idle-timeout-" + filepath.Base(t.Name())
-	if len(fnName) > 75 {
-		fnName = fnName[0:74]
+func TestKappaFunction_BinaryLaunch_SharesMountedBinary(t *testing.T) {
+	binaryPath := filepath.Join(t.TempDir(), "main")
+	require.NoError(t, os.WriteFile(binaryPath, []byte("binary"), 0755))
+	fn := NewKappaFunction("mounted", binaryPath, "", nil, 9100)
+	fn.ArtifactDigest = "9a3a45d01531a20e89ac6ae10b0b0beb0492acd7216a368aa062d1a5fecaf9cd"
+
+	shared := t.TempDir()
+	fn.SetBinaryMounter(stubMounter{dir: shared})
+	launch, err := fn.binaryLaunch(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, shared, launch.Mounts[0].Source)
+	assert.Empty(t, launch.TmpDirs, "the shared directory outlives the instance")
+
+	// Without a shared copy the binary is copied for the instance
+	fn.SetBinaryMounter(stubMounter{err: errors.New("no space left on device")})
+	launch, err = fn.binaryLaunch(context.Background())
+	require.NoError(t, err)
+	defer removeAll(launch.TmpDirs)
+	assert.Equal(t, []string{launch.Mounts[0].Source}, launch.TmpDirs)
+	assert.FileExists(t, filepath.Join(launch.Mounts[0].Source, "main"))
+}
+
+func TestKappaFunction_Start_BacksOffAfterFailures(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("crashing runtime script needs a posix shell")
 	}
-	fn := NewKappaFunction(fnName, binaryPath, testKappaImage, nil, 9094)
-	defer func() {
-		if fn.IsRunning() {
-			_ = fn.Stop()
+	// A runtime that dies before serving anything
+	binaryPath := filepath.Join(t.TempDir(), "main")
+	require.NoError(t, os.WriteFile(binaryPath, []byte("#!/bin/sh\necho starting\necho \"missing module 'left-pad'\" >&2\nexit 2\n"), 0755))
+
+	fn := NewKappaFunction("crashing", binaryPath, "", nil, 9096)
+	fn.SetBackend(ProcessBackend{})
+	defer fn.Stop()
+
+	require.NoError(t, fn.Start(context.Background()))
+	require.Eventually(t, func() bool { return !fn.IsRunning() }, 5*time.Second, 10*time.Millisecond)
+
+	status := fn.StartStatus()
+	assert.Equal(t, 1, status.ConsecutiveFailures)
+	assert.Contains(t, status.LastError, "exited with code 2")
+	assert.ElementsMatch(t, []string{"[stdout] starting", "[stderr] missing module 'left-pad'"}, status.LastOutput)
+	require.NotNil(t, status.RetryAt)
+
+	// Further starts wait out the backoff instead of trying again, saying why
+	err := fn.Start(context.Background())
+	assert.ErrorIs(t, err, ErrStartBackoff)
+	assert.ErrorContains(t, err, "exited with code 2")
+	assert.ErrorContains(t, err, "missing module 'left-pad'")
+
+	// Once it is due the next failure doubles the wait
+	fn.isRunningMu.Lock()
+	fn.startFailures.retryAt = time.Now()
+	fn.isRunningMu.Unlock()
+	require.NoError(t, fn.Start(context.Background()))
+	require.Eventually(t, func() bool { return fn.StartStatus().ConsecutiveFailures == 2 }, 5*time.Second, 10*time.Millisecond)
+	status = fn.StartStatus()
+	assert.WithinDuration(t, status.LastFailureAt.Add(2*startBackoffBase), *status.RetryAt, time.Millisecond)
+
+	fn.markHealthy()
+	assert.Zero(t, fn.StartStatus().ConsecutiveFailures)
+}
+
+func TestOutputTail_KeepsLastLines(t *testing.T) {
+	var tail outputTail
+	for i := range startOutputLines + 5 {
+		tail.add(fmt.Sprintf("line %d", i))
+	}
+	lines := tail.Lines()
+	require.Len(t, lines, startOutputLines)
+	assert.Equal(t, "line 5", lines[0])
+	assert.Equal(t, fmt.Sprintf("line %d", startOutputLines+4), lines[len(lines)-1])
+
+	err := &StartError{Err: errors.New("exec format error"), Output: []string{"a", "b"}}
+	assert.Equal(t, "exec format error, last output:\na\nb", err.Error())
+}
+
+func TestKappaFunction_Invoke_External(t *testing.T) {
+	var auth string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		auth = r.Header.Get("Authorization")
+		w.Header().Set(handler.HeaderResponseFormat, handler.ResponseFormatRaw)
+		w.Write([]byte(`{"ok":true}`))
+	}))
+	defer server.Close()
+
+	fn := NewKappaFunction("external", "", "", nil, 0)
+	fn.SetMode(ModeExternal)
+	_, err := fn.Invoke(context.Background(), KappaEvent{})
+	assert.ErrorIs(t, err, ErrNotAttached)
+	assert.False(t, fn.IsRunning())
+
+	require.NoError(t, fn.Attach(server.URL+"/", "runtime-token", time.Minute))
+	assert.True(t, fn.IsRunning())
+	resp, err := fn.Invoke(context.Background(), KappaEvent{})
+	require.NoError(t, err)
+	assert.Equal(t, true, decodeBody(t, resp)["ok"])
+	assert.Equal(t, "Bearer runtime-token", auth)
+
+	attached, ok := fn.Attached()
+	require.True(t, ok)
+	assert.Equal(t, server.URL, attached.URL)
+
+	assert.False(t, fn.Detach("http://elsewhere:8080"))
+	assert.True(t, fn.Detach(server.URL))
+	_, err = fn.Invoke(context.Background(), KappaEvent{})
+	assert.ErrorIs(t, err, ErrNotAttached)
+
+	// Runtimes that don't renew their lease are no longer invoked
+	require.NoError(t, fn.Attach(server.URL, "", -time.Second))
+	_, err = fn.Invoke(context.Background(), KappaEvent{})
+	assert.ErrorIs(t, err, ErrNotAttached)
+
+	assert.Error(t, fn.Attach("localhost:8080", "", time.Minute))
+	assert.Error(t, NewKappaFunction("managed", "", "", nil, 0).Attach(server.URL, "", time.Minute))
+}
+
+func TestKappaFunction_Invoke_ConcurrencyLimit(t *testing.T) {
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+		w.Header().Set(handler.HeaderResponseFormat, handler.ResponseFormatRaw)
+		w.Write([]byte(`{"ok":true}`))
+	}))
+	defer server.Close()
+
+	fn := NewKappaFunction("limited", "", "", nil, 0)
+	fn.SetMode(ModeExternal)
+	require.NoError(t, fn.Attach(server.URL, "", time.Minute))
+	fn.SetConcurrency(1, 1)
+
+	// One invocation runs and one waits for it
+	errs := make(chan error, 2)
+	for range 2 {
+		go func() {
+			_, err := fn.Invoke(context.Background(), KappaEvent{})
+			errs <- err
+		}()
+	}
+	require.Eventually(t, func() bool {
+		stats, _ := fn.Concurrency()
+		return stats.InFlight == 1 && stats.Queued == 1
+	}, 5*time.Second, 10*time.Millisecond)
+
+	_, err := fn.Invoke(context.Background(), KappaEvent{})
+	assert.ErrorIs(t, err, ErrConcurrencyLimit, "the queue is full")
+
+	// Queued invocations give up with their context
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	fn.concurrency.queue = 2
+	_, err = fn.Invoke(ctx, KappaEvent{})
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+
+	close(release)
+	for range 2 {
+		assert.NoError(t, <-errs)
+	}
+	stats, limited := fn.Concurrency()
+	require.True(t, limited)
+	assert.Equal(t, ConcurrencyStats{MaxConcurrency: 1, QueueDepth: 2}, stats)
+
+	fn.SetConcurrency(0, 0)
+	_, limited = fn.Concurrency()
+	assert.False(t, limited)
+}
+
+func TestKappaFunction_Invoke_Disabled(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set(handler.HeaderResponseFormat, handler.ResponseFormatRaw)
+		w.Write([]byte(`{"ok":true}`))
+	}))
+	defer server.Close()
+
+	fn := NewKappaFunction("migrating", "", "", nil, 0)
+	fn.SetMode(ModeExternal)
+	require.NoError(t, fn.Attach(server.URL, "", time.Minute))
+
+	now := time.Now()
+	past, soon, later := now.Add(-time.Hour), now.Add(time.Hour), now.Add(2*time.Hour)
+	fn.SetDisabled([]DisabledWindow{
+		{From: &past, Until: &soon, Message: "database migration"},
+		{From: &past, Until: &later, Message: "extended"},
+		{From: &later},
+	})
+
+	_, err := fn.Invoke(context.Background(), KappaEvent{})
+	var disabled *DisabledError
+	require.ErrorAs(t, err, &disabled)
+	assert.ErrorIs(t, err, ErrDisabled)
+	assert.Equal(t, "extended", disabled.Window.Message, "the window ending last is reported")
+	assert.ErrorContains(t, err, "until "+later.Format(time.RFC3339))
+
+	// Windows that haven't started or are over leave the function enabled
+	_, disabledNow := fn.DisabledAt(later.Add(-time.Minute))
+	assert.True(t, disabledNow)
+	_, disabledNow = fn.DisabledAt(past.Add(-time.Minute))
+	assert.False(t, disabledNow)
+
+	fn.SetDisabled(nil)
+	_, err = fn.Invoke(context.Background(), KappaEvent{})
+	assert.NoError(t, err)
+}
+
+func TestKappaFunction_FollowLogs(t *testing.T) {
+	fn := NewKappaFunction("chatty", "", "", nil, 0)
+	fn.appendLog("before")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	backlog, lines := fn.FollowLogs(ctx)
+	assert.Equal(t, []string{"before"}, backlog)
+
+	fn.appendLog("after")
+	assert.Equal(t, "after", <-lines)
+
+	// Slow followers miss lines instead of blocking the function
+	for i := range logFollowBuffer + 10 {
+		fn.appendLog(fmt.Sprintf("line %d", i))
+	}
+	assert.Len(t, lines, logFollowBuffer)
+
+	cancel()
+	require.Eventually(t, func() bool {
+		fn.logsMu.Lock()
+		defer fn.logsMu.Unlock()
+		return len(fn.logFollowers) == 0
+	}, time.Second, 10*time.Millisecond)
+	for range lines {
+	}
+}
+
+func TestKappaFunction_Invoke_InvocationLogs(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set(handler.HeaderResponseFormat, handler.ResponseFormatRaw)
+		w.Write([]byte(`{"ok":true}`))
+	}))
+	defer server.Close()
+
+	fn := NewKappaFunction("reported", "", "", nil, 0)
+	fn.SetMode(ModeExternal)
+	fn.SetMemoryLimit(128)
+	fn.SetVersion(3)
+	require.NoError(t, fn.Attach(server.URL, "", time.Minute))
+
+	_, err := fn.Invoke(context.Background(), KappaEvent{RequestID: "req-1"})
+	require.NoError(t, err)
+	assert.Empty(t, fn.GetLogs(), "invocation lines are opt in")
+
+	fn.SetInvocationLogs(true)
+	_, err = fn.Invoke(context.Background(), KappaEvent{RequestID: "req-2"})
+	require.NoError(t, err)
+	logs := fn.GetLogs()
+	require.Len(t, logs, 3)
+	assert.Equal(t, "START RequestId: req-2 Version: 3", logs[0])
+	assert.Equal(t, "END RequestId: req-2", logs[1])
+	assert.Regexp(t, `^REPORT RequestId: req-2\tDuration: \d+\.\d{2} ms\tMemory Size: 128 MB$`, logs[2])
+}
+
+func TestKappaFunction_SetLogLevel(t *testing.T) {
+	var got []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != handler.LogLevelPath {
+			http.NotFound(w, r)
+			return
 		}
-		if fn.container != nil {
-			_ = fn.container.Remove()
+		var body map[string]string
+		json.NewDecoder(r.Body).Decode(&body)
+		got = append(got, r.Method+" "+body["level"])
+		json.NewEncoder(w).Encode(body)
+	}))
+	defer server.Close()
+
+	fn := NewKappaFunction("chatty", "", "", nil, 0)
+	fn.SetMode(ModeExternal)
+	applied, err := fn.SetLogLevel(context.Background(), "debug")
+	require.NoError(t, err)
+	assert.False(t, applied, "nothing is told while no runtime serves")
+	assert.Equal(t, []string{handler.EnvLogLevel + "=debug"}, fn.logLevelEnv())
+
+	require.NoError(t, fn.Attach(server.URL, "", time.Minute))
+	applied, err = fn.SetLogLevel(context.Background(), "warn")
+	require.NoError(t, err)
+	assert.True(t, applied)
+	assert.Equal(t, []string{"PUT warn"}, got)
+
+	// Runtimes not built on the handler package can't change their level
+	require.NoError(t, fn.Attach(server.URL+"/elsewhere", "", time.Minute))
+	_, err = fn.SetLogLevel(context.Background(), "info")
+	assert.ErrorContains(t, err, handler.LogLevelPath)
+}
+
+func TestKappaFunction_Clock(t *testing.T) {
+	assert.Error(t, ValidateClock(ClockConfig{}))
+	assert.ErrorContains(t, ValidateClock(ClockConfig{Timezone: "Mars/Olympus"}), "unknown timezone")
+	assert.ErrorContains(t, ValidateClock(ClockConfig{Locale: "en US"}), "invalid locale")
+	assert.NoError(t, ValidateClock(ClockConfig{Timezone: "UTC", Locale: "en_US.UTF-8"}))
+
+	fn := NewKappaFunction("clocked", "", "", nil, 0)
+	assert.Empty(t, fn.clockEnv())
+	fn.SetClock(&ClockConfig{Timezone: "UTC", Locale: "de_DE.UTF-8"})
+	assert.Equal(t, []string{"TZ=UTC", "LANG=de_DE.UTF-8", "LC_ALL=de_DE.UTF-8"}, fn.clockEnv())
+	launch := &Launch{}
+	require.NoError(t, fn.configureClock(launch))
+	assert.Empty(t, launch.Mounts, "localtime is only mounted when asked to")
+	if _, err := os.Stat(filepath.Join(zoneinfoDir, "UTC")); err == nil {
+		fn.SetClock(&ClockConfig{Timezone: "UTC", MountLocaltime: true})
+		require.NoError(t, fn.configureClock(launch))
+		require.Len(t, launch.Mounts, 1)
+		assert.Equal(t, localtimePath, launch.Mounts[0].Destination)
+	}
+
+	_, err := fn.Clock(context.Background())
+	assert.ErrorIs(t, err, ErrNotRunning, "runtimes aren't started to read their clock")
+
+	// The runtime's clock runs an hour ahead
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]any{"time": time.Now().Add(time.Hour), "timezone": "UTC", "locale": "de_DE.UTF-8"})
+	}))
+	defer server.Close()
+	fn.SetMode(ModeExternal)
+	require.NoError(t, fn.Attach(server.URL, "", time.Minute))
+	clock, err := fn.Clock(context.Background())
+	require.NoError(t, err)
+	assert.InDelta(t, time.Hour, clock.Skew, float64(time.Second))
+	assert.Equal(t, "UTC", clock.Timezone)
+	assert.Equal(t, "de_DE.UTF-8", clock.Locale)
+}
+
+func TestKappaFunction_LastInvoked(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set(handler.HeaderResponseFormat, handler.ResponseFormatRaw)
+		w.Write([]byte(`{}`))
+	}))
+	defer server.Close()
+
+	fn := NewKappaFunction("counted", "", "", nil, 0)
+	fn.SetMode(ModeExternal)
+	assert.True(t, fn.LastInvoked().IsZero())
+	require.NoError(t, fn.Attach(server.URL, "", time.Minute))
+
+	before := time.Now()
+	for i := 0; i < 2; i++ {
+		_, err := fn.Invoke(context.Background(), KappaEvent{})
+		require.NoError(t, err)
+	}
+	assert.Equal(t, int64(2), fn.RequestsProcessed())
+	assert.WithinRange(t, fn.LastInvoked(), before, time.Now())
+}
+
+func TestKappaFunction_TimeoutGrace(t *testing.T) {
+	release := make(chan struct{})
+	var signalled atomic.Pointer[string]
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == handler.TimeoutPath {
+			var body struct {
+				RequestID string `json:"requestId"`
+				GraceMs   int    `json:"graceMs"`
+			}
+			json.NewDecoder(r.Body).Decode(&body)
+			signalled.Store(&body.RequestID)
+			json.NewEncoder(w).Encode(handler.PartialResult{RequestID: body.RequestID, Partial: map[string]int{"rows": 40}, ElapsedMs: 100})
+			return
+		}
+		select {
+		case <-release:
+		case <-r.Context().Done():
 		}
+	}))
+	defer server.Close()
+	defer close(release)
+
+	fn := NewKappaFunction("slow", "", "", nil, 0)
+	fn.SetMode(ModeExternal)
+	fn.SetTimeout(100 * time.Millisecond)
+	require.NoError(t, fn.Attach(server.URL, "", time.Minute))
+	for i := range 25 {
+		fn.appendLog(fmt.Sprintf("line %d", i))
+	}
+
+	_, err := fn.Invoke(context.Background(), KappaEvent{RequestID: "req-1"})
+	var timeoutErr *TimeoutError
+	require.ErrorAs(t, err, &timeoutErr)
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+	assert.Nil(t, timeoutErr.Partial, "runtimes without a grace period aren't asked")
+	assert.Nil(t, signalled.Load())
+	require.Len(t, timeoutErr.Logs, timeoutLogLines)
+	assert.Equal(t, "line 24", timeoutErr.Logs[timeoutLogLines-1])
+
+	fn.SetTimeoutGrace(500 * time.Millisecond)
+	_, err = fn.Invoke(context.Background(), KappaEvent{RequestID: "req-2"})
+	require.ErrorAs(t, err, &timeoutErr)
+	require.NotNil(t, timeoutErr.Partial)
+	assert.Equal(t, "req-2", *signalled.Load())
+	assert.Equal(t, map[string]any{"rows": float64(40)}, timeoutErr.Partial.Partial)
+}
+
+func TestKappaFunction_Warm_KeepsInstanceStarted(t *testing.T) {
+	binaryPath := filepath.Join(t.TempDir(), "main")
+	require.NoError(t, os.WriteFile(binaryPath, []byte("binary"), 0755))
+
+	fn := NewKappaFunction("warm", binaryPath, "image", nil, 0)
+	fn.SetBackend(&recordingBackend{})
+	fn.SetIdleTimeout(20 * time.Millisecond)
+	fn.SetWarm(true)
+	defer fn.Stop()
+
+	require.NoError(t, fn.Start(context.Background()))
+	time.Sleep(100 * time.Millisecond)
+	assert.True(t, fn.IsRunning(), "warm functions aren't stopped when idle")
+
+	fn.SetWarm(false)
+	assert.False(t, fn.Warm())
+	require.Eventually(t, func() bool { return !fn.IsRunning() }, time.Second, 10*time.Millisecond, "cooling down starts the idle timeout over")
+}
+
+func TestKappaFunction_Drain(t *testing.T) {
+	started := make(chan struct{})
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		started <- struct{}{}
+		<-release
+		w.Write([]byte(`{}`))
+	}))
+	defer server.Close()
+
+	fn := NewKappaFunction("busy", "", "", nil, 0)
+	fn.SetMode(ModeExternal)
+	require.NoError(t, fn.Attach(server.URL, "", time.Minute))
+	require.NoError(t, fn.Drain(context.Background()), "nothing in flight drains at once")
+	_, err := fn.Invoke(context.Background(), KappaEvent{})
+	assert.ErrorIs(t, err, ErrDraining)
+
+	fn = NewKappaFunction("busy", "", "", nil, 0)
+	fn.SetMode(ModeExternal)
+	require.NoError(t, fn.Attach(server.URL, "", time.Minute))
+	done := make(chan error, 1)
+	go func() {
+		_, err := fn.Invoke(context.Background(), KappaEvent{})
+		done <- err
 	}()
+	<-started
+	assert.Equal(t, 1, fn.InFlight())
 
-	idleTestTimeout := 2 * time.Second // Short timeout for test, ensure it's longer than typical startup
-	fn.SetIdleTimeout(idleTestTimeout)
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	assert.ErrorIs(t, fn.Drain(ctx), context.DeadlineExceeded, "draining gives up with its context")
+	_, err = fn.Invoke(context.Background(), KappaEvent{})
+	assert.ErrorIs(t, err, ErrDraining, "new invocations are turned away")
 
-	ctx := context.Background()
-	err := fn.Start(ctx)
-	require.NoError(t, err, "Failed to start function for idle test: %v", err)
-	assert.True(t, fn.IsRunning(), "Function should be running after start")
+	drained := make(chan error, 1)
+	go func() { drained <- fn.Drain(context.Background()) }()
+	close(release)
+	require.NoError(t, <-done, "invocations in flight finish")
+	require.NoError(t, <-drained)
+	assert.Zero(t, fn.InFlight())
+}
 
-	// Wait for longer than idle timeout, ensure this wait also accommodates container startup
-	time.Sleep(idleTestTimeout + 1*time.Second)
+type usageFunc func(Usage)
 
-	assert.False(t, fn.IsRunning(), "Function should be stopped by idle timeout")
+func (f usageFunc) RecordUsage(u Usage) { f(u) }
 
-	// Try to invoke again, it should restart
-	event := KappaEvent{Body: map[string]any{"name": "AfterIdle"}}
-	resp, errInvoke := fn.Invoke(ctx, event)
-	if errInvoke != nil {
-		logs := fn.GetLogs() // Logs from previous run might be gone, these are from new run
-		t.Logf("Invoke (after idle) failed. Function logs: %v", logs)
-	}
-	require.NoError(t, errInvoke, "Invoke after idle stop failed")
-	require.NotNil(t, resp)
-	assert.True(t, fn.IsRunning(), "Function should restart on invoke after idle stop")
-	assert.Contains(t, resp.Body["message"], "AfterIdle")
+func TestKappaFunction_Invoke_Stream(t *testing.T) {
+	events := "data: one\n\ndata: two\n\n"
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set(handler.HeaderResponseFormat, handler.ResponseFormatRaw)
+		w.Header().Set(handler.HeaderResponseStream, "true")
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Write([]byte(events))
+	}))
+	defer server.Close()
+
+	var recorded []Usage
+	fn := NewKappaFunction("tokens", "", "", nil, 0)
+	fn.isRunning = true
+	fn.containerURL = server.URL
+	fn.SetUsageRecorder(usageFunc(func(u Usage) { recorded = append(recorded, u) }))
+	defer fn.cancelIdleTimer()
+
+	// Without asking for streams the body is read whole
+	resp, err := fn.Invoke(context.Background(), KappaEvent{})
+	require.NoError(t, err)
+	assert.Nil(t, resp.Stream)
+	assert.Equal(t, events, string(resp.Body))
+	require.Len(t, recorded, 1)
+
+	resp, err = fn.Invoke(WithStreaming(context.Background()), KappaEvent{})
+	require.NoError(t, err)
+	require.NotNil(t, resp.Stream)
+	assert.Empty(t, resp.Body)
+	assert.Equal(t, "text/event-stream", resp.Headers["Content-Type"])
+	assert.NotContains(t, resp.Headers, handler.HeaderResponseStream)
+	assert.Equal(t, 1, fn.InFlight(), "the invocation lasts while its stream is read")
+	assert.Equal(t, 1, fn.Connections(), "the function isn't idle while its stream is read")
+	assert.Len(t, recorded, 1)
+
+	body, err := io.ReadAll(resp.Stream)
+	require.NoError(t, err)
+	assert.Equal(t, events, string(body))
+	require.NoError(t, resp.Stream.Close())
+	assert.Zero(t, fn.InFlight())
+	assert.Zero(t, fn.Connections())
+	require.Len(t, recorded, 2)
+	assert.Equal(t, len(events), recorded[1].EgressBytes)
+	assert.Equal(t, http.StatusOK, recorded[1].StatusCode)
 }
 
+func TestKappaFunction_Health(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/health", r.URL.Path)
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusServiceUnavailable)
+		w.Write([]byte(`{"db":"down"}`))
+	}))
+	defer server.Close()
+
+	fn := NewKappaFunction("health", "", "", nil, 0)
+	_, err := fn.Health(context.Background())
+	assert.ErrorIs(t, err, ErrNotRunning, "stopped functions aren't started to ask")
+
+	fn.isRunning = true
+	fn.containerURL = server.URL
+	health, err := fn.Health(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusServiceUnavailable, health.StatusCode)
+	assert.Equal(t, "application/json", health.ContentType)
+	assert.JSONEq(t, `{"db":"down"}`, string(health.Body))
+
+	fn.SetMode(ModeJob)
+	_, err = fn.Health(context.Background())
+	assert.ErrorIs(t, err, ErrNoRuntime)
+}
+
+func TestKappaFunction_Invoke_Panic(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set(handler.HeaderResponseFormat, handler.ResponseFormatRaw)
+		w.Header().Set(handler.HeaderHandlerPanic, "true")
+		w.Header().Set(handler.HeaderRequestID, "req-1")
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(handler.Panic{Message: "boom", Stack: "main.handle()\n\t/src/main.go:12 +0x1d\n"})
+	}))
+	defer server.Close()
+
+	var recorded []Usage
+	fn := NewKappaFunction("panics", "", "", nil, 0)
+	fn.isRunning = true
+	fn.containerURL = server.URL
+	fn.SetVersion(3)
+	fn.SetUsageRecorder(usageFunc(func(u Usage) { recorded = append(recorded, u) }))
+	defer fn.cancelIdleTimer()
+
+	resp, err := fn.Invoke(context.Background(), KappaEvent{})
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusInternalServerError, resp.StatusCode)
+	assert.NotContains(t, resp.Headers, handler.HeaderHandlerPanic)
+	assert.JSONEq(t, `{"error":"Function panicked","requestId":"req-1"}`, string(resp.Body))
+	require.NotNil(t, resp.Panic)
+	assert.Equal(t, "boom", resp.Panic.Message)
+
+	require.Len(t, recorded, 1)
+	assert.Equal(t, resp.Panic, recorded[0].Panic)
+	assert.Equal(t, 3, recorded[0].Version)
+}
+
+func TestKappaFunction_RestartLazily(t *testing.T) {
+	binaryPath := filepath.Join(t.TempDir(), "main")
+	require.NoError(t, os.WriteFile(binaryPath, []byte("binary"), 0755))
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/health" {
+			<-release
+		}
+		w.Write([]byte(`{}`))
+	}))
+	defer server.Close()
+	port, err := strconv.Atoi(server.URL[strings.LastIndex(server.URL, ":")+1:])
+	require.NoError(t, err)
+
+	backend := &recordingBackend{}
+	fn := NewKappaFunction("env", binaryPath, "image", []string{"MODE=old"}, port)
+	fn.SetBackend(backend)
+	defer fn.Stop()
+
+	fn.RestartLazily()
+	assert.False(t, fn.RestartPending(), "stopped functions pick up settings when they start")
+
+	require.NoError(t, fn.Start(context.Background()))
+	done := make(chan error, 1)
+	go func() {
+		_, err := fn.Invoke(context.Background(), KappaEvent{})
+		done <- err
+	}()
+	require.Eventually(t, func() bool { return fn.InFlight() == 1 }, time.Second, 10*time.Millisecond)
+
+	fn.SetEnv([]string{"MODE=new"})
+	fn.RestartLazily()
+	assert.True(t, fn.RestartPending())
+	assert.True(t, fn.IsRunning(), "invocations in flight aren't cut short")
+	close(release)
+	require.NoError(t, <-done)
+	require.Len(t, backend.specs, 1)
+
+	// The next invocation replaces the instance before it is sent
+	_, err = fn.Invoke(context.Background(), KappaEvent{})
+	require.NoError(t, err)
+	assert.False(t, fn.RestartPending())
+	require.Len(t, backend.specs, 2)
+	assert.Contains(t, backend.specs[1].Env, "MODE=new")
+	assert.Equal(t, 2, fn.StartStatus().Generation)
+}
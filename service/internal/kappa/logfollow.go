@@ -0,0 +1,43 @@
+package kappa
+
+import "context"
+
+// logFollowBuffer is how many lines a follower may fall behind before lines
+// are dropped for it
+const logFollowBuffer = 256
+
+// FollowLogs returns the function's retained log lines and a channel of the
+// lines written after them, closed once ctx ends. Followers falling too far
+// behind miss lines rather than holding up the function.
+func (lf *KappaFunction) FollowLogs(ctx context.Context) ([]string, <-chan string) {
+	lines := make(chan string, logFollowBuffer)
+
+	lf.logsMu.Lock()
+	backlog := make([]string, len(lf.logs))
+	copy(backlog, lf.logs)
+	if lf.logFollowers == nil {
+		lf.logFollowers = make(map[chan string]struct{})
+	}
+	lf.logFollowers[lines] = struct{}{}
+	lf.logsMu.Unlock()
+
+	go func() {
+		<-ctx.Done()
+		lf.logsMu.Lock()
+		delete(lf.logFollowers, lines)
+		close(lines)
+		lf.logsMu.Unlock()
+	}()
+	return backlog, lines
+}
+
+// sendToFollowers hands a new line to every follower keeping up, with
+// logsMu held.
+func (lf *KappaFunction) sendToFollowers(line string) {
+	for follower := range lf.logFollowers {
+		select {
+		case follower <- line:
+		default:
+		}
+	}
+}
@@ -0,0 +1,77 @@
+package kappa
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"kappa-v2/pkg/handler"
+	"net/http"
+	"strings"
+)
+
+// SetLogLevel sets the level the function's runtime logs at. Instances
+// started from now on get it in their environment, and a runtime already
+// serving is told through its control endpoint, so debug logs don't take
+// a redeploy. It reports whether a running runtime took the new level.
+func (lf *KappaFunction) SetLogLevel(ctx context.Context, level string) (bool, error) {
+	lf.logLevel.Store(&level)
+	lf.isRunningMu.Lock()
+	var baseURL string
+	var client *http.Client
+	switch lf.mode {
+	case ModeExternal:
+		if a := lf.attachedLocked(); a != nil {
+			baseURL, client = a.url, a.client
+		}
+	case ModeHTTP:
+		if lf.isRunning {
+			baseURL, client = lf.containerURL, lf.httpClient()
+		}
+	}
+	lf.isRunningMu.Unlock()
+
+	// Jobs and TCP runtimes only read the level as they start
+	if baseURL == "" || level == "" {
+		return false, nil
+	}
+	if err := signalLogLevel(ctx, client, baseURL, level); err != nil {
+		return false, fmt.Errorf("failed to change the runtime's log level: %w", err)
+	}
+	return true, nil
+}
+
+// logLevelEnv is the environment setting the runtime's log level, if any.
+func (lf *KappaFunction) logLevelEnv() []string {
+	level := lf.logLevel.Load()
+	if level == nil || *level == "" {
+		return nil
+	}
+	return []string{handler.EnvLogLevel + "=" + *level}
+}
+
+func signalLogLevel(ctx context.Context, client *http.Client, baseURL, level string) error {
+	body, err := json.Marshal(map[string]string{"level": level})
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, baseURL+handler.LogLevelPath, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return fmt.Errorf("the runtime has no %s endpoint", handler.LogLevelPath)
+	}
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("runtime answered %d: %s", resp.StatusCode, strings.TrimSpace(string(msg)))
+	}
+	return nil
+}
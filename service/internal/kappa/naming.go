@@ -0,0 +1,26 @@
+package kappa
+
+import "fmt"
+
+// SetVersion sets the version the function was registered as, which its
+// instances are named after.
+func (lf *KappaFunction) SetVersion(version int) {
+	lf.version = version
+}
+
+// versionedName is the function's name with its version, when it has one
+func (lf *KappaFunction) versionedName() string {
+	if lf.version == 0 {
+		return lf.Name
+	}
+	return fmt.Sprintf("%s-v%d", lf.Name, lf.version)
+}
+
+// instanceName names the instance of the current start, like
+// orders-v3-r0-g2. Its init steps and sidecars are named after it. Functions
+// run a single replica, so the replica index is always 0, and the generation
+// counts the function's starts so a replacement never takes the name of an
+// instance still going away. The caller must hold isRunningMu.
+func (lf *KappaFunction) instanceName() string {
+	return fmt.Sprintf("%s-r0-g%d", lf.versionedName(), lf.generation)
+}
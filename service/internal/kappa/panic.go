@@ -0,0 +1,26 @@
+package kappa
+
+import (
+	"encoding/json"
+	"kappa-v2/pkg/handler"
+)
+
+// takePanic moves the panic a runtime answered with into the response's
+// Panic, leaving the caller a body that doesn't give away the handler's
+// stack.
+func takePanic(resp *KappaResponse) {
+	if resp.Headers[handler.HeaderHandlerPanic] == "" || resp.Spilled != nil {
+		return
+	}
+	delete(resp.Headers, handler.HeaderHandlerPanic)
+	var p handler.Panic
+	if err := json.Unmarshal(resp.Body, &p); err != nil {
+		p.Message = string(resp.Body)
+	}
+	resp.Panic = &p
+	resp.Headers["Content-Type"] = "application/json"
+	resp.Body, _ = json.Marshal(map[string]string{
+		"error":     "Function panicked",
+		"requestId": resp.RequestID,
+	})
+}
@@ -0,0 +1,64 @@
+package kappa
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/opencontainers/runtime-spec/specs-go"
+)
+
+// Launch describes how to run a function whose runtime was set up by a Preparer.
+type Launch struct {
+	Image   string
+	Command []string
+	Env     []string
+	Mounts  []specs.Mount
+	WorkDir string
+	// TmpDirs are removed when the function stops
+	TmpDirs []string
+	// ResolvConf and Hosts replace the host's /etc/resolv.conf and
+	// /etc/hosts when set
+	ResolvConf string
+	Hosts      string
+}
+
+// Preparer sets up what a function needs before it can start, such as
+// installing dependencies for interpreted runtimes, and says how to launch it.
+// It replaces the default of running BinaryPath as /app/main in Image.
+type Preparer interface {
+	Prepare(ctx context.Context, backend Backend, name string) (*Launch, error)
+}
+
+// SetPreparer sets up the function to be launched through p.
+func (lf *KappaFunction) SetPreparer(p Preparer) {
+	lf.preparer = p
+}
+
+// RunToCompletion runs spec on backend and waits for it to exit, failing on a
+// non-zero exit code. It is used for one-off setup steps like dependency installs.
+func RunToCompletion(ctx context.Context, backend Backend, spec RunSpec) error {
+	instance, err := backend.Run(spec)
+	if err != nil {
+		return err
+	}
+	defer instance.Stop()
+
+	code, err := instance.Wait(ctx)
+	if err != nil {
+		return err
+	}
+	if code != 0 {
+		return &ExitError{Name: spec.Name, Code: code}
+	}
+	return nil
+}
+
+// ExitError is returned when a one-off step exits unsuccessfully.
+type ExitError struct {
+	Name string
+	Code int
+}
+
+func (e *ExitError) Error() string {
+	return fmt.Sprintf("%s exited with code %d", e.Name, e.Code)
+}
@@ -0,0 +1,158 @@
+package kappa
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"net"
+	"net/http"
+	"time"
+)
+
+// A runtime that was just started is probed until it is ready, waiting
+// twice as long after each failed probe between these bounds
+const (
+	readinessMinBackoff = 50 * time.Millisecond
+	readinessMaxBackoff = 2 * time.Second
+)
+
+// errExitedBeforeReady is returned when the runtime stops while being probed
+var errExitedBeforeReady = errors.New("runtime exited before it was ready")
+
+// readinessBackoff is the wait after the given failed probe, counting from
+// 0. Half of it is random, so runtimes started together don't probe in step.
+func readinessBackoff(probe int) time.Duration {
+	wait := readinessMaxBackoff
+	if probe < 6 {
+		wait = min(readinessMinBackoff<<probe, readinessMaxBackoff)
+	}
+	return wait/2 + rand.N(wait/2+1)
+}
+
+// waitReady probes a runtime that was just started until probe succeeds,
+// for up to the function's timeout or the deadline of ctx. A runtime that
+// exits meanwhile fails the wait, with why when it is now backing off.
+func (lf *KappaFunction) waitReady(ctx context.Context, probe func(ctx context.Context) error) error {
+	ctx, cancel := context.WithTimeout(ctx, lf.timeout)
+	defer cancel()
+	for attempt := 0; ; attempt++ {
+		probeCtx, cancelProbe := context.WithTimeout(ctx, readinessMaxBackoff)
+		err := probe(probeCtx)
+		cancelProbe()
+		if err == nil {
+			return nil
+		}
+		if !lf.IsRunning() {
+			lf.isRunningMu.Lock()
+			backoffErr := lf.checkStartBackoff()
+			lf.isRunningMu.Unlock()
+			if backoffErr != nil {
+				return backoffErr
+			}
+			return errExitedBeforeReady
+		}
+
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("runtime isn't ready: %w", err)
+		case <-time.After(readinessBackoff(attempt)):
+		}
+	}
+}
+
+// waitHealthy waits for a runtime that was just started to answer on
+// /health. Any answer short of a 5xx counts, runtimes without the route
+// answering 404 once they serve.
+func (lf *KappaFunction) waitHealthy(ctx context.Context) error {
+	lf.isRunningMu.Lock()
+	url := lf.containerURL + "/health"
+	client := &http.Client{}
+	if lf.transport != nil {
+		client.Transport = lf.transport
+	}
+	lf.isRunningMu.Unlock()
+
+	return lf.waitReady(ctx, func(ctx context.Context) error {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+		if err != nil {
+			return err
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			return err
+		}
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode >= 500 {
+			return fmt.Errorf("health check answered %s", resp.Status)
+		}
+		return nil
+	})
+}
+
+// waitListening waits for a runtime that was just started to accept
+// connections at addr. Runtimes spoken to over another protocol than
+// HTTP/1, or none, may not answer a health check.
+func (lf *KappaFunction) waitListening(ctx context.Context, addr string) error {
+	var dialer net.Dialer
+	return lf.waitReady(ctx, func(ctx context.Context) error {
+		conn, err := dialer.DialContext(ctx, "tcp", addr)
+		if err != nil {
+			return err
+		}
+		return conn.Close()
+	})
+}
+
+// maxHealthBytes caps how much of a runtime's health answer is read
+const maxHealthBytes = 64 * 1024
+
+// RuntimeHealth is what a runtime answered on its own /health.
+type RuntimeHealth struct {
+	StatusCode  int
+	ContentType string
+	Body        []byte
+}
+
+// Health asks the running runtime for its own /health, without starting
+// it or keeping it from being idle. It returns ErrNotRunning when no
+// instance is running, and ErrNoRuntime for jobs and tcp functions, which
+// have no HTTP runtime to ask.
+func (lf *KappaFunction) Health(ctx context.Context) (*RuntimeHealth, error) {
+	var baseURL string
+	var client *http.Client
+	switch lf.mode {
+	case ModeJob, ModeTCP:
+		return nil, ErrNoRuntime
+	case ModeExternal:
+		var err error
+		if baseURL, client, err = lf.attachedRuntime(); err != nil {
+			return nil, err
+		}
+	default:
+		if !lf.IsRunning() {
+			return nil, ErrNotRunning
+		}
+		lf.isRunningMu.Lock()
+		baseURL = lf.containerURL
+		lf.isRunningMu.Unlock()
+		client = lf.httpClient()
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, baseURL+"/health", nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("health check failed: %w", err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxHealthBytes))
+	if err != nil {
+		return nil, fmt.Errorf("health check failed: %w", err)
+	}
+	return &RuntimeHealth{StatusCode: resp.StatusCode, ContentType: resp.Header.Get("Content-Type"), Body: body}, nil
+}
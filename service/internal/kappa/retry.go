@@ -0,0 +1,233 @@
+package kappa
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"kappa-v2/pkg/logger"
+	"net"
+	"net/http"
+	"syscall"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// RetryPolicy controls which failed invocations are automatically retried.
+// Connection errors are always safe to retry as the request never reached the
+// handler, timeouts and 5xx responses may already have run side effects so
+// they are only retried when explicitly enabled.
+type RetryPolicy struct {
+	MaxAttempts    int  `json:"maxAttempts"`
+	RetryOnTimeout bool `json:"retryOnTimeout"`
+	RetryOn5xx     bool `json:"retryOn5xx"`
+	BackoffMs      int  `json:"backoffMs"`
+}
+
+const (
+	// MaxRetryAttempts bounds how many times an invocation is attempted,
+	// so a failing runtime isn't hammered
+	MaxRetryAttempts = 10
+	// MaxRetryBackoffMs bounds the wait between attempts, which the
+	// invocation's caller spends waiting
+	MaxRetryBackoffMs = 60000
+)
+
+// ValidateRetryPolicy checks a retry policy's attempts and backoff are
+// within bounds. Zero attempts are taken as one.
+func ValidateRetryPolicy(p RetryPolicy) error {
+	if p.MaxAttempts < 0 || p.MaxAttempts > MaxRetryAttempts {
+		return fmt.Errorf("maxAttempts must be between 0 and %d", MaxRetryAttempts)
+	}
+	if p.BackoffMs < 0 || p.BackoffMs > MaxRetryBackoffMs {
+		return fmt.Errorf("backoffMs must be between 0 and %d", MaxRetryBackoffMs)
+	}
+	return nil
+}
+
+// DefaultRetryPolicy retries once on connection errors only.
+func DefaultRetryPolicy() RetryPolicy {
+	return RetryPolicy{
+		MaxAttempts: 2,
+		BackoffMs:   1000,
+	}
+}
+
+// invokeErrorKind classifies a failed attempt for the retry decision.
+type invokeErrorKind int
+
+const (
+	errKindNone invokeErrorKind = iota
+	errKindConnect
+	errKindTimeout
+	errKindServer
+	errKindOther
+)
+
+func (k invokeErrorKind) String() string {
+	switch k {
+	case errKindNone:
+		return "none"
+	case errKindConnect:
+		return "connect"
+	case errKindTimeout:
+		return "timeout"
+	case errKindServer:
+		return "server"
+	default:
+		return "other"
+	}
+}
+
+// classifyInvokeError works out whether an attempt failed before reaching the
+// handler (connect), while waiting on it (timeout) or returned a 5xx.
+func classifyInvokeError(resp *http.Response, err error) invokeErrorKind {
+	if err == nil {
+		if resp != nil && resp.StatusCode >= 500 {
+			return errKindServer
+		}
+		return errKindNone
+	}
+
+	if errors.Is(err, syscall.ECONNREFUSED) {
+		return errKindConnect
+	}
+
+	var opErr *net.OpError
+	if errors.As(err, &opErr) && opErr.Op == "dial" {
+		return errKindConnect
+	}
+
+	if errors.Is(err, context.DeadlineExceeded) {
+		return errKindTimeout
+	}
+
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return errKindTimeout
+	}
+
+	return errKindOther
+}
+
+// allows reports whether the policy permits retrying the given kind of failure.
+func (p RetryPolicy) allows(kind invokeErrorKind) bool {
+	switch kind {
+	case errKindConnect:
+		return true
+	case errKindTimeout:
+		return p.RetryOnTimeout
+	case errKindServer:
+		return p.RetryOn5xx
+	default:
+		return false
+	}
+}
+
+// invocationsPath is where runtimes take invocations
+const invocationsPath = "/2015-03-31/functions/function/invocations"
+
+// runtimeTarget is the runtime invocations are sent to, and the generation
+// of the instance serving it.
+type runtimeTarget struct {
+	baseURL    string
+	client     *http.Client
+	generation int
+}
+
+// runningTarget returns the runtime of the running instance.
+func (lf *KappaFunction) runningTarget() runtimeTarget {
+	lf.isRunningMu.Lock()
+	defer lf.isRunningMu.Unlock()
+	return runtimeTarget{baseURL: lf.containerURL, client: lf.httpClient(), generation: lf.generation}
+}
+
+// restartDead restarts the runtime of the instance of generation an
+// invocation found dead, and waits for it to serve. Invocations finding the
+// same instance dead restart it once: those coming after the first find it
+// replaced and only wait for the new one.
+func (lf *KappaFunction) restartDead(ctx context.Context, generation int) error {
+	lf.restartMu.Lock()
+	defer lf.restartMu.Unlock()
+	lf.isRunningMu.Lock()
+	replaced := lf.generation != generation
+	lf.isRunningMu.Unlock()
+	if !replaced {
+		_ = lf.Stop()
+	}
+	if err := lf.Start(ctx); err != nil {
+		return err
+	}
+	return lf.waitHealthy(ctx)
+}
+
+// doWithRetry sends the payload to the target runtime, in the given
+// Content-Encoding when set, retrying according to the function's retry
+// policy. It returns the response and the number of attempts made. The
+// target is updated when the runtime is restarted on the way.
+func (lf *KappaFunction) doWithRetry(ctx context.Context, target *runtimeTarget, payload []byte, encoding, requestID string) (*http.Response, int, error) {
+	policy := lf.retryPolicy
+	if policy.MaxAttempts < 1 {
+		policy.MaxAttempts = 1
+	}
+
+	l := logger.FromCtx(ctx)
+	for attempt := 1; ; attempt++ {
+		req, err := http.NewRequestWithContext(ctx, "POST", target.baseURL+invocationsPath, bytes.NewReader(payload))
+		if err != nil {
+			return nil, attempt, fmt.Errorf("failed to create request: %w", err)
+		}
+		req.Header.Set("Content-Type", "application/json")
+		if encoding != "" {
+			req.Header.Set("Content-Encoding", encoding)
+		}
+		req.Header.Set("Kappa-Runtime-Aws-Request-Id", requestID)
+
+		resp, err := target.client.Do(req)
+		kind := classifyInvokeError(resp, err)
+		if kind == errKindNone {
+			return resp, attempt, nil
+		}
+
+		if attempt >= policy.MaxAttempts || !policy.allows(kind) || ctx.Err() != nil {
+			if err != nil {
+				if attempt > 1 {
+					return nil, attempt, fmt.Errorf("failed to invoke kappa function after %d attempts: %w", attempt, err)
+				}
+				return nil, attempt, fmt.Errorf("failed to invoke kappa function: %w", err)
+			}
+			// A 5xx from the runtime is still a valid response
+			return resp, attempt, nil
+		}
+
+		if resp != nil {
+			resp.Body.Close()
+		}
+
+		l.Warn("Kappa function invocation failed, retrying",
+			zap.String("name", lf.Name),
+			zap.String("kind", kind.String()),
+			zap.Int("attempt", attempt),
+			zap.Error(err))
+
+		// A connection error after the runtime was ready means it died, so
+		// restart it and try again as soon as it serves, on the new
+		// instance's address and connections. One that died before becoming
+		// healthy is backing off and fails with why. External runtimes are
+		// their supervisor's to restart.
+		if kind == errKindConnect && lf.mode != ModeExternal {
+			if err := lf.restartDead(ctx, target.generation); err != nil {
+				return nil, attempt, fmt.Errorf("failed to restart kappa function: %w", err)
+			}
+			*target = lf.runningTarget()
+			continue
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, attempt, fmt.Errorf("failed to invoke kappa function: %w", ctx.Err())
+		case <-time.After(time.Duration(policy.BackoffMs) * time.Millisecond):
+		}
+	}
+}
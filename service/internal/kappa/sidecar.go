@@ -0,0 +1,96 @@
+package kappa
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/opencontainers/runtime-spec/specs-go"
+)
+
+// Sidecar is an instance started and stopped with the function's runtime,
+// like a local cache or a telemetry agent. It shares the runtime's network,
+// mounts and env, with its own env on top, and runs in the function's image
+// unless it names one.
+type Sidecar struct {
+	Name    string   `json:"name"`
+	Image   string   `json:"image,omitempty"`
+	Command []string `json:"command"`
+	Env     []string `json:"env,omitempty"`
+	// MemoryMB limits the sidecar's memory, leaving it to the backend when 0
+	MemoryMB int `json:"memoryMb,omitempty"`
+}
+
+// ValidateSidecars checks sidecars are named uniquely and have something to
+// run.
+func ValidateSidecars(sidecars []Sidecar) error {
+	seen := make(map[string]bool)
+	for _, sidecar := range sidecars {
+		if !validStepName.MatchString(sidecar.Name) {
+			return fmt.Errorf("invalid sidecar name %q, expected lowercase letters, digits and dashes", sidecar.Name)
+		}
+		if seen[sidecar.Name] {
+			return fmt.Errorf("duplicate sidecar %s", sidecar.Name)
+		}
+		seen[sidecar.Name] = true
+		if len(sidecar.Command) == 0 {
+			return fmt.Errorf("sidecar %s has no command", sidecar.Name)
+		}
+		if sidecar.MemoryMB < 0 {
+			return fmt.Errorf("sidecar %s memoryMb must not be negative", sidecar.Name)
+		}
+		for _, kv := range sidecar.Env {
+			if key, _, ok := strings.Cut(kv, "="); !ok || key == "" {
+				return fmt.Errorf("sidecar %s has invalid env entry %q, expected KEY=VALUE", sidecar.Name, kv)
+			}
+		}
+	}
+	return nil
+}
+
+// SetSidecars sets the sidecars started with the runtime from its next start.
+func (lf *KappaFunction) SetSidecars(sidecars []Sidecar) {
+	lf.sidecars = sidecars
+}
+
+// startSidecars starts the function's sidecars ahead of its runtime, so
+// what they serve is there when it starts. Their output is logged with the
+// function's, labelled with the sidecar. Should one fail to start, those
+// already started are stopped again.
+func (lf *KappaFunction) startSidecars(launch *Launch, env []string, mounts []specs.Mount, output *outputTail) ([]*instanceRun, error) {
+	var runs []*instanceRun
+	for _, sidecar := range lf.sidecars {
+		image := launch.Image
+		if sidecar.Image != "" {
+			image = sidecar.Image
+		}
+		prefix := fmt.Sprintf("[sidecar %s] ", sidecar.Name)
+		instance, err := lf.backend.Run(RunSpec{
+			Name:     fmt.Sprintf("%s-sidecar-%s", lf.instanceName(), sidecar.Name),
+			Image:    image,
+			Command:  sidecar.Command,
+			Env:      append(append([]string(nil), env...), sidecar.Env...),
+			Mounts:   mounts,
+			WorkDir:  launch.WorkDir,
+			MemoryMB: sidecar.MemoryMB,
+			OnLog: func(line string) {
+				lf.appendLog(prefix + line)
+				output.add(prefix + line)
+			},
+			ResolvConf: launch.ResolvConf,
+			Hosts:      launch.Hosts,
+		})
+		if err != nil {
+			stopSidecars(runs)
+			return nil, &StartError{Err: fmt.Errorf("failed to start sidecar %s: %w", sidecar.Name, err), Output: output.Lines()}
+		}
+		runs = append(runs, &instanceRun{instance: instance, image: image})
+	}
+	return runs, nil
+}
+
+// stopSidecars stops sidecars once their runtime has stopped.
+func stopSidecars(runs []*instanceRun) {
+	for _, run := range runs {
+		_ = run.instance.Stop()
+	}
+}
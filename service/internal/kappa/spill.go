@@ -0,0 +1,81 @@
+package kappa
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// HeaderSpilled is set on responses whose body was spilled, the body being
+// the SpilledBody saying where it went
+const HeaderSpilled = "X-Kappa-Spilled"
+
+// Spiller keeps response bodies too large to pass through the service,
+// returning a link to where they can be fetched until it expires.
+type Spiller interface {
+	Spill(ctx context.Context, key string, body io.Reader) (url string, expiresAt time.Time, err error)
+}
+
+// SpilledBody is returned in place of a response body that was spilled.
+type SpilledBody struct {
+	URL         string    `json:"url"`
+	Size        int64     `json:"size"`
+	SHA256      string    `json:"sha256"`
+	ContentType string    `json:"contentType,omitempty"`
+	ExpiresAt   time.Time `json:"expiresAt"`
+}
+
+// SetSpillover has response bodies larger than threshold bytes handed to
+// spiller instead of being read into memory and returned.
+func (lf *KappaFunction) SetSpillover(threshold int64, spiller Spiller) {
+	lf.spillThreshold, lf.spiller = threshold, spiller
+}
+
+// readBody reads the runtime's response body, or spills it once it is over
+// the threshold, holding no more than the threshold in memory.
+func (lf *KappaFunction) readBody(ctx context.Context) func(resp *http.Response) ([]byte, *SpilledBody, error) {
+	return func(resp *http.Response) ([]byte, *SpilledBody, error) {
+		if lf.spiller == nil {
+			body, err := io.ReadAll(resp.Body)
+			return body, nil, err
+		}
+		head, err := io.ReadAll(io.LimitReader(resp.Body, lf.spillThreshold+1))
+		if err != nil || int64(len(head)) <= lf.spillThreshold {
+			return head, nil, err
+		}
+
+		hash := sha256.New()
+		body := &countingReader{r: io.TeeReader(io.MultiReader(bytes.NewReader(head), resp.Body), hash)}
+		key := fmt.Sprintf("responses/%s/%s", lf.Name, uuid.New().String())
+		url, expiresAt, err := lf.spiller.Spill(ctx, key, body)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to spill response: %w", err)
+		}
+		return nil, &SpilledBody{
+			URL:         url,
+			Size:        body.n,
+			SHA256:      hex.EncodeToString(hash.Sum(nil)),
+			ContentType: resp.Header.Get("Content-Type"),
+			ExpiresAt:   expiresAt,
+		}, nil
+	}
+}
+
+// countingReader counts the bytes read through it
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
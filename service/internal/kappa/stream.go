@@ -0,0 +1,73 @@
+package kappa
+
+import (
+	"context"
+	"io"
+	"kappa-v2/pkg/handler"
+	"mime"
+	"net/http"
+	"sync"
+)
+
+// streamingKey marks contexts whose invocations may return streams
+type streamingKey struct{}
+
+// WithStreaming has invocations made with ctx return the bodies runtimes
+// stream, like Server-Sent Events, in the response's Stream as they arrive
+// rather than read whole. The invocation lasts until the caller closes the
+// stream, which it must. Without it streams are read like any other body.
+func WithStreaming(ctx context.Context) context.Context {
+	return context.WithValue(ctx, streamingKey{}, true)
+}
+
+func streaming(ctx context.Context) bool {
+	ok, _ := ctx.Value(streamingKey{}).(bool)
+	return ok
+}
+
+// isStream reports whether the runtime streams its response, marking it as
+// one or sending Server-Sent Events.
+func isStream(resp *http.Response) bool {
+	if resp.Header.Get(handler.HeaderResponseFormat) != handler.ResponseFormatRaw {
+		return false
+	}
+	if resp.Header.Get(handler.HeaderResponseStream) != "" {
+		return true
+	}
+	mediaType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	return mediaType == "text/event-stream"
+}
+
+// streamResponse returns the runtime's response with its body left to
+// stream.
+func streamResponse(resp *http.Response) *KappaResponse {
+	headers, requestID := responseHeaders(resp)
+	delete(headers, handler.HeaderResponseStream)
+	return &KappaResponse{
+		StatusCode: resp.StatusCode,
+		Headers:    headers,
+		RequestID:  requestID,
+		Stream:     resp.Body,
+	}
+}
+
+// streamBody counts what is read of a stream and calls done with it once
+// the stream is closed.
+type streamBody struct {
+	io.ReadCloser
+	n    int64
+	once sync.Once
+	done func(n int64)
+}
+
+func (s *streamBody) Read(p []byte) (int, error) {
+	n, err := s.ReadCloser.Read(p)
+	s.n += int64(n)
+	return n, err
+}
+
+func (s *streamBody) Close() error {
+	err := s.ReadCloser.Close()
+	s.once.Do(func() { s.done(s.n) })
+	return err
+}
@@ -0,0 +1,103 @@
+package kappa
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"kappa-v2/pkg/handler"
+	"kappa-v2/pkg/logger"
+	"net/http"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// timeoutLogLines is how many of the function's latest log lines a timeout
+// error carries
+const timeoutLogLines = 20
+
+// MaxTimeoutGrace is the longest a timed out runtime may be given to report
+// a partial result.
+const MaxTimeoutGrace = 10 * time.Second
+
+// TimeoutError is an invocation that took longer than the function's
+// timeout, with what the runtime had to show for it and the function's
+// latest log lines, for whoever invoked it to see how far it got.
+type TimeoutError struct {
+	Err       error
+	RequestID string
+	// Partial is the runtime's answer to being signalled, nil when the
+	// function has no grace period or the runtime couldn't say
+	Partial *handler.PartialResult
+	Logs    []string
+}
+
+func (e *TimeoutError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *TimeoutError) Unwrap() error {
+	return e.Err
+}
+
+// SetTimeoutGrace sets how long the runtime of an invocation that timed out
+// gets to report a partial result, 0 doesn't ask it for one.
+func (lf *KappaFunction) SetTimeoutGrace(grace time.Duration) {
+	lf.timeoutGrace = grace
+}
+
+// timedOut turns a timed out invocation's error into a TimeoutError, asking
+// the runtime for its partial result when the function has a grace period.
+// Other errors are returned as they are.
+func (lf *KappaFunction) timedOut(err error, client *http.Client, baseURL, requestID string) error {
+	if classifyInvokeError(nil, err) != errKindTimeout {
+		return err
+	}
+	timeoutErr := &TimeoutError{Err: err, RequestID: requestID}
+	if lf.timeoutGrace > 0 {
+		partial, signalErr := signalTimeout(client, baseURL, requestID, lf.timeoutGrace)
+		if signalErr != nil {
+			logger.Get().Warn("No partial result for timed out invocation",
+				zap.String("function", lf.Name), zap.String("requestId", requestID), zap.Error(signalErr))
+		}
+		timeoutErr.Partial = partial
+	}
+	logs := lf.GetLogs()
+	if len(logs) > timeoutLogLines {
+		logs = logs[len(logs)-timeoutLogLines:]
+	}
+	timeoutErr.Logs = logs
+	return timeoutErr
+}
+
+// signalTimeout tells the runtime the invocation timed out and waits up to
+// grace for what it has, through the timeout endpoint of pkg/handler.
+func signalTimeout(client *http.Client, baseURL, requestID string, grace time.Duration) (*handler.PartialResult, error) {
+	body, err := json.Marshal(map[string]any{"requestId": requestID, "graceMs": grace.Milliseconds()})
+	if err != nil {
+		return nil, err
+	}
+	// The invocation's context is over, and its client's timeout may be
+	// shorter than the grace period
+	ctx, cancel := context.WithTimeout(context.Background(), grace+time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, baseURL+handler.TimeoutPath, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := (&http.Client{Transport: client.Transport}).Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("runtime answered %d", resp.StatusCode)
+	}
+	var partial handler.PartialResult
+	if err := json.NewDecoder(resp.Body).Decode(&partial); err != nil {
+		return nil, fmt.Errorf("invalid partial result: %w", err)
+	}
+	return &partial, nil
+}
@@ -0,0 +1,19 @@
+package kappa
+
+// SetWarm keeps the function's instance started while warm, so latency
+// sensitive functions don't wait on a cold start: it isn't stopped when
+// idle, and whoever warms it starts it again when it exits. Cooling a
+// running function down starts its idle timeout over.
+func (lf *KappaFunction) SetWarm(warm bool) {
+	if lf.warm.Swap(warm) == warm || warm {
+		return
+	}
+	if lf.IsRunning() {
+		lf.resetIdleTimer()
+	}
+}
+
+// Warm reports whether the function's instance is kept started.
+func (lf *KappaFunction) Warm() bool {
+	return lf.warm.Load()
+}
@@ -0,0 +1,133 @@
+// Package metrics exposes what functions do as Prometheus metrics,
+// invocations, errors, latency, cold starts and running instances, so the
+// platform can be alerted on without scraping its logs.
+package metrics
+
+import (
+	"kappa-v2/service/internal/kappa"
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// ErrorFunction is the error kind of invocations the function itself
+// answered with a 5xx status
+const ErrorFunction = "functionError"
+
+// DurationBuckets are the bounds of the invocation latency histogram, in
+// seconds, reaching past the default timeout
+var DurationBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10, 30, 60}
+
+// Metrics are the service's Prometheus metrics, served by Handler.
+type Metrics struct {
+	registry    *prometheus.Registry
+	invocations *prometheus.CounterVec
+	errors      *prometheus.CounterVec
+	duration    *prometheus.HistogramVec
+	coldStarts  *prometheus.CounterVec
+	errorKind   func(error) string
+}
+
+// New returns metrics naming the kind of failed invocations with errorKind
+// and counting running instances per function with running, called on
+// every scrape.
+func New(errorKind func(error) string, running func() map[string]int) *Metrics {
+	m := &Metrics{
+		registry: prometheus.NewRegistry(),
+		invocations: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "kappa_invocations_total",
+			Help: "Invocations of a function, failed ones included.",
+		}, []string{"function"}),
+		errors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "kappa_invocation_errors_total",
+			Help: "Invocations of a function that failed, by the kind of error.",
+		}, []string{"function", "kind"}),
+		duration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "kappa_invocation_duration_seconds",
+			Help:    "How long invocations of a function took, cold starts included.",
+			Buckets: DurationBuckets,
+		}, []string{"function"}),
+		coldStarts: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "kappa_cold_starts_total",
+			Help: "Invocations of a function that started its instance first.",
+		}, []string{"function"}),
+		errorKind: errorKind,
+	}
+	m.registry.MustRegister(
+		m.invocations, m.errors, m.duration, m.coldStarts,
+		runningCollector{running: running},
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+	)
+	return m
+}
+
+// Observe counts an invocation.
+func (m *Metrics) Observe(u kappa.Usage) {
+	m.invocations.WithLabelValues(u.Function).Inc()
+	m.duration.WithLabelValues(u.Function).Observe(u.Duration.Seconds())
+	if u.ColdStart {
+		m.coldStarts.WithLabelValues(u.Function).Inc()
+	}
+	switch {
+	case u.Err != nil:
+		m.errors.WithLabelValues(u.Function, m.errorKind(u.Err)).Inc()
+	case u.StatusCode >= 500:
+		m.errors.WithLabelValues(u.Function, ErrorFunction).Inc()
+	}
+}
+
+// Forget drops a function's series, once it is deleted.
+func (m *Metrics) Forget(function string) {
+	labels := prometheus.Labels{"function": function}
+	m.invocations.DeletePartialMatch(labels)
+	m.errors.DeletePartialMatch(labels)
+	m.duration.DeletePartialMatch(labels)
+	m.coldStarts.DeletePartialMatch(labels)
+}
+
+// Recorder returns a recorder observing every invocation before passing
+// it on to next.
+func (m *Metrics) Recorder(next kappa.UsageRecorder) kappa.UsageRecorder {
+	return recorder{metrics: m, next: next}
+}
+
+type recorder struct {
+	metrics *Metrics
+	next    kappa.UsageRecorder
+}
+
+func (r recorder) RecordUsage(u kappa.Usage) {
+	r.metrics.Observe(u)
+	if r.next != nil {
+		r.next.RecordUsage(u)
+	}
+}
+
+// Handler serves the metrics in the Prometheus exposition format.
+func (m *Metrics) Handler() http.Handler {
+	return promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{})
+}
+
+var runningDesc = prometheus.NewDesc(
+	"kappa_running_containers",
+	"Instances of a function running now, serving requests or running jobs.",
+	[]string{"function"}, nil,
+)
+
+// runningCollector reports running instances as they are when scraped
+type runningCollector struct {
+	running func() map[string]int
+}
+
+func (c runningCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- runningDesc
+}
+
+func (c runningCollector) Collect(ch chan<- prometheus.Metric) {
+	for function, n := range c.running() {
+		ch <- prometheus.MustNewConstMetric(runningDesc, prometheus.GaugeValue, float64(n), function)
+	}
+}
@@ -0,0 +1,59 @@
+package metrics
+
+import (
+	"context"
+	"errors"
+	"kappa-v2/service/internal/kappa"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type usageRecords []kappa.Usage
+
+func (r *usageRecords) RecordUsage(u kappa.Usage) {
+	*r = append(*r, u)
+}
+
+func TestMetrics(t *testing.T) {
+	kind := func(err error) string {
+		if errors.Is(err, context.DeadlineExceeded) {
+			return "timeout"
+		}
+		return "invocationFailed"
+	}
+	m := New(kind, func() map[string]int { return map[string]int{"cart": 1} })
+
+	var next usageRecords
+	r := m.Recorder(&next)
+	r.RecordUsage(kappa.Usage{Function: "cart", Duration: 20 * time.Millisecond, StatusCode: 200, ColdStart: true})
+	r.RecordUsage(kappa.Usage{Function: "cart", Duration: 3 * time.Second, StatusCode: 502})
+	r.RecordUsage(kappa.Usage{Function: "cart", Duration: 30 * time.Second, Failed: true, Err: context.DeadlineExceeded})
+	r.RecordUsage(kappa.Usage{Function: "search", Duration: time.Millisecond, StatusCode: 200})
+	assert.Len(t, next, 4, "usage is still recorded")
+
+	scrape := func() string {
+		rec := httptest.NewRecorder()
+		m.Handler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+		require.Equal(t, http.StatusOK, rec.Code)
+		return rec.Body.String()
+	}
+	body := scrape()
+	assert.Contains(t, body, `kappa_invocations_total{function="cart"} 3`)
+	assert.Contains(t, body, `kappa_invocation_errors_total{function="cart",kind="functionError"} 1`)
+	assert.Contains(t, body, `kappa_invocation_errors_total{function="cart",kind="timeout"} 1`)
+	assert.Contains(t, body, `kappa_cold_starts_total{function="cart"} 1`)
+	assert.Contains(t, body, `kappa_invocation_duration_seconds_bucket{function="cart",le="0.025"} 1`)
+	assert.Contains(t, body, `kappa_invocation_duration_seconds_count{function="search"} 1`)
+	assert.Contains(t, body, `kappa_running_containers{function="cart"} 1`)
+	assert.Contains(t, body, "go_goroutines")
+
+	m.Forget("cart")
+	body = scrape()
+	assert.NotContains(t, body, `kappa_invocations_total{function="cart"}`)
+	assert.Contains(t, body, `kappa_invocations_total{function="search"} 1`)
+}
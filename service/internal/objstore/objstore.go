@@ -0,0 +1,224 @@
+// Package objstore keeps objects by key in a local directory or an
+// S3-compatible bucket, for the state nodes share: function artifacts,
+// archived logs, spilled responses and async results. With a bucket, nodes
+// keep nothing they can't fetch again and can be replaced.
+package objstore
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ErrNotFound is returned for keys that aren't stored
+var ErrNotFound = errors.New("object not found")
+
+// Object is a stored object's key and what a listing tells about it.
+type Object struct {
+	Key          string
+	Size         int64
+	LastModified time.Time
+}
+
+// Store keeps objects by key. Keys are slash separated relative paths.
+type Store interface {
+	// Put stores r under key, replacing the object already there
+	Put(ctx context.Context, key string, r io.Reader) error
+	// Get opens the object stored under key, ErrNotFound if there is none
+	Get(ctx context.Context, key string) (io.ReadCloser, error)
+	// Delete removes an object, it is not an error if it doesn't exist
+	Delete(ctx context.Context, key string) error
+	// List returns the objects whose keys start with prefix, by key
+	List(ctx context.Context, prefix string) ([]Object, error)
+}
+
+// validKey keeps keys to relative paths of safe segments
+var validKey = regexp.MustCompile(`^[A-Za-z0-9._-]+(/[A-Za-z0-9._-]+)*$`)
+
+// ValidKey checks key is a relative path of safe segments.
+func ValidKey(key string) error {
+	if !validKey.MatchString(key) || strings.Contains(key, "..") {
+		return fmt.Errorf("invalid object key: %q", key)
+	}
+	return nil
+}
+
+// FromEnv returns the bucket KAPPA_STORAGE_BACKEND names, nil when it is
+// unset or "local", keeping state in the local directories each store is
+// configured with.
+func FromEnv() (*S3, error) {
+	switch backend := os.Getenv("KAPPA_STORAGE_BACKEND"); backend {
+	case "", "local":
+		return nil, nil
+	case "s3":
+		opts, err := S3OptionsFromEnv()
+		if err != nil {
+			return nil, err
+		}
+		return NewS3(opts)
+	default:
+		return nil, fmt.Errorf("unknown KAPPA_STORAGE_BACKEND %q, expected local or s3", backend)
+	}
+}
+
+// S3OptionsFromEnv reads the bucket from KAPPA_S3_BUCKET, KAPPA_S3_REGION,
+// us-east-1 by default, KAPPA_S3_ENDPOINT for S3-compatible services,
+// KAPPA_S3_PATH_STYLE and KAPPA_S3_PREFIX, and the credentials from
+// KAPPA_S3_ACCESS_KEY_ID and KAPPA_S3_SECRET_ACCESS_KEY, or the AWS_
+// variables of the same names and AWS_SESSION_TOKEN.
+func S3OptionsFromEnv() (S3Options, error) {
+	opts := S3Options{
+		Bucket:          os.Getenv("KAPPA_S3_BUCKET"),
+		Region:          os.Getenv("KAPPA_S3_REGION"),
+		Endpoint:        os.Getenv("KAPPA_S3_ENDPOINT"),
+		Prefix:          os.Getenv("KAPPA_S3_PREFIX"),
+		AccessKeyID:     os.Getenv("KAPPA_S3_ACCESS_KEY_ID"),
+		SecretAccessKey: os.Getenv("KAPPA_S3_SECRET_ACCESS_KEY"),
+	}
+	if opts.AccessKeyID == "" && opts.SecretAccessKey == "" {
+		opts.AccessKeyID = os.Getenv("AWS_ACCESS_KEY_ID")
+		opts.SecretAccessKey = os.Getenv("AWS_SECRET_ACCESS_KEY")
+		opts.SessionToken = os.Getenv("AWS_SESSION_TOKEN")
+	}
+	if v := os.Getenv("KAPPA_S3_PATH_STYLE"); v != "" {
+		pathStyle, err := strconv.ParseBool(v)
+		if err != nil {
+			return S3Options{}, fmt.Errorf("invalid KAPPA_S3_PATH_STYLE %q", v)
+		}
+		opts.PathStyle = pathStyle
+	}
+	return opts, nil
+}
+
+// Dir is a Store keeping objects as files under a directory.
+type Dir struct {
+	dir string
+}
+
+// NewDir creates a store in dir.
+func NewDir(dir string) (*Dir, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, fmt.Errorf("failed to create object directory: %w", err)
+	}
+	return &Dir{dir: dir}, nil
+}
+
+func (d *Dir) path(key string) (string, error) {
+	if err := ValidKey(key); err != nil {
+		return "", err
+	}
+	return filepath.Join(d.dir, filepath.FromSlash(key)), nil
+}
+
+// Put writes r to a temp file and moves it into place once complete, so an
+// object is never seen half written.
+func (d *Dir) Put(ctx context.Context, key string, r io.Reader) error {
+	path, err := d.path(key)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return fmt.Errorf("failed to create object directory: %w", err)
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".put-*")
+	if err != nil {
+		return fmt.Errorf("failed to create object: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	_, err = io.Copy(tmp, contextReader{ctx, r})
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return fmt.Errorf("failed to write object: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return fmt.Errorf("failed to store object: %w", err)
+	}
+	return nil
+}
+
+func (d *Dir) Get(ctx context.Context, key string) (io.ReadCloser, error) {
+	path, err := d.path(key)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, fmt.Errorf("%w: %s", ErrNotFound, key)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to open object: %w", err)
+	}
+	return f, nil
+}
+
+func (d *Dir) Delete(ctx context.Context, key string) error {
+	path, err := d.path(key)
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to delete object: %w", err)
+	}
+	return nil
+}
+
+func (d *Dir) List(ctx context.Context, prefix string) ([]Object, error) {
+	var objects []Object
+	err := filepath.WalkDir(d.dir, func(path string, entry os.DirEntry, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if entry.IsDir() || strings.HasPrefix(entry.Name(), ".put-") {
+			return nil
+		}
+		rel, err := filepath.Rel(d.dir, path)
+		if err != nil {
+			return err
+		}
+		key := filepath.ToSlash(rel)
+		if !strings.HasPrefix(key, prefix) {
+			return nil
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return nil
+		}
+		objects = append(objects, Object{Key: key, Size: info.Size(), LastModified: info.ModTime()})
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list objects: %w", err)
+	}
+	sort.Slice(objects, func(i, j int) bool { return objects[i].Key < objects[j].Key })
+	return objects, nil
+}
+
+// contextReader stops a copy once its context is done
+type contextReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (c contextReader) Read(p []byte) (int, error) {
+	if err := c.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return c.r.Read(p)
+}
@@ -0,0 +1,410 @@
+package objstore
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// unsignedPayload signs requests without hashing their bodies, so
+	// objects are streamed rather than read twice
+	unsignedPayload = "UNSIGNED-PAYLOAD"
+	// maxPresignExpiry is the longest a presigned link lasts
+	maxPresignExpiry = 7 * 24 * time.Hour
+	defaultRegion    = "us-east-1"
+)
+
+// S3Options are which bucket to keep objects in and how to reach it.
+type S3Options struct {
+	Bucket string
+	// Region is the bucket's, us-east-1 when empty
+	Region string
+	// Endpoint is the S3-compatible service's URL, AWS's for the region
+	// when empty
+	Endpoint string
+	// PathStyle addresses the bucket in the path rather than the host, as
+	// services like MinIO expect
+	PathStyle bool
+	// Prefix is prepended to every key, for sharing a bucket
+	Prefix          string
+	AccessKeyID     string
+	SecretAccessKey string
+	SessionToken    string
+	// Client sends the requests, http.DefaultClient when nil
+	Client *http.Client
+}
+
+// S3 is a Store keeping objects in an S3-compatible bucket, signing its
+// requests with AWS Signature Version 4.
+type S3 struct {
+	opts     S3Options
+	endpoint *url.URL
+	client   *http.Client
+	now      func() time.Time
+}
+
+// NewS3 returns a store of the bucket, without checking it can be reached.
+func NewS3(opts S3Options) (*S3, error) {
+	if opts.Bucket == "" {
+		return nil, fmt.Errorf("missing bucket")
+	}
+	if opts.AccessKeyID == "" || opts.SecretAccessKey == "" {
+		return nil, fmt.Errorf("missing credentials for bucket %s", opts.Bucket)
+	}
+	if opts.Region == "" {
+		opts.Region = defaultRegion
+	}
+	if opts.Endpoint == "" {
+		opts.Endpoint = "https://s3." + opts.Region + ".amazonaws.com"
+	}
+	endpoint, err := url.Parse(opts.Endpoint)
+	if err != nil || (endpoint.Scheme != "http" && endpoint.Scheme != "https") || endpoint.Host == "" {
+		return nil, fmt.Errorf("invalid endpoint %q", opts.Endpoint)
+	}
+	opts.Prefix = strings.Trim(opts.Prefix, "/")
+	client := opts.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	return &S3{opts: opts, endpoint: endpoint, client: client, now: time.Now}, nil
+}
+
+// String names the bucket, for logs.
+func (s *S3) String() string {
+	if s.opts.Prefix != "" {
+		return "s3://" + s.opts.Bucket + "/" + s.opts.Prefix
+	}
+	return "s3://" + s.opts.Bucket
+}
+
+// fullKey is key under the store's prefix.
+func (s *S3) fullKey(key string) string {
+	if s.opts.Prefix == "" {
+		return key
+	}
+	return s.opts.Prefix + "/" + key
+}
+
+// url addresses key in the bucket, the bucket itself when key is empty.
+func (s *S3) url(key string, query url.Values) *url.URL {
+	u := *s.endpoint
+	path := "/" + uriEncode(key, false)
+	if s.opts.PathStyle {
+		path = "/" + s.opts.Bucket + path
+	} else {
+		u.Host = s.opts.Bucket + "." + u.Host
+	}
+	u.Path = strings.TrimSuffix(s.endpoint.Path, "/") + path
+	u.RawPath = ""
+	u.RawQuery = canonicalQuery(query)
+	return &u
+}
+
+// Put uploads r, whose length must be known up front: readers that don't
+// tell it, unlike files and in-memory readers, are spooled to a temp file.
+func (s *S3) Put(ctx context.Context, key string, r io.Reader) error {
+	if err := ValidKey(key); err != nil {
+		return err
+	}
+	size, ok := readerSize(r)
+	if !ok {
+		tmp, err := os.CreateTemp("", "kappa-s3-*")
+		if err != nil {
+			return fmt.Errorf("failed to spool object: %w", err)
+		}
+		defer os.Remove(tmp.Name())
+		defer tmp.Close()
+		if size, err = io.Copy(tmp, contextReader{ctx, r}); err != nil {
+			return fmt.Errorf("failed to spool object: %w", err)
+		}
+		if _, err := tmp.Seek(0, io.SeekStart); err != nil {
+			return fmt.Errorf("failed to spool object: %w", err)
+		}
+		r = tmp
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, s.url(s.fullKey(key), nil).String(), io.NopCloser(r))
+	if err != nil {
+		return err
+	}
+	req.ContentLength = size
+	req.Header.Set("Content-Type", "application/octet-stream")
+	resp, err := s.do(req, key)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+func (s *S3) Get(ctx context.Context, key string) (io.ReadCloser, error) {
+	if err := ValidKey(key); err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, s.url(s.fullKey(key), nil).String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := s.do(req, key)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+func (s *S3) Delete(ctx context.Context, key string) error {
+	if err := ValidKey(key); err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodDelete, s.url(s.fullKey(key), nil).String(), nil)
+	if err != nil {
+		return err
+	}
+	resp, err := s.do(req, key)
+	if err != nil && !errors.Is(err, ErrNotFound) {
+		return err
+	}
+	if resp != nil {
+		resp.Body.Close()
+	}
+	return nil
+}
+
+// listResult is the part of a ListObjectsV2 response the store reads
+type listResult struct {
+	Contents []struct {
+		Key          string    `xml:"Key"`
+		Size         int64     `xml:"Size"`
+		LastModified time.Time `xml:"LastModified"`
+	} `xml:"Contents"`
+	IsTruncated           bool   `xml:"IsTruncated"`
+	NextContinuationToken string `xml:"NextContinuationToken"`
+}
+
+// List pages through ListObjectsV2, which returns keys in order.
+func (s *S3) List(ctx context.Context, prefix string) ([]Object, error) {
+	full := s.fullKey(prefix)
+	var objects []Object
+	token := ""
+	for {
+		query := url.Values{"list-type": {"2"}, "prefix": {full}}
+		if token != "" {
+			query.Set("continuation-token", token)
+		}
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, s.url("", query).String(), nil)
+		if err != nil {
+			return nil, err
+		}
+		resp, err := s.do(req, prefix)
+		if err != nil {
+			return nil, err
+		}
+		var page listResult
+		err = xml.NewDecoder(resp.Body).Decode(&page)
+		resp.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("failed to decode object list: %w", err)
+		}
+		for _, c := range page.Contents {
+			key := c.Key
+			if s.opts.Prefix != "" {
+				key = strings.TrimPrefix(key, s.opts.Prefix+"/")
+			}
+			objects = append(objects, Object{Key: key, Size: c.Size, LastModified: c.LastModified})
+		}
+		if !page.IsTruncated || page.NextContinuationToken == "" {
+			return objects, nil
+		}
+		token = page.NextContinuationToken
+	}
+}
+
+// Presign returns a link anyone holding it can send method to key with
+// until expires, at most a week away.
+func (s *S3) Presign(method, key string, expires time.Time) (string, error) {
+	if err := ValidKey(key); err != nil {
+		return "", err
+	}
+	now := s.now().UTC()
+	ttl := expires.Sub(now).Round(time.Second)
+	if ttl <= 0 || ttl > maxPresignExpiry {
+		return "", fmt.Errorf("presigned links last between a second and %s, not %s", maxPresignExpiry, ttl)
+	}
+	amzDate := now.Format("20060102T150405Z")
+	scope := s.scope(amzDate)
+	query := url.Values{
+		"X-Amz-Algorithm":     {"AWS4-HMAC-SHA256"},
+		"X-Amz-Credential":    {s.opts.AccessKeyID + "/" + scope},
+		"X-Amz-Date":          {amzDate},
+		"X-Amz-Expires":       {strconv.Itoa(int(ttl.Seconds()))},
+		"X-Amz-SignedHeaders": {"host"},
+	}
+	if s.opts.SessionToken != "" {
+		query.Set("X-Amz-Security-Token", s.opts.SessionToken)
+	}
+	u := s.url(s.fullKey(key), query)
+	canonical := strings.Join([]string{
+		method,
+		u.EscapedPath(),
+		u.RawQuery,
+		"host:" + u.Host + "\n",
+		"host",
+		unsignedPayload,
+	}, "\n")
+	query.Set("X-Amz-Signature", s.signature(amzDate, scope, canonical))
+	u.RawQuery = canonicalQuery(query)
+	return u.String(), nil
+}
+
+// do signs and sends req, turning error responses into errors.
+func (s *S3) do(req *http.Request, key string) (*http.Response, error) {
+	s.sign(req)
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("s3 %s %s: %w", req.Method, key, err)
+	}
+	if resp.StatusCode < 300 {
+		return resp, nil
+	}
+	defer resp.Body.Close()
+	var reply struct {
+		Code    string `xml:"Code"`
+		Message string `xml:"Message"`
+	}
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+	xml.Unmarshal(body, &reply)
+	if resp.StatusCode == http.StatusNotFound && (reply.Code == "" || reply.Code == "NoSuchKey") {
+		return nil, fmt.Errorf("%w: %s", ErrNotFound, key)
+	}
+	if reply.Code == "" {
+		reply.Code = resp.Status
+	}
+	return nil, fmt.Errorf("s3 %s %s: %s %s", req.Method, key, reply.Code, reply.Message)
+}
+
+// sign adds the Authorization header of AWS Signature Version 4.
+func (s *S3) sign(req *http.Request) {
+	amzDate := s.now().UTC().Format("20060102T150405Z")
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", unsignedPayload)
+	if s.opts.SessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", s.opts.SessionToken)
+	}
+	req.Host = req.URL.Host
+
+	headers := map[string]string{"host": req.URL.Host}
+	for name, values := range req.Header {
+		if lower := strings.ToLower(name); strings.HasPrefix(lower, "x-amz-") || lower == "content-type" {
+			headers[lower] = strings.TrimSpace(strings.Join(values, ","))
+		}
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonical := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.RawQuery,
+		canonicalHeaders.String(),
+		signedHeaders,
+		unsignedPayload,
+	}, "\n")
+	scope := s.scope(amzDate)
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		s.opts.AccessKeyID, scope, signedHeaders, s.signature(amzDate, scope, canonical)))
+}
+
+// scope is the credential scope of requests signed at amzDate.
+func (s *S3) scope(amzDate string) string {
+	return amzDate[:8] + "/" + s.opts.Region + "/s3/aws4_request"
+}
+
+// signature signs a canonical request with a key derived for its scope.
+func (s *S3) signature(amzDate, scope, canonical string) string {
+	sum := sha256.Sum256([]byte(canonical))
+	toSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(sum[:])
+	key := []byte("AWS4" + s.opts.SecretAccessKey)
+	for _, part := range []string{amzDate[:8], s.opts.Region, "s3", "aws4_request"} {
+		key = hmacSHA256(key, part)
+	}
+	return hex.EncodeToString(hmacSHA256(key, toSign))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	m := hmac.New(sha256.New, key)
+	m.Write([]byte(data))
+	return m.Sum(nil)
+}
+
+// canonicalQuery encodes a query sorted by key, as signatures expect.
+func canonicalQuery(query url.Values) string {
+	keys := make([]string, 0, len(query))
+	for k := range query {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var parts []string
+	for _, k := range keys {
+		for _, v := range query[k] {
+			parts = append(parts, uriEncode(k, true)+"="+uriEncode(v, true))
+		}
+	}
+	return strings.Join(parts, "&")
+}
+
+// uriEncode percent-encodes all but unreserved characters, and slashes
+// unless encodeSlash.
+func uriEncode(s string, encodeSlash bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9', c == '-', c == '.', c == '_', c == '~':
+			b.WriteByte(c)
+		case c == '/' && !encodeSlash:
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+// readerSize tells how many bytes are left in readers that know it.
+func readerSize(r io.Reader) (int64, bool) {
+	switch r := r.(type) {
+	case interface{ Len() int }:
+		return int64(r.Len()), true
+	case *os.File:
+		info, err := r.Stat()
+		if err != nil || !info.Mode().IsRegular() {
+			return 0, false
+		}
+		offset, err := r.Seek(0, io.SeekCurrent)
+		if err != nil {
+			return 0, false
+		}
+		return info.Size() - offset, true
+	}
+	return 0, false
+}
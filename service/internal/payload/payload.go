@@ -0,0 +1,167 @@
+// Package payload protects the invocation payloads the service keeps once an
+// invocation is over, like async results, dead letters and invocation
+// history. Events often carry personal data, so what is kept is first
+// redacted by the function's policy and then encrypted with the service key.
+package payload
+
+import (
+	"bufio"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// Formats of stored payloads, the first byte of what Seal returns
+const (
+	formatPlain  byte = 0
+	formatAESGCM byte = 1
+)
+
+// keyIDLen is how many bytes of a key's sha256 digest identify it
+const keyIDLen = 8
+
+// ErrNoKey is returned when opening a payload sealed with a key the sealer
+// doesn't have.
+var ErrNoKey = errors.New("payload key not found")
+
+// Sealer encrypts payloads with AES-256-GCM. The first key seals, every key
+// opens, so keys can be rotated by putting the new key first and dropping
+// the old one once nothing sealed with it is kept. A nil Sealer keeps
+// payloads in the clear.
+type Sealer struct {
+	current []byte
+	keys    map[string]cipher.AEAD
+}
+
+// NewSealer creates a sealer from 32 byte keys, the first of which seals.
+func NewSealer(keys ...[]byte) (*Sealer, error) {
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("no payload keys")
+	}
+	s := &Sealer{keys: make(map[string]cipher.AEAD, len(keys))}
+	for i, key := range keys {
+		if len(key) != 32 {
+			return nil, fmt.Errorf("payload key %d is %d bytes, expected 32", i+1, len(key))
+		}
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create cipher: %w", err)
+		}
+		aead, err := cipher.NewGCM(block)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create cipher: %w", err)
+		}
+		id := keyID(key)
+		if i == 0 {
+			s.current = id
+		}
+		s.keys[string(id)] = aead
+	}
+	return s, nil
+}
+
+func keyID(key []byte) []byte {
+	digest := sha256.Sum256(key)
+	return digest[:keyIDLen]
+}
+
+// SealerFromEnv creates a sealer from KAPPA_PAYLOAD_KEYS, a comma separated
+// list of base64 keys, or KAPPA_PAYLOAD_KEY_FILE, a file with one base64 key
+// per line as mounted by a KMS or secret manager. It returns nil when neither
+// is set.
+func SealerFromEnv() (*Sealer, error) {
+	var encoded []string
+	if v := os.Getenv("KAPPA_PAYLOAD_KEYS"); v != "" {
+		encoded = strings.Split(v, ",")
+	} else if path := os.Getenv("KAPPA_PAYLOAD_KEY_FILE"); path != "" {
+		file, err := os.Open(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read payload keys: %w", err)
+		}
+		defer file.Close()
+		scanner := bufio.NewScanner(file)
+		for scanner.Scan() {
+			encoded = append(encoded, scanner.Text())
+		}
+		if err := scanner.Err(); err != nil {
+			return nil, fmt.Errorf("failed to read payload keys: %w", err)
+		}
+	} else {
+		return nil, nil
+	}
+
+	var keys [][]byte
+	for _, e := range encoded {
+		if e = strings.TrimSpace(e); e == "" {
+			continue
+		}
+		key, err := base64.StdEncoding.DecodeString(e)
+		if err != nil {
+			return nil, fmt.Errorf("invalid payload key %d: %w", len(keys)+1, err)
+		}
+		keys = append(keys, key)
+	}
+	return NewSealer(keys...)
+}
+
+// Seal encrypts plaintext with the current key. The result starts with the
+// ID of the key, which is authenticated along with the ciphertext.
+func (s *Sealer) Seal(plaintext []byte) ([]byte, error) {
+	if s == nil {
+		return append([]byte{formatPlain}, plaintext...), nil
+	}
+	aead := s.keys[string(s.current)]
+	header := append([]byte{formatAESGCM}, s.current...)
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, fmt.Errorf("failed to generate nonce: %w", err)
+	}
+	sealed := append(header, nonce...)
+	return aead.Seal(sealed, nonce, plaintext, header), nil
+}
+
+// Open decrypts a payload returned by Seal, whichever of the sealer's keys
+// sealed it.
+func (s *Sealer) Open(sealed []byte) ([]byte, error) {
+	if len(sealed) == 0 {
+		return nil, fmt.Errorf("empty payload")
+	}
+	switch sealed[0] {
+	case formatPlain:
+		return sealed[1:], nil
+	case formatAESGCM:
+	default:
+		return nil, fmt.Errorf("unknown payload format %d", sealed[0])
+	}
+	if s == nil {
+		return nil, ErrNoKey
+	}
+	if len(sealed) < 1+keyIDLen {
+		return nil, fmt.Errorf("payload too short")
+	}
+	header := sealed[:1+keyIDLen]
+	aead, ok := s.keys[string(header[1:])]
+	if !ok {
+		return nil, ErrNoKey
+	}
+	rest := sealed[len(header):]
+	if len(rest) < aead.NonceSize() {
+		return nil, fmt.Errorf("payload too short")
+	}
+	plaintext, err := aead.Open(nil, rest[:aead.NonceSize()], rest[aead.NonceSize():], header)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt payload: %w", err)
+	}
+	return plaintext, nil
+}
+
+// Encrypted reports whether payloads are encrypted.
+func (s *Sealer) Encrypted() bool {
+	return s != nil
+}
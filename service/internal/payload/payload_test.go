@@ -0,0 +1,118 @@
+package payload
+
+import (
+	"bytes"
+	"encoding/base64"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSealer(t *testing.T) {
+	oldKey := bytes.Repeat([]byte{1}, 32)
+	newKey := bytes.Repeat([]byte{2}, 32)
+	plaintext := []byte(`{"email":"someone@example.com"}`)
+
+	old, err := NewSealer(oldKey)
+	require.NoError(t, err)
+	sealedOld, err := old.Seal(plaintext)
+	require.NoError(t, err)
+	assert.False(t, bytes.Contains(sealedOld, []byte("someone")))
+
+	rotated, err := NewSealer(newKey, oldKey)
+	require.NoError(t, err)
+	opened, err := rotated.Open(sealedOld)
+	require.NoError(t, err, "old keys still open what they sealed")
+	assert.Equal(t, plaintext, opened)
+
+	sealedNew, err := rotated.Seal(plaintext)
+	require.NoError(t, err)
+	_, err = old.Open(sealedNew)
+	assert.ErrorIs(t, err, ErrNoKey)
+
+	sealedNew[len(sealedNew)-1] ^= 1
+	_, err = rotated.Open(sealedNew)
+	assert.Error(t, err, "tampered payloads are rejected")
+
+	_, err = NewSealer([]byte("short"))
+	assert.Error(t, err)
+}
+
+func TestSealer_Nil(t *testing.T) {
+	var s *Sealer
+	assert.False(t, s.Encrypted())
+	sealed, err := s.Seal([]byte("body"))
+	require.NoError(t, err)
+	opened, err := s.Open(sealed)
+	require.NoError(t, err)
+	assert.Equal(t, []byte("body"), opened)
+
+	encrypted, err := NewSealer(bytes.Repeat([]byte{1}, 32))
+	require.NoError(t, err)
+	opened, err = encrypted.Open(sealed)
+	require.NoError(t, err, "payloads kept before a key was set can still be read")
+	assert.Equal(t, []byte("body"), opened)
+	sealed, err = encrypted.Seal([]byte("body"))
+	require.NoError(t, err)
+	_, err = s.Open(sealed)
+	assert.ErrorIs(t, err, ErrNoKey)
+}
+
+func TestSealerFromEnv(t *testing.T) {
+	key := base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{3}, 32))
+
+	t.Setenv("KAPPA_PAYLOAD_KEYS", "")
+	t.Setenv("KAPPA_PAYLOAD_KEY_FILE", "")
+	s, err := SealerFromEnv()
+	require.NoError(t, err)
+	assert.Nil(t, s)
+
+	path := filepath.Join(t.TempDir(), "keys")
+	require.NoError(t, os.WriteFile(path, []byte(key+"\n\n"), 0600))
+	t.Setenv("KAPPA_PAYLOAD_KEY_FILE", path)
+	s, err = SealerFromEnv()
+	require.NoError(t, err)
+	assert.True(t, s.Encrypted())
+
+	t.Setenv("KAPPA_PAYLOAD_KEYS", key+",not-base64")
+	_, err = SealerFromEnv()
+	assert.Error(t, err)
+}
+
+func TestPolicy_RedactBody(t *testing.T) {
+	body := []byte(`{"user":{"email":"a@example.com","name":"A"},"cards":[{"number":"4111"},{"number":"5500"}],"total":3}`)
+	p := &Policy{Fields: []string{"user.email", "cards.*.number", "missing.field"}}
+	assert.JSONEq(t,
+		`{"user":{"email":"[REDACTED]","name":"A"},"cards":[{"number":"[REDACTED]"},{"number":"[REDACTED]"}],"total":3}`,
+		string(p.RedactBody(body)))
+
+	assert.Equal(t, `"[REDACTED]"`, string(p.RedactBody([]byte("email=a@example.com"))),
+		"bodies that can't be searched are redacted whole")
+	assert.Nil(t, (&Policy{OmitBody: true}).RedactBody(body))
+	assert.Equal(t, body, (*Policy)(nil).RedactBody(body))
+}
+
+func TestPolicy_RedactValue(t *testing.T) {
+	v := map[string]any{"ssn": "123", "nested": map[string]any{"ssn": "456"}}
+	redacted := (&Policy{Fields: []string{"ssn", "*.ssn"}}).RedactValue(v)
+	assert.Equal(t, map[string]any{"ssn": Redacted, "nested": map[string]any{"ssn": Redacted}}, redacted)
+	assert.Equal(t, "123", v["ssn"], "the original is left alone")
+}
+
+func TestPolicy_RedactHeaders(t *testing.T) {
+	headers := map[string]string{"authorization": "Bearer x", "X-Api-Key": "k", "Accept": "*/*"}
+	assert.Equal(t, map[string]string{"authorization": Redacted, "X-Api-Key": "k", "Accept": "*/*"},
+		(*Policy)(nil).RedactHeaders(headers))
+	assert.Equal(t, map[string]string{"authorization": Redacted, "X-Api-Key": Redacted, "Accept": "*/*"},
+		(&Policy{Headers: []string{"x-api-key"}}).RedactHeaders(headers))
+}
+
+func TestPolicy_Validate(t *testing.T) {
+	assert.NoError(t, (*Policy)(nil).Validate())
+	assert.NoError(t, (&Policy{Fields: []string{"a.*.b"}}).Validate())
+	assert.Error(t, (&Policy{Fields: []string{"a..b"}}).Validate())
+	assert.Error(t, (&Policy{Headers: []string{""}}).Validate())
+}
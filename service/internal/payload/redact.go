@@ -0,0 +1,148 @@
+package payload
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// Redacted replaces redacted values
+const Redacted = "[REDACTED]"
+
+// sensitiveHeaders are redacted whatever the policy
+var sensitiveHeaders = []string{"Authorization", "Cookie", "Set-Cookie", "Proxy-Authorization"}
+
+// Policy is what of a function's payloads is redacted before they are kept.
+type Policy struct {
+	// Fields are dotted paths into JSON bodies, like "user.email", where "*"
+	// matches any key or array element. Values found are replaced, bodies
+	// that aren't JSON are replaced whole.
+	Fields []string `json:"fields,omitempty"`
+	// Headers are redacted on top of Authorization and cookies
+	Headers []string `json:"headers,omitempty"`
+	// OmitBody keeps no body at all
+	OmitBody bool `json:"omitBody,omitempty"`
+}
+
+// Validate checks the paths are usable.
+func (p *Policy) Validate() error {
+	if p == nil {
+		return nil
+	}
+	for _, field := range p.Fields {
+		for _, segment := range strings.Split(field, ".") {
+			if segment == "" {
+				return fmt.Errorf("invalid field %q", field)
+			}
+		}
+	}
+	for _, header := range p.Headers {
+		if header == "" {
+			return fmt.Errorf("empty header name")
+		}
+	}
+	return nil
+}
+
+// RedactBody returns body with the policy's fields redacted. A nil policy
+// keeps the body as is.
+func (p *Policy) RedactBody(body []byte) []byte {
+	if p == nil || len(body) == 0 {
+		return body
+	}
+	if p.OmitBody {
+		return nil
+	}
+	if len(p.Fields) == 0 {
+		return body
+	}
+	var v any
+	if err := json.Unmarshal(body, &v); err != nil {
+		redacted, _ := json.Marshal(Redacted)
+		return redacted
+	}
+	redacted, err := json.Marshal(p.RedactValue(v))
+	if err != nil {
+		return body
+	}
+	return redacted
+}
+
+// RedactValue returns a copy of a decoded JSON value with the policy's
+// fields redacted.
+func (p *Policy) RedactValue(v any) any {
+	if p == nil {
+		return v
+	}
+	if p.OmitBody {
+		return nil
+	}
+	v = clone(v)
+	for _, field := range p.Fields {
+		v = redactPath(v, strings.Split(field, "."))
+	}
+	return v
+}
+
+func redactPath(v any, path []string) any {
+	if len(path) == 0 {
+		return Redacted
+	}
+	switch v := v.(type) {
+	case map[string]any:
+		for key, child := range v {
+			if path[0] == "*" || path[0] == key {
+				v[key] = redactPath(child, path[1:])
+			}
+		}
+	case []any:
+		for i, child := range v {
+			if path[0] == "*" {
+				v[i] = redactPath(child, path[1:])
+			}
+		}
+	}
+	return v
+}
+
+func clone(v any) any {
+	switch v := v.(type) {
+	case map[string]any:
+		c := make(map[string]any, len(v))
+		for key, child := range v {
+			c[key] = clone(child)
+		}
+		return c
+	case []any:
+		c := make([]any, len(v))
+		for i, child := range v {
+			c[i] = clone(child)
+		}
+		return c
+	}
+	return v
+}
+
+// RedactHeaders returns a copy of headers with sensitive ones and the
+// policy's redacted.
+func (p *Policy) RedactHeaders(headers map[string]string) map[string]string {
+	if headers == nil {
+		return nil
+	}
+	redact := sensitiveHeaders
+	if p != nil {
+		redact = append(redact[:len(redact):len(redact)], p.Headers...)
+	}
+	c := make(map[string]string, len(headers))
+	for name, value := range headers {
+		for _, r := range redact {
+			if http.CanonicalHeaderKey(name) == http.CanonicalHeaderKey(r) {
+				value = Redacted
+				break
+			}
+		}
+		c[name] = value
+	}
+	return c
+}
@@ -0,0 +1,144 @@
+// Package ports hands out host ports from a range to functions exposing
+// them, for protocols other than HTTP.
+package ports
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// DefaultRange is where ports are allocated unless KAPPA_EXPOSED_PORTS says
+const DefaultRange = "30000-30999"
+
+// ErrExhausted is returned when every port in the range is taken
+var ErrExhausted = errors.New("no free ports left to expose")
+
+// Allocator listens on free ports in a range on behalf of their owners.
+type Allocator struct {
+	min, max int
+	mu       sync.Mutex
+	owners   map[int]string
+}
+
+// NewAllocator allocates ports from min to max inclusive.
+func NewAllocator(min, max int) (*Allocator, error) {
+	if min <= 0 || max > 65535 || min > max {
+		return nil, fmt.Errorf("invalid port range %d-%d", min, max)
+	}
+	return &Allocator{min: min, max: max, owners: make(map[int]string)}, nil
+}
+
+// ParseRange parses a range like "30000-30999".
+func ParseRange(s string) (int, int, error) {
+	lo, hi, ok := strings.Cut(s, "-")
+	if !ok {
+		return 0, 0, fmt.Errorf("invalid port range %q, expected MIN-MAX", s)
+	}
+	min, err := strconv.Atoi(strings.TrimSpace(lo))
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid port range %q: %w", s, err)
+	}
+	max, err := strconv.Atoi(strings.TrimSpace(hi))
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid port range %q: %w", s, err)
+	}
+	return min, max, nil
+}
+
+// FromEnv allocates from KAPPA_EXPOSED_PORTS, DefaultRange when unset.
+func FromEnv() (*Allocator, error) {
+	r := os.Getenv("KAPPA_EXPOSED_PORTS")
+	if r == "" {
+		r = DefaultRange
+	}
+	min, max, err := ParseRange(r)
+	if err != nil {
+		return nil, err
+	}
+	return NewAllocator(min, max)
+}
+
+// Listen listens on port for owner, or on the first free port in the range
+// when port is 0. Ports taken by other programs are skipped.
+func (a *Allocator) Listen(owner string, port int) (net.Listener, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if port != 0 {
+		if port < a.min || port > a.max {
+			return nil, fmt.Errorf("port %d is outside %d-%d", port, a.min, a.max)
+		}
+		if taken, exists := a.owners[port]; exists {
+			return nil, fmt.Errorf("port %d is exposed by %s", port, taken)
+		}
+		return a.listen(owner, port)
+	}
+	for port := a.min; port <= a.max; port++ {
+		if _, exists := a.owners[port]; exists {
+			continue
+		}
+		if l, err := a.listen(owner, port); err == nil {
+			return l, nil
+		}
+	}
+	return nil, ErrExhausted
+}
+
+func (a *Allocator) listen(owner string, port int) (net.Listener, error) {
+	l, err := net.Listen("tcp", fmt.Sprintf(":%d", port))
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen on port %d: %w", port, err)
+	}
+	a.owners[port] = owner
+	return l, nil
+}
+
+// Check reports whether Listen could be asked for port for owner, or for
+// any port when it is 0, without listening. Ports owner already holds count
+// as free.
+func (a *Allocator) Check(owner string, port int) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if port != 0 {
+		if port < a.min || port > a.max {
+			return fmt.Errorf("port %d is outside %d-%d", port, a.min, a.max)
+		}
+		if taken, exists := a.owners[port]; exists && taken != owner {
+			return fmt.Errorf("port %d is exposed by %s", port, taken)
+		}
+		return nil
+	}
+	for _, taken := range a.owners {
+		if taken == owner {
+			return nil
+		}
+	}
+	if len(a.owners) > a.max-a.min {
+		return ErrExhausted
+	}
+	return nil
+}
+
+// Release frees a port once its listener is closed.
+func (a *Allocator) Release(port int) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	delete(a.owners, port)
+}
+
+// Owners returns who each allocated port is exposed for.
+func (a *Allocator) Owners() map[int]string {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	owners := make(map[int]string, len(a.owners))
+	for port, owner := range a.owners {
+		owners[port] = owner
+	}
+	return owners
+}
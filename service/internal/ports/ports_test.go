@@ -0,0 +1,65 @@
+package ports
+
+import (
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// freeRange returns a range of n ports nothing is listening on, found by
+// listening on a random one first
+func freeRange(t *testing.T, n int) (int, int) {
+	l, err := net.Listen("tcp", ":0")
+	require.NoError(t, err)
+	port := l.Addr().(*net.TCPAddr).Port
+	require.NoError(t, l.Close())
+	return port, port + n - 1
+}
+
+func TestAllocator_Listen(t *testing.T) {
+	min, max := freeRange(t, 2)
+	a, err := NewAllocator(min, max)
+	require.NoError(t, err)
+
+	first, err := a.Listen("redis", 0)
+	require.NoError(t, err)
+	defer first.Close()
+	assert.Equal(t, min, first.Addr().(*net.TCPAddr).Port)
+
+	_, err = a.Listen("mqtt", min)
+	assert.ErrorContains(t, err, "exposed by redis")
+	_, err = a.Listen("mqtt", max+1)
+	assert.ErrorContains(t, err, "outside")
+
+	second, err := a.Listen("mqtt", 0)
+	require.NoError(t, err)
+	assert.Equal(t, map[int]string{min: "redis", max: "mqtt"}, a.Owners())
+
+	_, err = a.Listen("another", 0)
+	assert.ErrorIs(t, err, ErrExhausted)
+	assert.ErrorIs(t, a.Check("another", 0), ErrExhausted)
+	assert.NoError(t, a.Check("redis", 0), "redis already has a port")
+	assert.NoError(t, a.Check("redis", min))
+	assert.ErrorContains(t, a.Check("redis", max), "exposed by mqtt")
+
+	require.NoError(t, second.Close())
+	a.Release(max)
+	third, err := a.Listen("another", 0)
+	require.NoError(t, err)
+	defer third.Close()
+	assert.Equal(t, max, third.Addr().(*net.TCPAddr).Port)
+}
+
+func TestParseRange(t *testing.T) {
+	min, max, err := ParseRange("30000-30999")
+	require.NoError(t, err)
+	assert.Equal(t, 30000, min)
+	assert.Equal(t, 30999, max)
+
+	_, _, err = ParseRange("30000")
+	assert.Error(t, err)
+	_, err = NewAllocator(31000, 30000)
+	assert.Error(t, err)
+}
@@ -0,0 +1,188 @@
+// Package prewarm pulls and unpacks the images functions run in ahead of
+// the first function needing them, so the first deploy on a fresh host
+// doesn't wait minutes on a pull.
+package prewarm
+
+import (
+	"context"
+	"kappa-v2/service/internal/kappa"
+	"kappa-v2/service/internal/runtimes"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultTimeout bounds each image's pull
+const DefaultTimeout = 15 * time.Minute
+
+// DefaultImages are warmed on top of the runtime images, the image binary
+// functions usually run in
+var DefaultImages = []string{"docker.io/library/alpine:latest"}
+
+// Image states
+const (
+	StatePending = "pending"
+	StatePulling = "pulling"
+	StateReady   = "ready"
+	StateFailed  = "failed"
+)
+
+// Image is one image being warmed.
+type Image struct {
+	Ref string `json:"ref"`
+	// Runtime is the runtime version the image is for, empty for images
+	// added with KAPPA_PREWARM_IMAGES
+	Runtime string `json:"runtime,omitempty"`
+	State   string `json:"state"`
+	// Pulled is whether the image had to be pulled or unpacked, false when
+	// it was already warm
+	Pulled     bool       `json:"pulled"`
+	Error      string     `json:"error,omitempty"`
+	StartedAt  *time.Time `json:"startedAt,omitempty"`
+	FinishedAt *time.Time `json:"finishedAt,omitempty"`
+}
+
+// Report is the state of the last warm-up.
+type Report struct {
+	Running    bool       `json:"running"`
+	StartedAt  *time.Time `json:"startedAt,omitempty"`
+	FinishedAt *time.Time `json:"finishedAt,omitempty"`
+	Images     []Image    `json:"images"`
+}
+
+// Images lists the versions in matrix and extra, without duplicates.
+func Images(matrix *runtimes.Matrix, extra []string) []Image {
+	seen := make(map[string]bool)
+	var images []Image
+	for _, v := range matrix.Versions() {
+		if ref := v.Ref(); !seen[ref] {
+			seen[ref] = true
+			images = append(images, Image{Ref: ref, Runtime: v.Name, State: StatePending})
+		}
+	}
+	for _, ref := range extra {
+		if !seen[ref] {
+			seen[ref] = true
+			images = append(images, Image{Ref: ref, State: StatePending})
+		}
+	}
+	return images
+}
+
+// ExtraFromEnv returns the images in KAPPA_PREWARM_IMAGES, comma separated,
+// or DefaultImages when unset. Set to "none" to only warm runtime images.
+func ExtraFromEnv() []string {
+	v, ok := os.LookupEnv("KAPPA_PREWARM_IMAGES")
+	if !ok {
+		return DefaultImages
+	}
+	var extra []string
+	for _, ref := range strings.Split(v, ",") {
+		if ref = strings.TrimSpace(ref); ref != "" && ref != "none" {
+			extra = append(extra, ref)
+		}
+	}
+	return extra
+}
+
+// Warmer warms images with a backend, one warm-up at a time.
+type Warmer struct {
+	puller kappa.ImagePuller
+	// timeout bounds each image's pull
+	timeout time.Duration
+
+	mu     sync.Mutex
+	report Report
+}
+
+// NewWarmer creates a warmer pulling with puller, giving each image timeout.
+func NewWarmer(puller kappa.ImagePuller, timeout time.Duration) *Warmer {
+	return &Warmer{puller: puller, timeout: timeout, report: Report{Images: []Image{}}}
+}
+
+// Start warms images in the background, returning false when a warm-up is
+// already running.
+func (w *Warmer) Start(images []Image) bool {
+	if !w.begin(images) {
+		return false
+	}
+	go w.run(context.Background(), images)
+	return true
+}
+
+// Run warms images and waits for them, returning false when a warm-up is
+// already running.
+func (w *Warmer) Run(ctx context.Context, images []Image) (Report, bool) {
+	if !w.begin(images) {
+		return Report{}, false
+	}
+	w.run(ctx, images)
+	return w.Status(), true
+}
+
+// Status returns the state of the running or last warm-up.
+func (w *Warmer) Status() Report {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	report := w.report
+	report.Images = append([]Image{}, w.report.Images...)
+	return report
+}
+
+func (w *Warmer) begin(images []Image) bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.report.Running {
+		return false
+	}
+	now := time.Now()
+	w.report = Report{Running: true, StartedAt: &now, Images: append([]Image{}, images...)}
+	return true
+}
+
+// run pulls every image at once, as they mostly share their base layers.
+func (w *Warmer) run(ctx context.Context, images []Image) {
+	var wg sync.WaitGroup
+	for i := range images {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			w.warm(ctx, i, images[i].Ref)
+		}()
+	}
+	wg.Wait()
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	now := time.Now()
+	w.report.Running = false
+	w.report.FinishedAt = &now
+}
+
+func (w *Warmer) warm(ctx context.Context, i int, ref string) {
+	w.update(i, func(img *Image) {
+		now := time.Now()
+		img.State, img.StartedAt = StatePulling, &now
+	})
+
+	ctx, cancel := context.WithTimeout(ctx, w.timeout)
+	pulled, err := w.puller.PullImage(ctx, ref)
+	cancel()
+
+	w.update(i, func(img *Image) {
+		now := time.Now()
+		img.FinishedAt, img.Pulled = &now, pulled
+		if err != nil {
+			img.State, img.Error = StateFailed, err.Error()
+			return
+		}
+		img.State = StateReady
+	})
+}
+
+func (w *Warmer) update(i int, change func(*Image)) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	change(&w.report.Images[i])
+}
@@ -0,0 +1,76 @@
+package prewarm
+
+import (
+	"context"
+	"errors"
+	"kappa-v2/service/internal/runtimes"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type fakePuller struct {
+	mu      sync.Mutex
+	present map[string]bool
+	release chan struct{}
+}
+
+func (p *fakePuller) PullImage(ctx context.Context, ref string) (bool, error) {
+	if p.release != nil {
+		<-p.release
+	}
+	if ref == "broken" {
+		return false, errors.New("not found")
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.present[ref] {
+		return false, nil
+	}
+	p.present[ref] = true
+	return true, nil
+}
+
+func TestImages(t *testing.T) {
+	matrix := runtimes.DefaultMatrix()
+	images := Images(matrix, []string{"docker.io/library/alpine:latest", matrix.Versions()[0].Ref()})
+	require.Len(t, images, len(matrix.Versions())+1, "duplicates are warmed once")
+	assert.Equal(t, matrix.Versions()[0].Name, images[0].Runtime)
+	assert.Equal(t, StatePending, images[0].State)
+	assert.Empty(t, images[len(images)-1].Runtime)
+}
+
+func TestExtraFromEnv(t *testing.T) {
+	assert.Equal(t, DefaultImages, ExtraFromEnv())
+	t.Setenv("KAPPA_PREWARM_IMAGES", "python:3.12-slim, alpine:3.20,")
+	assert.Equal(t, []string{"python:3.12-slim", "alpine:3.20"}, ExtraFromEnv())
+	t.Setenv("KAPPA_PREWARM_IMAGES", "none")
+	assert.Empty(t, ExtraFromEnv())
+}
+
+func TestWarmer(t *testing.T) {
+	puller := &fakePuller{present: map[string]bool{"warm": true}}
+	w := NewWarmer(puller, time.Second)
+	images := []Image{{Ref: "cold", State: StatePending}, {Ref: "warm", State: StatePending}, {Ref: "broken", State: StatePending}}
+
+	report, ok := w.Run(context.Background(), images)
+	require.True(t, ok)
+	assert.False(t, report.Running)
+	require.NotNil(t, report.FinishedAt)
+	assert.Equal(t, StateReady, report.Images[0].State)
+	assert.True(t, report.Images[0].Pulled)
+	assert.Equal(t, StateReady, report.Images[1].State)
+	assert.False(t, report.Images[1].Pulled, "already warm")
+	assert.Equal(t, StateFailed, report.Images[2].State)
+	assert.Equal(t, "not found", report.Images[2].Error)
+
+	puller.release = make(chan struct{})
+	require.True(t, w.Start(images[:1]))
+	assert.False(t, w.Start(images), "one warm-up at a time")
+	assert.True(t, w.Status().Running)
+	close(puller.release)
+	assert.Eventually(t, func() bool { return !w.Status().Running }, time.Second, 10*time.Millisecond)
+}
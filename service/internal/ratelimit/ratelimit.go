@@ -0,0 +1,147 @@
+// Package ratelimit limits how fast functions are invoked with token
+// buckets, per function and per caller, so a misbehaving caller can't take
+// the host's capacity from every other function.
+package ratelimit
+
+import (
+	"fmt"
+	"math"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// sweepEvery is how many buckets are taken from between drops of the ones
+// that have refilled, which are no different from new ones
+const sweepEvery = 1024
+
+// Limit is a token bucket, refilled with PerSecond tokens a second and
+// holding at most Burst, PerSecond rounded up when Burst is 0. Every
+// invocation takes a token.
+type Limit struct {
+	PerSecond float64 `json:"perSecond"`
+	Burst     int     `json:"burst,omitempty"`
+}
+
+// Validate checks the limit lets some invocations through.
+func (l Limit) Validate() error {
+	if l.PerSecond <= 0 || math.IsInf(l.PerSecond, 0) || math.IsNaN(l.PerSecond) {
+		return fmt.Errorf("perSecond must be a positive number")
+	}
+	if l.Burst < 0 {
+		return fmt.Errorf("burst must not be negative")
+	}
+	return nil
+}
+
+func (l Limit) burst() float64 {
+	if l.Burst > 0 {
+		return float64(l.Burst)
+	}
+	return math.Max(1, math.Ceil(l.PerSecond))
+}
+
+// FromEnv returns the limit every caller of every function gets unless the
+// function sets its own, from KAPPA_RATE_LIMIT_PER_SECOND and
+// KAPPA_RATE_LIMIT_BURST, nil when callers aren't limited by default.
+func FromEnv() (*Limit, error) {
+	v := os.Getenv("KAPPA_RATE_LIMIT_PER_SECOND")
+	if v == "" {
+		return nil, nil
+	}
+	var limit Limit
+	var err error
+	if limit.PerSecond, err = strconv.ParseFloat(v, 64); err != nil {
+		return nil, fmt.Errorf("invalid KAPPA_RATE_LIMIT_PER_SECOND %q", v)
+	}
+	if v := os.Getenv("KAPPA_RATE_LIMIT_BURST"); v != "" {
+		if limit.Burst, err = strconv.Atoi(v); err != nil {
+			return nil, fmt.Errorf("invalid KAPPA_RATE_LIMIT_BURST %q", v)
+		}
+	}
+	if err := limit.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid rate limit: %w", err)
+	}
+	return &limit, nil
+}
+
+type bucket struct {
+	tokens float64
+	at     time.Time
+	limit  Limit
+}
+
+// refill tops the bucket up for the time since it was last taken from.
+func (b *bucket) refill(now time.Time) {
+	b.tokens = math.Min(b.limit.burst(), b.tokens+now.Sub(b.at).Seconds()*b.limit.PerSecond)
+	b.at = now
+}
+
+// Store keeps a token bucket for every key taken from.
+type Store interface {
+	// Take takes a token from key's bucket, reporting whether it had one
+	// and, when it didn't, how long until it will
+	Take(key string, limit Limit) (bool, time.Duration)
+}
+
+// Limiter is a Store keeping its buckets in memory, for a single replica.
+type Limiter struct {
+	mu      sync.Mutex
+	buckets map[string]*bucket
+	takes   int
+	now     func() time.Time
+}
+
+// New returns a limiter with every bucket full.
+func New() *Limiter {
+	return &Limiter{
+		buckets: make(map[string]*bucket),
+		now:     time.Now,
+	}
+}
+
+// Take takes a token from key's bucket, reporting whether it had one and,
+// when it didn't, how long until it will. A bucket is refilled at the limit
+// it is taken from with, so changing a limit applies to its next take.
+func (l *Limiter) Take(key string, limit Limit) (bool, time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := l.now()
+	l.sweep(now)
+
+	b, exists := l.buckets[key]
+	if !exists {
+		b = &bucket{tokens: limit.burst(), at: now}
+		l.buckets[key] = b
+	}
+	b.limit = limit
+	b.refill(now)
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0
+	}
+	wait := time.Duration((1 - b.tokens) / limit.PerSecond * float64(time.Second))
+	return false, wait
+}
+
+// sweep drops the buckets that have refilled every so often. The caller
+// must hold mu.
+func (l *Limiter) sweep(now time.Time) {
+	if l.takes++; l.takes < sweepEvery {
+		return
+	}
+	l.takes = 0
+	for key, b := range l.buckets {
+		if b.refill(now); b.tokens >= b.limit.burst() {
+			delete(l.buckets, key)
+		}
+	}
+}
+
+// Len returns how many buckets are kept.
+func (l *Limiter) Len() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return len(l.buckets)
+}
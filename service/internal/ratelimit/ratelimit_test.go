@@ -0,0 +1,137 @@
+package ratelimit
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"kappa-v2/service/internal/redis"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLimiter_Take(t *testing.T) {
+	start := time.Date(2024, 3, 1, 10, 0, 0, 0, time.UTC)
+	now := start
+	l := New()
+	l.now = func() time.Time { return now }
+	limit := Limit{PerSecond: 2, Burst: 3}
+
+	for i := 0; i < 3; i++ {
+		ok, _ := l.Take("cart/alice", limit)
+		require.True(t, ok, "the burst is let through")
+	}
+	ok, wait := l.Take("cart/alice", limit)
+	assert.False(t, ok)
+	assert.Equal(t, 500*time.Millisecond, wait)
+	ok, _ = l.Take("cart/bob", limit)
+	assert.True(t, ok, "callers have buckets of their own")
+
+	now = now.Add(time.Second)
+	for i := 0; i < 2; i++ {
+		ok, _ := l.Take("cart/alice", limit)
+		require.True(t, ok, "the bucket refills at perSecond")
+	}
+	ok, _ = l.Take("cart/alice", limit)
+	assert.False(t, ok)
+
+	// Without a burst, it's perSecond rounded up
+	ok, _ = l.Take("search/alice", Limit{PerSecond: 0.5})
+	assert.True(t, ok)
+	ok, wait = l.Take("search/alice", Limit{PerSecond: 0.5})
+	assert.False(t, ok)
+	assert.Equal(t, 2*time.Second, wait)
+}
+
+func TestLimiter_Sweep(t *testing.T) {
+	now := time.Date(2024, 3, 1, 10, 0, 0, 0, time.UTC)
+	l := New()
+	l.now = func() time.Time { return now }
+	for i := 0; i < sweepEvery-1; i++ {
+		l.Take(fmt.Sprintf("caller-%d", i), Limit{PerSecond: 1})
+	}
+	assert.Equal(t, sweepEvery-1, l.Len())
+
+	// Buckets that refilled are dropped, they'd be made full again anyway
+	now = now.Add(time.Second)
+	l.Take("last", Limit{PerSecond: 1})
+	assert.Equal(t, 1, l.Len())
+}
+
+func TestFromEnv(t *testing.T) {
+	limit, err := FromEnv()
+	require.NoError(t, err)
+	assert.Nil(t, limit, "callers aren't limited by default")
+
+	t.Setenv("KAPPA_RATE_LIMIT_PER_SECOND", "10")
+	t.Setenv("KAPPA_RATE_LIMIT_BURST", "20")
+	limit, err = FromEnv()
+	require.NoError(t, err)
+	assert.Equal(t, &Limit{PerSecond: 10, Burst: 20}, limit)
+
+	t.Setenv("KAPPA_RATE_LIMIT_PER_SECOND", "0")
+	_, err = FromEnv()
+	assert.Error(t, err)
+}
+
+func TestRedis_Take(t *testing.T) {
+	var mu sync.Mutex
+	var commands []string
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer listener.Close()
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		r := bufio.NewReader(conn)
+		for {
+			// Commands are arrays of bulk strings, the first is all we need
+			line, err := r.ReadString('\n')
+			if err != nil {
+				return
+			}
+			var n int
+			fmt.Sscanf(line, "*%d", &n)
+			var args []string
+			for range n {
+				var size int
+				header, _ := r.ReadString('\n')
+				fmt.Sscanf(header, "$%d", &size)
+				arg := make([]byte, size+2)
+				io.ReadFull(r, arg)
+				args = append(args, string(arg[:size]))
+			}
+			mu.Lock()
+			commands = append(commands, args[0])
+			mu.Unlock()
+			switch args[0] {
+			case "EVALSHA":
+				io.WriteString(conn, "-NOSCRIPT No matching script\r\n")
+			case "EVAL":
+				assert.Equal(t, []string{"1", "kappa:rate:cart", "2", "3"}, args[2:])
+				io.WriteString(conn, "*2\r\n:0\r\n$4\r\n0.25\r\n")
+			}
+		}
+	}()
+
+	r := NewRedis(redis.New(redis.Options{Addr: listener.Addr().String()}), "kappa:rate:")
+	ok, wait := r.Take("cart", Limit{PerSecond: 2, Burst: 3})
+	assert.False(t, ok)
+	assert.Equal(t, 250*time.Millisecond, wait)
+	mu.Lock()
+	assert.Equal(t, []string{"EVALSHA", "EVAL"}, commands, "the script is loaded when Redis doesn't have it")
+	mu.Unlock()
+
+	// Invocations aren't turned away when Redis is down
+	listener.Close()
+	down := NewRedis(redis.New(redis.Options{Addr: listener.Addr().String()}), "kappa:rate:")
+	ok, _ = down.Take("cart", Limit{PerSecond: 2, Burst: 3})
+	assert.True(t, ok)
+}
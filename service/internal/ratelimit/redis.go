@@ -0,0 +1,107 @@
+package ratelimit
+
+import (
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"kappa-v2/pkg/logger"
+	"kappa-v2/service/internal/redis"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// takeScript takes a token from the bucket at KEYS[1], refilled at
+// ARGV[1] tokens a second up to ARGV[2], on Redis's clock so replicas with
+// skewed clocks agree. It returns 1 and 0 when a token was taken, and 0 and
+// the seconds until there is one otherwise, as a string as Lua numbers are
+// truncated to integers on the way out. Buckets expire once they'd have
+// refilled.
+const takeScript = `
+redis.replicate_commands()
+local rate = tonumber(ARGV[1])
+local burst = tonumber(ARGV[2])
+local time = redis.call('TIME')
+local now = tonumber(time[1]) + tonumber(time[2]) / 1000000
+local state = redis.call('HMGET', KEYS[1], 'tokens', 'at')
+local tokens = tonumber(state[1]) or burst
+local at = tonumber(state[2]) or now
+tokens = math.min(burst, tokens + math.max(0, now - at) * rate)
+local taken = 0
+local wait = 0
+if tokens >= 1 then
+  tokens = tokens - 1
+  taken = 1
+else
+  wait = (1 - tokens) / rate
+end
+redis.call('HSET', KEYS[1], 'tokens', tostring(tokens), 'at', tostring(now))
+redis.call('PEXPIRE', KEYS[1], math.ceil(burst / rate * 1000) + 1000)
+return {taken, tostring(wait)}
+`
+
+var takeScriptSHA = func() string {
+	sum := sha1.Sum([]byte(takeScript))
+	return hex.EncodeToString(sum[:])
+}()
+
+// redisTimeout bounds taking a token, invocations aren't held up long by a
+// slow Redis
+const redisTimeout = 250 * time.Millisecond
+
+// Redis is a Store keeping its buckets in Redis, so every replica of the
+// service takes from the same ones. When Redis can't be reached
+// invocations are let through rather than turned away.
+type Redis struct {
+	client *redis.Client
+	prefix string
+}
+
+// NewRedis returns a store keeping buckets under keys starting with prefix.
+func NewRedis(client *redis.Client, prefix string) *Redis {
+	return &Redis{client: client, prefix: prefix}
+}
+
+// Take takes a token from key's bucket, like Limiter.Take.
+func (r *Redis) Take(key string, limit Limit) (bool, time.Duration) {
+	ctx, cancel := context.WithTimeout(context.Background(), redisTimeout)
+	defer cancel()
+	taken, wait, err := r.take(ctx, key, limit)
+	if err != nil {
+		logger.Get().Warn("Failed to take rate limit token from redis, letting the invocation through", zap.String("key", key), zap.Error(err))
+		return true, 0
+	}
+	return taken, wait
+}
+
+func (r *Redis) take(ctx context.Context, key string, limit Limit) (bool, time.Duration, error) {
+	args := []string{
+		r.prefix + key,
+		strconv.FormatFloat(limit.PerSecond, 'g', -1, 64),
+		strconv.FormatFloat(limit.burst(), 'g', -1, 64),
+	}
+	reply, err := r.client.Do(ctx, append([]string{"EVALSHA", takeScriptSHA, "1"}, args...)...)
+	var replyErr redis.Error
+	if errors.As(err, &replyErr) && strings.HasPrefix(string(replyErr), "NOSCRIPT") {
+		// Loaded by the first replica to need it after Redis restarted
+		reply, err = r.client.Do(ctx, append([]string{"EVAL", takeScript, "1"}, args...)...)
+	}
+	if err != nil {
+		return false, 0, err
+	}
+	items, ok := reply.([]any)
+	if !ok || len(items) != 2 {
+		return false, 0, fmt.Errorf("unexpected reply %v", reply)
+	}
+	taken, _ := items[0].(int64)
+	waitText, _ := items[1].(string)
+	seconds, err := strconv.ParseFloat(waitText, 64)
+	if err != nil {
+		return false, 0, fmt.Errorf("unexpected reply %v", reply)
+	}
+	return taken == 1, time.Duration(seconds * float64(time.Second)), nil
+}
@@ -0,0 +1,245 @@
+// Package rbac decides what callers of the service API may do. Subjects,
+// identified by their API key, are bound to roles per project, and each
+// role grants a set of permissions.
+package rbac
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"regexp"
+	"slices"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Role is a named set of permissions.
+type Role string
+
+const (
+	Admin    Role = "admin"
+	Deployer Role = "deployer"
+	Invoker  Role = "invoker"
+	Viewer   Role = "viewer"
+)
+
+// Permission is what a route group needs.
+type Permission string
+
+const (
+	// Read is looking at functions, projects and schedules
+	Read Permission = "read"
+	// Invoke is calling functions
+	Invoke Permission = "invoke"
+	// Deploy is changing functions, projects and schedules
+	Deploy Permission = "deploy"
+	// Manage is operating the service: maintenance, the admin API and roles
+	Manage Permission = "manage"
+)
+
+// Roles lists the permissions each role grants.
+var Roles = map[Role][]Permission{
+	Admin:    {Read, Invoke, Deploy, Manage},
+	Deployer: {Read, Invoke, Deploy},
+	Invoker:  {Read, Invoke},
+	Viewer:   {Read},
+}
+
+// AllProjects binds a role in every project, including functions outside
+// any project.
+const AllProjects = "*"
+
+// ParseRole returns the role named name.
+func ParseRole(name string) (Role, error) {
+	if _, ok := Roles[Role(name)]; !ok {
+		return "", fmt.Errorf("unknown role %q, expected admin, deployer, invoker or viewer", name)
+	}
+	return Role(name), nil
+}
+
+// Allows reports whether the role grants p.
+func (r Role) Allows(p Permission) bool {
+	return slices.Contains(Roles[r], p)
+}
+
+// Binding grants a role in a project, or in every project.
+type Binding struct {
+	Role    Role   `json:"role"`
+	Project string `json:"project"`
+}
+
+// Validate checks the role exists and the project is set.
+func (b Binding) Validate() error {
+	if _, err := ParseRole(string(b.Role)); err != nil {
+		return err
+	}
+	if b.Project == "" {
+		return fmt.Errorf("missing project, use %q for every project", AllProjects)
+	}
+	return nil
+}
+
+// Subject is someone or something calling the API, like a team or a CI
+// pipeline.
+type Subject struct {
+	Name      string    `json:"name"`
+	Bindings  []Binding `json:"bindings"`
+	CreatedAt time.Time `json:"createdAt"`
+	keyHash   string
+}
+
+// Allowed reports whether the subject has p in project. Manage is only
+// granted by bindings in every project.
+func (s Subject) Allowed(p Permission, project string) bool {
+	for _, b := range s.Bindings {
+		if !b.Role.Allows(p) {
+			continue
+		}
+		if b.Project == AllProjects || (p != Manage && b.Project == project && project != "") {
+			return true
+		}
+	}
+	return false
+}
+
+// AllowedAnywhere reports whether the subject has p in at least one project.
+func (s Subject) AllowedAnywhere(p Permission) bool {
+	for _, b := range s.Bindings {
+		if b.Role.Allows(p) && (p != Manage || b.Project == AllProjects) {
+			return true
+		}
+	}
+	return false
+}
+
+var subjectName = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._@-]*$`)
+
+// Store keeps the subjects and their keys. Only a hash of each key is kept.
+type Store struct {
+	mu       sync.RWMutex
+	subjects map[string]*Subject
+	keys     map[string]string
+}
+
+// NewStore creates a store without subjects.
+func NewStore() *Store {
+	return &Store{
+		subjects: make(map[string]*Subject),
+		keys:     make(map[string]string),
+	}
+}
+
+func hashKey(key string) string {
+	digest := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(digest[:])
+}
+
+func newKey() (string, error) {
+	b := make([]byte, 24)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("failed to generate key: %w", err)
+	}
+	return "kappa_" + hex.EncodeToString(b), nil
+}
+
+// Put creates or updates the subject's bindings. A new subject gets a key,
+// which is returned only this once.
+func (s *Store) Put(name string, bindings []Binding) (key string, err error) {
+	if !subjectName.MatchString(name) {
+		return "", fmt.Errorf("invalid subject name %q", name)
+	}
+	for _, b := range bindings {
+		if err := b.Validate(); err != nil {
+			return "", err
+		}
+	}
+
+	bindings = append([]Binding{}, bindings...)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if subject, exists := s.subjects[name]; exists {
+		subject.Bindings = bindings
+		return "", nil
+	}
+	key, err = newKey()
+	if err != nil {
+		return "", err
+	}
+	subject := &Subject{Name: name, Bindings: bindings, CreatedAt: time.Now(), keyHash: hashKey(key)}
+	s.subjects[name] = subject
+	s.keys[subject.keyHash] = name
+	return key, nil
+}
+
+// RotateKey replaces the subject's key, the old one stops working at once.
+func (s *Store) RotateKey(name string) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	subject, exists := s.subjects[name]
+	if !exists {
+		return "", fmt.Errorf("subject not found: %s", name)
+	}
+	key, err := newKey()
+	if err != nil {
+		return "", err
+	}
+	delete(s.keys, subject.keyHash)
+	subject.keyHash = hashKey(key)
+	s.keys[subject.keyHash] = name
+	return key, nil
+}
+
+// Delete removes the subject, reporting whether it existed.
+func (s *Store) Delete(name string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	subject, exists := s.subjects[name]
+	if exists {
+		delete(s.keys, subject.keyHash)
+		delete(s.subjects, name)
+	}
+	return exists
+}
+
+// Get returns a copy of the subject.
+func (s *Store) Get(name string) (Subject, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	subject, exists := s.subjects[name]
+	if !exists {
+		return Subject{}, false
+	}
+	return s.copy(subject), true
+}
+
+// List returns copies of every subject ordered by name.
+func (s *Store) List() []Subject {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	subjects := make([]Subject, 0, len(s.subjects))
+	for _, subject := range s.subjects {
+		subjects = append(subjects, s.copy(subject))
+	}
+	sort.Slice(subjects, func(i, j int) bool { return subjects[i].Name < subjects[j].Name })
+	return subjects
+}
+
+// Authenticate returns the subject key belongs to.
+func (s *Store) Authenticate(key string) (Subject, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	name, exists := s.keys[hashKey(key)]
+	if !exists {
+		return Subject{}, false
+	}
+	return s.copy(s.subjects[name]), true
+}
+
+func (s *Store) copy(subject *Subject) Subject {
+	c := *subject
+	c.Bindings = slices.Clone(subject.Bindings)
+	return c
+}
@@ -0,0 +1,73 @@
+package rbac
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSubject_Allowed(t *testing.T) {
+	subject := Subject{Bindings: []Binding{
+		{Role: Deployer, Project: "shop"},
+		{Role: Viewer, Project: AllProjects},
+	}}
+	assert.True(t, subject.Allowed(Deploy, "shop"))
+	assert.True(t, subject.Allowed(Invoke, "shop"))
+	assert.False(t, subject.Allowed(Deploy, "billing"))
+	assert.True(t, subject.Allowed(Read, "billing"))
+	assert.True(t, subject.Allowed(Read, ""), "every project includes functions outside any")
+	assert.False(t, subject.Allowed(Invoke, ""))
+	assert.True(t, subject.AllowedAnywhere(Deploy))
+	assert.False(t, subject.AllowedAnywhere(Manage))
+
+	projectAdmin := Subject{Bindings: []Binding{{Role: Admin, Project: "shop"}}}
+	assert.True(t, projectAdmin.Allowed(Deploy, "shop"))
+	assert.False(t, projectAdmin.Allowed(Manage, "shop"), "only admins of every project manage the service")
+	assert.False(t, projectAdmin.AllowedAnywhere(Manage))
+}
+
+func TestStore(t *testing.T) {
+	store := NewStore()
+	key, err := store.Put("ci", []Binding{{Role: Deployer, Project: "shop"}})
+	require.NoError(t, err)
+	require.NotEmpty(t, key)
+
+	subject, ok := store.Authenticate(key)
+	require.True(t, ok)
+	assert.Equal(t, "ci", subject.Name)
+	_, ok = store.Authenticate("kappa_wrong")
+	assert.False(t, ok)
+
+	again, err := store.Put("ci", []Binding{{Role: Viewer, Project: "shop"}})
+	require.NoError(t, err)
+	assert.Empty(t, again, "updating bindings keeps the key")
+	subject, _ = store.Authenticate(key)
+	assert.Equal(t, []Binding{{Role: Viewer, Project: "shop"}}, subject.Bindings)
+
+	rotated, err := store.RotateKey("ci")
+	require.NoError(t, err)
+	_, ok = store.Authenticate(key)
+	assert.False(t, ok, "the old key stops working")
+	_, ok = store.Authenticate(rotated)
+	assert.True(t, ok)
+
+	_, err = store.Put("bad name", nil)
+	assert.Error(t, err)
+	_, err = store.Put("ops", []Binding{{Role: "owner", Project: "shop"}})
+	assert.Error(t, err)
+	_, err = store.Put("ops", []Binding{{Role: Viewer}})
+	assert.Error(t, err)
+
+	_, err = store.Put("ops", nil)
+	require.NoError(t, err)
+	subjects := store.List()
+	require.Len(t, subjects, 2)
+	assert.Equal(t, "ci", subjects[0].Name)
+	assert.NotNil(t, subjects[1].Bindings)
+
+	assert.True(t, store.Delete("ci"))
+	assert.False(t, store.Delete("ci"))
+	_, ok = store.Authenticate(rotated)
+	assert.False(t, ok)
+}
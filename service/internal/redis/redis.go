@@ -0,0 +1,273 @@
+// Package redis is a small Redis client, speaking just enough of the RESP
+// protocol for the service to share state, like rate limits, between its
+// replicas.
+package redis
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// defaultPoolSize is how many idle connections are kept
+	defaultPoolSize = 16
+	// dialTimeout bounds connecting, commands are bounded by their context
+	// or commandTimeout
+	dialTimeout    = 5 * time.Second
+	commandTimeout = 5 * time.Second
+)
+
+// ErrNil is returned for nil replies, like GET of a missing key
+var ErrNil = errors.New("redis: nil")
+
+// Error is an error reply.
+type Error string
+
+func (e Error) Error() string {
+	return "redis: " + string(e)
+}
+
+// Options are how to connect to Redis.
+type Options struct {
+	Addr     string
+	Username string
+	Password string
+	DB       int
+	// PoolSize is how many idle connections are kept, 16 when 0
+	PoolSize int
+}
+
+// ParseURL parses a redis://[[user]:password@]host[:port][/db] URL.
+func ParseURL(raw string) (Options, error) {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return Options{}, err
+	}
+	if u.Scheme != "redis" {
+		return Options{}, fmt.Errorf("unsupported scheme %q, expected redis", u.Scheme)
+	}
+	opts := Options{Addr: u.Host}
+	if u.Port() == "" {
+		opts.Addr = net.JoinHostPort(u.Hostname(), "6379")
+	}
+	if u.User != nil {
+		opts.Username = u.User.Username()
+		opts.Password, _ = u.User.Password()
+	}
+	if db := strings.Trim(u.Path, "/"); db != "" {
+		if opts.DB, err = strconv.Atoi(db); err != nil || opts.DB < 0 {
+			return Options{}, fmt.Errorf("invalid database %q", db)
+		}
+	}
+	return opts, nil
+}
+
+// Client sends commands to Redis over a pool of connections. It is safe
+// for concurrent use.
+type Client struct {
+	opts Options
+	mu   sync.Mutex
+	idle []*conn
+}
+
+// New returns a client connecting as commands need it.
+func New(opts Options) *Client {
+	if opts.PoolSize <= 0 {
+		opts.PoolSize = defaultPoolSize
+	}
+	return &Client{opts: opts}
+}
+
+// FromEnv returns a client of the Redis at KAPPA_REDIS_URL, nil when unset,
+// having checked it answers.
+func FromEnv() (*Client, error) {
+	raw := os.Getenv("KAPPA_REDIS_URL")
+	if raw == "" {
+		return nil, nil
+	}
+	opts, err := ParseURL(raw)
+	if err != nil {
+		return nil, fmt.Errorf("invalid KAPPA_REDIS_URL: %w", err)
+	}
+	c := New(opts)
+	ctx, cancel := context.WithTimeout(context.Background(), dialTimeout)
+	defer cancel()
+	if _, err := c.Do(ctx, "PING"); err != nil {
+		return nil, fmt.Errorf("failed to reach redis at %s: %w", opts.Addr, err)
+	}
+	return c, nil
+}
+
+// Addr returns the address of the Redis the client talks to.
+func (c *Client) Addr() string {
+	return c.opts.Addr
+}
+
+// Do sends a command and returns its reply: a string for simple and bulk
+// strings, an int64 for integers and a []any for arrays. Error replies are
+// returned as Error and nil replies as ErrNil.
+func (c *Client) Do(ctx context.Context, args ...string) (any, error) {
+	cn, err := c.get(ctx)
+	if err != nil {
+		return nil, err
+	}
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		deadline = time.Now().Add(commandTimeout)
+	}
+	cn.SetDeadline(deadline)
+	reply, err := cn.do(args)
+	var replyErr Error
+	if err != nil && !errors.Is(err, ErrNil) && !errors.As(err, &replyErr) {
+		// The connection is in an unknown state
+		cn.Close()
+		return nil, err
+	}
+	c.put(cn)
+	return reply, err
+}
+
+// Close closes the idle connections.
+func (c *Client) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, cn := range c.idle {
+		cn.Close()
+	}
+	c.idle = nil
+	return nil
+}
+
+func (c *Client) get(ctx context.Context) (*conn, error) {
+	c.mu.Lock()
+	if n := len(c.idle); n > 0 {
+		cn := c.idle[n-1]
+		c.idle = c.idle[:n-1]
+		c.mu.Unlock()
+		return cn, nil
+	}
+	c.mu.Unlock()
+	return c.dial(ctx)
+}
+
+func (c *Client) put(cn *conn) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.idle) >= c.opts.PoolSize {
+		cn.Close()
+		return
+	}
+	c.idle = append(c.idle, cn)
+}
+
+// dial connects, authenticating and selecting the database.
+func (c *Client) dial(ctx context.Context) (*conn, error) {
+	d := net.Dialer{Timeout: dialTimeout}
+	nc, err := d.DialContext(ctx, "tcp", c.opts.Addr)
+	if err != nil {
+		return nil, err
+	}
+	cn := &conn{Conn: nc, r: bufio.NewReader(nc)}
+	cn.SetDeadline(time.Now().Add(dialTimeout))
+	if c.opts.Password != "" {
+		args := []string{"AUTH", c.opts.Password}
+		if c.opts.Username != "" {
+			args = []string{"AUTH", c.opts.Username, c.opts.Password}
+		}
+		if _, err := cn.do(args); err != nil {
+			cn.Close()
+			return nil, err
+		}
+	}
+	if c.opts.DB != 0 {
+		if _, err := cn.do([]string{"SELECT", strconv.Itoa(c.opts.DB)}); err != nil {
+			cn.Close()
+			return nil, err
+		}
+	}
+	return cn, nil
+}
+
+type conn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+// do writes a command as an array of bulk strings and reads its reply.
+func (cn *conn) do(args []string) (any, error) {
+	var b strings.Builder
+	fmt.Fprintf(&b, "*%d\r\n", len(args))
+	for _, arg := range args {
+		fmt.Fprintf(&b, "$%d\r\n%s\r\n", len(arg), arg)
+	}
+	if _, err := io.WriteString(cn.Conn, b.String()); err != nil {
+		return nil, err
+	}
+	return readReply(cn.r)
+}
+
+// readReply reads a RESP2 reply.
+func readReply(r *bufio.Reader) (any, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	if len(line) < 3 || !strings.HasSuffix(line, "\r\n") {
+		return nil, fmt.Errorf("redis: malformed reply %q", line)
+	}
+	kind, rest := line[0], line[1:len(line)-2]
+	switch kind {
+	case '+':
+		return rest, nil
+	case '-':
+		return nil, Error(rest)
+	case ':':
+		return strconv.ParseInt(rest, 10, 64)
+	case '$':
+		n, err := strconv.Atoi(rest)
+		if err != nil {
+			return nil, fmt.Errorf("redis: malformed reply %q", line)
+		}
+		if n < 0 {
+			return nil, ErrNil
+		}
+		buf := make([]byte, n+2)
+		if _, err := io.ReadFull(r, buf); err != nil {
+			return nil, err
+		}
+		return string(buf[:n]), nil
+	case '*':
+		n, err := strconv.Atoi(rest)
+		if err != nil {
+			return nil, fmt.Errorf("redis: malformed reply %q", line)
+		}
+		if n < 0 {
+			return nil, ErrNil
+		}
+		items := make([]any, n)
+		for i := range items {
+			items[i], err = readReply(r)
+			var replyErr Error
+			if errors.Is(err, ErrNil) {
+				items[i], err = nil, nil
+			} else if errors.As(err, &replyErr) {
+				items[i], err = replyErr, nil
+			}
+			if err != nil {
+				return nil, err
+			}
+		}
+		return items, nil
+	}
+	return nil, fmt.Errorf("redis: malformed reply %q", line)
+}
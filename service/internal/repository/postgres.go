@@ -0,0 +1,291 @@
+package repository
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"kappa-v2/service/internal/repository/queries"
+	"time"
+)
+
+// queryTimeout bounds each query, the Repository methods take no context
+const queryTimeout = 10 * time.Second
+
+// Postgres keeps functions in the functions table of a database whose
+// schema package database migrated, along with their versions, resources,
+// schedules and audit events. Its queries are generated by sqlc from those in
+// queries/*.sql, run `sqlc generate` in service/ after changing them.
+type Postgres struct {
+	q *queries.Queries
+}
+
+// NewPostgres keeps functions in db.
+func NewPostgres(db *sql.DB) *Postgres {
+	return &Postgres{q: queries.New(db)}
+}
+
+func (p *Postgres) Save(fn Function) error {
+	ctx, cancel := context.WithTimeout(context.Background(), queryTimeout)
+	defer cancel()
+	err := p.q.UpsertFunction(ctx, queries.UpsertFunctionParams{
+		Name:      fn.Name,
+		Config:    fn.Config,
+		Digest:    fn.Digest,
+		UpdatedAt: fn.UpdatedAt,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to save function: %w", err)
+	}
+	return nil
+}
+
+func (p *Postgres) Delete(name string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), queryTimeout)
+	defer cancel()
+	if err := p.q.DeleteFunction(ctx, name); err != nil {
+		return fmt.Errorf("failed to delete function: %w", err)
+	}
+	return nil
+}
+
+func (p *Postgres) List() ([]Function, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), queryTimeout)
+	defer cancel()
+	rows, err := p.q.ListFunctions(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list functions: %w", err)
+	}
+	functions := make([]Function, len(rows))
+	for i, row := range rows {
+		functions[i] = Function{Name: row.Name, Config: row.Config, Digest: row.Digest, UpdatedAt: row.UpdatedAt}
+	}
+	return functions, nil
+}
+
+func (p *Postgres) SaveResource(r Resource) error {
+	ctx, cancel := context.WithTimeout(context.Background(), queryTimeout)
+	defer cancel()
+	err := p.q.UpsertResource(ctx, queries.UpsertResourceParams{
+		Kind:      r.Kind,
+		Name:      r.Name,
+		Spec:      r.Spec,
+		UpdatedAt: r.UpdatedAt,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to save %s: %w", r.Kind, err)
+	}
+	return nil
+}
+
+func (p *Postgres) DeleteResource(kind, name string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), queryTimeout)
+	defer cancel()
+	if err := p.q.DeleteResource(ctx, queries.DeleteResourceParams{Kind: kind, Name: name}); err != nil {
+		return fmt.Errorf("failed to delete %s: %w", kind, err)
+	}
+	return nil
+}
+
+func (p *Postgres) ListResources(kind string) ([]Resource, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), queryTimeout)
+	defer cancel()
+	rows, err := p.q.ListResources(ctx, kind)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list %ss: %w", kind, err)
+	}
+	resources := make([]Resource, len(rows))
+	for i, row := range rows {
+		resources[i] = Resource{Kind: row.Kind, Name: row.Name, Spec: row.Spec, UpdatedAt: row.UpdatedAt}
+	}
+	return resources, nil
+}
+
+// Version is a deployed version of a function as persisted.
+type Version struct {
+	Function   string
+	Version    int
+	Config     json.RawMessage
+	Digest     string
+	DeployedAt time.Time
+	// RolledBackFrom is the version that was current when this one was
+	// restored by a rollback
+	RolledBackFrom int
+}
+
+// SaveVersion adds a function's version.
+func (p *Postgres) SaveVersion(v Version) error {
+	ctx, cancel := context.WithTimeout(context.Background(), queryTimeout)
+	defer cancel()
+	err := p.q.InsertFunctionVersion(ctx, queries.InsertFunctionVersionParams{
+		Function:       v.Function,
+		Version:        int32(v.Version),
+		Config:         v.Config,
+		Digest:         v.Digest,
+		DeployedAt:     v.DeployedAt,
+		RolledBackFrom: int32(v.RolledBackFrom),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to save version: %w", err)
+	}
+	return nil
+}
+
+// ListVersions returns a function's versions, oldest first.
+func (p *Postgres) ListVersions(function string) ([]Version, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), queryTimeout)
+	defer cancel()
+	rows, err := p.q.ListFunctionVersions(ctx, function)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list versions: %w", err)
+	}
+	versions := make([]Version, len(rows))
+	for i, row := range rows {
+		versions[i] = Version{
+			Function:       row.Function,
+			Version:        int(row.Version),
+			Config:         row.Config,
+			Digest:         row.Digest,
+			DeployedAt:     row.DeployedAt,
+			RolledBackFrom: int(row.RolledBackFrom),
+		}
+	}
+	return versions, nil
+}
+
+// PruneVersions drops a function's versions older than version.
+func (p *Postgres) PruneVersions(function string, version int) error {
+	ctx, cancel := context.WithTimeout(context.Background(), queryTimeout)
+	defer cancel()
+	err := p.q.DeleteFunctionVersionsBelow(ctx, queries.DeleteFunctionVersionsBelowParams{Function: function, Version: int32(version)})
+	if err != nil {
+		return fmt.Errorf("failed to prune versions: %w", err)
+	}
+	return nil
+}
+
+// DeleteVersions drops every version of a function.
+func (p *Postgres) DeleteVersions(function string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), queryTimeout)
+	defer cancel()
+	if err := p.q.DeleteFunctionVersions(ctx, function); err != nil {
+		return fmt.Errorf("failed to delete versions: %w", err)
+	}
+	return nil
+}
+
+// Schedule is a schedule as persisted, its spec as the scheduler encodes
+// it.
+type Schedule struct {
+	ID        string
+	Function  string
+	Spec      json.RawMessage
+	UpdatedAt time.Time
+}
+
+// SaveSchedule stores a schedule, replacing any with the same ID.
+func (p *Postgres) SaveSchedule(s Schedule) error {
+	ctx, cancel := context.WithTimeout(context.Background(), queryTimeout)
+	defer cancel()
+	err := p.q.UpsertSchedule(ctx, queries.UpsertScheduleParams{
+		ID:        s.ID,
+		Function:  s.Function,
+		Spec:      s.Spec,
+		UpdatedAt: s.UpdatedAt,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to save schedule: %w", err)
+	}
+	return nil
+}
+
+// DeleteSchedule forgets a schedule, doing nothing when it isn't stored.
+func (p *Postgres) DeleteSchedule(id string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), queryTimeout)
+	defer cancel()
+	if _, err := p.q.DeleteSchedule(ctx, id); err != nil {
+		return fmt.Errorf("failed to delete schedule: %w", err)
+	}
+	return nil
+}
+
+// ListSchedules returns every stored schedule, sorted by ID.
+func (p *Postgres) ListSchedules() ([]Schedule, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), queryTimeout)
+	defer cancel()
+	rows, err := p.q.ListSchedules(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list schedules: %w", err)
+	}
+	schedules := make([]Schedule, len(rows))
+	for i, row := range rows {
+		schedules[i] = Schedule{ID: row.ID, Function: row.Function, Spec: row.Spec, UpdatedAt: row.UpdatedAt}
+	}
+	return schedules, nil
+}
+
+// AuditEvent is a recorded change as persisted.
+type AuditEvent struct {
+	Time     time.Time
+	Actor    string
+	Action   string
+	Function string
+	Project  string
+	Detail   json.RawMessage
+}
+
+// RecordAudit adds an audit event.
+func (p *Postgres) RecordAudit(e AuditEvent) error {
+	ctx, cancel := context.WithTimeout(context.Background(), queryTimeout)
+	defer cancel()
+	detail := e.Detail
+	if len(detail) == 0 {
+		detail = json.RawMessage("{}")
+	}
+	err := p.q.InsertAuditEvent(ctx, queries.InsertAuditEventParams{
+		Time:     e.Time,
+		Actor:    e.Actor,
+		Action:   e.Action,
+		Function: e.Function,
+		Project:  e.Project,
+		Detail:   detail,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to record audit event: %w", err)
+	}
+	return nil
+}
+
+// ListAudit returns the audit events of function, or of every function
+// when empty, newest first and at most limit of them unless 0.
+func (p *Postgres) ListAudit(function string, limit int) ([]AuditEvent, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), queryTimeout)
+	defer cancel()
+	rows, err := p.q.ListAuditEvents(ctx, queries.ListAuditEventsParams{Function: function, MaxRows: int32(limit)})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list audit events: %w", err)
+	}
+	events := make([]AuditEvent, len(rows))
+	for i, row := range rows {
+		events[i] = AuditEvent{
+			Time:     row.Time,
+			Actor:    row.Actor,
+			Action:   row.Action,
+			Function: row.Function,
+			Project:  row.Project,
+			Detail:   row.Detail,
+		}
+	}
+	return events, nil
+}
+
+// PruneAudit drops the audit events recorded before t, returning how many.
+func (p *Postgres) PruneAudit(before time.Time) (int64, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), queryTimeout)
+	defer cancel()
+	n, err := p.q.DeleteAuditEventsBefore(ctx, before)
+	if err != nil {
+		return 0, fmt.Errorf("failed to prune audit events: %w", err)
+	}
+	return n, nil
+}
@@ -0,0 +1,13 @@
+-- name: InsertAuditEvent :exec
+INSERT INTO audit_events (time, actor, action, function, project, detail)
+VALUES ($1, $2, $3, $4, $5, $6);
+
+-- name: ListAuditEvents :many
+SELECT id, time, actor, action, function, project, detail
+FROM audit_events
+WHERE sqlc.arg(function)::text = '' OR function = sqlc.arg(function)
+ORDER BY time DESC, id DESC
+LIMIT NULLIF(sqlc.arg(max_rows)::int, 0);
+
+-- name: DeleteAuditEventsBefore :execrows
+DELETE FROM audit_events WHERE time < $1;
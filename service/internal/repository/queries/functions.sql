@@ -0,0 +1,10 @@
+-- name: UpsertFunction :exec
+INSERT INTO functions (name, config, digest, updated_at)
+VALUES ($1, $2, $3, $4)
+ON CONFLICT (name) DO UPDATE SET config = EXCLUDED.config, digest = EXCLUDED.digest, updated_at = EXCLUDED.updated_at;
+
+-- name: DeleteFunction :exec
+DELETE FROM functions WHERE name = $1;
+
+-- name: ListFunctions :many
+SELECT name, config, digest, updated_at FROM functions ORDER BY name;
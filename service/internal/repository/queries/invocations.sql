@@ -0,0 +1,18 @@
+-- name: InsertInvocation :exec
+INSERT INTO invocations (request_id, function, started_at, ended_at, status, status_code, error, cold_start)
+VALUES ($1, $2, $3, $4, $5, $6, $7, $8);
+
+-- name: ListInvocations :many
+SELECT id, request_id, function, started_at, ended_at, status, status_code, error, cold_start
+FROM invocations
+WHERE function = sqlc.arg(function)
+  AND (sqlc.arg(status)::text = '' OR status = sqlc.arg(status))
+  AND (sqlc.narg(before)::timestamptz IS NULL OR started_at < sqlc.narg(before))
+ORDER BY started_at DESC
+LIMIT NULLIF(sqlc.arg(max_rows)::int, 0);
+
+-- name: DeleteInvocationsBefore :execrows
+DELETE FROM invocations WHERE started_at < $1;
+
+-- name: DeleteFunctionInvocations :exec
+DELETE FROM invocations WHERE function = $1;
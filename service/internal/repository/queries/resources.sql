@@ -0,0 +1,10 @@
+-- name: UpsertResource :exec
+INSERT INTO resources (kind, name, spec, updated_at)
+VALUES ($1, $2, $3, $4)
+ON CONFLICT (kind, name) DO UPDATE SET spec = EXCLUDED.spec, updated_at = EXCLUDED.updated_at;
+
+-- name: DeleteResource :exec
+DELETE FROM resources WHERE kind = $1 AND name = $2;
+
+-- name: ListResources :many
+SELECT kind, name, spec, updated_at FROM resources WHERE kind = $1 ORDER BY name;
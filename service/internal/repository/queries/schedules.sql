@@ -0,0 +1,10 @@
+-- name: UpsertSchedule :exec
+INSERT INTO schedules (id, function, spec, updated_at)
+VALUES ($1, $2, $3, $4)
+ON CONFLICT (id) DO UPDATE SET function = EXCLUDED.function, spec = EXCLUDED.spec, updated_at = EXCLUDED.updated_at;
+
+-- name: DeleteSchedule :execrows
+DELETE FROM schedules WHERE id = $1;
+
+-- name: ListSchedules :many
+SELECT id, function, spec, updated_at FROM schedules ORDER BY id;
@@ -0,0 +1,15 @@
+-- name: InsertFunctionVersion :exec
+INSERT INTO function_versions (function, version, config, digest, deployed_at, rolled_back_from)
+VALUES ($1, $2, $3, $4, $5, $6);
+
+-- name: ListFunctionVersions :many
+SELECT function, version, config, digest, deployed_at, rolled_back_from
+FROM function_versions
+WHERE function = $1
+ORDER BY version;
+
+-- name: DeleteFunctionVersionsBelow :exec
+DELETE FROM function_versions WHERE function = $1 AND version < $2;
+
+-- name: DeleteFunctionVersions :exec
+DELETE FROM function_versions WHERE function = $1;
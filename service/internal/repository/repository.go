@@ -0,0 +1,204 @@
+// Package repository persists registered functions, and the projects,
+// environments and locks they depend on, so the service has them again
+// after it restarts.
+package repository
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Function is a registered function as persisted, its config as the
+// service encodes it and the digest of the stored binary it runs.
+type Function struct {
+	Name      string          `json:"name"`
+	Config    json.RawMessage `json:"config"`
+	Digest    string          `json:"sha256,omitempty"`
+	UpdatedAt time.Time       `json:"updatedAt"`
+}
+
+// Resource is service state other than functions as persisted, like a
+// project, keyed by its kind and name.
+type Resource struct {
+	Kind      string          `json:"kind"`
+	Name      string          `json:"name"`
+	Spec      json.RawMessage `json:"spec"`
+	UpdatedAt time.Time       `json:"updatedAt"`
+}
+
+// Repository stores registered functions and resources, in a file or in
+// Postgres.
+type Repository interface {
+	// Save stores a function, replacing any of the same name
+	Save(f Function) error
+	// Delete forgets a function, doing nothing when it isn't stored
+	Delete(name string) error
+	// List returns every stored function, sorted by name
+	List() ([]Function, error)
+	// SaveResource stores a resource, replacing any of the same kind and
+	// name
+	SaveResource(r Resource) error
+	// DeleteResource forgets a resource, doing nothing when it isn't
+	// stored
+	DeleteResource(kind, name string) error
+	// ListResources returns the stored resources of a kind, sorted by name
+	ListResources(kind string) ([]Resource, error)
+}
+
+// File keeps functions and resources in a JSON file, rewritten whole on
+// every change.
+type File struct {
+	path      string
+	mu        sync.Mutex
+	functions map[string]Function
+	resources map[string]Resource
+}
+
+// fileContents is what a File holds. Files written before resources were
+// kept hold just the functions.
+type fileContents struct {
+	Functions []Function `json:"functions"`
+	Resources []Resource `json:"resources"`
+}
+
+// resourceKey keys a resource in a File.
+func resourceKey(kind, name string) string {
+	return kind + "/" + name
+}
+
+// OpenFile reads the functions stored at path, starting with none when the
+// file doesn't exist yet.
+func OpenFile(path string) (*File, error) {
+	f := &File{path: path, functions: make(map[string]Function), resources: make(map[string]Resource)}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return f, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read functions: %w", err)
+	}
+	var contents fileContents
+	if trimmed := bytes.TrimSpace(data); len(trimmed) > 0 && trimmed[0] == '[' {
+		err = json.Unmarshal(data, &contents.Functions)
+	} else {
+		err = json.Unmarshal(data, &contents)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode functions in %s: %w", path, err)
+	}
+	for _, fn := range contents.Functions {
+		f.functions[fn.Name] = fn
+	}
+	for _, r := range contents.Resources {
+		f.resources[resourceKey(r.Kind, r.Name)] = r
+	}
+	return f, nil
+}
+
+func (f *File) Save(fn Function) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.functions[fn.Name] = fn
+	return f.write()
+}
+
+func (f *File) Delete(name string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if _, exists := f.functions[name]; !exists {
+		return nil
+	}
+	delete(f.functions, name)
+	return f.write()
+}
+
+func (f *File) List() ([]Function, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.sorted(), nil
+}
+
+func (f *File) SaveResource(r Resource) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.resources[resourceKey(r.Kind, r.Name)] = r
+	return f.write()
+}
+
+func (f *File) DeleteResource(kind, name string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if _, exists := f.resources[resourceKey(kind, name)]; !exists {
+		return nil
+	}
+	delete(f.resources, resourceKey(kind, name))
+	return f.write()
+}
+
+func (f *File) ListResources(kind string) ([]Resource, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var resources []Resource
+	for _, r := range f.sortedResources() {
+		if r.Kind == kind {
+			resources = append(resources, r)
+		}
+	}
+	return resources, nil
+}
+
+func (f *File) sorted() []Function {
+	return slices.SortedFunc(maps.Values(f.functions), func(a, b Function) int {
+		return strings.Compare(a.Name, b.Name)
+	})
+}
+
+func (f *File) sortedResources() []Resource {
+	return slices.SortedFunc(maps.Values(f.resources), func(a, b Resource) int {
+		return strings.Compare(resourceKey(a.Kind, a.Name), resourceKey(b.Kind, b.Name))
+	})
+}
+
+// write replaces the file by renaming a complete copy over it, so a crash
+// leaves the old or new functions and never half of them. The caller must
+// hold mu.
+func (f *File) write() error {
+	data, err := json.MarshalIndent(fileContents{Functions: f.sorted(), Resources: f.sortedResources()}, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode functions: %w", err)
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(f.path), filepath.Base(f.path)+".tmp-*")
+	if err != nil {
+		return fmt.Errorf("failed to write functions: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+	// Configs may carry secrets in their env
+	if err := tmp.Chmod(0600); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to write functions: %w", err)
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to write functions: %w", err)
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to write functions: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to write functions: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), f.path); err != nil {
+		return fmt.Errorf("failed to write functions: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,232 @@
+package repository
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"kappa-v2/service/internal/database"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "functions.json")
+	repo, err := OpenFile(path)
+	require.NoError(t, err)
+	functions, err := repo.List()
+	require.NoError(t, err)
+	assert.Empty(t, functions)
+
+	now := time.Now().UTC().Truncate(time.Second)
+	require.NoError(t, repo.Save(Function{Name: "orders", Config: json.RawMessage(`{"name":"orders","port":8080}`), Digest: "abc", UpdatedAt: now}))
+	require.NoError(t, repo.Save(Function{Name: "billing", Config: json.RawMessage(`{"name":"billing"}`), UpdatedAt: now}))
+	require.NoError(t, repo.Save(Function{Name: "orders", Config: json.RawMessage(`{"name":"orders","port":9090}`), Digest: "def", UpdatedAt: now}))
+	require.NoError(t, repo.Delete("billing"))
+	require.NoError(t, repo.Delete("missing"))
+
+	info, err := os.Stat(path)
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0600), info.Mode().Perm())
+
+	// Another service starting on the same file gets the functions back
+	reopened, err := OpenFile(path)
+	require.NoError(t, err)
+	functions, err = reopened.List()
+	require.NoError(t, err)
+	require.Len(t, functions, 1)
+	assert.Equal(t, "orders", functions[0].Name)
+	assert.Equal(t, "def", functions[0].Digest)
+	assert.JSONEq(t, `{"name":"orders","port":9090}`, string(functions[0].Config))
+	assert.True(t, now.Equal(functions[0].UpdatedAt))
+
+	require.NoError(t, os.WriteFile(path, []byte("not json"), 0600))
+	_, err = OpenFile(path)
+	assert.Error(t, err)
+}
+
+func TestFile_Resources(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "functions.json")
+	repo, err := OpenFile(path)
+	require.NoError(t, err)
+
+	now := time.Now().UTC().Truncate(time.Second)
+	require.NoError(t, repo.Save(Function{Name: "orders", Config: json.RawMessage(`{"name":"orders"}`), UpdatedAt: now}))
+	require.NoError(t, repo.SaveResource(Resource{Kind: "project", Name: "shop", Spec: json.RawMessage(`{"name":"shop"}`), UpdatedAt: now}))
+	require.NoError(t, repo.SaveResource(Resource{Kind: "project", Name: "billing", Spec: json.RawMessage(`{"name":"billing"}`), UpdatedAt: now}))
+	require.NoError(t, repo.SaveResource(Resource{Kind: "environment", Name: "shop", Spec: json.RawMessage(`{"name":"shop"}`), UpdatedAt: now}))
+	require.NoError(t, repo.DeleteResource("project", "billing"))
+	require.NoError(t, repo.DeleteResource("project", "missing"))
+
+	reopened, err := OpenFile(path)
+	require.NoError(t, err)
+	projects, err := reopened.ListResources("project")
+	require.NoError(t, err)
+	require.Len(t, projects, 1)
+	assert.Equal(t, "shop", projects[0].Name)
+	assert.True(t, now.Equal(projects[0].UpdatedAt))
+	environments, err := reopened.ListResources("environment")
+	require.NoError(t, err)
+	assert.Len(t, environments, 1)
+	functions, err := reopened.List()
+	require.NoError(t, err)
+	assert.Len(t, functions, 1)
+
+	// Files from before resources were kept hold just the functions
+	require.NoError(t, os.WriteFile(path, []byte(`[{"name":"orders","config":{"name":"orders"}}]`), 0600))
+	legacy, err := OpenFile(path)
+	require.NoError(t, err)
+	functions, err = legacy.List()
+	require.NoError(t, err)
+	assert.Len(t, functions, 1)
+	projects, err = legacy.ListResources("project")
+	require.NoError(t, err)
+	assert.Empty(t, projects)
+}
+
+// testDB opens the Postgres at KAPPA_TEST_DATABASE_URL and migrates its
+// schema, skipping the test without one. `make test_db` runs these tests
+// against a Postgres in docker.
+func testDB(t *testing.T) *sql.DB {
+	url := os.Getenv("KAPPA_TEST_DATABASE_URL")
+	if url == "" {
+		t.Skip("KAPPA_TEST_DATABASE_URL is not set")
+	}
+	db, err := database.Open(url)
+	require.NoError(t, err)
+	t.Cleanup(func() { db.Close() })
+	_, err = database.Migrate(context.Background(), db)
+	require.NoError(t, err)
+	return db
+}
+
+func TestPostgres(t *testing.T) {
+	db := testDB(t)
+	repo := NewPostgres(db)
+	t.Cleanup(func() { db.Exec("DELETE FROM functions WHERE name IN ('orders', 'billing')") })
+
+	now := time.Now().UTC().Truncate(time.Second)
+	require.NoError(t, repo.Save(Function{Name: "orders", Config: json.RawMessage(`{"name":"orders","port":8080}`), Digest: "abc", UpdatedAt: now}))
+	require.NoError(t, repo.Save(Function{Name: "billing", Config: json.RawMessage(`{"name":"billing"}`), UpdatedAt: now}))
+	require.NoError(t, repo.Save(Function{Name: "orders", Config: json.RawMessage(`{"name":"orders","port":9090}`), Digest: "def", UpdatedAt: now}))
+	require.NoError(t, repo.Delete("billing"))
+	require.NoError(t, repo.Delete("missing"))
+
+	functions, err := repo.List()
+	require.NoError(t, err)
+	require.Len(t, functions, 1)
+	assert.Equal(t, "orders", functions[0].Name)
+	assert.Equal(t, "def", functions[0].Digest)
+	assert.JSONEq(t, `{"name":"orders","port":9090}`, string(functions[0].Config))
+	assert.True(t, now.Equal(functions[0].UpdatedAt))
+}
+
+func TestPostgres_Resources(t *testing.T) {
+	db := testDB(t)
+	repo := NewPostgres(db)
+	t.Cleanup(func() { db.Exec("DELETE FROM resources WHERE name IN ('shop', 'billing')") })
+
+	now := time.Now().UTC().Truncate(time.Second)
+	require.NoError(t, repo.SaveResource(Resource{Kind: "project", Name: "shop", Spec: json.RawMessage(`{"locked":false}`), UpdatedAt: now}))
+	require.NoError(t, repo.SaveResource(Resource{Kind: "project", Name: "billing", Spec: json.RawMessage(`{}`), UpdatedAt: now}))
+	require.NoError(t, repo.SaveResource(Resource{Kind: "project", Name: "shop", Spec: json.RawMessage(`{"locked":true}`), UpdatedAt: now}))
+	require.NoError(t, repo.SaveResource(Resource{Kind: "lock", Name: "shop", Spec: json.RawMessage(`true`), UpdatedAt: now}))
+	require.NoError(t, repo.DeleteResource("project", "billing"))
+	require.NoError(t, repo.DeleteResource("project", "missing"))
+
+	projects, err := repo.ListResources("project")
+	require.NoError(t, err)
+	require.Len(t, projects, 1)
+	assert.Equal(t, "shop", projects[0].Name)
+	assert.JSONEq(t, `{"locked":true}`, string(projects[0].Spec))
+	locks, err := repo.ListResources("lock")
+	require.NoError(t, err)
+	assert.Len(t, locks, 1)
+}
+
+func TestPostgres_Versions(t *testing.T) {
+	db := testDB(t)
+	repo := NewPostgres(db)
+	t.Cleanup(func() { db.Exec("DELETE FROM function_versions WHERE function = 'orders'") })
+
+	now := time.Now().UTC().Truncate(time.Second)
+	for v := 1; v <= 3; v++ {
+		require.NoError(t, repo.SaveVersion(Version{Function: "orders", Version: v, Config: json.RawMessage(`{"name":"orders"}`), Digest: "abc", DeployedAt: now}))
+	}
+	require.NoError(t, repo.SaveVersion(Version{Function: "orders", Version: 4, Config: json.RawMessage(`{"name":"orders"}`), DeployedAt: now, RolledBackFrom: 3}))
+	assert.Error(t, repo.SaveVersion(Version{Function: "orders", Version: 4, Config: json.RawMessage(`{}`), DeployedAt: now}), "versions are never replaced")
+
+	require.NoError(t, repo.PruneVersions("orders", 3))
+	versions, err := repo.ListVersions("orders")
+	require.NoError(t, err)
+	require.Len(t, versions, 2)
+	assert.Equal(t, 3, versions[0].Version)
+	assert.Equal(t, "abc", versions[0].Digest)
+	assert.Equal(t, 3, versions[1].RolledBackFrom)
+	assert.True(t, now.Equal(versions[1].DeployedAt))
+
+	require.NoError(t, repo.DeleteVersions("orders"))
+	versions, err = repo.ListVersions("orders")
+	require.NoError(t, err)
+	assert.Empty(t, versions)
+}
+
+func TestPostgres_Schedules(t *testing.T) {
+	db := testDB(t)
+	repo := NewPostgres(db)
+	t.Cleanup(func() { db.Exec("DELETE FROM schedules WHERE id IN ('nightly', 'hourly')") })
+
+	now := time.Now().UTC().Truncate(time.Second)
+	require.NoError(t, repo.SaveSchedule(Schedule{ID: "nightly", Function: "orders", Spec: json.RawMessage(`{"cron":"0 0 * * *"}`), UpdatedAt: now}))
+	require.NoError(t, repo.SaveSchedule(Schedule{ID: "hourly", Function: "orders", Spec: json.RawMessage(`{"cron":"0 * * * *"}`), UpdatedAt: now}))
+	require.NoError(t, repo.SaveSchedule(Schedule{ID: "nightly", Function: "billing", Spec: json.RawMessage(`{"cron":"0 1 * * *"}`), UpdatedAt: now}))
+	require.NoError(t, repo.DeleteSchedule("hourly"))
+	require.NoError(t, repo.DeleteSchedule("missing"))
+
+	schedules, err := repo.ListSchedules()
+	require.NoError(t, err)
+	var nightly *Schedule
+	for i := range schedules {
+		if schedules[i].ID == "nightly" {
+			nightly = &schedules[i]
+		}
+		assert.NotEqual(t, "hourly", schedules[i].ID)
+	}
+	require.NotNil(t, nightly)
+	assert.Equal(t, "billing", nightly.Function)
+	assert.JSONEq(t, `{"cron":"0 1 * * *"}`, string(nightly.Spec))
+}
+
+func TestPostgres_Audit(t *testing.T) {
+	db := testDB(t)
+	repo := NewPostgres(db)
+	t.Cleanup(func() { db.Exec("DELETE FROM audit_events WHERE function IN ('orders', 'billing')") })
+
+	start := time.Now().UTC().Truncate(time.Second)
+	require.NoError(t, repo.RecordAudit(AuditEvent{Time: start.Add(-48 * time.Hour), Action: "deploy", Function: "orders"}))
+	require.NoError(t, repo.RecordAudit(AuditEvent{Time: start, Actor: "alice", Action: "rollback", Function: "orders", Detail: json.RawMessage(`{"from":2,"to":1}`)}))
+	require.NoError(t, repo.RecordAudit(AuditEvent{Time: start, Action: "deploy", Function: "billing"}))
+
+	events, err := repo.ListAudit("orders", 0)
+	require.NoError(t, err)
+	require.Len(t, events, 2)
+	assert.Equal(t, "rollback", events[0].Action, "newest first")
+	assert.Equal(t, "alice", events[0].Actor)
+	assert.JSONEq(t, `{"from":2,"to":1}`, string(events[0].Detail))
+	assert.JSONEq(t, `{}`, string(events[1].Detail))
+
+	events, err = repo.ListAudit("orders", 1)
+	require.NoError(t, err)
+	assert.Len(t, events, 1)
+
+	pruned, err := repo.PruneAudit(start.Add(-24 * time.Hour))
+	require.NoError(t, err)
+	assert.GreaterOrEqual(t, pruned, int64(1))
+	events, err = repo.ListAudit("orders", 0)
+	require.NoError(t, err)
+	assert.Len(t, events, 1)
+}
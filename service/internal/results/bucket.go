@@ -0,0 +1,207 @@
+package results
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"kappa-v2/service/internal/objstore"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// bucketPrefix starts the keys of results in a bucket
+	bucketPrefix = "results/"
+	// bucketTimeout bounds each request to the bucket, the Store methods
+	// take no context
+	bucketTimeout = 30 * time.Second
+)
+
+// Bucket is a Store keeping each result as a JSON object in an object
+// store, so every node sees the results of the others. Results aren't
+// indexed: listing reads every stored result, and a bucket lifecycle rule,
+// rather than a size cap, bounds how much is kept.
+type Bucket struct {
+	store objstore.Store
+
+	mu sync.Mutex
+	// count and bytes are as of the last listing
+	count   int
+	bytes   int64
+	expired uint64
+}
+
+// NewBucket keeps results in store.
+func NewBucket(store objstore.Store) *Bucket {
+	return &Bucket{store: store}
+}
+
+func (b *Bucket) key(id string) (string, error) {
+	if !validID.MatchString(id) {
+		return "", fmt.Errorf("invalid result ID: %q", id)
+	}
+	return bucketPrefix + id + ".json", nil
+}
+
+func (b *Bucket) Put(r Result) error {
+	key, err := b.key(r.ID)
+	if err != nil {
+		return err
+	}
+	data, err := json.Marshal(r)
+	if err != nil {
+		return fmt.Errorf("failed to encode result: %w", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), bucketTimeout)
+	defer cancel()
+	if err := b.store.Put(ctx, key, bytes.NewReader(data)); err != nil {
+		return fmt.Errorf("failed to write result: %w", err)
+	}
+	return nil
+}
+
+// read fetches the result stored under key, expired or not.
+func (b *Bucket) read(ctx context.Context, key string) (Result, error) {
+	rc, err := b.store.Get(ctx, key)
+	if errors.Is(err, objstore.ErrNotFound) {
+		return Result{}, ErrNotFound
+	}
+	if err != nil {
+		return Result{}, fmt.Errorf("failed to read result: %w", err)
+	}
+	defer rc.Close()
+	data, err := io.ReadAll(rc)
+	if err != nil {
+		return Result{}, fmt.Errorf("failed to read result: %w", err)
+	}
+	var r Result
+	if err := json.Unmarshal(data, &r); err != nil {
+		return Result{}, fmt.Errorf("failed to decode result: %w", err)
+	}
+	return r, nil
+}
+
+func (b *Bucket) Get(id string) (Result, error) {
+	key, err := b.key(id)
+	if err != nil {
+		return Result{}, ErrNotFound
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), bucketTimeout)
+	defer cancel()
+	r, err := b.read(ctx, key)
+	if err != nil {
+		return Result{}, err
+	}
+	if time.Now().After(r.ExpiresAt) {
+		return Result{}, ErrNotFound
+	}
+	return r, nil
+}
+
+// each reads every stored result, skipping those that can't be, and
+// records how many there are.
+func (b *Bucket) each(ctx context.Context, fn func(key string, r Result) error) error {
+	objects, err := b.store.List(ctx, bucketPrefix)
+	if err != nil {
+		return fmt.Errorf("failed to list results: %w", err)
+	}
+	var total int64
+	for _, object := range objects {
+		total += object.Size
+	}
+	b.mu.Lock()
+	b.count, b.bytes = len(objects), total
+	b.mu.Unlock()
+
+	for _, object := range objects {
+		if !strings.HasSuffix(object.Key, ".json") {
+			continue
+		}
+		r, err := b.read(ctx, object.Key)
+		if errors.Is(err, ErrNotFound) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if err := fn(object.Key, r); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (b *Bucket) List(f Filter) ([]Result, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), bucketTimeout)
+	defer cancel()
+	now := time.Now()
+	var list []Result
+	err := b.each(ctx, func(_ string, r Result) error {
+		if f.matches(r) && !now.After(r.ExpiresAt) {
+			r.Body = nil
+			list = append(list, r)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].CreatedAt.After(list[j].CreatedAt) })
+	return list, nil
+}
+
+func (b *Bucket) Delete(id string) error {
+	key, err := b.key(id)
+	if err != nil {
+		return ErrNotFound
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), bucketTimeout)
+	defer cancel()
+	if _, err := b.read(ctx, key); err != nil {
+		return err
+	}
+	if err := b.store.Delete(ctx, key); err != nil {
+		return fmt.Errorf("failed to delete result: %w", err)
+	}
+	return nil
+}
+
+func (b *Bucket) Prune(now time.Time) (int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), bucketTimeout)
+	defer cancel()
+	pruned := 0
+	var errs []error
+	err := b.each(ctx, func(key string, r Result) error {
+		if !now.After(r.ExpiresAt) {
+			return nil
+		}
+		if err := b.store.Delete(ctx, key); err != nil {
+			errs = append(errs, fmt.Errorf("failed to delete result: %w", err))
+			return nil
+		}
+		pruned++
+		return nil
+	})
+	b.mu.Lock()
+	b.expired += uint64(pruned)
+	b.count -= pruned
+	b.mu.Unlock()
+	return pruned, errors.Join(append(errs, err)...)
+}
+
+// Stats counts the results as of the last listing or prune. Nothing is
+// evicted, so MaxBytes and Evicted are 0.
+func (b *Bucket) Stats() Stats {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return Stats{
+		Count:   b.count,
+		Bytes:   b.bytes,
+		Expired: b.expired,
+	}
+}
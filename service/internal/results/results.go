@@ -0,0 +1,346 @@
+// Package results keeps the outcomes of invocations nobody waits on, like
+// async invocations, on disk so they survive the service restarting.
+// Results expire after their function's TTL, and the oldest finished ones
+// are evicted once the store outgrows its size cap.
+package results
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrNotFound is returned for results that aren't stored, or have expired
+var ErrNotFound = errors.New("result not found")
+
+// DefaultMaxBytes is how large a store grows before evicting results
+const DefaultMaxBytes = 1 << 30
+
+// Status is where an invocation is at.
+type Status string
+
+const (
+	Pending   Status = "pending"
+	Running   Status = "running"
+	Succeeded Status = "succeeded"
+	Failed    Status = "failed"
+)
+
+// ParseStatus returns the status named name.
+func ParseStatus(name string) (Status, error) {
+	switch s := Status(name); s {
+	case Pending, Running, Succeeded, Failed:
+		return s, nil
+	default:
+		return "", fmt.Errorf("unknown status %q, expected pending, running, succeeded or failed", name)
+	}
+}
+
+// Finished reports whether the invocation is over.
+func (s Status) Finished() bool {
+	return s == Succeeded || s == Failed
+}
+
+// Result is an invocation and, once it is over, its response.
+type Result struct {
+	ID       string `json:"id"`
+	Function string `json:"function"`
+	Project  string `json:"project,omitempty"`
+	Status   Status `json:"status"`
+	// StatusCode, Headers and Body are the function's response. Body is
+	// stored as given, callers seal it first.
+	StatusCode int               `json:"statusCode,omitempty"`
+	Headers    map[string]string `json:"headers,omitempty"`
+	Body       []byte            `json:"body,omitempty"`
+	// Error is why the invocation failed without a response
+	Error       string     `json:"error,omitempty"`
+	CreatedAt   time.Time  `json:"createdAt"`
+	CompletedAt *time.Time `json:"completedAt,omitempty"`
+	ExpiresAt   time.Time  `json:"expiresAt"`
+}
+
+// Filter selects results to list. Empty fields match every result.
+type Filter struct {
+	Status   Status
+	Function string
+}
+
+func (f Filter) matches(r Result) bool {
+	return (f.Status == "" || r.Status == f.Status) && (f.Function == "" || r.Function == f.Function)
+}
+
+// Stats describe a store's size and what it dropped.
+type Stats struct {
+	Count    int   `json:"count"`
+	Bytes    int64 `json:"bytes"`
+	MaxBytes int64 `json:"maxBytes"`
+	// Expired counts results dropped after their TTL, Evicted those dropped
+	// early to stay under MaxBytes
+	Expired uint64 `json:"expired"`
+	Evicted uint64 `json:"evicted"`
+}
+
+// Store keeps results by ID. A database backed one can take the place of
+// Dir.
+type Store interface {
+	// Put stores a result, replacing any with the same ID
+	Put(r Result) error
+	// Get returns a stored result, with its body
+	Get(id string) (Result, error)
+	// List returns the results matching f, newest first and without bodies
+	List(f Filter) ([]Result, error)
+	Delete(id string) error
+	// Prune drops the results expired at now, returning how many
+	Prune(now time.Time) (int, error)
+	Stats() Stats
+}
+
+// validID keeps IDs to safe file names
+var validID = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9_-]*$`)
+
+// entry is a stored result without its body, and the size of its file.
+type entry struct {
+	result Result
+	size   int64
+}
+
+// Dir is a Store keeping each result as a JSON file under a directory, and
+// an index of them in memory.
+type Dir struct {
+	dir      string
+	maxBytes int64
+
+	mu      sync.Mutex
+	index   map[string]entry
+	bytes   int64
+	expired uint64
+	evicted uint64
+}
+
+// OpenDir opens the store in dir, indexing the results already there.
+// Files that can't be read are skipped.
+func OpenDir(dir string, maxBytes int64) (*Dir, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, fmt.Errorf("failed to create result directory: %w", err)
+	}
+	d := &Dir{dir: dir, maxBytes: maxBytes, index: make(map[string]entry)}
+	files, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read results: %w", err)
+	}
+	for _, file := range files {
+		id, ok := strings.CutSuffix(file.Name(), ".json")
+		if !ok || !validID.MatchString(id) {
+			continue
+		}
+		data, err := os.ReadFile(filepath.Join(dir, file.Name()))
+		if err != nil {
+			continue
+		}
+		var r Result
+		if err := json.Unmarshal(data, &r); err != nil || r.ID != id {
+			continue
+		}
+		d.add(r, int64(len(data)))
+	}
+	return d, nil
+}
+
+// FromEnv opens the store in KAPPA_RESULTS_DIR, "results" by default,
+// capped at KAPPA_RESULTS_MAX_BYTES.
+func FromEnv() (*Dir, error) {
+	dir := os.Getenv("KAPPA_RESULTS_DIR")
+	if dir == "" {
+		dir = "results"
+	}
+	maxBytes := int64(DefaultMaxBytes)
+	if v := os.Getenv("KAPPA_RESULTS_MAX_BYTES"); v != "" {
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || n <= 0 {
+			return nil, fmt.Errorf("invalid KAPPA_RESULTS_MAX_BYTES %q", v)
+		}
+		maxBytes = n
+	}
+	return OpenDir(dir, maxBytes)
+}
+
+func (d *Dir) path(id string) (string, error) {
+	if !validID.MatchString(id) {
+		return "", fmt.Errorf("invalid result ID: %q", id)
+	}
+	return filepath.Join(d.dir, id+".json"), nil
+}
+
+// add indexes r, the caller must hold mu unless the store isn't shared yet.
+func (d *Dir) add(r Result, size int64) {
+	if old, exists := d.index[r.ID]; exists {
+		d.bytes -= old.size
+	}
+	r.Body = nil
+	d.index[r.ID] = entry{result: r, size: size}
+	d.bytes += size
+}
+
+// remove drops the result's file and index entry. The caller must hold mu.
+func (d *Dir) remove(id string) error {
+	e, exists := d.index[id]
+	if !exists {
+		return nil
+	}
+	path, err := d.path(id)
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to delete result: %w", err)
+	}
+	delete(d.index, id)
+	d.bytes -= e.size
+	return nil
+}
+
+// Put writes the result to a temp file and moves it into place once
+// complete, then evicts the oldest finished results while the store is over
+// its cap.
+func (d *Dir) Put(r Result) error {
+	path, err := d.path(r.ID)
+	if err != nil {
+		return err
+	}
+	data, err := json.Marshal(r)
+	if err != nil {
+		return fmt.Errorf("failed to encode result: %w", err)
+	}
+	if int64(len(data)) > d.maxBytes {
+		return fmt.Errorf("result is %d bytes, more than the store holds", len(data))
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	tmp, err := os.CreateTemp(d.dir, ".put-*")
+	if err != nil {
+		return fmt.Errorf("failed to write result: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to write result: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to write result: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return fmt.Errorf("failed to write result: %w", err)
+	}
+	d.add(r, int64(len(data)))
+	d.evict()
+	return nil
+}
+
+// evict drops finished results, oldest first, until the store fits its cap.
+// Unfinished ones are kept for their invocations to complete. The caller
+// must hold mu.
+func (d *Dir) evict() {
+	if d.bytes <= d.maxBytes {
+		return
+	}
+	var finished []Result
+	for _, e := range d.index {
+		if e.result.Status.Finished() {
+			finished = append(finished, e.result)
+		}
+	}
+	sort.Slice(finished, func(i, j int) bool { return finished[i].CreatedAt.Before(finished[j].CreatedAt) })
+	for _, r := range finished {
+		if d.bytes <= d.maxBytes {
+			return
+		}
+		if d.remove(r.ID) == nil {
+			d.evicted++
+		}
+	}
+}
+
+func (d *Dir) Get(id string) (Result, error) {
+	path, err := d.path(id)
+	if err != nil {
+		return Result{}, ErrNotFound
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	e, exists := d.index[id]
+	if !exists || time.Now().After(e.result.ExpiresAt) {
+		return Result{}, ErrNotFound
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return Result{}, fmt.Errorf("failed to read result: %w", err)
+	}
+	var r Result
+	if err := json.Unmarshal(data, &r); err != nil {
+		return Result{}, fmt.Errorf("failed to decode result: %w", err)
+	}
+	return r, nil
+}
+
+func (d *Dir) List(f Filter) ([]Result, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	now := time.Now()
+	var list []Result
+	for _, e := range d.index {
+		if f.matches(e.result) && !now.After(e.result.ExpiresAt) {
+			list = append(list, e.result)
+		}
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].CreatedAt.After(list[j].CreatedAt) })
+	return list, nil
+}
+
+func (d *Dir) Delete(id string) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if _, exists := d.index[id]; !exists {
+		return ErrNotFound
+	}
+	return d.remove(id)
+}
+
+func (d *Dir) Prune(now time.Time) (int, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	pruned := 0
+	var errs []error
+	for id, e := range d.index {
+		if !now.After(e.result.ExpiresAt) {
+			continue
+		}
+		if err := d.remove(id); err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		pruned++
+	}
+	d.expired += uint64(pruned)
+	return pruned, errors.Join(errs...)
+}
+
+func (d *Dir) Stats() Stats {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return Stats{
+		Count:    len(d.index),
+		Bytes:    d.bytes,
+		MaxBytes: d.maxBytes,
+		Expired:  d.expired,
+		Evicted:  d.evicted,
+	}
+}
@@ -0,0 +1,142 @@
+package results
+
+import (
+	"kappa-v2/service/internal/objstore"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func result(id, function string, status Status, created time.Time) Result {
+	return Result{
+		ID:        id,
+		Function:  function,
+		Status:    status,
+		Body:      []byte(`{"ok":true}`),
+		CreatedAt: created,
+		ExpiresAt: created.Add(time.Hour),
+	}
+}
+
+func TestDir(t *testing.T) {
+	dir := t.TempDir()
+	store, err := OpenDir(dir, DefaultMaxBytes)
+	require.NoError(t, err)
+
+	now := time.Now()
+	require.NoError(t, store.Put(result("a", "resize", Succeeded, now.Add(-2*time.Minute))))
+	require.NoError(t, store.Put(result("b", "resize", Failed, now.Add(-time.Minute))))
+	require.NoError(t, store.Put(result("c", "thumbs", Pending, now)))
+
+	got, err := store.Get("a")
+	require.NoError(t, err)
+	assert.Equal(t, []byte(`{"ok":true}`), got.Body)
+	_, err = store.Get("missing")
+	assert.ErrorIs(t, err, ErrNotFound)
+	_, err = store.Get("../etc/passwd")
+	assert.ErrorIs(t, err, ErrNotFound)
+
+	list, err := store.List(Filter{})
+	require.NoError(t, err)
+	require.Len(t, list, 3)
+	assert.Equal(t, "c", list[0].ID, "newest first")
+	assert.Nil(t, list[0].Body, "lists leave bodies out")
+
+	failed, err := store.List(Filter{Status: Failed})
+	require.NoError(t, err)
+	require.Len(t, failed, 1)
+	assert.Equal(t, "b", failed[0].ID)
+
+	resize, err := store.List(Filter{Function: "resize"})
+	require.NoError(t, err)
+	assert.Len(t, resize, 2)
+
+	// Results survive the store being opened again
+	reopened, err := OpenDir(dir, DefaultMaxBytes)
+	require.NoError(t, err)
+	assert.Equal(t, store.Stats(), reopened.Stats())
+	got, err = reopened.Get("b")
+	require.NoError(t, err)
+	assert.Equal(t, Failed, got.Status)
+
+	require.NoError(t, reopened.Delete("b"))
+	assert.ErrorIs(t, reopened.Delete("b"), ErrNotFound)
+}
+
+func TestDir_Prune(t *testing.T) {
+	store, err := OpenDir(t.TempDir(), DefaultMaxBytes)
+	require.NoError(t, err)
+	now := time.Now()
+	require.NoError(t, store.Put(result("old", "resize", Succeeded, now.Add(-2*time.Hour))))
+	require.NoError(t, store.Put(result("new", "resize", Succeeded, now)))
+
+	_, err = store.Get("old")
+	assert.ErrorIs(t, err, ErrNotFound, "expired results are gone before they are pruned")
+
+	pruned, err := store.Prune(now)
+	require.NoError(t, err)
+	assert.Equal(t, 1, pruned)
+	stats := store.Stats()
+	assert.Equal(t, 1, stats.Count)
+	assert.Equal(t, uint64(1), stats.Expired)
+}
+
+func TestDir_Evict(t *testing.T) {
+	now := time.Now()
+	probe, err := OpenDir(t.TempDir(), DefaultMaxBytes)
+	require.NoError(t, err)
+	require.NoError(t, probe.Put(result("a", "resize", Succeeded, now)))
+	size := probe.Stats().Bytes
+
+	// Room for two results
+	store, err := OpenDir(t.TempDir(), 2*size+size/2)
+	require.NoError(t, err)
+	require.NoError(t, store.Put(result("a", "resize", Pending, now.Add(-3*time.Minute))))
+	require.NoError(t, store.Put(result("b", "resize", Succeeded, now.Add(-2*time.Minute))))
+	require.NoError(t, store.Put(result("c", "resize", Succeeded, now.Add(-time.Minute))))
+
+	_, err = store.Get("a")
+	assert.NoError(t, err, "unfinished results aren't evicted")
+	_, err = store.Get("b")
+	assert.ErrorIs(t, err, ErrNotFound, "the oldest finished result is evicted")
+	_, err = store.Get("c")
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(1), store.Stats().Evicted)
+}
+
+func TestBucket(t *testing.T) {
+	objects, err := objstore.NewDir(t.TempDir())
+	require.NoError(t, err)
+	store := NewBucket(objects)
+
+	now := time.Now()
+	require.NoError(t, store.Put(result("a", "resize", Succeeded, now.Add(-2*time.Minute))))
+	require.NoError(t, store.Put(result("b", "resize", Failed, now.Add(-time.Minute))))
+	require.NoError(t, store.Put(result("c", "thumbs", Pending, now)))
+	assert.Error(t, store.Put(result("../d", "resize", Pending, now)))
+
+	got, err := store.Get("a")
+	require.NoError(t, err)
+	assert.Equal(t, `{"ok":true}`, string(got.Body))
+	_, err = store.Get("missing")
+	assert.ErrorIs(t, err, ErrNotFound)
+
+	// Another node sees the results through the same bucket
+	list, err := NewBucket(objects).List(Filter{Function: "resize"})
+	require.NoError(t, err)
+	require.Len(t, list, 2)
+	assert.Equal(t, "b", list[0].ID, "newest first")
+	assert.Nil(t, list[0].Body)
+
+	require.NoError(t, store.Delete("b"))
+	assert.ErrorIs(t, store.Delete("b"), ErrNotFound)
+
+	pruned, err := store.Prune(now.Add(time.Hour - time.Second))
+	require.NoError(t, err)
+	assert.Equal(t, 1, pruned, "a expires first")
+	stats := store.Stats()
+	assert.Equal(t, 1, stats.Count)
+	assert.Equal(t, uint64(1), stats.Expired)
+}
@@ -0,0 +1,121 @@
+'use strict';
+// Kappa runtime bootstrap for nodejs functions. It speaks the same protocol
+// as pkg/handler and calls the user's handler, given as "file.export" in
+// KAPPA_HANDLER, relative to /app.
+const fs = require('fs');
+const http = require('http');
+const https = require('https');
+const path = require('path');
+
+const [file, exportName] = (process.env.KAPPA_HANDLER || 'index.handler').split(/\.(?=[^.]+$)/);
+const handler = require(path.resolve(process.env.LAMBDA_TASK_ROOT || '/app', file))[exportName];
+if (typeof handler !== 'function') {
+  console.error(`Handler ${exportName} not exported from ${file}`);
+  process.exit(1);
+}
+
+const port = process.env.PORT || 8080;
+
+// The service tunes the server with the same env as pkg/handler
+function envInt(name, fallback) {
+  const v = parseInt(process.env[name], 10);
+  return Number.isNaN(v) ? fallback : v;
+}
+const serverConfig = {
+  readHeaderTimeoutMs: envInt('KAPPA_HTTP_READ_HEADER_TIMEOUT_MS', 10000),
+  readTimeoutMs: envInt('KAPPA_HTTP_READ_TIMEOUT_MS', 60000),
+  idleTimeoutMs: envInt('KAPPA_HTTP_IDLE_TIMEOUT_MS', 120000),
+  maxHeaderBytes: envInt('KAPPA_HTTP_MAX_HEADER_BYTES', 1 << 20),
+  keepAlive: process.env.KAPPA_HTTP_KEEPALIVE !== 'false',
+  tcpKeepAliveMs: envInt('KAPPA_HTTP_TCP_KEEPALIVE_MS', 15000),
+  drainTimeoutMs: envInt('KAPPA_HTTP_DRAIN_TIMEOUT_MS', 10000),
+};
+
+function send(res, statusCode, headers, body) {
+  res.writeHead(statusCode, headers);
+  res.end(body);
+}
+
+async function invoke(req, res) {
+  let data = '';
+  for await (const chunk of req) data += chunk;
+
+  let event;
+  try {
+    event = JSON.parse(data);
+  } catch {
+    return send(res, 400, { 'Content-Type': 'application/json' }, JSON.stringify({ error: 'Invalid request body' }));
+  }
+
+  const requestId = req.headers['kappa-runtime-aws-request-id'] || event.requestId || '';
+  if (!event.requestId) event.requestId = requestId;
+  console.log(`REQUEST: ${event.requestId} ${req.url}`);
+
+  let response;
+  try {
+    response = (await handler(event)) || {};
+  } catch (err) {
+    console.error(err);
+    response = { statusCode: 500, body: { error: String((err && err.message) || err) } };
+  }
+
+  const headers = Object.assign({}, response.headers);
+  let contentType = Object.keys(headers).find((k) => k.toLowerCase() === 'content-type');
+  if (!contentType) {
+    contentType = 'Content-Type';
+    headers[contentType] = 'application/json';
+  }
+  headers['Kappa-Request-Id'] = response.requestId || event.requestId;
+  headers['Kappa-Response-Format'] = 'raw';
+
+  // Non JSON bodies given as text are written as is
+  let body = response.body;
+  if (typeof body !== 'string' || headers[contentType].includes('json')) {
+    body = body === undefined ? '' : JSON.stringify(body);
+  }
+
+  const statusCode = response.statusCode || 200;
+  send(res, statusCode, headers, body);
+  console.log(`RESPONSE: ${event.requestId} ${statusCode}`);
+}
+
+function route(req, res) {
+  if (!serverConfig.keepAlive) res.setHeader('Connection', 'close');
+  if (req.url === '/health') return send(res, 200, {}, 'OK');
+  if (req.url === '/runtime/info') {
+    const info = { port: String(port), tls: Boolean(certFile && keyFile), nodeVersion: process.version, pid: process.pid, server: serverConfig };
+    return send(res, 200, { 'Content-Type': 'application/json' }, JSON.stringify(info));
+  }
+  if (req.url !== '/2015-03-31/functions/function/invocations') return send(res, 404, {}, '');
+  if (req.method !== 'POST') return send(res, 405, {}, '');
+  invoke(req, res).catch((err) => {
+    console.error(err);
+    send(res, 500, {}, '');
+  });
+}
+
+const certFile = process.env.KAPPA_TLS_CERT_FILE;
+const keyFile = process.env.KAPPA_TLS_KEY_FILE;
+const options = {
+  maxHeaderSize: serverConfig.maxHeaderBytes,
+  keepAlive: serverConfig.tcpKeepAliveMs > 0,
+  keepAliveInitialDelay: Math.max(serverConfig.tcpKeepAliveMs, 0),
+};
+const server = certFile && keyFile
+  ? https.createServer({ ...options, cert: fs.readFileSync(certFile), key: fs.readFileSync(keyFile) }, route)
+  : http.createServer(options, route);
+server.headersTimeout = serverConfig.readHeaderTimeoutMs;
+server.requestTimeout = serverConfig.readTimeoutMs;
+server.keepAliveTimeout = serverConfig.idleTimeoutMs;
+
+server.listen(port, () => console.log(`Kappa function starting on port ${port}`));
+
+// Let requests in flight finish before exiting, for up to the drain timeout
+function drain() {
+  console.log(`Kappa function draining for up to ${serverConfig.drainTimeoutMs}ms`);
+  server.close(() => process.exit(0));
+  if (server.closeIdleConnections) server.closeIdleConnections();
+  setTimeout(() => process.exit(0), serverConfig.drainTimeoutMs).unref();
+}
+process.on('SIGTERM', drain);
+process.on('SIGINT', drain);
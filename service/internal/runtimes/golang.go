@@ -0,0 +1,232 @@
+package runtimes
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"kappa-v2/pkg/logger"
+	"kappa-v2/service/internal/kappa"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/opencontainers/runtime-spec/specs-go"
+	"go.uber.org/zap"
+)
+
+// GoOptions configures how go functions are built.
+type GoOptions struct {
+	// CacheDir holds the module and build caches shared by every go build
+	CacheDir string
+	// BuildDir holds compiled functions, keyed by the hash of their source
+	BuildDir string
+	// Proxy is the GOPROXY modules are downloaded through
+	Proxy string
+	// Private is GOPRIVATE, modules fetched directly and not checked against the sumdb
+	Private string
+	// BuildTimeout bounds the download and compile
+	BuildTimeout time.Duration
+	// User is the "uid:gid" the builder runs as, never root
+	User string
+}
+
+// GoOptionsFromEnv reads the KAPPA_GO_* variables.
+func GoOptionsFromEnv() GoOptions {
+	base := os.Getenv("KAPPA_GO_RUNTIME_DIR")
+	if base == "" {
+		base = "/var/lib/kappa/runtimes/golang"
+	}
+	opts := GoOptions{
+		CacheDir:     filepath.Join(base, "cache"),
+		BuildDir:     filepath.Join(base, "builds"),
+		Proxy:        os.Getenv("KAPPA_GOPROXY"),
+		Private:      os.Getenv("KAPPA_GOPRIVATE"),
+		User:         os.Getenv("KAPPA_GO_USER"),
+		BuildTimeout: 10 * time.Minute,
+	}
+	if opts.Proxy == "" {
+		opts.Proxy = "https://proxy.golang.org,direct"
+	}
+	if opts.User == "" {
+		opts.User = "1000:1000"
+	}
+	if timeout, err := time.ParseDuration(os.Getenv("KAPPA_GO_BUILD_TIMEOUT")); err == nil {
+		opts.BuildTimeout = timeout
+	}
+	return opts
+}
+
+// Go compiles go functions in a builder container and runs the binary.
+type Go struct {
+	cfg     Config
+	version Version
+	opts    GoOptions
+}
+
+// NewGo creates a golang runtime for cfg building with version's image.
+func NewGo(cfg Config, version Version, opts GoOptions) *Go {
+	return &Go{cfg: cfg, version: version, opts: opts}
+}
+
+// Prepare builds the function and launches the resulting binary.
+func (g *Go) Prepare(ctx context.Context, backend kappa.Backend, name string) (*kappa.Launch, error) {
+	buildDir, err := g.build(ctx, backend, name)
+	if err != nil {
+		return nil, err
+	}
+
+	return &kappa.Launch{
+		Image:   g.version.Ref(),
+		Command: []string{"/app/main"},
+		Mounts: []specs.Mount{
+			{Type: "bind", Source: buildDir, Destination: "/app", Options: []string{"rbind", "ro"}},
+		},
+		WorkDir: "/app",
+	}, nil
+}
+
+// goBuildScript downloads the function's modules into the shared cache and
+// compiles it. The source is read only, so the module files are never changed.
+const goBuildScript = `set -e
+cd /src
+go mod download
+CGO_ENABLED=0 go build -mod=readonly -trimpath -o /out/main "$KAPPA_PACKAGE"`
+
+// build runs go mod download and go build in a builder container as an
+// unprivileged user, returning the directory holding the binary. The module
+// and build caches are shared between functions so later builds start warm,
+// and builds are keyed by the hash of the source so unchanged functions
+// aren't rebuilt.
+func (g *Go) build(ctx context.Context, backend kappa.Backend, name string) (string, error) {
+	if _, err := os.Stat(filepath.Join(g.cfg.CodePath, "go.mod")); err != nil {
+		return "", fmt.Errorf("go function has no go.mod: %w", err)
+	}
+
+	hash, err := sourceHash(g.cfg.CodePath)
+	if err != nil {
+		return "", fmt.Errorf("failed to hash source: %w", err)
+	}
+	// The toolchain and package change the output too
+	sum := sha256.Sum256([]byte(hash + g.version.Ref() + g.cfg.Handler))
+	hash = hex.EncodeToString(sum[:])
+
+	buildDir := filepath.Join(g.opts.BuildDir, hash)
+	if _, err := os.Stat(filepath.Join(buildDir, "main")); err == nil {
+		return buildDir, nil
+	}
+
+	modCache := filepath.Join(g.opts.CacheDir, "mod")
+	buildCache := filepath.Join(g.opts.CacheDir, "build")
+	for _, dir := range []string{modCache, buildCache, g.opts.BuildDir} {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return "", fmt.Errorf("failed to create cache directory: %w", err)
+		}
+		chownToUser(dir, g.opts.User)
+	}
+
+	// Build into a staging directory and move it into place once the build
+	// succeeds, so a failed or concurrent build is never launched
+	stagingDir, err := os.MkdirTemp(g.opts.BuildDir, ".build-"+hash[:12]+"-*")
+	if err != nil {
+		return "", fmt.Errorf("failed to create build directory: %w", err)
+	}
+	defer os.RemoveAll(stagingDir)
+	if err := os.Chmod(stagingDir, 0755); err != nil {
+		return "", fmt.Errorf("failed to create build directory: %w", err)
+	}
+	chownToUser(stagingDir, g.opts.User)
+
+	pkg := g.cfg.Handler
+	if pkg == "" {
+		pkg = "."
+	}
+
+	l := logger.Get()
+	l.Info("Building go function", zap.String("name", name), zap.String("hash", hash))
+
+	ctx, cancel := context.WithTimeout(ctx, g.opts.BuildTimeout)
+	defer cancel()
+
+	err = kappa.RunToCompletion(ctx, backend, kappa.RunSpec{
+		// Named after the staging dir, concurrent builds each have one
+		Name:    name + "-go-build-" + strings.TrimPrefix(filepath.Base(stagingDir), ".build-"),
+		Image:   g.version.Ref(),
+		Command: []string{"sh", "-c", goBuildScript},
+		Env: []string{
+			"KAPPA_PACKAGE=" + pkg,
+			"GOPROXY=" + g.opts.Proxy,
+			"GOPRIVATE=" + g.opts.Private,
+			"GOMODCACHE=/go/pkg/mod",
+			"GOCACHE=/go/cache",
+			"GOFLAGS=-modcacherw",
+			"GOTOOLCHAIN=local",
+			"HOME=/tmp",
+		},
+		Mounts: []specs.Mount{
+			{Type: "bind", Source: g.cfg.CodePath, Destination: "/src", Options: []string{"rbind", "ro"}},
+			{Type: "bind", Source: modCache, Destination: "/go/pkg/mod", Options: []string{"rbind", "rw"}},
+			{Type: "bind", Source: buildCache, Destination: "/go/cache", Options: []string{"rbind", "rw"}},
+			{Type: "bind", Source: stagingDir, Destination: "/out", Options: []string{"rbind", "rw"}},
+		},
+		WorkDir: "/src",
+		User:    g.opts.User,
+		OnLog: func(line string) {
+			l.Info("go build", zap.String("function", name), zap.String("log", line))
+		},
+	})
+	if err != nil {
+		if errors.Is(err, context.DeadlineExceeded) {
+			return "", fmt.Errorf("go build timed out after %s", g.opts.BuildTimeout)
+		}
+		return "", fmt.Errorf("go build failed: %w", err)
+	}
+
+	if err := os.Rename(stagingDir, buildDir); err != nil {
+		// Another function with the same source finished first
+		if _, statErr := os.Stat(buildDir); statErr == nil {
+			return buildDir, nil
+		}
+		return "", fmt.Errorf("failed to move build into place: %w", err)
+	}
+	return buildDir, nil
+}
+
+// sourceHash hashes the path and content of every file under dir, skipping
+// version control metadata.
+func sourceHash(dir string) (string, error) {
+	h := sha256.New()
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() && d.Name() == ".git" {
+			return filepath.SkipDir
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+
+		fmt.Fprintf(h, "%s\x00", filepath.ToSlash(rel))
+		_, err = io.Copy(h, f)
+		return err
+	})
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
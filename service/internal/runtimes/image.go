@@ -0,0 +1,256 @@
+package runtimes
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/fs"
+	"kappa-v2/service/internal/kappa"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"text/template"
+)
+
+// validHandler keeps handlers safe to write into a Dockerfile
+var validHandler = regexp.MustCompile(`^[A-Za-z0-9_./-]+$`)
+
+// imageUser is who functions run as in built images, the node user in the
+// official images
+const imageUser = "1000:1000"
+
+// nodeDockerfile bakes the code and bootstrap into the runtime's image and
+// installs production dependencies without running package scripts, like
+// setupNodeModules. The manifests are copied on their own first, so the
+// install layer is reused until they change.
+var nodeDockerfile = template.Must(template.New("node").Parse(`FROM {{.Image}}
+WORKDIR /app
+{{- if .Manifests}}
+COPY{{range .Manifests}} code/{{.}}{{end}} ./
+ARG NPM_CONFIG_REGISTRY
+RUN --mount=type=cache,id={{.CacheID}}-npm,target=/root/.npm \
+    npm {{if .Locked}}ci{{else}}install{{end}} --omit=dev --ignore-scripts --no-audit --no-fund
+{{- end}}
+COPY runtime/ /opt/kappa/runtime/
+COPY code/ /app/
+ENV KAPPA_HANDLER="{{.Handler}}" NODE_ENV=production
+USER {{.User}}
+CMD ["node", "/opt/kappa/runtime/node.js"]
+`))
+
+// goDockerfile compiles the function like goBuildScript and copies only the
+// binary into a fresh stage of the runtime's image. Modules are downloaded
+// before the rest of the code is copied, so the download layer is reused
+// until go.mod or go.sum change.
+var goDockerfile = template.Must(template.New("go").Parse(`FROM {{.Image}} AS build
+WORKDIR /src
+ARG GOPROXY
+ARG GOPRIVATE
+ENV GOTOOLCHAIN=local
+COPY{{range .Manifests}} code/{{.}}{{end}} ./
+RUN --mount=type=cache,id={{.CacheID}}-gomod,target=/go/pkg/mod \
+    go mod download
+COPY code/ .
+RUN --mount=type=cache,id={{.CacheID}}-gomod,target=/go/pkg/mod \
+    --mount=type=cache,id={{.CacheID}}-gobuild,target=/root/.cache/go-build \
+    CGO_ENABLED=0 go build -mod=readonly -trimpath -o /out/main "{{.Handler}}"
+
+FROM {{.Image}}
+COPY --from=build /out/main /app/main
+WORKDIR /app
+USER {{.User}}
+CMD ["/app/main"]
+`))
+
+// dockerfileData fills the Dockerfile templates
+type dockerfileData struct {
+	Image   string
+	Handler string
+	User    string
+	CacheID string
+	// Manifests are the dependency manifests in the code, copied before it
+	Manifests []string
+	// Locked is whether there's a package-lock.json to install from
+	Locked bool
+}
+
+// validCacheID keeps cache IDs safe to write into a Dockerfile
+var validCacheID = regexp.MustCompile(`^[a-z0-9][a-z0-9_.-]*$`)
+
+// existing returns the names of the files that exist in dir.
+func existing(dir string, names ...string) []string {
+	var found []string
+	for _, name := range names {
+		if _, err := os.Stat(filepath.Join(dir, name)); err == nil {
+			found = append(found, name)
+		}
+	}
+	return found
+}
+
+// WriteBuildContext writes a build context for cfg's code into dir: the code
+// under code/, the bootstrap under runtime/ and a Dockerfile baking them into
+// an image based on the runtime version's, so the function runs without any
+// mounts. Package and build caches are mounted by cacheID, so builds sharing
+// it reuse what earlier ones downloaded and compiled. It returns the build
+// args the Dockerfile takes, pointing package managers at the same
+// registries and proxies as the runtimes.
+func WriteBuildContext(dir string, cfg Config, matrix *Matrix, cacheID string) (map[string]string, error) {
+	if cfg.CodePath == "" {
+		return nil, fmt.Errorf("runtime needs a codePath")
+	}
+	if info, err := os.Stat(cfg.CodePath); err != nil || !info.IsDir() {
+		return nil, fmt.Errorf("code path %s is not a directory", cfg.CodePath)
+	}
+	version, err := matrix.Resolve(cfg)
+	if err != nil {
+		return nil, err
+	}
+	if !validCacheID.MatchString(cacheID) {
+		return nil, fmt.Errorf("invalid cache ID %q", cacheID)
+	}
+
+	var tmpl *template.Template
+	data := dockerfileData{Image: version.Ref(), User: imageUser, CacheID: cacheID}
+	args := make(map[string]string)
+	switch version.Language {
+	case "nodejs":
+		handler := cfg.Handler
+		if handler == "" {
+			handler = "index.handler"
+		}
+		if !validHandler.MatchString(handler) {
+			return nil, fmt.Errorf("invalid handler %q", handler)
+		}
+		tmpl, data.Handler = nodeDockerfile, handler
+		data.Manifests = existing(cfg.CodePath, "package.json", "package-lock.json")
+		data.Locked = len(data.Manifests) == 2
+		if len(data.Manifests) > 0 && data.Manifests[0] != "package.json" {
+			// npm needs the package.json, not just a lockfile
+			data.Manifests = nil
+		}
+		if opts := NodeOptionsFromEnv(); opts.Registry != "" {
+			args["NPM_CONFIG_REGISTRY"] = opts.Registry
+		}
+
+		bootstrap, err := bootstrapFS.ReadFile("bootstrap/node.js")
+		if err != nil {
+			return nil, fmt.Errorf("failed to read bootstrap: %w", err)
+		}
+		if err := os.MkdirAll(filepath.Join(dir, "runtime"), 0755); err != nil {
+			return nil, fmt.Errorf("failed to write bootstrap: %w", err)
+		}
+		if err := os.WriteFile(filepath.Join(dir, "runtime", "node.js"), bootstrap, 0644); err != nil {
+			return nil, fmt.Errorf("failed to write bootstrap: %w", err)
+		}
+	case "go":
+		if _, err := os.Stat(filepath.Join(cfg.CodePath, "go.mod")); err != nil {
+			return nil, fmt.Errorf("go function has no go.mod: %w", err)
+		}
+		pkg := cfg.Handler
+		if pkg == "" {
+			pkg = "."
+		}
+		if !validHandler.MatchString(pkg) {
+			return nil, fmt.Errorf("invalid handler %q", pkg)
+		}
+		tmpl, data.Handler = goDockerfile, pkg
+		data.Manifests = existing(cfg.CodePath, "go.mod", "go.sum")
+		opts := GoOptionsFromEnv()
+		args["GOPROXY"] = opts.Proxy
+		if opts.Private != "" {
+			args["GOPRIVATE"] = opts.Private
+		}
+	default:
+		return nil, fmt.Errorf("unsupported runtime language: %s", version.Language)
+	}
+
+	if err := copySource(cfg.CodePath, filepath.Join(dir, "code")); err != nil {
+		return nil, fmt.Errorf("failed to copy code: %w", err)
+	}
+	var dockerfile bytes.Buffer
+	if err := tmpl.Execute(&dockerfile, data); err != nil {
+		return nil, fmt.Errorf("failed to write Dockerfile: %w", err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "Dockerfile"), dockerfile.Bytes(), 0644); err != nil {
+		return nil, fmt.Errorf("failed to write Dockerfile: %w", err)
+	}
+	return args, nil
+}
+
+// copySource copies the regular files under src to dst, skipping version
+// control metadata and installed node modules, which the build installs
+// itself.
+func copySource(src, dst string) error {
+	return filepath.WalkDir(src, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() && path != src && (d.Name() == ".git" || d.Name() == "node_modules") {
+			return filepath.SkipDir
+		}
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dst, rel)
+		if d.IsDir() {
+			return os.MkdirAll(target, 0755)
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+
+		in, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer in.Close()
+		out, err := os.OpenFile(target, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+		if err != nil {
+			return err
+		}
+		if _, err := io.Copy(out, in); err != nil {
+			out.Close()
+			return err
+		}
+		return out.Close()
+	})
+}
+
+// Prebuilt runs a function from an image built from WriteBuildContext, with
+// its code and dependencies already in place.
+type Prebuilt struct {
+	cfg     Config
+	version Version
+}
+
+// NewPrebuilt creates a runtime running cfg.Image, built for version.
+func NewPrebuilt(cfg Config, version Version) (*Prebuilt, error) {
+	if strings.ContainsAny(cfg.Image, " \t\n") {
+		return nil, fmt.Errorf("invalid image %q", cfg.Image)
+	}
+	return &Prebuilt{cfg: cfg, version: version}, nil
+}
+
+// Prepare launches the image, there's nothing to set up.
+func (p *Prebuilt) Prepare(ctx context.Context, backend kappa.Backend, name string) (*kappa.Launch, error) {
+	launch := &kappa.Launch{
+		Image:   p.cfg.Image,
+		WorkDir: "/app",
+	}
+	switch p.version.Language {
+	case "nodejs":
+		handler := p.cfg.Handler
+		if handler == "" {
+			handler = "index.handler"
+		}
+		launch.Command = []string{"node", "/opt/kappa/runtime/node.js"}
+		launch.Env = []string{"KAPPA_HANDLER=" + handler, "NODE_ENV=production"}
+	default:
+		launch.Command = []string{"/app/main"}
+	}
+	return launch, nil
+}
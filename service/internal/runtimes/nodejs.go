@@ -0,0 +1,255 @@
+package runtimes
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"kappa-v2/pkg/logger"
+	"kappa-v2/service/internal/kappa"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/opencontainers/runtime-spec/specs-go"
+	"go.uber.org/zap"
+)
+
+// NodeOptions configures how nodejs dependencies are installed.
+type NodeOptions struct {
+	// BaseDir holds each function's install target
+	BaseDir string
+	// Registry is the npm registry or mirror to install from
+	Registry string
+	// AuthToken authenticates against Registry
+	AuthToken string
+	// InstallTimeout bounds how long npm may run
+	InstallTimeout time.Duration
+	// User is the "uid:gid" npm runs as, never root
+	User string
+}
+
+// NodeOptionsFromEnv reads the KAPPA_NODE_* and KAPPA_NPM_* variables.
+func NodeOptionsFromEnv() NodeOptions {
+	opts := NodeOptions{
+		BaseDir:        os.Getenv("KAPPA_NODE_RUNTIME_DIR"),
+		Registry:       os.Getenv("KAPPA_NPM_REGISTRY"),
+		AuthToken:      os.Getenv("KAPPA_NPM_TOKEN"),
+		User:           os.Getenv("KAPPA_NPM_USER"),
+		InstallTimeout: 5 * time.Minute,
+	}
+	if opts.BaseDir == "" {
+		opts.BaseDir = "/var/lib/kappa/runtimes/nodejs"
+	}
+	if opts.User == "" {
+		// The node user in the official images
+		opts.User = "1000:1000"
+	}
+	if timeout, err := time.ParseDuration(os.Getenv("KAPPA_NPM_INSTALL_TIMEOUT")); err == nil {
+		opts.InstallTimeout = timeout
+	}
+	return opts
+}
+
+// Node runs nodejs functions through the embedded bootstrap.
+type Node struct {
+	cfg     Config
+	version Version
+	opts    NodeOptions
+}
+
+// NewNode creates a nodejs runtime for cfg running in version's image.
+func NewNode(cfg Config, version Version, opts NodeOptions) *Node {
+	return &Node{cfg: cfg, version: version, opts: opts}
+}
+
+// Prepare installs the function's dependencies and launches the bootstrap.
+func (n *Node) Prepare(ctx context.Context, backend kappa.Backend, name string) (*kappa.Launch, error) {
+	modulesDir, err := n.setupNodeModules(ctx, backend, name)
+	if err != nil {
+		return nil, err
+	}
+
+	runtimeDir, err := writeBootstrap(name, "node.js")
+	if err != nil {
+		return nil, err
+	}
+
+	handler := n.cfg.Handler
+	if handler == "" {
+		handler = "index.handler"
+	}
+
+	launch := &kappa.Launch{
+		Image:   n.version.Ref(),
+		Command: []string{"node", "/opt/kappa/runtime/node.js"},
+		Env: []string{
+			"KAPPA_HANDLER=" + handler,
+			"NODE_ENV=production",
+		},
+		Mounts: []specs.Mount{
+			{Type: "bind", Source: n.cfg.CodePath, Destination: "/app", Options: []string{"rbind", "ro"}},
+			{Type: "bind", Source: runtimeDir, Destination: "/opt/kappa/runtime", Options: []string{"rbind", "ro"}},
+		},
+		WorkDir: "/app",
+		TmpDirs: []string{runtimeDir},
+	}
+
+	if modulesDir != "" {
+		launch.Env = append(launch.Env, "NODE_PATH=/opt/kappa/node_modules")
+		launch.Mounts = append(launch.Mounts, specs.Mount{
+			Type: "bind", Source: modulesDir, Destination: "/opt/kappa/node_modules", Options: []string{"rbind", "ro"},
+		})
+	}
+	return launch, nil
+}
+
+// npmInstallScript copies the manifest into the install target and installs
+// production dependencies without running package scripts.
+const npmInstallScript = `set -e
+cp "$KAPPA_SRC/package.json" "$KAPPA_INSTALL/"
+cd "$KAPPA_INSTALL"
+flags="--omit=dev --ignore-scripts --no-audit --no-fund"
+if [ -f "$KAPPA_SRC/package-lock.json" ]; then
+  cp "$KAPPA_SRC/package-lock.json" .
+  npm ci $flags
+else
+  npm install $flags
+fi`
+
+// setupNodeModules installs the function's dependencies with npm running in
+// a setup container as an unprivileged user, returning the node_modules
+// directory. Installs are keyed by the hash of package.json and its lockfile,
+// so functions only ever see their own dependency tree and functions with
+// identical manifests share one install. Nothing is installed without a
+// package.json.
+func (n *Node) setupNodeModules(ctx context.Context, backend kappa.Backend, name string) (string, error) {
+	hash, err := manifestHash(n.cfg.CodePath)
+	if errors.Is(err, os.ErrNotExist) {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+
+	modulesRoot := filepath.Join(n.opts.BaseDir, "modules")
+	installDir := filepath.Join(modulesRoot, hash)
+	modulesDir := filepath.Join(installDir, "node_modules")
+	if _, err := os.Stat(installDir); err == nil {
+		return modulesDir, nil
+	}
+
+	if err := os.MkdirAll(modulesRoot, 0755); err != nil {
+		return "", fmt.Errorf("failed to create modules directory: %w", err)
+	}
+
+	// Install into a staging directory and move it into place once npm
+	// succeeds, so a failed or concurrent install is never mounted
+	stagingDir, err := os.MkdirTemp(modulesRoot, ".install-"+hash[:12]+"-*")
+	if err != nil {
+		return "", fmt.Errorf("failed to create install directory: %w", err)
+	}
+	defer os.RemoveAll(stagingDir)
+	if err := os.Chmod(stagingDir, 0755); err != nil {
+		return "", fmt.Errorf("failed to create install directory: %w", err)
+	}
+	chownToUser(stagingDir, n.opts.User)
+
+	l := logger.Get()
+	l.Info("Installing node modules", zap.String("name", name), zap.String("hash", hash))
+
+	configDir, err := os.MkdirTemp("", fmt.Sprintf("kappa-%s-npmrc-*", name))
+	if err != nil {
+		return "", fmt.Errorf("failed to create npm config directory: %w", err)
+	}
+	defer os.RemoveAll(configDir)
+	if err := os.WriteFile(filepath.Join(configDir, "npmrc"), []byte(n.npmrc()), 0644); err != nil {
+		return "", fmt.Errorf("failed to write npmrc: %w", err)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, n.opts.InstallTimeout)
+	defer cancel()
+
+	err = kappa.RunToCompletion(ctx, backend, kappa.RunSpec{
+		// Named after the staging dir, concurrent installs each have one
+		Name:    name + "-npm-install-" + strings.TrimPrefix(filepath.Base(stagingDir), ".install-"),
+		Image:   n.version.Ref(),
+		Command: []string{"sh", "-c", npmInstallScript},
+		Env: []string{
+			"KAPPA_SRC=/src",
+			"KAPPA_INSTALL=/install",
+			"HOME=/install",
+			"NPM_CONFIG_CACHE=/install/.npm-cache",
+			"NPM_CONFIG_USERCONFIG=/kappa/npmrc",
+			"NPM_CONFIG_UPDATE_NOTIFIER=false",
+		},
+		Mounts: []specs.Mount{
+			{Type: "bind", Source: n.cfg.CodePath, Destination: "/src", Options: []string{"rbind", "ro"}},
+			{Type: "bind", Source: stagingDir, Destination: "/install", Options: []string{"rbind", "rw"}},
+			{Type: "bind", Source: configDir, Destination: "/kappa", Options: []string{"rbind", "ro"}},
+		},
+		WorkDir: "/install",
+		User:    n.opts.User,
+		OnLog: func(line string) {
+			l.Info("npm install", zap.String("function", name), zap.String("log", line))
+		},
+	})
+	if err != nil {
+		if errors.Is(err, context.DeadlineExceeded) {
+			return "", fmt.Errorf("npm install timed out after %s", n.opts.InstallTimeout)
+		}
+		return "", fmt.Errorf("npm install failed: %w", err)
+	}
+
+	// The npm cache and home are only needed during the install
+	if err := os.RemoveAll(filepath.Join(stagingDir, ".npm-cache")); err != nil {
+		return "", fmt.Errorf("failed to clean npm cache: %w", err)
+	}
+	if err := os.MkdirAll(filepath.Join(stagingDir, "node_modules"), 0755); err != nil {
+		return "", fmt.Errorf("failed to create node_modules: %w", err)
+	}
+	if err := os.Rename(stagingDir, installDir); err != nil {
+		// Another function with the same manifest finished first
+		if _, statErr := os.Stat(installDir); statErr == nil {
+			return modulesDir, nil
+		}
+		return "", fmt.Errorf("failed to move node modules into place: %w", err)
+	}
+	return modulesDir, nil
+}
+
+// npmrc points npm at the configured registry and its credentials.
+func (n *Node) npmrc() string {
+	var sb strings.Builder
+	if n.opts.Registry != "" {
+		fmt.Fprintf(&sb, "registry=%s\n", n.opts.Registry)
+	}
+	if n.opts.AuthToken != "" {
+		registry := n.opts.Registry
+		if registry == "" {
+			registry = "https://registry.npmjs.org/"
+		}
+		if u, err := url.Parse(registry); err == nil {
+			fmt.Fprintf(&sb, "//%s/:_authToken=%s\n", strings.TrimSuffix(u.Host+u.Path, "/"), n.opts.AuthToken)
+		}
+	}
+	return sb.String()
+}
+
+// manifestHash hashes package.json and package-lock.json, identifying the
+// dependency tree they install.
+func manifestHash(codePath string) (string, error) {
+	manifest, err := os.ReadFile(filepath.Join(codePath, "package.json"))
+	if err != nil {
+		return "", err
+	}
+	h := sha256.New()
+	h.Write(manifest)
+	if lock, err := os.ReadFile(filepath.Join(codePath, "package-lock.json")); err == nil {
+		h.Write(lock)
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
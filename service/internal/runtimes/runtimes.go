@@ -0,0 +1,97 @@
+package runtimes
+
+import (
+	"embed"
+	"fmt"
+	"kappa-v2/service/internal/kappa"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+//go:embed bootstrap
+var bootstrapFS embed.FS
+
+// Config selects an interpreted runtime for a function whose source lives in
+// CodePath on the host, instead of a prebuilt binary.
+type Config struct {
+	Language string `json:"language"`
+	// Version is a supported version of Language, or a friendly name like
+	// "nodejs20" on its own, see GET /runtimes
+	Version  string `json:"version"`
+	CodePath string `json:"codePath"`
+	// Handler is the entrypoint, for nodejs "index.handler" calls the handler
+	// export of index.js, for go it's the package to build, defaulting to "."
+	Handler string `json:"handler"`
+	// Image is an image POST /builds baked the code into, run instead of
+	// mounting CodePath
+	Image string `json:"image,omitempty"`
+}
+
+// New returns the preparer setting up cfg's runtime, which must be one of the
+// versions in matrix.
+func New(cfg Config, matrix *Matrix) (kappa.Preparer, error) {
+	if cfg.Image != "" {
+		version, err := matrix.Resolve(cfg)
+		if err != nil {
+			return nil, err
+		}
+		return NewPrebuilt(cfg, version)
+	}
+
+	if cfg.CodePath == "" {
+		return nil, fmt.Errorf("runtime needs a codePath")
+	}
+	if info, err := os.Stat(cfg.CodePath); err != nil || !info.IsDir() {
+		return nil, fmt.Errorf("code path %s is not a directory", cfg.CodePath)
+	}
+
+	version, err := matrix.Resolve(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	switch version.Language {
+	case "nodejs":
+		return NewNode(cfg, version, NodeOptionsFromEnv()), nil
+	case "go":
+		return NewGo(cfg, version, GoOptionsFromEnv()), nil
+	default:
+		return nil, fmt.Errorf("unsupported runtime language: %s", version.Language)
+	}
+}
+
+// writeBootstrap copies an embedded bootstrap script into a fresh temp dir.
+func writeBootstrap(name, script string) (string, error) {
+	data, err := bootstrapFS.ReadFile("bootstrap/" + script)
+	if err != nil {
+		return "", fmt.Errorf("failed to read bootstrap: %w", err)
+	}
+
+	dir, err := os.MkdirTemp("", fmt.Sprintf("kappa-%s-runtime-*", name))
+	if err != nil {
+		return "", fmt.Errorf("failed to create runtime directory: %w", err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, script), data, 0644); err != nil {
+		os.RemoveAll(dir)
+		return "", fmt.Errorf("failed to write bootstrap: %w", err)
+	}
+	return dir, nil
+}
+
+// chownToUser hands a directory written by a setup container to its "uid:gid"
+// user. It only works when the service runs as root, which containerd
+// requires anyway.
+func chownToUser(dir, user string) {
+	uidStr, gidStr, _ := strings.Cut(user, ":")
+	uid, err := strconv.Atoi(uidStr)
+	if err != nil {
+		return
+	}
+	gid, err := strconv.Atoi(gidStr)
+	if err != nil {
+		gid = uid
+	}
+	_ = os.Chown(dir, uid, gid)
+}
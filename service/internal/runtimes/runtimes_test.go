@@ -0,0 +1,314 @@
+package runtimes
+
+import (
+	"context"
+	"kappa-v2/service/internal/kappa"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeBackend records the specs it runs, calls onRun in place of running
+// them and exits with code
+type fakeBackend struct {
+	specs []kappa.RunSpec
+	code  int
+	onRun func(spec kappa.RunSpec)
+}
+
+func (b *fakeBackend) Run(spec kappa.RunSpec) (kappa.Instance, error) {
+	b.specs = append(b.specs, spec)
+	if b.onRun != nil {
+		b.onRun(spec)
+	}
+	return fakeInstance{code: b.code}, nil
+}
+
+// mountSource returns the host directory mounted at dest.
+func mountSource(spec kappa.RunSpec, dest string) string {
+	for _, m := range spec.Mounts {
+		if m.Destination == dest {
+			return m.Source
+		}
+	}
+	return ""
+}
+
+type fakeInstance struct {
+	code int
+}
+
+func (i fakeInstance) Stop() error { return nil }
+
+func (i fakeInstance) Wait(ctx context.Context) (int, error) { return i.code, nil }
+
+func newTestNode(t *testing.T, files map[string]string) *Node {
+	codeDir := t.TempDir()
+	for name, content := range files {
+		require.NoError(t, os.WriteFile(filepath.Join(codeDir, name), []byte(content), 0644))
+	}
+	version := Version{Name: "nodejs20", Language: "nodejs", Version: "20", Image: "docker.io/library/node:20"}
+	return NewNode(Config{Language: "nodejs", Version: "20", CodePath: codeDir}, version, NodeOptions{
+		BaseDir:        t.TempDir(),
+		Registry:       "https://npm.example.com/repo/",
+		AuthToken:      "secret",
+		InstallTimeout: time.Minute,
+		User:           "1000:1000",
+	})
+}
+
+func TestNew(t *testing.T) {
+	matrix := DefaultMatrix()
+
+	_, err := New(Config{Language: "nodejs", Version: "20"}, matrix)
+	assert.Error(t, err)
+
+	_, err = New(Config{Language: "cobol", Version: "1", CodePath: t.TempDir()}, matrix)
+	assert.Error(t, err)
+
+	_, err = New(Config{Language: "nodejs", Version: "latest", CodePath: t.TempDir()}, matrix)
+	assert.Error(t, err, "unlisted versions are rejected")
+
+	p, err := New(Config{Language: "nodejs", Version: "20", CodePath: t.TempDir()}, matrix)
+	require.NoError(t, err)
+	assert.IsType(t, &Node{}, p)
+
+	p, err = New(Config{Version: "go1.22", CodePath: t.TempDir()}, matrix)
+	require.NoError(t, err)
+	assert.IsType(t, &Go{}, p)
+
+	p, err = New(Config{Language: "nodejs", Version: "20", Image: "registry.local/fns/hello@sha256:1234"}, matrix)
+	require.NoError(t, err, "built images don't need the code")
+	launch, err := p.Prepare(context.Background(), nil, "hello")
+	require.NoError(t, err)
+	assert.Equal(t, "registry.local/fns/hello@sha256:1234", launch.Image)
+	assert.Empty(t, launch.Mounts)
+	assert.Contains(t, launch.Env, "KAPPA_HANDLER=index.handler")
+}
+
+func TestWriteBuildContext(t *testing.T) {
+	matrix := DefaultMatrix()
+	codeDir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(codeDir, "index.js"), []byte("exports.handler = () => ({})"), 0644))
+	require.NoError(t, os.WriteFile(filepath.Join(codeDir, "package.json"), []byte(`{"dependencies": {"left-pad": "1.3.0"}}`), 0644))
+	require.NoError(t, os.MkdirAll(filepath.Join(codeDir, "node_modules", "left-pad"), 0755))
+	require.NoError(t, os.WriteFile(filepath.Join(codeDir, "node_modules", "left-pad", "index.js"), nil, 0644))
+	t.Setenv("KAPPA_NPM_REGISTRY", "https://npm.example.com/")
+
+	dir := t.TempDir()
+	args, err := WriteBuildContext(dir, Config{Language: "nodejs", Version: "20", CodePath: codeDir, Handler: "index.main"}, matrix, "shop")
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{"NPM_CONFIG_REGISTRY": "https://npm.example.com/"}, args)
+	assert.FileExists(t, filepath.Join(dir, "code", "index.js"))
+	assert.NoDirExists(t, filepath.Join(dir, "code", "node_modules"), "the build installs dependencies itself")
+	assert.FileExists(t, filepath.Join(dir, "runtime", "node.js"))
+	dockerfile, err := os.ReadFile(filepath.Join(dir, "Dockerfile"))
+	require.NoError(t, err)
+	assert.Contains(t, string(dockerfile), `ENV KAPPA_HANDLER="index.main"`)
+	assert.Contains(t, string(dockerfile), "COPY code/package.json ./\n")
+	assert.Contains(t, string(dockerfile), "--mount=type=cache,id=shop-npm,target=/root/.npm")
+	assert.Contains(t, string(dockerfile), "npm install", "there's no lockfile to npm ci from")
+
+	require.NoError(t, os.WriteFile(filepath.Join(codeDir, "go.mod"), []byte("module hello\n"), 0644))
+	dir = t.TempDir()
+	_, err = WriteBuildContext(dir, Config{Version: "go1.22", CodePath: codeDir}, matrix, "shop")
+	require.NoError(t, err)
+	dockerfile, err = os.ReadFile(filepath.Join(dir, "Dockerfile"))
+	require.NoError(t, err)
+	assert.Contains(t, string(dockerfile), "COPY code/go.mod ./\n", "modules are downloaded before the code is copied")
+	assert.Contains(t, string(dockerfile), "id=shop-gobuild,target=/root/.cache/go-build")
+
+	_, err = WriteBuildContext(t.TempDir(), Config{Language: "nodejs", Version: "20", CodePath: codeDir, Handler: "x\nRUN rm -rf /"}, matrix, "shop")
+	assert.Error(t, err)
+	_, err = WriteBuildContext(t.TempDir(), Config{Version: "go1.22", CodePath: t.TempDir()}, matrix, "shop")
+	assert.Error(t, err, "go functions need a go.mod")
+	_, err = WriteBuildContext(t.TempDir(), Config{Language: "nodejs", Version: "20", CodePath: codeDir}, matrix, "a b")
+	assert.Error(t, err)
+}
+
+func TestMatrix(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "matrix.json")
+	require.NoError(t, os.WriteFile(path, []byte(`[
+		{"name": "nodejs20", "language": "nodejs", "version": "20", "image": "registry.local/node:20", "digest": "sha256:1234"}
+	]`), 0644))
+
+	m, err := LoadMatrix(path)
+	require.NoError(t, err)
+	require.Len(t, m.Versions(), 1)
+
+	v, err := m.Resolve(Config{Version: "nodejs20"})
+	require.NoError(t, err)
+	assert.Equal(t, "registry.local/node:20@sha256:1234", v.Ref())
+
+	v, err = m.Resolve(Config{Language: "nodejs", Version: "20"})
+	require.NoError(t, err)
+	assert.Equal(t, "nodejs20", v.Name)
+
+	_, err = m.Resolve(Config{Language: "go", Version: "nodejs20"})
+	assert.Error(t, err)
+
+	for _, invalid := range []string{
+		`[{"name": "a", "language": "nodejs", "version": "20"}]`,
+		`[{"name": "a", "language": "nodejs", "version": "20", "image": "x", "digest": "md5:1"}]`,
+		`[{"name": "a", "language": "nodejs", "version": "20", "image": "x"}, {"name": "a", "language": "nodejs", "version": "22", "image": "y"}]`,
+	} {
+		require.NoError(t, os.WriteFile(path, []byte(invalid), 0644))
+		_, err := LoadMatrix(path)
+		assert.Error(t, err, invalid)
+	}
+}
+
+func TestNode_Npmrc(t *testing.T) {
+	n := newTestNode(t, nil)
+	assert.Equal(t, "registry=https://npm.example.com/repo/\n//npm.example.com/repo/:_authToken=secret\n", n.npmrc())
+
+	n.opts.Registry = ""
+	assert.Equal(t, "//registry.npmjs.org/:_authToken=secret\n", n.npmrc())
+
+	n.opts.AuthToken = ""
+	assert.Empty(t, n.npmrc())
+}
+
+func TestNode_SetupNodeModules(t *testing.T) {
+	t.Run("no package.json", func(t *testing.T) {
+		n := newTestNode(t, map[string]string{"index.js": "exports.handler = () => 1"})
+		backend := &fakeBackend{}
+
+		dir, err := n.setupNodeModules(context.Background(), backend, "fn")
+		require.NoError(t, err)
+		assert.Empty(t, dir)
+		assert.Empty(t, backend.specs)
+	})
+
+	t.Run("installs once per manifest", func(t *testing.T) {
+		n := newTestNode(t, map[string]string{"package.json": `{"dependencies":{}}`})
+		backend := &fakeBackend{}
+
+		dir, err := n.setupNodeModules(context.Background(), backend, "fn")
+		require.NoError(t, err)
+		hash, err := manifestHash(n.cfg.CodePath)
+		require.NoError(t, err)
+		assert.Equal(t, filepath.Join(n.opts.BaseDir, "modules", hash, "node_modules"), dir)
+		assert.DirExists(t, dir)
+		require.Len(t, backend.specs, 1)
+
+		spec := backend.specs[0]
+		assert.Equal(t, "docker.io/library/node:20", spec.Image)
+		assert.Equal(t, "1000:1000", spec.User)
+		assert.Contains(t, spec.Env, "NPM_CONFIG_USERCONFIG=/kappa/npmrc")
+		assert.Contains(t, spec.Command[2], "--ignore-scripts")
+		for _, m := range spec.Mounts {
+			if m.Destination == "/src" {
+				assert.Contains(t, m.Options, "ro")
+			}
+		}
+
+		_, err = n.setupNodeModules(context.Background(), backend, "fn")
+		require.NoError(t, err)
+		assert.Len(t, backend.specs, 1, "unchanged manifest should not reinstall")
+
+		require.NoError(t, os.WriteFile(filepath.Join(n.cfg.CodePath, "package-lock.json"), []byte("{}"), 0644))
+		changed, err := n.setupNodeModules(context.Background(), backend, "fn")
+		require.NoError(t, err)
+		assert.Len(t, backend.specs, 2)
+		assert.NotEqual(t, dir, changed)
+	})
+
+	t.Run("isolated per lockfile", func(t *testing.T) {
+		a := newTestNode(t, map[string]string{"package.json": `{"dependencies":{"left-pad":"1.0.0"}}`})
+		b := newTestNode(t, map[string]string{"package.json": `{"dependencies":{"left-pad":"1.3.0"}}`})
+		c := newTestNode(t, map[string]string{"package.json": `{"dependencies":{"left-pad":"1.0.0"}}`})
+		b.opts.BaseDir = a.opts.BaseDir
+		c.opts.BaseDir = a.opts.BaseDir
+		backend := &fakeBackend{}
+
+		dirA, err := a.setupNodeModules(context.Background(), backend, "a")
+		require.NoError(t, err)
+		dirB, err := b.setupNodeModules(context.Background(), backend, "b")
+		require.NoError(t, err)
+		dirC, err := c.setupNodeModules(context.Background(), backend, "c")
+		require.NoError(t, err)
+
+		assert.NotEqual(t, dirA, dirB)
+		assert.Equal(t, dirA, dirC, "identical manifests share an install")
+		assert.Len(t, backend.specs, 2)
+	})
+
+	t.Run("failed install", func(t *testing.T) {
+		n := newTestNode(t, map[string]string{"package.json": `{}`})
+		backend := &fakeBackend{code: 1}
+
+		_, err := n.setupNodeModules(context.Background(), backend, "fn")
+		var exitErr *kappa.ExitError
+		assert.ErrorAs(t, err, &exitErr)
+
+		// Nothing is left behind so the next start tries again
+		entries, err := os.ReadDir(filepath.Join(n.opts.BaseDir, "modules"))
+		require.NoError(t, err)
+		assert.Empty(t, entries)
+	})
+}
+
+func TestNode_Prepare(t *testing.T) {
+	n := newTestNode(t, map[string]string{"package.json": `{}`})
+	n.cfg.Handler = "app.main"
+
+	launch, err := n.Prepare(context.Background(), &fakeBackend{}, "fn")
+	require.NoError(t, err)
+	defer os.RemoveAll(launch.TmpDirs[0])
+
+	assert.Equal(t, []string{"node", "/opt/kappa/runtime/node.js"}, launch.Command)
+	assert.Contains(t, launch.Env, "KAPPA_HANDLER=app.main")
+	assert.Contains(t, launch.Env, "NODE_PATH=/opt/kappa/node_modules")
+	assert.FileExists(t, filepath.Join(launch.TmpDirs[0], "node.js"))
+	for _, m := range launch.Mounts {
+		assert.Contains(t, m.Options, "ro", m.Destination)
+	}
+}
+
+func TestGo_Build(t *testing.T) {
+	codeDir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(codeDir, "go.mod"), []byte("module fn\n"), 0644))
+	require.NoError(t, os.WriteFile(filepath.Join(codeDir, "main.go"), []byte("package main\n"), 0644))
+
+	base := t.TempDir()
+	version := Version{Name: "go1.22", Language: "go", Version: "1.22", Image: "docker.io/library/golang:1.22", Digest: "sha256:abc"}
+	g := NewGo(Config{Language: "go", Version: "1.22", CodePath: codeDir}, version, GoOptions{
+		CacheDir:     filepath.Join(base, "cache"),
+		BuildDir:     filepath.Join(base, "builds"),
+		Proxy:        "https://goproxy.example.com",
+		BuildTimeout: time.Minute,
+		User:         "1000:1000",
+	})
+	backend := &fakeBackend{onRun: func(spec kappa.RunSpec) {
+		os.WriteFile(filepath.Join(mountSource(spec, "/out"), "main"), []byte("binary"), 0755)
+	}}
+
+	launch, err := g.Prepare(context.Background(), backend, "fn")
+	require.NoError(t, err)
+	require.Len(t, backend.specs, 1)
+
+	spec := backend.specs[0]
+	assert.Equal(t, "docker.io/library/golang:1.22@sha256:abc", spec.Image)
+	assert.Contains(t, spec.Env, "GOPROXY=https://goproxy.example.com")
+	assert.Equal(t, filepath.Join(base, "cache", "mod"), mountSource(spec, "/go/pkg/mod"))
+	assert.Equal(t, "1000:1000", spec.User)
+
+	assert.Equal(t, []string{"/app/main"}, launch.Command)
+	assert.FileExists(t, filepath.Join(launch.Mounts[0].Source, "main"))
+
+	// Unchanged source reuses the build, edits rebuild against the same cache
+	_, err = g.Prepare(context.Background(), backend, "fn")
+	require.NoError(t, err)
+	assert.Len(t, backend.specs, 1)
+
+	require.NoError(t, os.WriteFile(filepath.Join(codeDir, "main.go"), []byte("package main\n\nfunc main() {}\n"), 0644))
+	_, err = g.Prepare(context.Background(), backend, "fn")
+	require.NoError(t, err)
+	require.Len(t, backend.specs, 2)
+	assert.Equal(t, mountSource(spec, "/go/pkg/mod"), mountSource(backend.specs[1], "/go/pkg/mod"))
+}
@@ -0,0 +1,104 @@
+package runtimes
+
+import (
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+)
+
+//go:embed versions.json
+var defaultVersions []byte
+
+// Version is a runtime version this installation supports.
+type Version struct {
+	// Name is the friendly name, like "nodejs20" or "go1.22"
+	Name     string `json:"name"`
+	Language string `json:"language"`
+	Version  string `json:"version"`
+	// Image is the exact image the version runs in
+	Image string `json:"image"`
+	// Digest pins Image to a manifest, like "sha256:..."
+	Digest string `json:"digest,omitempty"`
+}
+
+// Ref returns the image reference, pinned to Digest when set.
+func (v Version) Ref() string {
+	if v.Digest == "" {
+		return v.Image
+	}
+	return v.Image + "@" + v.Digest
+}
+
+// Matrix is the allowlist of supported runtime versions.
+type Matrix struct {
+	versions []Version
+}
+
+// DefaultMatrix returns the versions shipped with kappa.
+func DefaultMatrix() *Matrix {
+	m, err := parseMatrix(defaultVersions)
+	if err != nil {
+		panic(fmt.Sprintf("invalid built-in runtime matrix: %v", err))
+	}
+	return m
+}
+
+// LoadMatrix reads a JSON list of versions, replacing the built-in matrix.
+func LoadMatrix(path string) (*Matrix, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read runtime matrix: %w", err)
+	}
+	return parseMatrix(data)
+}
+
+// MatrixFromEnv loads KAPPA_RUNTIME_MATRIX, or the built-in matrix when unset.
+func MatrixFromEnv() (*Matrix, error) {
+	if path := os.Getenv("KAPPA_RUNTIME_MATRIX"); path != "" {
+		return LoadMatrix(path)
+	}
+	return DefaultMatrix(), nil
+}
+
+func parseMatrix(data []byte) (*Matrix, error) {
+	var versions []Version
+	if err := json.Unmarshal(data, &versions); err != nil {
+		return nil, fmt.Errorf("failed to parse runtime matrix: %w", err)
+	}
+
+	seen := make(map[string]bool)
+	for _, v := range versions {
+		if v.Name == "" || v.Language == "" || v.Version == "" || v.Image == "" {
+			return nil, fmt.Errorf("runtime %q needs a name, language, version and image", v.Name)
+		}
+		if seen[v.Name] {
+			return nil, fmt.Errorf("duplicate runtime %q", v.Name)
+		}
+		if v.Digest != "" && !strings.HasPrefix(v.Digest, "sha256:") {
+			return nil, fmt.Errorf("runtime %q has invalid digest %q", v.Name, v.Digest)
+		}
+		seen[v.Name] = true
+	}
+	return &Matrix{versions: versions}, nil
+}
+
+// Versions lists the supported versions.
+func (m *Matrix) Versions() []Version {
+	return append([]Version(nil), m.versions...)
+}
+
+// Resolve finds the supported version cfg asks for, either by friendly name
+// in Version ("nodejs20") or by language and version ("nodejs", "20").
+func (m *Matrix) Resolve(cfg Config) (Version, error) {
+	for _, v := range m.versions {
+		if cfg.Version == v.Name && (cfg.Language == "" || cfg.Language == v.Language) {
+			return v, nil
+		}
+		if cfg.Language == v.Language && cfg.Version == v.Version {
+			return v, nil
+		}
+	}
+	return Version{}, fmt.Errorf("unsupported runtime version: %s %s", cfg.Language, cfg.Version)
+}
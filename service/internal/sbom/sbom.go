@@ -0,0 +1,199 @@
+package sbom
+
+import (
+	"bufio"
+	"bytes"
+	"debug/buildinfo"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// BOM is a minimal CycloneDX 1.5 document, enough for scanners like grype
+// and trivy to match components by purl.
+type BOM struct {
+	BOMFormat   string      `json:"bomFormat"`
+	SpecVersion string      `json:"specVersion"`
+	Version     int         `json:"version"`
+	Metadata    Metadata    `json:"metadata"`
+	Components  []Component `json:"components"`
+}
+
+// Metadata describes what the BOM is for.
+type Metadata struct {
+	Component Component `json:"component"`
+}
+
+// Component is a single dependency.
+type Component struct {
+	Type    string `json:"type"`
+	Name    string `json:"name"`
+	Version string `json:"version,omitempty"`
+	PURL    string `json:"purl,omitempty"`
+	Hash    string `json:"-"`
+}
+
+// Generate builds a BOM for a function from its binary and any dependency
+// lockfiles. Go binaries carry their module list in their build info, for
+// interpreted runtimes the resolved lockfiles are the source of truth.
+// Supported lockfiles are package-lock.json, go.mod and requirements*.txt.
+func Generate(name, binaryPath string, lockfiles []string) (*BOM, error) {
+	bom := &BOM{
+		BOMFormat:   "CycloneDX",
+		SpecVersion: "1.5",
+		Version:     1,
+		Metadata: Metadata{
+			Component: Component{Type: "application", Name: name},
+		},
+		Components: []Component{},
+	}
+
+	if binaryPath != "" {
+		// Not being a Go binary is fine, it just tells us nothing
+		if info, err := buildinfo.ReadFile(binaryPath); err == nil {
+			bom.Metadata.Component.Version = info.Main.Version
+			bom.Components = append(bom.Components, Component{
+				Type:    "platform",
+				Name:    "go",
+				Version: strings.TrimPrefix(info.GoVersion, "go"),
+				PURL:    "pkg:golang/stdlib@" + strings.TrimPrefix(info.GoVersion, "go"),
+			})
+			for _, dep := range info.Deps {
+				if dep.Replace != nil {
+					dep = dep.Replace
+				}
+				bom.Components = append(bom.Components, goComponent(dep.Path, dep.Version))
+			}
+		}
+	}
+
+	for _, path := range lockfiles {
+		components, err := parseLockfile(path)
+		if err != nil {
+			return nil, err
+		}
+		bom.Components = append(bom.Components, components...)
+	}
+
+	sort.SliceStable(bom.Components, func(i, j int) bool {
+		return bom.Components[i].PURL < bom.Components[j].PURL
+	})
+	return bom, nil
+}
+
+// parseLockfile picks a parser based on the lockfile's name.
+func parseLockfile(path string) ([]Component, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read lockfile: %w", err)
+	}
+
+	base := filepath.Base(path)
+	switch {
+	case base == "package-lock.json":
+		return parsePackageLock(data)
+	case base == "go.mod":
+		return parseGoMod(data), nil
+	case strings.HasPrefix(base, "requirements") && strings.HasSuffix(base, ".txt"):
+		return parseRequirements(data), nil
+	default:
+		return nil, fmt.Errorf("unsupported lockfile: %s", base)
+	}
+}
+
+// parsePackageLock reads npm lockfile v2/v3 "packages" entries.
+func parsePackageLock(data []byte) ([]Component, error) {
+	var lock struct {
+		Packages map[string]struct {
+			Version   string `json:"version"`
+			Integrity string `json:"integrity"`
+			Link      bool   `json:"link"`
+		} `json:"packages"`
+	}
+	if err := json.Unmarshal(data, &lock); err != nil {
+		return nil, fmt.Errorf("failed to parse package-lock.json: %w", err)
+	}
+
+	var components []Component
+	for path, pkg := range lock.Packages {
+		// The root project has an empty path
+		idx := strings.LastIndex(path, "node_modules/")
+		if idx < 0 || pkg.Link {
+			continue
+		}
+		name := path[idx+len("node_modules/"):]
+		components = append(components, Component{
+			Type:    "library",
+			Name:    name,
+			Version: pkg.Version,
+			PURL:    fmt.Sprintf("pkg:npm/%s@%s", url.PathEscape(name), pkg.Version),
+			Hash:    pkg.Integrity,
+		})
+	}
+	return components, nil
+}
+
+// parseGoMod reads the require directives of a go.mod.
+func parseGoMod(data []byte) []Component {
+	var components []Component
+	inBlock := false
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		line, _, _ = strings.Cut(line, "//")
+		fields := strings.Fields(line)
+
+		switch {
+		case len(fields) == 0:
+			continue
+		case fields[0] == "require" && len(fields) > 1 && fields[1] == "(":
+			inBlock = true
+			continue
+		case inBlock && fields[0] == ")":
+			inBlock = false
+			continue
+		case fields[0] == "require" && len(fields) == 3:
+			components = append(components, goComponent(fields[1], fields[2]))
+		case inBlock && len(fields) == 2:
+			components = append(components, goComponent(fields[0], fields[1]))
+		}
+	}
+	return components
+}
+
+// parseRequirements reads pinned "name==version" lines of a pip requirements file.
+func parseRequirements(data []byte) []Component {
+	var components []Component
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		line, _, _ = strings.Cut(line, "#")
+		line, _, _ = strings.Cut(line, ";")
+		name, version, ok := strings.Cut(strings.TrimSpace(line), "==")
+		if !ok {
+			continue
+		}
+		name = strings.ToLower(strings.TrimSpace(name))
+		version = strings.TrimSpace(strings.Fields(version + " ")[0])
+		components = append(components, Component{
+			Type:    "library",
+			Name:    name,
+			Version: version,
+			PURL:    fmt.Sprintf("pkg:pypi/%s@%s", name, version),
+		})
+	}
+	return components
+}
+
+func goComponent(path, version string) Component {
+	return Component{
+		Type:    "library",
+		Name:    path,
+		Version: version,
+		PURL:    fmt.Sprintf("pkg:golang/%s@%s", path, version),
+	}
+}
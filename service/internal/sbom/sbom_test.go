@@ -0,0 +1,78 @@
+package sbom
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func writeFile(t *testing.T, dir, name, content string) string {
+	t.Helper()
+	path := filepath.Join(dir, name)
+	require.NoError(t, os.WriteFile(path, []byte(content), 0644))
+	return path
+}
+
+func TestGenerate_GoBinary(t *testing.T) {
+	// The test binary itself is a Go binary with dependencies
+	exe, err := os.Executable()
+	require.NoError(t, err)
+
+	bom, err := Generate("self", exe, nil)
+	require.NoError(t, err)
+
+	assert.Equal(t, "CycloneDX", bom.BOMFormat)
+	assert.Equal(t, "self", bom.Metadata.Component.Name)
+
+	names := make([]string, 0, len(bom.Components))
+	for _, c := range bom.Components {
+		names = append(names, c.Name)
+	}
+	assert.Contains(t, names, "go")
+	assert.Contains(t, names, "github.com/stretchr/testify")
+}
+
+func TestGenerate_Lockfiles(t *testing.T) {
+	dir := t.TempDir()
+	packageLock := writeFile(t, dir, "package-lock.json", `{
+		"lockfileVersion": 3,
+		"packages": {
+			"": {"name": "fn"},
+			"node_modules/left-pad": {"version": "1.3.0", "integrity": "sha512-abc"},
+			"node_modules/@scope/pkg": {"version": "2.0.0"},
+			"node_modules/local": {"link": true}
+		}
+	}`)
+	goMod := writeFile(t, dir, "go.mod", `module fn
+
+go 1.24
+
+require github.com/google/uuid v1.6.0
+
+require (
+	github.com/gorilla/mux v1.8.1 // indirect
+)
+`)
+	requirements := writeFile(t, dir, "requirements.txt", "# pinned\nRequests==2.31.0 ; python_version > '3'\nflask>=2\n")
+
+	bom, err := Generate("fn", "", []string{packageLock, goMod, requirements})
+	require.NoError(t, err)
+
+	purls := make([]string, 0, len(bom.Components))
+	for _, c := range bom.Components {
+		purls = append(purls, c.PURL)
+	}
+	assert.ElementsMatch(t, []string{
+		"pkg:npm/left-pad@1.3.0",
+		"pkg:npm/@scope%2Fpkg@2.0.0",
+		"pkg:golang/github.com/google/uuid@v1.6.0",
+		"pkg:golang/github.com/gorilla/mux@v1.8.1",
+		"pkg:pypi/requests@2.31.0",
+	}, purls)
+
+	_, err = Generate("fn", "", []string{writeFile(t, dir, "Gemfile.lock", "")})
+	assert.ErrorContains(t, err, "unsupported lockfile")
+}
@@ -0,0 +1,248 @@
+// Package scheduler invokes functions on cron schedules.
+package scheduler
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"kappa-v2/pkg/logger"
+	"math/rand/v2"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// ErrNotFound is returned for a schedule id that isn't registered.
+var ErrNotFound = errors.New("schedule not found")
+
+// Schedule invokes a function whenever its cron expression fires.
+type Schedule struct {
+	ID       string `json:"id"`
+	Function string `json:"function"`
+	Cron     string `json:"cron"`
+	// Timezone is the IANA name the cron is evaluated in, defaulting to
+	// the service's timezone
+	Timezone string `json:"timezone,omitempty"`
+	// JitterMs delays each run by a random amount up to this, so schedules
+	// sharing a fire time don't all cold start at once
+	JitterMs int `json:"jitterMs,omitempty"`
+	// Event is the body of the event the function is invoked with
+	Event map[string]any `json:"event,omitempty"`
+	// Paused schedules are kept but don't fire
+	Paused bool `json:"paused,omitempty"`
+}
+
+// Validate checks the schedule has everything it needs and a valid cron.
+func (s Schedule) Validate() error {
+	if s.ID == "" {
+		return fmt.Errorf("missing id")
+	}
+	if s.Function == "" {
+		return fmt.Errorf("missing function")
+	}
+	if s.JitterMs < 0 {
+		return fmt.Errorf("jitterMs must not be negative")
+	}
+	if _, err := loadLocation(s.Timezone); err != nil {
+		return err
+	}
+	_, err := ParseCron(s.Cron)
+	return err
+}
+
+// loadLocation loads an IANA timezone, nil for an empty name.
+func loadLocation(name string) (*time.Location, error) {
+	if name == "" {
+		return nil, nil
+	}
+	loc, err := time.LoadLocation(name)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load timezone %q: %w", name, err)
+	}
+	return loc, nil
+}
+
+// InvokeFunc invokes the named function for a schedule.
+type InvokeFunc func(ctx context.Context, schedule Schedule) error
+
+// entry is a registered schedule and the goroutine running it.
+type entry struct {
+	schedule Schedule
+	cron     *Cron
+	location *time.Location
+	stop     chan struct{}
+}
+
+// Scheduler runs schedules, each in a goroutine that sleeps until its next
+// fire time.
+type Scheduler struct {
+	location *time.Location
+	invoke   InvokeFunc
+	entries  map[string]*entry
+	mu       sync.Mutex
+	ctx      context.Context
+	cancel   context.CancelFunc
+	wg       sync.WaitGroup
+	// now, after and jitter are swapped out by tests
+	now    func() time.Time
+	after  func(time.Duration) <-chan time.Time
+	jitter func(max time.Duration) time.Duration
+}
+
+// New creates a scheduler evaluating schedules without a timezone of their
+// own in location.
+func New(location *time.Location, invoke InvokeFunc) *Scheduler {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &Scheduler{
+		location: location,
+		invoke:   invoke,
+		entries:  make(map[string]*entry),
+		ctx:      ctx,
+		cancel:   cancel,
+		now:      time.Now,
+		after:    time.After,
+		jitter:   randomJitter,
+	}
+}
+
+// LocationFromEnv loads the service timezone from KAPPA_TIMEZONE, an IANA
+// name like Europe/London, defaulting to UTC.
+func LocationFromEnv() (*time.Location, error) {
+	loc, err := loadLocation(os.Getenv("KAPPA_TIMEZONE"))
+	if loc == nil && err == nil {
+		loc = time.UTC
+	}
+	return loc, err
+}
+
+// randomJitter picks a delay in [0, max).
+func randomJitter(max time.Duration) time.Duration {
+	if max <= 0 {
+		return 0
+	}
+	return rand.N(max)
+}
+
+// Location returns the timezone schedules without one are evaluated in.
+func (s *Scheduler) Location() *time.Location {
+	return s.location
+}
+
+// Put adds a schedule or replaces the one with the same id.
+func (s *Scheduler) Put(schedule Schedule) error {
+	if err := schedule.Validate(); err != nil {
+		return err
+	}
+	cron, _ := ParseCron(schedule.Cron)
+	location, _ := loadLocation(schedule.Timezone)
+	if location == nil {
+		location = s.location
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if old, exists := s.entries[schedule.ID]; exists {
+		close(old.stop)
+	}
+	e := &entry{schedule: schedule, cron: cron, location: location, stop: make(chan struct{})}
+	s.entries[schedule.ID] = e
+	if !schedule.Paused {
+		s.wg.Add(1)
+		go s.run(e)
+	}
+	return nil
+}
+
+// Remove deletes a schedule, stopping it from firing again.
+func (s *Scheduler) Remove(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	e, exists := s.entries[id]
+	if !exists {
+		return ErrNotFound
+	}
+	close(e.stop)
+	delete(s.entries, id)
+	return nil
+}
+
+// Get returns the schedule with the given id.
+func (s *Scheduler) Get(id string) (Schedule, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	e, exists := s.entries[id]
+	if !exists {
+		return Schedule{}, ErrNotFound
+	}
+	return e.schedule, nil
+}
+
+// List returns every schedule ordered by id.
+func (s *Scheduler) List() []Schedule {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	schedules := make([]Schedule, 0, len(s.entries))
+	for _, e := range s.entries {
+		schedules = append(schedules, e.schedule)
+	}
+	sort.Slice(schedules, func(i, j int) bool { return schedules[i].ID < schedules[j].ID })
+	return schedules
+}
+
+// Next returns the next count fire times of a schedule in its timezone,
+// before any jitter. Paused schedules are previewed as if they were running.
+func (s *Scheduler) Next(id string, count int) ([]time.Time, error) {
+	s.mu.Lock()
+	e, exists := s.entries[id]
+	s.mu.Unlock()
+	if !exists {
+		return nil, ErrNotFound
+	}
+	return e.cron.NextN(s.now().In(e.location), count), nil
+}
+
+// Stop stops every schedule and waits for invocations in flight.
+func (s *Scheduler) Stop() {
+	s.cancel()
+	s.wg.Wait()
+}
+
+// run fires a schedule until it is removed, replaced or the scheduler stops.
+// Invocations of one schedule don't overlap, fire times that pass while an
+// invocation is running are skipped.
+func (s *Scheduler) run(e *entry) {
+	defer s.wg.Done()
+	l := logger.Get()
+
+	for {
+		next := e.cron.Next(s.now().In(e.location))
+		if next.IsZero() {
+			l.Warn("Schedule will never fire", zap.String("id", e.schedule.ID), zap.String("cron", e.cron.String()))
+			return
+		}
+		delay := s.jitter(time.Duration(e.schedule.JitterMs) * time.Millisecond)
+
+		select {
+		case <-s.ctx.Done():
+			return
+		case <-e.stop:
+			return
+		case <-s.after(next.Add(delay).Sub(s.now())):
+		}
+
+		l.Info("Schedule fired",
+			zap.String("id", e.schedule.ID),
+			zap.String("function", e.schedule.Function),
+			zap.Time("scheduledFor", next),
+			zap.Duration("jitter", delay))
+		if err := s.invoke(s.ctx, e.schedule); err != nil {
+			l.Warn("Scheduled invocation failed",
+				zap.String("id", e.schedule.ID),
+				zap.String("function", e.schedule.Function),
+				zap.Error(err))
+		}
+	}
+}
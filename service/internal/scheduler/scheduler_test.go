@@ -0,0 +1,157 @@
+package scheduler
+
+import (
+	"context"
+	"kappa-v2/pkg/logger"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMain(m *testing.M) {
+	code := m.Run()
+	logger.ResetForTest()
+	os.Exit(code)
+}
+
+func mustParse(t *testing.T, expr string) *Cron {
+	t.Helper()
+	c, err := ParseCron(expr)
+	require.NoError(t, err)
+	return c
+}
+
+func TestParseCron_Invalid(t *testing.T) {
+	for _, expr := range []string{
+		"",
+		"* * * *",
+		"* * * * * *",
+		"60 * * * *",
+		"* 24 * * *",
+		"* * 0 * *",
+		"* * * 13 *",
+		"* * * * 8",
+		"5-1 * * * *",
+		"*/0 * * * *",
+		"a * * * *",
+		"* * * foo *",
+		"@fortnightly",
+	} {
+		_, err := ParseCron(expr)
+		assert.Error(t, err, expr)
+	}
+}
+
+func TestCron_Next(t *testing.T) {
+	from := time.Date(2024, 1, 15, 10, 7, 30, 0, time.UTC) // a Monday
+	tests := []struct {
+		expr string
+		want time.Time
+	}{
+		{"* * * * *", time.Date(2024, 1, 15, 10, 8, 0, 0, time.UTC)},
+		{"*/15 * * * *", time.Date(2024, 1, 15, 10, 15, 0, 0, time.UTC)},
+		{"5/20 * * * *", time.Date(2024, 1, 15, 10, 25, 0, 0, time.UTC)},
+		{"0 9-17 * * MON-FRI", time.Date(2024, 1, 15, 11, 0, 0, 0, time.UTC)},
+		{"30 2 * * *", time.Date(2024, 1, 16, 2, 30, 0, 0, time.UTC)},
+		{"0 0 1 * *", time.Date(2024, 2, 1, 0, 0, 0, 0, time.UTC)},
+		{"0 0 29 2 *", time.Date(2024, 2, 29, 0, 0, 0, 0, time.UTC)},
+		{"0 0 * * 7", time.Date(2024, 1, 21, 0, 0, 0, 0, time.UTC)},
+		{"@hourly", time.Date(2024, 1, 15, 11, 0, 0, 0, time.UTC)},
+		{"@yearly", time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)},
+		// Both day fields restricted match either, the 20th or a Wednesday
+		{"0 0 20 * WED", time.Date(2024, 1, 17, 0, 0, 0, 0, time.UTC)},
+	}
+	for _, tt := range tests {
+		assert.Equal(t, tt.want, mustParse(t, tt.expr).Next(from), tt.expr)
+	}
+
+	assert.True(t, mustParse(t, "0 0 30 2 *").Next(from).IsZero(), "February 30th never comes")
+}
+
+func TestCron_Next_DaylightSaving(t *testing.T) {
+	london, err := time.LoadLocation("Europe/London")
+	require.NoError(t, err)
+
+	// Clocks go forward at 01:00 on 2024-03-31, so 01:30 doesn't exist that day
+	c := mustParse(t, "30 1 * * *")
+	next := c.Next(time.Date(2024, 3, 30, 12, 0, 0, 0, london))
+	assert.Equal(t, time.Date(2024, 4, 1, 1, 30, 0, 0, london), next)
+
+	// Clocks go back at 02:00 on 2024-10-27, 01:30 fires once
+	times := c.NextN(time.Date(2024, 10, 26, 12, 0, 0, 0, london), 3)
+	require.Len(t, times, 3)
+	assert.Equal(t, 24*time.Hour+time.Hour, times[1].Sub(times[0]))
+	assert.Equal(t, 24*time.Hour, times[2].Sub(times[1]))
+}
+
+func TestScheduler_Next(t *testing.T) {
+	tokyo, err := time.LoadLocation("Asia/Tokyo")
+	require.NoError(t, err)
+
+	s := New(tokyo, func(ctx context.Context, schedule Schedule) error { return nil })
+	defer s.Stop()
+	s.now = func() time.Time { return time.Date(2024, 1, 15, 0, 0, 0, 0, time.UTC) }
+
+	require.NoError(t, s.Put(Schedule{ID: "daily", Function: "report", Cron: "0 9 * * *", Paused: true}))
+	times, err := s.Next("daily", 2)
+	require.NoError(t, err)
+	assert.Equal(t, []time.Time{
+		time.Date(2024, 1, 16, 9, 0, 0, 0, tokyo),
+		time.Date(2024, 1, 17, 9, 0, 0, 0, tokyo),
+	}, times)
+	assert.Equal(t, tokyo, times[0].Location())
+
+	// A schedule's own timezone wins over the service's
+	require.NoError(t, s.Put(Schedule{ID: "ny", Function: "report", Cron: "0 9 * * *", Timezone: "America/New_York", Paused: true}))
+	times, err = s.Next("ny", 1)
+	require.NoError(t, err)
+	newYork, err := time.LoadLocation("America/New_York")
+	require.NoError(t, err)
+	assert.Equal(t, []time.Time{time.Date(2024, 1, 15, 9, 0, 0, 0, newYork)}, times)
+	assert.Error(t, s.Put(Schedule{ID: "bad", Function: "report", Cron: "0 9 * * *", Timezone: "Mars/Olympus"}))
+	assert.Error(t, s.Put(Schedule{ID: "bad", Function: "report", Cron: "0 9 * * *", JitterMs: -1}))
+
+	_, err = s.Next("missing", 1)
+	assert.ErrorIs(t, err, ErrNotFound)
+	assert.Error(t, s.Put(Schedule{ID: "bad", Function: "report", Cron: "0 25 * * *"}))
+}
+
+func TestScheduler_Fires(t *testing.T) {
+	fired := make(chan Schedule)
+	s := New(time.UTC, func(ctx context.Context, schedule Schedule) error {
+		fired <- schedule
+		return nil
+	})
+
+	now := time.Date(2024, 1, 15, 10, 7, 30, 0, time.UTC)
+	s.now = func() time.Time { return now }
+	s.jitter = func(max time.Duration) time.Duration {
+		assert.Equal(t, 10*time.Second, max)
+		return max / 2
+	}
+
+	// Hand out the timer so the test decides when the minute is up
+	waits := make(chan time.Duration, 1)
+	timer := make(chan time.Time)
+	s.after = func(d time.Duration) <-chan time.Time {
+		waits <- d
+		return timer
+	}
+
+	require.NoError(t, s.Put(Schedule{ID: "tick", Function: "fn", Cron: "* * * * *", JitterMs: 10000, Event: map[string]any{"n": 1}}))
+	assert.Equal(t, 30*time.Second+5*time.Second, <-waits, "waits for the minute plus jitter")
+	timer <- time.Now()
+	schedule := <-fired
+	assert.Equal(t, "fn", schedule.Function)
+	assert.Equal(t, map[string]any{"n": 1}, schedule.Event)
+
+	// Waiting for the next run again
+	<-waits
+	require.NoError(t, s.Remove("tick"))
+	assert.ErrorIs(t, s.Remove("tick"), ErrNotFound)
+	assert.Empty(t, s.List())
+	s.Stop()
+}
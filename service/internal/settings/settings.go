@@ -0,0 +1,281 @@
+// Package settings resolves a function's settings through the defaults
+// hierarchy: built in, then service wide, then the function's project, the
+// function itself and finally the environment it is deployed to, recording
+// where each value came from.
+package settings
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"slices"
+	"sort"
+	"strings"
+)
+
+// Where a setting's value came from, from lowest to highest precedence
+const (
+	SourceBuiltin  = "builtin"
+	SourceService  = "service"
+	SourceProject  = "project"
+	SourceFunction = "function"
+	// SourceEnvironment overrides the function with the environment it is
+	// deployed to
+	SourceEnvironment = "environment"
+)
+
+// Settings are the defaults one level of the hierarchy sets. Unset fields
+// inherit from the level below, env entries and response headers are
+// merged by key.
+type Settings struct {
+	TimeoutMs     *int `json:"timeoutMs,omitempty"`
+	MemoryMB      *int `json:"memoryMb,omitempty"`
+	IdleTimeoutMs *int `json:"idleTimeoutMs,omitempty"`
+	// LogRetention is how many log lines are kept per function
+	LogRetention *int `json:"logRetention,omitempty"`
+	// ResultTTLMs is how long results of invocations nobody waits on are
+	// kept
+	ResultTTLMs *int     `json:"resultTtlMs,omitempty"`
+	Env         []string `json:"env,omitempty"`
+	// SecretEnv are the keys of env entries holding secrets, whose values
+	// the API shows Masked. A key marked at one level is masked at the
+	// levels above.
+	SecretEnv []string `json:"secretEnv,omitempty"`
+	// ResponseHeaders are set on every response of the function's HTTP
+	// routes, over the function's own. An empty value removes a header a
+	// level below sets.
+	ResponseHeaders map[string]string `json:"responseHeaders,omitempty"`
+}
+
+// Masked stands in for the values of secret env entries
+const Masked = "********"
+
+// reservedHeaders are managed by the service and HTTP itself, they can't
+// be set as response headers
+var reservedHeaders = []string{
+	"Connection", "Content-Length", "Content-Encoding", "Keep-Alive", "Trailer",
+	"Transfer-Encoding", "Upgrade", "X-Request-Id",
+}
+
+// Builtin returns the defaults used when nothing else sets a value. A
+// MemoryMB of 0 leaves the limit to the backend.
+func Builtin() Settings {
+	timeout, memory, idle, retention, resultTTL := 30000, 0, 300000, 1000, 86400000
+	return Settings{
+		TimeoutMs:     &timeout,
+		MemoryMB:      &memory,
+		IdleTimeoutMs: &idle,
+		LogRetention:  &retention,
+		ResultTTLMs:   &resultTTL,
+	}
+}
+
+// LoadFile reads settings from a JSON file.
+func LoadFile(path string) (Settings, error) {
+	var s Settings
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return s, fmt.Errorf("failed to read settings: %w", err)
+	}
+	if err := json.Unmarshal(data, &s); err != nil {
+		return s, fmt.Errorf("failed to parse settings: %w", err)
+	}
+	return s, s.Validate()
+}
+
+// Validate checks the values are usable.
+func (s Settings) Validate() error {
+	for name, v := range map[string]*int{
+		"timeoutMs":     s.TimeoutMs,
+		"memoryMb":      s.MemoryMB,
+		"idleTimeoutMs": s.IdleTimeoutMs,
+		"logRetention":  s.LogRetention,
+		"resultTtlMs":   s.ResultTTLMs,
+	} {
+		if v != nil && *v < 0 {
+			return fmt.Errorf("%s must not be negative", name)
+		}
+	}
+	if s.TimeoutMs != nil && *s.TimeoutMs == 0 {
+		return fmt.Errorf("timeoutMs must be positive")
+	}
+	if s.ResultTTLMs != nil && *s.ResultTTLMs == 0 {
+		return fmt.Errorf("resultTtlMs must be positive")
+	}
+	for _, kv := range s.Env {
+		if key, _, ok := strings.Cut(kv, "="); !ok || key == "" {
+			return fmt.Errorf("invalid env entry %q, expected KEY=VALUE", kv)
+		}
+	}
+	for _, key := range s.SecretEnv {
+		if key == "" || strings.Contains(key, "=") {
+			return fmt.Errorf("invalid secret env key %q", key)
+		}
+	}
+	for name, value := range s.ResponseHeaders {
+		if !validHeaderName(name) {
+			return fmt.Errorf("invalid response header name %q", name)
+		}
+		if slices.Contains(reservedHeaders, http.CanonicalHeaderKey(name)) {
+			return fmt.Errorf("response header %s is set by the service", name)
+		}
+		if strings.ContainsAny(value, "\r\n") {
+			return fmt.Errorf("invalid value of response header %s", name)
+		}
+	}
+	return nil
+}
+
+// validHeaderName reports whether name is an HTTP token.
+func validHeaderName(name string) bool {
+	if name == "" {
+		return false
+	}
+	for _, c := range name {
+		if c > '~' || c <= ' ' || strings.ContainsRune(`"(),/:;<=>?@[\]{}`, c) {
+			return false
+		}
+	}
+	return true
+}
+
+// Value is an effective setting and the level it came from.
+type Value[T any] struct {
+	Value  T      `json:"value"`
+	Source string `json:"source"`
+}
+
+// Effective is the result of resolving the hierarchy for one function.
+type Effective struct {
+	TimeoutMs     Value[int]               `json:"timeoutMs"`
+	MemoryMB      Value[int]               `json:"memoryMb"`
+	IdleTimeoutMs Value[int]               `json:"idleTimeoutMs"`
+	LogRetention  Value[int]               `json:"logRetention"`
+	ResultTTLMs   Value[int]               `json:"resultTtlMs"`
+	Env           map[string]Value[string] `json:"env"`
+	// SecretEnv are the keys marked secret at any level, sorted
+	SecretEnv []string `json:"secretEnv,omitempty"`
+	// ResponseHeaders are keyed by their canonical name
+	ResponseHeaders map[string]Value[string] `json:"responseHeaders,omitempty"`
+}
+
+// Layer is one level of the hierarchy.
+type Layer struct {
+	Source   string
+	Settings Settings
+}
+
+// Resolve applies the layers in order on top of the built in defaults, each
+// overriding the values it sets.
+func Resolve(layers ...Layer) Effective {
+	e := Effective{Env: make(map[string]Value[string]), ResponseHeaders: make(map[string]Value[string])}
+	for _, layer := range append([]Layer{{Source: SourceBuiltin, Settings: Builtin()}}, layers...) {
+		s := layer.Settings
+		setInt(&e.TimeoutMs, s.TimeoutMs, layer.Source)
+		setInt(&e.MemoryMB, s.MemoryMB, layer.Source)
+		setInt(&e.IdleTimeoutMs, s.IdleTimeoutMs, layer.Source)
+		setInt(&e.LogRetention, s.LogRetention, layer.Source)
+		setInt(&e.ResultTTLMs, s.ResultTTLMs, layer.Source)
+		for _, kv := range s.Env {
+			key, value, _ := strings.Cut(kv, "=")
+			e.Env[key] = Value[string]{Value: value, Source: layer.Source}
+		}
+		for _, key := range s.SecretEnv {
+			if !slices.Contains(e.SecretEnv, key) {
+				e.SecretEnv = append(e.SecretEnv, key)
+			}
+		}
+		for name, value := range s.ResponseHeaders {
+			name = http.CanonicalHeaderKey(name)
+			if value == "" {
+				delete(e.ResponseHeaders, name)
+				continue
+			}
+			e.ResponseHeaders[name] = Value[string]{Value: value, Source: layer.Source}
+		}
+	}
+	sort.Strings(e.SecretEnv)
+	return e
+}
+
+// Masked returns the settings with the values of the env entries keyed in
+// secret replaced by Masked.
+func (s Settings) Masked(secret []string) Settings {
+	if len(secret) == 0 || len(s.Env) == 0 {
+		return s
+	}
+	env := make([]string, len(s.Env))
+	for i, kv := range s.Env {
+		env[i] = kv
+		if key, _, _ := strings.Cut(kv, "="); slices.Contains(secret, key) {
+			env[i] = key + "=" + Masked
+		}
+	}
+	s.Env = env
+	return s
+}
+
+// Unmasked returns the settings with env entries still Masked, as read
+// back from the API, given the values they have in previous, so configs
+// fetched and sent back don't overwrite secrets. Entries previous doesn't
+// have are left as they are.
+func (s Settings) Unmasked(previous Settings) Settings {
+	if !slices.ContainsFunc(s.Env, func(kv string) bool { return strings.HasSuffix(kv, "="+Masked) }) {
+		return s
+	}
+	values := make(map[string]string, len(previous.Env))
+	for _, kv := range previous.Env {
+		key, value, _ := strings.Cut(kv, "=")
+		values[key] = value
+	}
+	env := make([]string, len(s.Env))
+	for i, kv := range s.Env {
+		env[i] = kv
+		if key, value, _ := strings.Cut(kv, "="); value == Masked {
+			if v, ok := values[key]; ok {
+				env[i] = key + "=" + v
+			}
+		}
+	}
+	s.Env = env
+	return s
+}
+
+// Masked returns the effective settings with the values of secret env
+// entries replaced by Masked.
+func (e Effective) Masked() Effective {
+	if len(e.SecretEnv) == 0 {
+		return e
+	}
+	env := make(map[string]Value[string], len(e.Env))
+	for key, v := range e.Env {
+		if slices.Contains(e.SecretEnv, key) {
+			v.Value = Masked
+		}
+		env[key] = v
+	}
+	e.Env = env
+	return e
+}
+
+func setInt(dst *Value[int], v *int, source string) {
+	if v != nil {
+		*dst = Value[int]{Value: *v, Source: source}
+	}
+}
+
+// EnvList returns the effective env as KEY=VALUE entries sorted by key.
+func (e Effective) EnvList() []string {
+	keys := make([]string, 0, len(e.Env))
+	for key := range e.Env {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	env := make([]string, len(keys))
+	for i, key := range keys {
+		env[i] = key + "=" + e.Env[key].Value
+	}
+	return env
+}
@@ -0,0 +1,109 @@
+package settings
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func intPtr(v int) *int {
+	return &v
+}
+
+func TestResolve(t *testing.T) {
+	e := Resolve(
+		Layer{Source: SourceService, Settings: Settings{
+			TimeoutMs: intPtr(10000),
+			Env:       []string{"LOG_LEVEL=info", "REGION=eu"},
+		}},
+		Layer{Source: SourceProject, Settings: Settings{
+			MemoryMB: intPtr(256),
+			Env:      []string{"LOG_LEVEL=debug"},
+		}},
+		Layer{Source: SourceFunction, Settings: Settings{
+			TimeoutMs: intPtr(5000),
+			Env:       []string{"NAME=fn", "EMPTY="},
+		}},
+	)
+
+	assert.Equal(t, Value[int]{Value: 5000, Source: SourceFunction}, e.TimeoutMs)
+	assert.Equal(t, Value[int]{Value: 256, Source: SourceProject}, e.MemoryMB)
+	assert.Equal(t, Value[int]{Value: 300000, Source: SourceBuiltin}, e.IdleTimeoutMs)
+	assert.Equal(t, Value[int]{Value: 1000, Source: SourceBuiltin}, e.LogRetention)
+	assert.Equal(t, Value[int]{Value: 86400000, Source: SourceBuiltin}, e.ResultTTLMs)
+	assert.Equal(t, Value[string]{Value: "debug", Source: SourceProject}, e.Env["LOG_LEVEL"])
+	assert.Equal(t, Value[string]{Value: "eu", Source: SourceService}, e.Env["REGION"])
+	assert.Equal(t, []string{"EMPTY=", "LOG_LEVEL=debug", "NAME=fn", "REGION=eu"}, e.EnvList())
+}
+
+func TestLoadFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "defaults.json")
+	require.NoError(t, os.WriteFile(path, []byte(`{"timeoutMs": 15000, "env": ["A=1"]}`), 0644))
+
+	s, err := LoadFile(path)
+	require.NoError(t, err)
+	assert.Equal(t, 15000, *s.TimeoutMs)
+	assert.Nil(t, s.MemoryMB)
+
+	require.NoError(t, os.WriteFile(path, []byte(`{"timeoutMs": -1}`), 0644))
+	_, err = LoadFile(path)
+	assert.Error(t, err)
+
+	require.NoError(t, os.WriteFile(path, []byte(`{"env": ["NOVALUE"]}`), 0644))
+	_, err = LoadFile(path)
+	assert.Error(t, err)
+}
+
+func TestResolve_ResponseHeaders(t *testing.T) {
+	e := Resolve(
+		Layer{Source: SourceService, Settings: Settings{ResponseHeaders: map[string]string{
+			"strict-transport-security": "max-age=31536000",
+			"Server":                    "kappa",
+		}}},
+		Layer{Source: SourceFunction, Settings: Settings{ResponseHeaders: map[string]string{
+			"Cache-Control": "no-store",
+			"server":        "",
+		}}},
+	)
+	assert.Equal(t, map[string]Value[string]{
+		"Strict-Transport-Security": {Value: "max-age=31536000", Source: SourceService},
+		"Cache-Control":             {Value: "no-store", Source: SourceFunction},
+	}, e.ResponseHeaders, "an empty value removes a header set below")
+}
+
+func TestValidate_ResponseHeaders(t *testing.T) {
+	assert.NoError(t, Settings{ResponseHeaders: map[string]string{"X-Frame-Options": "DENY"}}.Validate())
+	assert.ErrorContains(t, Settings{ResponseHeaders: map[string]string{"Bad Header": "x"}}.Validate(), "invalid response header name")
+	assert.ErrorContains(t, Settings{ResponseHeaders: map[string]string{"content-length": "1"}}.Validate(), "set by the service")
+	assert.ErrorContains(t, Settings{ResponseHeaders: map[string]string{"X-Split": "a\r\nSet-Cookie: b"}}.Validate(), "invalid value")
+}
+
+func TestMasked(t *testing.T) {
+	project := Settings{Env: []string{"DB_PASSWORD=hunter2", "REGION=eu"}, SecretEnv: []string{"DB_PASSWORD"}}
+	function := Settings{Env: []string{"API_KEY=abc", "DB_PASSWORD=s3cret"}, SecretEnv: []string{"API_KEY"}}
+	e := Resolve(
+		Layer{Source: SourceProject, Settings: project},
+		Layer{Source: SourceFunction, Settings: function},
+	)
+	assert.Equal(t, []string{"API_KEY", "DB_PASSWORD"}, e.SecretEnv)
+
+	masked := e.Masked()
+	assert.Equal(t, map[string]Value[string]{
+		"API_KEY":     {Value: Masked, Source: SourceFunction},
+		"DB_PASSWORD": {Value: Masked, Source: SourceFunction},
+		"REGION":      {Value: "eu", Source: SourceProject},
+	}, masked.Env, "keys marked at a level below are masked above")
+	assert.Equal(t, "s3cret", e.Env["DB_PASSWORD"].Value, "masking doesn't change what runs")
+
+	assert.Equal(t, []string{"API_KEY=" + Masked, "DB_PASSWORD=" + Masked}, function.Masked(e.SecretEnv).Env)
+	assert.Equal(t, []string{"API_KEY=abc", "DB_PASSWORD=s3cret"}, function.Env)
+
+	assert.ErrorContains(t, Settings{SecretEnv: []string{"A=B"}}.Validate(), "invalid secret env key")
+
+	// Sent back masked, secrets keep their values
+	sentBack := Settings{Env: []string{"API_KEY=" + Masked, "DB_PASSWORD=rotated", "NEW=" + Masked}}
+	assert.Equal(t, []string{"API_KEY=abc", "DB_PASSWORD=rotated", "NEW=" + Masked}, sentBack.Unmasked(function).Env)
+}
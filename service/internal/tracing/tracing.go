@@ -0,0 +1,179 @@
+// Package tracing carries W3C trace context through invocations and decides,
+// at the head of each trace, whether it is sampled, so tracing costs stay in
+// hand at high invocation volumes.
+package tracing
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// Header is the W3C trace context header
+const Header = "Traceparent"
+
+// flagSampled is the trace flag of sampled traces
+const flagSampled = 0x01
+
+// TraceContext identifies a trace and the span a request was made from.
+type TraceContext struct {
+	TraceID [16]byte
+	SpanID  [8]byte
+	Flags   byte
+}
+
+// Parse reads a traceparent header, reporting whether it was valid.
+func Parse(header string) (TraceContext, bool) {
+	var tc TraceContext
+	parts := strings.Split(strings.TrimSpace(header), "-")
+	// Later versions may add fields after the flags
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" || (parts[0] == "00" && len(parts) != 4) {
+		return tc, false
+	}
+	if _, err := hex.DecodeString(parts[0]); err != nil {
+		return tc, false
+	}
+	var flags [1]byte
+	for _, field := range []struct {
+		s   string
+		dst []byte
+	}{{parts[1], tc.TraceID[:]}, {parts[2], tc.SpanID[:]}, {parts[3], flags[:]}} {
+		if len(field.s) != 2*len(field.dst) || strings.ToLower(field.s) != field.s {
+			return tc, false
+		}
+		if _, err := hex.Decode(field.dst, []byte(field.s)); err != nil {
+			return tc, false
+		}
+	}
+	if tc.TraceID == [16]byte{} || tc.SpanID == [8]byte{} {
+		return tc, false
+	}
+	tc.Flags = flags[0]
+	return tc, true
+}
+
+// New starts a trace.
+func New() TraceContext {
+	var tc TraceContext
+	rand.Read(tc.TraceID[:])
+	rand.Read(tc.SpanID[:])
+	return tc
+}
+
+// Child is the context of a span made under tc, sampled or not.
+func (tc TraceContext) Child(sampled bool) TraceContext {
+	child := TraceContext{TraceID: tc.TraceID}
+	rand.Read(child.SpanID[:])
+	if sampled {
+		child.Flags = flagSampled
+	}
+	return child
+}
+
+// Sampled reports whether the trace is sampled.
+func (tc TraceContext) Sampled() bool {
+	return tc.Flags&flagSampled != 0
+}
+
+func (tc TraceContext) String() string {
+	return fmt.Sprintf("00-%x-%x-%02x", tc.TraceID, tc.SpanID, tc.Flags)
+}
+
+// Policy decides which traces of a function are sampled. Unset, the
+// service's rate applies.
+type Policy struct {
+	// Rate is the share of traces sampled, from 0 to 1
+	Rate *float64 `json:"rate,omitempty"`
+	// Rules set the rate of the requests they match, the first one
+	// matching deciding
+	Rules []Rule `json:"rules,omitempty"`
+	// IgnoreParent has the policy decide for requests arriving with a
+	// trace as well, rather than following the caller's decision
+	IgnoreParent bool `json:"ignoreParent,omitempty"`
+}
+
+// Rule matches requests by what is known of them as they arrive. Empty
+// fields match any request.
+type Rule struct {
+	Method     string `json:"method,omitempty"`
+	PathPrefix string `json:"pathPrefix,omitempty"`
+	// Header matches requests carrying it, like X-Debug
+	Header string  `json:"header,omitempty"`
+	Rate   float64 `json:"rate"`
+}
+
+// Validate checks the rates are shares.
+func (p *Policy) Validate() error {
+	if p == nil {
+		return nil
+	}
+	if p.Rate != nil && (*p.Rate < 0 || *p.Rate > 1) {
+		return fmt.Errorf("rate must be from 0 to 1")
+	}
+	for i, rule := range p.Rules {
+		if rule.Rate < 0 || rule.Rate > 1 {
+			return fmt.Errorf("rule %d: rate must be from 0 to 1", i)
+		}
+		if rule.Method != "" && strings.ToUpper(rule.Method) != rule.Method {
+			return fmt.Errorf("rule %d: method must be upper case", i)
+		}
+	}
+	return nil
+}
+
+// IsZero reports whether the policy sets nothing.
+func (p *Policy) IsZero() bool {
+	return p == nil || (p.Rate == nil && len(p.Rules) == 0 && !p.IgnoreParent)
+}
+
+// Decision is whether a request's trace is sampled and why.
+type Decision struct {
+	Sampled bool `json:"sampled"`
+	// Reason is "parent", "rule" or "rate"
+	Reason string `json:"reason"`
+	// Rule is the index of the rule that decided
+	Rule int `json:"rule,omitempty"`
+}
+
+// Decide samples r's trace: by the caller's decision when r arrived with a
+// trace, unless the policy ignores it, otherwise by the first rule matching
+// r or the policy's rate, falling back to rate. The decision is a function
+// of the trace ID, so every service seeing a trace at the same rate agrees
+// on it.
+func (p *Policy) Decide(r *http.Request, parent TraceContext, hasParent bool, rate float64) Decision {
+	if hasParent && (p == nil || !p.IgnoreParent) {
+		return Decision{Sampled: parent.Sampled(), Reason: "parent"}
+	}
+	if p != nil {
+		for i, rule := range p.Rules {
+			if rule.matches(r) {
+				return Decision{Sampled: sampled(parent.TraceID, rule.Rate), Reason: "rule", Rule: i}
+			}
+		}
+		if p.Rate != nil {
+			rate = *p.Rate
+		}
+	}
+	return Decision{Sampled: sampled(parent.TraceID, rate), Reason: "rate"}
+}
+
+func (rule Rule) matches(r *http.Request) bool {
+	return (rule.Method == "" || rule.Method == r.Method) &&
+		strings.HasPrefix(r.URL.Path, rule.PathPrefix) &&
+		(rule.Header == "" || r.Header.Get(rule.Header) != "")
+}
+
+// sampled compares the trace ID's lower 63 bits with the rate's share of
+// them.
+func sampled(traceID [16]byte, rate float64) bool {
+	if rate >= 1 {
+		return true
+	}
+	if rate <= 0 {
+		return false
+	}
+	return binary.BigEndian.Uint64(traceID[8:])>>1 < uint64(rate*(1<<63))
+}
@@ -0,0 +1,98 @@
+package tracing
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParse(t *testing.T) {
+	header := "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+	tc, ok := Parse(header)
+	require.True(t, ok)
+	assert.True(t, tc.Sampled())
+	assert.Equal(t, header, tc.String())
+
+	// Later versions may carry more fields
+	_, ok = Parse("01-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00-extra")
+	assert.True(t, ok)
+
+	for _, invalid := range []string{
+		"",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-extra",
+		"ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+		"00-00000000000000000000000000000000-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-0000000000000000-01",
+		"00-4BF92F3577B34DA6A3CE929D0E0E4736-00f067aa0ba902b7-01",
+		"zz-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+	} {
+		_, ok := Parse(invalid)
+		assert.False(t, ok, invalid)
+	}
+}
+
+func TestTraceContext_Child(t *testing.T) {
+	parent := New()
+	child := parent.Child(true)
+	assert.Equal(t, parent.TraceID, child.TraceID)
+	assert.NotEqual(t, parent.SpanID, child.SpanID)
+	assert.True(t, child.Sampled())
+	assert.False(t, parent.Child(false).Sampled())
+}
+
+func TestPolicy_Decide(t *testing.T) {
+	get := httptest.NewRequest(http.MethodGet, "/orders/1", nil)
+	debug := httptest.NewRequest(http.MethodPost, "/orders", nil)
+	debug.Header.Set("X-Debug", "1")
+	low, _ := Parse("00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00")
+	low.TraceID = [16]byte{}
+	high := low
+	for i := 8; i < 16; i++ {
+		high.TraceID[i] = 0xff
+	}
+
+	// Without a policy the service's rate applies
+	var none *Policy
+	assert.Equal(t, Decision{Sampled: true, Reason: "rate"}, none.Decide(get, low, false, 0.01))
+	assert.Equal(t, Decision{Sampled: false, Reason: "rate"}, none.Decide(get, high, false, 0.01))
+
+	rate := 0.0
+	p := &Policy{Rate: &rate, Rules: []Rule{
+		{Header: "X-Debug", Rate: 1},
+		{Method: http.MethodGet, PathPrefix: "/orders", Rate: 0.5},
+	}}
+	require.NoError(t, p.Validate())
+	assert.Equal(t, Decision{Sampled: true, Reason: "rule"}, p.Decide(debug, high, false, 1))
+	assert.Equal(t, Decision{Sampled: false, Reason: "rule", Rule: 1}, p.Decide(get, high, false, 1))
+	assert.Equal(t, Decision{Sampled: false, Reason: "rate"}, p.Decide(httptest.NewRequest(http.MethodPost, "/", nil), low, false, 1))
+
+	// Callers' decisions are followed unless the policy ignores them
+	sampledParent := high
+	sampledParent.Flags = flagSampled
+	assert.Equal(t, Decision{Sampled: true, Reason: "parent"}, p.Decide(get, sampledParent, true, 0))
+	p.IgnoreParent = true
+	assert.Equal(t, Decision{Sampled: false, Reason: "rule", Rule: 1}, p.Decide(get, sampledParent, true, 0))
+}
+
+func TestSampled_Rate(t *testing.T) {
+	n := 0
+	for i := 0; i < 10000; i++ {
+		if sampled(New().TraceID, 0.1) {
+			n++
+		}
+	}
+	assert.InDelta(t, 1000, n, 200)
+}
+
+func TestPolicy_Validate(t *testing.T) {
+	over, under := 1.5, -0.1
+	assert.ErrorContains(t, (&Policy{Rate: &over}).Validate(), "rate must be from 0 to 1")
+	assert.ErrorContains(t, (&Policy{Rate: &under}).Validate(), "rate must be from 0 to 1")
+	assert.ErrorContains(t, (&Policy{Rules: []Rule{{Rate: 2}}}).Validate(), "rule 0")
+	assert.ErrorContains(t, (&Policy{Rules: []Rule{{Method: "get", Rate: 1}}}).Validate(), "upper case")
+	assert.True(t, (&Policy{}).IsZero())
+}
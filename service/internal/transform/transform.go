@@ -0,0 +1,149 @@
+// Package transform reshapes requests into events and responses back with
+// Go templates, so a function can serve clients expecting a different
+// contract than its handler's without changing its code.
+package transform
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+	"text/template"
+)
+
+// funcs are available in templates on top of the builtins
+var funcs = template.FuncMap{
+	// json encodes a value, like a string from the request, as JSON
+	"json": func(v any) (string, error) {
+		data, err := json.Marshal(v)
+		return string(data), err
+	},
+	// default is the fallback when the value is missing or empty
+	"default": func(fallback, v any) any {
+		if v == nil {
+			return fallback
+		}
+		if rv := reflect.ValueOf(v); rv.IsZero() {
+			return fallback
+		}
+		return v
+	},
+	// get looks up a dotted path like "user.name" or "items.0.id", nil when
+	// any part is missing, where chaining fields would fail the template
+	"get": func(v any, path string) any {
+		for _, part := range strings.Split(path, ".") {
+			switch c := v.(type) {
+			case map[string]any:
+				v = c[part]
+			case []any:
+				i, err := strconv.Atoi(part)
+				if err != nil || i < 0 || i >= len(c) {
+					return nil
+				}
+				v = c[i]
+			default:
+				return nil
+			}
+		}
+		return v
+	},
+}
+
+// Request is what a request template renders the event body from.
+type Request struct {
+	Method  string
+	Path    string
+	Headers map[string]string
+	Query   map[string]string
+	// Body is the request body decoded as JSON, nil when it isn't JSON
+	Body    any
+	RawBody string
+}
+
+// Response is what a response template renders the response body from.
+type Response struct {
+	StatusCode int
+	Headers    map[string]string
+	// Body is the handler's body decoded as JSON, nil when it isn't JSON
+	Body    any
+	RawBody string
+}
+
+// Transform is a compiled pair of templates, either may be unset.
+type Transform struct {
+	request  *template.Template
+	response *template.Template
+}
+
+// Compile parses the request and response templates, empty ones leaving
+// that direction as it is.
+func Compile(request, response string) (*Transform, error) {
+	t := &Transform{}
+	var err error
+	if request != "" {
+		if t.request, err = parse("request", request); err != nil {
+			return nil, err
+		}
+	}
+	if response != "" {
+		if t.response, err = parse("response", response); err != nil {
+			return nil, err
+		}
+	}
+	return t, nil
+}
+
+func parse(name, text string) (*template.Template, error) {
+	tmpl, err := template.New(name).Funcs(funcs).Option("missingkey=zero").Parse(text)
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s template: %w", name, err)
+	}
+	return tmpl, nil
+}
+
+// HasRequest and HasResponse say which directions are transformed
+func (t *Transform) HasRequest() bool  { return t != nil && t.request != nil }
+func (t *Transform) HasResponse() bool { return t != nil && t.response != nil }
+
+// NewRequest describes a request for a template, decoding its body as JSON
+// when it is.
+func NewRequest(method, path string, headers, query map[string]string, body []byte) Request {
+	return Request{Method: method, Path: path, Headers: headers, Query: query, Body: decode(body), RawBody: string(body)}
+}
+
+// NewResponse describes a handler's response for a template.
+func NewResponse(statusCode int, headers map[string]string, body []byte) Response {
+	return Response{StatusCode: statusCode, Headers: headers, Body: decode(body), RawBody: string(body)}
+}
+
+func decode(body []byte) any {
+	var v any
+	if err := json.Unmarshal(body, &v); err != nil {
+		return nil
+	}
+	return v
+}
+
+// Request renders the event body for req, which must be a JSON object.
+func (t *Transform) Request(req Request) (map[string]any, error) {
+	var buf bytes.Buffer
+	if err := t.request.Execute(&buf, req); err != nil {
+		return nil, fmt.Errorf("failed to render request: %w", err)
+	}
+	var body map[string]any
+	if err := json.Unmarshal(buf.Bytes(), &body); err != nil {
+		return nil, fmt.Errorf("request template didn't render a JSON object: %w", err)
+	}
+	return body, nil
+}
+
+// Response renders the body returned for resp, as is.
+func (t *Transform) Response(resp Response) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := t.response.Execute(&buf, resp); err != nil {
+		return nil, fmt.Errorf("failed to render response: %w", err)
+	}
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,55 @@
+package transform
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTransform_Request(t *testing.T) {
+	tr, err := Compile(`{"name": {{json (get .Body "user.first")}}, "lang": {{json (default "en" .Query.lang)}}, "via": {{json .Headers.Via}}}`, "")
+	require.NoError(t, err)
+	assert.True(t, tr.HasRequest())
+	assert.False(t, tr.HasResponse())
+
+	req := NewRequest("POST", "/functions/hello", map[string]string{"Via": "legacy"}, map[string]string{}, []byte(`{"user": {"first": "Ada \"the\" first"}}`))
+	body, err := tr.Request(req)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]any{"name": `Ada "the" first`, "lang": "en", "via": "legacy"}, body)
+
+	// Missing fields render as null rather than failing
+	body, err = tr.Request(NewRequest("POST", "/", nil, map[string]string{"lang": "fr"}, []byte("not json")))
+	require.NoError(t, err)
+	assert.Equal(t, map[string]any{"name": nil, "lang": "fr", "via": ""}, body)
+
+	broken, err := Compile(`[{{json .Body}}]`, "")
+	require.NoError(t, err)
+	_, err = broken.Request(NewRequest("POST", "/", nil, nil, []byte(`{}`)))
+	assert.ErrorContains(t, err, "JSON object")
+}
+
+func TestTransform_Response(t *testing.T) {
+	tr, err := Compile("", `{"ok": {{if lt .StatusCode 400}}true{{else}}false{{end}}, "greeting": {{json (get .Body "messages.0.text")}}}`)
+	require.NoError(t, err)
+
+	body, err := tr.Response(NewResponse(http.StatusOK, nil, []byte(`{"messages": [{"text": "hi"}]}`)))
+	require.NoError(t, err)
+	assert.JSONEq(t, `{"ok": true, "greeting": "hi"}`, string(body))
+
+	body, err = tr.Response(NewResponse(http.StatusNotFound, nil, []byte(`oops`)))
+	require.NoError(t, err)
+	assert.JSONEq(t, `{"ok": false, "greeting": null}`, string(body))
+}
+
+func TestCompile(t *testing.T) {
+	_, err := Compile(`{{.Body`, "")
+	assert.ErrorContains(t, err, "invalid request template")
+	_, err = Compile("", `{{nope}}`)
+	assert.ErrorContains(t, err, "invalid response template")
+
+	tr, err := Compile("", "")
+	require.NoError(t, err)
+	assert.False(t, tr.HasRequest())
+}
@@ -0,0 +1,126 @@
+package usage
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+)
+
+// month is what monthly projections are for
+const month = 30 * 24 * time.Hour
+
+// Memory suggestions are only made when the peak is below half the limit,
+// and leave half the peak again as headroom in steps of 64MB
+const (
+	suggestBelow     = 0.5
+	suggestHeadroom  = 1.5
+	memoryStepMB     = 64
+	minSuggestMemory = 128
+)
+
+// Pricing turns usage into cost, costs are left out when both are 0.
+type Pricing struct {
+	PerGBSecond           float64 `json:"perGbSecond"`
+	PerMillionInvocations float64 `json:"perMillionInvocations"`
+}
+
+// PricingFromEnv reads KAPPA_PRICE_PER_GB_SECOND and
+// KAPPA_PRICE_PER_MILLION_INVOCATIONS.
+func PricingFromEnv() (Pricing, error) {
+	var p Pricing
+	for name, value := range map[string]*float64{
+		"KAPPA_PRICE_PER_GB_SECOND":           &p.PerGBSecond,
+		"KAPPA_PRICE_PER_MILLION_INVOCATIONS": &p.PerMillionInvocations,
+	} {
+		if v := os.Getenv(name); v != "" {
+			price, err := strconv.ParseFloat(v, 64)
+			if err != nil || price < 0 {
+				return p, fmt.Errorf("invalid %s %q", name, v)
+			}
+			*value = price
+		}
+	}
+	return p, nil
+}
+
+func (p Pricing) cost(invocations, gbSeconds float64) *float64 {
+	if p.PerGBSecond == 0 && p.PerMillionInvocations == 0 {
+		return nil
+	}
+	cost := gbSeconds*p.PerGBSecond + invocations/1e6*p.PerMillionInvocations
+	return &cost
+}
+
+// Estimate projects a function's usage over a month from its usage over a
+// recent window, at its current memory limit.
+type Estimate struct {
+	Window      string `json:"window"`
+	Invocations int64  `json:"invocations"`
+	// AvgDurationMs is the mean duration of the invocations in the window
+	AvgDurationMs float64 `json:"avgDurationMs"`
+	// MemoryMB is the memory invocations are billed for
+	MemoryMB int `json:"memoryMb"`
+	// PeakMemoryMB is the most memory an instance was seen using, 0 when
+	// the backend can't tell
+	PeakMemoryMB       int         `json:"peakMemoryMb"`
+	MonthlyInvocations float64     `json:"monthlyInvocations"`
+	MonthlyGBSeconds   float64     `json:"monthlyGbSeconds"`
+	MonthlyCost        *float64    `json:"monthlyCost,omitempty"`
+	Suggestion         *Suggestion `json:"suggestion,omitempty"`
+}
+
+// Suggestion is a lower memory limit the function would likely fit in.
+type Suggestion struct {
+	MemoryMB         int      `json:"memoryMb"`
+	MonthlyGBSeconds float64  `json:"monthlyGbSeconds"`
+	MonthlyCost      *float64 `json:"monthlyCost,omitempty"`
+	Reason           string   `json:"reason"`
+}
+
+// Estimate projects the function's monthly usage from its usage over the
+// last window, billing it for memoryMB, or the meter's default when 0. The
+// projection assumes durations don't change with the memory limit.
+func (m *Meter) Estimate(function string, window time.Duration, memoryMB int, pricing Pricing) Estimate {
+	if memoryMB <= 0 {
+		memoryMB = m.defaultMemoryMB
+	}
+	now := m.now()
+	rows := m.Query(Query{From: now.Add(-window), To: now, Function: function})
+
+	var invocations, durationMs int64
+	peak := 0
+	for _, row := range rows {
+		invocations += row.Invocations
+		durationMs += row.DurationMs
+		peak = max(peak, row.PeakMemoryMB)
+	}
+
+	scale := float64(month) / float64(window)
+	seconds := float64(durationMs) / 1000 * scale
+	e := Estimate{
+		Window:             window.String(),
+		Invocations:        invocations,
+		MemoryMB:           memoryMB,
+		PeakMemoryMB:       peak,
+		MonthlyInvocations: float64(invocations) * scale,
+		MonthlyGBSeconds:   seconds * float64(memoryMB) / 1024,
+	}
+	if invocations > 0 {
+		e.AvgDurationMs = float64(durationMs) / float64(invocations)
+	}
+	e.MonthlyCost = pricing.cost(e.MonthlyInvocations, e.MonthlyGBSeconds)
+
+	if peak > 0 && float64(peak) < float64(memoryMB)*suggestBelow {
+		if suggested := sizeFor(peak); suggested < memoryMB {
+			gbSeconds := seconds * float64(suggested) / 1024
+			e.Suggestion = &Suggestion{
+				MemoryMB:         suggested,
+				MonthlyGBSeconds: gbSeconds,
+				MonthlyCost:      pricing.cost(e.MonthlyInvocations, gbSeconds),
+				Reason:           fmt.Sprintf("peak usage of %dMB over the last %s is under half the %dMB limit", peak, window, memoryMB),
+			}
+		}
+	}
+	return e
+}
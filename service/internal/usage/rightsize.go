@@ -0,0 +1,119 @@
+package usage
+
+import (
+	"fmt"
+	"sort"
+)
+
+// Right-sizing goes by the most recent peaks of a function once it has
+// enough of them, and raises limits the p99 is over 90% of
+const (
+	peakSamples = 1000
+	minSamples  = 20
+	raiseAbove  = 0.9
+)
+
+// peakRing holds the most recent peak memory samples of a function.
+type peakRing struct {
+	samples []int
+	next    int
+}
+
+func (r *peakRing) add(mb int) {
+	if len(r.samples) < peakSamples {
+		r.samples = append(r.samples, mb)
+		return
+	}
+	r.samples[r.next] = mb
+	r.next = (r.next + 1) % peakSamples
+}
+
+// Bounds limit what right-sizing recommends, 0 leaving that side open.
+type Bounds struct {
+	MinMB int `json:"minMb,omitempty"`
+	MaxMB int `json:"maxMb,omitempty"`
+}
+
+// Validate checks the bounds are usable.
+func (b Bounds) Validate() error {
+	if b.MinMB < 0 || b.MaxMB < 0 {
+		return fmt.Errorf("bounds must not be negative")
+	}
+	if b.MaxMB > 0 && b.MinMB > b.MaxMB {
+		return fmt.Errorf("minMb %d is above maxMb %d", b.MinMB, b.MaxMB)
+	}
+	return nil
+}
+
+func (b Bounds) clamp(mb int) int {
+	if b.MinMB > 0 {
+		mb = max(mb, b.MinMB)
+	}
+	if b.MaxMB > 0 {
+		mb = min(mb, b.MaxMB)
+	}
+	return mb
+}
+
+// Recommendation is a memory limit sized to the peaks a function's
+// instances were seen at.
+type Recommendation struct {
+	Function string `json:"function"`
+	// Samples is how many invocations the percentiles are over, each
+	// sampling its instance's peak so far
+	Samples   int `json:"samples"`
+	P50PeakMB int `json:"p50PeakMb"`
+	P99PeakMB int `json:"p99PeakMb"`
+	MaxPeakMB int `json:"maxPeakMb"`
+	LimitMB   int `json:"limitMb"`
+	// RecommendedMB is the limit to change to, 0 when the current one fits
+	RecommendedMB int    `json:"recommendedMb,omitempty"`
+	Reason        string `json:"reason"`
+}
+
+// sizeFor is the limit fitting a peak with headroom, in steps of 64MB.
+func sizeFor(peakMB int) int {
+	mb := int(float64(peakMB) * suggestHeadroom)
+	return max((mb+memoryStepMB-1)/memoryStepMB*memoryStepMB, minSuggestMemory)
+}
+
+// Recommend sizes the function's memory limit to the p99 of its recent
+// peaks within bounds, recommending a lower limit when the p99 is under half
+// of limitMB and a higher one when it is close to it. A limitMB of 0 is the
+// meter's default.
+func (m *Meter) Recommend(function string, limitMB int, bounds Bounds) Recommendation {
+	if limitMB <= 0 {
+		limitMB = m.defaultMemoryMB
+	}
+	rec := Recommendation{Function: function, LimitMB: limitMB}
+
+	m.mu.Lock()
+	var samples []int
+	if ring, ok := m.peaks[function]; ok {
+		samples = append(samples, ring.samples...)
+	}
+	m.mu.Unlock()
+
+	rec.Samples = len(samples)
+	if rec.Samples < minSamples {
+		rec.Reason = fmt.Sprintf("%d of the %d invocations with memory stats needed so far", rec.Samples, minSamples)
+		return rec
+	}
+	sort.Ints(samples)
+	rec.P50PeakMB = samples[(len(samples)-1)*50/100]
+	rec.P99PeakMB = samples[(len(samples)-1)*99/100]
+	rec.MaxPeakMB = samples[len(samples)-1]
+
+	sized := bounds.clamp(sizeFor(rec.P99PeakMB))
+	switch {
+	case float64(rec.P99PeakMB) < float64(limitMB)*suggestBelow && sized < limitMB:
+		rec.RecommendedMB = sized
+		rec.Reason = fmt.Sprintf("p99 peak %dMB, limit %dMB, consider %dMB", rec.P99PeakMB, limitMB, sized)
+	case float64(rec.P99PeakMB) > float64(limitMB)*raiseAbove && sized > limitMB:
+		rec.RecommendedMB = sized
+		rec.Reason = fmt.Sprintf("p99 peak %dMB is close to the %dMB limit, consider %dMB", rec.P99PeakMB, limitMB, sized)
+	default:
+		rec.Reason = fmt.Sprintf("p99 peak %dMB fits the %dMB limit", rec.P99PeakMB, limitMB)
+	}
+	return rec
+}
@@ -0,0 +1,338 @@
+// Package usage meters what functions and projects use, invocations,
+// GB-seconds and egress, so platform teams can charge it back to the teams
+// owning them.
+package usage
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"kappa-v2/service/internal/kappa"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Resolution is the granularity usage is kept at, windows are rounded to it
+const Resolution = time.Minute
+
+// Defaults of a meter
+const (
+	DefaultRetention = 35 * 24 * time.Hour
+	DefaultMemoryMB  = 128
+)
+
+// GroupBy is what usage is totalled per.
+type GroupBy string
+
+const (
+	ByFunction GroupBy = "function"
+	ByProject  GroupBy = "project"
+)
+
+// ParseGroupBy returns the grouping named name, an empty name being
+// ByFunction.
+func ParseGroupBy(name string) (GroupBy, error) {
+	switch GroupBy(name) {
+	case "", ByFunction:
+		return ByFunction, nil
+	case ByProject:
+		return ByProject, nil
+	}
+	return "", fmt.Errorf("unknown grouping %q, expected function or project", name)
+}
+
+// key is a function as metered, in the project it was in at the time
+type key struct {
+	function, project string
+}
+
+// totals are the usage of one key over some time.
+type totals struct {
+	Invocations int64
+	Errors      int64
+	DurationMs  int64
+	GBSeconds   float64
+	EgressBytes int64
+	// PeakMemoryMB is the most memory an instance was seen using
+	PeakMemoryMB int
+}
+
+func (t *totals) add(o totals) {
+	t.Invocations += o.Invocations
+	t.Errors += o.Errors
+	t.DurationMs += o.DurationMs
+	t.GBSeconds += o.GBSeconds
+	t.EgressBytes += o.EgressBytes
+	t.PeakMemoryMB = max(t.PeakMemoryMB, o.PeakMemoryMB)
+}
+
+// Meter keeps usage in buckets of Resolution for the retention period.
+type Meter struct {
+	mu        sync.Mutex
+	buckets   map[key]map[int64]*totals
+	retention time.Duration
+	// defaultMemoryMB is what invocations of functions without a memory
+	// limit are billed for
+	defaultMemoryMB int
+	// peaks are each function's most recent peak memory samples
+	peaks  map[string]*peakRing
+	pruned time.Time
+	now    func() time.Time
+}
+
+// NewMeter creates a meter keeping usage for retention.
+func NewMeter(retention time.Duration, defaultMemoryMB int) *Meter {
+	return &Meter{
+		buckets:         make(map[key]map[int64]*totals),
+		peaks:           make(map[string]*peakRing),
+		retention:       retention,
+		defaultMemoryMB: defaultMemoryMB,
+		now:             time.Now,
+	}
+}
+
+// FromEnv creates a meter keeping usage for KAPPA_USAGE_RETENTION_DAYS,
+// billing functions without a memory limit for KAPPA_USAGE_DEFAULT_MEMORY_MB.
+func FromEnv() (*Meter, error) {
+	retention, memory := DefaultRetention, DefaultMemoryMB
+	if v := os.Getenv("KAPPA_USAGE_RETENTION_DAYS"); v != "" {
+		days, err := strconv.Atoi(v)
+		if err != nil || days < 1 {
+			return nil, fmt.Errorf("invalid KAPPA_USAGE_RETENTION_DAYS %q", v)
+		}
+		retention = time.Duration(days) * 24 * time.Hour
+	}
+	if v := os.Getenv("KAPPA_USAGE_DEFAULT_MEMORY_MB"); v != "" {
+		mb, err := strconv.Atoi(v)
+		if err != nil || mb < 1 {
+			return nil, fmt.Errorf("invalid KAPPA_USAGE_DEFAULT_MEMORY_MB %q", v)
+		}
+		memory = mb
+	}
+	return NewMeter(retention, memory), nil
+}
+
+// Recorder returns a recorder metering functions in project.
+func (m *Meter) Recorder(project string) kappa.UsageRecorder {
+	return recorder{meter: m, project: project}
+}
+
+type recorder struct {
+	meter   *Meter
+	project string
+}
+
+func (r recorder) RecordUsage(u kappa.Usage) {
+	r.meter.Record(r.project, u)
+}
+
+// Record adds an invocation of a function in project.
+func (m *Meter) Record(project string, u kappa.Usage) {
+	memoryMB := u.MemoryMB
+	if memoryMB <= 0 {
+		memoryMB = m.defaultMemoryMB
+	}
+	t := totals{
+		Invocations:  1,
+		DurationMs:   u.Duration.Milliseconds(),
+		GBSeconds:    float64(memoryMB) / 1024 * u.Duration.Seconds(),
+		EgressBytes:  int64(u.EgressBytes),
+		PeakMemoryMB: u.PeakMemoryMB,
+	}
+	if u.Failed {
+		t.Errors = 1
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	k := key{function: u.Function, project: project}
+	buckets, ok := m.buckets[k]
+	if !ok {
+		buckets = make(map[int64]*totals)
+		m.buckets[k] = buckets
+	}
+	bucket := u.Started.Truncate(Resolution).Unix()
+	if buckets[bucket] == nil {
+		buckets[bucket] = &totals{}
+	}
+	buckets[bucket].add(t)
+	if u.PeakMemoryMB > 0 {
+		ring, ok := m.peaks[u.Function]
+		if !ok {
+			ring = &peakRing{}
+			m.peaks[u.Function] = ring
+		}
+		ring.add(u.PeakMemoryMB)
+	}
+
+	if now := m.now(); now.Sub(m.pruned) > time.Hour {
+		m.prune(now)
+	}
+}
+
+// prune drops buckets older than the retention period.
+func (m *Meter) prune(now time.Time) {
+	oldest := now.Add(-m.retention).Unix()
+	for k, buckets := range m.buckets {
+		for bucket := range buckets {
+			if bucket < oldest {
+				delete(buckets, bucket)
+			}
+		}
+		if len(buckets) == 0 {
+			delete(m.buckets, k)
+		}
+	}
+	m.pruned = now
+}
+
+// Query is a window of usage to total.
+type Query struct {
+	From, To time.Time
+	GroupBy  GroupBy
+	// Interval splits the window into intervals totalled on their own, 0
+	// totals the whole window
+	Interval time.Duration
+	// Function and Project only include usage of that function or project
+	Function, Project string
+}
+
+// Validate checks the window and interval are usable.
+func (q Query) Validate() error {
+	if !q.To.After(q.From) {
+		return fmt.Errorf("the window must end after it starts")
+	}
+	if q.Interval < 0 || q.Interval%Resolution != 0 {
+		return fmt.Errorf("interval must be a whole number of minutes")
+	}
+	if q.Interval > 0 && q.To.Sub(q.From)/q.Interval > 10000 {
+		return fmt.Errorf("the window spans more than 10000 intervals")
+	}
+	return nil
+}
+
+// Row is the usage of a function or project over an interval.
+type Row struct {
+	From        time.Time `json:"from"`
+	To          time.Time `json:"to"`
+	Project     string    `json:"project"`
+	Function    string    `json:"function,omitempty"`
+	Invocations int64     `json:"invocations"`
+	Errors      int64     `json:"errors"`
+	DurationMs  int64     `json:"durationMs"`
+	GBSeconds   float64   `json:"gbSeconds"`
+	EgressBytes int64     `json:"egressBytes"`
+	// PeakMemoryMB is the most memory an instance was seen using, 0 when
+	// the backend can't tell
+	PeakMemoryMB int `json:"peakMemoryMb"`
+}
+
+// Query totals the usage in the window, rounded out to Resolution, ordered
+// by interval, project and function. Keys without usage are left out.
+func (m *Meter) Query(q Query) []Row {
+	from, to := q.From.Truncate(Resolution), q.To.Truncate(Resolution)
+	if !q.To.Equal(to) {
+		to = to.Add(Resolution)
+	}
+	interval := q.Interval
+	if interval == 0 {
+		interval = to.Sub(from)
+	}
+
+	type rowKey struct {
+		key
+		interval int64
+	}
+	rows := make(map[rowKey]*Row)
+
+	m.mu.Lock()
+	for k, buckets := range m.buckets {
+		if (q.Function != "" && k.function != q.Function) || (q.Project != "" && k.project != q.Project) {
+			continue
+		}
+		grouped := k
+		if q.GroupBy == ByProject {
+			grouped.function = ""
+		}
+		for bucket, t := range buckets {
+			started := time.Unix(bucket, 0)
+			if started.Before(from) || !started.Before(to) {
+				continue
+			}
+			i := int64(started.Sub(from) / interval)
+			rk := rowKey{key: grouped, interval: i}
+			row, ok := rows[rk]
+			if !ok {
+				start := from.Add(time.Duration(i) * interval)
+				end := start.Add(interval)
+				if end.After(to) {
+					end = to
+				}
+				row = &Row{
+					From:     start,
+					To:       end,
+					Project:  grouped.project,
+					Function: grouped.function,
+				}
+				rows[rk] = row
+			}
+			row.Invocations += t.Invocations
+			row.Errors += t.Errors
+			row.DurationMs += t.DurationMs
+			row.GBSeconds += t.GBSeconds
+			row.EgressBytes += t.EgressBytes
+			row.PeakMemoryMB = max(row.PeakMemoryMB, t.PeakMemoryMB)
+		}
+	}
+	m.mu.Unlock()
+
+	result := make([]Row, 0, len(rows))
+	for _, row := range rows {
+		result = append(result, *row)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		a, b := result[i], result[j]
+		if !a.From.Equal(b.From) {
+			return a.From.Before(b.From)
+		}
+		if a.Project != b.Project {
+			return a.Project < b.Project
+		}
+		return a.Function < b.Function
+	})
+	return result
+}
+
+// WriteCSV writes rows as CSV with a header, leaving out the function
+// column when usage is grouped by project.
+func WriteCSV(w io.Writer, rows []Row, groupBy GroupBy) error {
+	cw := csv.NewWriter(w)
+	header := []string{"from", "to", "project", "function", "invocations", "errors", "durationMs", "gbSeconds", "egressBytes", "peakMemoryMb"}
+	if groupBy == ByProject {
+		header = append(header[:3], header[4:]...)
+	}
+	cw.Write(header)
+	for _, row := range rows {
+		record := []string{
+			row.From.UTC().Format(time.RFC3339),
+			row.To.UTC().Format(time.RFC3339),
+			row.Project,
+			row.Function,
+			strconv.FormatInt(row.Invocations, 10),
+			strconv.FormatInt(row.Errors, 10),
+			strconv.FormatInt(row.DurationMs, 10),
+			strconv.FormatFloat(row.GBSeconds, 'f', 3, 64),
+			strconv.FormatInt(row.EgressBytes, 10),
+			strconv.Itoa(row.PeakMemoryMB),
+		}
+		if groupBy == ByProject {
+			record = append(record[:3], record[4:]...)
+		}
+		cw.Write(record)
+	}
+	cw.Flush()
+	return cw.Error()
+}
@@ -0,0 +1,161 @@
+package usage
+
+import (
+	"bytes"
+	"kappa-v2/service/internal/kappa"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMeter_Query(t *testing.T) {
+	start := time.Date(2024, 3, 1, 10, 0, 0, 0, time.UTC)
+	m := NewMeter(DefaultRetention, 256)
+	m.now = func() time.Time { return start.Add(2 * time.Hour) }
+
+	shop := m.Recorder("shop")
+	shop.RecordUsage(kappa.Usage{Function: "cart", Started: start.Add(5 * time.Minute), Duration: 2 * time.Second, MemoryMB: 1024, EgressBytes: 100})
+	shop.RecordUsage(kappa.Usage{Function: "cart", Started: start.Add(65 * time.Minute), Duration: time.Second, MemoryMB: 512, Failed: true})
+	shop.RecordUsage(kappa.Usage{Function: "search", Started: start.Add(10 * time.Minute), Duration: 4 * time.Second, EgressBytes: 50})
+	m.Recorder("").RecordUsage(kappa.Usage{Function: "cron", Started: start.Add(-time.Hour), Duration: time.Second})
+
+	rows := m.Query(Query{From: start, To: start.Add(2 * time.Hour), GroupBy: ByFunction})
+	assert.Equal(t, []Row{
+		{From: start, To: start.Add(2 * time.Hour), Project: "shop", Function: "cart", Invocations: 2, Errors: 1, DurationMs: 3000, GBSeconds: 2.5, EgressBytes: 100},
+		{From: start, To: start.Add(2 * time.Hour), Project: "shop", Function: "search", Invocations: 1, DurationMs: 4000, GBSeconds: 1, EgressBytes: 50},
+	}, rows, "functions without a memory limit are billed the default")
+
+	rows = m.Query(Query{From: start, To: start.Add(2 * time.Hour), GroupBy: ByProject, Interval: time.Hour})
+	assert.Equal(t, []Row{
+		{From: start, To: start.Add(time.Hour), Project: "shop", Invocations: 2, DurationMs: 6000, GBSeconds: 3, EgressBytes: 150},
+		{From: start.Add(time.Hour), To: start.Add(2 * time.Hour), Project: "shop", Invocations: 1, Errors: 1, DurationMs: 1000, GBSeconds: 0.5},
+	}, rows)
+
+	rows = m.Query(Query{From: start.Add(-2 * time.Hour), To: start, Function: "cron"})
+	require.Len(t, rows, 1)
+	assert.Equal(t, "", rows[0].Project)
+	assert.Empty(t, m.Query(Query{From: start, To: start.Add(time.Hour), Project: "billing"}))
+}
+
+func TestMeter_Prune(t *testing.T) {
+	now := time.Date(2024, 3, 1, 10, 0, 0, 0, time.UTC)
+	m := NewMeter(24*time.Hour, DefaultMemoryMB)
+	m.now = func() time.Time { return now }
+	m.Record("", kappa.Usage{Function: "old", Started: now.Add(-48 * time.Hour)})
+	assert.Empty(t, m.buckets, "usage past the retention period is dropped")
+}
+
+func TestQuery_Validate(t *testing.T) {
+	now := time.Now()
+	assert.NoError(t, Query{From: now.Add(-time.Hour), To: now, Interval: time.Minute}.Validate())
+	assert.Error(t, Query{From: now, To: now}.Validate())
+	assert.Error(t, Query{From: now.Add(-time.Hour), To: now, Interval: time.Second}.Validate())
+	assert.Error(t, Query{From: now.Add(-365 * 24 * time.Hour), To: now, Interval: time.Minute}.Validate())
+}
+
+func TestWriteCSV(t *testing.T) {
+	from := time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC)
+	rows := []Row{{From: from, To: from.Add(time.Hour), Project: "shop", Function: "cart", Invocations: 2, DurationMs: 3000, GBSeconds: 2.5, EgressBytes: 100}}
+
+	var buf bytes.Buffer
+	require.NoError(t, WriteCSV(&buf, rows, ByFunction))
+	assert.Equal(t, "from,to,project,function,invocations,errors,durationMs,gbSeconds,egressBytes,peakMemoryMb\n"+
+		"2024-03-01T00:00:00Z,2024-03-01T01:00:00Z,shop,cart,2,0,3000,2.500,100,0\n", buf.String())
+
+	buf.Reset()
+	require.NoError(t, WriteCSV(&buf, rows, ByProject))
+	assert.Equal(t, "from,to,project,invocations,errors,durationMs,gbSeconds,egressBytes,peakMemoryMb\n"+
+		"2024-03-01T00:00:00Z,2024-03-01T01:00:00Z,shop,2,0,3000,2.500,100,0\n", buf.String())
+}
+
+func TestParseGroupBy(t *testing.T) {
+	g, err := ParseGroupBy("")
+	require.NoError(t, err)
+	assert.Equal(t, ByFunction, g)
+	_, err = ParseGroupBy("team")
+	assert.Error(t, err)
+}
+
+func TestMeter_Estimate(t *testing.T) {
+	now := time.Date(2024, 3, 8, 0, 0, 0, 0, time.UTC)
+	m := NewMeter(DefaultRetention, DefaultMemoryMB)
+	m.now = func() time.Time { return now }
+	for day := 1; day <= 7; day++ {
+		m.Record("shop", kappa.Usage{Function: "cart", Started: now.Add(-time.Duration(day) * 24 * time.Hour), Duration: 2 * time.Second, PeakMemoryMB: 100})
+	}
+
+	e := m.Estimate("cart", 7*24*time.Hour, 1024, Pricing{PerGBSecond: 0.001})
+	assert.Equal(t, int64(7), e.Invocations)
+	assert.Equal(t, 2000.0, e.AvgDurationMs)
+	assert.Equal(t, 100, e.PeakMemoryMB)
+	assert.InDelta(t, 30, e.MonthlyInvocations, 0.001)
+	assert.InDelta(t, 60, e.MonthlyGBSeconds, 0.001)
+	require.NotNil(t, e.MonthlyCost)
+	assert.InDelta(t, 0.06, *e.MonthlyCost, 0.0001)
+	require.NotNil(t, e.Suggestion)
+	assert.Equal(t, 192, e.Suggestion.MemoryMB, "the peak plus half again, in 64MB steps")
+	assert.InDelta(t, 11.25, e.Suggestion.MonthlyGBSeconds, 0.001)
+
+	e = m.Estimate("cart", 7*24*time.Hour, 192, Pricing{})
+	assert.Nil(t, e.Suggestion, "the peak isn't far enough below the limit")
+	assert.Nil(t, e.MonthlyCost)
+	assert.Equal(t, int64(0), m.Estimate("search", time.Hour, 0, Pricing{}).Invocations)
+}
+
+func TestMeter_Recommend(t *testing.T) {
+	m := NewMeter(DefaultRetention, DefaultMemoryMB)
+	record := func(function string, peaks ...int) {
+		for _, peak := range peaks {
+			m.Record("shop", kappa.Usage{Function: function, Started: time.Now(), Duration: time.Second, PeakMemoryMB: peak})
+		}
+	}
+	for i := 0; i < 99; i++ {
+		record("cart", 60+i%20)
+	}
+	record("cart", 84, 300)
+
+	rec := m.Recommend("cart", 512, Bounds{})
+	assert.Equal(t, 101, rec.Samples)
+	assert.Equal(t, 70, rec.P50PeakMB)
+	assert.Equal(t, 84, rec.P99PeakMB, "an outlier doesn't move the p99")
+	assert.Equal(t, 300, rec.MaxPeakMB)
+	assert.Equal(t, 128, rec.RecommendedMB)
+	assert.Equal(t, "p99 peak 84MB, limit 512MB, consider 128MB", rec.Reason)
+
+	assert.Equal(t, 256, m.Recommend("cart", 512, Bounds{MinMB: 256}).RecommendedMB)
+	assert.Zero(t, m.Recommend("cart", 512, Bounds{MinMB: 512}).RecommendedMB, "the bounds keep it at the limit")
+	assert.Zero(t, m.Recommend("cart", 160, Bounds{}).RecommendedMB, "the p99 fits the limit")
+
+	for i := 0; i < 30; i++ {
+		record("search", 240)
+	}
+	rec = m.Recommend("search", 256, Bounds{})
+	assert.Equal(t, 384, rec.RecommendedMB, "close to the limit")
+	assert.Equal(t, 320, m.Recommend("search", 256, Bounds{MaxMB: 320}).RecommendedMB)
+
+	record("new", 10)
+	rec = m.Recommend("new", 0, Bounds{})
+	assert.Equal(t, DefaultMemoryMB, rec.LimitMB)
+	assert.Zero(t, rec.RecommendedMB, "not enough samples")
+}
+
+func TestBounds_Validate(t *testing.T) {
+	assert.NoError(t, Bounds{}.Validate())
+	assert.NoError(t, Bounds{MinMB: 128, MaxMB: 1024}.Validate())
+	assert.Error(t, Bounds{MinMB: 512, MaxMB: 256}.Validate())
+	assert.Error(t, Bounds{MinMB: -1}.Validate())
+}
+
+func TestPricingFromEnv(t *testing.T) {
+	t.Setenv("KAPPA_PRICE_PER_GB_SECOND", "0.0000166667")
+	t.Setenv("KAPPA_PRICE_PER_MILLION_INVOCATIONS", "0.2")
+	p, err := PricingFromEnv()
+	require.NoError(t, err)
+	assert.Equal(t, Pricing{PerGBSecond: 0.0000166667, PerMillionInvocations: 0.2}, p)
+
+	t.Setenv("KAPPA_PRICE_PER_GB_SECOND", "-1")
+	_, err = PricingFromEnv()
+	assert.Error(t, err)
+}
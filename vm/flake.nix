@@ -18,5 +18,29 @@
         system = "x86_64-linux";
         modules = [ ./vm.nix ];
       };
+      nixosConfigurations.function = nixpkgs.lib.nixosSystem {
+        system = "x86_64-linux";
+        modules = [ ./function.nix ];
+      };
+      # Image used by the service's vm backend, point KAPPA_VM_IMAGE at the result
+      packages."x86_64-linux".function-image =
+        let
+          build = self.nixosConfigurations.function.config.system.build;
+          pkgs = nixpkgs.legacyPackages."x86_64-linux";
+        in
+        pkgs.linkFarm "kappa-function-image" [
+          {
+            name = "kernel";
+            path = "${build.kernel}/${build.kernel.target or "bzImage"}";
+          }
+          {
+            name = "initrd";
+            path = "${build.initialRamdisk}/initrd";
+          }
+          {
+            name = "system";
+            path = build.toplevel;
+          }
+        ];
     };
 }
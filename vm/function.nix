@@ -0,0 +1,68 @@
+# Generic image for kappa's vm backend (service/internal/kappa/backend_vm.go).
+# The service shares the function's directories over 9p along with a
+# "kappa" metadata share holding a mount list and start script.
+{
+  pkgs,
+  modulesPath,
+  ...
+}:
+{
+  imports = [ "${modulesPath}/virtualisation/qemu-vm.nix" ];
+
+  # Root on tmpfs, the host's /nix/store is shared in by the backend
+  virtualisation.diskImage = null;
+  virtualisation.graphics = false;
+
+  boot.initrd.availableKernelModules = [
+    "9p"
+    "9pnet_virtio"
+    "virtio_console"
+  ];
+
+  networking.hostName = "kappa-function";
+  networking.firewall.enable = false;
+  services.getty.autologinUser = null;
+  documentation.enable = false;
+
+  systemd.services.kappa-mounts = {
+    description = "Mount kappa function shares";
+    wantedBy = [ "multi-user.target" ];
+    before = [ "kappa-function.service" ];
+    path = [ pkgs.util-linux ];
+    serviceConfig = {
+      Type = "oneshot";
+      RemainAfterExit = true;
+    };
+    script = ''
+      opts=trans=virtio,version=9p2000.L,msize=104857600
+      mkdir -p /run/kappa
+      mount -t 9p -o $opts,ro kappa /run/kappa
+      while read -r tag dest mode; do
+        mkdir -p "$dest"
+        mount -t 9p -o $opts,$mode "$tag" "$dest"
+      done < /run/kappa/mounts
+    '';
+  };
+
+  systemd.services.kappa-function = {
+    description = "Kappa function";
+    wantedBy = [ "multi-user.target" ];
+    requires = [ "kappa-mounts.service" ];
+    after = [
+      "kappa-mounts.service"
+      "network-online.target"
+    ];
+    wants = [ "network-online.target" ];
+    serviceConfig = {
+      ExecStart = "${pkgs.bash}/bin/sh /run/kappa/start.sh";
+      # The virtio console is wired to qemu's stdout on the host
+      StandardOutput = "tty";
+      StandardError = "tty";
+      TTYPath = "/dev/hvc0";
+      # The function exiting ends the vm, like a container's task
+      ExecStopPost = "${pkgs.systemd}/bin/systemctl poweroff --no-block";
+    };
+  };
+
+  system.stateVersion = "25.05";
+}